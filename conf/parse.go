@@ -227,7 +227,11 @@ func (p *parser) processItem(it item, fp string) error {
 		setValue(it, p.popContext())
 	case itemString:
 		// FIXME(dlc) sanitize string?
-		setValue(it, it.val)
+		sv, err := p.interpolate(it.val)
+		if err != nil {
+			return fmt.Errorf("%v on line %d", err, it.line)
+		}
+		setValue(it, sv)
 	case itemInteger:
 		lastDigit := 0
 		for _, r := range it.val {
@@ -328,10 +332,18 @@ func (p *parser) processItem(it item, fp string) error {
 			m   map[string]interface{}
 			err error
 		)
+		// Relative includes are resolved from the including file.
+		ip, err := p.interpolate(it.val)
+		if err != nil {
+			return fmt.Errorf("%v on line %d", err, it.line)
+		}
+		if !filepath.IsAbs(ip) {
+			ip = filepath.Join(p.fp, ip)
+		}
 		if p.pedantic {
-			m, err = ParseFileWithChecks(filepath.Join(p.fp, it.val))
+			m, err = ParseFileWithChecks(ip)
 		} else {
-			m, err = ParseFile(filepath.Join(p.fp, it.val))
+			m, err = ParseFile(ip)
 		}
 		if err != nil {
 			return fmt.Errorf("error parsing include file '%s', %v", it.val, err)
@@ -370,14 +382,8 @@ func (p *parser) lookupVariable(varReference string) (interface{}, bool, error)
 	}
 
 	// Loop through contexts currently on the stack.
-	for i := len(p.ctxs) - 1; i >= 0; i-- {
-		ctx := p.ctxs[i]
-		// Process if it is a map context
-		if m, ok := ctx.(map[string]interface{}); ok {
-			if v, ok := m[varReference]; ok {
-				return v, ok, nil
-			}
-		}
+	if v, ok := p.lookupScopedVariable(varReference); ok {
+		return v, ok, nil
 	}
 
 	// If we are here, we have exhausted our context maps and still not found anything.
@@ -394,6 +400,62 @@ func (p *parser) lookupVariable(varReference string) (interface{}, bool, error)
 	return nil, false, nil
 }
 
+// interpolate replaces the ${name} references inside a string value. Names
+// are looked up using the same block scoping as variable references, with
+// environment variables used as is.
+func (p *parser) interpolate(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			break
+		}
+		name := s[start+2 : start+end]
+		v, found := p.lookupScopedVariable(name)
+		if !found {
+			var vStr string
+			if vStr, found = os.LookupEnv(name); found {
+				v = vStr
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("variable reference for '%s' can not be found", name)
+		}
+		if tk, ok := v.(*token); ok {
+			tk.usedVariable = true
+			v = tk.Value()
+		}
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", fmt.Errorf("variable reference for '%s' is not a simple value", name)
+		}
+		sb.WriteString(s[:start])
+		sb.WriteString(fmt.Sprint(v))
+		s = s[start+end+1:]
+	}
+	sb.WriteString(s)
+	return sb.String(), nil
+}
+
+// lookupScopedVariable looks up a variable in the map contexts on the stack.
+func (p *parser) lookupScopedVariable(varReference string) (interface{}, bool) {
+	for i := len(p.ctxs) - 1; i >= 0; i-- {
+		if m, ok := p.ctxs[i].(map[string]interface{}); ok {
+			if v, ok := m[varReference]; ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
 func (p *parser) setValue(val interface{}) {
 	// Test to see if we are on an array or a map
 
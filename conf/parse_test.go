@@ -2,7 +2,9 @@ package conf
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -359,3 +361,70 @@ func TestIncludeVariablesWithChecks(t *testing.T) {
 	expectKeyVal(t, m, "BOB_PASS", "$2a$11$dZM98SpGeI7dCFFGSpt.JObQcix8YHml4TBUZoge9R1uxnMIln5ly", 3, 1)
 	expectKeyVal(t, m, "CAROL_PASS", "foo", 6, 3)
 }
+
+func TestStringInterpolation(t *testing.T) {
+	evar := "__UNIQ22__"
+	os.Setenv(evar, "1mb")
+	defer os.Unsetenv(evar)
+
+	ex := map[string]interface{}{
+		"host": "example.com",
+		"port": int64(4222),
+		"url":  "nats://example.com:4222",
+		"size": "size-1mb",
+		"sys":  "$SYS.>",
+		"raw":  "${unterminated",
+	}
+	test(t, fmt.Sprintf(`
+		host: example.com
+		port: 4222
+		url: "nats://${host}:${port}"
+		size: "size-${%s}"
+		sys: "$SYS.>"
+		raw: "${unterminated"
+	`, evar), ex)
+
+	for _, conf := range []string{
+		`foo: "${__NOT_DEFINED__}"`,
+		"m { a: 1 }\nfoo: \"${m}\"",
+	} {
+		if _, err := Parse(conf); err == nil || !strings.HasPrefix(err.Error(), "variable reference") {
+			t.Fatalf("Expected variable reference error for %q, got %v", conf, err)
+		}
+	}
+}
+
+func TestIncludeAbsoluteAndInterpolatedPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "inc.conf"), []byte("foo: bar"), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	evar := "__UNIQ22__"
+	os.Setenv(evar, dir)
+	defer os.Unsetenv(evar)
+
+	ex := map[string]interface{}{"foo": "bar"}
+	for _, conf := range []string{
+		fmt.Sprintf("include %q", filepath.Join(dir, "inc.conf")),
+		fmt.Sprintf(`include "${%s}/inc.conf"`, evar),
+	} {
+		// Parse from a file in another directory so that relative
+		// resolution would not find it.
+		main := filepath.Join(dir, "sub", "main.conf")
+		os.MkdirAll(filepath.Dir(main), 0700)
+		if err := ioutil.WriteFile(main, []byte(conf), 0600); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+		m, err := ParseFile(main)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", conf, err)
+		}
+		if !reflect.DeepEqual(m, ex) {
+			t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+		}
+	}
+}
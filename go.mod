@@ -7,7 +7,9 @@ require (
 	github.com/nats-io/nkeys v0.1.4
 	github.com/nats-io/nuid v1.0.1
 	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
 	golang.org/x/sys v0.0.0-20190726091711-fc99dfbffb4e
+	golang.org/x/text v0.3.0 // indirect
 )
 
 go 1.13
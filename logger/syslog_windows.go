@@ -29,6 +29,22 @@ func SetSyslogName(name string) {
 	natsEventSource = name
 }
 
+// InstallSysLogSource registers the event source in the registry. This
+// requires administrative privileges, so it is done when installing the
+// service and allows the service to log when running with fewer rights.
+func InstallSysLogSource() error {
+	err := eventlog.InstallAsEventCreate(natsEventSource, eventlog.Info|eventlog.Error|eventlog.Warning)
+	if err != nil && !strings.Contains(err.Error(), "registry key already exists") {
+		return err
+	}
+	return nil
+}
+
+// RemoveSysLogSource removes the event source from the registry.
+func RemoveSysLogSource() error {
+	return eventlog.Remove(natsEventSource)
+}
+
 // SysLogger logs to the windows event logger
 type SysLogger struct {
 	writer *eventlog.Log
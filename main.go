@@ -32,9 +32,11 @@ Server Options:
     -ms,--https_port <port>          Use port for https monitoring
     -c, --config <file>              Configuration file
     -sl,--signal <signal>[=<pid>]    Send signal to nats-server process (stop, quit, reopen, reload)
+                                     On Windows, also install, uninstall and start the service
                                      <pid> can be either a PID (e.g. 1) or the path to a PID file (e.g. /var/run/nats-server.pid)
         --client_advertise <string>  Client URL to advertise to other servers
-    -t                               Test configuration and exit
+    -t, --config-check               Test configuration and exit
+        --check-config               Test configuration, print it fully resolved and exit
 
 Logging Options:
     -l, --log <file>                 File to redirect log output
@@ -94,6 +96,11 @@ func main() {
 	if err != nil {
 		server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
 	} else if opts.CheckConfig {
+		if opts.PrintConfig {
+			if err := server.PrintResolvedConfig(os.Stdout, opts.ConfigFile); err != nil {
+				server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
+			}
+		}
 		fmt.Fprintf(os.Stderr, "%s: configuration file %s is valid\n", exe, opts.ConfigFile)
 		os.Exit(0)
 	}
@@ -0,0 +1,180 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The connections over the accept rate are closed.
+	AcceptOverflowDrop = "drop"
+	// The connections over the accept rate are set up once the rate allows
+	// it. Meanwhile the listener does not accept connections, so that they
+	// wait in the backlog of the listener.
+	AcceptOverflowQueue = "queue"
+)
+
+// AcceptRateOpts limits the rate of the connections accepted by a listener,
+// so that a storm of connections, such as the reconnections after a network
+// blip, does not spend all the CPU on handshakes. Rate is the number of
+// connections per second, and Burst the number of connections accepted at
+// once, at least the rate by default. Overflow is what happens to the
+// connections over the rate, "drop" (the default) or "queue".
+type AcceptRateOpts struct {
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst,omitempty"`
+	Overflow string  `json:"overflow,omitempty"`
+}
+
+// Returns the burst, defaulting to the rate.
+func (o *AcceptRateOpts) burst() int {
+	if o.Burst > 0 {
+		return o.Burst
+	}
+	return int(math.Max(1, math.Ceil(o.Rate)))
+}
+
+func (o *AcceptRateOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Rate < 0 {
+		return fmt.Errorf("rate can not be negative")
+	}
+	if o.Burst < 0 {
+		return fmt.Errorf("burst can not be negative")
+	}
+	switch o.Overflow {
+	case _EMPTY_, AcceptOverflowDrop, AcceptOverflowQueue:
+	default:
+		return fmt.Errorf("overflow %q is not supported, use %q or %q",
+			o.Overflow, AcceptOverflowDrop, AcceptOverflowQueue)
+	}
+	return nil
+}
+
+// validateAcceptRates checks the accept rates of the listeners.
+func validateAcceptRates(o *Options) error {
+	for name, ar := range map[string]*AcceptRateOpts{
+		"client":   o.AcceptRate,
+		"cluster":  o.Cluster.AcceptRate,
+		"gateway":  o.Gateway.AcceptRate,
+		"leafnode": o.LeafNode.AcceptRate,
+	} {
+		if err := ar.validate(); err != nil {
+			return fmt.Errorf("%s accept_rate: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// acceptLimiter is the token bucket of the accept rate of a listener. It
+// is only used by the accept loop of the listener, except for the metrics.
+type acceptLimiter struct {
+	// Connections over the rate, closed and queued. Accessed atomically,
+	// first to be 64-bit aligned.
+	rejected int64
+	queued   int64
+
+	tokens float64
+	last   time.Time
+}
+
+// The listeners with an accept rate, by kind of connection.
+func newAcceptLimiters() map[string]*acceptLimiter {
+	return map[string]*acceptLimiter{
+		"client":   {},
+		"route":    {},
+		"gateway":  {},
+		"leafnode": {},
+	}
+}
+
+// take takes a token for a connection accepted at now. It returns how long
+// to wait before setting up the connection, or false if it is to be closed.
+func (l *acceptLimiter) take(o *AcceptRateOpts, now time.Time) (time.Duration, bool) {
+	burst := float64(o.burst())
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = math.Min(burst, l.tokens+now.Sub(l.last).Seconds()*o.Rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if o.Overflow != AcceptOverflowQueue {
+		atomic.AddInt64(&l.rejected, 1)
+		return 0, false
+	}
+	// The token is borrowed, and available once the wait is over.
+	atomic.AddInt64(&l.queued, 1)
+	wait := time.Duration((1 - l.tokens) / o.Rate * float64(time.Second))
+	l.tokens--
+	return wait, true
+}
+
+// acceptRateAllowed returns true if the connection accepted on a listener is
+// within its accept rate, waiting for it with the queue overflow policy.
+// The connection is closed otherwise.
+func (s *Server) acceptRateAllowed(kind string, o *AcceptRateOpts, conn net.Conn) bool {
+	l := s.acceptLimiters[strings.ToLower(kind)]
+	if o == nil || o.Rate <= 0 || l == nil {
+		return true
+	}
+	wait, ok := l.take(o, time.Now())
+	if !ok {
+		s.Debugf("%s connection from %s rejected by the accept rate", kind, conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-s.quitCh:
+			conn.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// acceptRateStats returns the connections closed by the accept rates, by
+// listener, and the connections queued.
+func (s *Server) acceptRateStats() (rejected, queued map[string]int64) {
+	for kind, l := range s.acceptLimiters {
+		if n := atomic.LoadInt64(&l.rejected); n > 0 {
+			if rejected == nil {
+				rejected = make(map[string]int64)
+			}
+			rejected[kind] = n
+		}
+		if n := atomic.LoadInt64(&l.queued); n > 0 {
+			if queued == nil {
+				queued = make(map[string]int64)
+			}
+			queued[kind] = n
+		}
+	}
+	return rejected, queued
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestAcceptRateConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accept_rate: 50
+		cluster {
+			accept_rate { rate: 0.5, burst: 4, overflow: queue }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if ar := opts.AcceptRate; ar == nil || ar.Rate != 50 || ar.burst() != 50 || ar.Overflow != _EMPTY_ {
+		t.Fatalf("Unexpected client accept rate: %+v", ar)
+	}
+	if ar := opts.Cluster.AcceptRate; ar == nil || ar.Rate != 0.5 || ar.burst() != 4 || ar.Overflow != AcceptOverflowQueue {
+		t.Fatalf("Unexpected cluster accept rate: %+v", ar)
+	}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, ar := range []*AcceptRateOpts{
+		{Rate: -1},
+		{Rate: 1, Burst: -1},
+		{Rate: 1, Overflow: "block"},
+	} {
+		opts := DefaultOptions()
+		opts.LeafNode.AcceptRate = ar
+		if err := validateOptions(opts); err == nil {
+			t.Fatalf("Expected an error for %+v", ar)
+		}
+	}
+}
+
+func TestAcceptLimiter(t *testing.T) {
+	now := time.Now()
+	l := &acceptLimiter{}
+	drop := &AcceptRateOpts{Rate: 10, Burst: 2}
+	for i, expected := range []bool{true, true, false, false} {
+		if wait, ok := l.take(drop, now); ok != expected || wait != 0 {
+			t.Fatalf("Unexpected take %d: %v %v", i, wait, ok)
+		}
+	}
+	// A token every 100ms.
+	if _, ok := l.take(drop, now.Add(100*time.Millisecond)); !ok {
+		t.Fatal("Expected a token to be available")
+	}
+	if l.rejected != 2 || l.queued != 0 {
+		t.Fatalf("Unexpected metrics: %d rejected, %d queued", l.rejected, l.queued)
+	}
+
+	l = &acceptLimiter{}
+	queue := &AcceptRateOpts{Rate: 10, Burst: 1, Overflow: AcceptOverflowQueue}
+	if wait, ok := l.take(queue, now); !ok || wait != 0 {
+		t.Fatalf("Unexpected take: %v %v", wait, ok)
+	}
+	if wait, ok := l.take(queue, now); !ok || wait != 100*time.Millisecond {
+		t.Fatalf("Unexpected take: %v %v", wait, ok)
+	}
+	// Once the wait is over, the next connection waits for its own token.
+	if wait, ok := l.take(queue, now.Add(100*time.Millisecond)); !ok || wait != 100*time.Millisecond {
+		t.Fatalf("Unexpected take: %v %v", wait, ok)
+	}
+	if l.rejected != 0 || l.queued != 2 {
+		t.Fatalf("Unexpected metrics: %d rejected, %d queued", l.rejected, l.queued)
+	}
+}
+
+func TestAcceptRateClientListener(t *testing.T) {
+	o := DefaultOptions()
+	o.AcceptRate = &AcceptRateOpts{Rate: 0.1, Burst: 2}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		nc := natsConnect(t, s.ClientURL())
+		defer nc.Close()
+	}
+	if nc, err := nats.Connect(s.ClientURL(), nats.Timeout(500*time.Millisecond)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be rejected")
+	}
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	if n := v.RejectedAccepts["client"]; n < 1 {
+		t.Fatalf("Expected rejected client accepts, got %v", v.RejectedAccepts)
+	}
+
+	// With the queue policy, the connection is set up once the rate allows.
+	o = DefaultOptions()
+	o.AcceptRate = &AcceptRateOpts{Rate: 4, Burst: 1, Overflow: AcceptOverflowQueue}
+	s2 := RunServer(o)
+	defer s2.Shutdown()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", s2.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 512)); err != nil {
+			t.Fatalf("Expected the INFO of connection %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected the connections to be queued, took %v", elapsed)
+	}
+	if v, _ := s2.Varz(nil); v.QueuedAccepts["client"] != 2 || len(v.RejectedAccepts) != 0 {
+		t.Fatalf("Unexpected accepts metrics: %v %v", v.QueuedAccepts, v.RejectedAccepts)
+	}
+}
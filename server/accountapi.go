@@ -0,0 +1,214 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	accCreateReqSubj = "$SYS.REQ.ACCOUNT.CREATE"
+	accUpdateReqSubj = "$SYS.REQ.ACCOUNT.UPDATE"
+	accDeleteReqSubj = "$SYS.REQ.ACCOUNT.DELETE"
+)
+
+// AccountAPIResponse is sent back in response to the requests to create,
+// update or delete an account. The request is received and applied by every
+// server of the cluster, each of them responds.
+type AccountAPIResponse struct {
+	Server  ServerInfo `json:"server"`
+	Account string     `json:"account,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// accountDeleter is implemented by the account resolvers that can delete
+// the claims of an account.
+type accountDeleter interface {
+	Delete(name string) error
+}
+
+// Delete will remove the account jwt claims from the internal sync.Map.
+func (m *MemAccResolver) Delete(name string) error {
+	m.sm.Delete(name)
+	return nil
+}
+
+// accountCreateReq creates an account from the account JWT of the request.
+func (s *Server) accountCreateReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	s.accountAPIRespond(reply, func() (string, error) { return s.storeAccountClaims(string(msg), true) })
+}
+
+// accountUpdateReq updates an account from the account JWT of the request.
+func (s *Server) accountUpdateReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	s.accountAPIRespond(reply, func() (string, error) { return s.storeAccountClaims(string(msg), false) })
+}
+
+// accountDeleteReq deletes the account whose public key is the request.
+func (s *Server) accountDeleteReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	s.accountAPIRespond(reply, func() (string, error) {
+		name := strings.TrimSpace(string(msg))
+		return name, s.deleteAccount(name)
+	})
+}
+
+func (s *Server) accountAPIRespond(reply string, apply func() (string, error)) {
+	if !s.eventsRunning() {
+		return
+	}
+	var resp AccountAPIResponse
+	name, err := apply()
+	resp.Account = name
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, &resp)
+	}
+}
+
+// Returns the account resolver, or an error if the server is not running
+// with trusted operators.
+func (s *Server) accountAPIResolver() (AccountResolver, error) {
+	s.mu.Lock()
+	trusted := len(s.trustedKeys) > 0
+	ar := s.accResolver
+	s.mu.Unlock()
+	if !trusted {
+		return nil, fmt.Errorf("account API requires trusted operators")
+	}
+	if ar == nil {
+		return nil, ErrNoAccountResolver
+	}
+	return ar, nil
+}
+
+// storeAccountClaims verifies the account JWT, signed by a trusted operator,
+// stores it in the account resolver and applies it to the account if it is
+// already loaded. Returns the name of the account.
+func (s *Server) storeAccountClaims(claimJWT string, create bool) (string, error) {
+	ar, err := s.accountAPIResolver()
+	if err != nil {
+		return _EMPTY_, err
+	}
+	claimJWT = strings.TrimSpace(claimJWT)
+	accClaims, _, err := s.verifyAccountClaims(claimJWT)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	name := accClaims.Subject
+	if !s.isTrustedIssuer(accClaims.Issuer) {
+		return name, ErrAccountValidation
+	}
+	var acc *Account
+	if v, ok := s.accounts.Load(name); ok {
+		acc = v.(*Account)
+	}
+	exists := acc != nil
+	if !exists {
+		_, err := ar.Fetch(name)
+		exists = err == nil
+	}
+	if create && exists {
+		return name, fmt.Errorf("account %q already exists", name)
+	} else if !create && !exists {
+		return name, fmt.Errorf("account %q not found", name)
+	}
+	if err := ar.Store(name, claimJWT); err != nil {
+		return name, err
+	}
+	if acc != nil {
+		if err := s.updateAccountWithClaimJWT(acc, claimJWT); err != nil && err != ErrAccountResolverSameClaims {
+			return name, err
+		}
+		s.Noticef("Account %q updated", name)
+		return name, nil
+	}
+	if _, err := s.fetchAccount(name); err != nil {
+		return name, err
+	}
+	s.Noticef("Account %q created", name)
+	return name, nil
+}
+
+// deleteAccount removes the account from the account resolver, then closes
+// its connections and unregisters it.
+func (s *Server) deleteAccount(name string) error {
+	ar, err := s.accountAPIResolver()
+	if err != nil {
+		return err
+	}
+	if !nkeys.IsValidPublicAccountKey(name) {
+		return fmt.Errorf("not a valid public nkey for an account: %q", name)
+	}
+	if sacc := s.SystemAccount(); sacc != nil && sacc.Name == name {
+		return fmt.Errorf("system account can not be deleted")
+	}
+	ad, ok := ar.(accountDeleter)
+	if !ok {
+		return fmt.Errorf("delete operation not supported by the account resolver")
+	}
+	v, loaded := s.accounts.Load(name)
+	if _, err := ar.Fetch(name); err != nil && !loaded {
+		return fmt.Errorf("account %q not found", name)
+	}
+	if err := ad.Delete(name); err != nil {
+		return err
+	}
+	if loaded {
+		acc := v.(*Account)
+		s.accounts.Delete(name)
+		// The clients and the leafnodes bound to the account.
+		for _, c := range acc.localClients() {
+			c.sendErrAndDebug("Account Deleted")
+			c.closeConnection(AccountDeleted)
+		}
+		s.invalidateImportsFrom(acc)
+	}
+	s.Noticef("Account %q deleted", name)
+	return nil
+}
+
+// invalidateImportsFrom invalidates the stream and service imports of the
+// other accounts from the deleted account acc, and updates the subscriptions
+// of their clients for the stream imports no longer there.
+func (s *Server) invalidateImportsFrom(acc *Account) {
+	clients := map[*client]struct{}{}
+	awcsti := map[string]struct{}{}
+	s.accounts.Range(func(k, v interface{}) bool {
+		a := v.(*Account)
+		a.mu.Lock()
+		for _, im := range a.imports.streams {
+			if im != nil && im.acc == acc && !im.invalid {
+				im.invalid = true
+				awcsti[a.Name] = struct{}{}
+				for _, c := range a.clients {
+					clients[c] = struct{}{}
+				}
+			}
+		}
+		for _, si := range a.imports.services {
+			if si != nil && si.acc == acc {
+				si.invalid = true
+			}
+		}
+		a.mu.Unlock()
+		return true
+	})
+	for c := range clients {
+		c.processSubsOnConfigReload(awcsti)
+	}
+}
@@ -21,8 +21,10 @@ import (
 	"net/url"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt"
@@ -35,18 +37,24 @@ const globalAccountName = "$G"
 // Account are subject namespace definitions. By default no messages are shared between accounts.
 // You can share via Exports and Imports of Streams and Services.
 type Account struct {
+	// Keep first for the 64-bit alignment of the atomic counters.
+	stats        accountStats
 	Name         string
 	Nkey         string
 	Issuer       string
 	claimJWT     string
+	issuedAt     int64
 	updated      time.Time
 	mu           sync.RWMutex
 	sqmu         sync.Mutex
 	sl           *Sublist
 	etmr         *time.Timer
 	ctmr         *time.Timer
+	aetmr        *time.Timer
 	strack       map[string]sconns
 	nrclients    int32
+	logLevel     int32 // log level raised for the connections of the account, accessed atomically
+	csubs        int32 // subscriptions of the client connections, accessed atomically
 	sysclients   int32
 	nleafs       int32
 	nrleafs      int32
@@ -60,22 +68,52 @@ type Account struct {
 	imports      importMap
 	exports      exportMap
 	limits
-	nae           int32
-	pruning       bool
-	rmPruning     bool
-	expired       bool
-	signingKeys   []string
-	srv           *Server // server this account is registered with (possibly nil)
-	lds           string  // loop detection subject for leaf nodes
-	siReply       []byte  // service reply prefix, will form wildcard subscription.
-	siReplyClient *client
-	prand         *rand.Rand
+	nae               int32
+	pruning           bool
+	rmPruning         bool
+	expired           bool
+	signingKeys       []string
+	srv               *Server // server this account is registered with (possibly nil)
+	lds               string  // loop detection subject for leaf nodes
+	siReply           []byte  // service reply prefix, will form wildcard subscription.
+	siReplyClient     *client
+	prand             *rand.Rand
+	interest          []string                 // expected interest propagated on load
+	isubs             map[string]*subscription // subscriptions propagating expected interest
+	maxPayload        int32                    // max_payload of the account configuration, 0 if not set
+	maxCtrlLine       int32                    // max_control_line of the account configuration, 0 if not set
+	maxMemory         int64                    // max_memory of the account configuration, 0 if not set
+	pingInterval      time.Duration            // ping_interval of the account configuration, 0 if not set
+	maxPingsOut       int                      // ping_max of the account configuration, 0 if not set
+	deadLetter        *deadLetter              // dead_letter of the account configuration, nil if not set
+	dupConfig         map[string]time.Duration // duplicate_window of the account configuration, per subject
+	dupWindows        []*dupWindow             // message ids seen per subject of dupConfig
+	kv                *kvLimits                // kv of the account configuration, nil if not set
+	objStore          *objLimits               // object_store of the account configuration, nil if not set
+	streams           map[string]*StreamConfig // streams of the account configuration, by name, nil if not set
+	minClientVersions map[string]string        // min_client_version of the account configuration, per client library
+	subjectRules      *subjectRules            // subject_rules of the account configuration, nil if not set
+	traffic           accountTraffic           // payload sizes and top subjects, if enabled
+}
+
+// Messages and bytes received from and sent to the clients and
+// leafnodes of the account on this server.
+type accountStats struct {
+	inMsgs   int64
+	inBytes  int64
+	outMsgs  int64
+	outBytes int64
+	// Last sample of the counters, used to compute the rates.
+	// Protected by the account lock.
+	sampled time.Time
+	sample  [4]int64
 }
 
 // Account based limits.
 type limits struct {
 	mpay     int32
 	msubs    int32
+	mtsubs   int32
 	mconns   int32
 	mleafs   int32
 	maxnae   int32
@@ -96,6 +134,11 @@ type streamImport struct {
 	prefix  string
 	claim   *jwt.Import
 	invalid bool
+	// Subject in the importing account, which may contain wildcards.
+	to string
+	// Optional subject mapping to and from the importing account.
+	tr  *transform
+	rtr *transform
 }
 
 // Import service mapping struct
@@ -112,6 +155,7 @@ type serviceImport struct {
 	internal bool
 	invalid  bool
 	tracking bool
+	tr       *transform
 }
 
 // This is used to record when we create a mapping for implicit service
@@ -181,13 +225,15 @@ type exportMap struct {
 type importMap struct {
 	streams  []*streamImport
 	services map[string]*serviceImport // TODO(dlc) sync.Map may be better.
+	// Number of service imports with mapped subjects.
+	wcsis int
 }
 
 // NewAccount creates a new unlimited account with the given name.
 func NewAccount(name string) *Account {
 	a := &Account{
 		Name:   name,
-		limits: limits{-1, -1, -1, -1, 0, 0, 0},
+		limits: limits{-1, -1, -1, -1, -1, 0, 0, 0},
 	}
 	return a
 }
@@ -200,13 +246,31 @@ func (a *Account) shallowCopy() *Account {
 	na.Issuer = a.Issuer
 	na.imports = a.imports
 	na.exports = a.exports
+	na.interest = a.interest
+	na.mtsubs = a.mtsubs
+	na.mconns = a.mconns
+	na.maxPayload = a.maxPayload
+	na.maxMemory = a.maxMemory
+	na.pingInterval = a.pingInterval
+	na.maxPingsOut = a.maxPingsOut
+	na.deadLetter = a.deadLetter
+	na.dupConfig = a.dupConfig
+	na.dupWindows = newDupWindows(a.dupConfig)
+	na.kv = a.kv
+	na.objStore = a.objStore
+	na.streams = a.streams
+	na.minClientVersions = a.minClientVersions
+	na.subjectRules = a.subjectRules
+	na.maxCtrlLine = a.maxCtrlLine
 	return na
 }
 
 // Called to track a remote server and connections and leafnodes it
-// has for this account.
-func (a *Account) updateRemoteServer(m *AccountNumConns) {
+// has for this account. Returns the local clients to close if the
+// account is now over its limit of active connections.
+func (a *Account) updateRemoteServer(m *AccountNumConns) []*client {
 	a.mu.Lock()
+	defer a.mu.Unlock()
 	if a.strack == nil {
 		a.strack = make(map[string]sconns)
 	}
@@ -216,7 +280,7 @@ func (a *Account) updateRemoteServer(m *AccountNumConns) {
 	a.strack[m.Server.ID] = sconns{conns: int32(m.Conns), leafs: int32(m.LeafNodes)}
 	a.nrclients += int32(m.Conns) - prev.conns
 	a.nrleafs += int32(m.LeafNodes) - prev.leafs
-	a.mu.Unlock()
+	return a.clientsOverLimit()
 }
 
 // Removes tracking for a remote server that has shutdown.
@@ -252,6 +316,7 @@ func (a *Account) clearEventing() {
 	// Now clear state
 	clearTimer(&a.etmr)
 	clearTimer(&a.ctmr)
+	clearTimer(&a.aetmr)
 	a.clients = nil
 	a.strack = nil
 	a.mu.Unlock()
@@ -322,6 +387,53 @@ func (a *Account) MaxActiveConnections() int {
 	return mconns
 }
 
+// setMaxConnections sets the limit for the number of active connections,
+// closing the newest client connections that go over the new limit.
+func (a *Account) setMaxConnections(max int) {
+	a.mu.Lock()
+	a.mconns = int32(max)
+	clients := a.clientsOverLimit()
+	a.mu.Unlock()
+
+	for _, c := range clients {
+		c.maxAccountConnExceeded()
+	}
+}
+
+// Returns the newest local client connections that go over the limit of
+// active connections, which counts the connections of all the servers.
+// Lock should be held.
+func (a *Account) clientsOverLimit() []*client {
+	if a.mconns == jwt.NoLimit {
+		return nil
+	}
+	over := a.numLocalConnections() + int(a.nrclients) - int(a.mconns)
+	if over <= 0 {
+		return nil
+	}
+	clients := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		if c.kind == CLIENT {
+			clients = append(clients, c)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].start.After(clients[j].start)
+	})
+	if over < len(clients) {
+		clients = clients[:over]
+	}
+	return clients
+}
+
+// Returns true if the account has reached its limit on the total number of
+// subscriptions of its client connections, the routed, leafnode and system
+// subscriptions not being counted. The limit is only set from configuration
+// so no lock is needed.
+func (a *Account) subsAtLimit() bool {
+	return a.mtsubs != jwt.NoLimit && atomic.LoadInt32(&a.csubs) >= a.mtsubs
+}
+
 // MaxTotalLeafNodesReached returns if we have reached our limit for number of leafnodes.
 func (a *Account) MaxTotalLeafNodesReached() bool {
 	a.mu.RLock()
@@ -452,17 +564,6 @@ func (a *Account) removeClient(c *client) int {
 	return n
 }
 
-func (a *Account) randomClient() *client {
-	var c *client
-	if a.siReplyClient != nil {
-		return a.siReplyClient
-	}
-	for _, c = range a.clients {
-		break
-	}
-	return c
-}
-
 // AddServiceExport will configure the account with the defined export.
 func (a *Account) AddServiceExport(subject string, accounts []*Account) error {
 	return a.AddServiceExportWithResponse(subject, Singleton, accounts)
@@ -718,6 +819,7 @@ type remoteLatency struct {
 	Account string         `json:"account"`
 	ReqId   string         `json:"req_id"`
 	M2      ServiceLatency `json:"m2"`
+	Server  ServerInfo     `json:"server"`
 }
 
 // sendTrackingMessage will send out the appropriate tracking information for the
@@ -798,15 +900,28 @@ func (a *Account) AddServiceImportWithClaim(destination *Account, from, to strin
 	if to == "" {
 		to = from
 	}
-	if !IsValidLiteralSubject(from) || !IsValidLiteralSubject(to) {
-		return ErrInvalidSubject
+	// If the local subject has wildcards, or the destination references
+	// them, the requests will be mapped on the fly.
+	var tr *transform
+	if !IsValidLiteralSubject(from) || !IsValidLiteralSubject(to) || strings.Contains(to, "$") {
+		var err error
+		if tr, err = newTransform(from, to); err != nil {
+			return err
+		}
+		// Wildcards in the local subject have to be mapped.
+		if to = tr.pattern; subjectIsLiteral(to) {
+			if !subjectIsLiteral(from) {
+				return ErrInvalidSubject
+			}
+			tr = nil
+		}
 	}
 	// First check to see if the account has authorized us to route to the "to" subject.
 	if !destination.checkServiceImportAuthorized(a, to, imClaim) {
 		return ErrServiceImportAuthorization
 	}
 
-	_, err := a.addServiceImport(destination, from, to, imClaim)
+	_, err := a.addServiceImport(destination, from, to, tr, imClaim)
 	return err
 }
 
@@ -814,6 +929,8 @@ func (a *Account) AddServiceImportWithClaim(destination *Account, from, to strin
 // to the destination account. From is the local subject to map, To is the
 // subject that will appear on the destination account. Destination will need
 // to have an import rule to allow access via addService.
+// From can contain wildcards, in which case To can rearrange the matched
+// tokens with $1, $2, etc., e.g. from "tenant.*.*" to "svc.$2.$1".
 func (a *Account) AddServiceImport(destination *Account, from, to string) error {
 	return a.AddServiceImportWithClaim(destination, from, to, nil)
 }
@@ -825,6 +942,18 @@ func (a *Account) NumServiceImports() int {
 	return len(a.imports.services)
 }
 
+// matchMappedServiceImport returns the service import whose wildcard
+// subject matches the published subject.
+// Lock should be held.
+func (a *Account) matchMappedServiceImport(subject string) *serviceImport {
+	for _, si := range a.imports.services {
+		if si.tr != nil && matchLiteral(subject, si.from) {
+			return si
+		}
+	}
+	return nil
+}
+
 // removeServiceImport will remove the route by subject.
 func (a *Account) removeServiceImport(subject string) {
 	a.mu.Lock()
@@ -832,6 +961,9 @@ func (a *Account) removeServiceImport(subject string) {
 	if ok && si != nil && si.ae {
 		a.nae--
 	}
+	if ok && si != nil && si.tr != nil {
+		a.imports.wcsis--
+	}
 	delete(a.imports.services, subject)
 	a.mu.Unlock()
 }
@@ -922,6 +1054,9 @@ func (a *Account) SetAutoExpireTTL(ttl time.Duration) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	a.maxaettl = ttl
+	if a.aetmr != nil && ttl > 0 {
+		a.aetmr.Reset(ttl)
+	}
 }
 
 // Return a list of the current autoExpireResponseMaps.
@@ -963,7 +1098,7 @@ func (a *Account) SetMaxResponseMaps(max int) {
 // Add a route to connect from an implicit route created for a response to a request.
 // This does no checks and should be only called by the msg processing code. Use
 // AddServiceImport from above if responding to user input or config changes, etc.
-func (a *Account) addServiceImport(dest *Account, from, to string, claim *jwt.Import) (*serviceImport, error) {
+func (a *Account) addServiceImport(dest *Account, from, to string, tr *transform, claim *jwt.Import) (*serviceImport, error) {
 	rt := Singleton
 	var lat *serviceLatency
 
@@ -982,8 +1117,11 @@ func (a *Account) addServiceImport(dest *Account, from, to string, claim *jwt.Im
 		return nil, fmt.Errorf("duplicate service import subject %q, previously used in import for account %q, subject %q",
 			from, dup.acc.Name, dup.to)
 	}
-	si := &serviceImport{dest, claim, from, to, 0, rt, lat, nil, false, false, false, false}
+	si := &serviceImport{dest, claim, from, to, 0, rt, lat, nil, false, false, false, false, tr}
 	a.imports.services[from] = si
+	if tr != nil {
+		a.imports.wcsis++
+	}
 	a.mu.Unlock()
 
 	return si, nil
@@ -1052,6 +1190,63 @@ func (a *Account) createRespWildcard() []byte {
 	return pre
 }
 
+// updateExpectedInterest propagates the account's expected interest to
+// routes, gateways and leafnodes so that the first messages on these
+// subjects do not wait for interest from a local subscriber to arrive.
+// Subjects that are no longer expected are withdrawn.
+func (s *Server) updateExpectedInterest(a *Account) {
+	var added, removed []*subscription
+
+	a.mu.Lock()
+	expected := make(map[string]struct{}, len(a.interest))
+	for _, subj := range a.interest {
+		expected[subj] = struct{}{}
+	}
+	for subj, sub := range a.isubs {
+		if _, ok := expected[subj]; !ok {
+			removed = append(removed, sub)
+			delete(a.isubs, subj)
+		}
+	}
+	var c *client
+	for _, sub := range a.isubs {
+		c = sub.client
+		break
+	}
+	for _, subj := range a.interest {
+		if _, ok := a.isubs[subj]; ok {
+			continue
+		}
+		if c == nil {
+			now := time.Now()
+			c = &client{srv: s, acc: a, kind: SYSTEM, opts: internalOpts, msubs: -1, mpay: -1, start: now, last: now}
+		}
+		if a.isubs == nil {
+			a.isubs = make(map[string]*subscription)
+		}
+		sub := &subscription{client: c, subject: []byte(subj)}
+		a.isubs[subj] = sub
+		added = append(added, sub)
+	}
+	aName := a.Name
+	a.mu.Unlock()
+
+	for _, sub := range removed {
+		s.updateExpectedInterestSub(a, aName, sub, -1)
+	}
+	for _, sub := range added {
+		s.updateExpectedInterestSub(a, aName, sub, 1)
+	}
+}
+
+func (s *Server) updateExpectedInterestSub(a *Account, aName string, sub *subscription, delta int32) {
+	s.updateRouteSubscriptionMap(a, sub, delta)
+	if s.gateway.enabled {
+		s.gatewayUpdateSubInterest(aName, sub, delta)
+	}
+	s.updateLeafNodes(a, sub, delta)
+}
+
 func (a *Account) replyClient() *client {
 	a.mu.RLock()
 	c := a.siReplyClient
@@ -1106,7 +1301,7 @@ func (a *Account) addRespServiceImport(dest *Account, from, to string, rt Servic
 	}
 	// dest is the requestor's account. a is the service responder with the export.
 	ae := rt == Singleton
-	si := &serviceImport{dest, nil, from, to, 0, rt, nil, nil, ae, true, false, false}
+	si := &serviceImport{dest, nil, from, to, 0, rt, nil, nil, ae, true, false, false, nil}
 	a.imports.services[from] = si
 	if ae {
 		a.nae++
@@ -1119,11 +1314,45 @@ func (a *Account) addRespServiceImport(dest *Account, from, to string, rt Servic
 			a.pruning = true
 			go a.pruneAutoExpireResponseMaps()
 		}
+		// Make sure expired response maps are removed even when under the limit.
+		if a.aetmr == nil && a.maxaettl > 0 {
+			a.aetmr = time.AfterFunc(a.maxaettl, a.expireAutoExpireResponseMaps)
+		}
 	}
 	a.mu.Unlock()
 	return si
 }
 
+// Runs periodically while we have auto-expire response maps.
+func (a *Account) expireAutoExpireResponseMaps() {
+	a.mu.Lock()
+	prune := a.nae > 0 && !a.pruning
+	if prune {
+		a.pruning = true
+	}
+	a.mu.Unlock()
+
+	if prune {
+		a.pruneAutoExpireResponseMaps()
+	}
+
+	a.mu.Lock()
+	if a.aetmr != nil {
+		if a.nae > 0 {
+			a.aetmr.Reset(a.maxaettl)
+		} else {
+			a.aetmr = nil
+		}
+	}
+	a.mu.Unlock()
+}
+
+// Returns true if this is an auto-expire response map that is past its ttl.
+// Lock should be held.
+func (a *Account) isExpiredResponseMap(si *serviceImport) bool {
+	return si.ae && a.maxaettl > 0 && time.Now().UnixNano()-si.ts >= int64(a.maxaettl)
+}
+
 // This will prune off the non auto-expire (non singleton) response maps.
 func (a *Account) pruneNonAutoExpireResponseMaps() {
 	var sres []*serviceRespEntry
@@ -1208,16 +1437,62 @@ func (a *Account) AddStreamImportWithClaim(account *Account, from, prefix string
 			prefix = prefix + string(btsep)
 		}
 	}
+	return a.addStreamImport(&streamImport{acc: account, from: from, prefix: prefix, claim: imClaim, to: prefix + from})
+}
+
+// AddMappedStreamImport will add in the stream import from a specific account,
+// mapping the subjects into the importing account. To can rearrange the wildcard
+// tokens of from with $1, $2, etc., e.g. from "events.*.*" to "tenant.events.$2.$1".
+func (a *Account) AddMappedStreamImport(account *Account, from, to string) error {
+	return a.AddMappedStreamImportWithClaim(account, from, to, nil)
+}
+
+// AddMappedStreamImportWithClaim will add in the mapped stream import from a specific
+// account with optional token.
+func (a *Account) AddMappedStreamImportWithClaim(account *Account, from, to string, imClaim *jwt.Import) error {
+	if account == nil {
+		return ErrMissingAccount
+	}
+	if !account.checkStreamImportAuthorized(a, from, imClaim) {
+		return ErrStreamImportAuthorization
+	}
+	tr, err := newTransform(from, to)
+	if err != nil {
+		return err
+	}
+	// Local subscriptions need to be mapped back into the exporting account.
+	rtr, err := tr.reverse()
+	if err != nil {
+		return err
+	}
+	return a.addStreamImport(&streamImport{acc: account, from: from, claim: imClaim, to: tr.pattern, tr: tr, rtr: rtr})
+}
+
+func (a *Account) addStreamImport(im *streamImport) error {
 	a.mu.Lock()
-	if a.isStreamImportDuplicate(account, from) {
-		a.mu.Unlock()
+	defer a.mu.Unlock()
+	if a.isStreamImportDuplicate(im.acc, im.from) {
 		return ErrStreamImportDuplicate
 	}
-	a.imports.streams = append(a.imports.streams, &streamImport{account, from, prefix, imClaim, false})
-	a.mu.Unlock()
+	a.imports.streams = append(a.imports.streams, im)
 	return nil
 }
 
+// appendSubject appends the subject as seen by the importing account.
+func (im *streamImport) appendSubject(b, subject []byte) []byte {
+	if im.tr != nil {
+		if subj, err := im.tr.transformSubject(string(subject)); err == nil {
+			return append(b, subj...)
+		}
+	}
+	return append(append(b, im.prefix...), subject...)
+}
+
+// isMapped returns true if the subjects need to be mapped for the importing account.
+func (im *streamImport) isMapped() bool {
+	return im.prefix != _EMPTY_ || im.tr != nil
+}
+
 // isStreamImportDuplicate checks for duplicate.
 // Lock should be held.
 func (a *Account) isStreamImportDuplicate(acc *Account, from string) bool {
@@ -1556,16 +1831,24 @@ func (a *Account) checkStreamImportsEqual(b *Account) bool {
 	// Load the b imports into a map index by what we are looking for.
 	bm := make(map[string]*streamImport, len(b.imports.streams))
 	for _, bim := range b.imports.streams {
-		bm[bim.acc.Name+bim.from+bim.prefix] = bim
+		bm[bim.acc.Name+bim.from+bim.mapping()] = bim
 	}
 	for _, aim := range a.imports.streams {
-		if _, ok := bm[aim.acc.Name+aim.from+aim.prefix]; !ok {
+		if _, ok := bm[aim.acc.Name+aim.from+aim.mapping()]; !ok {
 			return false
 		}
 	}
 	return true
 }
 
+// mapping returns how the subjects are mapped into the importing account.
+func (im *streamImport) mapping() string {
+	if im.tr != nil {
+		return im.tr.dest
+	}
+	return im.prefix
+}
+
 func (a *Account) checkStreamExportsEqual(b *Account) bool {
 	if len(a.exports.streams) != len(b.exports.streams) {
 		return false
@@ -1609,7 +1892,7 @@ func (a *Account) checkServiceImportAuthorized(account *Account, subject string,
 // Check if another account is authorized to route requests to this service.
 func (a *Account) checkServiceImportAuthorizedNoLock(account *Account, subject string, imClaim *jwt.Import) bool {
 	// Find the subject in the services list.
-	if a.exports.services == nil || !IsValidLiteralSubject(subject) {
+	if a.exports.services == nil || !IsValidSubject(subject) {
 		return false
 	}
 	return a.checkServiceExportApproved(account, subject, imClaim)
@@ -1658,17 +1941,17 @@ func (a *Account) clearExpirationTimer() bool {
 	return stopped
 }
 
-// checkUserRevoked will check if a user has been revoked.
-func (a *Account) checkUserRevoked(nkey string) bool {
+// checkUserRevoked will check if a user has been revoked. A revocation
+// applies to the user JWTs issued at or before its time.
+func (a *Account) checkUserRevoked(nkey string, issuedAt int64) bool {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
-	if a.usersRevoked == nil {
-		return false
-	}
-	if t, ok := a.usersRevoked[nkey]; !ok || t > time.Now().Unix() {
-		return false
-	}
-	return true
+	return isRevoked(a.usersRevoked, nkey, issuedAt)
+}
+
+func isRevoked(revocations map[string]int64, key string, issuedAt int64) bool {
+	t, ok := revocations[key]
+	return ok && issuedAt <= t
 }
 
 // Check expiration and set the proper state as needed.
@@ -1781,6 +2064,7 @@ func (s *Server) updateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 		old.imports.services[k] = v
 		delete(a.imports.services, k)
 	}
+	old.imports.wcsis, a.imports.wcsis = a.imports.wcsis, 0
 	// Reset any notion of export revocations.
 	a.actsRevoked = nil
 
@@ -1939,10 +2223,11 @@ func (s *Server) updateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 	a.mpay = int32(ac.Limits.Payload)
 	a.mconns = int32(ac.Limits.Conn)
 	a.mleafs = int32(ac.Limits.LeafNodeConn)
-	// Check for any revocations
+	a.issuedAt = ac.IssuedAt
+	// Check for any revocations. We will always replace whatever we had
+	// with most current, so that the ones removed no longer apply.
+	a.usersRevoked = nil
 	if len(ac.Revocations) > 0 {
-		// We will always replace whatever we had with most current, so no
-		// need to look at what we have.
 		a.usersRevoked = make(map[string]int64, len(ac.Revocations))
 		for pk, t := range ac.Revocations {
 			a.usersRevoked[pk] = t
@@ -1957,7 +2242,6 @@ func (s *Server) updateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 			return clients[i].start.After(clients[j].start)
 		})
 	}
-	now := time.Now().Unix()
 	for i, c := range clients {
 		a.mu.RLock()
 		exceeded := a.mconns != jwt.NoLimit && i >= int(a.mconns)
@@ -1971,18 +2255,17 @@ func (s *Server) updateAccountClaims(a *Account, ac *jwt.AccountClaims) {
 		// Check for being revoked here. We use ac one to avoid
 		// the account lock.
 		var nkey string
+		var issuedAt int64
 		if c.user != nil {
-			nkey = c.user.Nkey
+			nkey, issuedAt = c.user.Nkey, c.user.issuedAt
 		}
 		c.mu.Unlock()
 
 		// Check if we have been revoked.
-		if ac.Revocations != nil {
-			if t, ok := ac.Revocations[nkey]; ok && now >= t {
-				c.sendErrAndDebug("User Authentication Revoked")
-				c.closeConnection(Revocation)
-				continue
-			}
+		if isRevoked(ac.Revocations, nkey, issuedAt) {
+			c.sendErrAndDebug("User Authentication Revoked")
+			c.closeConnection(Revocation)
+			continue
 		}
 	}
 
@@ -2018,7 +2301,7 @@ func (s *Server) buildInternalAccount(ac *jwt.AccountClaims) *Account {
 
 // Helper to build internal NKeyUser.
 func buildInternalNkeyUser(uc *jwt.UserClaims, acc *Account) *NkeyUser {
-	nu := &NkeyUser{Nkey: uc.Subject, Account: acc}
+	nu := &NkeyUser{Nkey: uc.Subject, Account: acc, issuedAt: uc.IssuedAt}
 	if uc.IssuerAccount != "" {
 		nu.SigningKey = uc.Issuer
 	}
@@ -2131,3 +2414,134 @@ func (ur *URLAccResolver) Fetch(name string) (string, error) {
 func (ur *URLAccResolver) Store(name, jwt string) error {
 	return fmt.Errorf("Store operation not supported for URL Resolver")
 }
+
+// transform is used to map subjects that match a source pattern into a
+// destination subject. The destination can reference the wildcard tokens
+// of the source with $1, $2, etc., or positionally with '*' and '>'.
+type transform struct {
+	src   string
+	dest  string
+	stoks []string
+	dtoks []string
+	// For each destination token, the index of the source token to
+	// substitute, or -1 for a literal token.
+	dtpi []int
+	// Destination with all references replaced by their wildcards.
+	pattern string
+}
+
+// newTransform creates a transform from src to dest.
+func newTransform(src, dest string) (*transform, error) {
+	if !IsValidSubject(src) {
+		return nil, ErrInvalidSubject
+	}
+	stoks := strings.Split(src, tsep)
+	var wcs []int
+	for i, t := range stoks {
+		if len(t) == 1 && (t[0] == pwc || t[0] == fwc) {
+			wcs = append(wcs, i)
+		}
+	}
+	dtoks := strings.Split(dest, tsep)
+	dtpi := make([]int, len(dtoks))
+	ptoks := make([]string, len(dtoks))
+	next := 0
+	for i, t := range dtoks {
+		dtpi[i], ptoks[i] = -1, t
+		if len(t) > 1 && t[0] == '$' {
+			n, err := strconv.Atoi(t[1:])
+			if err != nil {
+				// Not a reference, e.g. $SYS.
+				continue
+			}
+			if n < 1 || n > len(wcs) {
+				return nil, ErrBadSubjectTransform
+			}
+			dtpi[i] = wcs[n-1]
+		} else if t == pwcs {
+			// Positional, use the next partial wildcard of the source.
+			for next < len(wcs) && stoks[wcs[next]] != pwcs {
+				next++
+			}
+			if next >= len(wcs) {
+				return nil, ErrBadSubjectTransform
+			}
+			dtpi[i] = wcs[next]
+			next++
+		} else if t == fwcs {
+			if len(wcs) == 0 || stoks[len(stoks)-1] != fwcs {
+				return nil, ErrBadSubjectTransform
+			}
+			dtpi[i] = len(stoks) - 1
+		} else {
+			continue
+		}
+		ptoks[i] = stoks[dtpi[i]]
+		// A full wildcard can only be used as the last token.
+		if ptoks[i][0] == fwc && i != len(dtoks)-1 {
+			return nil, ErrBadSubjectTransform
+		}
+	}
+	pattern := strings.Join(ptoks, tsep)
+	if !IsValidSubject(pattern) {
+		return nil, ErrInvalidSubject
+	}
+	return &transform{src, dest, stoks, dtoks, dtpi, pattern}, nil
+}
+
+// transformSubject maps a subject that matches the source into the
+// destination space.
+func (tr *transform) transformSubject(subject string) (string, error) {
+	tts := strings.Split(subject, tsep)
+	sfwc := tr.stoks[len(tr.stoks)-1] == fwcs
+	if len(tts) < len(tr.stoks) || (!sfwc && len(tts) != len(tr.stoks)) {
+		return _EMPTY_, ErrInvalidSubject
+	}
+	var b strings.Builder
+	for i, si := range tr.dtpi {
+		if i > 0 {
+			b.WriteByte(btsep)
+		}
+		switch {
+		case si < 0:
+			b.WriteString(tr.dtoks[i])
+		case tr.stoks[si] == fwcs:
+			b.WriteString(strings.Join(tts[si:], tsep))
+		default:
+			b.WriteString(tts[si])
+		}
+	}
+	return b.String(), nil
+}
+
+// reverse returns the transform that maps subjects in the destination
+// space back to the source space. This requires that every wildcard
+// of the source is referenced exactly once in the destination.
+func (tr *transform) reverse() (*transform, error) {
+	// Source token index to its reference number in the pattern.
+	refs := make(map[int]int)
+	n := 0
+	for _, si := range tr.dtpi {
+		if si < 0 {
+			continue
+		}
+		if _, ok := refs[si]; ok {
+			return nil, ErrBadSubjectTransform
+		}
+		n++
+		refs[si] = n
+	}
+	rtoks := make([]string, len(tr.stoks))
+	for i, t := range tr.stoks {
+		if t != pwcs && t != fwcs {
+			rtoks[i] = t
+			continue
+		}
+		ref, ok := refs[i]
+		if !ok {
+			return nil, ErrBadSubjectTransform
+		}
+		rtoks[i] = "$" + strconv.Itoa(ref)
+	}
+	return newTransform(tr.pattern, strings.Join(rtoks, tsep))
+}
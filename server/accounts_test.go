@@ -14,13 +14,16 @@
 package server
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -387,6 +390,66 @@ func TestAccountParseConfigDuplicateUsers(t *testing.T) {
 	}
 }
 
+func TestAccountParseConfigDefaultPermissions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users = [
+					{user: alice, password: pwd}
+					{user: bob, password: pwd, permissions: {publish: "secret.>"}}
+				]
+				default_permissions {
+					publish { deny: "secret.>" }
+					subscribe { deny: "secret.>" }
+				}
+			}
+			B {
+				users = [{user: derek, password: pwd}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Received an error processing config file: %v", err)
+	}
+	perms := make(map[string]*Permissions)
+	for _, u := range opts.Users {
+		perms[u.Username] = u.Permissions
+	}
+	if p := perms["alice"]; p == nil || p.Publish == nil || len(p.Publish.Deny) != 1 || p.Subscribe == nil {
+		t.Fatalf("Expected alice to have the default permissions, got %+v", p)
+	}
+	if p := perms["bob"]; p == nil || p.Publish == nil || len(p.Publish.Allow) != 1 || p.Publish.Deny != nil {
+		t.Fatalf("Expected bob to keep his permissions, got %+v", p)
+	}
+	if p := perms["derek"]; p != nil {
+		t.Fatalf("Expected derek to have no permissions, got %+v", p)
+	}
+
+	s := RunServer(opts)
+	defer s.Shutdown()
+	errCh := make(chan error, 1)
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("alice", "pwd"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	nc.Publish("secret.foo", []byte("hello"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Expected a permissions violation, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a permissions violation")
+	}
+}
+
 func TestAccountParseConfigImportsExports(t *testing.T) {
 	opts, err := ProcessConfigFile("./configs/accounts.conf")
 	if err != nil {
@@ -2321,3 +2384,640 @@ func BenchmarkNewRouteReply(b *testing.B) {
 		g.newServiceReply(false)
 	}
 }
+
+func TestAccountExpectedInterest(t *testing.T) {
+	tmpl := `
+		listen: "127.0.0.1:-1"
+		cluster { listen: "127.0.0.1:-1" }
+		accounts {
+			FOO {
+				users [{user: foo, password: pwd}]
+				%s
+			}
+		}
+	`
+	confA := createConfFile(t, []byte(fmt.Sprintf(tmpl, `expected_interest: ["svc.>", "req.one"]`)))
+	defer os.Remove(confA)
+	sa, _ := RunServerWithConfig(confA)
+	defer sa.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Accounts = []*Account{NewAccount("FOO")}
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+	checkClusterFormed(t, sa, sb)
+
+	accB, err := sb.LookupAccount("FOO")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	checkInterest := func(subject string, expected bool) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			if has := len(accB.sl.Match(subject).psubs) > 0; has != expected {
+				return fmt.Errorf("Expected interest on %q to be %v", subject, expected)
+			}
+			return nil
+		})
+	}
+	// No local subscriber on A, but B should already see interest.
+	checkInterest("svc.echo", true)
+	checkInterest("req.one", true)
+	checkInterest("req.two", false)
+
+	nc := natsConnect(t, fmt.Sprintf("nats://foo:pwd@%s", sa.Addr()))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "svc.echo")
+	natsFlush(t, nc)
+
+	// Now change the expected interest and reload.
+	changeCurrentConfigContentWithNewContent(t, confA, []byte(fmt.Sprintf(tmpl, `expected_interest: "req.two"`)))
+	if err := sa.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	checkInterest("req.one", false)
+	checkInterest("req.two", true)
+	// The real subscription keeps the interest on svc.echo.
+	checkInterest("svc.echo", true)
+	checkInterest("svc.other", false)
+	natsUnsub(t, sub)
+	checkInterest("svc.echo", false)
+}
+
+func TestAccountExpectedInterestConfigErrors(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accounts { FOO { expected_interest: ["svc.> workers"] } }
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "queue group not allowed") {
+		t.Fatalf("Expected error about queue group, got %v", err)
+	}
+	conf = createConfFile(t, []byte(`
+		accounts { FOO { expected_interest: ["svc..bad"] } }
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected error for invalid subject")
+	}
+}
+
+func TestAccountMaxSubscriptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				max_subscriptions: 3
+				users [{user: a1, password: pwd}, {user: a2, password: pwd}]
+			}
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://a1:pwd@%s", s.Addr()))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	natsSubSync(t, nc, "bar")
+	natsFlush(t, nc)
+
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+	c.parseAsync("CONNECT {\"user\":\"a2\",\"pass\":\"pwd\",\"verbose\":false}\r\nSUB baz 1\r\nPING\r\n")
+	expectPong(t, cr)
+
+	// The limit is for the whole account.
+	c.parseAsync("SUB bat 2\r\n")
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR") || !strings.Contains(l, ErrTooManyAccountSubs.Error()) {
+		t.Fatalf("Expected an ERR for max account subscriptions exceeded, got: %v", l)
+	}
+	if n := s.NumSubsLimitExceeded(); n != 1 {
+		t.Fatalf("Expected 1 violation, got %v", n)
+	}
+	if v, _ := s.Varz(nil); v.SubsExceeded != 1 {
+		t.Fatalf("Expected 1 violation in varz, got %v", v.SubsExceeded)
+	}
+
+	// Other accounts are not affected.
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s", s.Addr()))
+	defer ncb.Close()
+	for i := 0; i < 5; i++ {
+		natsSubSync(t, ncb, fmt.Sprintf("foo.%d", i))
+	}
+	natsFlush(t, ncb)
+
+	// Removing a subscription makes room again.
+	natsUnsub(t, sub)
+	natsFlush(t, nc)
+	c.parseAsync("SUB bat 2\r\nPING\r\n")
+	expectPong(t, cr)
+	if n := s.NumSubsLimitExceeded(); n != 1 {
+		t.Fatalf("Expected 1 violation, got %v", n)
+	}
+}
+
+func TestAccountMaxSubscriptionsCountsOnlyClients(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				max_subscriptions: 2
+				users [{user: a, password: pwd}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	// The interest of remote servers is not limited.
+	for i := 0; i < 3; i++ {
+		rsub := &subscription{client: &client{kind: ROUTER}, subject: []byte(fmt.Sprintf("remote.%d", i))}
+		if err := acc.sl.Insert(rsub); err != nil {
+			t.Fatalf("Error inserting subscription: %v", err)
+		}
+	}
+
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s", s.Addr()))
+	defer nc.Close()
+	natsSubSync(t, nc, "foo")
+	natsSubSync(t, nc, "bar")
+	natsFlush(t, nc)
+	if n := s.NumSubsLimitExceeded(); n != 0 {
+		t.Fatalf("Expected no violation, got %v", n)
+	}
+	natsSubSync(t, nc, "baz")
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumSubsLimitExceeded(); n != 1 {
+			return fmt.Errorf("Expected 1 violation, got %v", n)
+		}
+		return nil
+	})
+
+	// The subscriptions of the closed connections are no longer counted.
+	nc.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&acc.csubs); n != 0 {
+			return fmt.Errorf("Expected no client subscriptions, got %v", n)
+		}
+		return nil
+	})
+}
+
+func TestAccountMaxSubscriptionsCountsRemovedOnly(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				max_subscriptions: 10
+				users [{user: a, password: pwd}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s", s.Addr()))
+	defer nc.Close()
+	natsSubSync(t, nc, "foo")
+	natsSubSync(t, nc, "bar")
+	natsFlush(t, nc)
+
+	// One of the subscriptions is already gone from the sublist, and no
+	// longer counted, when the connection is closed.
+	clients := acc.localClients()
+	if len(clients) != 1 {
+		t.Fatalf("Expected 1 client, got %d", len(clients))
+	}
+	c := clients[0]
+	c.mu.Lock()
+	var sub *subscription
+	for _, sub = range c.subs {
+		break
+	}
+	c.mu.Unlock()
+	if err := acc.sl.Remove(sub); err != nil {
+		t.Fatalf("Error removing subscription: %v", err)
+	}
+	atomic.AddInt32(&acc.csubs, -1)
+
+	nc.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&acc.csubs); n == 1 {
+			return fmt.Errorf("Expected the subscriptions to be removed")
+		}
+		return nil
+	})
+	if n := atomic.LoadInt32(&acc.csubs); n != 0 {
+		t.Fatalf("Expected no client subscriptions, got %v", n)
+	}
+}
+
+func TestAccountMaxSubscriptionsConfigErrors(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accounts { FOO { max_subscriptions: -1 } }
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "invalid max_subscriptions") {
+		t.Fatalf("Expected error about max_subscriptions, got %v", err)
+	}
+}
+
+func TestAccountMaxPayloadAndControlLine(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_payload: 1024
+		max_control_line: 256
+		accounts {
+			BIG {
+				max_payload: 4096
+				max_control_line: 1024
+				users [{user: big, password: pwd}]
+			}
+			SMALL { users [{user: small, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// The limits are sent in the INFO that follows the CONNECT.
+	ncb := natsConnect(t, fmt.Sprintf("nats://big:pwd@%s", s.Addr()))
+	defer ncb.Close()
+	natsFlush(t, ncb)
+	if mp := ncb.MaxPayload(); mp != 4096 {
+		t.Fatalf("Expected max payload of 4096, got %v", mp)
+	}
+	sub := natsSubSync(t, ncb, "foo")
+	natsPub(t, ncb, "foo", make([]byte, 2048))
+	if msg := natsNexMsg(t, sub, time.Second); len(msg.Data) != 2048 {
+		t.Fatalf("Unexpected message size: %v", len(msg.Data))
+	}
+
+	ncs := natsConnect(t, fmt.Sprintf("nats://small:pwd@%s", s.Addr()))
+	defer ncs.Close()
+	natsFlush(t, ncs)
+	if mp := ncs.MaxPayload(); mp != 1024 {
+		t.Fatalf("Expected max payload of 1024, got %v", mp)
+	}
+	if err := ncs.Publish("foo", make([]byte, 2048)); err != nats.ErrMaxPayload {
+		t.Fatalf("Expected %v, got %v", nats.ErrMaxPayload, err)
+	}
+
+	// The control line is checked when it does not fit in a single read.
+	longSubj := strings.Repeat("a", 512)
+	connectAndSub := func(user string) string {
+		t.Helper()
+		c, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		cr := bufio.NewReader(c)
+		cr.ReadString('\n')
+		fmt.Fprintf(c, "CONNECT {\"user\":%q,\"pass\":\"pwd\",\"verbose\":false,\"protocol\":1}\r\nPING\r\n", user)
+		expectPong(t, cr)
+		if user == "big" {
+			l, _ := cr.ReadString('\n')
+			var info Info
+			if !strings.HasPrefix(l, "INFO ") || json.Unmarshal([]byte(l[5:]), &info) != nil {
+				t.Fatalf("Expected INFO, got %q", l)
+			}
+			if info.MaxPayload != 4096 || info.MaxControlLine != 1024 {
+				t.Fatalf("Unexpected INFO: %q", l)
+			}
+		}
+		fmt.Fprintf(c, "SUB %s", longSubj)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(c, " 1\r\nPING\r\n")
+		l, _ := cr.ReadString('\n')
+		return l
+	}
+	if l := connectAndSub("big"); !strings.HasPrefix(l, "PONG") {
+		t.Fatalf("Expected a PONG, got %q", l)
+	}
+	if l := connectAndSub("small"); !strings.Contains(l, ErrMaxControlLine.Error()) {
+		t.Fatalf("Expected max control line error, got %q", l)
+	}
+
+	conf = createConfFile(t, []byte(`
+		max_pending: 2048
+		accounts { BIG { max_payload: 4096 } }
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "can not be greater than max_pending") {
+		t.Fatalf("Expected error about max_pending, got %v", err)
+	}
+}
+
+func TestAccountSubjectTransform(t *testing.T) {
+	for _, test := range []struct {
+		src, dest, subject, expected string
+	}{
+		{"foo.*", "bar.*", "foo.a", "bar.a"},
+		{"foo.*.*", "bar.$2.$1", "foo.a.b", "bar.b.a"},
+		{"foo.*.>", "bar.$1.baz.>", "foo.a.b.c", "bar.a.baz.b.c"},
+		{"foo.*", "$SYS.$1", "foo.a", "$SYS.a"},
+		{"foo.bar", "baz", "foo.bar", "baz"},
+	} {
+		tr, err := newTransform(test.src, test.dest)
+		if err != nil {
+			t.Fatalf("Error creating transform %q -> %q: %v", test.src, test.dest, err)
+		}
+		subj, err := tr.transformSubject(test.subject)
+		if err != nil || subj != test.expected {
+			t.Fatalf("Expected %q to map to %q, got %q (%v)", test.subject, test.expected, subj, err)
+		}
+		// Check that it maps back, with wildcards in the subscription subject too.
+		rtr, err := tr.reverse()
+		if err != nil {
+			t.Fatalf("Error reversing transform %q -> %q: %v", test.src, test.dest, err)
+		}
+		if subj, _ = rtr.transformSubject(test.expected); subj != test.subject {
+			t.Fatalf("Expected %q to map back to %q, got %q", test.expected, test.subject, subj)
+		}
+	}
+	for _, test := range []struct{ src, dest string }{
+		{"foo.*", "bar.$2"},
+		{"foo.*", "bar.$0"},
+		{"foo.bar", "bar.*"},
+		{"foo.>", "bar.>.baz"},
+		{"foo.*.>", "bar.>.$1"},
+	} {
+		if _, err := newTransform(test.src, test.dest); err != ErrBadSubjectTransform {
+			t.Fatalf("Expected error for %q -> %q, got %v", test.src, test.dest, err)
+		}
+	}
+	// Wildcards need to be referenced exactly once to be reversible.
+	for _, dest := range []string{"bar.$1", "bar.$1.$1.$2"} {
+		tr, err := newTransform("foo.*.*", dest)
+		if err != nil {
+			t.Fatalf("Error creating transform: %v", err)
+		}
+		if _, err := tr.reverse(); err != ErrBadSubjectTransform {
+			t.Fatalf("Expected error reversing %q, got %v", dest, err)
+		}
+	}
+}
+
+func TestAccountMappedStreamImport(t *testing.T) {
+	kp, _ := nkeys.CreateAccount()
+	pub, _ := kp.PublicKey()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users [{user: a, password: pwd}]
+				exports [{stream: "events.>", accounts: [%q]}]
+			}
+			B {
+				nkey: %q
+				users [{user: b, password: pwd}]
+				imports [{stream: {account: A, subject: "events.*.*"}, to: "tenant1.events.$2.$1"}]
+			}
+		}
+	`, pub, pub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s", s.Addr()))
+	defer nca.Close()
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s", s.Addr()))
+	defer ncb.Close()
+
+	literal := natsSubSync(t, ncb, "tenant1.events.b.a")
+	partial := natsSubSync(t, ncb, "tenant1.events.*.a")
+	full := natsSubSync(t, ncb, "tenant1.>")
+	other := natsSubSync(t, ncb, "tenant1.events.c.a")
+	natsFlush(t, ncb)
+
+	natsPub(t, nca, "events.a.b", []byte("hello"))
+	natsFlush(t, nca)
+	for _, sub := range []*nats.Subscription{literal, partial, full} {
+		if msg := natsNexMsg(t, sub, time.Second); msg.Subject != "tenant1.events.b.a" {
+			t.Fatalf("Unexpected subject: %q", msg.Subject)
+		}
+	}
+	if msg, err := other.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message: %q", msg.Subject)
+	}
+
+	// Only accounts in the export list can import.
+	conf = createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A { exports [{stream: "events.>", accounts: [%q]}] }
+			B { nkey: %q }
+			C { imports [{stream: {account: A, subject: "events.*.*"}, to: "tenant1.events.$2.$1"}] }
+		}
+	`, pub, pub)))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), ErrStreamImportAuthorization.Error()) {
+		t.Fatalf("Expected authorization error, got %v", err)
+	}
+
+	// A prefix can not be combined with a mapping.
+	conf = createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A { exports [{stream: "events.>"}] }
+			B { imports [{stream: {account: A, subject: "events.*"}, prefix: "p", to: "tenant1.$1"}] }
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), ErrStreamImportBadMapping.Error()) {
+		t.Fatalf("Expected mapping error, got %v", err)
+	}
+}
+
+func TestAccountMappedServiceImport(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users [{user: a, password: pwd}]
+				exports [{service: "req.*.*"}]
+			}
+			B {
+				users [{user: b, password: pwd}]
+				imports [{service: {account: A, subject: "req.$2.$1"}, to: "tenant1.req.*.*"}]
+			}
+			C {
+				users [{user: c, password: pwd}]
+				imports [{service: {account: A, subject: "req.*.*"}, to: "tenant2.req.*.*"}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s", s.Addr()))
+	defer nca.Close()
+	if _, err := nca.Subscribe("req.>", func(m *nats.Msg) {
+		m.Respond([]byte(m.Subject))
+	}); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	natsFlush(t, nca)
+
+	for _, test := range []struct {
+		user, subject, expected string
+	}{
+		{"b", "tenant1.req.x.y", "req.y.x"},
+		{"c", "tenant2.req.x.y", "req.x.y"},
+	} {
+		nc := natsConnect(t, fmt.Sprintf("nats://%s:pwd@%s", test.user, s.Addr()))
+		defer nc.Close()
+		resp, err := nc.Request(test.subject, nil, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		if string(resp.Data) != test.expected {
+			t.Fatalf("Expected request on %q to be mapped to %q, got %q", test.subject, test.expected, resp.Data)
+		}
+	}
+
+	// The import subject has to be covered by the export.
+	acc, _ := s.LookupAccount("A")
+	bad := NewAccount("D")
+	if err := bad.AddServiceImport(acc, "tenant3.>", "req.>"); err != ErrServiceImportAuthorization {
+		t.Fatalf("Expected %v, got %v", ErrServiceImportAuthorization, err)
+	}
+}
+
+func TestAccountWildcardServiceExportReplyIsolation(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users [{user: a, password: pwd}]
+				exports [{service: "svc.>", accounts: [B, C]}]
+			}
+			B {
+				users [{user: b, password: pwd}]
+				imports [{service: {account: A, subject: "svc.b.*"}, to: "svc.*"}]
+			}
+			C {
+				users [{user: c, password: pwd}]
+				imports [{service: {account: A, subject: "svc.c.*"}, to: "svc.*"}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, _ := s.LookupAccount("A")
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s", s.Addr()))
+	defer nca.Close()
+	reqs := make(chan *nats.Msg, 10)
+	if _, err := nca.ChanSubscribe("svc.>", reqs); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	natsFlush(t, nca)
+
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s", s.Addr()))
+	defer ncb.Close()
+	ncc := natsConnect(t, fmt.Sprintf("nats://c:pwd@%s", s.Addr()))
+	defer ncc.Close()
+
+	// Each importer gets its own reply mapping, the responder never
+	// sees the requestors' reply subjects.
+	bsub := natsSubSync(t, ncb, "b.reply")
+	csub := natsSubSync(t, ncc, "c.reply")
+	natsFlush(t, ncb)
+	natsFlush(t, ncc)
+	if err := ncb.PublishRequest("svc.foo", "b.reply", []byte("b")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if err := ncc.PublishRequest("svc.foo", "c.reply", []byte("c")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	replies := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-reqs:
+			if !strings.HasPrefix(m.Reply, replyPrefix) {
+				t.Fatalf("Expected reply to be mapped, got %q", m.Reply)
+			}
+			replies[m.Subject] = m.Reply
+		case <-time.After(time.Second):
+			t.Fatalf("Did not receive request")
+		}
+	}
+	if len(replies) != 2 || replies["svc.b.foo"] == replies["svc.c.foo"] {
+		t.Fatalf("Unexpected requests: %v", replies)
+	}
+	natsPub(t, nca, replies["svc.b.foo"], []byte("for b"))
+	natsPub(t, nca, replies["svc.c.foo"], []byte("for c"))
+	if msg := natsNexMsg(t, bsub, time.Second); string(msg.Data) != "for b" {
+		t.Fatalf("Unexpected response: %q", msg.Data)
+	}
+	if msg := natsNexMsg(t, csub, time.Second); string(msg.Data) != "for c" {
+		t.Fatalf("Unexpected response: %q", msg.Data)
+	}
+	// A reply mapping can only be used once.
+	natsPub(t, nca, replies["svc.b.foo"], []byte("again"))
+	natsFlush(t, nca)
+	if msg, err := bsub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected response: %q", msg.Data)
+	}
+
+	// Late responses are dropped once the mapping has expired, and the
+	// mapping is removed even though we are below the limit.
+	acc.SetAutoExpireTTL(100 * time.Millisecond)
+	if err := ncb.PublishRequest("svc.foo", "b.reply", []byte("b")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	var late *nats.Msg
+	select {
+	case late = <-reqs:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive request")
+	}
+	time.Sleep(150 * time.Millisecond)
+	natsPub(t, nca, late.Reply, []byte("late"))
+	natsFlush(t, nca)
+	if msg, err := bsub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected response: %q", msg.Data)
+	}
+	if err := ncc.PublishRequest("svc.foo", "c.reply", []byte("c")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	select {
+	case <-reqs:
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive request")
+	}
+	if n := acc.NumServiceImports(); n != 1 {
+		t.Fatalf("Expected a response mapping, got %v", n)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := acc.NumServiceImports(); n != 0 {
+			return fmt.Errorf("Expected no response mappings, got %v", n)
+		}
+		return nil
+	})
+}
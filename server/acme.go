@@ -0,0 +1,172 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// ACMEChallengeHTTP01 answers the ACME challenges over HTTP on port 80.
+	ACMEChallengeHTTP01 = "http-01"
+	// ACMEChallengeTLSALPN01 answers the ACME challenges during the TLS
+	// handshake on port 443.
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+
+	// DEFAULT_ACME_HTTP_LISTEN is where the http-01 challenges are answered.
+	DEFAULT_ACME_HTTP_LISTEN = ":80"
+)
+
+func validateACMEOptions(o *Options) error {
+	ao := &o.ACME
+	if len(ao.Domains) == 0 {
+		if ao.CacheDir != _EMPTY_ || ao.Email != _EMPTY_ || ao.DirectoryURL != _EMPTY_ {
+			return fmt.Errorf("acme requires at least one domain")
+		}
+		return nil
+	}
+	for _, d := range ao.Domains {
+		if d == _EMPTY_ || net.ParseIP(d) != nil || strings.ContainsAny(d, "/: ") {
+			return fmt.Errorf("invalid acme domain %q", d)
+		}
+	}
+	if !ao.AcceptTOS {
+		return fmt.Errorf("acme requires accept_tos to be set to agree to the CA's terms of service")
+	}
+	if ao.CacheDir == _EMPTY_ {
+		return fmt.Errorf("acme requires a cache_dir to store the account key and certificates")
+	}
+	switch ao.Challenge {
+	case _EMPTY_, ACMEChallengeHTTP01, ACMEChallengeTLSALPN01:
+	default:
+		return fmt.Errorf("invalid acme challenge %q, expected %q or %q",
+			ao.Challenge, ACMEChallengeHTTP01, ACMEChallengeTLSALPN01)
+	}
+	if ao.HTTPListen != _EMPTY_ {
+		if _, _, err := net.SplitHostPort(ao.HTTPListen); err != nil {
+			return fmt.Errorf("invalid acme http_listen %q: %v", ao.HTTPListen, err)
+		}
+	}
+	if o.TLSConfig != nil {
+		return fmt.Errorf("acme and tls can not both be configured for the client listener")
+	}
+	return nil
+}
+
+// configureACME creates the ACME client, if configured, and sets the TLS
+// configuration of the client and monitoring listeners to serve the
+// certificates it obtains.
+func configureACME(o *Options) (*autocert.Manager, error) {
+	if err := validateACMEOptions(o); err != nil {
+		return nil, err
+	}
+	ao := &o.ACME
+	if len(ao.Domains) == 0 {
+		return nil, nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(ao.CacheDir),
+		HostPolicy: autocert.HostWhitelist(ao.Domains...),
+		Email:      ao.Email,
+	}
+	if ao.DirectoryURL != _EMPTY_ {
+		m.Client = &acme.Client{DirectoryURL: ao.DirectoryURL}
+	}
+	o.TLSConfig = acmeTLSConfig(m, ao)
+	return m, nil
+}
+
+func acmeTLSConfig(m *autocert.Manager, ao *ACMEOpts) *tls.Config {
+	config := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CipherSuites:             defaultCipherSuites(),
+		PreferServerCipherSuites: true,
+		CurvePreferences:         defaultCurvePreferences(),
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Clients connecting by IP do not send a server name, so
+			// serve the certificate of the first domain.
+			if hello.ServerName == _EMPTY_ {
+				h := *hello
+				h.ServerName = ao.Domains[0]
+				hello = &h
+			}
+			return m.GetCertificate(hello)
+		},
+	}
+	if ao.Challenge == ACMEChallengeTLSALPN01 {
+		config.NextProtos = []string{acme.ALPNProto}
+	}
+	return config
+}
+
+// startACME answers the ACME http-01 challenges, if configured.
+func (s *Server) startACME() error {
+	s.mu.Lock()
+	m := s.acme
+	s.mu.Unlock()
+	opts := s.getOpts()
+	if m == nil || opts.ACME.Challenge == ACMEChallengeTLSALPN01 {
+		return nil
+	}
+	hp := opts.ACME.HTTPListen
+	if hp == _EMPTY_ {
+		hp = DEFAULT_ACME_HTTP_LISTEN
+	}
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		return fmt.Errorf("can't listen to the acme http port: %v", err)
+	}
+	s.Noticef("Listening for ACME %s challenges on %s", ACMEChallengeHTTP01, l.Addr())
+
+	s.mu.Lock()
+	s.acmeListener = l
+	s.mu.Unlock()
+
+	srv := &http.Server{
+		Handler:        m.HTTPHandler(http.NotFoundHandler()),
+		ReadTimeout:    2 * time.Second,
+		WriteTimeout:   2 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		srv.Serve(l)
+	})
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		<-s.quitCh
+		srv.Close()
+	})
+	return nil
+}
+
+// ACMEListenAddr returns the address the ACME http-01 challenges are
+// answered on, or nil if none.
+func (s *Server) ACMEListenAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.acmeListener == nil {
+		return nil
+	}
+	return s.acmeListener.Addr().(*net.TCPAddr)
+}
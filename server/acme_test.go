@@ -0,0 +1,150 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMEOptions(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		acme ACMEOpts
+		tls  bool
+		err  string
+	}{
+		{"disabled", ACMEOpts{}, false, ""},
+		{"valid", ACMEOpts{Domains: []string{"nats.example.com"}, CacheDir: "cache", AcceptTOS: true}, false, ""},
+		{"alpn", ACMEOpts{Domains: []string{"nats.example.com"}, CacheDir: "cache", AcceptTOS: true, Challenge: ACMEChallengeTLSALPN01}, false, ""},
+		{"no domain", ACMEOpts{CacheDir: "cache"}, false, "at least one domain"},
+		{"ip domain", ACMEOpts{Domains: []string{"127.0.0.1"}, CacheDir: "cache", AcceptTOS: true}, false, "invalid acme domain"},
+		{"no tos", ACMEOpts{Domains: []string{"nats.example.com"}, CacheDir: "cache"}, false, "accept_tos"},
+		{"no cache", ACMEOpts{Domains: []string{"nats.example.com"}, AcceptTOS: true}, false, "cache_dir"},
+		{"bad challenge", ACMEOpts{Domains: []string{"nats.example.com"}, CacheDir: "cache", AcceptTOS: true, Challenge: "dns-01"}, false, "invalid acme challenge"},
+		{"bad listen", ACMEOpts{Domains: []string{"nats.example.com"}, CacheDir: "cache", AcceptTOS: true, HTTPListen: "80"}, false, "invalid acme http_listen"},
+		{"with tls", ACMEOpts{Domains: []string{"nats.example.com"}, CacheDir: "cache", AcceptTOS: true}, true, "can not both be configured"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := DefaultOptions()
+			o.ACME = test.acme
+			if test.tls {
+				o.TLSConfig = &tls.Config{}
+			}
+			m, err := configureACME(o)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(test.acme.Domains) == 0 {
+				if m != nil || o.TLSConfig != nil {
+					t.Fatal("Expected no ACME client")
+				}
+				return
+			}
+			if m == nil || o.TLSConfig == nil || o.TLSConfig.GetCertificate == nil {
+				t.Fatal("Expected ACME client and TLS config")
+			}
+			alpn := len(o.TLSConfig.NextProtos) == 1 && o.TLSConfig.NextProtos[0] == acme.ALPNProto
+			if alpn != (test.acme.Challenge == ACMEChallengeTLSALPN01) {
+				t.Fatalf("Unexpected protocols: %v", o.TLSConfig.NextProtos)
+			}
+		})
+	}
+}
+
+func TestACMEServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := `
+		listen: 127.0.0.1:-1
+		acme {
+			domains: [%s]
+			email: "admin@example.com"
+			cache_dir: %q
+			http_listen: "127.0.0.1:0"
+			accept_tos: true
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, `"nats.example.com"`, dir)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if opts.ACME.Email != "admin@example.com" || len(opts.ACME.Domains) != 1 {
+		t.Fatalf("Unexpected options: %+v", opts.ACME)
+	}
+	s.mu.Lock()
+	tlsRequired := s.info.TLSRequired
+	s.mu.Unlock()
+	if !tlsRequired {
+		t.Fatal("Expected TLS to be required")
+	}
+
+	// Certificates are only requested for the configured domains.
+	config := s.getOpts().TLSConfig
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Fatal("Expected error for a domain that is not configured")
+	}
+
+	addr := s.ACMEListenAddr()
+	if addr == nil {
+		t.Fatal("Expected http-01 challenge listener")
+	}
+	get := func(path string, expected int) {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, path))
+		if err != nil {
+			t.Fatalf("Error on get: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("Expected status %v for %q, got %v", expected, path, resp.StatusCode)
+		}
+	}
+	// Challenges are answered, but not for other hosts.
+	get("/.well-known/acme-challenge/token", http.StatusForbidden)
+	// And nothing else is served.
+	get("/varz", http.StatusNotFound)
+
+	// A reload keeps the ACME client's certificates.
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if s.getOpts().TLSConfig != config {
+		t.Fatal("Expected TLS config to be kept")
+	}
+
+	// But the ACME client can't be reconfigured.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, `"nats.example.com", "nats2.example.com"`, dir)))
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "not supported for ACME") {
+		t.Fatalf("Expected reload error, got %v", err)
+	}
+}
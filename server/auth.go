@@ -25,38 +25,56 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Authentication is an interface for implementing authentication
+// Authentication is an interface for implementing authentication.
+// Applications embedding the server set it as the Options'
+// CustomClientAuthentication or CustomRouterAuthentication to verify
+// the credentials themselves. Check may call RegisterUser or
+// RegisterNkeyUser to set the account and permissions of the client.
 type Authentication interface {
 	// Check if a client is authorized to connect
 	Check(c ClientAuthentication) bool
 }
 
+// ClientOpts are the options sent by a client in its CONNECT protocol,
+// including its credentials.
+type ClientOpts = clientOpts
+
 // ClientAuthentication is an interface for client authentication
 type ClientAuthentication interface {
 	// Get options associated with a client
-	GetOpts() *clientOpts
+	GetOpts() *ClientOpts
 	// If TLS is enabled, TLS ConnectionState, nil otherwise
 	GetTLSConnectionState() *tls.ConnectionState
 	// Optionally map a user after auth.
 	RegisterUser(*User)
+	// Optionally map an nkey user after auth. An error is returned
+	// if the client can not be registered with the user's account.
+	RegisterNkeyUser(*NkeyUser) error
 	// RemoteAddress expose the connection information of the client
 	RemoteAddress() net.Addr
 }
 
 // NkeyUser is for multiple nkey based users
 type NkeyUser struct {
-	Nkey        string       `json:"user"`
-	Permissions *Permissions `json:"permissions,omitempty"`
-	Account     *Account     `json:"account,omitempty"`
-	SigningKey  string       `json:"signing_key,omitempty"`
+	Nkey        string        `json:"user"`
+	Permissions *Permissions  `json:"permissions,omitempty"`
+	Account     *Account      `json:"account,omitempty"`
+	SigningKey  string        `json:"signing_key,omitempty"`
+	Networks    *NetworkACL   `json:"networks,omitempty"`
+	Validity    *UserValidity `json:"validity,omitempty"`
+
+	// When the user JWT was issued, to check for revocations.
+	issuedAt int64
 }
 
 // User is for multiple accounts/users.
 type User struct {
-	Username    string       `json:"user"`
-	Password    string       `json:"password"`
-	Permissions *Permissions `json:"permissions,omitempty"`
-	Account     *Account     `json:"account,omitempty"`
+	Username    string        `json:"user"`
+	Password    string        `json:"password" secret:"true"`
+	Permissions *Permissions  `json:"permissions,omitempty"`
+	Account     *Account      `json:"account,omitempty"`
+	Networks    *NetworkACL   `json:"networks,omitempty"`
+	Validity    *UserValidity `json:"validity,omitempty"`
 }
 
 // clone performs a deep copy of the User struct, returning a new clone with
@@ -439,10 +457,14 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 			c.Debugf("Signature not verified")
 			return false
 		}
-		if acc.checkUserRevoked(juc.Subject) {
+		if acc.checkUserRevoked(juc.Subject, juc.IssuedAt) {
 			c.Debugf("User authentication revoked")
 			return false
 		}
+		if s.accountRevoked(acc) {
+			c.Debugf("Account authentication revoked")
+			return false
+		}
 
 		nkey = buildInternalNkeyUser(juc, acc)
 		if err := c.RegisterNkeyUser(nkey); err != nil {
@@ -480,6 +502,13 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 			c.Debugf("Signature not verified")
 			return false
 		}
+		if !nkey.Networks.allows(c.host) {
+			c.Debugf("User %q not allowed to connect from %q", nkey.Nkey, c.host)
+			return false
+		}
+		if !c.checkValidity(nkey.Validity) {
+			return false
+		}
 		if err := c.RegisterNkeyUser(nkey); err != nil {
 			return false
 		}
@@ -488,6 +517,13 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 
 	if user != nil {
 		ok = comparePasswords(user.Password, c.opts.Password)
+		if ok && !user.Networks.allows(c.host) {
+			c.Debugf("User %q not allowed to connect from %q", user.Username, c.host)
+			ok = false
+		}
+		if ok && !c.checkValidity(user.Validity) {
+			ok = false
+		}
 		// If we are authorized, register the user which will properly setup any permissions
 		// for pub/sub authorizations.
 		if ok {
@@ -656,6 +692,10 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 		// This is expected to be a very small array.
 		for _, u := range opts.LeafNode.Users {
 			if u.Username == c.opts.Username {
+				if !u.Networks.allows(c.host) {
+					c.Debugf("User %q not allowed to connect from %q", u.Username, c.host)
+					return false
+				}
 				var accName string
 				if u.Account != nil {
 					accName = u.Account.Name
@@ -0,0 +1,563 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default size of the buffer of a protocol capture.
+	defaultCaptureMaxBytes = 1024 * 1024
+	// Maximum size of the buffer of a protocol capture.
+	maxCaptureMaxBytes = 64 * 1024 * 1024
+	// Maximum number of captures kept by the server, stopped captures
+	// are removed, oldest first, to make room for new ones.
+	maxCaptures = 16
+)
+
+// Direction of the captured protocol data.
+const (
+	captureIn = iota
+	captureOut
+)
+
+// CaptureRequest starts capturing the raw protocol traffic of a client or
+// leafnode connection. The oldest traffic is dropped once MaxBytes are
+// captured. Payloads are replaced by their size if Redact is set, or
+// truncated to PayloadLimit bytes. The capture stops after Duration if set,
+// or when the connection is closed.
+type CaptureRequest struct {
+	CID          uint64        `json:"cid"`
+	MaxBytes     int           `json:"max_bytes,omitempty"`
+	Redact       bool          `json:"redact,omitempty"`
+	PayloadLimit int           `json:"payload_limit,omitempty"`
+	Duration     time.Duration `json:"duration,omitempty"`
+}
+
+// CaptureInfo describes a protocol capture.
+type CaptureInfo struct {
+	CID          uint64    `json:"cid"`
+	Kind         string    `json:"kind"`
+	Account      string    `json:"account,omitempty"`
+	Name         string    `json:"name,omitempty"`
+	Active       bool      `json:"active"`
+	Start        time.Time `json:"start"`
+	Stop         time.Time `json:"stop,omitempty"`
+	MaxBytes     int       `json:"max_bytes"`
+	Redact       bool      `json:"redact,omitempty"`
+	PayloadLimit int       `json:"payload_limit,omitempty"`
+	Bytes        int       `json:"bytes"`
+	Dropped      int64     `json:"dropped_bytes"`
+}
+
+// Capturez is the response of the /capturez endpoint.
+type Capturez struct {
+	ID       string        `json:"server_id"`
+	Now      time.Time     `json:"now"`
+	Captures []CaptureInfo `json:"captures"`
+}
+
+// protoCaptures are the captures of the connections of the server, by cid.
+type protoCaptures struct {
+	sync.Mutex
+	captures map[uint64]*protoCapture
+}
+
+// protoCapture is the bounded buffer of the protocol traffic of a
+// connection.
+type protoCapture struct {
+	sync.Mutex
+	info    CaptureInfo
+	entries []captureEntry
+	timer   *time.Timer
+	parsers [2]captureParser
+}
+
+type captureEntry struct {
+	time time.Time
+	dir  int
+	data []byte
+}
+
+// captureParser follows the protocol in one direction to redact the
+// secrets of CONNECT and the message payloads. Control lines are captured
+// once complete, so one split between two reads shows up in the entry of
+// the second read.
+type captureParser struct {
+	line     []byte
+	payload  int
+	keep     int
+	redacted int
+}
+
+// Secrets of CONNECT always removed from the captures.
+var captureSecretsPat = regexp.MustCompile(`"(pass|auth_token|jwt|sig)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+
+// filter returns the data to capture.
+func (p *captureParser) filter(data []byte, redact bool, limit int) []byte {
+	var out []byte
+	for len(data) > 0 {
+		if p.payload > 0 {
+			n := p.payload
+			if n > len(data) {
+				n = len(data)
+			}
+			keep := p.keep
+			if keep > n {
+				keep = n
+			}
+			out = append(out, data[:keep]...)
+			p.keep -= keep
+			p.redacted += n - keep
+			p.payload -= n
+			data = data[n:]
+			if p.payload == 0 && p.redacted > 0 {
+				out = append(out, fmt.Sprintf("[%d bytes redacted]", p.redacted)...)
+				p.redacted = 0
+			}
+			continue
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			p.line = append(p.line, data...)
+			// Not a control line we know of, do not hold it.
+			if len(p.line) > MAX_CONTROL_LINE_SIZE {
+				out = append(out, p.line...)
+				p.line = p.line[:0]
+			}
+			break
+		}
+		line := data[:i+1]
+		if len(p.line) > 0 {
+			line = append(p.line, line...)
+			p.line = p.line[:0]
+		}
+		data = data[i+1:]
+		out = append(out, p.controlLine(line, redact, limit)...)
+	}
+	return out
+}
+
+// controlLine returns the control line to capture and sets the size of the
+// payload that follows, if any.
+func (p *captureParser) controlLine(line []byte, redact bool, limit int) []byte {
+	args := bytes.Fields(line)
+	if len(args) == 0 {
+		return line
+	}
+	switch string(bytes.ToUpper(args[0])) {
+	case "CONNECT":
+		return captureSecretsPat.ReplaceAll(line, []byte(`"$1":"[REDACTED]"`))
+	case "PUB", "HPUB", "MSG", "HMSG", "RMSG", "LMSG":
+		if len(args) < 3 {
+			return line
+		}
+		size, err := strconv.Atoi(string(args[len(args)-1]))
+		if err != nil || size <= 0 {
+			return line
+		}
+		p.payload, p.keep = size, size
+		if redact {
+			p.keep = 0
+		} else if limit > 0 && limit < size {
+			p.keep = limit
+		}
+	}
+	return line
+}
+
+// record adds the data read from, or written to, the connection.
+func (pc *protoCapture) record(dir int, data []byte) {
+	pc.Lock()
+	defer pc.Unlock()
+	if !pc.info.Active {
+		return
+	}
+	data = pc.parsers[dir].filter(data, pc.info.Redact, pc.info.PayloadLimit)
+	if len(data) == 0 {
+		return
+	}
+	if len(data) > pc.info.MaxBytes {
+		pc.info.Dropped += int64(len(data) - pc.info.MaxBytes)
+		data = data[len(data)-pc.info.MaxBytes:]
+	}
+	pc.entries = append(pc.entries, captureEntry{time.Now(), dir, append([]byte(nil), data...)})
+	pc.info.Bytes += len(data)
+	// Drop the oldest traffic.
+	for pc.info.Bytes > pc.info.MaxBytes {
+		e := pc.entries[0]
+		pc.entries[0] = captureEntry{}
+		pc.entries = pc.entries[1:]
+		pc.info.Bytes -= len(e.data)
+		pc.info.Dropped += int64(len(e.data))
+	}
+}
+
+// recordBuffers adds the first n bytes of the buffers written to the
+// connection.
+func (pc *protoCapture) recordBuffers(nb net.Buffers, n int64) {
+	for _, b := range nb {
+		if n <= 0 {
+			break
+		}
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		pc.record(captureOut, b)
+		n -= int64(len(b))
+	}
+}
+
+func (pc *protoCapture) stop() {
+	pc.Lock()
+	if pc.info.Active {
+		pc.info.Active = false
+		pc.info.Stop = time.Now()
+	}
+	if pc.timer != nil {
+		pc.timer.Stop()
+		pc.timer = nil
+	}
+	pc.Unlock()
+}
+
+func (pc *protoCapture) captureInfo() CaptureInfo {
+	pc.Lock()
+	defer pc.Unlock()
+	return pc.info
+}
+
+// writeTo writes the captured traffic as text, each entry preceded by
+// its time, direction and size.
+func (pc *protoCapture) writeTo(w io.Writer) error {
+	pc.Lock()
+	info := pc.info
+	entries := append([]captureEntry(nil), pc.entries...)
+	pc.Unlock()
+
+	fmt.Fprintf(w, "# Capture of %s connection %d", info.Kind, info.CID)
+	if info.Account != _EMPTY_ {
+		fmt.Fprintf(w, ", account %q", info.Account)
+	}
+	if info.Name != _EMPTY_ {
+		fmt.Fprintf(w, ", name %q", info.Name)
+	}
+	fmt.Fprintf(w, "\n# Started %s, %d bytes, %d bytes dropped\n", info.Start.Format(time.RFC3339Nano), info.Bytes, info.Dropped)
+	for _, e := range entries {
+		dir := "<<-"
+		if e.dir == captureOut {
+			dir = "->>"
+		}
+		if _, err := fmt.Fprintf(w, "\n[%s] %s %d bytes\n", e.time.Format(time.RFC3339Nano), dir, len(e.data)); err != nil {
+			return err
+		}
+		if _, err := w.Write(e.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureData records inbound data of the connection when captured.
+func (c *client) captureData(data []byte) {
+	if atomic.LoadInt32(&c.captured) == 0 {
+		return
+	}
+	c.mu.Lock()
+	pc := c.capture
+	c.mu.Unlock()
+	if pc != nil {
+		pc.record(captureIn, data)
+	}
+}
+
+// StartCapture starts capturing the protocol traffic of a connection,
+// replacing its previous capture, if any.
+func (s *Server) StartCapture(req *CaptureRequest) (*CaptureInfo, error) {
+	switch {
+	case req.MaxBytes < 0 || req.MaxBytes > maxCaptureMaxBytes:
+		return nil, fmt.Errorf("max_bytes should be between 0 and %d", maxCaptureMaxBytes)
+	case req.PayloadLimit < 0:
+		return nil, fmt.Errorf("payload_limit can not be negative")
+	case req.Duration < 0:
+		return nil, fmt.Errorf("duration can not be negative")
+	}
+	s.mu.Lock()
+	c := s.clients[req.CID]
+	if c == nil {
+		c = s.leafs[req.CID]
+	}
+	s.mu.Unlock()
+	if c == nil {
+		return nil, fmt.Errorf("connection %d not found", req.CID)
+	}
+
+	pc := &protoCapture{info: CaptureInfo{
+		CID:          req.CID,
+		Active:       true,
+		Start:        time.Now(),
+		MaxBytes:     req.MaxBytes,
+		Redact:       req.Redact,
+		PayloadLimit: req.PayloadLimit,
+	}}
+	if pc.info.MaxBytes == 0 {
+		pc.info.MaxBytes = defaultCaptureMaxBytes
+	}
+
+	cs := &s.captures
+	cs.Lock()
+	if old := cs.captures[req.CID]; old != nil {
+		old.stop()
+		delete(cs.captures, req.CID)
+	}
+	if len(cs.captures) >= maxCaptures && !cs.removeOldestStopped() {
+		cs.Unlock()
+		return nil, fmt.Errorf("too many active captures, maximum is %d", maxCaptures)
+	}
+	if cs.captures == nil {
+		cs.captures = make(map[uint64]*protoCapture)
+	}
+	cs.captures[req.CID] = pc
+	cs.Unlock()
+
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		s.DeleteCapture(req.CID)
+		return nil, fmt.Errorf("connection %d not found", req.CID)
+	}
+	pc.Lock()
+	pc.info.Kind = c.typeString()
+	pc.info.Name = c.opts.Name
+	if c.acc != nil {
+		pc.info.Account = c.acc.Name
+	}
+	pc.Unlock()
+	c.capture = pc
+	atomic.StoreInt32(&c.captured, 1)
+	c.mu.Unlock()
+
+	if req.Duration > 0 {
+		pc.Lock()
+		pc.timer = time.AfterFunc(req.Duration, func() { s.StopCapture(req.CID) })
+		pc.Unlock()
+	}
+	s.Noticef("Started the protocol capture of connection %d", req.CID)
+	info := pc.captureInfo()
+	return &info, nil
+}
+
+// Removes the oldest stopped capture, returns false if they are all
+// active. Lock should be held.
+func (cs *protoCaptures) removeOldestStopped() bool {
+	var oldest *CaptureInfo
+	for _, pc := range cs.captures {
+		info := pc.captureInfo()
+		if !info.Active && (oldest == nil || info.Start.Before(oldest.Start)) {
+			oldest = &info
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(cs.captures, oldest.CID)
+	return true
+}
+
+// StopCapture stops capturing the traffic of a connection, the capture
+// is kept until deleted.
+func (s *Server) StopCapture(cid uint64) error {
+	cs := &s.captures
+	cs.Lock()
+	pc := cs.captures[cid]
+	cs.Unlock()
+	if pc == nil {
+		return fmt.Errorf("no capture for connection %d", cid)
+	}
+	s.detachCapture(cid, pc)
+	pc.stop()
+	return nil
+}
+
+// DeleteCapture stops and removes the capture of a connection.
+func (s *Server) DeleteCapture(cid uint64) error {
+	cs := &s.captures
+	cs.Lock()
+	pc := cs.captures[cid]
+	delete(cs.captures, cid)
+	cs.Unlock()
+	if pc == nil {
+		return fmt.Errorf("no capture for connection %d", cid)
+	}
+	s.detachCapture(cid, pc)
+	pc.stop()
+	return nil
+}
+
+// Removes the capture from its connection, if still open.
+func (s *Server) detachCapture(cid uint64, pc *protoCapture) {
+	s.mu.Lock()
+	c := s.clients[cid]
+	if c == nil {
+		c = s.leafs[cid]
+	}
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.capture == pc {
+		c.capture = nil
+		atomic.StoreInt32(&c.captured, 0)
+	}
+	c.mu.Unlock()
+}
+
+// Stops the capture of a closed connection.
+func (s *Server) stopConnCapture(cid uint64) {
+	cs := &s.captures
+	cs.Lock()
+	pc := cs.captures[cid]
+	cs.Unlock()
+	if pc != nil {
+		pc.stop()
+	}
+}
+
+// Captures returns the protocol captures of the server.
+func (s *Server) Captures() []CaptureInfo {
+	cs := &s.captures
+	cs.Lock()
+	captures := make([]CaptureInfo, 0, len(cs.captures))
+	for _, pc := range cs.captures {
+		captures = append(captures, pc.captureInfo())
+	}
+	cs.Unlock()
+	sort.Slice(captures, func(i, j int) bool { return captures[i].CID < captures[j].CID })
+	return captures
+}
+
+// WriteCapture writes the captured traffic of a connection to w.
+func (s *Server) WriteCapture(cid uint64, w io.Writer) error {
+	cs := &s.captures
+	cs.Lock()
+	pc := cs.captures[cid]
+	cs.Unlock()
+	if pc == nil {
+		return fmt.Errorf("no capture for connection %d", cid)
+	}
+	return pc.writeTo(w)
+}
+
+// Endpoints starting, stopping and deleting the protocol captures. Like
+// CapturezPath, they are only mounted if the monitoring users are
+// authenticated.
+const (
+	CapturezStartPath  = CapturezPath + "/start"
+	CapturezStopPath   = CapturezPath + "/stop"
+	CapturezDeletePath = CapturezPath + "/delete"
+)
+
+// HandleCapturez process HTTP requests for the protocol captures, which
+// downloads the capture of the `cid` parameter, or lists the captures.
+func (s *Server) HandleCapturez(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[CapturezPath]++
+	s.mu.Unlock()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(fmt.Sprintf("Captures can be changed only with a POST request to %s, %s or %s",
+			CapturezStartPath, CapturezStopPath, CapturezDeletePath)))
+		return
+	}
+	if v := r.URL.Query().Get("cid"); v != _EMPTY_ {
+		cid, err := strconv.ParseUint(v, 10, 64)
+		var buf bytes.Buffer
+		if err == nil {
+			err = s.WriteCapture(cid, &buf)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=capture-%d.txt", cid))
+		w.Write(buf.Bytes())
+		return
+	}
+	s.writeCapturez(w, r)
+}
+
+// HandleCapturezChange process HTTP requests to start, stop or delete the
+// capture of a connection, a POST to /capturez/start, /capturez/stop or
+// /capturez/delete with a CaptureRequest as JSON body, only its `cid` being
+// used to stop or delete the capture.
+func (s *Server) HandleCapturezChange(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[CapturezPath]++
+	s.mu.Unlock()
+
+	var change func(req *CaptureRequest) error
+	switch r.URL.Path {
+	case CapturezStartPath:
+		change = func(req *CaptureRequest) error {
+			_, err := s.StartCapture(req)
+			return err
+		}
+	case CapturezStopPath:
+		change = func(req *CaptureRequest) error { return s.StopCapture(req.CID) }
+	case CapturezDeletePath:
+		change = func(req *CaptureRequest) error { return s.DeleteCapture(req.CID) }
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Unknown path %q", r.URL.Path)))
+		return
+	}
+	req := &CaptureRequest{}
+	if !decodeMonitorRequest(w, r, "Captures can be changed", req) {
+		return
+	}
+	if err := change(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.writeCapturez(w, r)
+}
+
+// Writes the list of the captures.
+func (s *Server) writeCapturez(w http.ResponseWriter, r *http.Request) {
+	cz := &Capturez{ID: s.ID(), Now: time.Now(), Captures: s.Captures()}
+	b, err := json.MarshalIndent(cz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /capturez request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureParser(t *testing.T) {
+	proto := "CONNECT {\"user\":\"u\",\"pass\":\"sec\\\"ret\",\"auth_token\":\"tok\"}\r\n" +
+		"PUB foo 5\r\nhello\r\nHPUB bar reply 12 14\r\nNATS/1.0\r\n\r\nhi\r\nPING\r\n"
+	for _, test := range []struct {
+		name   string
+		redact bool
+		limit  int
+		out    string
+	}{
+		{"none", false, 0, "PUB foo 5\r\nhello\r\nHPUB bar reply 12 14\r\nNATS/1.0\r\n\r\nhi\r\nPING\r\n"},
+		{"limit", false, 2, "PUB foo 5\r\nhe[3 bytes redacted]\r\nHPUB bar reply 12 14\r\nNA[12 bytes redacted]\r\nPING\r\n"},
+		{"redact", true, 0, "PUB foo 5\r\n[5 bytes redacted]\r\nHPUB bar reply 12 14\r\n[14 bytes redacted]\r\nPING\r\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Split the protocol in all the possible places.
+			for i := 0; i < len(proto); i++ {
+				var p captureParser
+				out := p.filter([]byte(proto[:i]), test.redact, test.limit)
+				out = append(out, p.filter([]byte(proto[i:]), test.redact, test.limit)...)
+				connect := `CONNECT {"user":"u","pass":"[REDACTED]","auth_token":"[REDACTED]"}` + "\r\n"
+				if string(out) != connect+test.out {
+					t.Fatalf("Unexpected capture split at %d: %q", i, out)
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureMaxBytes(t *testing.T) {
+	pc := &protoCapture{info: CaptureInfo{Active: true, MaxBytes: 10}}
+	pc.record(captureIn, []byte("PING\r\n"))
+	pc.record(captureOut, []byte("PONG\r\n"))
+	pc.record(captureIn, []byte("+OK\r\n"))
+	info := pc.captureInfo()
+	if info.Bytes != 5 || info.Dropped != 12 || len(pc.entries) != 1 {
+		t.Fatalf("Unexpected capture: %+v", info)
+	}
+	pc.record(captureIn, []byte("SUB foo.bar 1\r\n"))
+	if info = pc.captureInfo(); info.Bytes != 10 || info.Dropped != 22 || string(pc.entries[0].data) != "oo.bar 1\r\n" {
+		t.Fatalf("Unexpected capture: %+v", info)
+	}
+	pc.stop()
+	pc.record(captureIn, []byte("PING\r\n"))
+	if info = pc.captureInfo(); info.Active || info.Bytes != 10 {
+		t.Fatalf("Unexpected capture: %+v", info)
+	}
+}
+
+func TestCapturez(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: "127.0.0.1:-1"
+		monitor {
+			users: [
+				{user: ops, password: ops, endpoints: "/capturez"}
+				{user: admin, password: admin, endpoints: ["/capturez", "/capturez/start"]}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	cid, _ := nc.GetClientID()
+	sub := natsSubSync(t, nc, "foo")
+	natsFlush(t, nc)
+
+	capturez := fmt.Sprintf("http://127.0.0.1:%d", s.MonitorAddr().Port)
+	do := func(method, path, user, ct, body string, status int) []byte {
+		t.Helper()
+		req, _ := http.NewRequest(method, capturez+path, strings.NewReader(body))
+		req.SetBasicAuth(user, user)
+		req.Header.Set("Content-Type", ct)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("Expected status %v for %s %s as %s, got %v: %s", status, method, path, user, resp.StatusCode, b)
+		}
+		return b
+	}
+	const ct = "application/json"
+	do(http.MethodPost, CapturezStartPath, "admin", ct, `{"cid":1000}`, http.StatusBadRequest)
+	do(http.MethodPost, CapturezStartPath, "admin", ct, fmt.Sprintf(`{"cid":%d,"max_bytes":-1}`, cid), http.StatusBadRequest)
+	// Listing the captures does not allow to change them.
+	do(http.MethodPost, CapturezPath+fmt.Sprintf("?cid=%d", cid), "admin", ct, "", http.StatusMethodNotAllowed)
+	do(http.MethodPost, CapturezStartPath, "ops", ct, fmt.Sprintf(`{"cid":%d}`, cid), http.StatusForbidden)
+	do(http.MethodPost, CapturezStopPath, "ops", ct, fmt.Sprintf(`{"cid":%d}`, cid), http.StatusForbidden)
+	do(http.MethodPost, CapturezStartPath, "admin", "text/plain", fmt.Sprintf(`{"cid":%d}`, cid), http.StatusUnsupportedMediaType)
+	do(http.MethodGet, CapturezStartPath, "admin", ct, "", http.StatusMethodNotAllowed)
+	do(http.MethodPost, CapturezPath+"/other", "admin", ct, "", http.StatusNotFound)
+	if captures := s.Captures(); len(captures) != 0 {
+		t.Fatalf("Unexpected captures: %+v", captures)
+	}
+	do(http.MethodPost, CapturezStartPath, "admin", ct, fmt.Sprintf(`{"cid":%d,"payload_limit":2}`, cid), http.StatusOK)
+
+	natsPub(t, nc, "foo", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s?cid=%d", capturez, CapturezPath, cid), nil)
+	req.SetBasicAuth("ops", "ops")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if cd := resp.Header.Get("Content-Disposition"); cd != fmt.Sprintf("attachment; filename=capture-%d.txt", cid) {
+		t.Fatalf("Unexpected content disposition %q", cd)
+	}
+	for _, expected := range []string{"<<-", "PUB foo 5\r\nhe[3 bytes redacted]\r\n", "->>", "MSG foo 1 5\r\nhe[3 bytes redacted]\r\n"} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Fatalf("Expected %q in the capture, got %q", expected, body)
+		}
+	}
+
+	do(http.MethodPost, CapturezStopPath, "admin", ct, fmt.Sprintf(`{"cid":%d}`, cid), http.StatusOK)
+	if captures := s.Captures(); len(captures) != 1 || captures[0].Active {
+		t.Fatalf("Expected the capture to stop, got %+v", captures)
+	}
+	// The capture is kept once the connection is closed.
+	nc.Close()
+	body = do(http.MethodGet, CapturezPath, "ops", _EMPTY_, _EMPTY_, http.StatusOK)
+	var cz Capturez
+	if err := json.Unmarshal(body, &cz); err != nil {
+		t.Fatalf("Error unmarshalling response %q: %v", body, err)
+	}
+	if len(cz.Captures) != 1 || cz.Captures[0].CID != cid || cz.Captures[0].Kind != "Client" ||
+		cz.Captures[0].PayloadLimit != 2 || cz.Captures[0].Bytes == 0 {
+		t.Fatalf("Unexpected captures: %+v", cz.Captures)
+	}
+
+	do(http.MethodPost, CapturezDeletePath, "admin", ct, fmt.Sprintf(`{"cid":%d}`, cid), http.StatusOK)
+	if captures := s.Captures(); len(captures) != 0 {
+		t.Fatalf("Expected the capture to be deleted, got %+v", captures)
+	}
+}
+
+func TestCapturezChangeRequiresMonitorAuth(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	cid, _ := nc.GetClientID()
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, CapturezStartPath)
+	resp, err := http.Post(url, "application/json", strings.NewReader(fmt.Sprintf(`{"cid":%d}`, cid)))
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || len(s.Captures()) != 0 {
+		t.Fatalf("Expected the endpoint to be disabled, got %v", resp.StatusCode)
+	}
+
+	// Existing captures can not be downloaded either.
+	if _, err := s.StartCapture(&CaptureRequest{CID: cid}); err != nil {
+		t.Fatalf("Error starting capture: %v", err)
+	}
+	nc.Flush()
+	url = fmt.Sprintf("http://127.0.0.1:%d%s?cid=%d", s.MonitorAddr().Port, CapturezPath, cid)
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || strings.Contains(string(body), "PING") {
+		t.Fatalf("Expected the capture download to be disabled, got %v: %q", resp.StatusCode, body)
+	}
+}
+
+func TestCaptureDuration(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	cid, _ := nc.GetClientID()
+	if _, err := s.StartCapture(&CaptureRequest{CID: cid, Redact: true, Duration: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("Error starting the capture: %v", err)
+	}
+	natsPub(t, nc, "foo", []byte("secret"))
+	natsFlush(t, nc)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if captures := s.Captures(); len(captures) != 1 || captures[0].Active {
+			return fmt.Errorf("Expected the capture to stop, got %+v", captures)
+		}
+		return nil
+	})
+	natsPub(t, nc, "bar", []byte("secret"))
+	natsFlush(t, nc)
+	var buf strings.Builder
+	if err := s.WriteCapture(cid, &buf); err != nil {
+		t.Fatalf("Error writing the capture: %v", err)
+	}
+	if out := buf.String(); !strings.Contains(out, "PUB foo 6\r\n[6 bytes redacted]") ||
+		strings.Contains(out, "secret") || strings.Contains(out, "bar") {
+		t.Fatalf("Unexpected capture %q", out)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader watches the certificate, key and CA files of a TLS
+// configuration and swaps in their new content for subsequent handshakes,
+// so that rotated certificates are picked up without a config reload.
+// Files are checked lazily, at most once per interval.
+type certReloader struct {
+	sync.Mutex
+	tc       *TLSConfigOpts
+	base     *tls.Config
+	interval time.Duration
+	checked  time.Time
+	mods     map[string]time.Time
+	cert     *tls.Certificate
+	cas      *x509.CertPool
+	origCAs  *x509.CertPool
+}
+
+// watchTLSFiles makes the given config serve the current content of the
+// files referenced by tc. Accepted connections get it through the config's
+// GetConfigForClient, solicited ones through tlsClientConfig().
+func watchTLSFiles(tc *TLSConfigOpts, config *tls.Config) {
+	r := &certReloader{
+		tc:       tc,
+		base:     config,
+		interval: tc.ReloadInterval,
+		checked:  time.Now(),
+		mods:     make(map[string]time.Time, 3),
+		origCAs:  config.ClientCAs,
+	}
+	for _, f := range r.files() {
+		if fi, err := os.Stat(f); err == nil {
+			r.mods[f] = fi.ModTime()
+		}
+	}
+	config.GetConfigForClient = r.getConfig
+}
+
+func (r *certReloader) files() []string {
+	var files []string
+	for _, f := range []string{r.tc.CertFile, r.tc.KeyFile, r.tc.CaFile} {
+		// Keys of external providers are reloaded along with the certificate.
+		if p, _ := keyProviderFor(f); f != "" && p == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Reloads the files if they have been modified since they were last
+// loaded. If loading fails, for instance because the certificate has
+// been written but not yet its key, the previous content is kept and
+// loading is retried after the next interval.
+// Lock held on entry.
+func (r *certReloader) checkFiles() {
+	now := time.Now()
+	if now.Sub(r.checked) < r.interval {
+		return
+	}
+	r.checked = now
+	changed := false
+	mods := make(map[string]time.Time, len(r.mods))
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return
+		}
+		if !fi.ModTime().Equal(r.mods[f]) {
+			changed = true
+		}
+		mods[f] = fi.ModTime()
+	}
+	if !changed {
+		return
+	}
+	var (
+		cert *tls.Certificate
+		cas  *x509.CertPool
+	)
+	if r.tc.CertFile != "" && r.tc.KeyFile != "" {
+		c, err := loadCertificate(r.tc.CertFile, r.tc.KeyFile)
+		if err != nil {
+			return
+		}
+		cert = &c
+	}
+	if r.tc.CaFile != "" {
+		pool, err := loadCAPool(r.tc.CaFile)
+		if err != nil {
+			return
+		}
+		cas = pool
+	}
+	r.cert, r.cas, r.mods = cert, cas, mods
+}
+
+// getConfig returns a copy of the base config with the current
+// certificate and CAs.
+func (r *certReloader) getConfig(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	r.Lock()
+	r.checkFiles()
+	cert, cas := r.cert, r.cas
+	r.Unlock()
+
+	config := r.base.Clone()
+	config.GetConfigForClient = nil
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	if cas != nil {
+		// The CAs may have been mirrored to the root CAs, for instance
+		// for routes and gateways which act as both client and server.
+		if r.base.ClientCAs == r.origCAs {
+			config.ClientCAs = cas
+		}
+		if r.base.RootCAs == r.origCAs {
+			config.RootCAs = cas
+		}
+	}
+	return config, nil
+}
+
+// tlsClientConfig returns a copy of the given config, updated with the
+// current content of its files if they are watched. This is to be used
+// when soliciting connections.
+func tlsClientConfig(config *tls.Config) *tls.Config {
+	if config.GetConfigForClient != nil {
+		if c, err := config.GetConfigForClient(nil); err == nil && c != nil {
+			return c
+		}
+	}
+	return config.Clone()
+}
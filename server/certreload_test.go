@@ -0,0 +1,171 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/conf"
+)
+
+func copyCertFiles(t *testing.T, dir, certFile, keyFile string, mod time.Time) {
+	t.Helper()
+	for src, dst := range map[string]string{certFile: "cert.pem", keyFile: "key.pem"} {
+		content, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", src, err)
+		}
+		dst = filepath.Join(dir, dst)
+		if err := ioutil.WriteFile(dst, content, 0600); err != nil {
+			t.Fatalf("Error writing %q: %v", dst, err)
+		}
+		if err := os.Chtimes(dst, mod, mod); err != nil {
+			t.Fatalf("Error setting time of %q: %v", dst, err)
+		}
+	}
+}
+
+func loadTestCertificate(t *testing.T, certFile, keyFile string) tls.Certificate {
+	t.Helper()
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error loading certificate: %v", err)
+	}
+	return cert
+}
+
+func TestTLSReloadIntervalParsing(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected time.Duration
+		err      string
+	}{
+		{`"1m"`, time.Minute, ""},
+		{`30`, 30 * time.Second, ""},
+		{`"abc"`, 0, "invalid 'reload_interval'"},
+		{`"-1s"`, 0, "cannot be negative"},
+		{`true`, 0, "expected 'reload_interval' to be a duration"},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			m, err := conf.Parse(fmt.Sprintf(`
+				tls {
+					cert_file: "./configs/certs/server.pem"
+					key_file: "./configs/certs/key.pem"
+					reload_interval: %s
+				}
+			`, test.value))
+			if err != nil {
+				t.Fatalf("Error parsing config: %v", err)
+			}
+			tc, err := parseTLS(m["tls"], true)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error parsing tls config: %v", err)
+			}
+			if tc.ReloadInterval != test.expected {
+				t.Fatalf("Expected interval %v, got %v", test.expected, tc.ReloadInterval)
+			}
+			config, err := GenTLSConfig(tc)
+			if err != nil {
+				t.Fatalf("Error generating tls config: %v", err)
+			}
+			if config.GetConfigForClient == nil {
+				t.Fatal("Expected files to be watched")
+			}
+		})
+	}
+}
+
+func TestTLSReloadCertificateOnFileChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsreload")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certA := loadTestCertificate(t, "./configs/certs/server.pem", "./configs/certs/key.pem")
+	certB := loadTestCertificate(t, "./configs/certs/cert.new.pem", "./configs/certs/key.new.pem")
+	copyCertFiles(t, dir, "./configs/certs/server.pem", "./configs/certs/key.pem", time.Now().Add(-time.Hour))
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		https: 127.0.0.1:-1
+		tls {
+			cert_file: %q
+			key_file: %q
+			reload_interval: "10ms"
+		}
+	`, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	serverCert := func(port int) []byte {
+		t.Helper()
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	clientCert := func() []byte {
+		t.Helper()
+		c := tlsClientConfig(opts.TLSConfig)
+		return c.Certificates[0].Certificate[0]
+	}
+	httpsPort := s.MonitorAddr().Port
+
+	// The client port requires the INFO to be read first, so check the
+	// monitoring port for handshakes.
+	if !bytes.Equal(serverCert(httpsPort), certA.Certificate[0]) {
+		t.Fatal("Expected initial certificate")
+	}
+	if !bytes.Equal(clientCert(), certA.Certificate[0]) {
+		t.Fatal("Expected initial certificate")
+	}
+
+	copyCertFiles(t, dir, "./configs/certs/cert.new.pem", "./configs/certs/key.new.pem", time.Now())
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if !bytes.Equal(serverCert(httpsPort), certB.Certificate[0]) {
+			return fmt.Errorf("certificate not reloaded")
+		}
+		return nil
+	})
+	if !bytes.Equal(clientCert(), certB.Certificate[0]) {
+		t.Fatal("Expected rotated certificate")
+	}
+
+	// A partially written pair is ignored and the last good one kept.
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("bad"), 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !bytes.Equal(serverCert(httpsPort), certB.Certificate[0]) {
+		t.Fatal("Expected last good certificate")
+	}
+}
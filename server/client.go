@@ -60,6 +60,31 @@ const (
 	pongProto = "PONG" + _CRLF_
 	errProto  = "-ERR '%s'" + _CRLF_
 	okProto   = "+OK" + _CRLF_
+	// Confirms to the client that a subscription has been drained.
+	drainedProto = "DRAINED %s" + _CRLF_
+)
+
+// Minimum time given to remote servers to stop sending messages for a
+// draining subscription before it is removed.
+const minDrainDelay = 10 * time.Millisecond
+
+// Marks the optional payload filter argument of a client subscription.
+const subFilterPrefix = "prefix="
+
+// Marks the optional header filter argument of a client subscription,
+// e.g. header=Region:eu for an exact match of the Region header.
+const subHeaderFilterPrefix = "header="
+
+// Marks the optional priority argument of a client subscription.
+const subPriorityPrefix = "priority="
+
+// Priorities of the subscriptions. Under backpressure, the messages of high
+// priority subscriptions are written first and the ones of low priority
+// subscriptions are dropped.
+const (
+	subPriorityLow    int8 = -1
+	subPriorityNormal int8 = 0
+	subPriorityHigh   int8 = 1
 )
 
 func init() {
@@ -93,6 +118,15 @@ const (
 
 var readLoopReportThreshold = readLoopReport
 
+// flushMode is the snapshot of the configured flush mode of a connection.
+type flushMode uint8
+
+const (
+	flushDefault flushMode = iota
+	flushLatency
+	flushThroughput
+)
+
 // Represent client booleans with a bitmask
 type clientFlag uint16
 
@@ -108,6 +142,9 @@ const (
 	writeLoopStarted                         // Marks that the writeLoop has been started.
 	skipFlushOnClose                         // Marks that flushOutbound() should not be called on connection close.
 	expectConnect                            // Marks if this connection is expected to send a CONNECT
+	connectNotified                          // Marks that the client connect hooks have been called.
+	inProcessConn                            // Marks a connection made through Server.InProcessConn.
+	outboundClosed                           // Marks that flushAndClose() has been called.
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -167,6 +204,10 @@ const (
 	WrongGateway
 	MissingAccount
 	Revocation
+	MemoryQuotaExceeded
+	AccountDeleted
+	Kicked
+	ClientVersionRejected
 )
 
 // Some flags passed to processMsgResultsEx
@@ -180,39 +221,49 @@ const (
 type client struct {
 	// Here first because of use of atomics, and memory alignment.
 	stats
+	// Copy of out.pb, the pending bytes, stored atomically so that the
+	// queue group policies read it without the lock.
+	opb int64
 	// Indicate if we should check gwrm or not. Since checking gwrm is done
 	// when processing inbound messages and requires the lock we want to
 	// check only when needed. This is set/get using atomic, so needs to
 	// be memory aligned.
-	cgwrt   int32
-	mpay    int32
-	msubs   int32
-	mcl     int32
-	mu      sync.Mutex
-	kind    int
-	cid     uint64
-	opts    clientOpts
-	start   time.Time
-	nonce   []byte
-	nc      net.Conn
-	ncs     string
-	out     outbound
-	srv     *Server
-	acc     *Account
-	user    *NkeyUser
-	host    string
-	port    uint16
-	subs    map[string]*subscription
-	perms   *permissions
-	replies map[string]*resp
-	mperms  *msgDeny
-	darray  []string
-	in      readCache
-	pcd     map[*client]struct{}
-	atmr    *time.Timer
-	ping    pinfo
-	msgb    [msgScratchSize]byte
-	last    time.Time
+	cgwrt int32
+	// Log level raised for this connection or its account, accessed
+	// atomically since it is checked without the lock when logging.
+	logLevel int32
+	// Set while the traffic is captured, accessed atomically since the
+	// inbound traffic is captured without the lock.
+	captured int32
+	mpay     int32
+	msubs    int32
+	mcl      int32
+	mu       sync.Mutex
+	kind     int
+	cid      uint64
+	opts     clientOpts
+	start    time.Time
+	nonce    []byte
+	nc       net.Conn
+	ncs      string
+	out      outbound
+	srv      *Server
+	acc      *Account
+	user     *NkeyUser
+	host     string
+	port     uint16
+	subs     map[string]*subscription
+	perms    *permissions
+	grant    *permGrant
+	replies  *respWheel
+	mperms   *msgDeny
+	darray   []string
+	in       readCache
+	pcd      map[*client]struct{}
+	atmr     *time.Timer
+	ping     pinfo
+	msgb     [msgScratchSize]byte
+	last     time.Time
 	parseState
 
 	rtt        time.Duration
@@ -220,6 +271,11 @@ type client struct {
 	rrTracking map[string]*remoteLatency
 	rrMax      int
 
+	// Message being traced, only set while it is processed.
+	mt *msgTrace
+	// Spans of the message being processed, if it carries a trace context.
+	otel *otelTrace
+
 	route *route
 	gw    *gateway
 	leaf  *leaf
@@ -230,7 +286,12 @@ type client struct {
 	flags clientFlag // Compact booleans into a single field. Size will be increased when needed.
 
 	trace bool
-	echo  bool
+	// Log level requested for this connection only, see logLevel.
+	connLogLevel int32
+	// Capture of the protocol traffic, see captured.
+	capture *protoCapture
+	echo    bool
+	headers bool
 }
 
 // Struct for PING initiation from the server.
@@ -245,6 +306,9 @@ type outbound struct {
 	p   []byte        // Primary write buffer
 	s   []byte        // Secondary for use post flush
 	nb  net.Buffers   // net.Buffers for writev IO
+	pw  []byte        // Left of a partial write, written before hp.
+	hp  net.Buffers   // High priority messages, written before nb.
+	sm  int64         // Messages of low priority subscriptions dropped under backpressure.
 	sz  int32         // limit size per []byte, uses variable BufSize constants, start, min, max.
 	sws int32         // Number of short writes, used for dynamic resizing.
 	pb  int64         // Total pending/queued bytes.
@@ -256,6 +320,13 @@ type outbound struct {
 	lft time.Duration // Last flush time for Write.
 	stc chan struct{} // Stall chan we create to slow down producers on overrun, e.g. fan-in.
 	lwb int32         // Last byte size of Write.
+	mcs int32         // Snapshot of max coalesce size.
+	fi  time.Duration // Snapshot of flush interval, throughput mode only.
+	fm  flushMode     // Snapshot of flush mode.
+	cw  compressor    // Compressor, set once outbound compression has started.
+	cwd bool          // Data was passed to the compressor since last flush.
+	sh  []sharedRef   // Shared payloads referenced by nb, released once written.
+	wt  int64         // Total bytes written, to release the shared payloads.
 }
 
 type perm struct {
@@ -266,15 +337,19 @@ type perm struct {
 type permissions struct {
 	sub    perm
 	pub    perm
+	ptrie  *permTrie // compiled pub allow and deny subjects, checked on pcache misses
 	resp   *ResponsePermission
 	pcache map[string]bool
 }
 
-// This is used to dynamically track responses and reply subjects
-// for dynamic permissioning.
-type resp struct {
-	t time.Time
-	n int
+// permGrant is a temporary elevation of permissions given to a client
+// connection through the system account. It sits on top of the regular
+// permissions and is revoked when the timer fires.
+type permGrant struct {
+	pub     *Sublist
+	sub     *Sublist
+	expires time.Time
+	timer   *time.Timer
 }
 
 // msgDeny is used when a user permission for subscriptions has a deny
@@ -318,6 +393,11 @@ type readCache struct {
 
 	prand *rand.Rand
 
+	// Snapshot of the queue_groups options, and the generation of the
+	// server options it was taken from.
+	qp    *QueueGroupOpts
+	qpgen int32
+
 	// These are all temporary totals for an invocation of a read in readloop.
 	msgs  int32
 	bytes int32
@@ -325,6 +405,14 @@ type readCache struct {
 
 	rsz int32 // Read buffer size
 	srs int32 // Short reads, used for dynamic buffer resizing.
+
+	zs bool   // Remote has started compression, switch after current read.
+	za string // Compression algorithm of the remote.
+	zb []byte // Compressed data left in the current read when switching.
+	zr bool   // Inbound data is compressed.
+
+	// Payload shared by the subscriptions of the message being delivered.
+	sp *sharedPayload
 }
 
 const (
@@ -359,7 +447,7 @@ func (c *client) GetName() string {
 }
 
 // GetOpts returns the client options provided by the application.
-func (c *client) GetOpts() *clientOpts {
+func (c *client) GetOpts() *ClientOpts {
 	return &c.opts
 }
 
@@ -385,10 +473,16 @@ type subscription struct {
 	subject []byte
 	queue   []byte
 	sid     []byte
+	filter  []byte
+	hfilter *subHeaderFilter
 	nm      int64
 	max     int64
+	// Time of the last update of the interest of a route or gateway, in
+	// unix nanoseconds.
+	updated int64
 	qw      int32
 	closed  int32
+	prio    int8
 }
 
 // Indicate that this subscription is closed.
@@ -420,6 +514,10 @@ type clientOpts struct {
 	Protocol      int    `json:"protocol"`
 	Account       string `json:"account,omitempty"`
 	AccountNew    bool   `json:"new_account,omitempty"`
+	SubFilters    bool   `json:"sub_filters,omitempty"`
+	SubPriorities bool   `json:"sub_priorities,omitempty"`
+	Headers       bool   `json:"headers,omitempty"`
+	NoResponders  bool   `json:"no_responders,omitempty"`
 
 	// Routes only
 	Import *SubjectPermission `json:"import,omitempty"`
@@ -437,7 +535,46 @@ func (c *client) setTraceLevel() {
 	if c.kind == SYSTEM && !(atomic.LoadInt32(&c.srv.logging.traceSysAcc) != 0) {
 		c.trace = false
 	} else {
-		c.trace = (atomic.LoadInt32(&c.srv.logging.trace) != 0)
+		c.trace = atomic.LoadInt32(&c.srv.logging.trace) != 0 || atomic.LoadInt32(&c.logLevel)&logLevelTrace != 0
+	}
+}
+
+// Returns the flush options of the listener this connection belongs to.
+func (c *client) flushOpts(opts *Options) *FlushOpts {
+	switch c.kind {
+	case ROUTER:
+		return &opts.Cluster.Flush
+	case GATEWAY:
+		return &opts.Gateway.Flush
+	case LEAF:
+		return &opts.LeafNode.Flush
+	default:
+		return &opts.Flush
+	}
+}
+
+// Snapshots the flush options into the outbound structure.
+// Lock should be held
+func (c *client) setFlushOpts(fo *FlushOpts) {
+	c.out.mcs = maxBufSize
+	if fo.MaxCoalesce > 0 {
+		c.out.mcs = int32(fo.MaxCoalesce)
+	}
+	if c.out.sz > c.out.mcs {
+		c.out.sz = c.out.mcs
+	}
+	if fo.WriteDeadline > 0 {
+		c.out.wdl = fo.WriteDeadline
+	}
+	switch fo.Mode {
+	case FlushModeLatency:
+		c.out.fm = flushLatency
+	case FlushModeThroughput:
+		c.out.fm = flushThroughput
+		c.out.fi = fo.Interval
+		if c.out.fi <= 0 {
+			c.out.fi = DEFAULT_FLUSH_INTERVAL
+		}
 	}
 }
 
@@ -453,6 +590,7 @@ func (c *client) initClient() {
 	// Snapshots to avoid mutex access in fast paths.
 	c.out.wdl = opts.WriteDeadline
 	c.out.mp = opts.MaxPending
+	c.setFlushOpts(c.flushOpts(opts))
 
 	c.subs = make(map[string]*subscription)
 	c.echo = true
@@ -476,6 +614,10 @@ func (c *client) initClient() {
 		host, port, _ := net.SplitHostPort(conn)
 		iPort, _ := strconv.Atoi(port)
 		c.host, c.port = host, uint16(iPort)
+	} else if uc, ok := c.nc.(*net.UnixConn); ok {
+		conn = "unix:" + uc.LocalAddr().String()
+	} else if c.flags.isSet(inProcessConn) {
+		conn = "pipe"
 	}
 
 	switch c.kind {
@@ -533,6 +675,7 @@ func (c *client) registerWithAccount(acc *Account) error {
 	srv := c.srv
 	c.acc = acc
 	c.applyAccountLimits()
+	c.updateLogLevel()
 	c.mu.Unlock()
 
 	// Check if we have a max connections violation
@@ -580,6 +723,15 @@ func (c *client) applyAccountLimits() {
 		c.mpay = int32(opts.MaxPayload)
 	}
 
+	// The limits of the account configuration replace the server's, they
+	// are checked against max_pending when the options are validated.
+	if c.acc.maxPayload > 0 {
+		c.mpay = c.acc.maxPayload
+	}
+	if c.acc.maxCtrlLine > 0 {
+		c.mcl = c.acc.maxCtrlLine
+	}
+
 	// We check here if the server has an option set that is lower than the account limit.
 	if c.msubs != jwt.NoLimit && opts.MaxSubs != 0 && opts.MaxSubs < int(c.acc.msubs) {
 		c.Errorf("Max Subscriptions set to %d from server config which overrides %d from account claims", opts.MaxSubs, c.acc.msubs)
@@ -648,6 +800,9 @@ func (c *client) RegisterNkeyUser(user *NkeyUser) error {
 
 func splitSubjectQueue(sq string) ([]byte, []byte, error) {
 	vals := strings.Fields(strings.TrimSpace(sq))
+	if len(vals) == 0 {
+		return nil, nil, fmt.Errorf("invalid subject-queue %q", sq)
+	}
 	s := []byte(vals[0])
 	var q []byte
 	if len(vals) == 2 {
@@ -661,6 +816,11 @@ func splitSubjectQueue(sq string) ([]byte, []byte, error) {
 // Initializes client.perms structure.
 // Lock is held on entry.
 func (c *client) setPermissions(perms *Permissions) {
+	// Stop tracking replies if response permissions are not (or no longer) set.
+	if (perms == nil || perms.Response == nil) && c.replies != nil {
+		c.replies.stop()
+		c.replies = nil
+	}
 	if perms == nil {
 		return
 	}
@@ -683,13 +843,23 @@ func (c *client) setPermissions(perms *Permissions) {
 			sub := &subscription{subject: []byte(pubSubject)}
 			c.perms.pub.deny.Insert(sub)
 		}
+		if c.perms.pub.allow != nil || c.perms.pub.deny != nil {
+			c.perms.ptrie = newPermTrie(perms.Publish.Allow, perms.Publish.Deny)
+		}
 	}
 
 	// Check if we are allowed to send responses.
 	if perms.Response != nil {
 		rp := *perms.Response
 		c.perms.resp = &rp
-		c.replies = make(map[string]*resp)
+		// Permissions are set again on configuration reload, so keep the
+		// replies we already track so that in-flight requests can still
+		// be responded to.
+		if c.replies == nil {
+			c.replies = newRespWheel(rp.Expires, replyPermLimit, time.Now())
+		} else {
+			c.replies = c.replies.setTTL(rp.Expires, time.Now())
+		}
 	}
 
 	// Loop over subscribe permissions
@@ -778,8 +948,9 @@ func (c *client) writeLoop() {
 	for {
 		c.mu.Lock()
 		if close = c.flags.isSet(closeConnection); !close {
-			owtf := c.out.fsp > 0 && c.out.pb < maxBufSize && c.out.fsp < maxFlushPending
-			if waitOk && (c.out.pb == 0 || owtf) {
+			// In latency mode we never wait for other producers.
+			owtf := c.out.fm != flushLatency && c.out.fsp > 0 && c.out.pb < int64(c.out.mcs) && c.out.fsp < maxFlushPending
+			if waitOk && ((c.out.pb == 0 && !c.out.cwd) || owtf) {
 				c.mu.Unlock()
 
 				// Reset our timer
@@ -794,6 +965,10 @@ func (c *client) writeLoop() {
 				c.mu.Lock()
 				close = c.flags.isSet(closeConnection)
 			}
+			// In throughput mode, give producers some time to coalesce more data.
+			if waitOk && !close && c.out.fm == flushThroughput && c.out.pb < int64(c.out.mcs) {
+				close = c.coalesceOutbound(ch, t)
+			}
 		}
 		if close {
 			c.flushAndClose(false)
@@ -806,6 +981,40 @@ func (c *client) writeLoop() {
 	}
 }
 
+// coalesceOutbound waits up to the flush interval for more pending data,
+// or until the max coalesce size is reached. Returns true if the connection
+// was closed while waiting.
+// Lock is held on entry and exit.
+func (c *client) coalesceOutbound(ch chan struct{}, t *time.Timer) bool {
+	deadline := time.Now().Add(c.out.fi)
+	for c.out.pb < int64(c.out.mcs) {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		c.mu.Unlock()
+
+		// Make sure a previous expiration does not cut the wait short.
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(wait)
+		select {
+		case <-ch:
+		case <-t.C:
+		}
+
+		c.mu.Lock()
+		if c.flags.isSet(closeConnection) {
+			return true
+		}
+	}
+	return false
+}
+
 // flushClients will make sure to flush any clients we may have
 // sent to during processing. We pass in a budget as a time.Duration
 // for how much time to spend in place flushing for this client. This
@@ -831,7 +1040,8 @@ func (c *client) flushClients(budget time.Duration) time.Time {
 			continue
 		}
 
-		if budget > 0 && cp.flushOutbound() {
+		// In throughput mode, leave it to the writeLoop to coalesce.
+		if budget > 0 && cp.out.fm != flushThroughput && cp.flushOutbound() {
 			budget -= cp.out.lft
 		} else {
 			cp.flushSignal()
@@ -863,6 +1073,7 @@ func (c *client) readLoop() {
 	if s != nil {
 		if opts := s.getOpts(); opts != nil {
 			c.mcl = int32(opts.MaxControlLine)
+			c.legacy = opts.LegacyParser
 		}
 	}
 	// Check the per-account-cache for closed subscriptions
@@ -880,8 +1091,11 @@ func (c *client) readLoop() {
 	// Start read buffer.
 	b := make([]byte, c.in.rsz)
 
+	// Where we read from, changes once the remote starts compression.
+	var r io.Reader = nc
+
 	for {
-		n, err := nc.Read(b)
+		n, err := r.Read(b)
 		// If we have any data we will try to parse and exit at the end.
 		if n == 0 && err != nil {
 			c.closeConnection(closedStateForErr(err))
@@ -894,6 +1108,8 @@ func (c *client) readLoop() {
 		c.in.bytes = 0
 		c.in.subs = 0
 
+		c.captureData(b[:n])
+
 		// Main call into parser for inbound data. This will generate callouts
 		// to process messages, etc.
 		if err := c.parse(b[:n]); err != nil {
@@ -921,6 +1137,12 @@ func (c *client) readLoop() {
 			atomic.AddInt64(&s.inBytes, int64(c.in.bytes))
 		}
 
+		// Everything after the compression start protocol is compressed.
+		if c.in.zs {
+			r = newDecompressor(c.in.za, c.in.zb, nc)
+			c.in.zs, c.in.zb, c.in.zr = false, nil, true
+		}
+
 		// Budget to spend in place flushing outbound data.
 		// Client will be checked on several fronts to see
 		// if applicable. Routes and Gateways will never
@@ -941,6 +1163,10 @@ func (c *client) readLoop() {
 		if c.in.msgs > 0 || c.in.subs > 0 {
 			c.last = last
 		}
+		if c.in.msgs > 0 && c.acc != nil && (c.kind == CLIENT || c.kind == LEAF) {
+			atomic.AddInt64(&c.acc.stats.inMsgs, int64(c.in.msgs))
+			atomic.AddInt64(&c.acc.stats.inBytes, int64(c.in.bytes))
+		}
 
 		if n >= cap(b) {
 			c.in.srs = 0
@@ -1002,9 +1228,21 @@ func (c *client) collapsePtoNB() net.Buffers {
 	return c.out.nb
 }
 
-// This will handle the fixup needed on a partial write.
+// This will handle the fixup needed on a partial write, where pnb is what
+// is left of the buffers written, the last nbn of them coming from nb.
 // Assume pending has been already calculated correctly.
-func (c *client) handlePartialWrite(pnb net.Buffers) {
+func (c *client) handlePartialWrite(pnb net.Buffers, nbn int) {
+	// The first buffer left is likely partially written, it needs to go
+	// out before anything else, including the high priority messages.
+	if len(pnb) > 0 {
+		c.out.pw = pnb[0]
+		pnb = pnb[1:]
+	}
+	// The high priority messages left go before the ones queued since.
+	if hpn := len(pnb) - nbn; hpn > 0 {
+		c.out.hp = append(pnb[:hpn:hpn], c.out.hp...)
+		pnb = pnb[hpn:]
+	}
 	nb := c.collapsePtoNB()
 	// The partial needs to be first, so append nb to pnb
 	c.out.nb = append(pnb, nb...)
@@ -1026,6 +1264,11 @@ func (c *client) flushOutbound() bool {
 	c.flags.set(flushOutbound)
 	defer c.flags.clear(flushOutbound)
 
+	// Get whatever the compressor holds.
+	if c.out.cwd {
+		c.flushCompressor()
+	}
+
 	// Check for nothing to do.
 	if c.nc == nil || c.srv == nil || c.out.pb == 0 {
 		return true // true because no need to queue a signal.
@@ -1035,8 +1278,23 @@ func (c *client) flushOutbound() bool {
 	nb := c.collapsePtoNB()
 	c.out.p, c.out.nb, c.out.s = c.out.s, nil, nil
 
-	// For selecting primary replacement.
+	nbn := len(nb)
+
+	// High priority messages are written first, after what is left of
+	// a partial write.
+	if len(c.out.hp) > 0 {
+		nb = append(c.out.hp, nb...)
+		c.out.hp = nil
+	}
+	if c.out.pw != nil {
+		nb = append(net.Buffers{c.out.pw}, nb...)
+		c.out.pw = nil
+	}
+
+	// For selecting primary replacement, the buffers of nb can not be
+	// reused if some are shared with other connections.
 	cnb := nb
+	shared := len(c.out.sh) > 0
 	var lfs int
 	if len(cnb) > 0 {
 		lfs = len(cnb[0])
@@ -1047,6 +1305,13 @@ func (c *client) flushOutbound() bool {
 	attempted := c.out.pb
 	apm := c.out.pm
 
+	// Keep the buffers to capture, the write consumes nb.
+	pc := c.capture
+	var pcnb net.Buffers
+	if pc != nil {
+		pcnb = append(pcnb, nb...)
+	}
+
 	// Capture this (we change the value in some tests)
 	wdl := c.out.wdl
 	// Do NOT hold lock during actual IO.
@@ -1062,10 +1327,22 @@ func (c *client) flushOutbound() bool {
 	n, err := nb.WriteTo(nc)
 	nc.SetWriteDeadline(time.Time{})
 	lft := time.Since(now)
+	if pc != nil {
+		pc.recordBuffers(pcnb, n)
+	}
 
 	// Re-acquire client lock.
 	c.mu.Lock()
 
+	// If the connection has been closed during the write, flushAndClose()
+	// left the shared payloads for us to release once we are done.
+	if c.flags.isSet(outboundClosed) && len(c.out.sh) > 0 {
+		defer func() {
+			c.out.nb = nil
+			c.releaseSharedPayloads()
+		}()
+	}
+
 	if err != nil {
 		// Handle timeout error (slow consumer) differently
 		if ne, ok := err.(net.Error); ok && ne.Timeout() {
@@ -1090,13 +1367,14 @@ func (c *client) flushOutbound() bool {
 	c.out.lwb = int32(n)
 
 	// Subtract from pending bytes and messages.
-	c.out.pb -= int64(c.out.lwb)
+	c.addPendingBytes(-int64(c.out.lwb))
+	c.out.wt += n
 	c.out.pm -= apm // FIXME(dlc) - this will not be totally accurate on partials.
 
 	// Check for partial writes
 	// TODO(dlc) - zero write with no error will cause lost message and the writeloop to spin.
 	if int64(c.out.lwb) != attempted && n > 0 {
-		c.handlePartialWrite(nb)
+		c.handlePartialWrite(nb, nbn)
 	} else if c.out.lwb >= c.out.sz {
 		c.out.sws = 0
 	}
@@ -1113,12 +1391,24 @@ func (c *client) flushOutbound() bool {
 		}
 	}
 	// Adjust sz as needed upward, keeping power of 2.
-	if pt > int64(c.out.sz) && c.out.sz < maxBufSize {
+	if pt > int64(c.out.sz) && c.out.sz < c.out.mcs {
 		c.out.sz <<= 1
+		if c.out.sz > c.out.mcs {
+			c.out.sz = c.out.mcs
+		}
+	}
+
+	// The shared payloads are no longer referenced once written.
+	if len(c.out.sh) > 0 {
+		if c.out.pb == 0 {
+			c.releaseSharedPayloads()
+		} else {
+			c.releaseWrittenSharedPayloads()
+		}
 	}
 
 	// Check to see if we can reuse buffers.
-	if lfs != 0 && n >= int64(lfs) {
+	if lfs != 0 && n >= int64(lfs) && !shared {
 		oldp := cnb[0][:0]
 		if cap(oldp) >= int(c.out.sz) {
 			// Replace primary or secondary if they are nil, reusing same buffer.
@@ -1274,6 +1564,9 @@ func (c *client) processInfo(arg []byte) error {
 	if err := json.Unmarshal(arg, &info); err != nil {
 		return err
 	}
+	if info.CompressionStart {
+		return c.processCompressionStart(info.CompressionAlgorithm)
+	}
 	switch c.kind {
 	case ROUTER:
 		c.processRouteInfo(&info)
@@ -1389,9 +1682,14 @@ func (c *client) processConnect(arg []byte) error {
 	c.flags.set(connectReceived)
 	// Capture these under lock
 	c.echo = c.opts.Echo
+	c.headers = c.opts.Headers && srv != nil && srv.supportsHeaders()
+	headers := c.headers
+	noResponders := c.opts.NoResponders
 	proto := c.opts.Protocol
 	verbose := c.opts.Verbose
 	lang := c.opts.Lang
+	version := c.opts.Version
+	name := c.opts.Name
 	account := c.opts.Account
 	accountNew := c.opts.AccountNew
 	ujwt := c.opts.JWT
@@ -1409,6 +1707,12 @@ func (c *client) processConnect(arg []byte) error {
 			srv.mu.Unlock()
 		}
 
+		// Slow down or reject the sources of repeated authentication failures.
+		if kind == CLIENT && srv.authLockedOut(c) {
+			c.authViolation()
+			return ErrAuthentication
+		}
+
 		// Check for Auth
 		if ok := srv.checkAuthentication(c); !ok {
 			// We may fail here because we reached max limits on an account.
@@ -1423,9 +1727,15 @@ func (c *client) processConnect(arg []byte) error {
 					return ErrTooManyAccountConnections
 				}
 			}
+			if kind == CLIENT {
+				srv.authFailed(c)
+			}
 			c.authViolation()
 			return ErrAuthentication
 		}
+		if kind == CLIENT {
+			srv.authSucceeded(c)
+		}
 
 		// Check for Account designation, this section should be only used when there is not a jwt.
 		if account != "" {
@@ -1470,9 +1780,31 @@ func (c *client) processConnect(arg []byte) error {
 			c.closeConnection(BadClientProtocolVersion)
 			return ErrBadClientProtocol
 		}
+		// No responders status messages are sent as headers only messages.
+		if noResponders && !headers {
+			c.sendErr(ErrNoRespondersRequiresHeaders.Error())
+			c.closeConnection(ProtocolViolation)
+			return ErrNoRespondersRequiresHeaders
+		}
+		if srv != nil {
+			c.mu.Lock()
+			allowed, minVersion := c.clientVersionAllowed()
+			c.mu.Unlock()
+			c.Debugf("Client library %q version %q, name %q", lang, version, name)
+			if !allowed {
+				c.Warnf("Client library %q version %q is older than the minimum version %q of the account",
+					lang, version, minVersion)
+				c.sendErr(fmt.Sprintf("%s, minimum version is %s", ErrClientVersionRejected, minVersion))
+				c.closeConnection(ClientVersionRejected)
+				return ErrClientVersionRejected
+			}
+		}
 		if verbose {
 			c.sendOK()
 		}
+		if srv != nil {
+			srv.clientConnected(c)
+		}
 	case ROUTER:
 		// Delegate the rest of processing to the route
 		return c.processRouteConnect(srv, arg, lang)
@@ -1521,6 +1853,7 @@ func (c *client) authViolation() {
 		hasUsers = s.users != nil
 		s.mu.Unlock()
 		defer s.sendAuthErrorEvent(c)
+		defer s.clientAuthFailed(c)
 
 	}
 	if hasTrustedNkeys {
@@ -1551,9 +1884,19 @@ func (c *client) maxConnExceeded() {
 }
 
 func (c *client) maxSubsExceeded() {
+	if c.srv != nil {
+		atomic.AddInt64(&c.srv.subsExceeded, 1)
+	}
 	c.sendErrAndErr(ErrTooManySubs.Error())
 }
 
+func (c *client) maxAccountSubsExceeded() {
+	if c.srv != nil {
+		atomic.AddInt64(&c.srv.subsExceeded, 1)
+	}
+	c.sendErrAndErr(ErrTooManyAccountSubs.Error())
+}
+
 func (c *client) maxPayloadViolation(sz int, max int32) {
 	c.Errorf("%s: %d vs %d", ErrMaxPayload.Error(), sz, max)
 	c.sendErr("Maximum Payload Violation")
@@ -1565,6 +1908,23 @@ func (c *client) maxPayloadViolation(sz int, max int32) {
 // should not reuse the `data` array.
 // Lock should be held.
 func (c *client) queueOutbound(data []byte) bool {
+	if c.out.cw != nil {
+		c.compressOutbound(data)
+		return false
+	}
+	return c.queueRawOutbound(data)
+}
+
+// addPendingBytes adds n to the pending bytes of the client, keeping their
+// atomic copy up to date. Lock should be held.
+func (c *client) addPendingBytes(n int64) {
+	c.out.pb += n
+	atomic.StoreInt64(&c.opb, c.out.pb)
+}
+
+// queueRawOutbound queues data as-is, see queueOutbound.
+// Lock should be held.
+func (c *client) queueRawOutbound(data []byte) bool {
 	// Do not keep going if closed
 	if c.flags.isSet(closeConnection) {
 		return false
@@ -1573,14 +1933,14 @@ func (c *client) queueOutbound(data []byte) bool {
 	// Assume data will not be referenced
 	referenced := false
 	// Add to pending bytes total.
-	c.out.pb += int64(len(data))
+	c.addPendingBytes(int64(len(data)))
 
 	// Check for slow consumer via pending bytes limit.
 	// ok to return here, client is going away.
 	if c.kind == CLIENT && c.out.pb > c.out.mp {
 		// Perf wise, it looks like it is faster to optimistically add than
 		// checking current pb+len(data) and then add to pb.
-		c.out.pb -= int64(len(data))
+		c.addPendingBytes(-int64(len(data)))
 		atomic.AddInt64(&c.srv.slowConsumers, 1)
 		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
 		c.markConnAsClosed(SlowConsumerPendingBytes, true)
@@ -1623,7 +1983,7 @@ func (c *client) queueOutbound(data []byte) bool {
 			// We will copy to primary.
 			if c.out.p == nil {
 				// Grow here
-				if (c.out.sz << 1) <= maxBufSize {
+				if (c.out.sz << 1) <= c.out.mcs {
 					c.out.sz <<= 1
 				}
 				if len(data) > int(c.out.sz) {
@@ -1653,6 +2013,51 @@ func (c *client) queueOutbound(data []byte) bool {
 	return referenced
 }
 
+// queuePriorityOutbound queues the message of a high priority subscription,
+// written before the other pending data. The message is copied since the
+// outbound buffers are not used.
+// Lock should be held.
+func (c *client) queuePriorityOutbound(mh, msg []byte) {
+	// The compressor keeps the order of the data.
+	if c.out.cw != nil {
+		c.queueOutbound(mh)
+		c.queueOutbound(msg)
+		return
+	}
+	if c.flags.isSet(closeConnection) {
+		return
+	}
+	size := int64(len(mh) + len(msg))
+	c.addPendingBytes(size)
+	if c.kind == CLIENT && c.out.pb > c.out.mp {
+		c.addPendingBytes(-size)
+		atomic.AddInt64(&c.srv.slowConsumers, 1)
+		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
+		c.markConnAsClosed(SlowConsumerPendingBytes, true)
+		return
+	}
+	data := make([]byte, 0, size)
+	data = append(data, mh...)
+	c.out.hp = append(c.out.hp, append(data, msg...))
+	// Written ahead of the shared payloads queued in nb.
+	for i := range c.out.sh {
+		c.out.sh[i].end += size
+	}
+}
+
+// parseSubPriority returns the priority of a subscription from its name.
+func parseSubPriority(name string) (int8, bool) {
+	switch strings.ToLower(name) {
+	case "high":
+		return subPriorityHigh, true
+	case "normal":
+		return subPriorityNormal, true
+	case "low":
+		return subPriorityLow, true
+	}
+	return 0, false
+}
+
 // Assume the lock is held upon entry.
 func (c *client) enqueueProtoAndFlush(proto []byte, doFlush bool) {
 	if c.isClosed() {
@@ -1728,6 +2133,9 @@ func (c *client) generateClientInfoJSON(info Info) []byte {
 	info.CID = c.cid
 	info.ClientIP = c.host
 	info.MaxPayload = c.mpay
+	if c.acc != nil && c.acc.maxCtrlLine > 0 {
+		info.MaxControlLine = c.mcl
+	}
 	// Generate the info json
 	b, _ := json.Marshal(info)
 	pcs := [][]byte{[]byte("INFO"), b, []byte(CR_LF)}
@@ -1803,8 +2211,9 @@ func (c *client) processPing() {
 		// send a double INFO protocol.
 		c.flags.set(firstPongSent)
 		// If there was a cluster update since this client was created,
-		// send an updated INFO protocol now.
-		if srv.lastCURLsUpdate >= c.start.UnixNano() || c.mpay != int32(opts.MaxPayload) {
+		// or its account has its own limits, send an updated INFO protocol now.
+		if srv.lastCURLsUpdate >= c.start.UnixNano() || c.mpay != int32(opts.MaxPayload) ||
+			c.acc != nil && c.acc.maxCtrlLine > 0 {
 			c.enqueueProto(c.generateClientInfoJSON(srv.copyInfo()))
 		}
 		c.mu.Unlock()
@@ -1878,6 +2287,54 @@ func (c *client) processPub(arg []byte) error {
 	return nil
 }
 
+// processHeaderPub handles HPUB <subject> [reply] <hdr_len> <total_len>,
+// where the header is included at the start of the payload.
+func (c *client) processHeaderPub(arg []byte) error {
+	if !c.headers {
+		c.sendErr("Message Headers Not Supported")
+		return ErrMsgHeadersNotSupported
+	}
+	args := splitArg(arg)
+	c.pa.arg = arg
+	switch len(args) {
+	case 3:
+		c.pa.subject = args[0]
+		c.pa.reply = nil
+		c.pa.hdb = args[1]
+		c.pa.szb = args[2]
+	case 4:
+		c.pa.subject = args[0]
+		c.pa.reply = args[1]
+		c.pa.hdb = args[2]
+		c.pa.szb = args[3]
+	default:
+		return fmt.Errorf("processHeaderPub Parse Error: '%s'", arg)
+	}
+	c.pa.hdr = parseSize(c.pa.hdb)
+	c.pa.size = parseSize(c.pa.szb)
+	if c.pa.hdr <= 0 {
+		return fmt.Errorf("processHeaderPub Bad or Missing Header Size: '%s'", arg)
+	}
+	if c.pa.size < 0 {
+		return fmt.Errorf("processHeaderPub Bad or Missing Size: '%s'", arg)
+	}
+	if c.pa.hdr > c.pa.size {
+		return fmt.Errorf("processHeaderPub Header Size larger than Total Size: '%s'", arg)
+	}
+	c.pa.psz = []byte(strconv.Itoa(c.pa.size - c.pa.hdr))
+	maxPayload := atomic.LoadInt32(&c.mpay)
+	// Use int64() to avoid int32 overrun...
+	if maxPayload != jwt.NoLimit && int64(c.pa.size) > int64(maxPayload) {
+		c.maxPayloadViolation(c.pa.size, maxPayload)
+		return ErrMaxPayload
+	}
+
+	if c.opts.Pedantic && !IsValidLiteralSubject(string(c.pa.subject)) {
+		c.sendErr("Invalid Publish Subject")
+	}
+	return nil
+}
+
 func splitArg(arg []byte) [][]byte {
 	a := [MAX_MSG_ARGS][]byte{}
 	args := a[:0]
@@ -1911,6 +2368,36 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 	copy(arg, argo)
 	args := splitArg(arg)
 	sub := &subscription{client: c}
+	// Clients that opted in with sub_filters can add a payload filter as
+	// the last argument, e.g. SUB foo 1 prefix=bar, or a header filter,
+	// e.g. SUB foo 1 header=Region:eu, and the ones that opted in with
+	// sub_priorities a priority, e.g. SUB foo 1 priority=high.
+	var hasPrio bool
+	for len(args) > 2 {
+		last := args[len(args)-1]
+		if c.opts.SubFilters && sub.filter == nil && bytes.HasPrefix(last, []byte(subFilterPrefix)) {
+			sub.filter = last[len(subFilterPrefix):]
+			if len(sub.filter) == 0 {
+				return nil, fmt.Errorf("processSub Parse Error: '%s'", arg)
+			}
+		} else if c.opts.SubFilters && sub.hfilter == nil && bytes.HasPrefix(last, []byte(subHeaderFilterPrefix)) {
+			// Headers are only delivered to the clients supporting them.
+			hf := parseSubHeaderFilter(last[len(subHeaderFilterPrefix):])
+			if hf == nil || !c.headers {
+				return nil, fmt.Errorf("processSub Parse Error: '%s'", arg)
+			}
+			sub.hfilter = hf
+		} else if c.opts.SubPriorities && !hasPrio && bytes.HasPrefix(last, []byte(subPriorityPrefix)) {
+			prio, ok := parseSubPriority(string(last[len(subPriorityPrefix):]))
+			if !ok {
+				return nil, fmt.Errorf("processSub Parse Error: '%s'", arg)
+			}
+			sub.prio, hasPrio = prio, true
+		} else {
+			break
+		}
+		args = args[:len(args)-1]
+	}
 	switch len(args) {
 	case 2:
 		sub.subject = args[0]
@@ -1959,6 +2446,14 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 			c.subPermissionViolation(sub)
 			return nil, nil
 		}
+		// Check the naming conventions of the account.
+		if acc != nil && acc.subjectRules != nil {
+			if err := acc.subjectRules.check(string(sub.subject)); err != nil {
+				c.mu.Unlock()
+				c.subjectNamingViolation("Subscription", sub.subject, err)
+				return nil, nil
+			}
+		}
 	}
 	// Check if we have a maximum on the number of subscriptions.
 	if c.subsAtLimit() {
@@ -1966,6 +2461,12 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 		c.maxSubsExceeded()
 		return nil, nil
 	}
+	// The account wide maximum only applies to client connections.
+	if kind == CLIENT && acc != nil && c.subs[sid] == nil && acc.subsAtLimit() {
+		c.mu.Unlock()
+		c.maxAccountSubsExceeded()
+		return nil, nil
+	}
 
 	var updateGWs bool
 	var err error
@@ -1978,6 +2479,9 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 			if err != nil {
 				delete(c.subs, sid)
 			} else {
+				if kind == CLIENT {
+					atomic.AddInt32(&acc.csubs, 1)
+				}
 				updateGWs = c.srv.gateway.enabled
 			}
 		}
@@ -2047,7 +2551,7 @@ func (c *client) addShadowSubscriptions(acc *Account, sub *subscription) error {
 			continue
 		}
 		subj := string(sub.subject)
-		if subj == im.prefix+im.from {
+		if subj == im.to {
 			ims = append(ims, im)
 			continue
 		}
@@ -2067,10 +2571,10 @@ func (c *client) addShadowSubscriptions(acc *Account, sub *subscription) error {
 			}
 			tokens = append(tokens, subj[start:])
 		}
-		if isSubsetMatch(tokens, im.prefix+im.from) {
+		if isSubsetMatch(tokens, im.to) {
 			ims = append(ims, im)
 		} else if hasWC {
-			if subjectIsSubsetMatch(im.prefix+im.from, subj) {
+			if subjectIsSubsetMatch(im.to, subj) {
 				froms = append(froms, im)
 			}
 		}
@@ -2118,6 +2622,13 @@ func (c *client) addShadowSub(sub *subscription, im *streamImport, useFrom bool)
 	nsub.im = im
 	if useFrom {
 		nsub.subject = []byte(im.from)
+	} else if im.rtr != nil {
+		// Map the subject back into the publisher account space.
+		subj, err := im.rtr.transformSubject(string(sub.subject))
+		if err != nil {
+			return nil, err
+		}
+		nsub.subject = []byte(subj)
 	} else if im.prefix != "" {
 		// redo subject here to match subject in the publisher account space.
 		// Just remove prefix from what they gave us. That maps into other space.
@@ -2173,6 +2684,9 @@ func (c *client) canSubscribe(subject string) bool {
 			}
 		}
 	}
+	if !allowed {
+		allowed = c.subGranted(subject)
+	}
 	return allowed
 }
 
@@ -2227,6 +2741,9 @@ func (c *client) canQueueSubscribe(subject, queue string) bool {
 		}
 	}
 
+	if !allowed {
+		allowed = c.subGranted(subject)
+	}
 	return allowed
 }
 
@@ -2253,8 +2770,8 @@ func (c *client) unsubscribe(acc *Account, sub *subscription, force, remove bool
 	// with open subscriptions.
 	if remove {
 		delete(c.subs, string(sub.sid))
-		if acc != nil {
-			acc.sl.Remove(sub)
+		if acc != nil && acc.sl.Remove(sub) == nil && c.kind == CLIENT {
+			atomic.AddInt32(&acc.csubs, -1)
 		}
 	}
 
@@ -2345,6 +2862,73 @@ func (c *client) processUnsub(arg []byte) error {
 	return nil
 }
 
+// processDrain handles a client request to drain a subscription. The
+// interest is first removed from routes, gateways and leafnodes, but the
+// subscription keeps receiving messages until the remote servers had a
+// chance to stop sending them. It is then removed and the client gets a
+// confirmation, sent after any message that was delivered to it.
+func (c *client) processDrain(arg []byte) error {
+	args := splitArg(arg)
+	if len(args) != 1 {
+		return fmt.Errorf("processDrain Parse Error: '%s'", arg)
+	}
+	sid := string(args[0])
+
+	c.mu.Lock()
+	srv, acc := c.srv, c.acc
+	sub := c.subs[sid]
+	if sub != nil {
+		// Remove it now so that it is neither counted nor
+		// unsubscribed twice if the connection is closed.
+		delete(c.subs, sid)
+		// Drain overrides auto-unsubscribe.
+		sub.max = 0
+	}
+	c.mu.Unlock()
+
+	if c.opts.Verbose {
+		c.sendOK()
+	}
+	if sub == nil || acc == nil {
+		c.sendDrained(sid)
+		return nil
+	}
+
+	srv.updateRouteSubscriptionMap(acc, sub, -1)
+	if srv.gateway.enabled {
+		srv.gatewayUpdateSubInterest(acc.Name, sub, -1)
+	}
+	srv.updateLeafNodes(acc, sub, -1)
+
+	done := func() {
+		if acc.sl.Remove(sub) == nil {
+			atomic.AddInt32(&acc.csubs, -1)
+		}
+		// This takes care of the shadow subscriptions.
+		c.unsubscribe(acc, sub, true, false)
+		c.sendDrained(sid)
+	}
+	if delay := srv.drainDelay(); delay > 0 {
+		time.AfterFunc(delay, done)
+	} else {
+		done()
+	}
+	return nil
+}
+
+// Sends the confirmation that the subscription sid has been drained.
+func (c *client) sendDrained(sid string) {
+	c.mu.Lock()
+	if !c.isClosed() {
+		if c.trace {
+			c.traceOutOp("DRAINED", []byte(sid))
+		}
+		c.enqueueProto([]byte(fmt.Sprintf(drainedProto, sid)))
+		c.flushSignal()
+	}
+	c.mu.Unlock()
+}
+
 // checkDenySub will check if we are allowed to deliver this message in the
 // presence of deny clauses for subscriptions. Deny clauses will not prevent
 // larger scoped wildcard subscriptions, so we need to check at delivery time.
@@ -2364,7 +2948,20 @@ func (c *client) checkDenySub(subject string) bool {
 	return false
 }
 
+// The message header mh is expected to start in c.msgb at index 1, unless
+// it outgrew c.msgb.
 func (c *client) msgHeader(mh []byte, sub *subscription, reply []byte) []byte {
+	// Messages with a header are sent as HMSG to clients supporting headers,
+	// so use the byte before MSG for the protocol name while mh is still in
+	// c.msgb, a long subject having moved it elsewhere.
+	if c.pa.hdr > 0 && sub.client.headers {
+		if cap(mh) == len(c.msgb)-1 {
+			c.msgb[0] = 'H'
+			mh = c.msgb[:len(mh)+1]
+		} else {
+			mh = append([]byte{'H'}, mh...)
+		}
+	}
 	if len(sub.sid) > 0 {
 		mh = append(mh, sub.sid...)
 		mh = append(mh, ' ')
@@ -2373,11 +2970,60 @@ func (c *client) msgHeader(mh []byte, sub *subscription, reply []byte) []byte {
 		mh = append(mh, reply...)
 		mh = append(mh, ' ')
 	}
-	mh = append(mh, c.pa.szb...)
+	mh = c.appendMsgSize(mh, sub.client)
 	mh = append(mh, _CRLF_...)
 	return mh
 }
 
+// Appends the size part of the message protocol for the given connection.
+// If the message has a header, this is the header and total size for
+// connections supporting headers, or the size of the payload without
+// the header for the others.
+func (c *client) appendMsgSize(mh []byte, dst *client) []byte {
+	if c.pa.hdr > 0 {
+		if !dst.headers {
+			return append(mh, c.pa.psz...)
+		}
+		mh = append(mh, c.pa.hdb...)
+		mh = append(mh, ' ')
+	}
+	return append(mh, c.pa.szb...)
+}
+
+// subHeaderFilter is the header filter of a subscription, which only
+// delivers the messages having the header key with exactly the value.
+type subHeaderFilter struct {
+	key   string
+	value []byte
+}
+
+// Parses a header filter of the form key:value, returns nil if invalid.
+func parseSubHeaderFilter(arg []byte) *subHeaderFilter {
+	i := bytes.IndexByte(arg, ':')
+	if i <= 0 || i == len(arg)-1 {
+		return nil
+	}
+	return &subHeaderFilter{key: string(arg[:i]), value: arg[i+1:]}
+}
+
+// Returns true if the message msg, whose header is hdr bytes long, has
+// the header of the filter with its value.
+func (hf *subHeaderFilter) match(hdr int, msg []byte) bool {
+	if hdr <= 0 || hdr > len(msg) {
+		return false
+	}
+	return bytes.Equal(getHeader(hf.key, msg[:hdr]), hf.value)
+}
+
+// Returns the message to deliver to the given connection, which is the
+// message without its header if the connection does not support headers.
+func (c *client) msgForClient(msg []byte, dst *client) []byte {
+	if c.pa.hdr > 0 && !dst.headers {
+		return msg[c.pa.hdr:]
+	}
+	return msg
+}
+
 func (c *client) stalledWait(producer *client) {
 	stall := c.out.stc
 	ttl := stallDuration(c.out.pb, c.out.mp)
@@ -2421,6 +3067,23 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 		return false
 	}
 
+	// Drop messages that do not match the subscription's payload filter.
+	if sub.filter != nil {
+		payload := msg
+		if c.pa.hdr > 0 && client.headers {
+			payload = msg[c.pa.hdr:]
+		}
+		if !bytes.HasPrefix(payload, sub.filter) {
+			client.mu.Unlock()
+			return false
+		}
+	}
+	// Drop messages that do not match the subscription's header filter.
+	if sub.hfilter != nil && !sub.hfilter.match(c.pa.hdr, msg) {
+		client.mu.Unlock()
+		return false
+	}
+
 	// Check if we have a subscribe deny clause. This will trigger us to check the subject
 	// for a match against the denied subjects.
 	if client.mperms != nil && client.checkDenySub(string(subject)) {
@@ -2436,6 +3099,14 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 		return false
 	}
 
+	// Under backpressure, drop the messages of low priority subscriptions
+	// before the connection becomes a slow consumer.
+	if sub.prio == subPriorityLow && client.kind == CLIENT && client.out.pb > client.out.mp/2 {
+		client.out.sm++
+		client.mu.Unlock()
+		return false
+	}
+
 	srv := client.srv
 
 	sub.nm++
@@ -2489,6 +3160,10 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 
 	atomic.AddInt64(&srv.outMsgs, 1)
 	atomic.AddInt64(&srv.outBytes, msgSize)
+	if client.acc != nil && (client.kind == CLIENT || client.kind == LEAF) {
+		atomic.AddInt64(&client.acc.stats.outMsgs, 1)
+		atomic.AddInt64(&client.acc.stats.outBytes, msgSize)
+	}
 
 	// Check for internal subscription.
 	if client.kind == SYSTEM {
@@ -2541,18 +3216,29 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 	}
 
 	// Queue to outbound buffer
-	client.queueOutbound(mh)
-	client.queueOutbound(msg)
+	if sub.prio == subPriorityHigh {
+		client.queuePriorityOutbound(mh, msg)
+	} else if sp := c.in.sp; sp != nil && client.kind == CLIENT && client.out.cw == nil && sp.owns(msg) {
+		client.queueOutbound(mh)
+		client.queueSharedOutbound(msg, sp)
+	} else {
+		client.queueOutbound(mh)
+		client.queueOutbound(msg)
+	}
+
+	// The message is lost if the connection just became a slow consumer.
+	var dlAcc *Account
+	var dlAdv *DeadLetterAdvisory
+	if client.kind == CLIENT && client.isClosed() {
+		dlAcc, dlAdv = client.newDeadLetter(deadLetterSlowConsumer, subject, c.pa.reply, msg)
+	}
 
 	client.out.pm++
 
 	// If we are tracking dynamic publish permissions that track reply subjects,
 	// do that accounting here. We only look at client.replies which will be non-nil.
 	if client.replies != nil && len(c.pa.reply) > 0 {
-		client.replies[string(c.pa.reply)] = &resp{time.Now(), 0}
-		if len(client.replies) > replyPermLimit {
-			client.pruneReplyPerms()
-		}
+		client.addReplyPerm(string(c.pa.reply))
 	}
 
 	// Check outbound threshold and queue IO flush if needed.
@@ -2560,7 +3246,7 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 	// to intervene before this producer goes back to top of readloop. We are in the producer's
 	// readloop go routine at this point.
 	// FIXME(dlc) - We may call this alot, maybe suppress after first call?
-	if client.out.pm > 1 && client.out.pb > maxBufSize*2 {
+	if client.out.pm > 1 && client.out.pb > int64(client.out.mcs)*2 {
 		client.flushSignal()
 	}
 
@@ -2575,8 +3261,19 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 		client.traceOutOp(string(mh[:len(mh)-LEN_CR_LF]), nil)
 	}
 
+	if c.mt != nil {
+		c.mt.addEgress(client, sub)
+	}
+	if c.otel != nil {
+		c.otel.addEgress(client, subject)
+	}
+
 	client.mu.Unlock()
 
+	if dlAdv != nil {
+		srv.sendDeadLetter(dlAcc, dlAdv)
+	}
+
 	return true
 }
 
@@ -2599,24 +3296,30 @@ func (c *client) trackRemoteReply(reply string) {
 	}
 }
 
-// pruneReplyPerms will remove any stale or expired entries
-// in our reply cache. We make sure to not check too often.
-func (c *client) pruneReplyPerms() {
-	// Make sure we do not check too often.
-	if c.perms.resp == nil {
-		return
+// addReplyPerm allows this client to respond on reply. Expired entries
+// are swept periodically so that idle clients release them as well.
+// Lock should be held.
+func (c *client) addReplyPerm(reply string) {
+	w := c.replies
+	w.add(reply, time.Now())
+	if w.tmr == nil && w.tick > 0 {
+		w.tmr = time.AfterFunc(w.sweepInterval(), c.expireReplyPerms)
 	}
+}
 
-	mm := c.perms.resp.MaxMsgs
-	ttl := c.perms.resp.Expires
-	now := time.Now()
-
-	for k, resp := range c.replies {
-		if mm > 0 && resp.n >= mm {
-			delete(c.replies, k)
-		} else if ttl > 0 && now.Sub(resp.t) > ttl {
-			delete(c.replies, k)
-		}
+// expireReplyPerms is invoked from the sweep timer.
+func (c *client) expireReplyPerms() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.replies
+	if w == nil || w.tmr == nil {
+		return
+	}
+	w.expire(time.Now())
+	if w.len() > 0 {
+		w.tmr.Reset(w.sweepInterval())
+	} else {
+		w.tmr = nil
 	}
 }
 
@@ -2675,20 +3378,16 @@ func (c *client) pubAllowedFullCheck(subject string, fullCheck bool) bool {
 	// Check if published subject is allowed if we have permissions in place.
 	allowed, ok := c.perms.pcache[subject]
 	if ok {
+		if !allowed && fullCheck {
+			allowed = c.pubGranted(subject)
+		}
 		return allowed
 	}
-	// Cache miss, check allow then deny as needed.
-	if c.perms.pub.allow != nil {
-		r := c.perms.pub.allow.Match(subject)
-		allowed = len(r.psubs) != 0
+	// Cache miss, check allow and deny with the compiled permissions.
+	if c.perms.ptrie != nil {
+		allowed = c.perms.ptrie.allowed(subject)
 	} else {
-		// No entries means all are allowed. Deny will overrule as needed.
-		allowed = true
-	}
-	// If we have a deny list and are currently allowed, check that as well.
-	if allowed && c.perms.pub.deny != nil {
-		r := c.perms.pub.deny.Match(subject)
-		allowed = len(r.psubs) == 0
+		allowed = c.pubAllowedBySublists(subject)
 	}
 
 	// If we are currently not allowed but we are tracking reply subjects
@@ -2696,16 +3395,8 @@ func (c *client) pubAllowedFullCheck(subject string, fullCheck bool) bool {
 	// We need to acquire the lock though.
 	if !allowed && fullCheck && c.perms.resp != nil {
 		c.mu.Lock()
-		if resp := c.replies[subject]; resp != nil {
-			resp.n++
-			// Check if we have sent too many responses.
-			if c.perms.resp.MaxMsgs > 0 && resp.n > c.perms.resp.MaxMsgs {
-				delete(c.replies, subject)
-			} else if c.perms.resp.Expires > 0 && time.Since(resp.t) > c.perms.resp.Expires {
-				delete(c.replies, subject)
-			} else {
-				allowed = true
-			}
+		if c.replies != nil {
+			allowed = c.replies.allow(string(subject), time.Now(), c.perms.resp.MaxMsgs)
 		}
 		c.mu.Unlock()
 	} else {
@@ -2716,9 +3407,110 @@ func (c *client) pubAllowedFullCheck(subject string, fullCheck bool) bool {
 			c.prunePubPermsCache()
 		}
 	}
+	// Temporary grants are not cached since they expire.
+	if !allowed && fullCheck {
+		allowed = c.pubGranted(subject)
+	}
+	return allowed
+}
+
+// Checks the allow then deny sublists of the publish permissions, for the
+// permissions that were not compiled into a trie.
+func (c *client) pubAllowedBySublists(subject string) bool {
+	allowed := true
+	if c.perms.pub.allow != nil {
+		r := c.perms.pub.allow.Match(subject)
+		allowed = len(r.psubs) != 0
+	}
+	// If we have a deny list and are currently allowed, check that as well.
+	if allowed && c.perms.pub.deny != nil {
+		r := c.perms.pub.deny.Match(subject)
+		allowed = len(r.psubs) == 0
+	}
 	return allowed
 }
 
+// Returns true if a temporary grant allows publishing on this subject.
+// Lock should not be held.
+func (c *client) pubGranted(subject string) bool {
+	c.mu.Lock()
+	g := c.grant
+	allowed := g != nil && g.pub != nil && len(g.pub.Match(subject).psubs) > 0
+	c.mu.Unlock()
+	return allowed
+}
+
+// Returns true if a temporary grant allows subscribing on this subject.
+// Lock should be held.
+func (c *client) subGranted(subject string) bool {
+	g := c.grant
+	return g != nil && g.sub != nil && len(g.sub.Match(subject).psubs) > 0
+}
+
+// Sets a temporary grant on top of the client's permissions, replacing
+// any existing one. The grant is revoked once it expires.
+func (c *client) setPermissionGrant(pub, sub []string, expires time.Duration) error {
+	g := &permGrant{expires: time.Now().Add(expires)}
+	newSublist := func(subjects []string) (*Sublist, error) {
+		if len(subjects) == 0 {
+			return nil, nil
+		}
+		sl := NewSublistWithCache()
+		for _, subject := range subjects {
+			if !IsValidSubject(subject) {
+				return nil, fmt.Errorf("invalid subject %q", subject)
+			}
+			sl.Insert(&subscription{subject: []byte(subject)})
+		}
+		return sl, nil
+	}
+	var err error
+	if g.pub, err = newSublist(pub); err != nil {
+		return err
+	}
+	if g.sub, err = newSublist(sub); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return ErrConnectionClosed
+	}
+	if c.grant != nil {
+		c.grant.timer.Stop()
+	}
+	g.timer = time.AfterFunc(expires, func() { c.revokePermissionGrant(g) })
+	c.grant = g
+	c.mu.Unlock()
+	return nil
+}
+
+// Revokes the given temporary grant if it is still the active one.
+// Passing nil revokes whatever grant is in place. Subscriptions that
+// are no longer allowed are removed. Returns false if nothing was revoked.
+func (c *client) revokePermissionGrant(g *permGrant) bool {
+	c.mu.Lock()
+	if c.grant == nil || (g != nil && c.grant != g) {
+		c.mu.Unlock()
+		return false
+	}
+	c.grant.timer.Stop()
+	c.grant = nil
+	closed := c.isClosed()
+	srv := c.srv
+	c.mu.Unlock()
+
+	if closed {
+		return true
+	}
+	if srv != nil {
+		srv.Noticef("Revoked temporary permissions for %s (cid %d)", c.getAuthUser(), c.cid)
+		srv.sendPermissionGrantEvent(c, nil)
+	}
+	c.processSubsOnConfigReload(nil)
+	return true
+}
+
 // Test whether a reply subject is a service import reply.
 func isServiceReply(reply []byte) bool {
 	// This function is inlined and checking this way is actually faster
@@ -2740,6 +3532,18 @@ func isReservedReply(reply []byte) bool {
 
 // This will decide to call the client code or router code.
 func (c *client) processInboundMsg(msg []byte) {
+	if c.srv != nil && c.srv.msgTracing() {
+		c.startMsgTrace(msg)
+		if c.mt != nil {
+			defer c.endMsgTrace()
+		}
+	}
+	if c.srv != nil && c.pa.hdr > 0 && c.srv.otelEnabled() {
+		c.startOTelSpan(msg)
+		if c.otel != nil {
+			defer c.endOTelSpan()
+		}
+	}
 	switch c.kind {
 	case CLIENT:
 		c.processInboundClientMsg(msg)
@@ -2771,6 +3575,14 @@ func (c *client) processInboundClientMsg(msg []byte) {
 		return
 	}
 
+	// Check the naming conventions of the account.
+	if c.kind == CLIENT && c.acc != nil && c.acc.subjectRules != nil {
+		if err := c.acc.subjectRules.check(string(c.pa.subject)); err != nil {
+			c.subjectNamingViolation("Publish", c.pa.subject, err)
+			return
+		}
+	}
+
 	// Now check for reserved replies. These are used for service imports.
 	if len(c.pa.reply) > 0 && isReservedReply(c.pa.reply) {
 		c.replySubjectViolation(c.pa.reply)
@@ -2786,14 +3598,29 @@ func (c *client) processInboundClientMsg(msg []byte) {
 		return
 	}
 
+	c.recordTraffic()
+
+	// Messages with a delay header are held and delivered later. The delayed
+	// delivery is set up before the clients are accepted.
+	if c.kind == CLIENT && c.pa.hdr > 0 && c.srv.delayed != nil && c.delayMsg(c.srv.delayed, msg) {
+		return
+	}
+
+	// Messages whose id was already published within the duplicate window
+	// of the account are accepted but not delivered.
+	if c.pa.hdr > 0 && c.acc.isDuplicateMsg(c.pa.subject, msg[:c.pa.hdr]) {
+		return
+	}
+
 	// Check if this client's gateway replies map is not empty
 	if atomic.LoadInt32(&c.cgwrt) > 0 && c.handleGWReplyMap(msg) {
 		return
 	}
 
 	// Check to see if we need to map/route to another account.
+	var imported bool
 	if c.acc.imports.services != nil {
-		c.checkForImportServices(c.acc, msg)
+		imported = c.checkForImportServices(c.acc, msg)
 	}
 
 	// If we have an exported service and we are doing remote tracking, check this subject
@@ -2816,7 +3643,7 @@ func (c *client) processInboundClientMsg(msg []byte) {
 			sanitizeLatencyMetric(sl)
 
 			lsub := remoteLatencySubjectForResponse(c.pa.subject)
-			c.srv.sendInternalAccountMsg(nil, lsub, &rl) // Send to SYS account
+			c.srv.sendInternalMsgLocked(lsub, _EMPTY_, &rl.Server, rl) // Send to SYS account
 		}
 	}
 
@@ -2854,7 +3681,9 @@ func (c *client) processInboundClientMsg(msg []byte) {
 
 	// Check for no interest, short circuit if so.
 	// This is the fanout scale.
-	if len(r.psubs)+len(r.qsubs) > 0 {
+	if len(r.psubs) == 1 && len(r.qsubs) == 0 && c.deliverToSingleSub(r.psubs[0], msg) {
+		// Delivered through the fast path.
+	} else if len(r.psubs)+len(r.qsubs) > 0 {
 		flag := pmrNoFlag
 		// If there are matching queue subs and we are in gateway mode,
 		// we need to keep track of the queue names the messages are
@@ -2869,8 +3698,63 @@ func (c *client) processInboundClientMsg(msg []byte) {
 	}
 
 	// Now deal with gateways
+	var gwSent bool
 	if c.srv.gateway.enabled {
-		c.sendMsgToGateways(c.acc, msg, c.pa.subject, c.pa.reply, qnames)
+		gwSent = c.sendMsgToGateways(c.acc, msg, c.pa.subject, c.pa.reply, qnames)
+	}
+
+	// Let the requestor know right away that there is nobody to respond.
+	if len(c.pa.reply) > 0 && !imported && !gwSent && len(r.psubs)+len(r.qsubs) == 0 {
+		if c.opts.NoResponders {
+			c.sendNoResponders(c.pa.reply)
+		}
+		c.mu.Lock()
+		acc, adv := c.newDeadLetter(deadLetterNoResponders, c.pa.subject, c.pa.reply, msg)
+		c.mu.Unlock()
+		if adv != nil {
+			c.srv.sendDeadLetter(acc, adv)
+		}
+	}
+}
+
+// deliverToSingleSub is the fast path for the common case of a message with
+// a single matching subscription that belongs to a local client. It reuses
+// our scratch buffer for the header and skips the route, leafnode and queue
+// handling of processMsgResults. Returns false if the subscription does not
+// qualify, in which case the caller should fall back to processMsgResults.
+func (c *client) deliverToSingleSub(sub *subscription, msg []byte) bool {
+	if sub.client.kind != CLIENT || sub.im != nil || isGWRoutedReply(c.pa.reply) {
+		return false
+	}
+	mh := c.msgb[1:msgHeadProtoLen]
+	mh = append(mh, c.pa.subject...)
+	mh = append(mh, ' ')
+	mh = c.msgHeader(mh, sub, c.pa.reply)
+	c.deliverMsg(sub, c.pa.subject, mh, c.msgForClient(msg, sub.client), false)
+	return true
+}
+
+// Status message sent back to requestors when there is no interest.
+const noRespondersHdr = "NATS/1.0 503\r\n\r\n"
+
+// sendNoResponders sends a headers only 503 status message to the client's
+// own subscription on the reply subject, if there is one.
+func (c *client) sendNoResponders(reply []byte) {
+	r := c.acc.sl.Match(string(reply))
+	for _, sub := range r.psubs {
+		if sub.client != c {
+			continue
+		}
+		proto := fmt.Sprintf("HMSG %s %s %d %d\r\n%s\r\n",
+			reply, sub.sid, len(noRespondersHdr), len(noRespondersHdr), noRespondersHdr)
+		c.mu.Lock()
+		if c.trace {
+			c.traceOutOp(proto[:strings.IndexByte(proto, '\r')], nil)
+		}
+		c.enqueueProto([]byte(proto))
+		c.pcd[c] = needFlush
+		c.mu.Unlock()
+		return
 	}
 }
 
@@ -2911,7 +3795,7 @@ func (c *client) handleGWReplyMap(msg []byte) bool {
 		sanitizeLatencyMetric(sl)
 
 		lsub := remoteLatencySubjectForResponse(c.pa.subject)
-		c.srv.sendInternalAccountMsg(nil, lsub, &rl) // Send to SYS account
+		c.srv.sendInternalMsgLocked(lsub, _EMPTY_, &rl.Server, rl) // Send to SYS account
 	}
 
 	// Check for leaf nodes
@@ -2928,20 +3812,37 @@ func (c *client) handleGWReplyMap(msg []byte) bool {
 }
 
 // This checks and process import services by doing the mapping and sending the
-// message onward if applicable.
-func (c *client) checkForImportServices(acc *Account, msg []byte) {
+// message onward if applicable. Returns true if the message had interest.
+func (c *client) checkForImportServices(acc *Account, msg []byte) (interest bool) {
 	if acc == nil || acc.imports.services == nil {
-		return
+		return false
 	}
 
 	acc.mu.RLock()
 	si := acc.imports.services[string(c.pa.subject)]
+	if si == nil && acc.imports.wcsis > 0 {
+		si = acc.matchMappedServiceImport(string(c.pa.subject))
+	}
 	invalid := si != nil && si.invalid
+	// Responses are only routed back to the requestor while the mapping is valid.
+	expired := si != nil && acc.isExpiredResponseMap(si)
 	acc.mu.RUnlock()
 
+	if expired {
+		acc.removeServiceImport(si.from)
+		return false
+	}
+
 	// Get the results from the other account for the mapped "to" subject.
 	// If we have been marked invalid simply return here.
 	if si != nil && !invalid && si.acc != nil && si.acc.sl != nil {
+		to := si.to
+		if si.tr != nil {
+			var err error
+			if to, err = si.tr.transformSubject(string(c.pa.subject)); err != nil {
+				return false
+			}
+		}
 		var nrr []byte
 		if c.pa.reply != nil {
 			var latency *serviceLatency
@@ -2962,13 +3863,13 @@ func (c *client) checkForImportServices(acc *Account, msg []byte) {
 			}
 		}
 		// FIXME(dlc) - Do L1 cache trick from above.
-		rr := si.acc.sl.Match(si.to)
+		rr := si.acc.sl.Match(to)
 
 		// Check to see if we have no results and this is an internal serviceImport. If so we
 		// need to clean that up.
 		if len(rr.psubs)+len(rr.qsubs) == 0 && si.internal {
 			// We may also have a response entry, so go through that way.
-			si.acc.checkForRespEntry(si.to)
+			si.acc.checkForRespEntry(to)
 		}
 
 		flags := pmrNoFlag
@@ -2977,13 +3878,15 @@ func (c *client) checkForImportServices(acc *Account, msg []byte) {
 		if c.kind == GATEWAY || c.kind == ROUTER || c.kind == LEAF {
 			flags |= pmrIgnoreEmptyQueueFilter
 		}
+		var gwSent bool
 		if c.srv.gateway.enabled {
 			flags |= pmrCollectQueueNames
-			queues := c.processMsgResults(si.acc, rr, msg, []byte(si.to), nrr, flags)
-			c.sendMsgToGateways(si.acc, msg, []byte(si.to), nrr, queues)
+			queues := c.processMsgResults(si.acc, rr, msg, []byte(to), nrr, flags)
+			gwSent = c.sendMsgToGateways(si.acc, msg, []byte(to), nrr, queues)
 		} else {
-			c.processMsgResults(si.acc, rr, msg, []byte(si.to), nrr, flags)
+			c.processMsgResults(si.acc, rr, msg, []byte(to), nrr, flags)
 		}
+		interest = gwSent || len(rr.psubs)+len(rr.qsubs) > 0
 
 		shouldRemove := si.ae
 
@@ -2998,6 +3901,7 @@ func (c *client) checkForImportServices(acc *Account, msg []byte) {
 			acc.removeServiceImport(si.from)
 		}
 	}
+	return interest
 }
 
 func (c *client) addSubToRouteTargets(sub *subscription) {
@@ -3038,6 +3942,7 @@ func (c *client) addSubToRouteTargets(sub *subscription) {
 // This processes the sublist results for a given message.
 func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject, reply []byte, flags int) [][]byte {
 	var queues [][]byte
+	var qp *QueueGroupOpts
 	// msg header for clients.
 	msgh := c.msgb[1:msgHeadProtoLen]
 	msgh = append(msgh, subject...)
@@ -3061,6 +3966,14 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 		creply = reply[gwSubjectOffset:]
 	}
 
+	// A message delivered to many subscriptions is shared by their
+	// connections instead of being copied to each of them.
+	smsg := msg
+	if len(r.psubs) >= sharedPayloadMinFanout && len(msg) >= sharedPayloadMinSize && len(msg) <= maxBufSize {
+		c.in.sp = newSharedPayload(msg)
+		smsg = c.in.sp.buf
+	}
+
 	// Loop over all normal subscriptions that match.
 	for _, sub := range r.psubs {
 		// Check if this is a send to a ROUTER. We now process
@@ -3085,17 +3998,20 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 			continue
 		}
 		// Check for stream import mapped subs. These apply to local subs only.
-		if sub.im != nil && sub.im.prefix != "" {
+		if sub.im != nil && sub.im.isMapped() {
 			// Redo the subject here on the fly.
 			msgh = c.msgb[1:msgHeadProtoLen]
-			msgh = append(msgh, sub.im.prefix...)
-			msgh = append(msgh, subject...)
+			msgh = sub.im.appendSubject(msgh, subject)
 			msgh = append(msgh, ' ')
 			si = len(msgh)
 		}
 		// Normal delivery
 		mh := c.msgHeader(msgh[:si], sub, creply)
-		c.deliverMsg(sub, subject, mh, msg, rplyHasGWPrefix)
+		c.deliverMsg(sub, subject, mh, c.msgForClient(smsg, sub.client), rplyHasGWPrefix)
+	}
+	if c.in.sp != nil {
+		c.in.sp.release()
+		c.in.sp = nil
 	}
 
 	// Set these up to optionally filter based on the queue lists.
@@ -3117,6 +4033,13 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 		c.in.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
 
+	// The distribution policy of the queue groups.
+	if len(r.qsubs) > 0 && c.srv != nil {
+		qp = c.queueGroupOpts()
+	} else {
+		qp = &defaultQueueGroupOpts
+	}
+
 	// Process queue subs
 	for i := 0; i < len(r.qsubs); i++ {
 		qsubs := r.qsubs[i]
@@ -3154,12 +4077,22 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 				}
 			}
 			qsubs = ql
+		} else if qp.Policy == QueuePolicyLocal {
+			// Prefer the local subs, unless they are all busy.
+			qsubs, rsub = localQSubs(qsubs, _ql[:0], qp.SpillThreshold)
 		}
 
 		sindex := 0
 		lqs := len(qsubs)
 		if lqs > 1 {
-			sindex = c.in.prand.Int() % lqs
+			switch {
+			case qp.Policy == QueuePolicyHash:
+				sindex = hashQSubIndex(qsubs, subject)
+			case qp.LocalWeight > 1 && src != ROUTER:
+				sindex = weightedQSubIndex(qsubs, qp.LocalWeight, c.in.prand.Int())
+			default:
+				sindex = c.in.prand.Int() % lqs
+			}
 		}
 
 		// Find a subscription that is able to deliver this message starting at a random index.
@@ -3191,11 +4124,10 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 			}
 
 			// Check for mapped subs
-			if sub.im != nil && sub.im.prefix != "" {
+			if sub.im != nil && sub.im.isMapped() {
 				// Redo the subject here on the fly.
 				msgh = c.msgb[1:msgHeadProtoLen]
-				msgh = append(msgh, sub.im.prefix...)
-				msgh = append(msgh, subject...)
+				msgh = sub.im.appendSubject(msgh, subject)
 				msgh = append(msgh, ' ')
 				si = len(msgh)
 			}
@@ -3207,7 +4139,7 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 			// "rreply" will be stripped of the $GNR prefix (if present)
 			// for client connections only.
 			mh := c.msgHeader(msgh[:si], sub, rreply)
-			if c.deliverMsg(sub, subject, mh, msg, rplyHasGWPrefix) {
+			if c.deliverMsg(sub, subject, mh, c.msgForClient(msg, sub.client), rplyHasGWPrefix) {
 				// Clear rsub
 				rsub = nil
 				if flags&pmrCollectQueueNames != 0 {
@@ -3241,19 +4173,29 @@ sendToRoutesOrLeafs:
 		kind := rt.sub.client.kind
 		mh := c.msgb[:msgHeadProtoLen]
 		if kind == ROUTER {
+			// Do not send subjects owned by other servers to the route.
+			if r := rt.sub.client.route; r != nil && len(r.pruned) > 0 && r.prunes(string(subject)) {
+				continue
+			}
 			// Router (and Gateway) nodes are RMSG. Set here since leafnodes may rewrite.
+			// Messages with a header are HMSG if the route supports headers.
 			mh[0] = 'R'
+			if c.pa.hdr > 0 && rt.sub.client.headers {
+				mh[0] = 'H'
+			}
 			mh = append(mh, acc.Name...)
 			mh = append(mh, ' ')
+			mh = append(mh, subject...)
 		} else {
 			// Leaf nodes are LMSG
 			mh[0] = 'L'
 			// Remap subject if its a shadow subscription, treat like a normal client.
-			if rt.sub.im != nil && rt.sub.im.prefix != "" {
-				mh = append(mh, rt.sub.im.prefix...)
+			if rt.sub.im != nil {
+				mh = rt.sub.im.appendSubject(mh, subject)
+			} else {
+				mh = append(mh, subject...)
 			}
 		}
-		mh = append(mh, subject...)
 		mh = append(mh, ' ')
 
 		if len(rt.qs) > 0 {
@@ -3269,9 +4211,9 @@ sendToRoutesOrLeafs:
 			mh = append(mh, reply...)
 			mh = append(mh, ' ')
 		}
-		mh = append(mh, c.pa.szb...)
+		mh = c.appendMsgSize(mh, rt.sub.client)
 		mh = append(mh, _CRLF_...)
-		c.deliverMsg(rt.sub, subject, mh, msg, false)
+		c.deliverMsg(rt.sub, subject, mh, c.msgForClient(msg, rt.sub.client), false)
 	}
 	return queues
 }
@@ -3315,9 +4257,10 @@ func (c *client) processPingTimer() {
 	// If we have had activity within the PingInterval then
 	// there is no need to send a ping. This can be client data
 	// or if we received a ping from the other side.
-	pingInterval := c.srv.getOpts().PingInterval
+	opts := c.srv.getOpts()
+	pingInterval, maxPingsOut := c.pingPolicy(opts)
 	now := time.Now()
-	needRTT := c.rtt == 0 || now.Sub(c.rttStart) > DEFAULT_RTT_MEASUREMENT_INTERVAL
+	needRTT := c.rtt == 0 || now.Sub(c.rttStart) > opts.RTTInterval
 
 	if delta := now.Sub(c.last); delta < pingInterval && !needRTT {
 		c.Debugf("Delaying PING due to client activity %v ago", delta.Round(time.Second))
@@ -3325,7 +4268,7 @@ func (c *client) processPingTimer() {
 		c.Debugf("Delaying PING due to remote ping %v ago", delta.Round(time.Second))
 	} else {
 		// Check for violation
-		if c.ping.out+1 > c.srv.getOpts().MaxPingsOut {
+		if c.ping.out+1 > maxPingsOut {
 			c.Debugf("Stale Client Connection - Closing")
 			c.enqueueProto([]byte(fmt.Sprintf(errProto, "Stale Connection")))
 			c.mu.Unlock()
@@ -3346,10 +4289,39 @@ func (c *client) setPingTimer() {
 	if c.srv == nil {
 		return
 	}
-	d := c.srv.getOpts().PingInterval
+	d, _ := c.pingPolicy(c.srv.getOpts())
 	c.ping.tmr = time.AfterFunc(d, c.processPingTimer)
 }
 
+// pingPolicy returns the ping interval and the maximum number of outstanding
+// pings of the connection. The cluster, gateway and leafnode blocks override
+// the global values for their connections, and so does the account of a
+// client connection.
+// Lock should be held.
+func (c *client) pingPolicy(opts *Options) (time.Duration, int) {
+	var d time.Duration
+	var max int
+	switch c.kind {
+	case CLIENT:
+		if c.acc != nil {
+			d, max = c.acc.pingInterval, c.acc.maxPingsOut
+		}
+	case ROUTER:
+		d, max = opts.Cluster.PingInterval, opts.Cluster.MaxPingsOut
+	case GATEWAY:
+		d, max = opts.Gateway.PingInterval, opts.Gateway.MaxPingsOut
+	case LEAF:
+		d, max = opts.LeafNode.PingInterval, opts.LeafNode.MaxPingsOut
+	}
+	if d <= 0 {
+		d = opts.PingInterval
+	}
+	if max <= 0 {
+		max = opts.MaxPingsOut
+	}
+	return d, max
+}
+
 // Lock should be held
 func (c *client) clearPingTimer() {
 	if c.ping.tmr == nil {
@@ -3394,7 +4366,7 @@ func (c *client) setExpirationTimer(d time.Duration) {
 // minimal write deadline.
 // Lock is held on entry.
 func (c *client) flushAndClose(minimalFlush bool) {
-	if !c.flags.isSet(skipFlushOnClose) && c.out.pb > 0 {
+	if !c.flags.isSet(skipFlushOnClose) && (c.out.pb > 0 || c.out.cwd) {
 		if minimalFlush {
 			const lowWriteDeadline = 100 * time.Millisecond
 
@@ -3406,6 +4378,13 @@ func (c *client) flushAndClose(minimalFlush bool) {
 		c.flushOutbound()
 	}
 	c.out.p, c.out.s = nil, nil
+	c.flags.set(outboundClosed)
+	// Another goroutine may still be writing the shared payloads, in which
+	// case it releases them when done, see flushOutbound().
+	if len(c.out.sh) > 0 && !c.flags.isSet(flushOutbound) {
+		c.out.nb = nil
+		c.releaseSharedPayloads()
+	}
 
 	// Close the low level connection. WriteDeadline need to be set
 	// in case this is a TLS connection.
@@ -3429,6 +4408,19 @@ func (c *client) typeString() string {
 	return "Unknown Type"
 }
 
+// updatePermissions replaces the permissions of the connection, then removes
+// the subscriptions that are no longer authorized, notifying the client.
+func (c *client) updatePermissions(perms *Permissions) {
+	c.mu.Lock()
+	c.setPermissions(perms)
+	if perms == nil {
+		c.perms = nil
+		c.mperms = nil
+	}
+	c.mu.Unlock()
+	c.processSubsOnConfigReload(nil)
+}
+
 // processSubsOnConfigReload removes any subscriptions the client has that are no
 // longer authorized, and check for imports (accounts) due to a config reload.
 func (c *client) processSubsOnConfigReload(awcsti map[string]struct{}) {
@@ -3528,6 +4520,13 @@ func (c *client) teardownConn() {
 
 	c.clearAuthTimer()
 	c.clearPingTimer()
+	if c.grant != nil {
+		c.grant.timer.Stop()
+		c.grant = nil
+	}
+	if c.replies != nil {
+		c.replies.stop()
+	}
 	// Unblock anyone who is potentially stalled waiting on us.
 	if c.out.stc != nil {
 		close(c.out.stc)
@@ -3578,7 +4577,10 @@ func (c *client) teardownConn() {
 
 	// Remove client's or leaf node subscriptions.
 	if (kind == CLIENT || kind == LEAF) && acc != nil {
-		acc.sl.RemoveBatch(subs)
+		removed, _ := acc.sl.removeBatch(subs)
+		if kind == CLIENT {
+			atomic.AddInt32(&acc.csubs, -int32(removed))
+		}
 	} else if kind == ROUTER {
 		go c.removeRemoteSubs()
 	}
@@ -3733,11 +4735,13 @@ func (c *client) getAccAndResultFromCache() (*Account, *SublistResult) {
 			return nil, nil
 		}
 
-		// Match against the account sublist.
+		// Match against the account sublist. The genid is read first so
+		// that a change made during the match invalidates the result.
+		genid := atomic.LoadUint64(&acc.sl.genid)
 		r = acc.sl.Match(string(c.pa.subject))
 
 		// Store in our cache
-		c.in.pacache[string(c.pa.pacache)] = &perAccountCache{acc, r, atomic.LoadUint64(&acc.sl.genid)}
+		c.in.pacache[string(c.pa.pacache)] = &perAccountCache{acc, r, genid}
 
 		// Check if we need to prune.
 		if len(c.in.pacache) > maxPerAccountCacheSize {
@@ -3810,17 +4814,30 @@ func (c *client) isClosed() bool {
 
 // Logging functionality scoped to a client or route.
 func (c *client) Error(err error) {
+	if !c.srv.allowErrorLog(UnpackIfErrorCtx(err)) {
+		return
+	}
 	c.srv.Errors(c, err)
 }
 
 func (c *client) Errorf(format string, v ...interface{}) {
+	if !c.srv.allowErrorLog(format) {
+		return
+	}
 	format = fmt.Sprintf("%s - %s", c, format)
 	c.srv.Errorf(format, v...)
 }
 
+// Debug and trace statements are logged if enabled for the server, or for
+// this connection or its account.
 func (c *client) Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&c.srv.logging.debug) == 0 && atomic.LoadInt32(&c.logLevel)&logLevelDebug == 0 {
+		return
+	}
 	format = fmt.Sprintf("%s - %s", c, format)
-	c.srv.Debugf(format, v...)
+	c.srv.executeLogCall(func(logger Logger, format string, v ...interface{}) {
+		logger.Debugf(format, v...)
+	}, format, v...)
 }
 
 func (c *client) Noticef(format string, v ...interface{}) {
@@ -3829,8 +4846,13 @@ func (c *client) Noticef(format string, v ...interface{}) {
 }
 
 func (c *client) Tracef(format string, v ...interface{}) {
+	if atomic.LoadInt32(&c.srv.logging.trace) == 0 && atomic.LoadInt32(&c.logLevel)&logLevelTrace == 0 {
+		return
+	}
 	format = fmt.Sprintf("%s - %s", c, format)
-	c.srv.Tracef(format, v...)
+	c.srv.executeLogCall(func(logger Logger, format string, v ...interface{}) {
+		logger.Tracef(format, v...)
+	}, format, v...)
 }
 
 func (c *client) Warnf(format string, v ...interface{}) {
@@ -19,8 +19,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
+	"os"
 	"reflect"
 	"regexp"
 	"strings"
@@ -434,6 +436,235 @@ func TestClientPubSubNoEcho(t *testing.T) {
 	}
 }
 
+func TestClientPubSubWithFilters(t *testing.T) {
+	_, c, cr := setupClient()
+	defer c.close()
+	connectOp := []byte("CONNECT {\"sub_filters\":true,\"verbose\":false}\r\n")
+	if err := c.parse(connectOp); err != nil {
+		t.Fatalf("Received error: %v\n", err)
+	}
+	c.parseAsync("SUB foo 1 prefix=ok\r\nSUB foo g1 2 prefix=yes\r\n" +
+		"PUB foo 5\r\nnope!\r\nPUB foo 5\r\nok123\r\nPUB foo 5\r\nyes12\r\nPING\r\n")
+	for _, expected := range []struct{ sid, payload string }{{"1", "ok123"}, {"2", "yes12"}} {
+		l, err := cr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error receiving msg from server: %v\n", err)
+		}
+		matches := msgPat.FindAllStringSubmatch(l, -1)
+		if len(matches) == 0 {
+			t.Fatalf("Expected a message, got %q", l)
+		}
+		if matches[0][SID_INDEX] != expected.sid {
+			t.Fatalf("Did not get correct sid: '%s'\n", matches[0][SID_INDEX])
+		}
+		checkPayload(cr, []byte(expected.payload+"\r\n"), t)
+	}
+	l, err := cr.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error receiving msg from server: %v\n", err)
+	}
+	if !strings.HasPrefix(l, "PONG\r\n") {
+		t.Fatalf("PONG response incorrect: %q\n", l)
+	}
+}
+
+func TestClientPubSubWithHeaderFilters(t *testing.T) {
+	_, c, cr := setupClient()
+	defer c.close()
+	connectOp := []byte("CONNECT {\"sub_filters\":true,\"headers\":true,\"verbose\":false}\r\n")
+	if err := c.parse(connectOp); err != nil {
+		t.Fatalf("Received error: %v\n", err)
+	}
+	hdr := func(region string) string {
+		h := "NATS/1.0\r\n"
+		if region != "" {
+			h += "Region: " + region + "\r\n"
+		}
+		h += "\r\n"
+		return fmt.Sprintf("HPUB foo %d %d\r\n%sok123\r\n", len(h), len(h)+5, h)
+	}
+	c.parseAsync("SUB foo 1 header=region:eu\r\nSUB foo 2 header=Region:us prefix=ok\r\n" +
+		"PUB foo 5\r\nok123\r\n" + hdr("") + hdr("asia") + hdr("eu") + hdr("us") + "PING\r\n")
+	for _, sid := range []string{"1", "2"} {
+		l, err := cr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error receiving msg from server: %v\n", err)
+		}
+		if !strings.HasPrefix(l, "HMSG foo "+sid+" ") {
+			t.Fatalf("Expected a message for sid %s, got %q", sid, l)
+		}
+		// Skip the header and the payload.
+		for l != "ok123\r\n" {
+			if l, err = cr.ReadString('\n'); err != nil {
+				t.Fatalf("Error receiving msg from server: %v\n", err)
+			}
+		}
+	}
+	l, err := cr.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error receiving msg from server: %v\n", err)
+	}
+	if !strings.HasPrefix(l, "PONG\r\n") {
+		t.Fatalf("PONG response incorrect: %q\n", l)
+	}
+}
+
+func TestClientSubFilterParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		connect string
+		sub     string
+	}{
+		{"filter without opt-in", "CONNECT {}\r\n", "SUB foo g1 1 prefix=ok\r\n"},
+		{"empty filter", "CONNECT {\"sub_filters\":true}\r\n", "SUB foo 1 prefix=\r\n"},
+		{"too many args", "CONNECT {\"sub_filters\":true}\r\n", "SUB foo g1 1 bar\r\n"},
+		{"header filter without value", "CONNECT {\"sub_filters\":true,\"headers\":true}\r\n", "SUB foo 1 header=Region:\r\n"},
+		{"header filter without key", "CONNECT {\"sub_filters\":true,\"headers\":true}\r\n", "SUB foo 1 header=:eu\r\n"},
+		{"header filter without headers", "CONNECT {\"sub_filters\":true}\r\n", "SUB foo 1 header=Region:eu\r\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, c, _ := setupClient()
+			defer c.close()
+			if err := c.parse([]byte(test.connect)); err != nil {
+				t.Fatalf("Received error: %v\n", err)
+			}
+			if err := c.parse([]byte(test.sub)); err == nil {
+				t.Fatal("Expected a parse error")
+			}
+		})
+	}
+}
+
+func TestClientSubPriorities(t *testing.T) {
+	_, c, _ := setupClient()
+	defer c.close()
+	connectOp := []byte("CONNECT {\"sub_priorities\":true,\"sub_filters\":true,\"verbose\":false}\r\n")
+	if err := c.parse(connectOp); err != nil {
+		t.Fatalf("Received error: %v\n", err)
+	}
+	if err := c.parse([]byte("SUB foo 1 priority=high\r\nSUB bar g1 2 prefix=ok priority=low\r\nSUB baz 3\r\n")); err != nil {
+		t.Fatalf("Received error: %v\n", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for sid, expected := range map[string]int8{"1": subPriorityHigh, "2": subPriorityLow, "3": subPriorityNormal} {
+		sub := c.subs[sid]
+		if sub == nil || sub.prio != expected {
+			t.Fatalf("Unexpected subscription %q: %+v", sid, sub)
+		}
+	}
+	if sub := c.subs["2"]; string(sub.queue) != "g1" || string(sub.filter) != "ok" {
+		t.Fatalf("Unexpected subscription: %+v", sub)
+	}
+
+	for _, test := range []struct {
+		name    string
+		connect string
+		sub     string
+	}{
+		{"priority without opt-in", "CONNECT {}\r\n", "SUB foo g1 1 priority=high\r\n"},
+		{"unknown priority", "CONNECT {\"sub_priorities\":true}\r\n", "SUB foo 1 priority=urgent\r\n"},
+		{"duplicate priority", "CONNECT {\"sub_priorities\":true}\r\n", "SUB foo g1 1 priority=high priority=low\r\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, c, _ := setupClient()
+			defer c.close()
+			if err := c.parse([]byte(test.connect)); err != nil {
+				t.Fatalf("Received error: %v\n", err)
+			}
+			if err := c.parse([]byte(test.sub)); err == nil {
+				t.Fatal("Expected a parse error")
+			}
+		})
+	}
+}
+
+func TestClientHighPriorityFlushedFirst(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxPending = 1024
+	s := &Server{opts: opts}
+
+	fakeConn := &testConnWritePartial{}
+	c := &client{srv: s, nc: fakeConn}
+	c.initClient()
+
+	c.mu.Lock()
+	c.queueOutbound([]byte("MSG bulk 1 2\r\n"))
+	c.queueOutbound([]byte("ok\r\n"))
+	c.queuePriorityOutbound([]byte("MSG ctrl 2 2\r\n"), []byte("ok\r\n"))
+	c.flushOutbound()
+	pb := c.out.pb
+	c.mu.Unlock()
+
+	expected := "MSG ctrl 2 2\r\nok\r\nMSG bulk 1 2\r\nok\r\n"
+	if got := fakeConn.buf.String(); got != expected {
+		t.Fatalf("Expected\n%q\ngot\n%q", expected, got)
+	}
+	if pb != 0 {
+		t.Fatalf("Expected no pending bytes, got %v", pb)
+	}
+}
+
+func TestClientHighPriorityAfterPartialWrite(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxPending = 1024
+	s := &Server{opts: opts}
+
+	fakeConn := &testConnWritePartial{partial: true}
+	c := &client{srv: s, nc: fakeConn}
+	c.initClient()
+
+	c.mu.Lock()
+	c.queueOutbound([]byte("MSG bulk 1 10\r\n0123456789\r\n"))
+	c.flushOutbound()
+	if fakeConn.buf.Len() != 15 {
+		c.mu.Unlock()
+		t.Fatalf("Expected a partial write, got %q", fakeConn.buf.String())
+	}
+	fakeConn.partial = false
+	c.queueOutbound([]byte("MSG bulk 1 2\r\nok\r\n"))
+	c.queuePriorityOutbound([]byte("MSG ctrl 2 2\r\n"), []byte("ok\r\n"))
+	c.flushOutbound()
+	pb := c.out.pb
+	c.mu.Unlock()
+
+	expected := "MSG bulk 1 10\r\n0123456789\r\nMSG ctrl 2 2\r\nok\r\nMSG bulk 1 2\r\nok\r\n"
+	if got := fakeConn.buf.String(); got != expected {
+		t.Fatalf("Expected\n%q\ngot\n%q", expected, got)
+	}
+	if pb != 0 {
+		t.Fatalf("Expected no pending bytes, got %v", pb)
+	}
+}
+
+func TestClientLowPriorityDroppedUnderBackpressure(t *testing.T) {
+	opts := defaultServerOptions
+	opts.MaxPending = 1024
+	s, c, _, _ := rawSetup(opts)
+	defer c.close()
+	if err := c.parse([]byte("CONNECT {\"sub_priorities\":true,\"verbose\":false}\r\nSUB foo 1 priority=low\r\n")); err != nil {
+		t.Fatalf("Received error: %v\n", err)
+	}
+
+	// The subscriber does not read, so the pending bytes grow.
+	pub, _, _ := newClientForServer(s)
+	defer pub.close()
+	payload := strings.Repeat("a", 300)
+	for i := 0; i < 10; i++ {
+		pub.parse([]byte(fmt.Sprintf("PUB foo %d\r\n%s\r\n", len(payload), payload)))
+	}
+
+	c.mu.Lock()
+	dropped, pb, closed := c.out.sm, c.out.pb, c.isClosed()
+	c.mu.Unlock()
+	if dropped == 0 || pb > 1024 {
+		t.Fatalf("Expected messages to be dropped, got dropped=%v pending=%v", dropped, pb)
+	}
+	if closed {
+		t.Fatal("Expected the connection to remain")
+	}
+}
+
 func TestClientSimplePubSubWithReply(t *testing.T) {
 	_, c, cr := setupClient()
 	defer c.close()
@@ -689,6 +920,19 @@ func TestQueueSubscribePermissions(t *testing.T) {
 			queue:   "bar",
 			want:    "+OK\r\n",
 		},
+		{
+			name:    "queue subscribe within allowed group only",
+			perms:   &SubjectPermission{Allow: []string{"orders.> v1-workers"}},
+			subject: "orders.new",
+			queue:   "v1-workers",
+			want:    "+OK\r\n",
+		},
+		{
+			name:    "plain subscribe denied when only queue group allowed",
+			perms:   &SubjectPermission{Allow: []string{"orders.> v1-workers"}},
+			subject: "orders.new",
+			want:    "-ERR 'Permissions Violation for Subscription to \"orders.new\"'\r\n",
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -819,6 +1063,86 @@ func TestClientUnSub(t *testing.T) {
 	}
 }
 
+func TestClientDrain(t *testing.T) {
+	_, c, cr := setupClient()
+	defer c.close()
+
+	op := []byte("SUB foo 1\r\nSUB foo 2\r\nDRAIN 1\r\nDRAIN 3\r\nPUB foo 5\r\nhello\r\n")
+	go c.parseAndClose(op)
+
+	for _, expected := range []string{"DRAINED 1\r\n", "DRAINED 3\r\n"} {
+		if l, err := cr.ReadString('\n'); err != nil || l != expected {
+			t.Fatalf("Expected %q, got %q (%v)", expected, l, err)
+		}
+	}
+	var received int
+	for ; ; received++ {
+		l, err := cr.ReadString('\n')
+		if err != nil {
+			break
+		}
+		matches := msgPat.FindAllStringSubmatch(l, -1)[0]
+		if matches[SID_INDEX] != "2" {
+			t.Fatalf("Received msg on drained subscription!\n")
+		}
+		checkPayload(cr, []byte("hello\r\n"), t)
+	}
+	if received != 1 {
+		t.Fatalf("Received wrong # of msgs: %d vs 1\n", received)
+	}
+}
+
+func TestClientDrainAcrossRoutes(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", srvA.ClusterAddr().Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	cb, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", optsB.Port))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer cb.Close()
+	br := bufio.NewReader(cb)
+	cb.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if l, _ := br.ReadString('\n'); !strings.Contains(l, `"drain":true`) {
+		t.Fatalf("Expected drain support in INFO, got %q", l)
+	}
+	cb.Write([]byte("CONNECT {\"verbose\":false}\r\nSUB foo 1\r\nPING\r\n"))
+	if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	checkExpectedSubs(t, 1, srvA, srvB)
+
+	nc := natsConnect(t, srvA.ClientURL())
+	defer nc.Close()
+	natsPub(t, nc, "foo", []byte("before"))
+	natsFlush(t, nc)
+
+	cb.Write([]byte("DRAIN 1\r\n"))
+	// The message sent before the drain is delivered, then the confirmation.
+	if l, _ := br.ReadString('\n'); !strings.HasPrefix(l, "MSG foo 1 6") {
+		t.Fatalf("Expected message, got %q", l)
+	}
+	if l, _ := br.ReadString('\n'); l != "before\r\n" {
+		t.Fatalf("Expected payload, got %q", l)
+	}
+	if l, _ := br.ReadString('\n'); l != "DRAINED 1\r\n" {
+		t.Fatalf("Expected confirmation, got %q", l)
+	}
+	checkExpectedSubs(t, 0, srvA, srvB)
+}
+
 func TestClientUnSubMax(t *testing.T) {
 	_, c, cr := setupClient()
 	defer c.close()
@@ -2038,3 +2362,149 @@ func TestCloseConnectionLogsReason(t *testing.T) {
 		t.Fatal("Log does not contain closed reason")
 	}
 }
+
+func benchPubSingleSub(b *testing.B, pedantic bool) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	pub, _, _ := newClientForServer(s)
+	defer pub.close()
+	pub.opts.Pedantic = pedantic
+
+	sub, sr, _ := newClientForServer(s)
+	defer sub.close()
+	sub.parseAsync("SUB foo 1\r\nPING\r\n")
+	if l, _ := sr.ReadString('\n'); l != "PONG\r\n" {
+		b.Fatalf("Expected PONG, got %q", l)
+	}
+	sub.nc.SetReadDeadline(time.Time{})
+	go io.Copy(ioutil.Discard, sr)
+
+	msg := []byte("PUB foo 5\r\nhello\r\n")
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pub.client.parse(msg)
+		// Flush in batches, like the readLoop does.
+		if i%64 == 0 {
+			pub.flushClients(0)
+		}
+	}
+	pub.flushClients(0)
+}
+
+func Benchmark_______________ClientPubSingleSub(b *testing.B) {
+	benchPubSingleSub(b, false)
+}
+
+func Benchmark_______ClientPubSingleSubPedantic(b *testing.B) {
+	benchPubSingleSub(b, true)
+}
+
+func TestClientFlushOpts(t *testing.T) {
+	o := DefaultOptions()
+	o.Flush = FlushOpts{Mode: FlushModeThroughput, MaxCoalesce: 4096, Interval: 250 * time.Millisecond}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	natsFlush(t, nc)
+
+	s.mu.Lock()
+	for _, c := range s.clients {
+		c.mu.Lock()
+		fm, fi, mcs := c.out.fm, c.out.fi, c.out.mcs
+		c.mu.Unlock()
+		if fm != flushThroughput || fi != o.Flush.Interval || mcs != 4096 {
+			s.mu.Unlock()
+			t.Fatalf("Unexpected flush snapshot: mode=%v interval=%v max=%v", fm, fi, mcs)
+		}
+	}
+	s.mu.Unlock()
+
+	// Small messages are held for the flush interval.
+	pc := natsConnect(t, s.ClientURL())
+	defer pc.Close()
+	start := time.Now()
+	natsPub(t, pc, "foo", []byte("hello"))
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+	if dur := time.Since(start); dur < o.Flush.Interval/2 {
+		t.Fatalf("Expected message to be coalesced for about %v, got it after %v", o.Flush.Interval, dur)
+	}
+
+	// Reaching the max coalesce size writes right away.
+	start = time.Now()
+	natsPub(t, pc, "foo", make([]byte, 8192))
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+	if dur := time.Since(start); dur >= o.Flush.Interval {
+		t.Fatalf("Expected large message to not wait for the flush interval, got it after %v", dur)
+	}
+
+	// Latency mode and write deadline on new connections.
+	o2 := DefaultOptions()
+	o2.Port = -1
+	o2.Flush = FlushOpts{Mode: FlushModeLatency, WriteDeadline: 100 * time.Millisecond}
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	c, _, _ := newClientForServer(s2)
+	defer c.close()
+	c.mu.Lock()
+	fm, wdl, mcs := c.out.fm, c.out.wdl, c.out.mcs
+	c.mu.Unlock()
+	if fm != flushLatency || wdl != 100*time.Millisecond || mcs != maxBufSize {
+		t.Fatalf("Unexpected flush snapshot: mode=%v deadline=%v max=%v", fm, wdl, mcs)
+	}
+}
+
+func TestClientAccountPingPolicy(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		ping_interval: "1m"
+		accounts {
+			A { users [{user: a, password: pwd}], ping_interval: "50ms", ping_max: 1 }
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Raw connections that never reply to the server's PINGs.
+	connect := func(user string) net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.getOpts().Port))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		if _, err := bufio.NewReader(c).ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		if _, err := c.Write([]byte(fmt.Sprintf("CONNECT {\"user\":%q,\"pass\":\"pwd\",\"verbose\":false}\r\n", user))); err != nil {
+			t.Fatalf("Error sending CONNECT: %v", err)
+		}
+		return c
+	}
+	ca := connect("a")
+	defer ca.Close()
+	cb := connect("b")
+	defer cb.Close()
+
+	// The first PING is sent after about 2 seconds to compute the RTT.
+	checkFor(t, 4*time.Second, 50*time.Millisecond, func() error {
+		if n := s.NumClients(); n != 1 {
+			return fmt.Errorf("Expected 1 client, got %d", n)
+		}
+		return nil
+	})
+	conns := s.closedClients()
+	if len(conns) != 1 || conns[0].user != "a" || conns[0].Reason != StaleConnection.String() {
+		t.Fatalf("Unexpected closed connections: %+v", conns)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Key of the minimum client versions applying to the libraries
+// without a version of their own.
+const anyClientLang = "*"
+
+// Returns the numeric components of a version such as "1.10.2-beta",
+// ignoring a leading "v" and anything after the first non numeric
+// character of a component.
+func versionComponents(version string) ([]int, error) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if version == _EMPTY_ {
+		return nil, fmt.Errorf("empty version")
+	}
+	var comps []int
+	for _, s := range strings.Split(version, ".") {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		comps = append(comps, n)
+		if i < len(s) {
+			break
+		}
+	}
+	return comps, nil
+}
+
+// versionAtLeast returns true if version is not lower than min, whose
+// missing components are considered 0. An invalid version is lower than
+// any minimum.
+func versionAtLeast(version string, min []int) bool {
+	comps, err := versionComponents(version)
+	if err != nil {
+		return false
+	}
+	for i, m := range min {
+		var c int
+		if i < len(comps) {
+			c = comps[i]
+		}
+		if c != m {
+			return c > m
+		}
+	}
+	return true
+}
+
+// Parses the minimum client versions of an account, a map of the client
+// library names, as sent in the lang field of CONNECT, to their minimum
+// version. "*" applies to the libraries not in the map.
+func parseMinClientVersions(v interface{}, errors *[]error) (map[string]string, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected map to define min_client_version, got %T", v)}
+	}
+	versions := make(map[string]string, len(m))
+	for lang, mv := range m {
+		tk, mv = unwrapValue(mv, &lt)
+		version, ok := mv.(string)
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected string version for client %q, got %T", lang, mv)}
+		}
+		if _, err := versionComponents(version); err != nil {
+			return nil, &configErr{tk, fmt.Sprintf("min_client_version of client %q: %v", lang, err)}
+		}
+		versions[strings.ToLower(lang)] = version
+	}
+	return versions, nil
+}
+
+// clientVersionAllowed returns false, with the required version, if the
+// library of the client is older than the minimum version of its account.
+// Lock should be held.
+func (c *client) clientVersionAllowed() (bool, string) {
+	if c.acc == nil || len(c.acc.minClientVersions) == 0 {
+		return true, _EMPTY_
+	}
+	min, ok := c.acc.minClientVersions[strings.ToLower(c.opts.Lang)]
+	if !ok {
+		if min, ok = c.acc.minClientVersions[anyClientLang]; !ok {
+			return true, _EMPTY_
+		}
+	}
+	comps, _ := versionComponents(min)
+	return versionAtLeast(c.opts.Version, comps), min
+}
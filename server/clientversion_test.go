@@ -0,0 +1,123 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestVersionAtLeast(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		min     string
+		ok      bool
+	}{
+		{"1.9.2", "1.9.2", true},
+		{"1.10.0", "1.9.2", true},
+		{"v2.0", "1.9.2", true},
+		{"1.9.1", "1.9.2", false},
+		{"1.9", "1.9.2", false},
+		{"1.9.2-beta.1", "1.9.2", true},
+		{"1.9.2", "1", true},
+		{"0.9.9", "1", false},
+		{"", "1", false},
+		{"dev", "1", false},
+	} {
+		min, err := versionComponents(test.min)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", test.min, err)
+		}
+		if ok := versionAtLeast(test.version, min); ok != test.ok {
+			t.Fatalf("Expected %v for version %q and minimum %q", test.ok, test.version, test.min)
+		}
+	}
+}
+
+func TestMinClientVersionConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accounts {
+			A { min_client_version { Go: "1.10.0", "*": "2.0" } }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	versions := opts.Accounts[0].minClientVersions
+	if len(versions) != 2 || versions["go"] != "1.10.0" || versions[anyClientLang] != "2.0" {
+		t.Fatalf("Unexpected versions: %v", versions)
+	}
+
+	for _, c := range []string{
+		`accounts { A { min_client_version: "1.0" } }`,
+		`accounts { A { min_client_version { go: 1 } } }`,
+		`accounts { A { min_client_version { go: "latest" } } }`,
+	} {
+		conf := createConfFile(t, []byte(c))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil {
+			t.Fatalf("Expected an error for %q", c)
+		}
+	}
+}
+
+func TestMinClientVersion(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		accounts {
+			A {
+				users: [{user: a, password: a}]
+				min_client_version { go: "100.0.0" }
+			}
+			B {
+				users: [{user: b, password: b}]
+				min_client_version { java: "100.0.0", "*": "1.0" }
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	if nc, err := nats.Connect(url, nats.UserInfo("a", "a"), nats.MaxReconnects(0)); err == nil {
+		nc.Close()
+		t.Fatal("Expected the client to be rejected")
+	}
+	nc := natsConnect(t, url, nats.UserInfo("b", "b"))
+	nc.Close()
+
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		conns := s.closedClients()
+		if len(conns) != 2 {
+			return fmt.Errorf("Expected 2 closed connections, got %d", len(conns))
+		}
+		for _, cc := range conns {
+			switch {
+			case cc.acc == "A" && cc.Reason == ClientVersionRejected.String() &&
+				cc.ReasonCode == "client_version" && cc.Lang == "go":
+			case cc.acc == "B" && cc.Reason == ClientClosed.String():
+			default:
+				return fmt.Errorf("Unexpected closed connection: %+v", cc)
+			}
+		}
+		return nil
+	})
+}
@@ -16,6 +16,7 @@ package server
 import (
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -265,3 +266,47 @@ func TestClosedTLSHandshake(t *testing.T) {
 	}
 	checkReason(t, conns[0].Reason, TLSHandshakeError)
 }
+
+func TestClosedConnsConfigAndReload(t *testing.T) {
+	s, _, conf := runReloadServerWithContent(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_closed_clients: 5
+	`))
+	defer os.Remove(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s", s.Addr())
+	for i := 0; i < 8; i++ {
+		nc, err := nats.Connect(url, nats.Name(fmt.Sprintf("c%d", i)))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		nc.Close()
+	}
+	checkClosedConns(t, s, 5, time.Second)
+	checkTotalClosedConns(t, s, 8, time.Second)
+
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(`
+		listen: "127.0.0.1:-1"
+		max_closed_clients: 2
+	`))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	checkClosedConns(t, s, 2, time.Second)
+	checkTotalClosedConns(t, s, 8, time.Second)
+	conns := s.closedClients()
+	if conns[0].Name != "c6" || conns[1].Name != "c7" {
+		t.Fatalf("Expected the most recent connections to be kept, got %q and %q", conns[0].Name, conns[1].Name)
+	}
+
+	conf2 := createConfFile(t, []byte(`max_closed_clients: -1`))
+	defer os.Remove(conf2)
+	opts, err := ProcessConfigFile(conf2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "can not be negative") {
+		t.Fatalf("Expected error for negative max_closed_clients, got %v", err)
+	}
+}
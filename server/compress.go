@@ -0,0 +1,204 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Compression modes for route and leafnode connections.
+const (
+	// CompressionOff disables compression.
+	CompressionOff = "off"
+	// CompressionFast favors speed over compression ratio.
+	CompressionFast = "fast"
+	// CompressionBest favors compression ratio over speed.
+	CompressionBest = "best"
+)
+
+// CompressionDeflate is the deflate algorithm of compress/flate.
+const CompressionDeflate = "deflate"
+
+// The compression algorithms this server can compress and decompress, in
+// order of preference. Each side advertises the ones it supports and the
+// sender picks the algorithm of its data, so that new ones can be added
+// without breaking the servers that do not know them. A remote that does
+// not advertise any supports only deflate.
+var compressionAlgorithms = []string{CompressionDeflate}
+
+// Returns the preferred algorithm of this server among the ones supported
+// by the remote, or an empty string if there is none.
+func selectCompression(remote []string) string {
+	if len(remote) == 0 {
+		return CompressionDeflate
+	}
+	for _, algo := range compressionAlgorithms {
+		for _, ra := range remote {
+			if algo == ra {
+				return algo
+			}
+		}
+	}
+	return _EMPTY_
+}
+
+// Returns whether this server can decompress the algorithm.
+func supportsCompression(algo string) bool {
+	for _, a := range compressionAlgorithms {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the protocol sent by a side that has compression enabled, once it
+// knows that the remote has it enabled too. Everything it sends after this
+// protocol is compressed with the algorithm.
+func compressionStartProto(algo string) []byte {
+	return []byte(fmt.Sprintf("INFO {\"compression_start\":true,\"compression_algorithm\":%q}%s", algo, _CRLF_))
+}
+
+// Returns the flate level for the given compression mode, or false
+// if the mode does not enable compression.
+func compressionLevel(mode string) (int, bool) {
+	switch mode {
+	case CompressionFast:
+		return flate.BestSpeed, true
+	case CompressionBest:
+		return flate.BestCompression, true
+	}
+	return 0, false
+}
+
+// Parses a compression mode from the configuration, which can be given
+// as a boolean or one of the compression modes.
+func parseCompression(v interface{}) (string, error) {
+	switch mode := v.(type) {
+	case bool:
+		if mode {
+			return CompressionFast, nil
+		}
+		return CompressionOff, nil
+	case string:
+		switch m := strings.ToLower(mode); m {
+		case CompressionOff, CompressionFast, CompressionBest:
+			return m, nil
+		}
+		return _EMPTY_, fmt.Errorf("invalid compression mode %q, expected %q, %q or %q",
+			mode, CompressionOff, CompressionFast, CompressionBest)
+	default:
+		return _EMPTY_, fmt.Errorf("expected compression to be a boolean or string, got %T", v)
+	}
+}
+
+// compressedOutbound receives the output of the compressor and
+// queues it as regular outbound data.
+type compressedOutbound struct {
+	c *client
+}
+
+func (co compressedOutbound) Write(p []byte) (int, error) {
+	// The compressor reuses its buffer, so make sure that we do not
+	// hold on to it.
+	if len(p) > maxBufSize {
+		p = append([]byte(nil), p...)
+	}
+	co.c.queueRawOutbound(p)
+	return len(p), nil
+}
+
+// compressor is the writer of an outbound compression algorithm.
+type compressor interface {
+	io.Writer
+	Flush() error
+}
+
+// Returns the compressor of the algorithm at the flate level, which must
+// be supported.
+func newCompressor(algo string, w io.Writer, level int) compressor {
+	switch algo {
+	default:
+		// Levels returned by compressionLevel are valid, so no error here.
+		fw, _ := flate.NewWriter(w, level)
+		return fw
+	}
+}
+
+// startCompression sends the compression start protocol and compresses
+// everything queued after it, if mode enables compression. The algorithm
+// is picked among the ones advertised by the remote.
+// Lock is held on entry.
+func (c *client) startCompression(mode string, remote []string) {
+	level, ok := compressionLevel(mode)
+	if !ok || c.out.cw != nil || c.isClosed() {
+		return
+	}
+	algo := selectCompression(remote)
+	if algo == _EMPTY_ {
+		c.Warnf("Not compressing outbound data, no supported algorithm in %q", remote)
+		return
+	}
+	c.enqueueProto(compressionStartProto(algo))
+	c.out.cw = newCompressor(algo, compressedOutbound{c}, level)
+	c.Debugf("Compressing outbound data (%s, %s)", algo, mode)
+}
+
+// compressOutbound passes data through the compressor.
+// Lock is held on entry.
+func (c *client) compressOutbound(data []byte) {
+	c.out.cw.Write(data)
+	c.out.cwd = true
+}
+
+// flushCompressor flushes data held by the compressor to the outbound buffers.
+// Lock is held on entry.
+func (c *client) flushCompressor() {
+	c.out.cwd = false
+	c.out.cw.Flush()
+}
+
+// processCompressionStart is invoked from the readLoop when the remote
+// has indicated that everything after this protocol is compressed with
+// the algorithm, deflate if the remote did not say.
+func (c *client) processCompressionStart(algo string) error {
+	if c.kind != ROUTER && c.kind != LEAF {
+		return fmt.Errorf("compression not supported for this connection type")
+	}
+	if c.in.zr {
+		return fmt.Errorf("compression already started")
+	}
+	if algo == _EMPTY_ {
+		algo = CompressionDeflate
+	}
+	if !supportsCompression(algo) {
+		return fmt.Errorf("unsupported compression algorithm %q", algo)
+	}
+	c.in.zs, c.in.za = true, algo
+	return nil
+}
+
+// Returns a reader that decompresses with the algorithm the rest of the
+// data received by the parser, followed by everything read from r.
+func newDecompressor(algo string, rest []byte, r io.Reader) io.Reader {
+	r = io.MultiReader(bytes.NewReader(rest), r)
+	switch algo {
+	default:
+		return flate.NewReader(r)
+	}
+}
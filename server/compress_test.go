@@ -0,0 +1,282 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns whether outbound compression has started on all the
+// given connections.
+func compressionStarted(conns map[uint64]*client) bool {
+	if len(conns) == 0 {
+		return false
+	}
+	for _, c := range conns {
+		c.mu.Lock()
+		started := c.out.cw != nil
+		c.mu.Unlock()
+		if !started {
+			return false
+		}
+	}
+	return true
+}
+
+func checkCompression(t *testing.T, s *Server, leafs bool, expected bool) {
+	t.Helper()
+	s.mu.Lock()
+	conns := s.routes
+	if leafs {
+		conns = s.leafs
+	}
+	started := compressionStarted(conns)
+	s.mu.Unlock()
+	if started != expected {
+		t.Fatalf("Expected compression started to be %v, got %v", expected, started)
+	}
+}
+
+// Sends compressible messages from one server and checks that
+// they are received intact on the other.
+func checkCompressedMsgs(t *testing.T, pub, sub *Server) {
+	t.Helper()
+	snc := natsConnect(t, sub.ClientURL())
+	defer snc.Close()
+	ssub := natsSubSync(t, snc, "foo")
+	natsFlush(t, snc)
+
+	pnc := natsConnect(t, pub.ClientURL())
+	defer pnc.Close()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := pub.globalAccount().sl.Count(); n < 1 {
+			return fmt.Errorf("interest not propagated")
+		}
+		natsPub(t, pnc, "foo", []byte("ping"))
+		if _, err := ssub.NextMsg(100 * time.Millisecond); err != nil {
+			return err
+		}
+		return nil
+	})
+	// Drain possible extra pings.
+	for {
+		if _, err := ssub.NextMsg(50 * time.Millisecond); err != nil {
+			break
+		}
+	}
+
+	payload := bytes.Repeat([]byte(`{"symbol":"NATS","price":100}`), 4096)
+	for i := 0; i < 10; i++ {
+		natsPub(t, pnc, "foo", payload)
+	}
+	for i := 0; i < 10; i++ {
+		m, err := ssub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Error receiving message %d: %v", i, err)
+		}
+		if !bytes.Equal(m.Data, payload) {
+			t.Fatalf("Unexpected payload for message %d", i)
+		}
+	}
+}
+
+func TestRouteCompression(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		modeA    string
+		modeB    string
+		expected bool
+	}{
+		{"both", CompressionFast, CompressionBest, true},
+		{"one side", CompressionFast, CompressionOff, false},
+		{"none", _EMPTY_, _EMPTY_, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			oa := DefaultOptions()
+			oa.Cluster.Host = "127.0.0.1"
+			oa.Cluster.Port = -1
+			oa.Cluster.Compression = test.modeA
+			sa := RunServer(oa)
+			defer sa.Shutdown()
+
+			ob := DefaultOptions()
+			ob.Cluster.Host = "127.0.0.1"
+			ob.Cluster.Port = -1
+			ob.Cluster.Compression = test.modeB
+			ob.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", oa.Cluster.Port))
+			sb := RunServer(ob)
+			defer sb.Shutdown()
+
+			checkClusterFormed(t, sa, sb)
+			checkCompressedMsgs(t, sa, sb)
+			checkCompressedMsgs(t, sb, sa)
+			checkCompression(t, sa, false, test.expected)
+			checkCompression(t, sb, false, test.expected)
+		})
+	}
+}
+
+func TestLeafNodeCompression(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		hub      string
+		remote   string
+		expected bool
+	}{
+		{"both", CompressionBest, CompressionFast, true},
+		{"hub only", CompressionBest, _EMPTY_, false},
+		{"remote only", CompressionOff, CompressionFast, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ob := DefaultOptions()
+			ob.LeafNode.Host = "127.0.0.1"
+			ob.LeafNode.Port = -1
+			ob.LeafNode.Compression = test.hub
+			sb := RunServer(ob)
+			defer sb.Shutdown()
+
+			u, _ := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", ob.LeafNode.Port))
+			oa := DefaultOptions()
+			oa.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}, Compression: test.remote}}
+			sa := RunServer(oa)
+			defer sa.Shutdown()
+
+			checkLeafNodeConnected(t, sa)
+			checkLeafNodeConnected(t, sb)
+			checkCompressedMsgs(t, sa, sb)
+			checkCompressedMsgs(t, sb, sa)
+			checkCompression(t, sa, true, test.expected)
+			checkCompression(t, sb, true, test.expected)
+		})
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		cluster {
+			port: -1
+			compression: best
+		}
+		leafnodes {
+			port: -1
+			compression: true
+			remotes [
+				{url: "nats://127.0.0.1:1234", compression: "Fast"}
+				{url: "nats://127.0.0.1:1235", compression: false}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.Cluster.Compression != CompressionBest {
+		t.Fatalf("Unexpected cluster compression: %q", opts.Cluster.Compression)
+	}
+	if opts.LeafNode.Compression != CompressionFast {
+		t.Fatalf("Unexpected leafnode compression: %q", opts.LeafNode.Compression)
+	}
+	if c := opts.LeafNode.Remotes[0].Compression; c != CompressionFast {
+		t.Fatalf("Unexpected remote compression: %q", c)
+	}
+	if c := opts.LeafNode.Remotes[1].Compression; c != CompressionOff {
+		t.Fatalf("Unexpected remote compression: %q", c)
+	}
+
+	for _, test := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"bad mode", `cluster: {port: -1, compression: gzip}`, "invalid compression mode"},
+		{"bad type", `leafnodes: {port: -1, compression: 1}`, "expected compression to be a boolean or string"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.conf))
+			defer os.Remove(conf)
+			if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCompressionAlgorithmNegotiation(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		remote []string
+		algo   string
+	}{
+		{"older remote", nil, CompressionDeflate},
+		{"deflate", []string{CompressionDeflate}, CompressionDeflate},
+		{"preferred", []string{"s2", CompressionDeflate}, CompressionDeflate},
+		{"unknown", []string{"s2"}, _EMPTY_},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if algo := selectCompression(test.remote); algo != test.algo {
+				t.Fatalf("Expected algorithm %q, got %q", test.algo, algo)
+			}
+		})
+	}
+
+	c := &client{kind: ROUTER}
+	if err := c.processCompressionStart("s2"); err == nil || !strings.Contains(err.Error(), "unsupported compression algorithm") {
+		t.Fatalf("Expected an error for an unknown algorithm, got %v", err)
+	}
+	// A remote that does not say compresses with deflate.
+	if err := c.processCompressionStart(_EMPTY_); err != nil || c.in.za != CompressionDeflate {
+		t.Fatalf("Unexpected algorithm %q: %v", c.in.za, err)
+	}
+
+	// Both sides advertise the algorithms they support.
+	o := DefaultOptions()
+	o.Cluster.Port = -1
+	o.Cluster.Compression = CompressionFast
+	o.LeafNode.Port = -1
+	o.LeafNode.Compression = CompressionFast
+	s := RunServer(o)
+	defer s.Shutdown()
+	s.mu.Lock()
+	routeAlgos := s.routeInfo.CompressionAlgorithms
+	leafAlgos := s.leafNodeInfo.CompressionAlgorithms
+	s.mu.Unlock()
+	if len(routeAlgos) != 1 || routeAlgos[0] != CompressionDeflate {
+		t.Fatalf("Unexpected route algorithms: %q", routeAlgos)
+	}
+	if len(leafAlgos) != 1 || leafAlgos[0] != CompressionDeflate {
+		t.Fatalf("Unexpected leafnode algorithms: %q", leafAlgos)
+	}
+}
+
+func TestCompressionStartProto(t *testing.T) {
+	var info Info
+	proto := compressionStartProto(CompressionDeflate)
+	if !bytes.HasPrefix(proto, []byte("INFO ")) || !bytes.HasSuffix(proto, []byte(_CRLF_)) {
+		t.Fatalf("Unexpected protocol %q", proto)
+	}
+	if err := json.Unmarshal(proto[5:len(proto)-2], &info); err != nil {
+		t.Fatalf("Error decoding %q: %v", proto, err)
+	}
+	if !info.CompressionStart || info.CompressionAlgorithm != CompressionDeflate {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+}
@@ -15,6 +15,7 @@ package server
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"strings"
@@ -47,9 +48,9 @@ func TestConfigCheck(t *testing.T) {
 		{
 			name: "when unknown field is used at top level",
 			config: `
-                monitor = "127.0.0.1:4442"
+                monitoring = "127.0.0.1:4442"
                 `,
-			err:       errors.New(`unknown field "monitor"`),
+			err:       errors.New(`unknown field "monitoring"`),
 			errorLine: 2,
 			errorPos:  17,
 		},
@@ -1382,3 +1383,63 @@ func TestConfigCheckMultipleErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigCheckAuthConflicts(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			"token and account users",
+			`authorization {
+			  token = quux
+			}
+			accounts {
+			  A { users = [ {user: a, password: a} ] }
+			}`,
+			"1:0: Can not have a token and users or nkeys",
+		},
+		{
+			"user and account nkeys",
+			`authorization {
+			  user = foo
+			  pass = bar
+			}
+			accounts {
+			  A { users = [ {nkey: "UDXU4RCSJNZOIQHZNWXHXORDPRTGNJAHAHFRGZNEEJCPQTT2M7NLCNF4"} ] }
+			}`,
+			"1:0: Can not have a single user/pass and users or nkeys",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.config))
+			defer os.Remove(conf)
+			opts := &Options{CheckConfig: true}
+			err := opts.ProcessConfigFile(conf)
+			if err == nil || !strings.Contains(err.Error(), conf+":"+test.err) {
+				t.Fatalf("Expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestConfigCheckValidatesOptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`max_closed_clients: -1`))
+	defer os.Remove(conf)
+
+	for _, flagName := range []string{"-t", "--config-check"} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		_, err := ConfigureOptions(fs, []string{flagName, "-c", conf}, PrintServerAndExit, fs.Usage, PrintTLSHelpAndDie)
+		if err == nil || !strings.Contains(err.Error(), "max_closed_clients can not be negative") {
+			t.Fatalf("Expected validation error with %s, got %v", flagName, err)
+		}
+	}
+
+	conf = createConfFile(t, []byte(`max_closed_clients: 10`))
+	defer os.Remove(conf)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := ConfigureOptions(fs, []string{"--config-check", "-c", conf}, PrintServerAndExit, fs.Usage, PrintTLSHelpAndDie); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedValuePrefix marks a configuration string value that has
+	// been encrypted with EncryptConfigValue.
+	encryptedValuePrefix = "enc:v1:"
+
+	// ConfigKeyEnv is the environment variable holding the base64 encoded
+	// master key used to decrypt configuration values, unless the
+	// configuration names another source through "config_key".
+	ConfigKeyEnv = "NATS_CONFIG_KEY"
+
+	// configKeySize is the size of the AES-256 master key.
+	configKeySize = 32
+)
+
+var errNoConfigKey = errors.New("configuration has encrypted values but no master key, set " + ConfigKeyEnv + " or config_key")
+
+// decryptedToken replaces the value of an encrypted configuration
+// token while keeping its position for error reporting.
+type decryptedToken struct {
+	token
+	value string
+}
+
+func (t *decryptedToken) Value() interface{} {
+	return t.value
+}
+
+// EncryptConfigValue encrypts the given plaintext with the base64 encoded
+// master key. The result can be used as a string value in a configuration
+// file and is decrypted when the configuration is processed.
+func EncryptConfigValue(key, plaintext string) (string, error) {
+	aead, err := configCipher([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// configCipher returns the AES-GCM cipher for a base64 encoded master key.
+func configCipher(key []byte) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %v", err)
+	}
+	if len(raw) != configKeySize {
+		return nil, fmt.Errorf("invalid master key: expected %d bytes, got %d", configKeySize, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptConfigValue decrypts a value produced by EncryptConfigValue.
+func decryptConfigValue(aead cipher.AEAD, v string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, encryptedValuePrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %v", err)
+	}
+	ns := aead.NonceSize()
+	if len(sealed) < ns {
+		return "", errors.New("invalid encrypted value: too short")
+	}
+	plain, err := aead.Open(nil, sealed[:ns], sealed[ns:], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt value, wrong master key?")
+	}
+	return string(plain), nil
+}
+
+// configMasterKey loads the master key, either from the key provider
+// reference in the top level "config_key" field or from ConfigKeyEnv.
+func configMasterKey(m map[string]interface{}) ([]byte, error) {
+	v, ok := m["config_key"]
+	if !ok {
+		if key := os.Getenv(ConfigKeyEnv); key != "" {
+			return []byte(key), nil
+		}
+		return nil, errNoConfigKey
+	}
+	tk, v := unwrapValue(v, nil)
+	ref, ok := v.(string)
+	if !ok {
+		return nil, &configErr{tk, "config_key should be a key provider reference"}
+	}
+	p, u := keyProviderFor(ref)
+	if p == nil {
+		return nil, &configErr{tk, fmt.Sprintf("config_key %q does not use a registered key provider", ref)}
+	}
+	key, err := p.Seed(u)
+	if err != nil {
+		return nil, &configErr{tk, fmt.Sprintf("error loading config_key: %v", err)}
+	}
+	return key, nil
+}
+
+// decryptConfigValues replaces, in place, all encrypted string values of
+// the parsed configuration with their plaintext. The master key is only
+// loaded if the configuration holds encrypted values.
+func decryptConfigValues(m map[string]interface{}) error {
+	var (
+		aead   cipher.AEAD
+		errs   []error
+		keyErr error
+	)
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		tk, uv := unwrapValue(v, nil)
+		switch vv := uv.(type) {
+		case map[string]interface{}:
+			for k, e := range vv {
+				vv[k] = walk(e)
+			}
+		case []interface{}:
+			for i, e := range vv {
+				vv[i] = walk(e)
+			}
+		case string:
+			if !strings.HasPrefix(vv, encryptedValuePrefix) {
+				return v
+			}
+			if aead == nil && keyErr == nil {
+				var key []byte
+				if key, keyErr = configMasterKey(m); keyErr == nil {
+					aead, keyErr = configCipher(key)
+				}
+				if keyErr != nil {
+					if _, ok := keyErr.(*configErr); !ok {
+						keyErr = &configErr{tk, keyErr.Error()}
+					}
+					errs = append(errs, keyErr)
+				}
+			}
+			if keyErr != nil {
+				return v
+			}
+			plain, err := decryptConfigValue(aead, vv)
+			if err != nil {
+				errs = append(errs, &configErr{tk, err.Error()})
+				return v
+			}
+			if tk == nil {
+				return plain
+			}
+			return &decryptedToken{tk, plain}
+		}
+		return v
+	}
+	for k, v := range m {
+		if k == "config_key" {
+			continue
+		}
+		m[k] = walk(v)
+	}
+	if len(errs) > 0 {
+		return &processConfigErr{errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func newTestConfigKey(t *testing.T) string {
+	t.Helper()
+	raw := make([]byte, configKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func encryptTestValue(t *testing.T, key, value string) string {
+	t.Helper()
+	enc, err := EncryptConfigValue(key, value)
+	if err != nil {
+		t.Fatalf("Error encrypting value: %v", err)
+	}
+	return enc
+}
+
+func TestConfigEncryptedValues(t *testing.T) {
+	key := newTestConfigKey(t)
+	pass := encryptTestValue(t, key, "s3cr3t")
+	routePass := encryptTestValue(t, key, "routepwd")
+	if strings.Contains(pass, "s3cr3t") {
+		t.Fatalf("Plaintext leaked in encrypted value %q", pass)
+	}
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		authorization {
+			user: ivan
+			password: "%s"
+		}
+		cluster {
+			listen: "127.0.0.1:-1"
+			authorization {
+				user: route
+				password: "%s"
+			}
+		}
+	`, pass, routePass)))
+	defer os.Remove(conf)
+
+	os.Setenv(ConfigKeyEnv, key)
+	defer os.Unsetenv(ConfigKeyEnv)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Password != "s3cr3t" {
+		t.Fatalf("Expected password to be decrypted, got %q", opts.Password)
+	}
+	if opts.Cluster.Password != "routepwd" {
+		t.Fatalf("Expected cluster password to be decrypted, got %q", opts.Cluster.Password)
+	}
+
+	// Wrong master key.
+	os.Setenv(ConfigKeyEnv, newTestConfigKey(t))
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "unable to decrypt") {
+		t.Fatalf("Expected decryption error, got %v", err)
+	}
+
+	// No master key.
+	os.Unsetenv(ConfigKeyEnv)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "no master key") {
+		t.Fatalf("Expected missing key error, got %v", err)
+	}
+
+	// A configuration without encrypted values does not need a key.
+	plain := createConfFile(t, []byte(`authorization { user: ivan, password: "enc" }`))
+	defer os.Remove(plain)
+	if _, err := ProcessConfigFile(plain); err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+}
+
+func TestConfigEncryptedValuesKeyProvider(t *testing.T) {
+	key := newTestConfigKey(t)
+	os.Setenv("NATS_TEST_CONFIG_KEY", key)
+	defer os.Unsetenv("NATS_TEST_CONFIG_KEY")
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		config_key: "env://NATS_TEST_CONFIG_KEY"
+		accounts {
+			A { users = [ {user: a, password: "%s"} ] }
+		}
+	`, encryptTestValue(t, key, "pwd"))))
+	defer os.Remove(conf)
+
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if len(opts.Users) != 1 || opts.Users[0].Password != "pwd" {
+		t.Fatalf("Expected account user password to be decrypted, got %+v", opts.Users)
+	}
+
+	conf = createConfFile(t, []byte(fmt.Sprintf(`
+		config_key: "unknown://key"
+		authorization { user: a, password: "%s" }
+	`, encryptTestValue(t, key, "pwd"))))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "registered key provider") {
+		t.Fatalf("Expected key provider error, got %v", err)
+	}
+}
+
+func TestConfigReloadEncryptedValues(t *testing.T) {
+	key := newTestConfigKey(t)
+	os.Setenv(ConfigKeyEnv, key)
+	defer os.Unsetenv(ConfigKeyEnv)
+
+	template := `
+		listen: "127.0.0.1:-1"
+		authorization { user: ivan, password: "%s" }
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, encryptTestValue(t, key, "pwd1"))))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	nc, err := nats.Connect(url, nats.UserInfo("ivan", "pwd1"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	nc.Close()
+
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(template, encryptTestValue(t, key, "pwd2")))
+
+	if nc, err := nats.Connect(url, nats.UserInfo("ivan", "pwd1")); err == nil {
+		nc.Close()
+		t.Fatal("Expected old password to be rejected")
+	}
+	nc, err = nats.Connect(url, nats.UserInfo("ivan", "pwd2"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	nc.Close()
+}
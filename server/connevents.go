@@ -0,0 +1,188 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default subject of the connection events, followed by the type
+	// of the event.
+	DefaultConnectionEventsSubject = "$EVENTS.CONN"
+
+	ConnectionEventConnect    = "connect"
+	ConnectionEventDisconnect = "disconnect"
+
+	// Code of the reason of the connections closed by a server in lame
+	// duck mode.
+	ReasonCodeLameDuck = "lame_duck"
+)
+
+// ConnectionEvent is published in the account of a client connection when
+// it connects and when it is closed, on the subject of the connection
+// events followed by the type of the event. ReasonCode is the machine
+// readable reason of a disconnect.
+type ConnectionEvent struct {
+	Type       string     `json:"type"`
+	Server     ServerInfo `json:"server"`
+	Client     ClientInfo `json:"client"`
+	Sent       *DataStats `json:"sent,omitempty"`
+	Received   *DataStats `json:"received,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	ReasonCode string     `json:"reason_code,omitempty"`
+}
+
+// Code returns the machine readable code of the reason.
+func (reason ClosedState) Code() string {
+	switch reason {
+	case ClientClosed:
+		return "client_closed"
+	case AuthenticationTimeout:
+		return "auth_timeout"
+	case AuthenticationViolation:
+		return "auth_violation"
+	case TLSHandshakeError:
+		return "tls_handshake_error"
+	case SlowConsumerPendingBytes:
+		return "slow_consumer"
+	case SlowConsumerWriteDeadline:
+		return "write_deadline"
+	case WriteError:
+		return "write_error"
+	case ReadError:
+		return "read_error"
+	case ParseError:
+		return "parse_error"
+	case StaleConnection:
+		return "stale_connection"
+	case ProtocolViolation:
+		return "protocol_violation"
+	case BadClientProtocolVersion:
+		return "bad_client_protocol"
+	case WrongPort:
+		return "wrong_port"
+	case MaxConnectionsExceeded:
+		return "max_connections"
+	case MaxAccountConnectionsExceeded:
+		return "max_account_connections"
+	case MaxPayloadExceeded:
+		return "max_payload"
+	case MaxControlLineExceeded:
+		return "max_control_line"
+	case MaxSubscriptionsExceeded:
+		return "max_subscriptions"
+	case DuplicateRoute:
+		return "duplicate_route"
+	case RouteRemoved:
+		return "route_removed"
+	case ServerShutdown:
+		return "server_shutdown"
+	case AuthenticationExpired:
+		return "auth_expired"
+	case WrongGateway:
+		return "wrong_gateway"
+	case MissingAccount:
+		return "missing_account"
+	case Revocation:
+		return "revoked"
+	case MemoryQuotaExceeded:
+		return "memory_quota"
+	case AccountDeleted:
+		return "account_deleted"
+	case Kicked:
+		return "kicked"
+	case ClientVersionRejected:
+		return "client_version"
+	}
+	return "unknown"
+}
+
+// closedReasonCode returns the code of the reason a connection is closed,
+// telling apart the connections closed by the lame duck mode.
+func (s *Server) closedReasonCode(reason ClosedState) string {
+	if reason == ServerShutdown && s.isLameDuckMode() {
+		return ReasonCodeLameDuck
+	}
+	return reason.Code()
+}
+
+func validateConnectionEvents(o *Options) error {
+	subject := o.ConnectionEvents.Subject
+	if subject != _EMPTY_ && !IsValidLiteralSubject(subject) {
+		return fmt.Errorf("connection_events subject %q is not a valid literal subject", subject)
+	}
+	return nil
+}
+
+// Returns the subject of the connection events, empty if not enabled.
+func (s *Server) connectionEventsSubject() string {
+	return s.getOpts().ConnectionEvents.Subject
+}
+
+// sendConnectionEvent publishes a connection event in the account of the
+// client, if enabled. The reason is only used for a disconnect.
+func (s *Server) sendConnectionEvent(c *client, typ string, now time.Time, reason ClosedState) {
+	subject := s.connectionEventsSubject()
+	if subject == _EMPTY_ || !s.eventsEnabled() {
+		return
+	}
+	c.mu.Lock()
+	acc := c.acc
+	if acc == nil || c.kind != CLIENT {
+		c.mu.Unlock()
+		return
+	}
+	m := ConnectionEvent{
+		Type: typ,
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: acc.Name,
+			User:    nameForClient(c),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+			RTT:     c.getRTT(),
+		},
+	}
+	if typ == ConnectionEventDisconnect {
+		m.Client.Stop = &now
+		m.Sent = &DataStats{
+			Msgs:  atomic.LoadInt64(&c.inMsgs),
+			Bytes: atomic.LoadInt64(&c.inBytes),
+		}
+		m.Received = &DataStats{
+			Msgs:  c.outMsgs,
+			Bytes: c.outBytes,
+		}
+	}
+	c.mu.Unlock()
+	if typ == ConnectionEventDisconnect {
+		m.Reason = reason.String()
+		m.ReasonCode = s.closedReasonCode(reason)
+	}
+
+	s.mu.Lock()
+	if s.sys == nil || s.sys.sendq == nil {
+		s.mu.Unlock()
+		return
+	}
+	sendq := s.sys.sendq
+	s.mu.Unlock()
+	sendq <- &pubMsg{acc, fmt.Sprintf("%s.%s", subject, typ), _EMPTY_, &m.Server, &m, false}
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestConnectionEventsConfig(t *testing.T) {
+	for _, test := range []struct {
+		conf    string
+		subject string
+	}{
+		{"connection_events: true", DefaultConnectionEventsSubject},
+		{"connection_events: false", _EMPTY_},
+		{"connection_events: \"events.conn\"", "events.conn"},
+		{"connection_events { subject: \"events.conn\" }", "events.conn"},
+		{"connection_events {}", DefaultConnectionEventsSubject},
+	} {
+		conf := createConfFile(t, []byte(test.conf))
+		defer os.Remove(conf)
+		opts, err := ProcessConfigFile(conf)
+		if err != nil {
+			t.Fatalf("Error processing %q: %v", test.conf, err)
+		}
+		if opts.ConnectionEvents.Subject != test.subject {
+			t.Fatalf("Expected subject %q for %q, got %q", test.subject, test.conf, opts.ConnectionEvents.Subject)
+		}
+	}
+
+	conf := createConfFile(t, []byte(`connection_events { subject: "events.conn", foo: bar }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected an error for an unknown field")
+	}
+
+	opts := DefaultOptions()
+	opts.ConnectionEvents.Subject = "events.*"
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected an error for a wildcard subject")
+	}
+}
+
+func TestClosedStateCode(t *testing.T) {
+	for reason, code := range map[ClosedState]string{
+		ClientClosed:              "client_closed",
+		SlowConsumerPendingBytes:  "slow_consumer",
+		SlowConsumerWriteDeadline: "write_deadline",
+		AuthenticationExpired:     "auth_expired",
+		ServerShutdown:            "server_shutdown",
+		ClosedState(1000):         "unknown",
+	} {
+		if c := reason.Code(); c != code {
+			t.Fatalf("Expected code %q for %v, got %q", code, reason, c)
+		}
+	}
+
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+	if code := s.closedReasonCode(ServerShutdown); code != "server_shutdown" {
+		t.Fatalf("Unexpected code %q", code)
+	}
+	s.mu.Lock()
+	s.ldm = true
+	s.mu.Unlock()
+	if code := s.closedReasonCode(ServerShutdown); code != ReasonCodeLameDuck {
+		t.Fatalf("Expected code %q, got %q", ReasonCodeLameDuck, code)
+	}
+	s.mu.Lock()
+	s.ldm = false
+	s.mu.Unlock()
+}
+
+func TestConnectionEvents(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: "127.0.0.1:-1"
+		system_account: SYS
+		connection_events: true
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A { users: [{user: a, password: a}, {user: b, password: b}] }
+			B { users: [{user: c, password: c}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nc := natsConnect(t, url, nats.UserInfo("a", "a"))
+	defer nc.Close()
+	events := natsSubSync(t, nc, DefaultConnectionEventsSubject+".>")
+	natsFlush(t, nc)
+
+	nextEvent := func(subject string) *ConnectionEvent {
+		t.Helper()
+		msg, err := events.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Expected an event: %v", err)
+		}
+		if msg.Subject != subject {
+			t.Fatalf("Expected subject %q, got %q", subject, msg.Subject)
+		}
+		var e ConnectionEvent
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		return &e
+	}
+
+	ncb := natsConnect(t, url, nats.UserInfo("b", "b"), nats.Name("b"))
+	e := nextEvent(DefaultConnectionEventsSubject + ".connect")
+	if e.Type != ConnectionEventConnect || e.Client.Account != "A" ||
+		e.Client.Name != "b" || e.Server.ID != s.ID() || e.ReasonCode != _EMPTY_ {
+		t.Fatalf("Unexpected event: %+v", e)
+	}
+	cid := e.Client.ID
+	ncb.Close()
+	e = nextEvent(DefaultConnectionEventsSubject + ".disconnect")
+	if e.Type != ConnectionEventDisconnect || e.Client.ID != cid || e.Client.Stop == nil ||
+		e.Reason != ClientClosed.String() || e.ReasonCode != "client_closed" {
+		t.Fatalf("Unexpected event: %+v", e)
+	}
+
+	// The events of other accounts are not published in this account.
+	ncc := natsConnect(t, url, nats.UserInfo("c", "c"))
+	ncc.Close()
+	if _, err := events.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("Expected no event from another account")
+	}
+
+	// The reason code is reported in the closed connections.
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/connz?state=closed", s.MonitorAddr().Port))
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	defer resp.Body.Close()
+	var c Connz
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		t.Fatalf("Error decoding connz: %v", err)
+	}
+	var found bool
+	for _, ci := range c.Conns {
+		if ci.Cid == cid {
+			found = true
+			if ci.ReasonCode != "client_closed" {
+				t.Fatalf("Unexpected reason code %q", ci.ReasonCode)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Expected connection %d in the closed connections", cid)
+	}
+}
@@ -27,6 +27,11 @@ const (
 	CommandReopen = Command("reopen")
 	CommandReload = Command("reload")
 
+	// Windows service management.
+	CommandInstall   = Command("install")
+	CommandUninstall = Command("uninstall")
+	CommandStart     = Command("start")
+
 	// private for now
 	commandLDMode = Command("ldm")
 )
@@ -94,6 +99,10 @@ const (
 	// DEFAULT_FLUSH_DEADLINE is the write/flush deadlines.
 	DEFAULT_FLUSH_DEADLINE = 2 * time.Second
 
+	// DEFAULT_FLUSH_INTERVAL is how long outbound data may wait to be
+	// coalesced when a listener uses the throughput flush mode.
+	DEFAULT_FLUSH_INTERVAL = time.Millisecond
+
 	// DEFAULT_HTTP_PORT is the default monitoring port.
 	DEFAULT_HTTP_PORT = 8222
 
@@ -112,6 +121,14 @@ const (
 	// DEFAULT_ROUTE_DIAL Route dial timeout.
 	DEFAULT_ROUTE_DIAL = 1 * time.Second
 
+	// DEFAULT_DISCOVERY_INTERVAL is how often routes are discovered
+	// again, including the ones given as SRV records.
+	DEFAULT_DISCOVERY_INTERVAL = 30 * time.Second
+
+	// DEFAULT_ROUTE_RETRY_MAX_DELAY is the maximum delay between route
+	// connection attempts when the retry policy has no max delay.
+	DEFAULT_ROUTE_RETRY_MAX_DELAY = 30 * time.Second
+
 	// DEFAULT_LEAF_NODE_RECONNECT LeafNode reconnect interval.
 	DEFAULT_LEAF_NODE_RECONNECT = time.Second
 
@@ -166,6 +183,7 @@ const (
 
 	// DEFAULT_RTT_MEASUREMENT_INTERVAL is how often we want to measure RTT from
 	// this server to clients, routes, gateways or leafnode connections.
+	// It can be changed with the rtt_interval option.
 	DEFAULT_RTT_MEASUREMENT_INTERVAL = time.Hour
 
 	// DEFAULT_ALLOW_RESPONSE_MAX_MSGS is the default number of responses allowed
@@ -179,4 +197,9 @@ const (
 	// DEFAULT_SERVICE_LATENCY_SAMPLING is the default sampling rate for service
 	// latency metrics
 	DEFAULT_SERVICE_LATENCY_SAMPLING = 100
+
+	// DEFAULT_TLS_HANDSHAKE_FIRST_FALLBACK_DELAY is how long we wait for a
+	// client to start the TLS handshake, when handshake_first is "auto",
+	// before sending the INFO as expected by clients not supporting it.
+	DEFAULT_TLS_HANDSHAKE_FIRST_FALLBACK_DELAY = 50 * time.Millisecond
 )
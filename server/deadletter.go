@@ -0,0 +1,107 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+)
+
+// deadLetter is the policy of an account for the messages that could not
+// be delivered: an advisory is published to subject, with the payload of
+// the message if it is not larger than maxPayload.
+type deadLetter struct {
+	subject    string
+	maxPayload int
+}
+
+// Reasons of the dead letter advisories.
+const (
+	deadLetterSlowConsumer = "Slow Consumer"
+	deadLetterNoResponders = "No Responders"
+)
+
+// DeadLetterAdvisory is published to the dead letter subject of an account
+// when a message is dropped. Client is the connection the message could not
+// be delivered to, or for a request without responders, the requestor.
+type DeadLetterAdvisory struct {
+	Server  ServerInfo `json:"server"`
+	Time    time.Time  `json:"timestamp"`
+	Reason  string     `json:"reason"`
+	Subject string     `json:"subject"`
+	Reply   string     `json:"reply,omitempty"`
+	Size    int        `json:"size"`
+	Client  ClientInfo `json:"client"`
+	Payload []byte     `json:"payload,omitempty"`
+}
+
+// Returns the dead letter policy of the account, nil if not set.
+func (a *Account) deadLetterPolicy() *deadLetter {
+	a.mu.RLock()
+	dl := a.deadLetter
+	a.mu.RUnlock()
+	return dl
+}
+
+// newDeadLetter returns the advisory for the message, including its CR_LF,
+// that could not be delivered to or was published by this client, or nil
+// if the account does not have a dead letter policy.
+// Lock should be held.
+func (c *client) newDeadLetter(reason string, subject, reply, msg []byte) (*Account, *DeadLetterAdvisory) {
+	acc := c.acc
+	if acc == nil {
+		return nil, nil
+	}
+	dl := acc.deadLetterPolicy()
+	// Never report the loss of the advisories themselves.
+	if dl == nil || string(subject) == dl.subject {
+		return nil, nil
+	}
+	size := len(msg) - LEN_CR_LF
+	adv := &DeadLetterAdvisory{
+		Time:    time.Now().UTC(),
+		Reason:  reason,
+		Subject: string(subject),
+		Reply:   string(reply),
+		Size:    size,
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: accForClient(c),
+			User:    nameForClient(c),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+	}
+	if size > 0 && size <= dl.maxPayload {
+		adv.Payload = append([]byte(nil), msg[:size]...)
+	}
+	return acc, adv
+}
+
+// sendDeadLetter publishes the advisory to the dead letter subject of the
+// account.
+func (s *Server) sendDeadLetter(acc *Account, adv *DeadLetterAdvisory) {
+	dl := acc.deadLetterPolicy()
+	if dl == nil {
+		return
+	}
+	s.mu.Lock()
+	adv.Server = ServerInfo{Name: s.info.Name, Host: s.info.Host, ID: s.info.ID, Cluster: s.info.Cluster}
+	s.mu.Unlock()
+	if err := s.sendInternalAccountMsg(acc, dl.subject, adv); err != nil {
+		s.Debugf("Unable to send dead letter advisory for account %q: %v", acc.Name, err)
+	}
+}
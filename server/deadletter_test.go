@@ -0,0 +1,127 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestDeadLetterConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		accounts {
+			A { dead_letter: "dlq.a" }
+			B { dead_letter { subject: "dlq.b", max_payload: 1KB } }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	for _, acc := range opts.Accounts {
+		dl := acc.deadLetter
+		switch {
+		case acc.Name == "A" && dl != nil && dl.subject == "dlq.a" && dl.maxPayload == 0:
+		case acc.Name == "B" && dl != nil && dl.subject == "dlq.b" && dl.maxPayload == 1024:
+		default:
+			t.Fatalf("Unexpected dead letter policy for %q: %+v", acc.Name, dl)
+		}
+	}
+
+	conf = createConfFile(t, []byte(`
+		accounts { A { dead_letter: "dlq.*" } }
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected an error for a wildcard subject")
+	}
+}
+
+func TestDeadLetterAdvisories(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}, {user: b, password: b}]
+				dead_letter { subject: "dlq", max_payload: 16 }
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nc := natsConnect(t, url, nats.UserInfo("a", "a"))
+	defer nc.Close()
+	dlq := natsSubSync(t, nc, "dlq")
+	natsFlush(t, nc)
+
+	nextAdvisory := func() *DeadLetterAdvisory {
+		t.Helper()
+		msg, err := dlq.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Expected an advisory: %v", err)
+		}
+		var adv DeadLetterAdvisory
+		if err := json.Unmarshal(msg.Data, &adv); err != nil {
+			t.Fatalf("Error unmarshalling advisory: %v", err)
+		}
+		return &adv
+	}
+
+	// A request without responders.
+	natsPubReq(t, nc, "no.one", "reply", []byte("hello"))
+	adv := nextAdvisory()
+	if adv.Reason != deadLetterNoResponders || adv.Subject != "no.one" || adv.Reply != "reply" ||
+		string(adv.Payload) != "hello" || adv.Client.Account != "A" || adv.Server.ID != s.ID() {
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	}
+	requestor := adv.Client.ID
+	// Publishes without a reply are not reported.
+	natsPub(t, nc, "no.one", []byte("hello"))
+
+	// A slow consumer.
+	ncb := natsConnect(t, url, nats.UserInfo("b", "b"))
+	defer ncb.Close()
+	natsSubSync(t, ncb, "foo")
+	natsFlush(t, ncb)
+	s.mu.Lock()
+	for _, c := range s.clients {
+		c.mu.Lock()
+		if c.opts.Username == "b" {
+			c.out.mp = 1
+		}
+		c.mu.Unlock()
+	}
+	s.mu.Unlock()
+	natsPub(t, nc, "foo", []byte("this payload is too large"))
+	adv = nextAdvisory()
+	if adv.Reason != deadLetterSlowConsumer || adv.Subject != "foo" || adv.Size != 25 ||
+		adv.Payload != nil || adv.Client.ID == requestor {
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	}
+	if _, err := dlq.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("Expected no other advisory")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Header holding the id of a message for the duplicate detection.
+	msgIDHdr = "Nats-Msg-Id"
+	// Maximum number of message ids remembered per duplicate window, the
+	// oldest are forgotten first.
+	maxDupWindowIDs = 1000000
+)
+
+// dupWindow remembers the ids of the messages published on the subjects
+// matching subject during window. A message whose id was already seen is
+// not delivered. The ids are only known to this server.
+type dupWindow struct {
+	subject string
+	window  time.Duration
+
+	mu  sync.Mutex
+	ids map[string]time.Time
+	// The ids in the order they were seen, to expire them.
+	fifo []dupID
+}
+
+type dupID struct {
+	id      string
+	expires time.Time
+}
+
+// newDupWindows returns the duplicate windows for the subject spaces of
+// the account configuration, sorted by subject.
+func newDupWindows(windows map[string]time.Duration) []*dupWindow {
+	if len(windows) == 0 {
+		return nil
+	}
+	dws := make([]*dupWindow, 0, len(windows))
+	for subject, window := range windows {
+		dws = append(dws, &dupWindow{subject: subject, window: window})
+	}
+	sort.Slice(dws, func(i, j int) bool { return dws[i].subject < dws[j].subject })
+	return dws
+}
+
+// isDuplicate records the id and returns true if it was already seen
+// within the window.
+func (dw *dupWindow) isDuplicate(id string, now time.Time) bool {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.ids == nil {
+		dw.ids = make(map[string]time.Time)
+	}
+	// Forget the expired ids.
+	for len(dw.fifo) > 0 {
+		oldest := dw.fifo[0]
+		if now.Before(oldest.expires) && len(dw.fifo) < maxDupWindowIDs {
+			break
+		}
+		if dw.ids[oldest.id].Equal(oldest.expires) {
+			delete(dw.ids, oldest.id)
+		}
+		dw.fifo = dw.fifo[1:]
+	}
+	if exp, ok := dw.ids[id]; ok && now.Before(exp) {
+		return true
+	}
+	exp := now.Add(dw.window)
+	dw.ids[id] = exp
+	dw.fifo = append(dw.fifo, dupID{id, exp})
+	return false
+}
+
+// isDuplicateMsg returns true if the message published on subject, with
+// the headers hdr, has an id already seen within the duplicate window of
+// the first subject space of the account matching subject.
+func (a *Account) isDuplicateMsg(subject, hdr []byte) bool {
+	a.mu.RLock()
+	dws := a.dupWindows
+	a.mu.RUnlock()
+	if len(dws) == 0 {
+		return false
+	}
+	id := getHeader(msgIDHdr, hdr)
+	if len(id) == 0 {
+		return false
+	}
+	for _, dw := range dws {
+		if subjectIsSubsetMatch(string(subject), dw.subject) {
+			return dw.isDuplicate(string(id), time.Now())
+		}
+	}
+	return false
+}
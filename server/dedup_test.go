@@ -0,0 +1,152 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicateWindowExpiration(t *testing.T) {
+	dw := &dupWindow{subject: ">", window: time.Minute}
+	now := time.Now()
+	if dw.isDuplicate("1", now) || dw.isDuplicate("2", now.Add(time.Second)) {
+		t.Fatal("Expected new ids not to be duplicates")
+	}
+	if !dw.isDuplicate("1", now.Add(30*time.Second)) {
+		t.Fatal("Expected a duplicate within the window")
+	}
+	// Past the window, the id is new again and the expired ids are forgotten.
+	if dw.isDuplicate("1", now.Add(time.Minute)) {
+		t.Fatal("Expected the id to be new past the window")
+	}
+	if len(dw.ids) != 2 || len(dw.fifo) != 2 {
+		t.Fatalf("Expected 2 ids, got %v", dw.ids)
+	}
+	if dw.isDuplicate("2", now.Add(2*time.Minute)) {
+		t.Fatal("Expected the id to be new past the window")
+	}
+	if len(dw.ids) != 1 || len(dw.fifo) != 1 {
+		t.Fatalf("Expected 1 id, got %v", dw.ids)
+	}
+}
+
+func TestDuplicateWindowConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accounts {
+			A { duplicate_window: "2m" }
+			B { duplicate_window { "orders.>": "30s", "payments.*": "1m" } }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	for _, acc := range opts.Accounts {
+		dc := acc.dupConfig
+		switch {
+		case acc.Name == "A" && len(dc) == 1 && dc[">"] == 2*time.Minute:
+		case acc.Name == "B" && len(dc) == 2 && dc["orders.>"] == 30*time.Second && dc["payments.*"] == time.Minute:
+		default:
+			t.Fatalf("Unexpected duplicate windows for %q: %v", acc.Name, dc)
+		}
+	}
+
+	for _, cfg := range []string{
+		`accounts { A { duplicate_window { "orders..": "1m" } } }`,
+		`accounts { A { duplicate_window: "-1s" } }`,
+	} {
+		conf := createConfFile(t, []byte(cfg))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil {
+			t.Fatalf("Expected an error for %q", cfg)
+		}
+	}
+}
+
+func TestDuplicateWindowDropsRepublishedIDs(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		accounts {
+			A {
+				users: [{user: a, password: a}]
+				duplicate_window { "orders.>": "1m" }
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(c)
+		br.ReadString('\n')
+		c.Write([]byte("CONNECT {\"verbose\":false,\"headers\":true,\"user\":\"a\",\"pass\":\"a\"}\r\nPING\r\n"))
+		if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q", l)
+		}
+		return c, br
+	}
+	sc, sr := connect()
+	defer sc.Close()
+	sc.Write([]byte("SUB > 1\r\nPING\r\n"))
+	sr.ReadString('\n')
+	pc, pr := connect()
+	defer pc.Close()
+
+	send := func(subject, id string) {
+		hdr := fmt.Sprintf("NATS/1.0\r\nNats-Msg-Id: %s\r\n\r\n", id)
+		pc.Write([]byte(fmt.Sprintf("HPUB %s %d %d\r\n%shello\r\n", subject, len(hdr), len(hdr)+5, hdr)))
+	}
+	send("orders.1", "1")
+	send("orders.2", "1")
+	send("orders.1", "2")
+	send("other", "1")
+	send("other", "1")
+	// The duplicates are accepted.
+	pc.Write([]byte("PING\r\n"))
+	if l, _ := pr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	sc.Write([]byte("PING\r\n"))
+
+	for _, expected := range []struct{ subject, id string }{
+		{"orders.1", "1"}, {"orders.1", "2"}, {"other", "1"}, {"other", "1"},
+	} {
+		if l, _ := sr.ReadString('\n'); !strings.HasPrefix(l, "HMSG "+expected.subject+" 1") {
+			t.Fatalf("Expected message on %q, got %q", expected.subject, l)
+		}
+		sr.ReadString('\n')
+		if l, _ := sr.ReadString('\n'); l != "Nats-Msg-Id: "+expected.id+"\r\n" {
+			t.Fatalf("Expected id %q, got %q", expected.id, l)
+		}
+		sr.ReadString('\n')
+		sr.ReadString('\n')
+	}
+	if l, _ := sr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Header asking the server to deliver a message after a delay.
+	msgDelayHdr = "Nats-Delay"
+	// Extension of the files of the pending delayed messages.
+	delayedMsgExt = ".msg"
+)
+
+// delayedMsg is a message held by the server until its delivery time.
+type delayedMsg struct {
+	Seq     uint64    `json:"seq"`
+	Account string    `json:"account"`
+	Subject string    `json:"subject"`
+	Reply   string    `json:"reply,omitempty"`
+	Hdr     int       `json:"hdr,omitempty"`
+	Msg     []byte    `json:"msg"`
+	Deliver time.Time `json:"deliver"`
+}
+
+// delayedQueue orders the delayed messages by delivery time.
+type delayedQueue []*delayedMsg
+
+func (q delayedQueue) Len() int { return len(q) }
+func (q delayedQueue) Less(i, j int) bool {
+	if q[i].Deliver.Equal(q[j].Deliver) {
+		return q[i].Seq < q[j].Seq
+	}
+	return q[i].Deliver.Before(q[j].Deliver)
+}
+func (q delayedQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *delayedQueue) Push(x interface{}) { *q = append(*q, x.(*delayedMsg)) }
+func (q *delayedQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	dm := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return dm
+}
+
+// delayedDelivery holds the messages published with a delay and delivers
+// them, in the name of their publisher's account, when they are due. The
+// messages are stored in dir, if set, until they are delivered.
+type delayedDelivery struct {
+	mu     sync.Mutex
+	seq    uint64
+	queue  delayedQueue
+	dir    string
+	max    int
+	maxDly time.Duration
+	kick   chan struct{}
+	client *client
+	cipher *storeCipher
+}
+
+// startDelayedDelivery recovers the stored delayed messages and starts the
+// delivery loop, if the delayed delivery is enabled.
+func (s *Server) startDelayedDelivery() {
+	opts := s.getOpts().DelayedDelivery
+	if !opts.Enabled {
+		return
+	}
+	now := time.Now()
+	c := &client{srv: s, kind: SYSTEM, opts: internalOpts, msubs: -1, mpay: -1, start: now, last: now}
+	c.initClient()
+	dd := &delayedDelivery{
+		dir:    opts.StoreDir,
+		max:    opts.MaxMessages,
+		maxDly: opts.MaxDelay,
+		kick:   make(chan struct{}, 1),
+		client: c,
+	}
+	if dd.dir != _EMPTY_ {
+		var err error
+		if dd.cipher, err = s.storeCipher("delayed"); err != nil {
+			s.Errorf("Error initializing the encryption of delayed messages: %v", err)
+			return
+		}
+		if err := dd.recover(); err != nil {
+			s.Errorf("Error recovering delayed messages: %v", err)
+		} else if len(dd.queue) > 0 {
+			s.Noticef("Recovered %d delayed message(s)", len(dd.queue))
+		}
+	}
+	s.mu.Lock()
+	s.delayed = dd
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		t := time.NewTimer(time.Hour)
+		defer t.Stop()
+		for {
+			for _, dm := range dd.due(time.Now()) {
+				s.deliverDelayedMsg(dd, dm)
+				dd.remove(dm)
+			}
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(dd.next(time.Now()))
+			select {
+			case <-t.C:
+			case <-dd.kick:
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// recover loads the messages stored in the directory.
+func (dd *delayedDelivery) recover() error {
+	if err := os.MkdirAll(dd.dir, 0750); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dd.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), delayedMsgExt) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dd.dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		b, stale, err := dd.cipher.open(fi.Name(), b)
+		if err != nil {
+			return fmt.Errorf("delayed message %q: %v", fi.Name(), err)
+		}
+		dm := &delayedMsg{}
+		if err := json.Unmarshal(b, dm); err != nil {
+			return fmt.Errorf("invalid delayed message %q: %v", fi.Name(), err)
+		}
+		// Encrypt again the messages stored with a previous key.
+		if stale {
+			if err := dd.store(dm); err != nil {
+				return err
+			}
+		}
+		heap.Push(&dd.queue, dm)
+		if dm.Seq > dd.seq {
+			dd.seq = dm.Seq
+		}
+	}
+	return nil
+}
+
+// Returns the file of a stored message.
+func (dd *delayedDelivery) file(dm *delayedMsg) string {
+	return filepath.Join(dd.dir, strconv.FormatUint(dm.Seq, 10)+delayedMsgExt)
+}
+
+// store writes the message to its file, synced to disk.
+func (dd *delayedDelivery) store(dm *delayedMsg) error {
+	b, _ := json.Marshal(dm)
+	b, err := dd.cipher.seal(filepath.Base(dd.file(dm)), b)
+	if err != nil {
+		return err
+	}
+	tmp := dd.file(dm) + ".tmp"
+	err = writeFileSync(tmp, b, 0640)
+	if err == nil {
+		err = renameSync(tmp, dd.file(dm))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// add stores and schedules the message.
+func (dd *delayedDelivery) add(dm *delayedMsg, delay time.Duration) error {
+	if dd.maxDly > 0 && delay > dd.maxDly {
+		return fmt.Errorf("delay %v exceeds the maximum of %v", delay, dd.maxDly)
+	}
+	dd.mu.Lock()
+	if dd.max > 0 && len(dd.queue) >= dd.max {
+		dd.mu.Unlock()
+		return fmt.Errorf("maximum of %d delayed messages reached", dd.max)
+	}
+	dd.seq++
+	dm.Seq = dd.seq
+	dm.Deliver = time.Now().Add(delay).UTC()
+	if dd.dir != _EMPTY_ {
+		if err := dd.store(dm); err != nil {
+			dd.mu.Unlock()
+			return fmt.Errorf("unable to store the delayed message: %v", err)
+		}
+	}
+	heap.Push(&dd.queue, dm)
+	first := dd.queue[0] == dm
+	dd.mu.Unlock()
+
+	// Wake up the delivery loop if this message is now the first one due.
+	if first {
+		select {
+		case dd.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// due returns the messages whose delivery time has come, in order.
+func (dd *delayedDelivery) due(now time.Time) []*delayedMsg {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	var msgs []*delayedMsg
+	for len(dd.queue) > 0 && !dd.queue[0].Deliver.After(now) {
+		msgs = append(msgs, heap.Pop(&dd.queue).(*delayedMsg))
+	}
+	return msgs
+}
+
+// next returns the time until the next message is due.
+func (dd *delayedDelivery) next(now time.Time) time.Duration {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	if len(dd.queue) == 0 {
+		return time.Hour
+	}
+	return dd.queue[0].Deliver.Sub(now)
+}
+
+// remove deletes the file of a delivered message.
+func (dd *delayedDelivery) remove(dm *delayedMsg) {
+	if dd.dir != _EMPTY_ {
+		os.Remove(dd.file(dm))
+	}
+}
+
+// pending returns the number of messages waiting to be delivered.
+func (dd *delayedDelivery) pending() int {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	return len(dd.queue)
+}
+
+// deliverDelayedMsg publishes the message in its account, as if it was
+// published by a client.
+func (s *Server) deliverDelayedMsg(dd *delayedDelivery, dm *delayedMsg) {
+	acc, err := s.LookupAccount(dm.Account)
+	if err != nil {
+		s.Warnf("Dropping delayed message on %q, account %q: %v", dm.Subject, dm.Account, err)
+		return
+	}
+	c := dd.client
+	c.mu.Lock()
+	c.acc = acc
+	c.pa.subject = []byte(dm.Subject)
+	c.pa.reply = nil
+	if dm.Reply != _EMPTY_ {
+		c.pa.reply = []byte(dm.Reply)
+	}
+	c.pa.size = len(dm.Msg)
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	c.pa.hdr, c.pa.hdb, c.pa.psz = 0, nil, nil
+	if dm.Hdr > 0 {
+		c.pa.hdr = dm.Hdr
+		c.pa.hdb = []byte(strconv.Itoa(dm.Hdr))
+		c.pa.psz = []byte(strconv.Itoa(c.pa.size - dm.Hdr))
+	}
+	c.mu.Unlock()
+
+	c.processInboundClientMsg(append(dm.Msg, _CRLF_...))
+	c.flushClients(0)
+}
+
+// delayMsg holds the message being processed if it has a delay header.
+// Returns true if the message was held, or rejected, and so must not be
+// delivered now.
+func (c *client) delayMsg(dd *delayedDelivery, msg []byte) bool {
+	v := getHeader(msgDelayHdr, msg[:c.pa.hdr])
+	if v == nil {
+		return false
+	}
+	delay, err := time.ParseDuration(string(v))
+	if err != nil {
+		c.sendErr(fmt.Sprintf("Invalid %s Header %q", msgDelayHdr, v))
+		return true
+	}
+	if delay <= 0 {
+		return false
+	}
+	dm := &delayedMsg{
+		Account: c.acc.Name,
+		Subject: string(c.pa.subject),
+		Reply:   string(c.pa.reply),
+		Hdr:     c.pa.hdr,
+		Msg:     append([]byte(nil), msg[:len(msg)-LEN_CR_LF]...),
+	}
+	if err := dd.add(dm, delay); err != nil {
+		c.sendErr(fmt.Sprintf("Delayed Delivery Error: %v", err))
+		c.Warnf("Delayed delivery of message on %q failed: %v", dm.Subject, err)
+	}
+	return true
+}
+
+func validateDelayedDeliveryOptions(o *Options) error {
+	do := &o.DelayedDelivery
+	if do.MaxDelay < 0 {
+		return fmt.Errorf("delayed_delivery max_delay can not be negative")
+	}
+	if do.MaxMessages < 0 {
+		return fmt.Errorf("delayed_delivery max_messages can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDelayedDeliveryConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		delayed_delivery {
+			store_dir: "/tmp/delayed"
+			max_delay: "1h"
+			max_messages: 100
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	do := opts.DelayedDelivery
+	if !do.Enabled || do.StoreDir != "/tmp/delayed" || do.MaxDelay != time.Hour || do.MaxMessages != 100 {
+		t.Fatalf("Unexpected options: %+v", do)
+	}
+
+	opts = DefaultOptions()
+	opts.DelayedDelivery.MaxMessages = -1
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected an error for negative max_messages")
+	}
+}
+
+// Connects to the server with headers support.
+func delayedConnect(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	br.ReadString('\n')
+	c.Write([]byte("CONNECT {\"verbose\":false,\"headers\":true}\r\nPING\r\n"))
+	if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	return c, br
+}
+
+func delayedPub(c net.Conn, subject, delay string) {
+	hdr := fmt.Sprintf("NATS/1.0\r\nNats-Delay: %s\r\n\r\n", delay)
+	c.Write([]byte(fmt.Sprintf("HPUB %s %d %d\r\n%shello\r\nPING\r\n", subject, len(hdr), len(hdr)+5, hdr)))
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayed")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.DelayedDelivery = DelayedDeliveryOpts{Enabled: true, StoreDir: dir, MaxDelay: time.Minute}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	sc, sr := delayedConnect(t, s)
+	defer sc.Close()
+	sc.Write([]byte("SUB foo 1\r\nPING\r\n"))
+	sr.ReadString('\n')
+	pc, pr := delayedConnect(t, s)
+	defer pc.Close()
+
+	start := time.Now()
+	delayedPub(pc, "foo", "250ms")
+	if l, _ := pr.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+delayedMsgExt)); len(files) != 1 {
+		t.Fatalf("Expected the message to be stored, got %v", files)
+	}
+	if l, _ := sr.ReadString('\n'); !strings.HasPrefix(l, "HMSG foo 1") {
+		t.Fatalf("Expected message, got %q", l)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("Message delivered after %v", elapsed)
+	}
+	for _, expected := range []string{"NATS/1.0\r\n", "Nats-Delay: 250ms\r\n", "\r\n", "hello\r\n"} {
+		if l, _ := sr.ReadString('\n'); l != expected {
+			t.Fatalf("Expected %q, got %q", expected, l)
+		}
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if files, _ := filepath.Glob(filepath.Join(dir, "*"+delayedMsgExt)); len(files) != 0 {
+			return fmt.Errorf("Expected the message to be removed, got %v", files)
+		}
+		return nil
+	})
+
+	// Invalid or too long delays are rejected.
+	for _, delay := range []string{"soon", "2m"} {
+		delayedPub(pc, "foo", delay)
+		if l, _ := pr.ReadString('\n'); !strings.HasPrefix(l, "-ERR") {
+			t.Fatalf("Expected an error for %q, got %q", delay, l)
+		}
+		pr.ReadString('\n')
+	}
+	if n := s.delayed.pending(); n != 0 {
+		t.Fatalf("Expected no pending message, got %d", n)
+	}
+}
+
+func TestDelayedDeliveryRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delayed")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.DelayedDelivery = DelayedDeliveryOpts{Enabled: true, StoreDir: dir}
+	s := RunServer(opts)
+	pc, pr := delayedConnect(t, s)
+	delayedPub(pc, "foo", "1s")
+	pr.ReadString('\n')
+	pc.Close()
+	s.Shutdown()
+
+	// The message is delivered by the restarted server.
+	s = RunServer(opts)
+	defer s.Shutdown()
+	if n := s.delayed.pending(); n != 1 {
+		t.Fatalf("Expected 1 recovered message, got %d", n)
+	}
+	sc, sr := delayedConnect(t, s)
+	defer sc.Close()
+	sc.Write([]byte("SUB foo 1\r\nPING\r\n"))
+	sr.ReadString('\n')
+	if l, _ := sr.ReadString('\n'); !strings.HasPrefix(l, "HMSG foo 1") {
+		t.Fatalf("Expected message, got %q", l)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// Status headers of the flow control requests and idle heartbeats.
+	flowControlHdr = "NATS/1.0 100 FlowControl Request\r\n\r\n"
+	heartbeatHdr   = "NATS/1.0 100 Idle Heartbeat\r\n\r\n"
+)
+
+var (
+	// Number of messages delivered between the flow control requests.
+	flowWindow = 8
+
+	// Deliveries whose flow control requests are not responded to for
+	// that long are considered stalled and stopped.
+	flowStallTimeout = 30 * time.Second
+)
+
+// deliveries publishes the messages delivered by a store with its internal
+// client, and tracks the deliveries waiting for the response to their flow
+// control request. The responses are published to flowPrefix followed by
+// the id of the delivery.
+type deliveries struct {
+	client     *client
+	flowPrefix string
+	flowMu     sync.Mutex
+	flows      map[string]chan struct{}
+	// Serializes the messages published by the client.
+	sendMu sync.Mutex
+}
+
+// startFlow registers a flow controlled delivery, which must be ended once
+// done.
+func (d *deliveries) startFlow() (string, chan struct{}) {
+	id, resume := nuid.Next(), make(chan struct{}, 1)
+	d.flowMu.Lock()
+	if d.flows == nil {
+		d.flows = make(map[string]chan struct{})
+	}
+	d.flows[id] = resume
+	d.flowMu.Unlock()
+	return id, resume
+}
+
+// endFlow removes the flow controlled delivery.
+func (d *deliveries) endFlow(id string) {
+	d.flowMu.Lock()
+	delete(d.flows, id)
+	d.flowMu.Unlock()
+}
+
+// waitFlow sends a flow control request and waits for the client to
+// respond, sending idle heartbeats meanwhile. Returns false if the client
+// stalled or the server is shutting down.
+func (d *deliveries) waitFlow(acc *Account, reply, id string, resume chan struct{}, heartbeat time.Duration) bool {
+	d.publish(acc, reply, d.flowPrefix+id, []byte(flowControlHdr), nil)
+	stall := time.NewTimer(flowStallTimeout)
+	defer stall.Stop()
+	var hbc <-chan time.Time
+	if heartbeat > 0 {
+		hb := time.NewTicker(heartbeat)
+		defer hb.Stop()
+		hbc = hb.C
+	}
+	for {
+		select {
+		case <-resume:
+			return true
+		case <-hbc:
+			d.publish(acc, reply, _EMPTY_, []byte(heartbeatHdr), nil)
+		case <-stall.C:
+			d.client.Warnf("Stopping stalled delivery to %q in account %q", reply, acc.Name)
+			return false
+		case <-d.client.srv.quitCh:
+			return false
+		}
+	}
+}
+
+// resumeFlow resumes the delivery waiting for the response to its flow
+// control request.
+func (d *deliveries) resumeFlow(id string) {
+	d.flowMu.Lock()
+	resume := d.flows[id]
+	d.flowMu.Unlock()
+	if resume != nil {
+		select {
+		case resume <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// publish sends a message, with an optional header, in the account with
+// the client of the store.
+func (d *deliveries) publish(acc *Account, subject, reply string, hdr, data []byte) {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	c := d.client
+	c.mu.Lock()
+	c.acc = acc
+	c.pa.subject = []byte(subject)
+	c.pa.reply = nil
+	if reply != _EMPTY_ {
+		c.pa.reply = []byte(reply)
+	}
+	c.pa.size = len(hdr) + len(data)
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	c.pa.hdr, c.pa.hdb, c.pa.psz = 0, nil, nil
+	if len(hdr) > 0 {
+		c.pa.hdr = len(hdr)
+		c.pa.hdb = []byte(strconv.Itoa(len(hdr)))
+		c.pa.psz = []byte(strconv.Itoa(len(data)))
+	}
+	c.mu.Unlock()
+
+	msg := make([]byte, 0, c.pa.size+len(_CRLF_))
+	msg = append(append(append(msg, hdr...), data...), _CRLF_...)
+	c.processInboundClientMsg(msg)
+	c.flushClients(0)
+}
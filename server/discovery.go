@@ -0,0 +1,235 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RouteDiscovery is implemented by the sources of the route URLs of the
+// cluster peers, for instance a Kubernetes or Consul lookup. The server
+// calls Discover every Cluster.DiscoveryInterval and solicits routes to
+// the URLs that it did not know about. Routes to URLs that are no longer
+// returned are not reconnected to once closed.
+type RouteDiscovery interface {
+	Discover() ([]*url.URL, error)
+}
+
+// SeedDiscovery is a RouteDiscovery that returns a fixed list of seed
+// URLs. Once connected to a seed, the rest of the cluster is found through
+// the gossip of the routes. Unlike the configured routes, connections to
+// the seeds follow the Cluster.Retry policy, including its max attempts.
+type SeedDiscovery struct {
+	URLs []*url.URL
+}
+
+// Discover returns the seed URLs.
+func (sd *SeedDiscovery) Discover() ([]*url.URL, error) {
+	return sd.URLs, nil
+}
+
+// RetryPolicy controls how solicited routes are reconnected.
+// The zero value retries every second, forever.
+type RetryPolicy struct {
+	// InitialDelay is the delay after the first failed attempt. It is
+	// doubled after each failed attempt, up to MaxDelay.
+	InitialDelay time.Duration `json:"initial_delay,omitempty"`
+	MaxDelay     time.Duration `json:"max_delay,omitempty"`
+	// Jitter is the fraction, between 0 and 1, of the delay that is
+	// randomly removed from it so that servers do not retry in lockstep.
+	Jitter float64 `json:"jitter,omitempty"`
+	// MaxAttempts, if positive, is the number of attempts after which
+	// a discovered route is given up, until it is discovered again.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+// Returns how long to wait after the given number of failed attempts.
+func (p *RetryPolicy) delay(attempts int) time.Duration {
+	d := p.InitialDelay
+	if d <= 0 {
+		return routeConnectDelay
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = DEFAULT_ROUTE_RETRY_MAX_DELAY
+	}
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+func validateRetryPolicy(p *RetryPolicy) error {
+	if p.InitialDelay < 0 || p.MaxDelay < 0 || p.MaxAttempts < 0 {
+		return fmt.Errorf("route retry delays and max attempts can not be negative")
+	}
+	if p.MaxDelay > 0 && p.InitialDelay > p.MaxDelay {
+		return fmt.Errorf("route retry initial delay (%v) can not be greater than max delay (%v)",
+			p.InitialDelay, p.MaxDelay)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("route retry jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+// Keeps track of the routes found by the route discoveries.
+type discoveredRoutes struct {
+	sync.RWMutex
+	// Route URLs, keyed by discovery.
+	routes map[string][]*url.URL
+}
+
+// update replaces the routes of the given discovery and returns the
+// ones that were not known before.
+func (dr *discoveredRoutes) update(key string, urls []*url.URL) []*url.URL {
+	dr.Lock()
+	defer dr.Unlock()
+	var added []*url.URL
+	for _, u := range urls {
+		if !containsURL(dr.routes[key], u) {
+			added = append(added, u)
+		}
+	}
+	if dr.routes == nil {
+		dr.routes = make(map[string][]*url.URL)
+	}
+	dr.routes[key] = urls
+	return added
+}
+
+func (dr *discoveredRoutes) get(key string) []*url.URL {
+	dr.RLock()
+	defer dr.RUnlock()
+	return dr.routes[key]
+}
+
+func (dr *discoveredRoutes) remove(key string) {
+	dr.Lock()
+	delete(dr.routes, key)
+	dr.Unlock()
+}
+
+// forget removes u from the discovered routes, so that it is solicited
+// again if discovered again. Returns true if u was a discovered route.
+func (dr *discoveredRoutes) forget(u *url.URL) bool {
+	dr.Lock()
+	defer dr.Unlock()
+	found := false
+	for key, urls := range dr.routes {
+		kept := urls[:0:0]
+		for _, ou := range urls {
+			if urlsAreEqual(ou, u) {
+				found = true
+			} else {
+				kept = append(kept, ou)
+			}
+		}
+		dr.routes[key] = kept
+	}
+	return found
+}
+
+// Returns true if u is one of the discovered routes.
+func (dr *discoveredRoutes) contains(u *url.URL) bool {
+	dr.RLock()
+	defer dr.RUnlock()
+	for _, urls := range dr.routes {
+		if containsURL(urls, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if one of the discovered routes has the given host and port.
+func (dr *discoveredRoutes) containsHost(hostPort string) bool {
+	dr.RLock()
+	defer dr.RUnlock()
+	for _, urls := range dr.routes {
+		for _, u := range urls {
+			if strings.EqualFold(u.Host, hostPort) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsURL(urls []*url.URL, u *url.URL) bool {
+	for _, ou := range urls {
+		if urlsAreEqual(ou, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key of Cluster.Discovery in the discovered routes.
+const clusterDiscoveryKey = "discovery"
+
+// discoverRoutes runs the discovery until the server shuts down or valid
+// returns false, soliciting the routes that it finds.
+func (s *Server) discoverRoutes(key, name string, d RouteDiscovery, valid func() bool) {
+	defer s.grWG.Done()
+	defer s.discoveredRoutes.remove(key)
+
+	firstConnect := true
+	for s.isRunning() && valid() {
+		urls, err := d.Discover()
+		if err != nil {
+			// Keep the current routes on discovery errors.
+			s.Errorf("Error discovering routes from %s: %v", name, err)
+		} else {
+			for _, u := range s.discoveredRoutes.update(key, urls) {
+				route, fc := u, firstConnect
+				s.Debugf("Adding route %s discovered from %s", route.Host, name)
+				s.startGoRoutine(func() { s.connectToRoute(route, true, fc) })
+			}
+			firstConnect = false
+		}
+		interval := s.getOpts().Cluster.DiscoveryInterval
+		if interval <= 0 {
+			interval = DEFAULT_DISCOVERY_INTERVAL
+		}
+		select {
+		case <-s.quitCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Starts the cluster discovery, if one is configured.
+func (s *Server) startRouteDiscovery() {
+	d := s.getOpts().Cluster.Discovery
+	if d == nil {
+		return
+	}
+	// Changing the discovery is not supported by config reload.
+	s.startGoRoutine(func() {
+		s.discoverRoutes(clusterDiscoveryKey, "cluster discovery", d, func() bool { return true })
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRouteDiscovery struct {
+	sync.Mutex
+	urls []*url.URL
+}
+
+func (d *testRouteDiscovery) Discover() ([]*url.URL, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.urls, nil
+}
+
+func (d *testRouteDiscovery) set(urls ...*url.URL) {
+	d.Lock()
+	d.urls = urls
+	d.Unlock()
+}
+
+func routeURL(port int) *url.URL {
+	return &url.URL{Scheme: "nats", Host: fmt.Sprintf("127.0.0.1:%d", port)}
+}
+
+func TestRouteDiscovery(t *testing.T) {
+	oa := DefaultOptions()
+	oa.Cluster.Host = "127.0.0.1"
+	oa.Cluster.Port = -1
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	ob := DefaultOptions()
+	ob.Cluster.Host = "127.0.0.1"
+	ob.Cluster.Port = -1
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	d := &testRouteDiscovery{}
+	d.set(routeURL(oa.Cluster.Port))
+
+	oc := DefaultOptions()
+	oc.Cluster.Host = "127.0.0.1"
+	oc.Cluster.Port = -1
+	oc.Cluster.Discovery = d
+	oc.Cluster.DiscoveryInterval = 50 * time.Millisecond
+	sc := RunServer(oc)
+	defer sc.Shutdown()
+
+	checkClusterFormed(t, sa, sc)
+	checkNumRoutes(t, sb, 0)
+
+	// Peers returned by later discoveries are connected to.
+	d.set(routeURL(oa.Cluster.Port), routeURL(ob.Cluster.Port))
+	checkClusterFormed(t, sa, sb, sc)
+
+	// Peers that are no longer returned are not reconnected to.
+	d.set(routeURL(oa.Cluster.Port))
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if sc.routeStillValid(routeURL(ob.Cluster.Port)) {
+			return fmt.Errorf("route to B still valid")
+		}
+		return nil
+	})
+}
+
+func TestRouteDiscoveryMaxAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	dead := routeURL(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	o := DefaultOptions()
+	o.Cluster.Host = "127.0.0.1"
+	o.Cluster.Port = -1
+	o.Cluster.Discovery = &SeedDiscovery{URLs: []*url.URL{dead}}
+	o.Cluster.DiscoveryInterval = time.Hour
+	o.Cluster.Retry = RetryPolicy{InitialDelay: 5 * time.Millisecond, MaxAttempts: 3}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	// The seed is given up after 3 attempts, until it is discovered again.
+	checkFor(t, 2*time.Second, 5*time.Millisecond, func() error {
+		if s.discoveredRoutes.contains(dead) {
+			return fmt.Errorf("seed still tried")
+		}
+		return nil
+	})
+	if urls := s.discoveredRoutes.update(clusterDiscoveryKey, []*url.URL{dead}); len(urls) != 1 {
+		t.Fatalf("Expected seed to be new when discovered again, got %v", urls)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	var p RetryPolicy
+	if d := p.delay(5); d != routeConnectDelay {
+		t.Fatalf("Expected default delay %v, got %v", routeConnectDelay, d)
+	}
+
+	p = RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for _, test := range []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{1000, time.Second},
+	} {
+		if d := p.delay(test.attempts); d != test.expected {
+			t.Fatalf("Expected delay %v after %d attempts, got %v", test.expected, test.attempts, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.delay(2); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("Delay %v out of the jitter range", d)
+		}
+	}
+}
+
+func TestRouteDiscoveryConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		cluster {
+			port: -1
+			discovery {
+				seeds: ["nats://127.0.0.1:1234", "nats://127.0.0.1:1235"]
+				interval: "10s"
+			}
+			retry {
+				initial_delay: "100ms"
+				max_delay: "5s"
+				jitter: 0.2
+				max_attempts: 10
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sd, ok := opts.Cluster.Discovery.(*SeedDiscovery)
+	if !ok || len(sd.URLs) != 2 || sd.URLs[1].Host != "127.0.0.1:1235" {
+		t.Fatalf("Unexpected discovery: %+v", opts.Cluster.Discovery)
+	}
+	if opts.Cluster.DiscoveryInterval != 10*time.Second {
+		t.Fatalf("Unexpected discovery interval: %v", opts.Cluster.DiscoveryInterval)
+	}
+	expected := RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second, Jitter: 0.2, MaxAttempts: 10}
+	if opts.Cluster.Retry != expected {
+		t.Fatalf("Expected retry policy %+v, got %+v", expected, opts.Cluster.Retry)
+	}
+
+	for _, test := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"bad jitter", `cluster: {port: -1, retry: {jitter: 2}}`, "jitter must be between 0 and 1"},
+		{"bad delays", `cluster: {port: -1, retry: {initial_delay: "2s", max_delay: "1s"}}`, "can not be greater than max delay"},
+		{"unknown field", `cluster: {port: -1, discovery: {consul: true}}`, `unknown field "consul"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.conf))
+			defer os.Remove(conf)
+			if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
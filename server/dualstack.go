@@ -0,0 +1,175 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IP families that can be preferred when dialing routes.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// Removes the brackets around an IPv6 host, since hosts are
+// always joined with their port using net.JoinHostPort.
+func trimIPv6Brackets(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+func parseFamily(v string) (string, error) {
+	switch f := strings.ToLower(v); f {
+	case FamilyIPv4, FamilyIPv6:
+		return f, nil
+	}
+	return _EMPTY_, fmt.Errorf("invalid IP family %q, expected %q or %q", v, FamilyIPv4, FamilyIPv6)
+}
+
+// natsListen listens on host:port and, if hostV6 is set, on the same port
+// of hostV6 for IPv6 connections. Connections from both are returned by
+// the listener's Accept, whose Addr is the one of host.
+func natsListen(host, hostV6 string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil || hostV6 == _EMPTY_ {
+		return l, err
+	}
+	// Use the resolved port in case a random one was requested.
+	port = l.Addr().(*net.TCPAddr).Port
+	l6, err := net.Listen("tcp6", net.JoinHostPort(hostV6, strconv.Itoa(port)))
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return newDualListener(l, l6), nil
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dualListener accepts connections from two listeners.
+type dualListener struct {
+	net.Listener
+	other  net.Listener
+	ch     chan acceptResult
+	quit   chan struct{}
+	closer sync.Once
+}
+
+func newDualListener(l, other net.Listener) *dualListener {
+	dl := &dualListener{
+		Listener: l,
+		other:    other,
+		ch:       make(chan acceptResult),
+		quit:     make(chan struct{}),
+	}
+	go dl.acceptLoop(l)
+	go dl.acceptLoop(other)
+	return dl
+}
+
+func (dl *dualListener) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case dl.ch <- acceptResult{conn, err}:
+		case <-dl.quit:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+		}
+	}
+}
+
+// Accept returns the next connection from either listener.
+func (dl *dualListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-dl.ch:
+		return r.conn, r.err
+	case <-dl.quit:
+		return nil, fmt.Errorf("accept on closed listener %s", dl.Addr())
+	}
+}
+
+// Close closes both listeners.
+func (dl *dualListener) Close() error {
+	var err error
+	dl.closer.Do(func() {
+		close(dl.quit)
+		err = dl.Listener.Close()
+		if e := dl.other.Close(); err == nil {
+			err = e
+		}
+	})
+	return err
+}
+
+// Returns true if ip belongs to the given family.
+func isIPFamily(ip net.IP, family string) bool {
+	if family == FamilyIPv4 {
+		return ip.To4() != nil
+	}
+	return ip.To4() == nil
+}
+
+// Moves the addresses of the given family first, keeping their order.
+func sortByFamily(ips []net.IPAddr, family string) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		return isIPFamily(ips[i].IP, family) && !isIPFamily(ips[j].IP, family)
+	})
+}
+
+// dialPreferFamily dials addr, trying the addresses of the preferred
+// family first when the host resolves to several addresses.
+func dialPreferFamily(addr, family string, timeout time.Duration) (net.Conn, error) {
+	if family == _EMPTY_ {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	sortByFamily(ips, family)
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), timeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
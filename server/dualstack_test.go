@@ -0,0 +1,182 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func skipIfNoIPv6Loopback(t *testing.T) {
+	t.Helper()
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	l.Close()
+}
+
+func TestDualStackListeners(t *testing.T) {
+	skipIfNoIPv6Loopback(t)
+
+	oa := DefaultOptions()
+	oa.HostV6 = "::1"
+	oa.Cluster.Host = "127.0.0.1"
+	oa.Cluster.HostV6 = "::1"
+	oa.Cluster.Port = -1
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	port := strconv.Itoa(oa.Port)
+	expected := []string{net.JoinHostPort("127.0.0.1", port), net.JoinHostPort("::1", port)}
+	sa.mu.Lock()
+	urls := sa.getClientConnectURLs()
+	sa.mu.Unlock()
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("Expected connect URLs %v, got %v", expected, urls)
+	}
+
+	// Clients can connect over both families.
+	for _, u := range []string{sa.ClientURL(), "nats://" + expected[1]} {
+		nc := natsConnect(t, u)
+		nc.Close()
+	}
+
+	// A route over IPv6 only.
+	ob := DefaultOptions()
+	ob.Host = "::1"
+	ob.Cluster.Host = "::1"
+	ob.Cluster.Port = -1
+	ob.Routes = RoutesFromStr(fmt.Sprintf("nats://[::1]:%d", oa.Cluster.Port))
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+	checkClusterFormed(t, sa, sb)
+
+	if u := sb.ClientURL(); u != fmt.Sprintf("nats://[::1]:%d", ob.Port) {
+		t.Fatalf("Unexpected client URL: %q", u)
+	}
+
+	// Closing the listener stops both families.
+	sa.Shutdown()
+	if _, err := net.DialTimeout("tcp", expected[1], 250*time.Millisecond); err == nil {
+		t.Fatal("Expected IPv6 listener to be closed")
+	}
+}
+
+func TestDualStackPreferFamily(t *testing.T) {
+	skipIfNoIPv6Loopback(t)
+
+	l, err := natsListen("127.0.0.1", "::1", 0)
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	for _, test := range []struct {
+		family string
+		addr   string
+		isV6   bool
+	}{
+		{_EMPTY_, net.JoinHostPort("::1", port), true},
+		{FamilyIPv4, net.JoinHostPort("127.0.0.1", port), false},
+		{FamilyIPv6, net.JoinHostPort("::1", port), true},
+	} {
+		conn, err := dialPreferFamily(test.addr, test.family, time.Second)
+		if err != nil {
+			t.Fatalf("Error dialing %q: %v", test.addr, err)
+		}
+		ip := conn.RemoteAddr().(*net.TCPAddr).IP
+		conn.Close()
+		if isIPFamily(ip, FamilyIPv6) != test.isV6 {
+			t.Fatalf("Unexpected remote address %v for %q", ip, test.addr)
+		}
+	}
+
+	// Addresses of the preferred family are tried first.
+	for _, test := range []struct {
+		family   string
+		expected string
+	}{
+		{FamilyIPv4, "127.0.0.1 10.0.0.1 ::1 fd00::1"},
+		{FamilyIPv6, "::1 fd00::1 127.0.0.1 10.0.0.1"},
+	} {
+		var ips []net.IPAddr
+		for _, ip := range []string{"127.0.0.1", "::1", "10.0.0.1", "fd00::1"} {
+			ips = append(ips, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		sortByFamily(ips, test.family)
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if s := strings.Join(got, " "); s != test.expected {
+			t.Fatalf("Expected order %q for %s, got %q", test.expected, test.family, s)
+		}
+	}
+}
+
+func TestDualStackConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		host: "0.0.0.0"
+		host_v6: "[::]"
+		cluster {
+			port: -1
+			host_v6: "::"
+			prefer_family: IPv6
+		}
+		gateway {
+			name: "A"
+			port: -1
+			host_v6: "::1"
+		}
+		leafnodes {
+			port: -1
+			host_v6: "[::1]"
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.HostV6 != "::" || opts.Cluster.HostV6 != "::" || opts.Gateway.HostV6 != "::1" || opts.LeafNode.HostV6 != "::1" {
+		t.Fatalf("Unexpected IPv6 hosts: %q %q %q %q",
+			opts.HostV6, opts.Cluster.HostV6, opts.Gateway.HostV6, opts.LeafNode.HostV6)
+	}
+	if opts.Cluster.PreferFamily != FamilyIPv6 {
+		t.Fatalf("Unexpected prefer family: %q", opts.Cluster.PreferFamily)
+	}
+
+	conf = createConfFile(t, []byte(`cluster: {port: -1, prefer_family: ipv5}`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "invalid IP family") {
+		t.Fatalf("Expected invalid family error, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnEvent describes a connection passed to the lifecycle hooks.
+type ConnEvent struct {
+	Kind     string `json:"kind"`
+	CID      uint64 `json:"cid"`
+	Name     string `json:"name,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Account  string `json:"account,omitempty"`
+	User     string `json:"user,omitempty"`
+	RemoteID string `json:"remote_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Machine readable code of the reason.
+	ReasonCode string    `json:"reason_code,omitempty"`
+	Start      time.Time `json:"start"`
+}
+
+// Hooks registered by the applications embedding the server.
+type lifecycleHooks struct {
+	sync.RWMutex
+	ready              bool
+	onReady            []func()
+	onClientConnect    []func(ConnEvent)
+	onClientDisconnect []func(ConnEvent)
+	onRouteConnect     []func(ConnEvent)
+}
+
+// OnReady registers a function that is called once the server is ready
+// for connections. If the server is already ready, f is called right away.
+// The hooks are called without holding server locks and must not block.
+func (s *Server) OnReady(f func()) {
+	s.hooks.Lock()
+	ready := s.hooks.ready
+	if !ready {
+		s.hooks.onReady = append(s.hooks.onReady, f)
+	}
+	s.hooks.Unlock()
+	if ready {
+		f()
+	}
+}
+
+// OnClientConnect registers a function that is called when a client
+// connection has been authenticated and its CONNECT processed.
+func (s *Server) OnClientConnect(f func(ConnEvent)) {
+	s.hooks.Lock()
+	s.hooks.onClientConnect = append(s.hooks.onClientConnect, f)
+	s.hooks.Unlock()
+}
+
+// OnClientDisconnect registers a function that is called when a client
+// for which the connect hooks were called is closed. The event's Reason
+// is the reason of the close.
+func (s *Server) OnClientDisconnect(f func(ConnEvent)) {
+	s.hooks.Lock()
+	s.hooks.onClientDisconnect = append(s.hooks.onClientDisconnect, f)
+	s.hooks.Unlock()
+}
+
+// OnRouteConnect registers a function that is called when a route to
+// another server of the cluster is registered. The event's RemoteID is
+// the ID of the remote server.
+func (s *Server) OnRouteConnect(f func(ConnEvent)) {
+	s.hooks.Lock()
+	s.hooks.onRouteConnect = append(s.hooks.onRouteConnect, f)
+	s.hooks.Unlock()
+}
+
+// notifyReady calls the ready hooks the first time it is called with
+// all the listeners of the server started.
+func (s *Server) notifyReady() {
+	if !s.readyForConnections() {
+		return
+	}
+	s.hooks.Lock()
+	if s.hooks.ready {
+		s.hooks.Unlock()
+		return
+	}
+	s.hooks.ready = true
+	hooks := s.hooks.onReady
+	s.hooks.onReady = nil
+	s.hooks.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+}
+
+func (s *Server) runConnHooks(hooks *[]func(ConnEvent), e ConnEvent) {
+	s.hooks.RLock()
+	fs := *hooks
+	s.hooks.RUnlock()
+	for _, f := range fs {
+		f(e)
+	}
+}
+
+// Returns the event of the client connection. Lock held on entry.
+func (c *client) connEvent() ConnEvent {
+	e := ConnEvent{
+		Kind:  c.typeString(),
+		CID:   c.cid,
+		Name:  c.opts.Name,
+		Host:  c.host,
+		Port:  int(c.port),
+		User:  c.opts.Username,
+		Start: c.start,
+	}
+	if c.opts.Nkey != _EMPTY_ {
+		e.User = c.opts.Nkey
+	}
+	if c.acc != nil {
+		e.Account = c.acc.Name
+	}
+	if c.route != nil {
+		e.RemoteID = c.route.remoteID
+	}
+	return e
+}
+
+// clientConnected runs the client connect hooks and webhook, if any.
+func (s *Server) clientConnected(c *client) {
+	s.hooks.RLock()
+	none := len(s.hooks.onClientConnect) == 0 && len(s.hooks.onClientDisconnect) == 0
+	s.hooks.RUnlock()
+	if none && atomic.LoadInt32(&s.webhookOn) == 0 && s.connectionEventsSubject() == _EMPTY_ {
+		return
+	}
+	c.mu.Lock()
+	// The disconnect hooks are called only for the clients that
+	// were reported as connected.
+	c.flags.set(connectNotified)
+	e := c.connEvent()
+	c.mu.Unlock()
+	s.runConnHooks(&s.hooks.onClientConnect, e)
+	if s.webhookEnabled(WebhookClientConnect) {
+		s.queueWebhookEvent(WebhookClientConnect, e)
+	}
+	s.sendConnectionEvent(c, ConnectionEventConnect, time.Now(), 0)
+}
+
+// clientDisconnected runs the client disconnect hooks and webhook, if any.
+func (s *Server) clientDisconnected(c *client, now time.Time, reason ClosedState) {
+	c.mu.Lock()
+	if c.kind != CLIENT || !c.flags.isSet(connectNotified) {
+		c.mu.Unlock()
+		return
+	}
+	e := c.connEvent()
+	c.mu.Unlock()
+	e.Reason = reason.String()
+	e.ReasonCode = s.closedReasonCode(reason)
+	s.runConnHooks(&s.hooks.onClientDisconnect, e)
+	if s.webhookEnabled(WebhookClientDisconnect) {
+		s.queueWebhookEvent(WebhookClientDisconnect, e)
+	}
+	s.sendConnectionEvent(c, ConnectionEventDisconnect, now, reason)
+}
+
+// routeConnected runs the route connect hooks, if any.
+func (s *Server) routeConnected(c *client) {
+	c.mu.Lock()
+	e := c.connEvent()
+	c.mu.Unlock()
+	s.runConnHooks(&s.hooks.onRouteConnect, e)
+}
+
+// StartContext starts the server and waits for it to be ready for
+// connections. If ctx is done first, the server is shutdown and the
+// error of ctx is returned.
+func (s *Server) StartContext(ctx context.Context) error {
+	go s.Start()
+	for {
+		if s.readyForConnections() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.Shutdown()
+			return ctx.Err()
+		case <-time.After(25 * time.Millisecond):
+		}
+	}
+}
+
+// ShutdownContext shuts the server down, waiting at most until ctx is done
+// for the shutdown to complete. When ctx is done first, the shutdown keeps
+// going in the background and the error of ctx is returned.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OptionsBuilder builds the Options of an embedded server. The errors
+// of the builder methods are returned by Build.
+type OptionsBuilder struct {
+	opts *Options
+	errs []string
+}
+
+// NewOptionsBuilder returns a builder of empty Options.
+func NewOptionsBuilder() *OptionsBuilder {
+	return &OptionsBuilder{opts: &Options{}}
+}
+
+// WithHost sets the client listen host.
+func (b *OptionsBuilder) WithHost(host string) *OptionsBuilder {
+	b.opts.Host = host
+	return b
+}
+
+// WithPort sets the client listen port. Use -1 for a random port.
+func (b *OptionsBuilder) WithPort(port int) *OptionsBuilder {
+	b.opts.Port = port
+	return b
+}
+
+// WithServerName sets the server name.
+func (b *OptionsBuilder) WithServerName(name string) *OptionsBuilder {
+	b.opts.ServerName = name
+	return b
+}
+
+// WithAuth sets the user and password required from the clients.
+func (b *OptionsBuilder) WithAuth(user, password string) *OptionsBuilder {
+	b.opts.Username = user
+	b.opts.Password = password
+	return b
+}
+
+// WithMaxPayload sets the maximum payload of the messages.
+func (b *OptionsBuilder) WithMaxPayload(max int32) *OptionsBuilder {
+	b.opts.MaxPayload = max
+	return b
+}
+
+// WithHTTPPort sets the port of the monitoring endpoint.
+func (b *OptionsBuilder) WithHTTPPort(port int) *OptionsBuilder {
+	b.opts.HTTPPort = port
+	return b
+}
+
+// WithCluster sets the host and port to listen on for routes.
+func (b *OptionsBuilder) WithCluster(host string, port int) *OptionsBuilder {
+	b.opts.Cluster.Host = host
+	b.opts.Cluster.Port = port
+	return b
+}
+
+// WithRoutes adds the URLs of the routes to solicit.
+func (b *OptionsBuilder) WithRoutes(urls ...string) *OptionsBuilder {
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			b.errs = append(b.errs, fmt.Sprintf("invalid route url %q: %v", s, err))
+			continue
+		}
+		b.opts.Routes = append(b.opts.Routes, u)
+	}
+	return b
+}
+
+// WithLeafNode sets the host and port to listen on for leafnodes.
+func (b *OptionsBuilder) WithLeafNode(host string, port int) *OptionsBuilder {
+	b.opts.LeafNode.Host = host
+	b.opts.LeafNode.Port = port
+	return b
+}
+
+// WithLeafNodeRemote adds a leafnode remote with the given URLs.
+func (b *OptionsBuilder) WithLeafNodeRemote(urls ...string) *OptionsBuilder {
+	remote := &RemoteLeafOpts{}
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			b.errs = append(b.errs, fmt.Sprintf("invalid leafnode remote url %q: %v", s, err))
+			continue
+		}
+		remote.URLs = append(remote.URLs, u)
+	}
+	if len(remote.URLs) > 0 {
+		b.opts.LeafNode.Remotes = append(b.opts.LeafNode.Remotes, remote)
+	}
+	return b
+}
+
+// WithDebug enables the debug logs.
+func (b *OptionsBuilder) WithDebug() *OptionsBuilder {
+	b.opts.Debug = true
+	return b
+}
+
+// WithTrace enables the protocol traces.
+func (b *OptionsBuilder) WithTrace() *OptionsBuilder {
+	b.opts.Trace = true
+	return b
+}
+
+// WithLameDuckDuration sets the duration of the lame duck mode.
+func (b *OptionsBuilder) WithLameDuckDuration(d time.Duration) *OptionsBuilder {
+	b.opts.LameDuckDuration = d
+	return b
+}
+
+// Apply calls f with the options being built, for the options that
+// have no builder method.
+func (b *OptionsBuilder) Apply(f func(*Options)) *OptionsBuilder {
+	f(b.opts)
+	return b
+}
+
+// Build returns a copy of the options, or the errors of the builder
+// methods. The defaults are set by NewServer.
+func (b *OptionsBuilder) Build() (*Options, error) {
+	if len(b.errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(b.errs, "; "))
+	}
+	return b.opts.Clone(), nil
+}
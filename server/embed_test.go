@@ -0,0 +1,166 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestOptionsBuilder(t *testing.T) {
+	opts, err := NewOptionsBuilder().
+		WithHost("127.0.0.1").
+		WithPort(-1).
+		WithServerName("embedded").
+		WithAuth("user", "pwd").
+		WithMaxPayload(1024).
+		WithCluster("127.0.0.1", -1).
+		WithRoutes("nats://127.0.0.1:1234", "nats://127.0.0.1:1235").
+		WithLeafNodeRemote("nats://127.0.0.1:7422").
+		WithLameDuckDuration(time.Minute).
+		Apply(func(o *Options) { o.NoSigs = true }).
+		Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.Host != "127.0.0.1" || opts.Port != -1 || opts.ServerName != "embedded" {
+		t.Fatalf("Unexpected listen options: %+v", opts)
+	}
+	if opts.Username != "user" || opts.Password != "pwd" || opts.MaxPayload != 1024 || !opts.NoSigs {
+		t.Fatalf("Unexpected options: %+v", opts)
+	}
+	if len(opts.Routes) != 2 || opts.Routes[1].Host != "127.0.0.1:1235" {
+		t.Fatalf("Unexpected routes: %v", opts.Routes)
+	}
+	if len(opts.LeafNode.Remotes) != 1 || opts.LeafNode.Remotes[0].URLs[0].Host != "127.0.0.1:7422" {
+		t.Fatalf("Unexpected remotes: %+v", opts.LeafNode.Remotes)
+	}
+	if opts.LameDuckDuration != time.Minute {
+		t.Fatalf("Unexpected lame duck duration: %v", opts.LameDuckDuration)
+	}
+
+	_, err = NewOptionsBuilder().WithRoutes("nats://127.0.0.1:%zz").WithLeafNodeRemote(":bad").Build()
+	if err == nil || !strings.Contains(err.Error(), "invalid route url") ||
+		!strings.Contains(err.Error(), "invalid leafnode remote url") {
+		t.Fatalf("Expected both url errors, got %v", err)
+	}
+}
+
+func TestStartShutdownContext(t *testing.T) {
+	opts, err := NewOptionsBuilder().WithHost("127.0.0.1").WithPort(-1).Apply(func(o *Options) {
+		o.NoLog, o.NoSigs = true, true
+	}).Build()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	ready := make(chan struct{})
+	s.OnReady(func() { close(ready) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.StartContext(ctx); err != nil {
+		t.Fatalf("Error starting server: %v", err)
+	}
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("Ready hook not called")
+	}
+	// Ready hooks registered after the server is ready run right away.
+	called := false
+	s.OnReady(func() { called = true })
+	if !called {
+		t.Fatal("Ready hook not called for a ready server")
+	}
+
+	if err := s.ShutdownContext(ctx); err != nil {
+		t.Fatalf("Error shutting down: %v", err)
+	}
+	if s.isRunning() {
+		t.Fatal("Server still running")
+	}
+
+	// A done context stops the start.
+	s, err = NewServer(opts)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	done, cancelDone := context.WithCancel(context.Background())
+	cancelDone()
+	if err := s.StartContext(done); err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+	if s.isRunning() {
+		t.Fatal("Server still running")
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	oa := DefaultOptions()
+	oa.Cluster.Host = "127.0.0.1"
+	oa.Cluster.Port = -1
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	connects := make(chan ConnEvent, 1)
+	disconnects := make(chan ConnEvent, 1)
+	routes := make(chan ConnEvent, 1)
+	sa.OnClientConnect(func(e ConnEvent) { connects <- e })
+	sa.OnClientDisconnect(func(e ConnEvent) { disconnects <- e })
+	sa.OnRouteConnect(func(e ConnEvent) { routes <- e })
+
+	nc := natsConnect(t, fmt.Sprintf("nats://127.0.0.1:%d", oa.Port), nats.Name("hooked"))
+	var e ConnEvent
+	select {
+	case e = <-connects:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client connect hook not called")
+	}
+	if e.Kind != "Client" || e.Name != "hooked" || e.CID == 0 || e.Account != globalAccountName {
+		t.Fatalf("Unexpected connect event: %+v", e)
+	}
+	nc.Close()
+	select {
+	case e = <-disconnects:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client disconnect hook not called")
+	}
+	if e.Name != "hooked" || e.Reason != ClientClosed.String() {
+		t.Fatalf("Unexpected disconnect event: %+v", e)
+	}
+
+	ob := DefaultOptions()
+	ob.Cluster.Host = "127.0.0.1"
+	ob.Cluster.Port = -1
+	ob.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", oa.Cluster.Port))
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+	select {
+	case e = <-routes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Route connect hook not called")
+	}
+	if e.Kind != "Router" || e.RemoteID != sb.ID() {
+		t.Fatalf("Unexpected route event: %+v", e)
+	}
+}
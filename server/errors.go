@@ -34,6 +34,14 @@ var (
 	// ErrMaxPayload represents an error condition when the payload is too big.
 	ErrMaxPayload = errors.New("maximum payload exceeded")
 
+	// ErrMsgHeadersNotSupported signals the parser detected a message header
+	// but the connection has not opted in to headers or they are disabled.
+	ErrMsgHeadersNotSupported = errors.New("message headers not supported")
+
+	// ErrNoRespondersRequiresHeaders signals that a client asked for no responders
+	// status messages without also supporting headers.
+	ErrNoRespondersRequiresHeaders = errors.New("no responders requires headers support")
+
 	// ErrMaxControlLine represents an error condition when the control line is too big.
 	ErrMaxControlLine = errors.New("maximum control line exceeded")
 
@@ -54,10 +62,18 @@ var (
 	// connections.
 	ErrTooManyAccountConnections = errors.New("maximum account active connections exceeded")
 
+	// ErrClientVersionRejected signals a client that its library is older than
+	// the minimum version of its account.
+	ErrClientVersionRejected = errors.New("client library version rejected")
+
 	// ErrTooManySubs signals a client that the maximum number of subscriptions per connection
 	// has been reached.
 	ErrTooManySubs = errors.New("maximum subscriptions exceeded")
 
+	// ErrTooManyAccountSubs signals a client that the maximum number of subscriptions
+	// for its account has been reached.
+	ErrTooManyAccountSubs = errors.New("maximum account subscriptions exceeded")
+
 	// ErrClientConnectedToRoutePort represents an error condition when a client
 	// attempted to connect to the route listen port.
 	ErrClientConnectedToRoutePort = errors.New("attempted to connect to route port")
@@ -95,6 +111,9 @@ var (
 	// ErrAccountValidation is returned when an account has failed validation.
 	ErrAccountValidation = errors.New("account validation failed")
 
+	// ErrAccountRevoked is returned when an account has been revoked by the operator.
+	ErrAccountRevoked = errors.New("account revoked")
+
 	// ErrAccountExpired is returned when an account has expired.
 	ErrAccountExpired = errors.New("account expired")
 
@@ -113,6 +132,12 @@ var (
 	// ErrStreamImportBadPrefix is returned when a stream import prefix contains wildcards.
 	ErrStreamImportBadPrefix = errors.New("stream import prefix can not contain wildcard tokens")
 
+	// ErrStreamImportBadMapping is returned when a stream import has both a prefix and a subject mapping.
+	ErrStreamImportBadMapping = errors.New("stream import can not have both a prefix and a subject mapping")
+
+	// ErrBadSubjectTransform is returned when a subject mapping is not valid for its source subject.
+	ErrBadSubjectTransform = errors.New("invalid subject mapping")
+
 	// ErrStreamImportDuplicate is returned when a stream import is a duplicate of one that already exists.
 	ErrStreamImportDuplicate = errors.New("stream import already exists")
 
@@ -137,6 +162,15 @@ var (
 
 	// Used to signal an error that a server is not running.
 	ErrServerNotRunning = errors.New("server is not running")
+
+	// ErrEventNotSigned is returned when verifying a system event that has no signature.
+	ErrEventNotSigned = errors.New("system event not signed")
+
+	// ErrEventBadSignature is returned when a system event signature does not verify.
+	ErrEventBadSignature = errors.New("system event signature invalid")
+
+	// ErrEventUntrustedServer is returned when a system event is signed by a server that is not trusted.
+	ErrEventUntrustedServer = errors.New("system event from untrusted server")
 )
 
 // configErr is a configuration error.
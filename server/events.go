@@ -26,7 +26,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-server/v2/server/pse"
+	"github.com/nats-io/nkeys"
 )
 
 const (
@@ -44,6 +46,19 @@ const (
 	leafNodeConnectEventSubj = "$SYS.ACCOUNT.%s.LEAFNODE.CONNECT"
 	remoteLatencyEventSubj   = "$SYS.LATENCY.M2.%s"
 	inboxRespSubj            = "$SYS._INBOX.%s.%s"
+	permGrantReqSubj         = "$SYS.REQ.SERVER.%s.GRANT"
+	permGrantEventSubj       = "$SYS.SERVER.%s.CLIENT.GRANT"
+	connLimitsReqSubj        = "$SYS.REQ.SERVER.%s.LIMITS"
+	profileReqSubj           = "$SYS.REQ.SERVER.%s.PROFILE"
+	msgTraceReqSubj          = "$SYS.REQ.SERVER.%s.TRACE"
+	msgTracePingReqSubj      = "$SYS.REQ.SERVER.TRACE"
+	msgTraceEventSubj        = "$SYS.SERVER.%s.TRACE"
+	kickReqSubj              = "$SYS.REQ.SERVER.%s.KICK"
+	kickPingReqSubj          = "$SYS.REQ.SERVER.KICK"
+	logLevelReqSubj          = "$SYS.REQ.SERVER.%s.LOGLEVEL"
+	storezReqSubj            = "$SYS.REQ.SERVER.%s.STOREZ"
+	storezPingReqSubj        = "$SYS.REQ.SERVER.STOREZ"
+	userUpdateReqSubj        = "$SYS.REQ.USER.UPDATE"
 
 	// FIXME(dlc) - Should account scope, even with wc for now, but later on
 	// we can then shard as needed.
@@ -61,6 +76,12 @@ const (
 // FIXME(dlc) - make configurable.
 var eventsHBInterval = 30 * time.Second
 
+// Upper bound for the lifetime of a temporary permission grant.
+var maxPermGrantExpiration = time.Hour
+
+// Upper bound for how long client accepts can be paused.
+var maxAcceptsPause = time.Hour
+
 // Used to send and receive messages from inside the server.
 type internal struct {
 	account  *Account
@@ -101,6 +122,8 @@ type DisconnectEventMsg struct {
 	Sent     DataStats  `json:"sent"`
 	Received DataStats  `json:"received"`
 	Reason   string     `json:"reason"`
+	// Machine readable code of the reason.
+	ReasonCode string `json:"reason_code,omitempty"`
 }
 
 // AccountNumConns is an event that will be sent from a server that is tracking
@@ -121,15 +144,66 @@ type accNumConnsReq struct {
 	Account string     `json:"acc"`
 }
 
+// PermissionGrant is a request to temporarily extend the permissions of
+// a client connection. The grant is revoked automatically when it expires.
+// A request with no subjects revokes any existing grant.
+type PermissionGrant struct {
+	CID       uint64        `json:"cid"`
+	Publish   []string      `json:"publish,omitempty"`
+	Subscribe []string      `json:"subscribe,omitempty"`
+	Expires   time.Duration `json:"expires,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+}
+
+// PermissionGrantResponse is sent back in response to a PermissionGrant.
+type PermissionGrantResponse struct {
+	Server  ServerInfo `json:"server"`
+	CID     uint64     `json:"cid"`
+	Expires time.Time  `json:"expires,omitempty"`
+	Revoked bool       `json:"revoked,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// PermissionGrantEventMsg is sent when a temporary permission grant is
+// given to or revoked from a client connection.
+type PermissionGrantEventMsg struct {
+	Server  ServerInfo       `json:"server"`
+	Client  ClientInfo       `json:"client"`
+	Grant   *PermissionGrant `json:"grant,omitempty"`
+	Revoked bool             `json:"revoked,omitempty"`
+}
+
+// ConnectionLimits is a request to adjust connection limits at runtime.
+// A positive MaxConnections overrides the configured max_connections and a
+// negative one restores it. Account limits of -1 mean no limit. An empty
+// request returns the current limits.
+type ConnectionLimits struct {
+	MaxConnections int            `json:"max_connections,omitempty"`
+	Accounts       map[string]int `json:"accounts,omitempty"`
+	PauseAccepts   time.Duration  `json:"pause_accepts,omitempty"`
+	ResumeAccepts  bool           `json:"resume_accepts,omitempty"`
+}
+
+// ConnectionLimitsResponse is sent back in response to ConnectionLimits.
+type ConnectionLimitsResponse struct {
+	Server         ServerInfo     `json:"server"`
+	MaxConnections int            `json:"max_connections"`
+	Accounts       map[string]int `json:"accounts,omitempty"`
+	PausedUntil    time.Time      `json:"paused_until,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
 // ServerInfo identifies remote servers.
 type ServerInfo struct {
-	Name    string    `json:"name"`
-	Host    string    `json:"host"`
-	ID      string    `json:"id"`
-	Cluster string    `json:"cluster,omitempty"`
-	Version string    `json:"ver"`
-	Seq     uint64    `json:"seq"`
-	Time    time.Time `json:"time"`
+	Name    string            `json:"name"`
+	Host    string            `json:"host"`
+	ID      string            `json:"id"`
+	Cluster string            `json:"cluster,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Version string            `json:"ver"`
+	Seq     uint64            `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Sig     string            `json:"sig,omitempty"`
 }
 
 // ClientInfo is detailed information about the client forming a connection.
@@ -220,10 +294,13 @@ func (s *Server) internalSendLoop(wg *sync.WaitGroup) {
 	host := s.info.Host
 	servername := s.info.Name
 	seqp := &s.sys.seq
-	var cluster string
-	if s.gateway.enabled {
-		cluster = s.getGatewayName()
+	// Sign events if the server has been given an identity.
+	var kp nkeys.KeyPair
+	if s.signEvents() {
+		kp = s.kp
 	}
+	cluster := s.clusterName()
+	tags := s.info.Tags
 	s.mu.Unlock()
 
 	// Warn when internal send queue is backed up past 75%
@@ -244,6 +321,7 @@ func (s *Server) internalSendLoop(wg *sync.WaitGroup) {
 				pm.si.Name = servername
 				pm.si.Host = host
 				pm.si.Cluster = cluster
+				pm.si.Tags = tags
 				pm.si.ID = id
 				pm.si.Seq = atomic.AddUint64(seqp, 1)
 				pm.si.Version = VERSION
@@ -251,7 +329,11 @@ func (s *Server) internalSendLoop(wg *sync.WaitGroup) {
 			}
 			var b []byte
 			if pm.msg != nil {
-				b, _ = json.MarshalIndent(pm.msg, _EMPTY_, "  ")
+				if kp != nil && pm.si != nil {
+					b = signServerEvent(kp, pm.msg, pm.si)
+				} else {
+					b, _ = json.MarshalIndent(pm.msg, _EMPTY_, "  ")
+				}
 			}
 			c.mu.Lock()
 			// We can have an override for account here.
@@ -310,11 +392,17 @@ func (s *Server) sendShutdownEvent() {
 	s.sys.replies = nil
 	s.mu.Unlock()
 	// Send to the internal queue and mark as last.
-	sendq <- &pubMsg{nil, subj, _EMPTY_, nil, nil, true}
+	si := &ServerInfo{}
+	sendq <- &pubMsg{nil, subj, _EMPTY_, si, si, true}
 }
 
 // Used to send an internal message to an arbitrary account.
 func (s *Server) sendInternalAccountMsg(a *Account, subject string, msg interface{}) error {
+	return s.sendInternalAccountRequest(a, subject, _EMPTY_, msg)
+}
+
+// Queue up a message with a reply subject to be sent in the account a.
+func (s *Server) sendInternalAccountRequest(a *Account, subject, reply string, msg interface{}) error {
 	s.mu.Lock()
 	if s.sys == nil || s.sys.sendq == nil {
 		s.mu.Unlock()
@@ -323,7 +411,7 @@ func (s *Server) sendInternalAccountMsg(a *Account, subject string, msg interfac
 	sendq := s.sys.sendq
 	// Don't hold lock while placing on the channel.
 	s.mu.Unlock()
-	sendq <- &pubMsg{a, subject, "", nil, msg, false}
+	sendq <- &pubMsg{a, subject, reply, nil, msg, false}
 	return nil
 }
 
@@ -557,6 +645,20 @@ func (s *Server) initEventTracking() {
 	if _, err := s.sysSubscribe(subject, s.accountClaimUpdate); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
+	// Listen for requests to create, update and delete accounts.
+	if _, err := s.sysSubscribe(accCreateReqSubj, s.accountCreateReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	if _, err := s.sysSubscribe(accUpdateReqSubj, s.accountUpdateReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	if _, err := s.sysSubscribe(accDeleteReqSubj, s.accountDeleteReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for user JWT updates to apply to existing connections.
+	if _, err := s.sysSubscribe(userUpdateReqSubj, s.userUpdateReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	// Listen for requests for our statsz.
 	subject = fmt.Sprintf(serverStatsReqSubj, s.info.ID)
 	if _, err := s.sysSubscribe(subject, s.statszReq); err != nil {
@@ -572,6 +674,50 @@ func (s *Server) initEventTracking() {
 	if _, err := s.sysSubscribe(subject, s.leafNodeConnected); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
+	// Listen for requests to temporarily grant permissions to our clients.
+	subject = fmt.Sprintf(permGrantReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.permissionGrantReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to adjust connection limits.
+	subject = fmt.Sprintf(connLimitsReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.connLimitsReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to write profiles.
+	subject = fmt.Sprintf(profileReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.profileReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to trace messages, for this server or all of them.
+	subject = fmt.Sprintf(msgTraceReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.msgTraceReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	if _, err := s.sysSubscribe(msgTracePingReqSubj, s.msgTraceReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to close client connections, for this server or all of them.
+	subject = fmt.Sprintf(kickReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.kickReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	if _, err := s.sysSubscribe(kickPingReqSubj, s.kickReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to raise the log level of accounts or connections.
+	subject = fmt.Sprintf(logLevelReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.logLevelReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests for the usage of our stores, or of all of them.
+	subject = fmt.Sprintf(storezReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.storezReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	if _, err := s.sysSubscribe(storezPingReqSubj, s.storezReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	// For tracking remote latency measurements.
 	subject = fmt.Sprintf(remoteLatencyEventSubj, s.sys.shash)
 	if _, err := s.sysSubscribe(subject, s.remoteLatencyUpdate); err != nil {
@@ -600,6 +746,14 @@ func (s *Server) accountClaimUpdate(sub *subscription, _ *client, subject, reply
 		s.Debugf("Received account claims update on bad subject %q", subject)
 		return
 	}
+	// The claims must be issued for that account by a trusted operator.
+	name := toks[accUpdateAccIndex]
+	claims, err := jwt.DecodeAccountClaims(string(msg))
+	if err != nil || claims.Subject != name || !s.isTrustedIssuer(claims.Issuer) {
+		s.Errorf("Dropping claims update for account %q: invalid or untrusted claims", name)
+		return
+	}
+	s.proposeAccountClaims(toks[accUpdateAccIndex], string(msg))
 	if v, ok := s.accounts.Load(toks[accUpdateAccIndex]); ok {
 		s.updateAccountWithClaimJWT(v.(*Account), string(msg))
 	}
@@ -628,6 +782,21 @@ func (s *Server) remoteServerShutdown(sub *subscription, _ *client, subject, rep
 		return
 	}
 	sid := toks[serverSubjectIndex]
+	// The event is the server information of the server shutting down.
+	var si ServerInfo
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, &si); err != nil {
+			s.Debugf("Received bad remote server shutdown message: %v", err)
+			return
+		}
+	}
+	if s.signEvents() && si.ID != sid {
+		s.Errorf("Dropping shutdown event of server %q sent by server %q", sid, si.ID)
+		return
+	}
+	if !s.checkServerEventSig(msg, &si) {
+		return
+	}
 	su := s.sys.servers[sid]
 	if su != nil {
 		s.processRemoteServerShutdown(sid)
@@ -719,6 +888,9 @@ func (s *Server) connsRequest(sub *subscription, _ *client, subject, reply strin
 		s.sys.client.Errorf("Error unmarshalling account connections request message: %v", err)
 		return
 	}
+	if !s.checkServerEventSig(msg, &m.Server) {
+		return
+	}
 	// Here we really only want to lookup the account if its local. We do not want to fetch this
 	// account if we have no interest in it.
 	var acc *Account
@@ -743,6 +915,9 @@ func (s *Server) leafNodeConnected(sub *subscription, _ *client, subject, reply
 		s.sys.client.Errorf("Error unmarshalling account connections request message: %v", err)
 		return
 	}
+	if !s.checkServerEventSig(msg, &m.Server) {
+		return
+	}
 
 	s.mu.Lock()
 	na := m.Account == "" || !s.eventsEnabled() || !s.gateway.enabled
@@ -767,6 +942,144 @@ func (s *Server) statszReq(sub *subscription, _ *client, subject, reply string,
 	s.sendStatsz(reply)
 }
 
+// permissionGrantReq is a request to give or revoke temporary permissions
+// for one of our client connections.
+func (s *Server) permissionGrantReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var req PermissionGrant
+	var resp PermissionGrantResponse
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = fmt.Sprintf("error unmarshalling request: %v", err)
+	} else {
+		resp.CID = req.CID
+		s.mu.Lock()
+		c := s.clients[req.CID]
+		s.mu.Unlock()
+		switch {
+		case c == nil:
+			resp.Error = fmt.Sprintf("client %d not found", req.CID)
+		case len(req.Publish) == 0 && len(req.Subscribe) == 0:
+			resp.Revoked = c.revokePermissionGrant(nil)
+		case req.Expires <= 0 || req.Expires > maxPermGrantExpiration:
+			resp.Error = fmt.Sprintf("expiration must be greater than 0 and at most %v", maxPermGrantExpiration)
+		default:
+			if err := c.setPermissionGrant(req.Publish, req.Subscribe, req.Expires); err != nil {
+				resp.Error = err.Error()
+				break
+			}
+			resp.Expires = time.Now().Add(req.Expires).UTC()
+			c.mu.Lock()
+			user := c.getAuthUser()
+			c.mu.Unlock()
+			s.Noticef("Granted temporary permissions to %s (cid %d) for %v, publish: %q, subscribe: %q, reason: %q",
+				user, c.cid, req.Expires, req.Publish, req.Subscribe, req.Reason)
+			s.sendPermissionGrantEvent(c, &req)
+		}
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, &resp)
+	}
+}
+
+// sendPermissionGrantEvent will send an event when a temporary grant is given
+// to a client, or revoked if the grant is nil.
+func (s *Server) sendPermissionGrantEvent(c *client, g *PermissionGrant) {
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	m := PermissionGrantEventMsg{
+		Client: ClientInfo{
+			Start:   c.start,
+			Host:    c.host,
+			ID:      c.cid,
+			Account: accForClient(c),
+			User:    nameForClient(c),
+			Name:    c.opts.Name,
+			Lang:    c.opts.Lang,
+			Version: c.opts.Version,
+		},
+		Grant:   g,
+		Revoked: g == nil,
+	}
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	subj := fmt.Sprintf(permGrantEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, &m)
+	s.mu.Unlock()
+}
+
+// connLimitsReq is a request to adjust our connection limits or to pause
+// accepting new client connections.
+func (s *Server) connLimitsReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var req ConnectionLimits
+	var resp ConnectionLimitsResponse
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = fmt.Sprintf("error unmarshalling request: %v", err)
+		}
+	}
+	// Validate everything first so that we do not apply partial requests.
+	accs := make(map[*Account]int, len(req.Accounts))
+	if resp.Error == _EMPTY_ {
+		for name, max := range req.Accounts {
+			acc, err := s.lookupAccount(name)
+			if err != nil {
+				resp.Error = fmt.Sprintf("account %q not found", name)
+				break
+			}
+			if max < jwt.NoLimit {
+				resp.Error = fmt.Sprintf("invalid connection limit %d for account %q", max, name)
+				break
+			}
+			accs[acc] = max
+		}
+	}
+	if resp.Error == _EMPTY_ && (req.PauseAccepts < 0 || req.PauseAccepts > maxAcceptsPause) {
+		resp.Error = fmt.Sprintf("pause must be greater than 0 and at most %v", maxAcceptsPause)
+	}
+	if resp.Error == _EMPTY_ {
+		if req.MaxConnections != 0 {
+			s.setMaxConnections(req.MaxConnections)
+		}
+		for acc, max := range accs {
+			acc.setMaxConnections(max)
+			s.Noticef("Connection limit for account %q set to %d", acc.Name, max)
+		}
+		switch {
+		case req.ResumeAccepts:
+			s.pauseAccepts(0)
+		case req.PauseAccepts > 0:
+			s.pauseAccepts(req.PauseAccepts)
+		}
+		if len(accs) > 0 {
+			resp.Accounts = make(map[string]int, len(accs))
+			for acc := range accs {
+				resp.Accounts[acc.Name] = acc.MaxActiveConnections()
+			}
+		}
+	}
+	s.mu.Lock()
+	resp.MaxConnections = s.maxConnections()
+	if time.Now().Before(s.connLimits.paused) {
+		resp.PausedUntil = s.connLimits.paused.UTC()
+	}
+	s.mu.Unlock()
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, &resp)
+	}
+}
+
 // remoteConnsUpdate gets called when we receive a remote update from another server.
 func (s *Server) remoteConnsUpdate(sub *subscription, _ *client, subject, reply string, msg []byte) {
 	if !s.eventsRunning() {
@@ -777,6 +1090,9 @@ func (s *Server) remoteConnsUpdate(sub *subscription, _ *client, subject, reply
 		s.sys.client.Errorf("Error unmarshalling account connection event message: %v", err)
 		return
 	}
+	if !s.checkServerEventSig(msg, &m.Server) {
+		return
+	}
 
 	// See if we have the account registered, if not drop it.
 	// Make sure this does not force us to load this account here.
@@ -790,20 +1106,27 @@ func (s *Server) remoteConnsUpdate(sub *subscription, _ *client, subject, reply
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	// check again here if we have been shutdown.
 	if !s.running || !s.eventsEnabled() {
+		s.mu.Unlock()
 		return
 	}
 	// Double check that this is not us, should never happen, so error if it does.
 	if m.Server.ID == s.info.ID {
 		s.sys.client.Errorf("Processing our own account connection event message: ignored")
+		s.mu.Unlock()
 		return
 	}
 	// If we are here we have interest in tracking this account. Update our accounting.
-	acc.updateRemoteServer(&m)
+	clients := acc.updateRemoteServer(&m)
 	s.updateRemoteServer(&m.Server)
+	s.mu.Unlock()
+
+	// Connections accepted concurrently on several servers can put the
+	// account over its limit, the newest ones are closed.
+	for _, c := range clients {
+		c.maxAccountConnExceeded()
+	}
 }
 
 // Setup tracking for this account. This allows us to track global account activity.
@@ -931,7 +1254,7 @@ func (s *Server) accountConnectEvent(c *client) {
 
 // accountDisconnectEvent will send an account client disconnect event if there is interest.
 // This is a billing event.
-func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string) {
+func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason ClosedState) {
 	s.mu.Lock()
 	gacc := s.gacc
 	if !s.eventsEnabled() {
@@ -969,9 +1292,10 @@ func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string)
 			Msgs:  c.outMsgs,
 			Bytes: c.outBytes,
 		},
-		Reason: reason,
+		Reason: reason.String(),
 	}
 	c.mu.Unlock()
+	m.ReasonCode = s.closedReasonCode(reason)
 
 	subj := fmt.Sprintf(disconnectEventSubj, c.acc.Name)
 	s.sendInternalMsgLocked(subj, _EMPTY_, &m.Server, &m)
@@ -1007,7 +1331,8 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 			Msgs:  c.outMsgs,
 			Bytes: c.outBytes,
 		},
-		Reason: AuthenticationViolation.String(),
+		Reason:     AuthenticationViolation.String(),
+		ReasonCode: AuthenticationViolation.Code(),
 	}
 	c.mu.Unlock()
 
@@ -1068,6 +1393,53 @@ func (s *Server) systemSubscribe(subject string, internalOnly bool, cb msgHandle
 	return c.processSub(arg, internalOnly)
 }
 
+// Create an internal subscription in the account acc, handled by cb, with
+// a client of its own. The interest is not forwarded.
+func (s *Server) accountSubscribeInternal(acc *Account, subject string, cb msgHandler) (*client, *subscription, error) {
+	return s.subscribeInAccount(acc, subject, true, cb)
+}
+
+// Create an internal subscription in the account acc, handled by cb, with
+// a client of its own. The interest is forwarded to the other servers.
+func (s *Server) accountSubscribe(acc *Account, subject string, cb msgHandler) (*client, *subscription, error) {
+	return s.subscribeInAccount(acc, subject, false, cb)
+}
+
+func (s *Server) subscribeInAccount(acc *Account, subject string, internalOnly bool, cb msgHandler) (*client, *subscription, error) {
+	now := time.Now()
+	c := &client{srv: s, acc: acc, kind: SYSTEM, opts: internalOpts, msubs: -1, mpay: -1, start: now, last: now}
+	c.initClient()
+
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return nil, nil, ErrNoSysAccount
+	}
+	sid := strconv.FormatInt(int64(s.sys.sid), 10)
+	s.sys.subs[sid] = cb
+	s.sys.sid++
+	s.mu.Unlock()
+
+	sub, err := c.processSub([]byte(subject+" "+sid), internalOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, sub, nil
+}
+
+// Remove an internal subscription created with accountSubscribeInternal.
+// If acc is nil, only the handler is removed.
+func (s *Server) accountUnsubscribeInternal(acc *Account, c *client, sub *subscription) {
+	s.mu.Lock()
+	if s.sys != nil && s.sys.subs != nil {
+		delete(s.sys.subs, string(sub.sid))
+	}
+	s.mu.Unlock()
+	if acc != nil {
+		c.unsubscribe(acc, sub, true, true)
+	}
+}
+
 func (s *Server) sysUnsubscribe(sub *subscription) {
 	if sub == nil || !s.eventsEnabled() {
 		return
@@ -1100,6 +1472,9 @@ func (s *Server) remoteLatencyUpdate(sub *subscription, _ *client, subject, _ st
 		s.Errorf("Error unmarshalling remot elatency measurement: %v", err)
 		return
 	}
+	if !s.checkServerEventSig(msg, &rl.Server) {
+		return
+	}
 	// Now we need to look up the responseServiceImport associated with this measurement.
 	acc, err := s.LookupAccount(rl.Account)
 	if err != nil {
@@ -1360,6 +1735,80 @@ func (s *Server) nsubsRequest(sub *subscription, _ *client, subject, reply strin
 	s.sendInternalMsgLocked(reply, _EMPTY_, nil, nsubs)
 }
 
+// Value of the signature field of a server event while it is signed.
+const serverEventSigMask = "*"
+
+// Returns the signature field of a server event as encoded in the payload.
+func serverEventSigField(sig string) []byte {
+	return []byte(`"sig": "` + sig + `"`)
+}
+
+// signServerEvent encodes msg, si being the event's server information, and
+// signs the encoded bytes with the server key. The signature covers the
+// payload as sent, with the signature itself masked, see VerifyServerEvent().
+func signServerEvent(kp nkeys.KeyPair, msg interface{}, si *ServerInfo) []byte {
+	si.Sig = serverEventSigMask
+	b, _ := json.MarshalIndent(msg, _EMPTY_, "  ")
+	sig, err := kp.Sign(b)
+	if err != nil {
+		si.Sig = _EMPTY_
+		b, _ = json.MarshalIndent(msg, _EMPTY_, "  ")
+		return b
+	}
+	si.Sig = base64.RawURLEncoding.EncodeToString(sig)
+	return bytes.Replace(b, serverEventSigField(serverEventSigMask), serverEventSigField(si.Sig), 1)
+}
+
+// VerifyServerEvent checks the signature of the raw system event msg, si
+// being the event's server information decoded from msg. The signature is
+// verified over msg with the signature value masked, against the server ID,
+// which is the server's public nkey, so callers must also check that the
+// server ID is trusted.
+func VerifyServerEvent(msg []byte, si *ServerInfo) error {
+	if si == nil || si.Sig == _EMPTY_ {
+		return ErrEventNotSigned
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(si.Sig)
+	if err != nil {
+		return ErrEventBadSignature
+	}
+	pub, err := nkeys.FromPublicKey(si.ID)
+	if err != nil {
+		return ErrEventBadSignature
+	}
+	field := serverEventSigField(si.Sig)
+	if bytes.Count(msg, field) != 1 {
+		return ErrEventBadSignature
+	}
+	b := bytes.Replace(msg, field, serverEventSigField(serverEventSigMask), 1)
+	if err := pub.Verify(b, sig); err != nil {
+		return ErrEventBadSignature
+	}
+	return nil
+}
+
+// Returns false if the remote event has to be dropped. When our events are
+// signed, the events of other servers must be signed too, by one of the
+// trusted server keys.
+func (s *Server) checkServerEventSig(msg []byte, si *ServerInfo) bool {
+	if !s.signEvents() {
+		return true
+	}
+	err := ErrEventNotSigned
+	if si.Sig != _EMPTY_ {
+		if _, ok := s.trustedServerKeys[si.ID]; !ok {
+			err = ErrEventUntrustedServer
+		} else {
+			err = VerifyServerEvent(msg, si)
+		}
+	}
+	if err != nil {
+		s.Errorf("Dropping system event from server %q: %v", si.ID, err)
+		return false
+	}
+	return true
+}
+
 // Helper to grab name for a client.
 func nameForClient(c *client) string {
 	if c.user != nil {
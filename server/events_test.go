@@ -1224,7 +1224,7 @@ func TestSystemAccountWithGateways(t *testing.T) {
 
 	// If this tests fails with wrong number after 10 seconds we may have
 	// added a new inititial subscription for the eventing system.
-	checkExpectedSubs(t, 13, sa)
+	checkExpectedSubs(t, 27, sa)
 
 	// Create a client on B and see if we receive the event
 	urlb := fmt.Sprintf("nats://%s:%d", ob.Host, ob.Port)
@@ -1535,3 +1535,959 @@ func TestConnectionUpdatesTimerProperlySet(t *testing.T) {
 		return nil
 	})
 }
+
+func TestServerEventsSignedWithServerKey(t *testing.T) {
+	skp, _ := nkeys.CreateServer()
+	spub, _ := skp.PublicKey()
+	seed, _ := skp.Seed()
+	keyFile := createConfFile(t, []byte(fmt.Sprintf("# Server identity\n%s\n", seed)))
+	defer os.Remove(keyFile)
+
+	kp, _ := nkeys.FromSeed(oSeed)
+	pub, _ := kp.PublicKey()
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, _ := nac.Encode(kp)
+	mr := &MemAccResolver{}
+	mr.Store(apub, ajwt)
+
+	opts := DefaultOptions()
+	opts.TrustedKeys = []string{pub}
+	opts.AccountResolver = mr
+	opts.SystemAccount = apub
+	opts.ServerKeyFile = keyFile
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	if s.ID() != spub {
+		t.Fatalf("Expected server ID to be %q, got %q", spub, s.ID())
+	}
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port), createUserCreds(t, s, akp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	msg, err := nc.Request(fmt.Sprintf(serverStatsReqSubj, s.ID()), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Error trying to request statsz: %v", err)
+	}
+	m := ServerStatsMsg{}
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		t.Fatalf("Error unmarshalling the statz json: %v", err)
+	}
+	if m.Server.Sig == _EMPTY_ {
+		t.Fatal("Expected event to be signed")
+	}
+	if err := VerifyServerEvent(msg.Data, &m.Server); err != nil {
+		t.Fatalf("Expected signature to verify, got %v", err)
+	}
+	// The signature covers the bytes that were sent, so a receiver that
+	// does not know all the fields of the event can still verify it.
+	var partial struct {
+		Server ServerInfo `json:"server"`
+	}
+	if err := json.Unmarshal(msg.Data, &partial); err != nil {
+		t.Fatalf("Error unmarshalling the statz json: %v", err)
+	}
+	if err := VerifyServerEvent(msg.Data, &partial.Server); err != nil {
+		t.Fatalf("Expected signature to verify, got %v", err)
+	}
+	// Tamper with the event, verification should fail.
+	tampered := bytes.Replace(msg.Data, []byte(`"connections": `), []byte(`"connections": 1`), 1)
+	if err := VerifyServerEvent(tampered, &m.Server); err != ErrEventBadSignature {
+		t.Fatalf("Expected %v, got %v", ErrEventBadSignature, err)
+	}
+	m.Server.Sig = _EMPTY_
+	if err := VerifyServerEvent(msg.Data, &m.Server); err != ErrEventNotSigned {
+		t.Fatalf("Expected %v, got %v", ErrEventNotSigned, err)
+	}
+}
+
+func TestServerEventsFromUntrustedServersDropped(t *testing.T) {
+	skp, _ := nkeys.CreateServer()
+	seed, _ := skp.Seed()
+	keyFile := createConfFile(t, seed)
+	defer os.Remove(keyFile)
+	tkp, _ := nkeys.CreateServer()
+	tpub, _ := tkp.PublicKey()
+
+	opts := DefaultOptions()
+	opts.ServerKeyFile = keyFile
+	opts.TrustedServerKeys = []string{tpub}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	event := func(kp nkeys.KeyPair, id string) ([]byte, *ServerInfo) {
+		m := &ServerStatsMsg{Server: ServerInfo{ID: id, Seq: 1}}
+		if kp != nil {
+			return signServerEvent(kp, m, &m.Server), &m.Server
+		}
+		b, _ := json.MarshalIndent(m, _EMPTY_, "  ")
+		return b, &m.Server
+	}
+	if b, si := event(tkp, tpub); !s.checkServerEventSig(b, si) {
+		t.Fatal("Expected the event of a trusted server to be accepted")
+	}
+	// An untrusted server signing with its own key.
+	fkp, _ := nkeys.CreateServer()
+	fpub, _ := fkp.PublicKey()
+	if b, si := event(fkp, fpub); s.checkServerEventSig(b, si) {
+		t.Fatal("Expected the forged event to be dropped")
+	}
+	// An untrusted server claiming the ID of a trusted one.
+	if b, si := event(fkp, tpub); s.checkServerEventSig(b, si) {
+		t.Fatal("Expected the forged event to be dropped")
+	}
+	if b, si := event(nil, tpub); s.checkServerEventSig(b, si) {
+		t.Fatal("Expected the unsigned event to be dropped")
+	}
+	// A second signature field cannot be used to move the signed one.
+	if b, si := event(tkp, tpub); s.checkServerEventSig(append(b, serverEventSigField(si.Sig)...), si) {
+		t.Fatal("Expected the event with a duplicated signature to be dropped")
+	}
+
+	opts = DefaultOptions()
+	opts.TrustedServerKeys = []string{tpub}
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "requires server_key_file") {
+		t.Fatalf("Expected error about missing server key file, got %v", err)
+	}
+	opts.ServerKeyFile = keyFile
+	opts.TrustedServerKeys = []string{fpub[1:]}
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "not a valid public server nkey") {
+		t.Fatalf("Expected error about invalid key, got %v", err)
+	}
+}
+
+func TestServerEventsRemoteShutdownVerified(t *testing.T) {
+	skp, _ := nkeys.CreateServer()
+	seed, _ := skp.Seed()
+	keyFile := createConfFile(t, seed)
+	defer os.Remove(keyFile)
+	tkp, _ := nkeys.CreateServer()
+	tpub, _ := tkp.PublicKey()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		server_key_file: "%s"
+		trusted_server_keys: ["%s"]
+		accounts { SYS {}, APP {} }
+		system_account: SYS
+	`, keyFile, tpub)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("APP")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	s.mu.Lock()
+	s.sys.servers[tpub] = &serverUpdate{1, time.Now()}
+	s.mu.Unlock()
+	acc.updateRemoteServer(&AccountNumConns{Server: ServerInfo{ID: tpub}, Conns: 1})
+	remoteConns := func() int32 {
+		acc.mu.RLock()
+		defer acc.mu.RUnlock()
+		return acc.nrclients
+	}
+
+	subj := fmt.Sprintf(shutdownEventSubj, tpub)
+	// Forged shutdown events of a known server are dropped.
+	s.remoteServerShutdown(nil, nil, subj, _EMPTY_, nil)
+	fkp, _ := nkeys.CreateServer()
+	forged := &ServerInfo{ID: tpub}
+	s.remoteServerShutdown(nil, nil, subj, _EMPTY_, signServerEvent(fkp, forged, forged))
+	if n := remoteConns(); n != 1 {
+		t.Fatalf("Expected the remote connection to still be tracked, got %v", n)
+	}
+	si := &ServerInfo{ID: tpub}
+	s.remoteServerShutdown(nil, nil, subj, _EMPTY_, signServerEvent(tkp, si, si))
+	if n := remoteConns(); n != 0 {
+		t.Fatalf("Expected the remote connection to be removed, got %v", n)
+	}
+}
+
+func TestServerKeyFileErrors(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ServerKeyFile = "missing.seed"
+	if _, err := NewServer(opts); err == nil {
+		t.Fatal("Expected error for missing key file")
+	}
+	ukp, _ := nkeys.CreateUser()
+	useed, _ := ukp.Seed()
+	keyFile := createConfFile(t, useed)
+	defer os.Remove(keyFile)
+	opts.ServerKeyFile = keyFile
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "does not contain a server seed") {
+		t.Fatalf("Expected error about missing server seed, got %v", err)
+	}
+}
+
+func TestServerEventsPermissionGrant(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			SYS { users [{user: admin, password: pwd}] }
+			APP {
+				users [
+					{user: ops, password: pwd}
+					{
+						user: app, password: pwd
+						permissions { publish: "app.>", subscribe: "app.>" }
+					}
+				]
+			}
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%s@%s", "admin", "pwd", s.Addr())
+	ncs := natsConnect(t, url)
+	defer ncs.Close()
+
+	url = fmt.Sprintf("nats://%s:%s@%s", "ops", "pwd", s.Addr())
+	nco := natsConnect(t, url)
+	defer nco.Close()
+
+	errCh := make(chan error, 10)
+	url = fmt.Sprintf("nats://%s:%s@%s", "app", "pwd", s.Addr())
+	nc, err := nats.Connect(url, nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	cid, err := nc.GetClientID()
+	if err != nil {
+		t.Fatalf("Error getting client id: %v", err)
+	}
+
+	events := natsSubSync(t, ncs, fmt.Sprintf(permGrantEventSubj, s.ID()))
+	natsFlush(t, ncs)
+	adminSub := natsSubSync(t, nco, "admin.ops")
+	natsFlush(t, nco)
+
+	checkViolation := func() {
+		t.Helper()
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Permissions Violation") {
+				t.Fatalf("Expected permissions violation, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not get the permissions violation")
+		}
+	}
+
+	// Not allowed before the grant.
+	natsPub(t, nc, "admin.ops", []byte("hello"))
+	checkViolation()
+
+	grant := func(g *PermissionGrant) *PermissionGrantResponse {
+		t.Helper()
+		req, _ := json.Marshal(g)
+		msg, err := ncs.Request(fmt.Sprintf(permGrantReqSubj, s.ID()), req, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &PermissionGrantResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		return resp
+	}
+
+	for _, test := range []struct {
+		name string
+		g    *PermissionGrant
+		err  string
+	}{
+		{"unknown client", &PermissionGrant{CID: 12345, Publish: []string{"admin.>"}, Expires: time.Second}, "not found"},
+		{"no expiration", &PermissionGrant{CID: cid, Publish: []string{"admin.>"}}, "expiration"},
+		{"expiration too long", &PermissionGrant{CID: cid, Publish: []string{"admin.>"}, Expires: 2 * maxPermGrantExpiration}, "expiration"},
+		{"invalid subject", &PermissionGrant{CID: cid, Publish: []string{"admin..ops"}, Expires: time.Second}, "invalid subject"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if resp := grant(test.g); !strings.Contains(resp.Error, test.err) {
+				t.Fatalf("Expected error %q, got %q", test.err, resp.Error)
+			}
+		})
+	}
+
+	resp := grant(&PermissionGrant{
+		CID:       cid,
+		Publish:   []string{"admin.>"},
+		Subscribe: []string{"admin.events"},
+		Expires:   250 * time.Millisecond,
+		Reason:    "incident",
+	})
+	if resp.Error != _EMPTY_ || resp.CID != cid || resp.Expires.IsZero() {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	msg := natsNexMsg(t, events, time.Second)
+	em := PermissionGrantEventMsg{}
+	if err := json.Unmarshal(msg.Data, &em); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if em.Revoked || em.Grant == nil || em.Client.ID != cid || em.Grant.Reason != "incident" {
+		t.Fatalf("Unexpected grant event: %+v", em)
+	}
+
+	// Now allowed to publish and subscribe on the granted subjects.
+	natsPub(t, nc, "admin.ops", []byte("hello"))
+	natsNexMsg(t, adminSub, time.Second)
+	sub := natsSubSync(t, nc, "admin.events")
+	natsFlush(t, nc)
+	natsPub(t, nco, "admin.events", []byte("event"))
+	natsNexMsg(t, sub, time.Second)
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+
+	// Wait for the grant to expire.
+	msg = natsNexMsg(t, events, 2*time.Second)
+	em = PermissionGrantEventMsg{}
+	if err := json.Unmarshal(msg.Data, &em); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if !em.Revoked || em.Client.ID != cid {
+		t.Fatalf("Unexpected revoke event: %+v", em)
+	}
+	// The subscription should have been removed.
+	checkViolation()
+	natsPub(t, nc, "admin.ops", []byte("hello"))
+	checkViolation()
+	if _, err := adminSub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no message, got %v", err)
+	}
+
+	// Grant again and revoke explicitly.
+	if resp := grant(&PermissionGrant{CID: cid, Publish: []string{"admin.>"}, Expires: time.Minute}); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	if resp := grant(&PermissionGrant{CID: cid}); !resp.Revoked {
+		t.Fatalf("Expected grant to be revoked: %+v", resp)
+	}
+	natsPub(t, nc, "admin.ops", []byte("hello"))
+	checkViolation()
+}
+
+func TestServerEventsConnectionLimits(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			SYS { users [{user: admin, password: pwd}] }
+			APP { users [{user: app, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%s@%s", "admin", "pwd", s.Addr())
+	ncs := natsConnect(t, url)
+	defer ncs.Close()
+
+	limits := func(l *ConnectionLimits) *ConnectionLimitsResponse {
+		t.Helper()
+		req, _ := json.Marshal(l)
+		msg, err := ncs.Request(fmt.Sprintf(connLimitsReqSubj, s.ID()), req, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &ConnectionLimitsResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		return resp
+	}
+
+	appURL := fmt.Sprintf("nats://%s:%s@%s", "app", "pwd", s.Addr())
+	connectApp := func() (*nats.Conn, error) {
+		return nats.Connect(appURL, nats.NoReconnect())
+	}
+	nc1 := natsConnect(t, appURL)
+	defer nc1.Close()
+	nc2 := natsConnect(t, appURL)
+	defer nc2.Close()
+
+	// Empty request returns current limits.
+	if resp := limits(&ConnectionLimits{}); resp.Error != "" || resp.MaxConnections != DEFAULT_MAX_CONNECTIONS {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	// Validation errors do not apply anything.
+	for _, l := range []*ConnectionLimits{
+		{MaxConnections: 1, Accounts: map[string]int{"FOO": 1}},
+		{Accounts: map[string]int{"APP": -2}},
+		{PauseAccepts: 2 * maxAcceptsPause},
+	} {
+		if resp := limits(l); resp.Error == "" || resp.MaxConnections != DEFAULT_MAX_CONNECTIONS {
+			t.Fatalf("Expected error and no change for %+v, got %+v", l, resp)
+		}
+	}
+
+	// Cap the account, newest connection should be closed.
+	resp := limits(&ConnectionLimits{Accounts: map[string]int{"APP": 1}})
+	if resp.Error != "" || resp.Accounts["APP"] != 1 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if !nc2.IsClosed() {
+			return fmt.Errorf("connection still open")
+		}
+		return nil
+	})
+	if nc1.IsClosed() {
+		t.Fatal("Oldest connection should not have been closed")
+	}
+	if nc, err := connectApp(); err == nil {
+		nc.Close()
+		t.Fatal("Expected account connection to be rejected")
+	}
+	limits(&ConnectionLimits{Accounts: map[string]int{"APP": -1}})
+
+	// Cap the server, only the system and one app connection fit.
+	if resp := limits(&ConnectionLimits{MaxConnections: 2}); resp.MaxConnections != 2 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if nc, err := connectApp(); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be rejected")
+	}
+	if resp := limits(&ConnectionLimits{MaxConnections: -1}); resp.MaxConnections != DEFAULT_MAX_CONNECTIONS {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	// Pause and resume accepts.
+	resp = limits(&ConnectionLimits{PauseAccepts: time.Minute})
+	if resp.PausedUntil.IsZero() {
+		t.Fatalf("Expected accepts to be paused: %+v", resp)
+	}
+	if nc, err := connectApp(); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be dropped while paused")
+	}
+	if resp := limits(&ConnectionLimits{ResumeAccepts: true}); !resp.PausedUntil.IsZero() {
+		t.Fatalf("Expected accepts to be resumed: %+v", resp)
+	}
+	nc3, err := connectApp()
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc3.Close()
+}
+
+func TestAccountConnectionLimitsAcrossCluster(t *testing.T) {
+	tmpl := `
+		listen: "127.0.0.1:-1"
+		accounts {
+			SYS { users [{user: admin, password: pwd}] }
+			A {
+				max_connections: 2
+				users [{user: a, password: pwd}]
+			}
+		}
+		system_account: SYS
+		cluster {
+			listen: "127.0.0.1:-1"
+			%s
+		}
+	`
+	confA := createConfFile(t, []byte(fmt.Sprintf(tmpl, "")))
+	defer os.Remove(confA)
+	sa, oa := RunServerWithConfig(confA)
+	defer sa.Shutdown()
+
+	confB := createConfFile(t, []byte(fmt.Sprintf(tmpl,
+		fmt.Sprintf("routes: [\"nats://127.0.0.1:%d\"]", oa.Cluster.Port))))
+	defer os.Remove(confB)
+	sb, _ := RunServerWithConfig(confB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	for i := 0; i < 2; i++ {
+		nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s", sa.Addr()))
+		defer nc.Close()
+	}
+	accB, err := sb.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := accB.NumConnections(); n != 2 {
+			return fmt.Errorf("Expected 2 connections for the account, got %v", n)
+		}
+		return nil
+	})
+
+	// The limit applies to the whole cluster.
+	_, err = nats.Connect(fmt.Sprintf("nats://a:pwd@%s", sb.Addr()))
+	if err == nil || !strings.Contains(err.Error(), strings.ToLower(ErrTooManyAccountConnections.Error())) {
+		t.Fatalf("Expected error about account connections, got %v", err)
+	}
+
+	// Connections accepted before a remote update are closed when the
+	// update puts the account over its limit.
+	accA, _ := sa.LookupAccount("A")
+	accA.mu.RLock()
+	var newest *client
+	for c := range accA.clients {
+		if c.kind == CLIENT && (newest == nil || c.start.After(newest.start)) {
+			newest = c
+		}
+	}
+	accA.mu.RUnlock()
+	m := AccountNumConns{Account: "A", Conns: 1, TotalConns: 1}
+	m.Server.ID = "SERVERC"
+	msg, _ := json.Marshal(&m)
+	sa.remoteConnsUpdate(nil, nil, fmt.Sprintf(accConnsEventSubj, "A"), _EMPTY_, msg)
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := accA.NumLocalConnections(); n != 1 {
+			return fmt.Errorf("Expected 1 local connection, got %v", n)
+		}
+		for _, cc := range sa.closedClients() {
+			if cc.Cid == newest.cid && cc.Reason == MaxAccountConnectionsExceeded.String() {
+				return nil
+			}
+		}
+		return fmt.Errorf("Newest connection should have been closed")
+	})
+}
+
+func TestServerEventsMsgTrace(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			SYS { users [{user: admin, password: pwd}] }
+			APP { users [{user: app, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs := natsConnect(t, fmt.Sprintf("nats://admin:pwd@%s", s.Addr()))
+	defer ncs.Close()
+	events := natsSubSync(t, ncs, fmt.Sprintf(msgTraceEventSubj, "*"))
+	natsFlush(t, ncs)
+
+	trace := func(r *MsgTraceRequest) *MsgTraceResponse {
+		t.Helper()
+		req, _ := json.Marshal(r)
+		msg, err := ncs.Request(msgTracePingReqSubj, req, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &MsgTraceResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		return resp
+	}
+
+	if resp := trace(&MsgTraceRequest{Subject: "foo.*", Sampling: 101}); resp.Error == _EMPTY_ {
+		t.Fatalf("Expected an error for an invalid sampling")
+	}
+	if resp := trace(&MsgTraceRequest{Subject: "foo..bar"}); resp.Error == _EMPTY_ {
+		t.Fatalf("Expected an error for an invalid subject")
+	}
+	resp := trace(&MsgTraceRequest{Subject: "foo.*", Account: "APP"})
+	if resp.Error != _EMPTY_ || len(resp.Traces) != 1 || resp.Traces[0].Sampling != 100 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	nc := natsConnect(t, fmt.Sprintf("nats://app:pwd@%s", s.Addr()), nats.Name("app"))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo.bar")
+	natsPub(t, nc, "bar", []byte("not traced"))
+	natsPub(t, nc, "foo.bar", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+
+	msg := natsNexMsg(t, events, time.Second)
+	ev := &MsgTraceEventMsg{}
+	if err := json.Unmarshal(msg.Data, ev); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if ev.Subject != "foo.bar" || ev.Account != "APP" || ev.Size != 5 || ev.Server.ID != s.ID() {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	if ev.Ingress.Kind != "Client" || ev.Ingress.Name != "app" || ev.Ingress.Account != "APP" {
+		t.Fatalf("Unexpected ingress: %+v", ev.Ingress)
+	}
+	if len(ev.Egress) != 1 || ev.Egress[0].Subscription != "foo.bar" || ev.Egress[0].Kind != "Client" {
+		t.Fatalf("Unexpected egress: %+v", ev.Egress)
+	}
+	if _, err := events.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected only one trace event, got %v", err)
+	}
+
+	if resp := trace(&MsgTraceRequest{Subject: "foo.*", Account: "APP", Stop: true}); len(resp.Traces) != 0 {
+		t.Fatalf("Expected trace to be stopped: %+v", resp)
+	}
+	natsPub(t, nc, "foo.bar", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+	if _, err := events.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no trace event, got %v", err)
+	}
+
+	// Traces expire after their ttl.
+	trace(&MsgTraceRequest{Subject: "foo.*", TTL: 50 * time.Millisecond})
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if s.msgTracing() {
+			return fmt.Errorf("Trace still active")
+		}
+		return nil
+	})
+}
+
+func TestServerEventsMsgTraceAcrossRoutes(t *testing.T) {
+	tmpl := `
+		listen: "127.0.0.1:-1"
+		server_name: %s
+		accounts {
+			SYS { users [{user: admin, password: pwd}] }
+			APP { users [{user: app, password: pwd}] }
+		}
+		system_account: SYS
+		cluster {
+			listen: "127.0.0.1:-1"
+			%s
+		}
+	`
+	confA := createConfFile(t, []byte(fmt.Sprintf(tmpl, "A", "")))
+	defer os.Remove(confA)
+	sa, _ := RunServerWithConfig(confA)
+	defer sa.Shutdown()
+	confB := createConfFile(t, []byte(fmt.Sprintf(tmpl, "B",
+		fmt.Sprintf("routes: [\"nats://127.0.0.1:%d\"]", sa.ClusterAddr().Port))))
+	defer os.Remove(confB)
+	sb, _ := RunServerWithConfig(confB)
+	defer sb.Shutdown()
+	checkClusterFormed(t, sa, sb)
+
+	ncs := natsConnect(t, fmt.Sprintf("nats://admin:pwd@%s", sa.Addr()))
+	defer ncs.Close()
+	events := natsSubSync(t, ncs, fmt.Sprintf(msgTraceEventSubj, "*"))
+	natsFlush(t, ncs)
+
+	// Activate on all servers, and wait for both of them to respond.
+	inbox := nats.NewInbox()
+	resps := natsSubSync(t, ncs, inbox)
+	req, _ := json.Marshal(&MsgTraceRequest{Subject: "foo"})
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		natsPubReq(t, ncs, msgTracePingReqSubj, inbox, req)
+		for i := 0; i < 2; i++ {
+			if _, err := resps.NextMsg(250 * time.Millisecond); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	ncb := natsConnect(t, fmt.Sprintf("nats://app:pwd@%s", sb.Addr()))
+	defer ncb.Close()
+	sub := natsSubSync(t, ncb, "foo")
+	natsFlush(t, ncb)
+	acc, _ := sa.LookupAccount("APP")
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if r := acc.sl.Match("foo"); len(r.psubs) == 0 {
+			return fmt.Errorf("No interest yet")
+		}
+		return nil
+	})
+
+	nca := natsConnect(t, fmt.Sprintf("nats://app:pwd@%s", sa.Addr()))
+	defer nca.Close()
+	natsPub(t, nca, "foo", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+
+	evs := map[string]*MsgTraceEventMsg{}
+	for i := 0; i < 2; i++ {
+		ev := &MsgTraceEventMsg{}
+		if err := json.Unmarshal(natsNexMsg(t, events, time.Second).Data, ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		evs[ev.Server.Name] = ev
+	}
+	if ev := evs["A"]; ev == nil || ev.Ingress.Kind != "Client" ||
+		len(ev.Egress) != 1 || ev.Egress[0].Kind != "Router" || ev.Egress[0].Name != "B" {
+		t.Fatalf("Unexpected event from A: %+v", ev)
+	}
+	if ev := evs["B"]; ev == nil || ev.Ingress.Kind != "Router" || ev.Ingress.Name != "A" ||
+		ev.Account != "APP" || len(ev.Egress) != 1 || ev.Egress[0].Kind != "Client" {
+		t.Fatalf("Unexpected event from B: %+v", ev)
+	}
+}
+
+func TestServerEventsAccountAPI(t *testing.T) {
+	s, opts := runTrustedServer(t)
+	defer s.Shutdown()
+
+	sacc, sakp := createAccount(s)
+	s.setSystemAccount(sacc)
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	ncs, err := nats.Connect(url, createUserCreds(t, s, sakp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	request := func(subject string, data []byte) *AccountAPIResponse {
+		t.Helper()
+		msg, err := ncs.Request(subject, data, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &AccountAPIResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		return resp
+	}
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, _ := nac.Encode(okp)
+
+	// Accounts must be signed by a trusted operator.
+	bad, _ := nkeys.CreateOperator()
+	bjwt, _ := nac.Encode(bad)
+	if resp := request(accCreateReqSubj, []byte(bjwt)); resp.Error == _EMPTY_ {
+		t.Fatalf("Expected an error for an untrusted issuer, got %+v", resp)
+	}
+	if resp := request(accUpdateReqSubj, []byte(ajwt)); !strings.Contains(resp.Error, "not found") {
+		t.Fatalf("Expected an error for an unknown account, got %+v", resp)
+	}
+
+	resp := request(accCreateReqSubj, []byte(ajwt))
+	if resp.Error != _EMPTY_ || resp.Account != apub || resp.Server.ID != s.ID() {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if stored, _ := s.AccountResolver().Fetch(apub); stored != ajwt {
+		t.Fatal("Expected the account to be stored in the resolver")
+	}
+	if resp := request(accCreateReqSubj, []byte(ajwt)); !strings.Contains(resp.Error, "already exists") {
+		t.Fatalf("Expected an error for an existing account, got %+v", resp)
+	}
+	nc, err := nats.Connect(url, createUserCreds(t, s, akp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Update the account live.
+	nac.Limits.Conn = 1
+	ajwt, _ = nac.Encode(okp)
+	if resp := request(accUpdateReqSubj, []byte(ajwt)); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	acc, _ := s.LookupAccount(apub)
+	if n := acc.MaxActiveConnections(); n != 1 {
+		t.Fatalf("Expected a connection limit of 1, got %d", n)
+	}
+
+	// Delete the account, its connections are closed.
+	if resp := request(accDeleteReqSubj, []byte(sacc.Name)); resp.Error == _EMPTY_ {
+		t.Fatal("Expected an error deleting the system account")
+	}
+	if resp := request(accDeleteReqSubj, []byte(apub)); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if nc.IsConnected() {
+			return fmt.Errorf("Expected the connection of the account to be closed")
+		}
+		return nil
+	})
+	if _, err := s.AccountResolver().Fetch(apub); err == nil {
+		t.Fatal("Expected the account to be removed from the resolver")
+	}
+	if _, err := nats.Connect(url, createUserCreds(t, s, akp), nats.NoReconnect()); err == nil {
+		t.Fatal("Expected the connection to fail")
+	}
+}
+
+func TestServerEventsAccountDeleteLeafAndImports(t *testing.T) {
+	s, opts := runTrustedLeafServer(t)
+	defer s.Shutdown()
+
+	okp, _ := nkeys.FromSeed(oSeed)
+
+	// The exporting account, deleted below.
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	nac.Exports.Add(&jwt.Export{Subject: "foo", Type: jwt.Stream})
+	nac.Exports.Add(&jwt.Export{Subject: "svc", Type: jwt.Service})
+	ajwt, _ := nac.Encode(okp)
+	addAccountToMemResolver(s, apub, ajwt)
+
+	bkp, _ := nkeys.CreateAccount()
+	bpub, _ := bkp.PublicKey()
+	nbc := jwt.NewAccountClaims(bpub)
+	nbc.Imports.Add(&jwt.Import{Account: apub, Subject: "foo", Type: jwt.Stream})
+	nbc.Imports.Add(&jwt.Import{Account: apub, Subject: "svc", Type: jwt.Service})
+	bjwt, _ := nbc.Encode(okp)
+	addAccountToMemResolver(s, bpub, bjwt)
+	bacc, err := s.LookupAccount(bpub)
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nc, err := nats.Connect(url, createUserCreds(t, s, bkp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	natsSubSync(t, nc, "foo")
+	natsFlush(t, nc)
+
+	kp, _ := nkeys.CreateUser()
+	upub, _ := kp.PublicKey()
+	ujwt, err := jwt.NewUserClaims(upub).Encode(akp)
+	if err != nil {
+		t.Fatalf("Error generating user JWT: %v", err)
+	}
+	seed, _ := kp.Seed()
+	mycreds := genCredsFile(t, ujwt, seed)
+	defer os.Remove(mycreds)
+
+	sl, _, lnconf := runSolicitWithCredentials(t, opts, mycreds)
+	defer os.Remove(lnconf)
+	defer sl.Shutdown()
+	checkLeafNodeConnected(t, s)
+
+	if err := s.deleteAccount(apub); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The leafnode bound to the account is closed, and can not come back.
+	checkLeafNodeConnectedCount(t, s, 0)
+	time.Sleep(100 * time.Millisecond)
+	checkLeafNodeConnectedCount(t, s, 0)
+
+	bacc.mu.RLock()
+	for _, im := range bacc.imports.streams {
+		if !im.invalid {
+			t.Errorf("Expected the stream import %q to be invalid", im.from)
+		}
+	}
+	for _, si := range bacc.imports.services {
+		if !si.invalid {
+			t.Errorf("Expected the service import %q to be invalid", si.from)
+		}
+	}
+	bacc.mu.RUnlock()
+
+	// The subscription no longer has interest in the deleted account.
+	for _, c := range bacc.localClients() {
+		c.mu.Lock()
+		for _, sub := range c.subs {
+			if len(sub.shadow) > 0 {
+				t.Errorf("Expected no shadow subscription for %q", sub.subject)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestServerEventsUserUpdate(t *testing.T) {
+	s, opts := runTrustedServer(t)
+	defer s.Shutdown()
+
+	sacc, sakp := createAccount(s)
+	s.setSystemAccount(sacc)
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	ncs, err := nats.Connect(url, createUserCreds(t, s, sakp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+
+	_, akp := createAccount(s)
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	nuc := jwt.NewUserClaims(upub)
+	ujwt, _ := nuc.Encode(akp)
+	errCh := make(chan error, 10)
+	nc, err := nats.Connect(url,
+		nats.UserJWT(
+			func() (string, error) { return ujwt, nil },
+			func(nonce []byte) ([]byte, error) { return ukp.Sign(nonce) }),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	natsSubSync(t, nc, "foo.bar")
+	natsSubSync(t, nc, "baz")
+	natsFlush(t, nc)
+
+	// Restrict the user, its connection is updated without reconnecting.
+	nuc.Sub.Allow.Add("foo.>")
+	nuc.Pub.Deny.Add("foo.bar")
+	ujwt, _ = nuc.Encode(akp)
+	msg, err := ncs.Request(userUpdateReqSubj, []byte(ujwt), time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	var resp UserUpdateResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if resp.Error != _EMPTY_ || resp.User != upub || len(resp.Updated) != 1 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), `Permissions Violation for Subscription to "baz"`) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a permissions violation for the subscription")
+	}
+	natsPub(t, nc, "foo.bar", []byte("hello"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), `Permissions Violation for Publish to "foo.bar"`) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a permissions violation for the publish")
+	}
+	if nc.IsClosed() {
+		t.Fatal("Expected the connection to remain")
+	}
+
+	// JWTs not signed by the account are rejected.
+	other, _ := nkeys.CreateAccount()
+	ujwt, _ = nuc.Encode(other)
+	msg, err = ncs.Request(userUpdateReqSubj, []byte(ujwt), time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp = UserUpdateResponse{}
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if resp.Error == _EMPTY_ {
+		t.Fatalf("Expected an error, got %+v", resp)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// A message is shared by the connections it is delivered to when it
+	// matches at least that many subscriptions, and is at least that big.
+	// Smaller messages are cheaper to copy than to write separately.
+	sharedPayloadMinFanout = 8
+	sharedPayloadMinSize   = 1024
+)
+
+// Size classes of the shared payload buffers, the largest being the size
+// above which the messages are referenced by the outbound buffers anyway.
+var sharedPayloadClasses = [...]int{4 * 1024, 16 * 1024, maxBufSize}
+
+var sharedPayloadPools [len(sharedPayloadClasses)]sync.Pool
+
+// sharedPayload is an immutable copy of a message, referenced by the
+// outbound buffers of the connections it is delivered to instead of being
+// copied in each of them. The buffer returns to its pool once the message
+// has been written to all of them.
+type sharedPayload struct {
+	refs  int32
+	class int
+	buf   []byte
+}
+
+// newSharedPayload copies the message into a shared payload, referenced
+// by the caller.
+func newSharedPayload(msg []byte) *sharedPayload {
+	class := 0
+	for len(msg) > sharedPayloadClasses[class] {
+		class++
+	}
+	sp, _ := sharedPayloadPools[class].Get().(*sharedPayload)
+	if sp == nil {
+		sp = &sharedPayload{class: class, buf: make([]byte, 0, sharedPayloadClasses[class])}
+	}
+	sp.refs = 1
+	sp.buf = append(sp.buf[:0], msg...)
+	return sp
+}
+
+func (sp *sharedPayload) retain() {
+	atomic.AddInt32(&sp.refs, 1)
+}
+
+// release drops a reference, the buffer is reused once all are dropped.
+func (sp *sharedPayload) release() {
+	if atomic.AddInt32(&sp.refs, -1) == 0 {
+		sharedPayloadPools[sp.class].Put(sp)
+	}
+}
+
+// owns returns true if msg is the payload, or its end, as returned by
+// msgForClient.
+func (sp *sharedPayload) owns(msg []byte) bool {
+	return len(msg) > 0 && len(msg) <= len(sp.buf) && &msg[len(msg)-1] == &sp.buf[len(sp.buf)-1]
+}
+
+// sharedRef is a shared payload queued to a connection.
+type sharedRef struct {
+	sp *sharedPayload
+	// Total bytes written to the connection once the payload is, that is
+	// what was written and pending when queued, including the payload.
+	// The high priority messages queued since are written ahead of it.
+	end int64
+}
+
+// queueSharedOutbound queues a shared payload, which is referenced instead
+// of copied, and retained until it has been written. The pending bytes are
+// accounted as for any other message, so a slow consumer is still detected
+// and stalls its producers.
+// Lock should be held.
+func (c *client) queueSharedOutbound(msg []byte, sp *sharedPayload) {
+	if c.flags.isSet(closeConnection) {
+		return
+	}
+	c.addPendingBytes(int64(len(msg)))
+	if c.kind == CLIENT && c.out.pb > c.out.mp {
+		c.addPendingBytes(-int64(len(msg)))
+		atomic.AddInt64(&c.srv.slowConsumers, 1)
+		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
+		c.markConnAsClosed(SlowConsumerPendingBytes, true)
+		return
+	}
+	// What is in the primary buffer goes first, and the rest of the
+	// primary buffer is used for what follows.
+	if len(c.out.p) > 0 {
+		c.out.nb = append(c.out.nb, c.out.p)
+		if c.out.p = c.out.p[len(c.out.p):]; cap(c.out.p) == 0 {
+			c.out.p = nil
+		}
+	}
+	c.out.nb = append(c.out.nb, msg)
+	sp.retain()
+	c.out.sh = append(c.out.sh, sharedRef{sp: sp, end: c.out.wt + c.out.pb})
+
+	if c.out.pb > c.out.mp/2 && c.out.stc == nil {
+		c.out.stc = make(chan struct{})
+	}
+}
+
+// releaseSharedPayloads drops the references to the shared payloads, once
+// they have been written or when the connection is closed.
+// Lock should be held.
+func (c *client) releaseSharedPayloads() {
+	for i, sr := range c.out.sh {
+		sr.sp.release()
+		c.out.sh[i] = sharedRef{}
+	}
+	c.out.sh = c.out.sh[:0]
+}
+
+// releaseWrittenSharedPayloads drops the references to the shared payloads
+// already written, while the ones queued after are still pending.
+// Lock should be held.
+func (c *client) releaseWrittenSharedPayloads() {
+	i := 0
+	for ; i < len(c.out.sh) && c.out.sh[i].end <= c.out.wt; i++ {
+		c.out.sh[i].sp.release()
+	}
+	if i == 0 {
+		return
+	}
+	n := copy(c.out.sh, c.out.sh[i:])
+	for j := n; j < len(c.out.sh); j++ {
+		c.out.sh[j] = sharedRef{}
+	}
+	c.out.sh = c.out.sh[:n]
+}
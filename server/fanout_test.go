@@ -0,0 +1,220 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSharedPayload(t *testing.T) {
+	msg := append(bytes.Repeat([]byte("x"), 5000), _CRLF_...)
+	sp := newSharedPayload(msg)
+	if sp.class != 1 || !bytes.Equal(sp.buf, msg) {
+		t.Fatalf("Unexpected shared payload of class %d", sp.class)
+	}
+	if !sp.owns(sp.buf) || !sp.owns(sp.buf[100:]) || sp.owns(msg) || sp.owns(sp.buf[:10]) {
+		t.Fatal("Unexpected ownership")
+	}
+	sp.retain()
+	sp.release()
+	if sp.refs != 1 {
+		t.Fatalf("Unexpected references: %d", sp.refs)
+	}
+	sp.release()
+	if sp.refs != 0 {
+		t.Fatalf("Unexpected references: %d", sp.refs)
+	}
+}
+
+func TestSharedPayloadFanout(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	const subs, msgs = 12, 200
+	var sublist []*nats.Subscription
+	for i := 0; i < subs; i++ {
+		nc := natsConnect(t, s.ClientURL())
+		defer nc.Close()
+		sublist = append(sublist, natsSubSync(t, nc, "foo"))
+		natsFlush(t, nc)
+	}
+	payload := func(i int) []byte {
+		// Alternate shared and copied payloads, so that both are queued
+		// in the same outbound buffers.
+		if i%3 == 0 {
+			return []byte(fmt.Sprintf("small-%d", i))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("%08d", i)), 256+i*10)
+	}
+	pub := natsConnect(t, s.ClientURL())
+	defer pub.Close()
+	for i := 0; i < msgs; i++ {
+		natsPub(t, pub, "foo", payload(i))
+	}
+	natsFlush(t, pub)
+
+	for n, sub := range sublist {
+		for i := 0; i < msgs; i++ {
+			msg := natsNexMsg(t, sub, 2*time.Second)
+			if !bytes.Equal(msg.Data, payload(i)) {
+				t.Fatalf("Subscriber %d got an unexpected message %d of %d bytes", n, i, len(msg.Data))
+			}
+		}
+	}
+}
+
+func TestSharedPayloadReleasedAfterCloseDuringFlush(t *testing.T) {
+	cnc, snc := net.Pipe()
+	defer snc.Close()
+	c := &client{srv: &Server{}, nc: cnc, kind: CLIENT}
+	c.out.wdl = 5 * time.Second
+	c.out.mp = 1024 * 1024
+
+	sp := newSharedPayload(bytes.Repeat([]byte("x"), 2048))
+	c.mu.Lock()
+	c.queueSharedOutbound(sp.buf, sp)
+	c.mu.Unlock()
+	// Drop the reference of the producer.
+	sp.release()
+
+	// Nothing reads the pipe, so the write blocks.
+	done := make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		c.flushOutbound()
+		c.mu.Unlock()
+		close(done)
+	}()
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.flags.isSet(flushOutbound) {
+			return fmt.Errorf("flush not in progress")
+		}
+		return nil
+	})
+
+	c.mu.Lock()
+	c.flags.set(closeConnection | skipFlushOnClose)
+	c.flushAndClose(false)
+	if refs := atomic.LoadInt32(&sp.refs); refs != 1 {
+		c.mu.Unlock()
+		t.Fatalf("Expected the payload being written to be retained, got %d references", refs)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Flush did not return")
+	}
+	if refs := atomic.LoadInt32(&sp.refs); refs != 0 {
+		t.Fatalf("Expected the payload to be released after the write, got %d references", refs)
+	}
+}
+
+// Writes at most the budget set before each flush.
+type testConnWriteBudget struct {
+	net.Conn
+	budget int
+	buf    bytes.Buffer
+}
+
+func (c *testConnWriteBudget) Write(p []byte) (int, error) {
+	n := len(p)
+	if n > c.budget {
+		n = c.budget
+	}
+	c.budget -= n
+	return c.buf.Write(p[:n])
+}
+
+func (c *testConnWriteBudget) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+func TestSharedPayloadReleasedOnceWritten(t *testing.T) {
+	conn := &testConnWriteBudget{}
+	c := &client{srv: &Server{}, nc: conn, kind: CLIENT}
+	c.out.wdl = 5 * time.Second
+	c.out.mp = 1024 * 1024
+
+	var sps []*sharedPayload
+	c.mu.Lock()
+	for i := 0; i < 4; i++ {
+		sp := newSharedPayload(bytes.Repeat([]byte{byte('a' + i)}, 2048))
+		c.queueSharedOutbound(sp.buf, sp)
+		sp.release()
+		sps = append(sps, sp)
+	}
+	c.mu.Unlock()
+
+	check := func(pending int) {
+		t.Helper()
+		c.mu.Lock()
+		n := len(c.out.sh)
+		c.mu.Unlock()
+		if n != pending {
+			t.Fatalf("Expected %d shared payloads, got %d", pending, n)
+		}
+		for i, sp := range sps {
+			refs, want := atomic.LoadInt32(&sp.refs), int32(0)
+			if i >= len(sps)-pending {
+				want = 1
+			}
+			if refs != want {
+				t.Fatalf("Expected %d references to payload %d, got %d", want, i, refs)
+			}
+		}
+	}
+	flush := func(budget int) {
+		c.mu.Lock()
+		conn.budget = budget
+		c.flushOutbound()
+		c.mu.Unlock()
+	}
+
+	// The subscriber stays backed up, but what it read is released.
+	flush(2*2048 + 100)
+	check(2)
+
+	// A high priority message goes after the partially written payload,
+	// but ahead of the next one, which is then retained.
+	c.mu.Lock()
+	c.queuePriorityOutbound([]byte("MSG ctrl 1 2\r\n"), []byte("ok\r\n"))
+	c.mu.Unlock()
+	flush(2048 - 100 + 20 + 10)
+	check(1)
+
+	flush(1024 * 1024)
+	check(0)
+
+	var expected bytes.Buffer
+	for _, b := range []string{"a", "b", "c"} {
+		expected.WriteString(strings.Repeat(b, 2048))
+	}
+	expected.WriteString("MSG ctrl 1 2\r\nok\r\n")
+	expected.WriteString(strings.Repeat("d", 2048))
+	if !bytes.Equal(conn.buf.Bytes(), expected.Bytes()) {
+		t.Fatal("Unexpected data written")
+	}
+}
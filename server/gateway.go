@@ -186,6 +186,9 @@ type gateway struct {
 	outsim     *sync.Map         // Per-account subject interest (or no-interest) (outbound conn)
 	insim      map[string]*insie // Per-account subject no-interest sent or modeInterestOnly mode (inbound conn)
 
+	// Time of the last interest update received (outbound conn)
+	lastInterest time.Time
+
 	// Set/check in readLoop without lock. This is to know that an inbound has sent the CONNECT protocol first
 	connected bool
 	// Set to true if outbound is to a server that only knows about $GR, not $GNR
@@ -442,8 +445,7 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 		port = 0
 	}
 
-	hp := net.JoinHostPort(opts.Gateway.Host, strconv.Itoa(port))
-	l, e := net.Listen("tcp", hp)
+	l, e := natsListen(opts.Gateway.Host, opts.Gateway.HostV6, port)
 	if e != nil {
 		s.Fatalf("Error listening on gateway port: %d - %v", opts.Gateway.Port, e)
 		return
@@ -451,6 +453,10 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 	s.Noticef("Gateway name is %s", s.getGatewayName())
 	s.Noticef("Listening for gateways connections on %s",
 		net.JoinHostPort(opts.Gateway.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	if opts.Gateway.HostV6 != _EMPTY_ {
+		s.Noticef("Listening for gateways connections on %s",
+			net.JoinHostPort(opts.Gateway.HostV6, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	}
 
 	s.mu.Lock()
 	tlsReq := opts.Gateway.TLSConfig != nil
@@ -510,10 +516,13 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 			continue
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
-		s.startGoRoutine(func() {
-			s.createGateway(nil, nil, conn)
-			s.grWG.Done()
-		})
+		if !s.acceptAllowed("Gateway", s.getOpts().Gateway.Networks, conn) {
+			continue
+		}
+		if !s.acceptRateAllowed("Gateway", s.getOpts().Gateway.AcceptRate, conn) {
+			continue
+		}
+		s.startAcceptWorker(s.routeAcceptPool, conn, func(conn net.Conn) { s.createGateway(nil, nil, conn) })
 	}
 	s.Debugf("Gateway accept loop exiting..")
 	s.done <- true
@@ -655,18 +664,30 @@ func (s *Server) solicitGateway(cfg *gatewayCfg, firstConnect bool) {
 		attempts++
 		report := s.shouldReportConnectErr(firstConnect, attempts)
 		// Iteration is random
+		// The proxy, if any, resolves the gateway's host.
+		proxy := outboundProxy(cfg.Proxy, opts.OutboundProxy)
 		for _, u := range urls {
-			address, err := s.getRandomIP(s.gateway.resolver, u.Host)
-			if err != nil {
-				s.Errorf("Error getting IP for %s gateway %q (%s): %v", typeStr, cfg.Name, u.Host, err)
-				continue
+			address := u.Host
+			if proxy == _EMPTY_ {
+				var err error
+				address, err = s.getRandomIP(s.gateway.resolver, u.Host)
+				if err != nil {
+					s.Errorf("Error getting IP for %s gateway %q (%s): %v", typeStr, cfg.Name, u.Host, err)
+					continue
+				}
 			}
 			if report {
 				s.Noticef(connFmt, typeStr, cfg.Name, u.Host, address, attempts)
 			} else {
 				s.Debugf(connFmt, typeStr, cfg.Name, u.Host, address, attempts)
 			}
-			conn, err := net.DialTimeout("tcp", address, DEFAULT_ROUTE_DIAL)
+			var conn net.Conn
+			var err error
+			if proxy != _EMPTY_ {
+				conn, err = dialProxy(proxy, address, DEFAULT_ROUTE_DIAL)
+			} else {
+				conn, err = net.DialTimeout("tcp", address, DEFAULT_ROUTE_DIAL)
+			}
 			if err == nil {
 				// We could connect, create the gateway connection and return.
 				s.createGateway(cfg, u, conn)
@@ -752,7 +773,7 @@ func (s *Server) createGateway(cfg *gatewayCfg, url *url.URL, conn net.Conn) {
 			c.Debugf("Starting TLS gateway client handshake")
 			cfg.RLock()
 			tlsName := cfg.tlsName
-			tlsConfig := cfg.TLSConfig.Clone()
+			tlsConfig := tlsClientConfig(cfg.TLSConfig)
 			timeout = cfg.TLSTimeout
 			cfg.RUnlock()
 			if tlsConfig.ServerName == "" {
@@ -780,7 +801,13 @@ func (s *Server) createGateway(cfg *gatewayCfg, url *url.URL, conn net.Conn) {
 		conn.SetReadDeadline(time.Now().Add(ttl))
 
 		c.mu.Unlock()
-		if err := conn.Handshake(); err != nil {
+		var err error
+		if solicit {
+			err = conn.Handshake()
+		} else {
+			err = s.tlsHandshake(conn, ttl)
+		}
+		if err != nil {
 			if solicit {
 				// Based on type of error, possibly clear the saved tlsName
 				// See: https://github.com/nats-io/nats-server/issues/1256
@@ -1702,6 +1729,9 @@ func (s *Server) GatewayAddr() *net.TCPAddr {
 func (c *client) processGatewayAccountUnsub(accName string) {
 	// Just to indicate activity around "subscriptions" events.
 	c.in.subs++
+	c.mu.Lock()
+	c.gw.lastInterest = time.Now()
+	c.mu.Unlock()
 	// This account may have an entry because of queue subs.
 	// If that's the case, we can reset the no-interest map,
 	// but not set the entry to nil.
@@ -1731,6 +1761,9 @@ func (c *client) processGatewayAccountUnsub(accName string) {
 func (c *client) processGatewayAccountSub(accName string) error {
 	// Just to indicate activity around "subscriptions" events.
 	c.in.subs++
+	c.mu.Lock()
+	c.gw.lastInterest = time.Now()
+	c.mu.Unlock()
 	// If this account has an entry because of queue subs, we
 	// can't delete the entry.
 	remove := true
@@ -1788,6 +1821,7 @@ func (c *client) processGatewayRUnsub(arg []byte) error {
 		c.closeConnection(ProtocolViolation)
 		return nil
 	}
+	c.gw.lastInterest = time.Now()
 	defer c.mu.Unlock()
 
 	ei, _ := c.gw.outsim.Load(accName)
@@ -1894,6 +1928,7 @@ func (c *client) processGatewayRSub(arg []byte) error {
 		c.closeConnection(ProtocolViolation)
 		return nil
 	}
+	c.gw.lastInterest = time.Now()
 	defer c.mu.Unlock()
 
 	ei, _ := c.gw.outsim.Load(string(accName))
@@ -1942,7 +1977,7 @@ func (c *client) processGatewayRSub(arg []byte) error {
 			csubject = make([]byte, len(subject))
 			copy(csubject, subject)
 		}
-		sub = &subscription{client: c, subject: csubject, queue: cqueue, qw: qw}
+		sub = &subscription{client: c, subject: csubject, queue: cqueue, qw: qw, updated: c.gw.lastInterest.UnixNano()}
 		// If no error inserting in sublist...
 		if e.sl.Insert(sub) == nil {
 			c.subs[string(key)] = sub
@@ -2342,9 +2377,9 @@ var subPool = &sync.Pool{
 // May send a message to all outbound gateways. It is possible
 // that the message is not sent to a given gateway if for instance
 // it is known that this gateway has no interest in the account or
-// subject, etc..
+// subject, etc.. Returns true if the message was sent to at least one gateway.
 // <Invoked from any client connection's readLoop>
-func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgroups [][]byte) {
+func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgroups [][]byte) bool {
 	gwsa := [16]*client{}
 	gws := gwsa[:0]
 	// This is in fast path, so avoid calling function when possible.
@@ -2359,9 +2394,10 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 	thisClusterOldReplyPrefix := gw.oldReplyPfx
 	gw.RUnlock()
 	if len(gws) == 0 {
-		return
+		return false
 	}
 	var (
+		sent       bool
 		subj       = string(subject)
 		queuesa    = [512]byte{}
 		queues     = queuesa[:0]
@@ -2472,7 +2508,8 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 			mh = append(mh, mreply...)
 			mh = append(mh, ' ')
 		}
-		mh = append(mh, c.pa.szb...)
+		// Headers are not supported across gateways and are stripped.
+		mh = c.appendMsgSize(mh, gwc)
 		mh = append(mh, CR_LF...)
 
 		// We reuse the subscription object that we pass to deliverMsg.
@@ -2480,11 +2517,13 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 		sub.nm, sub.max = 0, 0
 		sub.client = gwc
 		sub.subject = subject
-		c.deliverMsg(sub, subject, mh, msg, false)
+		c.deliverMsg(sub, subject, mh, c.msgForClient(msg, gwc), false)
+		sent = true
 	}
 	// Done with subscription, put back to pool. We don't need
 	// to reset content since we explicitly set when using it.
 	subPool.Put(sub)
+	return sent
 }
 
 // Possibly sends an A- to the remote gateway `c`.
@@ -4150,6 +4150,10 @@ func TestGatewayServiceImportComplexSetup(t *testing.T) {
 	checkSubs(t, barB1, "B1", 0)
 	checkSubs(t, barB2, "B2", 0)
 
+	// Restore the TTL so that replies below do not expire.
+	fooA2.SetAutoExpireTTL(10 * time.Second)
+	fooB1.SetAutoExpireTTL(10 * time.Second)
+
 	// Check that this all work in interest-only mode.
 
 	// We need at least a subscription on B2 otherwise when publishing
@@ -4518,6 +4522,10 @@ func TestGatewayServiceExportWithWildcards(t *testing.T) {
 			checkSubs(t, barB1, "B1", 0)
 			checkSubs(t, barB2, "B2", 0)
 
+			// Restore the TTL so that replies below do not expire.
+			fooA2.SetAutoExpireTTL(10 * time.Second)
+			fooB1.SetAutoExpireTTL(10 * time.Second)
+
 			// Check that this all work in interest-only mode.
 
 			// We need at least a subscription on B2 otherwise when publishing
@@ -0,0 +1,61 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+)
+
+// InProcessConn returns a connection to the server that does not go
+// through a listener, for instance to be returned by the dialer given to
+// the nats.SetCustomDialer option of the client. It can be used whether
+// or not the server listens for clients. TLS is not used on these
+// connections, but the authentication is.
+func (s *Server) InProcessConn() (net.Conn, error) {
+	if !s.isRunning() {
+		return nil, ErrServerNotRunning
+	}
+	sc, cc := net.Pipe()
+	// The go routine is not started if the server is shutting down.
+	if !s.startGoRoutine(func() {
+		s.createClientEx(sc, true)
+		s.grWG.Done()
+	}) {
+		sc.Close()
+		cc.Close()
+		return nil, ErrServerNotRunning
+	}
+	return cc, nil
+}
+
+// startWithoutListener is used by the AcceptLoop when Options.DontListen
+// is set. Clients can only connect with InProcessConn.
+func (s *Server) startWithoutListener(clr chan struct{}) {
+	s.Noticef("Not listening for client connections")
+	s.Noticef("Server id is %s", s.info.ID)
+	s.Noticef("Server is ready")
+
+	s.mu.Lock()
+	if err := s.setInfoHostPortAndGenerateJSON(); err != nil {
+		s.Fatalf("Error setting server INFO with ClientAdvertise value of %s, err=%v", s.opts.ClientAdvertise, err)
+		s.mu.Unlock()
+		close(clr)
+		return
+	}
+	s.mu.Unlock()
+
+	// Let the caller know that we are ready
+	close(clr)
+	s.notifyReady()
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type inProcessDialer struct {
+	s *Server
+}
+
+func (d *inProcessDialer) Dial(network, address string) (net.Conn, error) {
+	return d.s.InProcessConn()
+}
+
+func TestInProcessConn(t *testing.T) {
+	o := DefaultOptions()
+	o.DontListen = true
+	o.Username, o.Password = "user", "pwd"
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if s.Addr() != nil {
+		t.Fatalf("Expected no client listener, got %v", s.Addr())
+	}
+
+	dialer := nats.SetCustomDialer(&inProcessDialer{s})
+	if _, err := nats.Connect("nats://127.0.0.1:4222", dialer, nats.NoReconnect()); err == nil {
+		t.Fatal("Expected authentication error")
+	}
+	nc, err := nats.Connect("nats://127.0.0.1:4222", dialer, nats.UserInfo("user", "pwd"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	if err := nc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if msg, err := sub.NextMsg(time.Second); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("Unexpected message %v, err=%v", msg, err)
+	}
+
+	cz, _ := s.Connz(nil)
+	if cz.NumConns != 1 {
+		t.Fatalf("Expected 1 connection, got %v", cz.NumConns)
+	}
+
+	s.Shutdown()
+	if _, err := s.InProcessConn(); err != ErrServerNotRunning {
+		t.Fatalf("Expected %v, got %v", ErrServerNotRunning, err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RouteInterest is the interest of the remote server of a route, as known
+// by this server.
+type RouteInterest struct {
+	Rid        uint64           `json:"rid"`
+	RemoteID   string           `json:"remote_id"`
+	RemoteName string           `json:"remote_name,omitempty"`
+	LastUpdate time.Time        `json:"last_update,omitempty"`
+	Subs       []RemoteInterest `json:"subscriptions_list,omitempty"`
+}
+
+// GatewayInterest is the interest of a remote cluster, as known by the
+// outbound gateway connection to it.
+type GatewayInterest struct {
+	Name       string                   `json:"name"`
+	Cid        uint64                   `json:"cid"`
+	LastUpdate time.Time                `json:"last_update,omitempty"`
+	Accounts   []GatewayAccountInterest `json:"accounts,omitempty"`
+}
+
+// GatewayAccountInterest is the interest of a remote cluster in an account.
+// In the optimistic mode, messages are sent unless the remote cluster has
+// no interest in the account or in their subjects. Otherwise, they are
+// only sent on the subjects of the subscriptions.
+type GatewayAccountInterest struct {
+	Account    string           `json:"account"`
+	Mode       string           `json:"interest_mode"`
+	NoInterest bool             `json:"no_interest,omitempty"`
+	NoSubjects []string         `json:"no_interest_subjects,omitempty"`
+	Subs       []RemoteInterest `json:"subscriptions_list,omitempty"`
+}
+
+// RemoteInterest is a subscription of a remote server.
+type RemoteInterest struct {
+	Account string    `json:"account,omitempty"`
+	Subject string    `json:"subject"`
+	Queue   string    `json:"qgroup,omitempty"`
+	Weight  int32     `json:"weight,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Returns the remote interests of the subscriptions of a route or gateway,
+// keyed by account, subject and queue, that match the test subject if set.
+// Lock should be held.
+func remoteInterests(subs map[string]*subscription, test string) []RemoteInterest {
+	var ris []RemoteInterest
+	for key, sub := range subs {
+		if test != _EMPTY_ && !matchLiteral(test, string(sub.subject)) {
+			continue
+		}
+		ri := RemoteInterest{
+			Subject: string(sub.subject),
+			Queue:   string(sub.queue),
+			Weight:  atomic.LoadInt32(&sub.qw),
+		}
+		if sub.updated > 0 {
+			ri.Updated = time.Unix(0, sub.updated)
+		}
+		if i := strings.IndexByte(key, ' '); i > 0 {
+			ri.Account = key[:i]
+		}
+		ris = append(ris, ri)
+	}
+	sort.Slice(ris, func(i, j int) bool {
+		a, b := &ris[i], &ris[j]
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		return a.Queue < b.Queue
+	})
+	return ris
+}
+
+// routesInterest returns the interest of the remote servers of the routes.
+func (s *Server) routesInterest(test string) []RouteInterest {
+	s.mu.Lock()
+	routes := make([]*client, 0, len(s.routes))
+	for _, r := range s.routes {
+		routes = append(routes, r)
+	}
+	s.mu.Unlock()
+
+	ris := make([]RouteInterest, 0, len(routes))
+	for _, r := range routes {
+		r.mu.Lock()
+		if r.route != nil {
+			ris = append(ris, RouteInterest{
+				Rid:        r.cid,
+				RemoteID:   r.route.remoteID,
+				RemoteName: r.route.remoteName,
+				LastUpdate: r.route.lastInterest,
+				Subs:       remoteInterests(r.subs, test),
+			})
+		}
+		r.mu.Unlock()
+	}
+	sort.Slice(ris, func(i, j int) bool { return ris[i].Rid < ris[j].Rid })
+	return ris
+}
+
+// gatewaysInterest returns the interest of the remote clusters, as known by
+// the outbound gateway connections.
+func (s *Server) gatewaysInterest(test string) []GatewayInterest {
+	if !s.gateway.enabled {
+		return nil
+	}
+	var gws []*client
+	s.getOutboundGatewayConnections(&gws)
+
+	gis := make([]GatewayInterest, 0, len(gws))
+	for _, c := range gws {
+		c.mu.Lock()
+		gi := GatewayInterest{Name: c.gw.name, Cid: c.cid, LastUpdate: c.gw.lastInterest}
+		subs := remoteInterests(c.subs, test)
+		accounts := map[string]*GatewayAccountInterest{}
+		account := func(name string) *GatewayAccountInterest {
+			ai := accounts[name]
+			if ai == nil {
+				ai = &GatewayAccountInterest{Account: name, Mode: Optimistic.String()}
+				accounts[name] = ai
+			}
+			return ai
+		}
+		if c.gw.outsim != nil {
+			c.gw.outsim.Range(func(k, v interface{}) bool {
+				ai := account(k.(string))
+				e, _ := v.(*outsie)
+				if e == nil {
+					ai.NoInterest = true
+					return true
+				}
+				e.RLock()
+				ai.Mode = e.mode.String()
+				for subj := range e.ni {
+					if test == _EMPTY_ || matchLiteral(test, subj) {
+						ai.NoSubjects = append(ai.NoSubjects, subj)
+					}
+				}
+				e.RUnlock()
+				sort.Strings(ai.NoSubjects)
+				return true
+			})
+		}
+		for _, ri := range subs {
+			ai := account(ri.Account)
+			ri.Account = _EMPTY_
+			ai.Subs = append(ai.Subs, ri)
+		}
+		c.mu.Unlock()
+		for _, ai := range accounts {
+			gi.Accounts = append(gi.Accounts, *ai)
+		}
+		sort.Slice(gi.Accounts, func(i, j int) bool { return gi.Accounts[i].Account < gi.Accounts[j].Account })
+		gis = append(gis, gi)
+	}
+	sort.Slice(gis, func(i, j int) bool { return gis[i].Name < gis[j].Name })
+	return gis
+}
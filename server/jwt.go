@@ -71,6 +71,14 @@ func wipeSlice(buf []byte) {
 // assigned trusted keys and trusted operators. If operators are defined we
 // will expand the trusted keys in options.
 func validateTrustedOperators(o *Options) error {
+	if len(o.AccountRevocations) > 0 && len(o.TrustedOperators) == 0 && len(o.TrustedKeys) == 0 {
+		return fmt.Errorf("account revocations require operators to be configured")
+	}
+	for pub := range o.AccountRevocations {
+		if !nkeys.IsValidPublicAccountKey(pub) {
+			return fmt.Errorf("account revocation %q is not a valid public account nkey", pub)
+		}
+	}
 	if len(o.TrustedOperators) == 0 {
 		return nil
 	}
@@ -106,3 +114,124 @@ func validateTrustedOperators(o *Options) error {
 	}
 	return nil
 }
+
+// accountRevoked returns true if the operator revoked the account JWT the
+// account was built from.
+func (s *Server) accountRevoked(acc *Account) bool {
+	revocations := s.getOpts().AccountRevocations
+	if len(revocations) == 0 {
+		return false
+	}
+	acc.mu.RLock()
+	name, issuedAt := acc.Name, acc.issuedAt
+	acc.mu.RUnlock()
+	return isRevoked(revocations, name, issuedAt)
+}
+
+// closeRevokedAccount closes the client and leafnode connections of an
+// account revoked by the operator.
+func (s *Server) closeRevokedAccount(acc *Account) {
+	acc.mu.RLock()
+	clients := make([]*client, 0, len(acc.clients))
+	for _, c := range acc.clients {
+		clients = append(clients, c)
+	}
+	acc.mu.RUnlock()
+	if len(clients) > 0 {
+		s.Noticef("Account %q revoked, closing %d connections", acc.Name, len(clients))
+	}
+	for _, c := range clients {
+		c.sendErrAndDebug("Account Authentication Revoked")
+		c.closeConnection(Revocation)
+	}
+}
+
+// closeRevokedAccounts closes the connections of all accounts revoked by
+// the operator.
+func (s *Server) closeRevokedAccounts() {
+	var revoked []*Account
+	s.accounts.Range(func(k, v interface{}) bool {
+		if acc := v.(*Account); s.accountRevoked(acc) {
+			revoked = append(revoked, acc)
+		}
+		return true
+	})
+	for _, acc := range revoked {
+		s.closeRevokedAccount(acc)
+	}
+}
+
+// UserUpdateResponse is sent back in response to a user JWT update with the
+// ids of the connections of the user whose permissions were updated.
+type UserUpdateResponse struct {
+	Server  ServerInfo `json:"server"`
+	User    string     `json:"user,omitempty"`
+	Updated []uint64   `json:"updated"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// userUpdateReq applies the permissions of the user JWT of the request to
+// the existing connections of the user, without them having to reconnect.
+func (s *Server) userUpdateReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var resp UserUpdateResponse
+	user, updated, err := s.updateUserClaims(strings.TrimSpace(string(msg)))
+	resp.User, resp.Updated = user, updated
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, &resp)
+	}
+}
+
+// updateUserClaims verifies the user JWT, issued by its account or one of
+// the account's signing keys, and updates the permissions of the connections
+// of the user. JWTs older than the one a connection authenticated with are
+// ignored. Returns the user and the ids of the updated connections.
+func (s *Server) updateUserClaims(userJWT string) (string, []uint64, error) {
+	juc, err := jwt.DecodeUserClaims(userJWT)
+	if err != nil {
+		return _EMPTY_, nil, err
+	}
+	vr := jwt.CreateValidationResults()
+	juc.Validate(vr)
+	if vr.IsBlocking(true) {
+		return juc.Subject, nil, fmt.Errorf("user JWT not valid")
+	}
+	issuer := juc.Issuer
+	if juc.IssuerAccount != _EMPTY_ {
+		issuer = juc.IssuerAccount
+	}
+	acc, err := s.LookupAccount(issuer)
+	if err != nil {
+		return juc.Subject, nil, err
+	}
+	if juc.IssuerAccount != _EMPTY_ && !acc.hasIssuer(juc.Issuer) {
+		return juc.Subject, nil, fmt.Errorf("user JWT issuer is not known")
+	}
+	if acc.checkUserRevoked(juc.Subject, juc.IssuedAt) {
+		return juc.Subject, nil, fmt.Errorf("user authentication revoked")
+	}
+	nu := buildInternalNkeyUser(juc, acc)
+	updated := []uint64{}
+	for _, c := range acc.localClients() {
+		c.mu.Lock()
+		match := c.kind == CLIENT && c.user != nil && c.user.Nkey == nu.Nkey && c.user.issuedAt <= nu.issuedAt
+		if match {
+			c.user = nu
+		}
+		cid := c.cid
+		c.mu.Unlock()
+		if match {
+			c.updatePermissions(nu.Permissions)
+			updated = append(updated, cid)
+		}
+	}
+	if len(updated) > 0 {
+		s.Noticef("Updated the permissions of %d connection(s) of user %q", len(updated), nu.Nkey)
+	}
+	return nu.Nkey, updated, nil
+}
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 )
 
@@ -2449,3 +2450,101 @@ func TestJWTAccountLimitsMaxConnsAfterExpired(t *testing.T) {
 		return nil
 	})
 }
+
+func TestJWTUserRevocationsReplaced(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	s := opTrustBasicSetup()
+	defer s.Shutdown()
+	buildMemAccResolver(s)
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nkp, _ := nkeys.CreateUser()
+	pub, _ := nkp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	// Only the user JWTs issued up to an hour ago are revoked.
+	nac.RevokeAt(pub, time.Now().Add(-time.Hour))
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	addAccountToMemResolver(s, apub, ajwt)
+	acc, err := s.LookupAccount(apub)
+	if err != nil {
+		t.Fatalf("Error looking up the account: %v", err)
+	}
+	if acc.checkUserRevoked(pub, time.Now().Unix()) {
+		t.Fatal("Expected user JWT issued after the revocation to be valid")
+	}
+	if !acc.checkUserRevoked(pub, time.Now().Add(-2*time.Hour).Unix()) {
+		t.Fatal("Expected user JWT issued before the revocation to be revoked")
+	}
+
+	// An update without the revocation clears it.
+	nac = jwt.NewAccountClaims(apub)
+	nac.Name = "updated"
+	ajwt, err = nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	if err := s.updateAccountWithClaimJWT(acc, ajwt); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	if acc.checkUserRevoked(pub, time.Now().Add(-2*time.Hour).Unix()) {
+		t.Fatal("Expected revocation to be cleared")
+	}
+}
+
+func TestJWTAccountRevokedByOperator(t *testing.T) {
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(okp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	template := `
+		listen: "127.0.0.1:-1"
+		trusted: %q
+		resolver: MEMORY
+		resolver_preload { %s: %q }
+		account_revocations { %s: %d }
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, opub, apub, ajwt, apub, time.Now().Add(-time.Hour).Unix())))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 1)
+	nc, err := nats.Connect(s.ClientURL(), createUserCreds(t, s, akp), nats.NoReconnect(),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			errCh <- nc.LastError()
+		}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Revoke the account JWTs issued up to now, which closes the connection.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(template, opub, apub, ajwt, apub, time.Now().Add(time.Second).Unix()))
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "Account Authentication Revoked") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected connection to be closed")
+	}
+
+	// New connections are rejected as well.
+	if nc, err := nats.Connect(s.ClientURL(), createUserCreds(t, s, akp)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be rejected")
+	}
+	if _, _, err := s.verifyAccountClaims(ajwt); err != ErrAccountRevoked {
+		t.Fatalf("Expected %v, got %v", ErrAccountRevoked, err)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyProvider loads private keys from an external store, such as an HSM,
+// a KMS or a secrets manager, so that they don't have to be kept on disk.
+// A key is referenced in the configuration by a URL whose scheme is the
+// one the provider was registered with, for instance as the `key_file` of
+// a tls block or as the `server_key_file` of the server.
+type KeyProvider interface {
+	// PrivateKey returns the TLS private key referenced by u. Keys that
+	// can't leave the store should be returned as a crypto.Signer.
+	PrivateKey(u *url.URL) (crypto.PrivateKey, error)
+	// Seed returns the NKey seed referenced by u.
+	Seed(u *url.URL) ([]byte, error)
+}
+
+var keyProviders = struct {
+	sync.RWMutex
+	m map[string]KeyProvider
+}{m: map[string]KeyProvider{
+	"env":   envKeyProvider{},
+	"vault": &vaultKeyProvider{client: &http.Client{Timeout: 10 * time.Second}},
+}}
+
+// RegisterKeyProvider registers the provider of the keys referenced by
+// URLs with the given scheme. This is how applications embedding the
+// server plug in providers, for instance using PKCS#11 or a cloud KMS.
+// Registering a nil provider removes the scheme.
+func RegisterKeyProvider(scheme string, p KeyProvider) {
+	scheme = strings.ToLower(scheme)
+	keyProviders.Lock()
+	defer keyProviders.Unlock()
+	if p == nil {
+		delete(keyProviders.m, scheme)
+	} else {
+		keyProviders.m[scheme] = p
+	}
+}
+
+// keyProviderFor returns the provider of the given key reference and its
+// parsed URL, or nil if it is a file name.
+func keyProviderFor(ref string) (KeyProvider, *url.URL) {
+	i := strings.Index(ref, "://")
+	if i <= 0 {
+		return nil, nil
+	}
+	keyProviders.RLock()
+	p := keyProviders.m[strings.ToLower(ref[:i])]
+	keyProviders.RUnlock()
+	if p == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, nil
+	}
+	return p, u
+}
+
+// loadProviderCertificate loads the certificate chain from certFile and
+// its private key from the given provider.
+func loadProviderCertificate(certFile string, p KeyProvider, u *url.URL) (tls.Certificate, error) {
+	var cert tls.Certificate
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return cert, fmt.Errorf("error reading X509 certificate: %v", err)
+	}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, fmt.Errorf("error parsing X509 certificate: no certificate found in %q", certFile)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return cert, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	key, err := p.PrivateKey(u)
+	if err != nil {
+		return cert, fmt.Errorf("error loading private key %q: %v", u.Redacted(), err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return cert, fmt.Errorf("private key %q is not a signer", u.Redacted())
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.Leaf.PublicKey) {
+		return cert, fmt.Errorf("private key %q does not match the certificate", u.Redacted())
+	}
+	cert.PrivateKey = key
+	return cert, nil
+}
+
+// Keys are PEM encoded, or seeds, in environment variables: env://NAME
+type envKeyProvider struct{}
+
+func (envKeyProvider) value(u *url.URL) ([]byte, error) {
+	name := u.Host + u.Path
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %q is not set", name)
+	}
+	return []byte(v), nil
+}
+
+func (p envKeyProvider) PrivateKey(u *url.URL) (crypto.PrivateKey, error) {
+	v, err := p.value(u)
+	if err != nil {
+		return nil, err
+	}
+	return parsePEMPrivateKey(v)
+}
+
+func (p envKeyProvider) Seed(u *url.URL) ([]byte, error) {
+	return p.value(u)
+}
+
+// Keys are fields of secrets stored in HashiCorp Vault, read with the
+// token and from the address of the VAULT_TOKEN and VAULT_ADDR environment
+// variables: vault://secret/data/nats?field=tls_key. Both the v1 and v2
+// versions of the key/value secrets engine are supported.
+type vaultKeyProvider struct {
+	client *http.Client
+}
+
+func (p *vaultKeyProvider) value(u *url.URL) ([]byte, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == _EMPTY_ {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	field := u.Query().Get("field")
+	if field == _EMPTY_ {
+		return nil, fmt.Errorf("missing field of the vault secret")
+	}
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+u.Host+u.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned status %d", resp.StatusCode)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("error decoding vault secret: %v", err)
+	}
+	data := secret.Data
+	// The v2 engine nests the secret's data along with its metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault secret has no field %q", field)
+	}
+	return []byte(v), nil
+}
+
+func (p *vaultKeyProvider) PrivateKey(u *url.URL) (crypto.PrivateKey, error) {
+	v, err := p.value(u)
+	if err != nil {
+		return nil, err
+	}
+	return parsePEMPrivateKey(v)
+}
+
+func (p *vaultKeyProvider) Seed(u *url.URL) ([]byte, error) {
+	return p.value(u)
+}
+
+// parsePEMPrivateKey parses a PKCS#1, PKCS#8 or EC private key.
+func parsePEMPrivateKey(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("failed to parse private key")
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+// Simulates a key that can't leave its store, such as in an HSM.
+type testSigner struct {
+	signer crypto.Signer
+}
+
+func (s *testSigner) Public() crypto.PublicKey { return s.signer.Public() }
+
+func (s *testSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+type testKeyProvider struct {
+	keyFile string
+}
+
+func (p *testKeyProvider) PrivateKey(u *url.URL) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(p.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePEMPrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return &testSigner{signer: key.(crypto.Signer)}, nil
+}
+
+func (p *testKeyProvider) Seed(u *url.URL) ([]byte, error) {
+	return nil, fmt.Errorf("no seed")
+}
+
+func checkKeyProviderTLS(t *testing.T, keyFile string) {
+	t.Helper()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		https: 127.0.0.1:-1
+		tls {
+			cert_file: "./configs/certs/server.pem"
+			key_file: %q
+		}
+	`, keyFile)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(fmt.Sprintf("https://%s/varz", s.MonitorAddr()))
+	if err != nil {
+		t.Fatalf("Error on get: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestKeyProviderCustom(t *testing.T) {
+	RegisterKeyProvider("hsm", &testKeyProvider{keyFile: "./configs/certs/key.pem"})
+	defer RegisterKeyProvider("hsm", nil)
+
+	checkKeyProviderTLS(t, "hsm://slot/0")
+
+	// The key has to match the certificate.
+	RegisterKeyProvider("hsm", &testKeyProvider{keyFile: "./configs/certs/key.new.pem"})
+	if _, err := loadCertificate("./configs/certs/server.pem", "hsm://slot/0"); err == nil ||
+		!strings.Contains(err.Error(), "does not match the certificate") {
+		t.Fatalf("Expected mismatch error, got %v", err)
+	}
+
+	// Once removed, the reference is a file name again.
+	RegisterKeyProvider("hsm", nil)
+	if p, _ := keyProviderFor("hsm://slot/0"); p != nil {
+		t.Fatal("Expected no provider")
+	}
+}
+
+func TestKeyProviderEnv(t *testing.T) {
+	key, err := ioutil.ReadFile("./configs/certs/key.pem")
+	if err != nil {
+		t.Fatalf("Error reading key: %v", err)
+	}
+	skp, _ := nkeys.CreateServer()
+	spub, _ := skp.PublicKey()
+	seed, _ := skp.Seed()
+	os.Setenv("NATS_TEST_TLS_KEY", string(key))
+	defer os.Unsetenv("NATS_TEST_TLS_KEY")
+	os.Setenv("NATS_TEST_SERVER_SEED", string(seed))
+	defer os.Unsetenv("NATS_TEST_SERVER_SEED")
+
+	checkKeyProviderTLS(t, "env://NATS_TEST_TLS_KEY")
+
+	opts := DefaultOptions()
+	opts.ServerKeyFile = "env://NATS_TEST_SERVER_SEED"
+	s := RunServer(opts)
+	defer s.Shutdown()
+	if s.ID() != spub {
+		t.Fatalf("Expected server ID to be %q, got %q", spub, s.ID())
+	}
+
+	opts = DefaultOptions()
+	opts.ServerKeyFile = "env://NATS_TEST_MISSING"
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "is not set") {
+		t.Fatalf("Expected error about missing variable, got %v", err)
+	}
+}
+
+func TestKeyProviderVault(t *testing.T) {
+	key, err := ioutil.ReadFile("./configs/certs/key.pem")
+	if err != nil {
+		t.Fatalf("Error reading key: %v", err)
+	}
+	skp, _ := nkeys.CreateServer()
+	spub, _ := skp.PublicKey()
+	seed, _ := skp.Seed()
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var secret interface{}
+		switch r.URL.Path {
+		case "/v1/secret/data/nats":
+			// Key/value engine v2
+			secret = map[string]interface{}{"data": map[string]interface{}{
+				"data":     map[string]string{"tls_key": string(key)},
+				"metadata": map[string]interface{}{"version": 1},
+			}}
+		case "/v1/kv/nats":
+			// Key/value engine v1
+			secret = map[string]interface{}{"data": map[string]string{"seed": string(seed)}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	}))
+	defer vault.Close()
+
+	os.Setenv("VAULT_ADDR", vault.URL)
+	defer os.Unsetenv("VAULT_ADDR")
+	os.Setenv("VAULT_TOKEN", "s.token")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	checkKeyProviderTLS(t, "vault://secret/data/nats?field=tls_key")
+
+	opts := DefaultOptions()
+	opts.ServerKeyFile = "vault://kv/nats?field=seed"
+	s := RunServer(opts)
+	defer s.Shutdown()
+	if s.ID() != spub {
+		t.Fatalf("Expected server ID to be %q, got %q", spub, s.ID())
+	}
+
+	for _, test := range []struct {
+		ref string
+		err string
+	}{
+		{"vault://kv/nats?field=other", "has no field"},
+		{"vault://kv/other?field=seed", "status 404"},
+		{"vault://kv/nats", "missing field"},
+	} {
+		opts := DefaultOptions()
+		opts.ServerKeyFile = test.ref
+		if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error containing %q for %q, got %v", test.err, test.ref, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// KickRequest is a request to close client connections, either a given
+// connection, or all the connections of a user or of an account.
+type KickRequest struct {
+	CID     uint64 `json:"cid,omitempty"`
+	User    string `json:"user,omitempty"`
+	Account string `json:"account,omitempty"`
+	// Reason, if set, is sent to the clients as an error before
+	// their connection is closed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// KickResponse is sent back in response to a KickRequest with the ids of
+// the connections that were closed.
+type KickResponse struct {
+	Server ServerInfo `json:"server"`
+	Closed []uint64   `json:"closed"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// Kick closes the client connections selected by the request and returns
+// their ids.
+func (s *Server) Kick(req *KickRequest) ([]uint64, error) {
+	if req.CID == 0 && req.User == _EMPTY_ && req.Account == _EMPTY_ {
+		return nil, fmt.Errorf("a connection id, user or account is required")
+	}
+	var clients []*client
+	s.mu.Lock()
+	if req.CID != 0 {
+		if c := s.clients[req.CID]; c != nil {
+			clients = append(clients, c)
+		}
+	} else {
+		clients = make([]*client, 0, len(s.clients))
+		for _, c := range s.clients {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.Unlock()
+
+	closed := []uint64{}
+	for _, c := range clients {
+		c.mu.Lock()
+		match := (req.User == _EMPTY_ || c.opts.Username == req.User || c.opts.Nkey == req.User) &&
+			(req.Account == _EMPTY_ || (c.acc != nil && c.acc.Name == req.Account))
+		cid := c.cid
+		c.mu.Unlock()
+		if !match {
+			continue
+		}
+		if req.Reason != _EMPTY_ {
+			c.sendErr(req.Reason)
+		}
+		c.closeConnection(Kicked)
+		closed = append(closed, cid)
+	}
+	if req.CID != 0 && len(closed) == 0 {
+		return nil, fmt.Errorf("connection %d not found", req.CID)
+	}
+	if len(closed) > 0 {
+		s.Noticef("Closed %d client connection(s) on request", len(closed))
+	}
+	return closed, nil
+}
+
+// kickReq is a request to close client connections. Connection ids are
+// only meaningful for a given server, so the request sent to all servers
+// selects the connections by user or account.
+func (s *Server) kickReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var req KickRequest
+	var resp KickResponse
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = fmt.Sprintf("error unmarshalling request: %v", err)
+	} else if subject == kickPingReqSubj && req.CID != 0 {
+		resp.Error = "a connection id requires the request to be sent to a given server"
+	} else if closed, err := s.Kick(&req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Closed = closed
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, &resp)
+	}
+}
+
+// HandleConnzClose process HTTP requests to close client connections,
+// either `POST /connz/<cid>/close`, or `POST /connz/close` for all the
+// connections of the `user` or `account` of the JSON body. The `reason`
+// of the body, if set, is sent to the clients.
+func (s *Server) HandleConnzClose(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[ConnzPath]++
+	s.mu.Unlock()
+
+	req := &KickRequest{}
+	if !decodeMonitorRequest(w, r, "Connections can be closed", req) {
+		return
+	}
+	// The connection id is only taken from the path.
+	req.CID = 0
+	path := strings.TrimPrefix(r.URL.Path, ConnzPath+"/")
+	if path != "close" {
+		cid, err := strconv.ParseUint(strings.TrimSuffix(path, "/close"), 10, 64)
+		if err != nil || !strings.HasSuffix(path, "/close") || cid == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("Unknown path %q", r.URL.Path)))
+			return
+		}
+		req.CID = cid
+	}
+	closed, err := s.Kick(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.mu.Lock()
+	resp := &KickResponse{Server: ServerInfo{Name: s.info.Name, Host: s.info.Host, ID: s.info.ID}, Closed: closed}
+	s.mu.Unlock()
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /connz close request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestKickConnections(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		monitor { token: secret }
+		accounts {
+			SYS { users [{user: admin, password: pwd}] }
+			A { users [{user: a1, password: pwd}, {user: a2, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+		system_account: SYS
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(user string) (*nats.Conn, uint64) {
+		t.Helper()
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, "pwd"), nats.NoReconnect())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		cid, _ := nc.GetClientID()
+		return nc, cid
+	}
+	checkClosed := func(nc *nats.Conn) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			if !nc.IsClosed() {
+				return fmt.Errorf("Expected connection to be closed")
+			}
+			return nil
+		})
+	}
+
+	// Close a given connection over HTTP.
+	na1, cid := connect("a1")
+	defer na1.Close()
+	baseURL := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, ConnzPath)
+	post := func(method, url, contentType, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		if contentType != _EMPTY_ {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		return resp
+	}
+	if resp := post(http.MethodGet, fmt.Sprintf("%s/%d/close", baseURL, cid), _EMPTY_, _EMPTY_); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected GET to be rejected, got %v", resp.StatusCode)
+	}
+	// Browsers can send forms across origins without a preflight request.
+	for _, ct := range []string{_EMPTY_, "text/plain", "application/x-www-form-urlencoded"} {
+		if resp := post(http.MethodPost, fmt.Sprintf("%s/%d/close", baseURL, cid), ct, `{}`); resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Fatalf("Expected a %q request to be rejected, got %v", ct, resp.StatusCode)
+		}
+	}
+	resp := post(http.MethodPost, fmt.Sprintf("%s/%d/close", baseURL, cid), "application/json", `{"reason": "evicted"}`)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var kr KickResponse
+	if err := json.Unmarshal(body, &kr); err != nil {
+		t.Fatalf("Error unmarshalling response %q: %v", body, err)
+	}
+	if len(kr.Closed) != 1 || kr.Closed[0] != cid {
+		t.Fatalf("Unexpected response: %+v", kr)
+	}
+	checkClosed(na1)
+	if err := na1.LastError(); err == nil || !strings.Contains(err.Error(), "evicted") {
+		t.Fatalf("Expected the reason to be sent, got %v", err)
+	}
+	if conns := s.closedClients(); len(conns) != 1 || conns[0].Reason != Kicked.String() {
+		t.Fatalf("Unexpected closed connections: %+v", conns)
+	}
+	if resp := post(http.MethodPost, fmt.Sprintf("%s/%d/close", baseURL, cid), "application/json", _EMPTY_); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown connection to be rejected, got %v", resp.StatusCode)
+	}
+
+	// Close all the connections of an account through the system account.
+	na1, _ = connect("a1")
+	defer na1.Close()
+	na2, _ := connect("a2")
+	defer na2.Close()
+	nb, _ := connect("b")
+	defer nb.Close()
+	ncs, err := nats.Connect(s.ClientURL(), nats.UserInfo("admin", "pwd"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer ncs.Close()
+	kick := func(subject string, req *KickRequest) *KickResponse {
+		t.Helper()
+		b, _ := json.Marshal(req)
+		msg, err := ncs.Request(subject, b, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &KickResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		return resp
+	}
+	if resp := kick(kickPingReqSubj, &KickRequest{CID: 1}); resp.Error == _EMPTY_ {
+		t.Fatal("Expected an error for a connection id sent to all servers")
+	}
+	if resp := kick(kickPingReqSubj, &KickRequest{}); resp.Error == _EMPTY_ {
+		t.Fatal("Expected an error without selection")
+	}
+	if resp := kick(fmt.Sprintf(kickReqSubj, s.ID()), &KickRequest{Account: "A"}); resp.Error != _EMPTY_ || len(resp.Closed) != 2 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkClosed(na1)
+	checkClosed(na2)
+
+	// And of a user.
+	if resp := kick(kickPingReqSubj, &KickRequest{User: "b"}); resp.Error != _EMPTY_ || len(resp.Closed) != 1 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkClosed(nb)
+	if ncs.IsClosed() {
+		t.Fatal("Expected the system account connection to remain")
+	}
+}
+
+func TestKickConnectionsRequiresMonitorAuth(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	cid, _ := nc.GetClientID()
+	url := fmt.Sprintf("http://127.0.0.1:%d%s/%d/close", s.MonitorAddr().Port, ConnzPath, cid)
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("Error on POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected closing connections not to be served, got %v", resp.StatusCode)
+	}
+	if nc.IsClosed() {
+		t.Fatal("Expected the connection to remain")
+	}
+}
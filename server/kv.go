@@ -0,0 +1,881 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of the subjects of the key-value API, followed by the
+	// operation, the bucket and, for the operations on a key, the key.
+	kvAPIPrefix = "$KV.API."
+	// Prefix of the subjects on which the changes of the keys are
+	// published, followed by the bucket and the key.
+	kvWatchPrefix = "$KV."
+
+	kvOpCreate  = "CREATE"
+	kvOpDestroy = "DESTROY"
+	kvOpPut     = "PUT"
+	kvOpGet     = "GET"
+	kvOpDel     = "DEL"
+	kvOpHistory = "HISTORY"
+	kvOpKeys    = "KEYS"
+	kvOpInfo    = "INFO"
+
+	// Discard policies of the buckets, when a retention limit is reached
+	// the oldest entries are discarded, or the new entry is rejected.
+	KVDiscardOld = "old"
+	KVDiscardNew = "new"
+
+	// Maximum number of values kept per key.
+	kvMaxHistory = 64
+
+	// Extensions of the files of a stored bucket, its configuration and
+	// the log of its entries.
+	kvBucketExt = ".json"
+	kvLogExt    = ".log"
+
+	// Maximum number of API requests waiting for the store, the requests
+	// over it being rejected.
+	kvMaxPendingRequests = 1024
+)
+
+var (
+	kvValidBucket = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	// Default interval of the enforcement of the retention limits of the
+	// buckets and of the compaction of their logs.
+	kvCompactInterval = time.Minute
+
+	errKVBucketExists   = errors.New("bucket already exists")
+	errKVBucketNotFound = errors.New("bucket not found")
+	errKVKeyNotFound    = errors.New("key not found")
+	errKVTooManyPending = errors.New("too many pending requests")
+)
+
+// kvLimits are the key-value store limits of an account, a zero value
+// meaning no limit.
+type kvLimits struct {
+	maxBuckets   int
+	maxBytes     int64
+	maxHistory   int
+	maxValueSize int
+}
+
+// KVEntry is a value of a key, or the deletion of the key.
+type KVEntry struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Value    []byte    `json:"value,omitempty"`
+	Revision uint64    `json:"revision"`
+	Created  time.Time `json:"created"`
+	Delete   bool      `json:"delete,omitempty"`
+}
+
+// KVBucketConfig is the optional payload of a bucket creation request.
+type KVBucketConfig struct {
+	// Number of values kept per key, 1 by default.
+	History int `json:"history,omitempty"`
+	// Age after which the entries are removed.
+	MaxAge time.Duration `json:"max_age,omitempty"`
+	// Maximum size and number of the entries kept by the bucket.
+	MaxBytes   int64 `json:"max_bytes,omitempty"`
+	MaxEntries int64 `json:"max_entries,omitempty"`
+	// KVDiscardOld, the default, or KVDiscardNew.
+	Discard string `json:"discard,omitempty"`
+}
+
+// KVBucketInfo is the state of a bucket. The entries expired or discarded
+// by its retention limits, and the space reclaimed by the compactions of
+// its log, are counted since the store was started.
+type KVBucketInfo struct {
+	Name        string         `json:"name"`
+	Config      KVBucketConfig `json:"config"`
+	Entries     int            `json:"entries"`
+	Bytes       int64          `json:"bytes"`
+	Revision    uint64         `json:"revision"`
+	Expired     uint64         `json:"expired"`
+	Discarded   uint64         `json:"discarded"`
+	Compactions uint64         `json:"compactions"`
+	Reclaimed   int64          `json:"reclaimed_bytes"`
+}
+
+// KVResponse is the response to the key-value API requests.
+type KVResponse struct {
+	Entry   *KVEntry      `json:"entry,omitempty"`
+	History []*KVEntry    `json:"history,omitempty"`
+	Keys    []string      `json:"keys,omitempty"`
+	Bucket  *KVBucketInfo `json:"bucket,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// kvBucket holds the values of the keys of a bucket, oldest first, and
+// the entries in the order they were added, some of which may no longer
+// be kept, for the retention limits.
+type kvBucket struct {
+	name    string
+	cfg     KVBucketConfig
+	rev     uint64
+	keys    map[string][]*KVEntry
+	order   []*KVEntry
+	entries int
+	bytes   int64
+	// Number of entries in the log, including the ones no longer kept.
+	logged int
+
+	expired     uint64
+	discarded   uint64
+	compactions uint64
+	reclaimed   int64
+}
+
+// kvStore is the key-value store of an account. The buckets are local to
+// this server and are stored in dir, if set.
+type kvStore struct {
+	mu      sync.Mutex
+	account string
+	limits  kvLimits
+	dir     string
+	buckets map[string]*kvBucket
+	bytes   int64
+	cipher  *storeCipher
+	client  *client
+	sub     *subscription
+	reqs    chan *kvReq
+	quit    chan struct{}
+}
+
+// kvReq is an API request waiting for the store.
+type kvReq struct {
+	subject string
+	reply   string
+	msg     []byte
+}
+
+// Size accounted for an entry.
+func kvEntrySize(e *KVEntry) int64 {
+	return int64(len(e.Key) + len(e.Value))
+}
+
+// configureKV starts the key-value store of the accounts configured with
+// one, updates the limits of the existing ones and stops the ones of the
+// accounts no longer configured with one.
+func (s *Server) configureKV() {
+	s.mu.Lock()
+	if s.kv == nil {
+		s.kv = make(map[string]*kvStore)
+	}
+	stores := make(map[string]*kvStore, len(s.kv))
+	for name, kvs := range s.kv {
+		stores[name] = kvs
+	}
+	s.mu.Unlock()
+
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		limits := acc.kv
+		acc.mu.RUnlock()
+		kvs := stores[acc.Name]
+		delete(stores, acc.Name)
+		switch {
+		case limits == nil && kvs != nil:
+			s.stopKV(acc, kvs)
+		case limits != nil && kvs != nil:
+			kvs.mu.Lock()
+			kvs.limits = *limits
+			kvs.mu.Unlock()
+		case limits != nil:
+			if !s.EventsEnabled() {
+				s.Warnf("Key-value store of account %q requires a system account", acc.Name)
+				return true
+			}
+			if err := s.startKV(acc, *limits); err != nil {
+				s.Errorf("Error starting key-value store of account %q: %v", acc.Name, err)
+			}
+		}
+		return true
+	})
+	// The accounts that were removed.
+	for _, kvs := range stores {
+		s.stopKV(nil, kvs)
+	}
+}
+
+// startKV loads the buckets of the account and subscribes to its API.
+func (s *Server) startKV(acc *Account, limits kvLimits) error {
+	kvs := &kvStore{
+		account: acc.Name,
+		limits:  limits,
+		buckets: make(map[string]*kvBucket),
+		reqs:    make(chan *kvReq, kvMaxPendingRequests),
+		quit:    make(chan struct{}),
+	}
+	opts := s.getOpts().KV
+	if dir := opts.StoreDir; dir != _EMPTY_ {
+		kvs.dir = filepath.Join(dir, acc.Name)
+		var err error
+		if kvs.cipher, err = s.storeCipher("kv/" + acc.Name); err != nil {
+			return err
+		}
+		if err := kvs.load(); err != nil {
+			return err
+		}
+	}
+
+	// The API is only served by this server, so the interest is not
+	// propagated to the other servers.
+	c, sub, err := s.accountSubscribeInternal(acc, kvAPIPrefix+">", s.kvRequestHandler(kvs))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.kv[acc.Name] = kvs
+	s.mu.Unlock()
+
+	kvs.mu.Lock()
+	kvs.client, kvs.sub = c, sub
+	n := len(kvs.buckets)
+	kvs.mu.Unlock()
+
+	interval := opts.CompactInterval
+	if interval <= 0 {
+		interval = kvCompactInterval
+	}
+	s.startGoRoutine(func() { s.runKV(kvs, interval) })
+	s.Noticef("Key-value store of account %q started with %d bucket(s)", acc.Name, n)
+	return nil
+}
+
+// runKV processes the API requests of the store, and enforces the
+// retention limits of its buckets and compacts their logs at a jittered
+// interval so that the stores of the accounts do not all do it at once.
+func (s *Server) runKV(kvs *kvStore, interval time.Duration) {
+	defer s.grWG.Done()
+	jitter := func() time.Duration {
+		return interval - interval/10 + time.Duration(rand.Int63n(int64(interval/5)+1))
+	}
+	t := time.NewTimer(jitter())
+	defer t.Stop()
+	for {
+		select {
+		case req := <-kvs.reqs:
+			s.processKVRequest(kvs, req)
+		case <-t.C:
+			if err := kvs.compactBuckets(time.Now()); err != nil {
+				s.Warnf("Error compacting key-value store of account %q: %v", kvs.account, err)
+			}
+			t.Reset(jitter())
+		case <-kvs.quit:
+			return
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// stopKV unsubscribes from the API of the account, the stored buckets are
+// kept.
+func (s *Server) stopKV(acc *Account, kvs *kvStore) {
+	kvs.mu.Lock()
+	sub := kvs.sub
+	kvs.sub = nil
+	close(kvs.quit)
+	kvs.mu.Unlock()
+
+	s.mu.Lock()
+	delete(s.kv, kvs.account)
+	s.mu.Unlock()
+	if sub != nil {
+		s.accountUnsubscribeInternal(acc, kvs.client, sub)
+	}
+	s.Noticef("Key-value store of account %q stopped", kvs.account)
+}
+
+// kvRequestHandler returns the handler of the API requests of the store.
+// It is invoked by the publishers, and so never waits for the store: the
+// requests are queued for runKV, and rejected if too many are pending.
+func (s *Server) kvRequestHandler(kvs *kvStore) msgHandler {
+	return func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		if c != nil && c.pa.hdr > 0 && c.pa.hdr <= len(msg) {
+			msg = msg[c.pa.hdr:]
+		}
+		req := &kvReq{subject: subject, reply: reply, msg: append([]byte(nil), msg...)}
+		select {
+		case kvs.reqs <- req:
+		default:
+			if reply == _EMPTY_ {
+				return
+			}
+			if acc, err := s.LookupAccount(kvs.account); err == nil {
+				s.sendInternalAccountMsg(acc, reply, &KVResponse{Error: errKVTooManyPending.Error()})
+			}
+		}
+	}
+}
+
+// processKVRequest serves an API request of the store.
+func (s *Server) processKVRequest(kvs *kvStore, req *kvReq) {
+	msg := req.msg
+	tokens := strings.SplitN(strings.TrimPrefix(req.subject, kvAPIPrefix), tsep, 3)
+	op, bucket, key := tokens[0], _EMPTY_, _EMPTY_
+	if len(tokens) > 1 {
+		bucket = tokens[1]
+	}
+	if len(tokens) > 2 {
+		key = tokens[2]
+	}
+
+	resp := &KVResponse{}
+	var err error
+	switch op {
+	case kvOpCreate:
+		var cfg KVBucketConfig
+		if len(msg) > 0 {
+			err = json.Unmarshal(msg, &cfg)
+		}
+		if err == nil {
+			err = kvs.createBucket(bucket, cfg)
+		}
+	case kvOpDestroy:
+		err = kvs.destroyBucket(bucket)
+	case kvOpPut:
+		resp.Entry, err = kvs.put(bucket, key, msg, false)
+	case kvOpDel:
+		resp.Entry, err = kvs.put(bucket, key, nil, true)
+	case kvOpGet:
+		resp.Entry, err = kvs.get(bucket, key)
+	case kvOpHistory:
+		resp.History, err = kvs.history(bucket, key)
+	case kvOpKeys:
+		resp.Keys, err = kvs.keys(bucket)
+	case kvOpInfo:
+		resp.Bucket, err = kvs.info(bucket)
+	default:
+		err = fmt.Errorf("unknown operation %q", op)
+	}
+
+	acc, aerr := s.LookupAccount(kvs.account)
+	if aerr != nil {
+		return
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else if op == kvOpPut || op == kvOpDel {
+		// Let the watchers know about the change.
+		s.sendInternalAccountMsg(acc, kvWatchPrefix+bucket+tsep+key, resp.Entry)
+	}
+	if req.reply != _EMPTY_ {
+		s.sendInternalAccountMsg(acc, req.reply, resp)
+	}
+}
+
+// Returns the bucket, lock should be held.
+func (kvs *kvStore) bucket(name string) (*kvBucket, error) {
+	b := kvs.buckets[name]
+	if b == nil {
+		return nil, errKVBucketNotFound
+	}
+	return b, nil
+}
+
+func (kvs *kvStore) createBucket(name string, cfg KVBucketConfig) error {
+	if !kvValidBucket.MatchString(name) || name == "API" {
+		return fmt.Errorf("invalid bucket name %q", name)
+	}
+	if cfg.History == 0 {
+		cfg.History = 1
+	}
+	if cfg.MaxAge < 0 || cfg.MaxBytes < 0 || cfg.MaxEntries < 0 {
+		return fmt.Errorf("invalid retention limits")
+	}
+	switch cfg.Discard {
+	case _EMPTY_:
+		cfg.Discard = KVDiscardOld
+	case KVDiscardOld, KVDiscardNew:
+	default:
+		return fmt.Errorf("invalid discard policy %q", cfg.Discard)
+	}
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	if cfg.History < 0 || cfg.History > kvMaxHistory ||
+		(kvs.limits.maxHistory > 0 && cfg.History > kvs.limits.maxHistory) {
+		return fmt.Errorf("invalid history %d", cfg.History)
+	}
+	if kvs.buckets[name] != nil {
+		return errKVBucketExists
+	}
+	if kvs.limits.maxBuckets > 0 && len(kvs.buckets) >= kvs.limits.maxBuckets {
+		return fmt.Errorf("maximum of %d buckets reached", kvs.limits.maxBuckets)
+	}
+	if kvs.dir != _EMPTY_ {
+		if err := kvs.storeBucket(name, cfg); err != nil {
+			return fmt.Errorf("unable to store the bucket: %v", err)
+		}
+	}
+	kvs.buckets[name] = &kvBucket{name: name, cfg: cfg, keys: make(map[string][]*KVEntry)}
+	return nil
+}
+
+func (kvs *kvStore) destroyBucket(name string) error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	b, err := kvs.bucket(name)
+	if err != nil {
+		return err
+	}
+	if kvs.dir != _EMPTY_ {
+		if err := os.Remove(filepath.Join(kvs.dir, name+kvBucketExt)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove the bucket: %v", err)
+		}
+		os.Remove(filepath.Join(kvs.dir, name+kvLogExt))
+		if err := syncDir(kvs.dir); err != nil {
+			return fmt.Errorf("unable to remove the bucket: %v", err)
+		}
+	}
+	kvs.bytes -= b.bytes
+	delete(kvs.buckets, name)
+	return nil
+}
+
+// put adds a value, or the deletion of the key, to its history.
+func (kvs *kvStore) put(bucket, key string, value []byte, del bool) (*KVEntry, error) {
+	if !IsValidLiteralSubject(key) {
+		return nil, fmt.Errorf("invalid key %q", key)
+	}
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	b, err := kvs.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if del {
+		if entries := b.keys[key]; len(entries) == 0 || entries[len(entries)-1].Delete {
+			return nil, errKVKeyNotFound
+		}
+	}
+	if max := kvs.limits.maxValueSize; max > 0 && len(value) > max {
+		return nil, fmt.Errorf("value size %d exceeds the maximum of %d", len(value), max)
+	}
+	e := &KVEntry{
+		Bucket:   bucket,
+		Key:      key,
+		Value:    value,
+		Revision: b.rev + 1,
+		Created:  time.Now().UTC(),
+		Delete:   del,
+	}
+	if max := kvs.limits.maxBytes; max > 0 {
+		size := kvs.bytes + kvEntrySize(e)
+		if entries := b.keys[key]; len(entries) >= b.cfg.History {
+			size -= kvEntrySize(entries[0])
+		}
+		if size > max {
+			return nil, fmt.Errorf("maximum of %d bytes reached", max)
+		}
+	}
+	if err := b.checkLimits(e); err != nil {
+		return nil, err
+	}
+	if kvs.dir != _EMPTY_ {
+		if err := kvs.appendLog(bucket, e); err != nil {
+			return nil, fmt.Errorf("unable to store the value: %v", err)
+		}
+		b.logged++
+	}
+	kvs.bytes += b.apply(e)
+	kvs.bytes += b.trim(e.Created)
+	return e, nil
+}
+
+// checkLimits returns an error if the entry can not be added within the
+// retention limits of the bucket.
+func (b *kvBucket) checkLimits(e *KVEntry) error {
+	size := kvEntrySize(e)
+	if max := b.cfg.MaxBytes; max > 0 && size > max {
+		return fmt.Errorf("entry size %d exceeds the bucket maximum of %d bytes", size, max)
+	}
+	if b.cfg.Discard != KVDiscardNew {
+		return nil
+	}
+	entries, bytes := int64(b.entries)+1, b.bytes+size
+	if h := b.keys[e.Key]; len(h) >= b.cfg.History {
+		entries--
+		bytes -= kvEntrySize(h[0])
+	}
+	if max := b.cfg.MaxEntries; max > 0 && entries > max {
+		return fmt.Errorf("bucket maximum of %d entries reached", max)
+	}
+	if max := b.cfg.MaxBytes; max > 0 && bytes > max {
+		return fmt.Errorf("bucket maximum of %d bytes reached", max)
+	}
+	return nil
+}
+
+// apply adds the entry to the history of its key and returns the change of
+// the size of the bucket.
+func (b *kvBucket) apply(e *KVEntry) int64 {
+	delta := kvEntrySize(e)
+	entries := append(b.keys[e.Key], e)
+	b.entries++
+	for len(entries) > b.cfg.History {
+		delta -= kvEntrySize(entries[0])
+		entries[0] = nil
+		entries = entries[1:]
+		b.entries--
+	}
+	b.keys[e.Key] = entries
+	b.order = append(b.order, e)
+	b.bytes += delta
+	if e.Revision > b.rev {
+		b.rev = e.Revision
+	}
+	return delta
+}
+
+// oldest returns the oldest entry kept by the bucket, if any.
+func (b *kvBucket) oldest() *KVEntry {
+	for len(b.order) > 0 {
+		e := b.order[0]
+		// The oldest entry kept is the first of the history of its key.
+		if entries := b.keys[e.Key]; len(entries) > 0 && entries[0] == e {
+			return e
+		}
+		b.order[0] = nil
+		b.order = b.order[1:]
+	}
+	return nil
+}
+
+// removeOldest removes the oldest entry kept by the bucket.
+func (b *kvBucket) removeOldest() {
+	e := b.oldest()
+	if e == nil {
+		return
+	}
+	b.order[0] = nil
+	b.order = b.order[1:]
+	if entries := b.keys[e.Key]; len(entries) == 1 {
+		delete(b.keys, e.Key)
+	} else {
+		entries[0] = nil
+		b.keys[e.Key] = entries[1:]
+	}
+	b.entries--
+	b.bytes -= kvEntrySize(e)
+}
+
+// trim removes the oldest entries over the limits of the bucket, and the
+// entries older than its maximum age, and returns the change of the size
+// of the bucket.
+func (b *kvBucket) trim(now time.Time) int64 {
+	before := b.bytes
+	for b.entries > 0 && ((b.cfg.MaxEntries > 0 && int64(b.entries) > b.cfg.MaxEntries) ||
+		(b.cfg.MaxBytes > 0 && b.bytes > b.cfg.MaxBytes)) {
+		b.removeOldest()
+		b.discarded++
+	}
+	if b.cfg.MaxAge > 0 {
+		cutoff := now.Add(-b.cfg.MaxAge)
+		for e := b.oldest(); e != nil && e.Created.Before(cutoff); e = b.oldest() {
+			b.removeOldest()
+			b.expired++
+		}
+	}
+	return b.bytes - before
+}
+
+func (kvs *kvStore) get(bucket, key string) (*KVEntry, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	b, err := kvs.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	entries := b.keys[key]
+	if len(entries) == 0 || entries[len(entries)-1].Delete {
+		return nil, errKVKeyNotFound
+	}
+	return entries[len(entries)-1], nil
+}
+
+func (kvs *kvStore) history(bucket, key string) ([]*KVEntry, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	b, err := kvs.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	entries := b.keys[key]
+	if len(entries) == 0 {
+		return nil, errKVKeyNotFound
+	}
+	return append([]*KVEntry(nil), entries...), nil
+}
+
+func (kvs *kvStore) info(bucket string) (*KVBucketInfo, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	b, err := kvs.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return b.info(), nil
+}
+
+// Returns the state of the bucket, the store lock should be held.
+func (b *kvBucket) info() *KVBucketInfo {
+	return &KVBucketInfo{
+		Name:        b.name,
+		Config:      b.cfg,
+		Entries:     b.entries,
+		Bytes:       b.bytes,
+		Revision:    b.rev,
+		Expired:     b.expired,
+		Discarded:   b.discarded,
+		Compactions: b.compactions,
+		Reclaimed:   b.reclaimed,
+	}
+}
+
+// compactBuckets enforces the retention limits of the buckets, and
+// compacts their logs once at least half of the entries in them are no
+// longer kept.
+func (kvs *kvStore) compactBuckets(now time.Time) error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	var firstErr error
+	for _, b := range kvs.buckets {
+		kvs.bytes += b.trim(now)
+		if kvs.dir == _EMPTY_ || b.logged <= b.entries || b.logged < 2*b.entries {
+			continue
+		}
+		if err := kvs.compact(b); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("bucket %q: %v", b.name, err)
+		}
+	}
+	return firstErr
+}
+
+// keys returns the keys of the bucket that are not deleted, sorted.
+func (kvs *kvStore) keys(bucket string) ([]string, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	b, err := kvs.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(b.keys))
+	for key, entries := range b.keys {
+		if !entries[len(entries)-1].Delete {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Writes the configuration of the bucket, synced to disk.
+func (kvs *kvStore) storeBucket(name string, cfg KVBucketConfig) error {
+	b, _ := json.Marshal(cfg)
+	b, err := kvs.cipher.seal(name+kvBucketExt, b)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(kvs.dir, name+kvBucketExt)
+	tmp := file + ".tmp"
+	err = writeFileSync(tmp, b, 0640)
+	if err == nil {
+		err = renameSync(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Appends the entry to the log of the bucket and syncs it, lock should be
+// held.
+func (kvs *kvStore) appendLog(bucket string, e *KVEntry) error {
+	b, _ := json.Marshal(e)
+	b, err := kvs.cipher.sealLine(bucket+kvLogExt, b)
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	err = appendLogSync(&f, filepath.Join(kvs.dir, bucket+kvLogExt), append(b, '\n'))
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// load reads the stored buckets and compacts their logs to the entries
+// still in their history. The buckets stored with a previous encryption
+// key are encrypted again.
+func (kvs *kvStore) load() error {
+	if err := os.MkdirAll(kvs.dir, 0750); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(kvs.dir, "*"+kvBucketExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), kvBucketExt)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		data, stale, err := kvs.cipher.open(name+kvBucketExt, data)
+		if err != nil {
+			return fmt.Errorf("bucket %q: %v", name, err)
+		}
+		var cfg KVBucketConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("invalid bucket %q: %v", name, err)
+		}
+		if cfg.History <= 0 {
+			cfg.History = 1
+		}
+		if cfg.Discard == _EMPTY_ {
+			cfg.Discard = KVDiscardOld
+		}
+		if stale {
+			if err := kvs.storeBucket(name, cfg); err != nil {
+				return err
+			}
+		}
+		b := &kvBucket{name: name, cfg: cfg, keys: make(map[string][]*KVEntry)}
+		if err := kvs.replay(b); err != nil {
+			return fmt.Errorf("invalid log of bucket %q: %v", name, err)
+		}
+		kvs.buckets[name] = b
+	}
+	return nil
+}
+
+// replay applies the log of the bucket and the retention limits, and
+// rewrites it with the entries kept, or when some were not encrypted with
+// the current key.
+func (kvs *kvStore) replay(b *kvBucket) error {
+	file := filepath.Join(kvs.dir, b.name+kvLogExt)
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var n int
+	var rewrite bool
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// The last entry was torn by a crash, rewrite the log without.
+			rewrite = true
+			break
+		}
+		if len(line) > 1 {
+			line, stale, oerr := kvs.cipher.openLine(b.name+kvLogExt, line)
+			if oerr != nil {
+				f.Close()
+				return oerr
+			}
+			e := &KVEntry{}
+			if jerr := json.Unmarshal(line, e); jerr != nil {
+				f.Close()
+				return jerr
+			}
+			kvs.bytes += b.apply(e)
+			rewrite = rewrite || stale
+			n++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	f.Close()
+
+	b.logged = n
+	kvs.bytes += b.trim(time.Now())
+	if b.entries == n && !rewrite {
+		return nil
+	}
+	return kvs.compact(b)
+}
+
+// compact rewrites the log of the bucket with the entries kept, lock
+// should be held.
+func (kvs *kvStore) compact(b *kvBucket) error {
+	file := filepath.Join(kvs.dir, b.name+kvLogExt)
+	var before int64
+	if fi, err := os.Stat(file); err == nil {
+		before = fi.Size()
+	}
+	kept := make([]*KVEntry, 0, b.entries)
+	for _, entries := range b.keys {
+		kept = append(kept, entries...)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Revision < kept[j].Revision })
+	var buf []byte
+	for _, e := range kept {
+		data, _ := json.Marshal(e)
+		data, err := kvs.cipher.sealLine(b.name+kvLogExt, data)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	tmp := file + ".tmp"
+	if err := writeFileSync(tmp, buf, 0640); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := renameSync(tmp, file); err != nil {
+		return err
+	}
+	b.order, b.logged = kept, len(kept)
+	b.compactions++
+	if reclaimed := before - int64(len(buf)); reclaimed > 0 {
+		b.reclaimed += reclaimed
+	}
+	return nil
+}
+
+func validateKVOptions(o *Options) error {
+	if o.KV.CompactInterval < 0 {
+		return fmt.Errorf("kv compact_interval can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestKVConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		kv { store_dir: "/tmp/kv", compact_interval: "30s" }
+		accounts {
+			A { kv: true }
+			B { kv { max_buckets: 2, max_bytes: 1KB, max_history: 10, max_value_size: 128 } }
+			C { kv: false }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.KV.StoreDir != "/tmp/kv" || opts.KV.CompactInterval != 30*time.Second {
+		t.Fatalf("Unexpected options: %+v", opts.KV)
+	}
+	for _, acc := range opts.Accounts {
+		l := acc.kv
+		switch {
+		case acc.Name == "A" && l != nil && *l == kvLimits{}:
+		case acc.Name == "B" && l != nil && *l == kvLimits{2, 1024, 10, 128}:
+		case acc.Name == "C" && l == nil:
+		default:
+			t.Fatalf("Unexpected kv limits for %q: %+v", acc.Name, l)
+		}
+	}
+
+	for _, cfg := range []string{
+		`accounts { A { kv { max_history: 100 } } }`,
+		`accounts { A { kv { max_bytes: -1 } } }`,
+		`accounts { A { kv: "yes" } }`,
+	} {
+		conf := createConfFile(t, []byte(cfg))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil {
+			t.Fatalf("Expected an error for %q", cfg)
+		}
+	}
+}
+
+func runKVServer(t *testing.T, dir string) (*Server, *nats.Conn) {
+	t.Helper()
+	return runAccountServer(t, fmt.Sprintf(`kv { store_dir: %q }`, dir),
+		`kv { max_buckets: 2, max_history: 5, max_value_size: 16 }`)
+}
+
+func kvRequest(t *testing.T, nc *nats.Conn, subject string, data []byte) *KVResponse {
+	t.Helper()
+	var resp KVResponse
+	apiRequest(t, nc, subject, data, &resp)
+	return &resp
+}
+
+func TestKVBuckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, nc := runKVServer(t, dir)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	watch := natsSubSync(t, nc, "$KV.cfg.>")
+	natsFlush(t, nc)
+
+	if resp := kvRequest(t, nc, "$KV.API.CREATE.cfg", []byte(`{"history": 3}`)); resp.Error != _EMPTY_ {
+		t.Fatalf("Error creating bucket: %s", resp.Error)
+	}
+	for _, test := range []struct{ subject, data, err string }{
+		{"$KV.API.CREATE.cfg", "", "bucket already exists"},
+		{"$KV.API.CREATE.API", "", "invalid bucket name"},
+		{"$KV.API.CREATE.other", `{"history": 6}`, "invalid history"},
+		{"$KV.API.PUT.none.key", "v", "bucket not found"},
+		{"$KV.API.PUT.cfg.key", "this value is too large", "exceeds the maximum"},
+		{"$KV.API.GET.cfg.key", "", "key not found"},
+		{"$KV.API.DEL.cfg.key", "", "key not found"},
+		{"$KV.API.NOPE.cfg", "", "unknown operation"},
+	} {
+		if resp := kvRequest(t, nc, test.subject, []byte(test.data)); !strings.Contains(resp.Error, test.err) {
+			t.Fatalf("Expected error %q for %q, got %+v", test.err, test.subject, resp)
+		}
+	}
+
+	for i := 1; i <= 4; i++ {
+		resp := kvRequest(t, nc, "$KV.API.PUT.cfg.db.host", []byte(fmt.Sprintf("h%d", i)))
+		if resp.Error != _EMPTY_ || resp.Entry.Revision != uint64(i) {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		msg := natsNexMsg(t, watch, time.Second)
+		var e KVEntry
+		if err := json.Unmarshal(msg.Data, &e); err != nil || msg.Subject != "$KV.cfg.db.host" ||
+			e.Key != "db.host" || string(e.Value) != fmt.Sprintf("h%d", i) {
+			t.Fatalf("Unexpected change on %q: %+v (%v)", msg.Subject, e, err)
+		}
+	}
+	kvRequest(t, nc, "$KV.API.PUT.cfg.db.port", []byte("4222"))
+	natsNexMsg(t, watch, time.Second)
+
+	if resp := kvRequest(t, nc, "$KV.API.GET.cfg.db.host", nil); resp.Entry == nil || string(resp.Entry.Value) != "h4" {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	resp := kvRequest(t, nc, "$KV.API.HISTORY.cfg.db.host", nil)
+	if len(resp.History) != 3 || string(resp.History[0].Value) != "h2" || string(resp.History[2].Value) != "h4" {
+		t.Fatalf("Unexpected history: %+v", resp.History)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.KEYS.cfg", nil); len(resp.Keys) != 2 || resp.Keys[0] != "db.host" {
+		t.Fatalf("Unexpected keys: %+v", resp)
+	}
+
+	// Deleting a key keeps its history.
+	if resp := kvRequest(t, nc, "$KV.API.DEL.cfg.db.port", nil); resp.Error != _EMPTY_ || !resp.Entry.Delete {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	var e KVEntry
+	if msg := natsNexMsg(t, watch, time.Second); json.Unmarshal(msg.Data, &e) != nil || !e.Delete {
+		t.Fatalf("Expected a delete, got %q", msg.Data)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.GET.cfg.db.port", nil); resp.Error != errKVKeyNotFound.Error() {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.HISTORY.cfg.db.port", nil); len(resp.History) != 2 {
+		t.Fatalf("Unexpected history: %+v", resp)
+	}
+
+	// The number of buckets is limited.
+	kvRequest(t, nc, "$KV.API.CREATE.other", nil)
+	if resp := kvRequest(t, nc, "$KV.API.CREATE.third", nil); !strings.Contains(resp.Error, "maximum of 2 buckets") {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.DESTROY.other", nil); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// The buckets are loaded by the restarted server.
+	s, nc = runKVServer(t, dir)
+	defer s.Shutdown()
+	defer nc.Close()
+	resp = kvRequest(t, nc, "$KV.API.HISTORY.cfg.db.host", nil)
+	if len(resp.History) != 3 || string(resp.History[2].Value) != "h4" {
+		t.Fatalf("Unexpected history: %+v", resp)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.PUT.cfg.db.host", []byte("h5")); resp.Entry == nil || resp.Entry.Revision != 7 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.KEYS.other", nil); resp.Error != errKVBucketNotFound.Error() {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+}
+
+func TestKVRetention(t *testing.T) {
+	ci := kvCompactInterval
+	kvCompactInterval = 50 * time.Millisecond
+	defer func() { kvCompactInterval = ci }()
+
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, nc := runKVServer(t, dir)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	for _, test := range []struct{ cfg, err string }{
+		{`{"max_age": -1}`, "invalid retention limits"},
+		{`{"discard": "all"}`, "invalid discard policy"},
+	} {
+		if resp := kvRequest(t, nc, "$KV.API.CREATE.bad", []byte(test.cfg)); !strings.Contains(resp.Error, test.err) {
+			t.Fatalf("Expected error %q for %s, got %+v", test.err, test.cfg, resp)
+		}
+	}
+
+	// The new entries are rejected when the limits are reached.
+	kvRequest(t, nc, "$KV.API.CREATE.new", []byte(`{"max_entries": 2, "discard": "new"}`))
+	kvRequest(t, nc, "$KV.API.PUT.new.a", []byte("1"))
+	kvRequest(t, nc, "$KV.API.PUT.new.b", []byte("1"))
+	if resp := kvRequest(t, nc, "$KV.API.PUT.new.c", []byte("1")); !strings.Contains(resp.Error, "maximum of 2 entries") {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.PUT.new.a", []byte("2")); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	// Or the oldest ones are discarded, and they expire after their age.
+	kvRequest(t, nc, "$KV.API.CREATE.old", []byte(`{"max_entries": 3, "max_age": 300000000}`))
+	for i := 1; i <= 5; i++ {
+		kvRequest(t, nc, fmt.Sprintf("$KV.API.PUT.old.k%d", i), []byte("v"))
+	}
+	if resp := kvRequest(t, nc, "$KV.API.KEYS.old", nil); len(resp.Keys) != 3 || resp.Keys[0] != "k3" {
+		t.Fatalf("Unexpected keys: %+v", resp)
+	}
+	info := kvRequest(t, nc, "$KV.API.INFO.old", nil).Bucket
+	if info == nil || info.Entries != 3 || info.Discarded != 2 || info.Config.Discard != KVDiscardOld {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		info = kvRequest(t, nc, "$KV.API.INFO.old", nil).Bucket
+		if info.Entries != 0 || info.Expired != 3 || info.Compactions == 0 || info.Reclaimed == 0 {
+			return fmt.Errorf("Unexpected info: %+v", info)
+		}
+		return nil
+	})
+	if fi, err := os.Stat(filepath.Join(dir, "A", "old"+kvLogExt)); err != nil || fi.Size() != 0 {
+		t.Fatalf("Expected a compacted log: %v", err)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.GET.old.k5", nil); resp.Error != errKVKeyNotFound.Error() {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	// The revisions continue after the expired entries.
+	if resp := kvRequest(t, nc, "$KV.API.PUT.old.k6", []byte("v")); resp.Entry == nil || resp.Entry.Revision != 6 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+}
+
+func TestKVRecoveryAfterCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, nc := runKVServer(t, dir)
+	defer s.Shutdown()
+	defer nc.Close()
+	kvRequest(t, nc, "$KV.API.CREATE.cfg", nil)
+	kvRequest(t, nc, "$KV.API.PUT.cfg.a", []byte("1"))
+	kvRequest(t, nc, "$KV.API.PUT.cfg.b", []byte("2"))
+
+	// The files as they are while the server runs are what a crash would
+	// leave, with a partial last entry if it happened during a write.
+	crashed, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(crashed)
+	os.MkdirAll(filepath.Join(crashed, "A"), 0750)
+	for _, name := range []string{"cfg" + kvBucketExt, "cfg" + kvLogExt} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "A", name))
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", name, err)
+		}
+		if name == "cfg"+kvLogExt {
+			b = append(b, `{"bucket":"cfg","key":"c","val`...)
+		}
+		if err := ioutil.WriteFile(filepath.Join(crashed, "A", name), b, 0640); err != nil {
+			t.Fatalf("Error writing %q: %v", name, err)
+		}
+	}
+
+	s2, nc2 := runKVServer(t, crashed)
+	defer s2.Shutdown()
+	defer nc2.Close()
+	if resp := kvRequest(t, nc2, "$KV.API.KEYS.cfg", nil); len(resp.Keys) != 2 || resp.Keys[0] != "a" || resp.Keys[1] != "b" {
+		t.Fatalf("Unexpected keys: %+v", resp)
+	}
+	if resp := kvRequest(t, nc2, "$KV.API.PUT.cfg.c", []byte("3")); resp.Entry == nil || resp.Entry.Revision != 3 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+}
+
+func TestKVRequestsNeverBlock(t *testing.T) {
+	s := &Server{}
+	kvs := &kvStore{account: "A", reqs: make(chan *kvReq, 1)}
+	handler := s.kvRequestHandler(kvs)
+	// The store is busy, the requests are queued or rejected.
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		msg := []byte("v1")
+		handler(nil, nil, "$KV.API.PUT.cfg.a", _EMPTY_, msg)
+		copy(msg, "v2")
+		handler(nil, nil, "$KV.API.PUT.cfg.b", _EMPTY_, msg)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the handler not to wait for the store")
+	}
+	if len(kvs.reqs) != 1 {
+		t.Fatalf("Expected one queued request, got %d", len(kvs.reqs))
+	}
+	// The payload is copied since the buffer of the publisher is reused.
+	if req := <-kvs.reqs; req.subject != "$KV.API.PUT.cfg.a" || string(req.msg) != "v1" {
+		t.Fatalf("Unexpected request: %+v", req)
+	}
+}
@@ -61,6 +61,13 @@ type leaf struct {
 	// isSpoke tells us what role we are playing.
 	// Used when we receive a connection but otherside tells us they are a hub.
 	isSpoke bool
+	// For solicited connections, the remote has compression enabled and
+	// the algorithms it supports.
+	compress      bool
+	compressAlgos []string
+	// ID and name of the remote server, reported in /leafz.
+	remoteID   string
+	remoteName string
 }
 
 // Used for remote (solicited) leafnodes.
@@ -69,6 +76,7 @@ type leafNodeCfg struct {
 	*RemoteLeafOpts
 	urls      []*url.URL
 	curURL    *url.URL
+	srvURL    *url.URL
 	tlsName   string
 	username  string
 	password  string
@@ -200,16 +208,28 @@ func (cfg *leafNodeCfg) pickNextURL() *url.URL {
 		cfg.urls[len(cfg.urls)-1] = first
 	}
 	cfg.curURL = cfg.urls[0]
+	cfg.srvURL = nil
 	return cfg.curURL
 }
 
-// Returns the current URL
+// Returns the current URL, or the target it was resolved to if
+// the current URL is a SRV name.
 func (cfg *leafNodeCfg) getCurrentURL() *url.URL {
 	cfg.RLock()
 	defer cfg.RUnlock()
+	if cfg.srvURL != nil {
+		return cfg.srvURL
+	}
 	return cfg.curURL
 }
 
+// Sets the target that the current SRV URL was resolved to.
+func (cfg *leafNodeCfg) setSRVTarget(u *url.URL) {
+	cfg.Lock()
+	cfg.srvURL = u
+	cfg.Unlock()
+}
+
 // Returns how long the server should wait before attempting
 // to solicit a remote leafnode connection.
 func (cfg *leafNodeCfg) getConnectDelay() time.Duration {
@@ -269,17 +289,35 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 
 	const connErrFmt = "Error trying to connect as leafnode to remote server %q (attempt %v): %v"
 
+	// The proxy, if any, resolves the remote's host.
+	proxy := outboundProxy(remote.Proxy, opts.OutboundProxy)
+
 	attempts := 0
 	for s.isRunning() && s.remoteLeafNodeStillValid(remote) {
 		rURL := remote.pickNextURL()
-		url, err := s.getRandomIP(resolver, rURL.Host)
+		host := rURL.Host
+		var addr string
+		var err error
+		// Remotes given as SRV names are resolved on every attempt.
+		if isSRVURL(rURL) {
+			var target *url.URL
+			if target, err = s.pickSRVTarget(rURL, attempts); err == nil {
+				remote.setSRVTarget(target)
+				host = target.Host
+			}
+		}
 		if err == nil {
-			var ipStr string
-			if url != rURL.Host {
-				ipStr = fmt.Sprintf(" (%s)", url)
+			if proxy != _EMPTY_ {
+				s.Debugf("Trying to connect as leafnode to remote server on %q through proxy", host)
+				conn, err = dialProxy(proxy, host, dialTimeout)
+			} else if addr, err = s.getRandomIP(resolver, host); err == nil {
+				var ipStr string
+				if addr != host {
+					ipStr = fmt.Sprintf(" (%s)", addr)
+				}
+				s.Debugf("Trying to connect as leafnode to remote server on %q%s", host, ipStr)
+				conn, err = net.DialTimeout("tcp", addr, dialTimeout)
 			}
-			s.Debugf("Trying to connect as leafnode to remote server on %q%s", rURL.Host, ipStr)
-			conn, err = net.DialTimeout("tcp", url, dialTimeout)
 		}
 		if err != nil {
 			attempts++
@@ -351,8 +389,7 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 		port = 0
 	}
 
-	hp := net.JoinHostPort(opts.LeafNode.Host, strconv.Itoa(port))
-	l, e := net.Listen("tcp", hp)
+	l, e := natsListen(opts.LeafNode.Host, opts.LeafNode.HostV6, port)
 	if e != nil {
 		s.Fatalf("Error listening on leafnode port: %d - %v", opts.LeafNode.Port, e)
 		return
@@ -360,6 +397,10 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 
 	s.Noticef("Listening for leafnode connections on %s",
 		net.JoinHostPort(opts.LeafNode.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	if opts.LeafNode.HostV6 != _EMPTY_ {
+		s.Noticef("Listening for leafnode connections on %s",
+			net.JoinHostPort(opts.LeafNode.HostV6, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	}
 
 	s.mu.Lock()
 	tlsRequired := opts.LeafNode.TLSConfig != nil
@@ -375,6 +416,9 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 		MaxPayload:   s.info.MaxPayload, // TODO(dlc) - Allow override?
 		Proto:        1,                 // Fixed for now.
 	}
+	if _, info.Compression = compressionLevel(opts.LeafNode.Compression); info.Compression {
+		info.CompressionAlgorithms = compressionAlgorithms
+	}
 	// If we have selected a random port...
 	if port == 0 {
 		// Write resolved port back to options.
@@ -429,10 +473,13 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 			continue
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
-		s.startGoRoutine(func() {
-			s.createLeafNode(conn, nil)
-			s.grWG.Done()
-		})
+		if !s.acceptAllowed("LeafNode", s.getOpts().LeafNode.Networks, conn) {
+			continue
+		}
+		if !s.acceptRateAllowed("LeafNode", s.getOpts().LeafNode.AcceptRate, conn) {
+			continue
+		}
+		s.startAcceptWorker(s.routeAcceptPool, conn, func(conn net.Conn) { s.createLeafNode(conn, nil) })
 	}
 	s.Debugf("Leafnode accept loop exiting..")
 	s.done <- true
@@ -444,10 +491,16 @@ var credsRe = regexp.MustCompile(`\s*(?:(?:[-]{3,}[^\n]*[-]{3,}\n)(.+)(?:\n\s*[-
 // Lock should be held entering here.
 func (c *client) sendLeafConnect(tlsRequired bool) {
 	// We support basic user/pass and operator based user JWT with signatures.
+	_, compress := compressionLevel(c.leaf.remote.Compression)
 	cinfo := leafConnectInfo{
-		TLS:  tlsRequired,
-		Name: c.srv.info.ID,
-		Hub:  c.leaf.remote.Hub,
+		TLS:        tlsRequired,
+		Comp:       compress && c.leaf.compress,
+		Name:       c.srv.info.ID,
+		ServerName: c.srv.info.Name,
+		Hub:        c.leaf.remote.Hub,
+	}
+	if cinfo.Comp {
+		cinfo.CompAlgos = compressionAlgorithms
 	}
 
 	// Check for credentials first, that will take precedence..
@@ -679,7 +732,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 			// Specify the ServerName we are expecting.
 			var tlsConfig *tls.Config
 			if remote.TLSConfig != nil {
-				tlsConfig = remote.TLSConfig.Clone()
+				tlsConfig = tlsClientConfig(remote.TLSConfig)
 			} else {
 				tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
 			}
@@ -742,6 +795,11 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 		c.sendLeafConnect(tlsRequired)
 		c.Debugf("Remote leafnode connect msg sent")
 
+		// Compress what we send if both sides have compression enabled.
+		if c.leaf.compress {
+			c.startCompression(remote.Compression, c.leaf.compressAlgos)
+		}
+
 	} else {
 		// Send our info to the other side.
 		// Remember the nonce we sent here for signatures, etc.
@@ -770,7 +828,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 
 			// Force handshake
 			c.mu.Unlock()
-			if err := conn.Handshake(); err != nil {
+			if err := s.tlsHandshake(conn, ttl); err != nil {
 				c.Errorf("TLS handshake error: %v", err)
 				c.closeConnection(TLSHandshakeError)
 				return nil
@@ -861,6 +919,10 @@ func (c *client) processLeafnodeInfo(info *Info) error {
 		if info.TLSRequired && c.leaf.remote != nil {
 			c.leaf.remote.TLS = true
 		}
+		c.leaf.compress = info.Compression
+		c.leaf.compressAlgos = info.CompressionAlgorithms
+		c.leaf.remoteID = info.ID
+		c.leaf.remoteName = info.Name
 	}
 	// For both initial INFO and async INFO protocols, Possibly
 	// update our list of remote leafnode URLs we can connect to.
@@ -964,14 +1026,16 @@ func (s *Server) removeLeafNodeConnection(c *client) {
 }
 
 type leafConnectInfo struct {
-	JWT  string `json:"jwt,omitempty"`
-	Sig  string `json:"sig,omitempty"`
-	User string `json:"user,omitempty"`
-	Pass string `json:"pass,omitempty"`
-	TLS  bool   `json:"tls_required"`
-	Comp bool   `json:"compression,omitempty"`
-	Name string `json:"name,omitempty"`
-	Hub  bool   `json:"is_hub,omitempty"`
+	JWT        string   `json:"jwt,omitempty"`
+	Sig        string   `json:"sig,omitempty"`
+	User       string   `json:"user,omitempty"`
+	Pass       string   `json:"pass,omitempty"`
+	TLS        bool     `json:"tls_required"`
+	Comp       bool     `json:"compression,omitempty"`
+	CompAlgos  []string `json:"compression_algorithms,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	ServerName string   `json:"server_name,omitempty"`
+	Hub        bool     `json:"is_hub,omitempty"`
 	// Just used to detect wrong connection attempts.
 	Gateway string `json:"gateway,omitempty"`
 }
@@ -1014,6 +1078,18 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 		c.leaf.isSpoke = true
 	}
 
+	c.mu.Lock()
+	c.leaf.remoteID = proto.Name
+	c.leaf.remoteName = proto.ServerName
+	c.mu.Unlock()
+
+	// The other side asks for compression only if we advertised it.
+	if proto.Comp {
+		c.mu.Lock()
+		c.startCompression(s.getOpts().LeafNode.Compression, proto.CompAlgos)
+		c.mu.Unlock()
+	}
+
 	// Create and initialize the smap since we know our bound account now.
 	lm := s.initLeafNodeSmap(c)
 	// We are good to go, send over all the bound account subscriptions.
@@ -1057,6 +1133,11 @@ func (s *Server) initLeafNodeSmap(c *client) int {
 		acc.sl.All(&subs)
 	}
 
+	// Add expected interest declared for this account.
+	for _, sub := range acc.isubs {
+		subs = append(subs, sub)
+	}
+
 	// Check if we have an existing service import reply.
 	siReply := acc.siReply
 
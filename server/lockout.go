@@ -0,0 +1,274 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults for the authentication lockout.
+	defaultLockoutWindow      = 5 * time.Minute
+	defaultLockoutDelay       = time.Second
+	defaultLockoutMaxDelay    = 30 * time.Second
+	defaultLockoutBanDuration = 10 * time.Minute
+)
+
+// authLockout tracks the authentication failures of the client connections
+// per remote IP and per user.
+type authLockout struct {
+	sync.Mutex
+	ips       map[string]*authFailures
+	users     map[string]*authFailures
+	lastPrune time.Time
+}
+
+// authFailures is the state of a remote IP or user.
+type authFailures struct {
+	count  int
+	last   time.Time
+	banned time.Time
+}
+
+func (o *AuthLockoutOpts) window() time.Duration {
+	if o.Window > 0 {
+		return o.Window
+	}
+	return defaultLockoutWindow
+}
+
+func (o *AuthLockoutOpts) banDuration() time.Duration {
+	if o.BanDuration > 0 {
+		return o.BanDuration
+	}
+	return defaultLockoutBanDuration
+}
+
+// delay returns how long to delay a connection with the given number of
+// recent failures. The delay doubles with each failure past the threshold.
+func (o *AuthLockoutOpts) delay(failures int) time.Duration {
+	if o.Threshold <= 0 || failures < o.Threshold {
+		return 0
+	}
+	d, max := o.Delay, o.MaxDelay
+	if d <= 0 {
+		d = defaultLockoutDelay
+	}
+	if max <= 0 {
+		max = defaultLockoutMaxDelay
+	}
+	for i := o.Threshold; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Returns the number of recent failures, and when the ban ends if banned.
+// Lock should be held.
+func (f *authFailures) state(now time.Time, window time.Duration) (int, time.Time) {
+	if f == nil {
+		return 0, time.Time{}
+	}
+	count := f.count
+	if now.Sub(f.last) > window {
+		count = 0
+	}
+	if now.After(f.banned) {
+		return count, time.Time{}
+	}
+	return count, f.banned
+}
+
+// Returns the user name tracked for the client. Lock should be held.
+func (c *client) lockoutUser() string {
+	if c.opts.Nkey != _EMPTY_ {
+		return c.opts.Nkey
+	}
+	return c.opts.Username
+}
+
+// authLockedOut delays the authentication of the client if its IP or user
+// had too many recent failures. Returns true if either is banned.
+func (s *Server) authLockedOut(c *client) bool {
+	opts := s.getOpts().AuthLockout
+	if opts.Threshold <= 0 && opts.BanThreshold <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	host, user := c.host, c.lockoutUser()
+	c.mu.Unlock()
+
+	now := time.Now()
+	window := opts.window()
+	s.lockout.Lock()
+	ipCount, ipBan := s.lockout.ips[host].state(now, window)
+	userCount, userBan := s.lockout.users[user].state(now, window)
+	s.lockout.Unlock()
+	if !ipBan.IsZero() || (user != _EMPTY_ && !userBan.IsZero()) {
+		c.Debugf("Authentication rejected, locked out after repeated failures")
+		return true
+	}
+	if user == _EMPTY_ {
+		userCount = 0
+	}
+	if userCount > ipCount {
+		ipCount = userCount
+	}
+	if d := opts.delay(ipCount); d > 0 {
+		c.Debugf("Delaying authentication by %v after %d failures", d, ipCount)
+		select {
+		case <-time.After(d):
+		case <-s.quitCh:
+		}
+	}
+	return false
+}
+
+// authFailed records an authentication failure of the client.
+func (s *Server) authFailed(c *client) {
+	opts := s.getOpts().AuthLockout
+	if opts.Threshold <= 0 && opts.BanThreshold <= 0 {
+		return
+	}
+	c.mu.Lock()
+	host, user := c.host, c.lockoutUser()
+	c.mu.Unlock()
+
+	now := time.Now()
+	s.lockout.Lock()
+	if s.lockout.ips == nil {
+		s.lockout.ips = make(map[string]*authFailures)
+		s.lockout.users = make(map[string]*authFailures)
+	}
+	s.pruneAuthFailures(now, &opts)
+	var banned []string
+	if host != _EMPTY_ && s.recordAuthFailure(s.lockout.ips, host, now, &opts) {
+		banned = append(banned, fmt.Sprintf("IP %q", host))
+	}
+	if user != _EMPTY_ && s.recordAuthFailure(s.lockout.users, user, now, &opts) {
+		banned = append(banned, fmt.Sprintf("user %q", user))
+	}
+	s.lockout.Unlock()
+	for _, b := range banned {
+		s.Warnf("Banning %s for %v after %d authentication failures", b, opts.banDuration(), opts.BanThreshold)
+	}
+}
+
+// Records a failure for the key, and returns true if it is now banned.
+// Lock should be held.
+func (s *Server) recordAuthFailure(m map[string]*authFailures, key string, now time.Time, opts *AuthLockoutOpts) bool {
+	f := m[key]
+	if f == nil {
+		f = &authFailures{}
+		m[key] = f
+	}
+	f.count, _ = f.state(now, opts.window())
+	f.count++
+	f.last = now
+	if opts.BanThreshold > 0 && f.count >= opts.BanThreshold && now.After(f.banned) {
+		f.banned = now.Add(opts.banDuration())
+		f.count = 0
+		return true
+	}
+	return false
+}
+
+// Removes the entries that no longer have recent failures nor a ban, at
+// most once per window. Lock should be held.
+func (s *Server) pruneAuthFailures(now time.Time, opts *AuthLockoutOpts) {
+	window := opts.window()
+	if now.Sub(s.lockout.lastPrune) < window {
+		return
+	}
+	s.lockout.lastPrune = now
+	for _, m := range []map[string]*authFailures{s.lockout.ips, s.lockout.users} {
+		for k, f := range m {
+			if now.Sub(f.last) > window && now.After(f.banned) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+// authSucceeded clears the failures of the user of the client.
+func (s *Server) authSucceeded(c *client) {
+	if opts := s.getOpts().AuthLockout; opts.Threshold <= 0 && opts.BanThreshold <= 0 {
+		return
+	}
+	c.mu.Lock()
+	user := c.lockoutUser()
+	c.mu.Unlock()
+	if user == _EMPTY_ {
+		return
+	}
+	s.lockout.Lock()
+	if f := s.lockout.users[user]; f != nil && time.Now().After(f.banned) {
+		delete(s.lockout.users, user)
+	}
+	s.lockout.Unlock()
+}
+
+// ipBanned returns true if the remote IP of the connection is banned.
+func (s *Server) ipBanned(conn net.Conn) bool {
+	s.lockout.Lock()
+	defer s.lockout.Unlock()
+	if len(s.lockout.ips) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	f := s.lockout.ips[host]
+	return f != nil && time.Now().Before(f.banned)
+}
+
+// lockoutInfos returns the state of the IPs or users with recent failures
+// or a ban. Lock should be held.
+func lockoutInfos(m map[string]*authFailures, now time.Time, opts *AuthLockoutOpts) []*LockoutInfo {
+	var infos []*LockoutInfo
+	for k, f := range m {
+		count, banned := f.state(now, opts.window())
+		if count == 0 && banned.IsZero() {
+			continue
+		}
+		li := &LockoutInfo{Key: k, Failures: count, LastFailure: f.last}
+		if d := opts.delay(count); d > 0 {
+			li.Delay = d.String()
+		}
+		if !banned.IsZero() {
+			li.BannedUntil = &banned
+		}
+		infos = append(infos, li)
+	}
+	return infos
+}
+
+// validateAuthLockoutOptions checks the authentication lockout settings.
+func validateAuthLockoutOptions(o *Options) error {
+	al := &o.AuthLockout
+	if al.Threshold < 0 || al.BanThreshold < 0 {
+		return fmt.Errorf("auth_lockout thresholds can not be negative")
+	}
+	if al.MaxDelay > 0 && al.Delay > al.MaxDelay {
+		return fmt.Errorf("auth_lockout delay %v is greater than max_delay %v", al.Delay, al.MaxDelay)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestAuthLockoutDelay(t *testing.T) {
+	opts := &AuthLockoutOpts{Threshold: 3, Delay: time.Second, MaxDelay: 5 * time.Second}
+	for failures, expected := range []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if d := opts.delay(failures); d != expected {
+			t.Fatalf("Expected delay %v for %d failures, got %v", expected, failures, d)
+		}
+	}
+	if d := (&AuthLockoutOpts{BanThreshold: 3}).delay(10); d != 0 {
+		t.Fatalf("Expected no delay without threshold, got %v", d)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		authorization {
+			users [{user: a, password: pwd}, {user: b, password: pwd}]
+		}
+		auth_lockout {
+			threshold: 2
+			delay: "100ms"
+			max_delay: "200ms"
+			ban_threshold: 4
+			ban_duration: "500ms"
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(user, pwd string) (time.Duration, error) {
+		start := time.Now()
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, pwd), nats.NoReconnect())
+		if err == nil {
+			nc.Close()
+		}
+		return time.Since(start), err
+	}
+	for i := 0; i < 3; i++ {
+		d, err := connect("a", "bad")
+		if err == nil {
+			t.Fatal("Expected authentication failure")
+		}
+		if i == 2 && d < 100*time.Millisecond {
+			t.Fatalf("Expected authentication to be delayed, took %v", d)
+		}
+	}
+
+	lz := s.Lockoutz()
+	if len(lz.IPs) != 1 || lz.IPs[0].Key != "127.0.0.1" || lz.IPs[0].Failures != 3 ||
+		lz.IPs[0].Delay != "200ms" || lz.IPs[0].BannedUntil != nil {
+		t.Fatalf("Unexpected IPs: %+v", lz.IPs)
+	}
+	if len(lz.Users) != 1 || lz.Users[0].Key != "a" || lz.Users[0].Failures != 3 {
+		t.Fatalf("Unexpected users: %+v", lz.Users)
+	}
+
+	// The next failure bans the IP and the user, even with valid credentials.
+	connect("a", "bad")
+	if _, err := connect("b", "pwd"); err == nil {
+		t.Fatal("Expected connection from banned IP to fail")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, LockoutzPath))
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	defer resp.Body.Close()
+	lz = &Lockoutz{}
+	if err := json.NewDecoder(resp.Body).Decode(lz); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(lz.IPs) != 1 || lz.IPs[0].BannedUntil == nil || len(lz.Users) != 1 || lz.Users[0].BannedUntil == nil {
+		t.Fatalf("Expected IP and user to be banned, got %+v %+v", lz.IPs, lz.Users)
+	}
+
+	// Once the ban expires, valid credentials are accepted.
+	time.Sleep(600 * time.Millisecond)
+	if _, err := connect("b", "pwd"); err != nil {
+		t.Fatalf("Expected connection to succeed, got %v", err)
+	}
+	if _, err := connect("a", "pwd"); err != nil {
+		t.Fatalf("Expected connection to succeed, got %v", err)
+	}
+}
@@ -63,17 +63,19 @@ func (s *Server) ConfigureLogger() {
 		syslog = true
 	}
 
+	// The loggers log all levels, debug and trace statements are filtered
+	// by the server, and can be enabled for an account or a connection.
 	if opts.LogFile != "" {
-		log = srvlog.NewFileLogger(opts.LogFile, opts.Logtime, opts.Debug, opts.Trace, true)
+		log = srvlog.NewFileLogger(opts.LogFile, opts.Logtime, true, true, true)
 		if opts.LogSizeLimit > 0 {
 			if l, ok := log.(*srvlog.Logger); ok {
 				l.SetSizeLimit(opts.LogSizeLimit)
 			}
 		}
 	} else if opts.RemoteSyslog != "" {
-		log = srvlog.NewRemoteSysLogger(opts.RemoteSyslog, opts.Debug, opts.Trace)
+		log = srvlog.NewRemoteSysLogger(opts.RemoteSyslog, true, true)
 	} else if syslog {
-		log = srvlog.NewSysLogger(opts.Debug, opts.Trace)
+		log = srvlog.NewSysLogger(true, true)
 	} else {
 		colors := true
 		// Check to see if stderr is being redirected and if so turn off color
@@ -82,7 +84,7 @@ func (s *Server) ConfigureLogger() {
 		if err != nil || (stat.Mode()&os.ModeCharDevice) == 0 {
 			colors = false
 		}
-		log = srvlog.NewStdLogger(opts.Logtime, opts.Debug, opts.Trace, colors, true)
+		log = srvlog.NewStdLogger(opts.Logtime, true, true, colors, true)
 	}
 
 	s.SetLoggerV2(log, opts.Debug, opts.Trace, opts.TraceVerbose)
@@ -146,8 +148,13 @@ func (s *Server) ReOpenLogFile() {
 		s.Noticef("File log re-open ignored, not a file logger")
 	} else {
 		fileLog := srvlog.NewFileLogger(opts.LogFile,
-			opts.Logtime, opts.Debug, opts.Trace, true)
-		s.SetLogger(fileLog, opts.Debug, opts.Trace)
+			opts.Logtime, true, true, true)
+		if opts.LogSizeLimit > 0 {
+			fileLog.SetSizeLimit(opts.LogSizeLimit)
+		}
+		// Keep the levels, which may have been changed at runtime.
+		s.SetLoggerV2(fileLog, atomic.LoadInt32(&s.logging.debug) != 0,
+			atomic.LoadInt32(&s.logging.trace) != 0, atomic.LoadInt32(&s.logging.traceSysAcc) != 0)
 		s.Noticef("File log re-opened")
 	}
 }
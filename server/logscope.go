@@ -0,0 +1,405 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels raised for an account or a connection, on top of the
+// levels of the server.
+const (
+	logLevelDebug = 1 << iota
+	logLevelTrace
+)
+
+// Parses the level of a LogLevelRequest, trace also enabling debug. Off
+// resets the level, for the server to the level of its configuration, and
+// info disables debug and trace.
+func parseLogLevel(level string) (int32, error) {
+	switch level {
+	case "off", "info", _EMPTY_:
+		return 0, nil
+	case "debug":
+		return logLevelDebug, nil
+	case "trace":
+		return logLevelDebug | logLevelTrace, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q, expected debug, trace or off", level)
+}
+
+func logLevelString(level int32) string {
+	switch {
+	case level&logLevelTrace != 0:
+		return "trace"
+	case level&logLevelDebug != 0:
+		return "debug"
+	}
+	return "off"
+}
+
+// LogLevelRequest changes the log level of the server, or raises the level
+// of an account or of a client connection only, if set. The level is info,
+// debug, trace or off, and is reset after Expires if set.
+type LogLevelRequest struct {
+	Account string        `json:"account,omitempty"`
+	CID     uint64        `json:"cid,omitempty"`
+	Level   string        `json:"level"`
+	Expires time.Duration `json:"expires,omitempty"`
+}
+
+// LogLevelResponse is sent back in response to a LogLevelRequest, with the
+// scopes whose log level is raised on this server.
+type LogLevelResponse struct {
+	Server ServerInfo `json:"server"`
+	Scopes []LogScope `json:"scopes"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// LogScope is the server, an account or a client connection whose log level
+// is changed at runtime.
+type LogScope struct {
+	Server  bool      `json:"server,omitempty"`
+	Account string    `json:"account,omitempty"`
+	CID     uint64    `json:"cid,omitempty"`
+	Level   string    `json:"level"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// logScopes are the accounts and connections whose log level is raised.
+type logScopes struct {
+	sync.Mutex
+	scopes map[string]*logScope
+}
+
+type logScope struct {
+	LogScope
+	timer *time.Timer
+}
+
+// Key of the log scope of the server.
+const serverLogScopeKey = "server"
+
+func logScopeKey(account string, cid uint64) string {
+	switch {
+	case account != _EMPTY_:
+		return "acc:" + account
+	case cid != 0:
+		return "cid:" + strconv.FormatUint(cid, 10)
+	}
+	return serverLogScopeKey
+}
+
+// SetLogLevel changes or resets the log level of the server, or of an
+// account or a client connection.
+func (s *Server) SetLogLevel(req *LogLevelRequest) error {
+	if req.Account != _EMPTY_ && req.CID != 0 {
+		return fmt.Errorf("either an account or a connection id can be set")
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		return err
+	}
+	if req.Expires < 0 {
+		return fmt.Errorf("expires can not be negative")
+	}
+	server := req.Account == _EMPTY_ && req.CID == 0
+	revert := level == 0
+	levelName := logLevelString(level)
+	if server {
+		s.logging.RLock()
+		noLog := s.logging.logger == nil
+		s.logging.RUnlock()
+		if noLog {
+			return fmt.Errorf("logging is disabled")
+		}
+		opts := s.getOpts()
+		debug, trace := opts.Debug, opts.Trace
+		if revert = req.Level == "off" || req.Level == _EMPTY_; !revert {
+			debug, trace = level&logLevelDebug != 0, level&logLevelTrace != 0
+			if level == 0 {
+				levelName = "info"
+			}
+		}
+		atomic.StoreInt32(&s.logging.debug, boolToInt32(debug))
+		atomic.StoreInt32(&s.logging.trace, boolToInt32(trace))
+		s.updateClientTraceLevel()
+	} else if req.Account != _EMPTY_ {
+		v, ok := s.accounts.Load(req.Account)
+		if !ok {
+			return fmt.Errorf("account %q not found", req.Account)
+		}
+		acc := v.(*Account)
+		atomic.StoreInt32(&acc.logLevel, level)
+		acc.mu.RLock()
+		clients := make([]*client, 0, len(acc.clients))
+		for c := range acc.clients {
+			clients = append(clients, c)
+		}
+		acc.mu.RUnlock()
+		for _, c := range clients {
+			c.mu.Lock()
+			c.updateLogLevel()
+			c.mu.Unlock()
+		}
+	} else {
+		s.mu.Lock()
+		c := s.clients[req.CID]
+		if c == nil {
+			c = s.leafs[req.CID]
+		}
+		s.mu.Unlock()
+		if c == nil {
+			return fmt.Errorf("connection %d not found", req.CID)
+		}
+		c.mu.Lock()
+		c.connLogLevel = level
+		c.updateLogLevel()
+		c.mu.Unlock()
+	}
+
+	key := logScopeKey(req.Account, req.CID)
+	ls := &s.logScopes
+	ls.Lock()
+	if old := ls.scopes[key]; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+	if revert {
+		delete(ls.scopes, key)
+	} else {
+		if ls.scopes == nil {
+			ls.scopes = make(map[string]*logScope)
+		}
+		scope := &logScope{LogScope: LogScope{Server: server, Account: req.Account, CID: req.CID, Level: levelName}}
+		if req.Expires > 0 {
+			scope.Expires = time.Now().Add(req.Expires)
+			reset := &LogLevelRequest{Account: req.Account, CID: req.CID}
+			scope.timer = time.AfterFunc(req.Expires, func() {
+				ls.Lock()
+				expired := ls.scopes[key] == scope
+				ls.Unlock()
+				if expired {
+					s.SetLogLevel(reset)
+				}
+			})
+		}
+		ls.scopes[key] = scope
+	}
+	ls.Unlock()
+
+	if revert {
+		levelName = "the configured level"
+		if !server {
+			levelName = "off"
+		}
+	}
+	s.Noticef("Log level of %s set to %s", logScopeName(req.Account, req.CID), levelName)
+	return nil
+}
+
+func logScopeName(account string, cid uint64) string {
+	switch {
+	case account != _EMPTY_:
+		return fmt.Sprintf("account %q", account)
+	case cid != 0:
+		return fmt.Sprintf("connection %d", cid)
+	}
+	return "the server"
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// LogScopes returns the accounts and connections whose log level is raised.
+func (s *Server) LogScopes() []LogScope {
+	ls := &s.logScopes
+	ls.Lock()
+	scopes := make([]LogScope, 0, len(ls.scopes))
+	for _, scope := range ls.scopes {
+		scopes = append(scopes, scope.LogScope)
+	}
+	ls.Unlock()
+	// The server first, then accounts and connections.
+	sort.Slice(scopes, func(i, j int) bool {
+		a, b := &scopes[i], &scopes[j]
+		if a.Server != b.Server {
+			return a.Server
+		}
+		if a.CID != b.CID {
+			return a.CID < b.CID
+		}
+		return a.Account < b.Account
+	})
+	return scopes
+}
+
+// Removes the log scope of a closed connection.
+func (s *Server) removeConnLogScope(cid uint64) {
+	s.removeLogScope(logScopeKey(_EMPTY_, cid))
+}
+
+func (s *Server) removeLogScope(key string) {
+	ls := &s.logScopes
+	ls.Lock()
+	if scope := ls.scopes[key]; scope != nil {
+		if scope.timer != nil {
+			scope.timer.Stop()
+		}
+		delete(ls.scopes, key)
+	}
+	ls.Unlock()
+}
+
+// updateLogLevel sets the log level of the connection from its own level
+// and the level of its account.
+// Lock should be held.
+func (c *client) updateLogLevel() {
+	level := c.connLogLevel
+	if c.acc != nil {
+		level |= atomic.LoadInt32(&c.acc.logLevel)
+	}
+	atomic.StoreInt32(&c.logLevel, level)
+	c.setTraceLevel()
+}
+
+// logLevelReq is a request to raise the log level of an account or a
+// connection of this server.
+func (s *Server) logLevelReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var req LogLevelRequest
+	var resp LogLevelResponse
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = fmt.Sprintf("error unmarshalling request: %v", err)
+	} else if err := s.SetLogLevel(&req); err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Scopes = s.LogScopes()
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, &resp)
+	}
+}
+
+// LogzSetPath is the endpoint changing the log levels, only mounted if the
+// monitoring users are authenticated.
+const LogzSetPath = LogzPath + "/set"
+
+// HandleLogz process HTTP requests for the accounts and connections whose
+// log level is raised.
+func (s *Server) HandleLogz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[LogzPath]++
+	s.mu.Unlock()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Log levels can be changed only with a POST request to " + LogzSetPath))
+		return
+	}
+	s.writeLogz(w, r)
+}
+
+// HandleLogzSet process HTTP requests to set the log level of an account or
+// a connection, `POST /logz/set` with a LogLevelRequest as JSON body.
+func (s *Server) HandleLogzSet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[LogzPath]++
+	s.mu.Unlock()
+
+	req := &LogLevelRequest{}
+	if !decodeMonitorRequest(w, r, "Log levels can be changed", req) {
+		return
+	}
+	if err := s.SetLogLevel(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.writeLogz(w, r)
+}
+
+// Writes the scopes whose log level is raised.
+func (s *Server) writeLogz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	resp := &LogLevelResponse{Server: ServerInfo{Name: s.info.Name, Host: s.info.Host, ID: s.info.ID}}
+	s.mu.Unlock()
+	resp.Scopes = s.LogScopes()
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /logz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// errLogLimiter limits the error logs of the connections to a number per
+// second for each message format, the logs over the limit are counted and
+// reported once the second is over.
+type errLogLimiter struct {
+	sync.Mutex
+	start      time.Time
+	counts     map[string]int
+	suppressed map[string]int
+	timer      *time.Timer
+}
+
+// allowErrorLog returns true if the error log of a connection with this
+// format is not over the client_error_log_rate.
+func (s *Server) allowErrorLog(format string) bool {
+	rate := s.getOpts().ClientErrorLogRate
+	if rate <= 0 {
+		return true
+	}
+	l := &s.errLogs
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.start) >= time.Second || l.counts == nil {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	if l.counts[format]++; l.counts[format] <= rate {
+		return true
+	}
+	if l.suppressed == nil {
+		l.suppressed = make(map[string]int)
+		l.timer = time.AfterFunc(time.Second-now.Sub(l.start), s.reportSuppressedErrorLogs)
+	}
+	l.suppressed[format]++
+	return false
+}
+
+func (s *Server) reportSuppressedErrorLogs() {
+	l := &s.errLogs
+	l.Lock()
+	suppressed := l.suppressed
+	l.suppressed, l.timer = nil, nil
+	l.Unlock()
+	for format, n := range suppressed {
+		s.Warnf("Suppressed %d client error logs like %q", n, format)
+	}
+}
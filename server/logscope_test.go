@@ -0,0 +1,329 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type captureLevelLogger struct {
+	DummyLogger
+	mu     sync.Mutex
+	debugs []string
+	traces []string
+	errors []string
+	warns  []string
+}
+
+func (l *captureLevelLogger) Debugf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.debugs = append(l.debugs, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *captureLevelLogger) Tracef(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.traces = append(l.traces, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *captureLevelLogger) Errorf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *captureLevelLogger) Warnf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.warns = append(l.warns, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+// Returns the number of logs containing the text.
+func (l *captureLevelLogger) count(logs *[]string, txt string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, log := range *logs {
+		if strings.Contains(log, txt) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSetLogLevel(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		accounts {
+			A { users: [{user: a, password: a}] }
+			B { users: [{user: b, password: b}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	l := &captureLevelLogger{}
+	s.SetLogger(l, false, false)
+
+	for _, req := range []*LogLevelRequest{
+		{Account: "A", CID: 1, Level: "debug"},
+		{Account: "A", Level: "verbose"},
+		{Account: "C", Level: "debug"},
+		{CID: 1000, Level: "debug"},
+		{Account: "A", Level: "debug", Expires: -time.Second},
+	} {
+		if err := s.SetLogLevel(req); err == nil {
+			t.Fatalf("Expected an error for %+v", req)
+		}
+	}
+
+	if err := s.SetLogLevel(&LogLevelRequest{Account: "A", Level: "debug"}); err != nil {
+		t.Fatalf("Error setting the log level: %v", err)
+	}
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nca := natsConnect(t, url, nats.UserInfo("a", "a"))
+	ncb := natsConnect(t, url, nats.UserInfo("b", "b"))
+	defer ncb.Close()
+	cida, _ := nca.GetClientID()
+	cidb, _ := ncb.GetClientID()
+	nca.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if l.count(&l.debugs, fmt.Sprintf("cid:%d - Client connection closed", cida)) != 1 {
+			return fmt.Errorf("Expected the debug log of the connection of account A")
+		}
+		return nil
+	})
+
+	// Trace a single connection of account B.
+	if err := s.SetLogLevel(&LogLevelRequest{CID: cidb, Level: "trace"}); err != nil {
+		t.Fatalf("Error setting the log level: %v", err)
+	}
+	natsPub(t, ncb, "foo", []byte("hello"))
+	natsFlush(t, ncb)
+	if l.count(&l.traces, fmt.Sprintf("cid:%d - <<- [PUB foo 5]", cidb)) != 1 {
+		t.Fatalf("Expected the trace of the publish, got %q", l.traces)
+	}
+	scopes := s.LogScopes()
+	if len(scopes) != 2 || scopes[0].Account != "A" || scopes[0].Level != "debug" ||
+		scopes[1].CID != cidb || scopes[1].Level != "trace" {
+		t.Fatalf("Unexpected scopes: %+v", scopes)
+	}
+
+	// Reset and expire.
+	if err := s.SetLogLevel(&LogLevelRequest{CID: cidb, Level: "off"}); err != nil {
+		t.Fatalf("Error setting the log level: %v", err)
+	}
+	natsPub(t, ncb, "foo", []byte("hello"))
+	natsFlush(t, ncb)
+	if n := l.count(&l.traces, "<<- [PUB foo 5]"); n != 1 {
+		t.Fatalf("Expected no other trace, got %q", l.traces)
+	}
+	if err := s.SetLogLevel(&LogLevelRequest{Account: "A", Level: "trace", Expires: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("Error setting the log level: %v", err)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if scopes := s.LogScopes(); len(scopes) != 0 {
+			return fmt.Errorf("Expected the scopes to expire, got %+v", scopes)
+		}
+		return nil
+	})
+	if l.count(&l.debugs, "Client connection closed") != 1 {
+		t.Fatalf("Unexpected debug logs: %q", l.debugs)
+	}
+}
+
+func TestSetServerLogLevel(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Debug, opts.Trace = true, false
+	s := RunServer(opts)
+	defer s.Shutdown()
+	l := &captureLevelLogger{}
+	s.SetLogger(l, true, false)
+
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	cid, _ := nc.GetClientID()
+
+	// Disable debug, then trace the protocol messages.
+	if err := s.SetLogLevel(&LogLevelRequest{Level: "info"}); err != nil {
+		t.Fatalf("Error setting the log level: %v", err)
+	}
+	s.Debugf("not logged")
+	if err := s.SetLogLevel(&LogLevelRequest{Level: "trace", Expires: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Error setting the log level: %v", err)
+	}
+	s.Debugf("logged")
+	natsPub(t, nc, "foo", []byte("hello"))
+	natsFlush(t, nc)
+	if l.count(&l.debugs, "not logged") != 0 || l.count(&l.debugs, "logged") != 1 {
+		t.Fatalf("Unexpected debug logs: %q", l.debugs)
+	}
+	if l.count(&l.traces, fmt.Sprintf("cid:%d - <<- [PUB foo 5]", cid)) != 1 {
+		t.Fatalf("Expected the trace of the publish, got %q", l.traces)
+	}
+	if scopes := s.LogScopes(); len(scopes) != 1 || !scopes[0].Server || scopes[0].Level != "trace" {
+		t.Fatalf("Unexpected scopes: %+v", scopes)
+	}
+
+	// Reverted to the configured levels.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if scopes := s.LogScopes(); len(scopes) != 0 {
+			return fmt.Errorf("Expected the scopes to expire, got %+v", scopes)
+		}
+		return nil
+	})
+	natsPub(t, nc, "foo", []byte("hello"))
+	natsFlush(t, nc)
+	s.Debugf("logged again")
+	if l.count(&l.traces, "<<- [PUB foo 5]") != 1 || l.count(&l.debugs, "logged again") != 1 {
+		t.Fatalf("Expected the configured levels, got traces %q and debugs %q", l.traces, l.debugs)
+	}
+}
+
+func TestLogLevelRequests(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: "127.0.0.1:-1"
+		system_account: SYS
+		monitor {
+			users: [
+				{user: ops, password: ops, endpoints: "/logz"}
+				{user: admin, password: admin}
+			]
+		}
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A { users: [{user: a, password: a}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port), nats.UserInfo("sys", "sys"))
+	defer nc.Close()
+	req, _ := json.Marshal(&LogLevelRequest{Account: "A", Level: "debug"})
+	msg, err := nc.Request(fmt.Sprintf(logLevelReqSubj, s.ID()), req, time.Second)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	var resp LogLevelResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if resp.Error != _EMPTY_ || resp.Server.ID != s.ID() || len(resp.Scopes) != 1 || resp.Scopes[0].Account != "A" {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	logz := fmt.Sprintf("http://127.0.0.1:%d", s.MonitorAddr().Port)
+	do := func(method, path, user, ct, body string) (int, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(method, logz+path, strings.NewReader(body))
+		req.SetBasicAuth(user, user)
+		req.Header.Set("Content-Type", ct)
+		hresp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		defer hresp.Body.Close()
+		b, _ := ioutil.ReadAll(hresp.Body)
+		return hresp.StatusCode, b
+	}
+	status, body := do(http.MethodPost, LogzSetPath, "admin", "application/json", `{"account":"A","level":"off"}`)
+	resp = LogLevelResponse{}
+	if err := json.Unmarshal(body, &resp); status != http.StatusOK || err != nil {
+		t.Fatalf("Unexpected response %v %q: %v", status, body, err)
+	}
+	if len(resp.Scopes) != 0 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	for _, test := range []struct {
+		method, path, user, ct, body string
+		status                       int
+	}{
+		{http.MethodGet, LogzPath, "ops", "", "", http.StatusOK},
+		// Reading the log levels does not allow to change them.
+		{http.MethodPost, LogzPath + "?acc=A&level=trace", "admin", "", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, LogzSetPath, "ops", "application/json", `{"account":"A","level":"trace"}`, http.StatusForbidden},
+		{http.MethodPost, LogzSetPath, "admin", "application/x-www-form-urlencoded", `{"account":"A","level":"trace"}`, http.StatusUnsupportedMediaType},
+		{http.MethodGet, LogzSetPath, "admin", "application/json", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, LogzSetPath, "admin", "application/json", `{"account":"A","level":"bad"}`, http.StatusBadRequest},
+	} {
+		if status, body := do(test.method, test.path, test.user, test.ct, test.body); status != test.status {
+			t.Fatalf("Expected status %v for %s %s as %s, got %v: %s", test.status, test.method, test.path, test.user, status, body)
+		}
+	}
+	if scopes := s.LogScopes(); len(scopes) != 0 {
+		t.Fatalf("Expected no scope, got %+v", scopes)
+	}
+}
+
+func TestLogzSetRequiresMonitorAuth(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, LogzSetPath)
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"level":"trace"}`))
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the endpoint to be disabled, got %v", resp.StatusCode)
+	}
+}
+
+func TestClientErrorLogRate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ClientErrorLogRate = 2
+	s := RunServer(opts)
+	defer s.Shutdown()
+	l := &captureLevelLogger{}
+	s.SetLogger(l, false, false)
+
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	cid, _ := nc.GetClientID()
+	c := s.getClient(cid)
+	for i := 0; i < 5; i++ {
+		c.Errorf("Repeated error %d", i)
+	}
+	c.Errorf("Other error")
+	if n := l.count(&l.errors, "Repeated error"); n != 2 {
+		t.Fatalf("Expected 2 error logs, got %q", l.errors)
+	}
+	if n := l.count(&l.errors, "Other error"); n != 1 {
+		t.Fatalf("Expected the other error log, got %q", l.errors)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if l.count(&l.warns, `Suppressed 3 client error logs like "Repeated error %d"`) != 1 {
+			return fmt.Errorf("Expected the suppressed logs to be reported, got %q", l.warns)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Root of the cgroup file system, changed by tests.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupCPULimit returns the number of CPUs the process is limited to by
+// its cgroup CPU quota, rounded up, or 0 if it is not limited. Both the
+// unified (v2) and cpu controller (v1) hierarchies are checked.
+func cgroupCPULimit() int {
+	// cgroup v2: "<quota> <period>" or "max <period>".
+	if b, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) != 2 || f[0] == "max" {
+			return 0
+		}
+		return cpuQuota(f[0], f[1])
+	}
+	// cgroup v1, the quota is -1 if not limited.
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		quota, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		period, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			continue
+		}
+		return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+	}
+	return 0
+}
+
+// Returns the quota divided by the period, rounded up, 0 if not limited.
+func cpuQuota(quota, period string) int {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(q) / float64(p)))
+}
+
+// configureMaxProcs sets GOMAXPROCS to the max_procs option. Without it,
+// and unless the GOMAXPROCS environment variable is set, GOMAXPROCS is
+// lowered to the CPU quota of the cgroup, if any.
+func (s *Server) configureMaxProcs() {
+	opts := s.getOpts()
+	cur := runtime.GOMAXPROCS(0)
+	n, reason := opts.MaxProcs, "max_procs"
+	if n <= 0 {
+		if os.Getenv("GOMAXPROCS") != _EMPTY_ {
+			return
+		}
+		n, reason = cgroupCPULimit(), "cgroup CPU quota"
+		if n <= 0 || n >= cur {
+			return
+		}
+	}
+	if n != cur {
+		runtime.GOMAXPROCS(n)
+		s.Noticef("Set GOMAXPROCS to %d from the %s", n, reason)
+	}
+}
+
+// startAcceptWorker sets up an accepted connection in its own go routine,
+// once a worker of the pool is available. This bounds the CPU spent on the
+// handshakes of connection floods, so that the delivery of messages is not
+// stalled. A nil pool is not bounded.
+func (s *Server) startAcceptWorker(pool chan struct{}, conn net.Conn, create func(net.Conn)) {
+	if pool != nil {
+		select {
+		case pool <- struct{}{}:
+		case <-s.quitCh:
+			conn.Close()
+			return
+		}
+	}
+	if !s.startGoRoutine(func() {
+		create(conn)
+		if pool != nil {
+			<-pool
+		}
+		s.grWG.Done()
+	}) && pool != nil {
+		<-pool
+	}
+}
+
+// Returns the pool of workers for the given size, nil if not bounded.
+func newAcceptPool(size int) chan struct{} {
+	if size <= 0 {
+		return nil
+	}
+	return make(chan struct{}, size)
+}
+
+func validateMaxProcsOptions(o *Options) error {
+	if o.MaxProcs < 0 {
+		return fmt.Errorf("max_procs can not be negative")
+	}
+	if o.AcceptWorkers < 0 || o.RouteAcceptWorkers < 0 {
+		return fmt.Errorf("accept workers can not be negative")
+	}
+	if o.MaxTLSHandshakes < 0 {
+		return fmt.Errorf("max_tls_handshakes can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func createCgroupDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestCgroupCPULimit(t *testing.T) {
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+
+	write := func(dir, name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Error creating directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		cpuMax   string
+		expected int
+	}{
+		{"unlimited", "max 100000\n", 0},
+		{"exact", "200000 100000\n", 2},
+		{"rounded up", "150000 100000\n", 2},
+		{"invalid", "abc 100000\n", 0},
+	} {
+		t.Run("v2 "+test.name, func(t *testing.T) {
+			cgroupRoot = createCgroupDir(t)
+			defer os.RemoveAll(cgroupRoot)
+			write(cgroupRoot, "cpu.max", test.cpuMax)
+			if n := cgroupCPULimit(); n != test.expected {
+				t.Fatalf("Expected %d CPUs, got %d", test.expected, n)
+			}
+		})
+	}
+
+	cgroupRoot = createCgroupDir(t)
+	defer os.RemoveAll(cgroupRoot)
+	dir := filepath.Join(cgroupRoot, "cpu,cpuacct")
+	write(dir, "cpu.cfs_quota_us", "-1\n")
+	write(dir, "cpu.cfs_period_us", "100000\n")
+	if n := cgroupCPULimit(); n != 0 {
+		t.Fatalf("Expected no limit, got %d", n)
+	}
+	write(dir, "cpu.cfs_quota_us", "300000\n")
+	if n := cgroupCPULimit(); n != 3 {
+		t.Fatalf("Expected 3 CPUs, got %d", n)
+	}
+}
+
+func TestConfigureMaxProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = createCgroupDir(t)
+	defer os.RemoveAll(cgroupRoot)
+	if err := ioutil.WriteFile(filepath.Join(cgroupRoot, "cpu.max"), []byte("100000 100000"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	runtime.GOMAXPROCS(4)
+
+	opts := DefaultOptions()
+	opts.MaxProcs = 3
+	s := RunServer(opts)
+	defer s.Shutdown()
+	if n := runtime.GOMAXPROCS(0); n != 3 {
+		t.Fatalf("Expected GOMAXPROCS to be 3, got %d", n)
+	}
+
+	// Without max_procs, the cgroup CPU quota is used unless GOMAXPROCS is set.
+	if os.Getenv("GOMAXPROCS") == _EMPTY_ {
+		s.getOpts().MaxProcs = 0
+		s.configureMaxProcs()
+		if n := runtime.GOMAXPROCS(0); n != 1 {
+			t.Fatalf("Expected GOMAXPROCS to be 1, got %d", n)
+		}
+	}
+}
+
+func TestAcceptWorkers(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AcceptWorkers = 1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// Hold the only worker.
+	release := make(chan struct{})
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s.startAcceptWorker(s.acceptPool, c1, func(conn net.Conn) { <-release })
+
+	created := make(chan struct{})
+	go s.startAcceptWorker(s.acceptPool, c1, func(conn net.Conn) { close(created) })
+	select {
+	case <-created:
+		t.Fatal("Expected the connection to wait for a worker")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-created:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the connection to be set up once the worker was released")
+	}
+
+	// Clients connect through the pool.
+	for i := 0; i < 5; i++ {
+		nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		nc.Close()
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+)
+
+const (
+	// Estimated memory used by a subscription, including its entries in
+	// the client map and in the account sublist, without its subject.
+	memSubscriptionSize = 256
+	// Estimated memory used by an entry of the reply maps, without its
+	// subject.
+	memReplySize = 96
+	// How often the memory quotas of the accounts are checked.
+	memQuotaCheckInterval = time.Second
+)
+
+// AccountMemory is the estimated memory used by the connections of an
+// account on this server, in bytes.
+type AccountMemory struct {
+	Pending       int64 `json:"pending"`
+	Subscriptions int64 `json:"subscriptions"`
+	Replies       int64 `json:"replies"`
+	Total         int64 `json:"total"`
+	Limit         int64 `json:"limit,omitempty"`
+}
+
+func (m *AccountMemory) add(o *AccountMemory) {
+	m.Pending += o.Pending
+	m.Subscriptions += o.Subscriptions
+	m.Replies += o.Replies
+	m.Total += o.Total
+}
+
+// memoryUsage returns the estimated memory used by the client for its
+// pending outbound data, its subscriptions and its reply maps.
+// Lock should be held.
+func (c *client) memoryUsage() AccountMemory {
+	m := AccountMemory{Pending: c.out.pb}
+	for _, sub := range c.subs {
+		m.Subscriptions += memSubscriptionSize + int64(len(sub.subject)+len(sub.queue))
+	}
+	if c.replies != nil {
+		m.Replies += int64(c.replies.len()) * memReplySize
+	}
+	for subj := range c.rrTracking {
+		m.Replies += memReplySize + int64(len(subj))
+	}
+	m.Total = m.Pending + m.Subscriptions + m.Replies
+	return m
+}
+
+// Returns the client and leafnode connections of the account.
+func (a *Account) localClients() []*client {
+	a.mu.RLock()
+	clients := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		if c.kind == CLIENT || c.kind == LEAF {
+			clients = append(clients, c)
+		}
+	}
+	a.mu.RUnlock()
+	return clients
+}
+
+// memoryUsage returns the estimated memory used by the connections of the
+// account, including the service reply maps of the account itself.
+func (a *Account) memoryUsage() *AccountMemory {
+	m := &AccountMemory{}
+	for _, c := range a.localClients() {
+		c.mu.Lock()
+		cm := c.memoryUsage()
+		c.mu.Unlock()
+		m.add(&cm)
+	}
+	a.mu.RLock()
+	for reply := range a.respMap {
+		m.Replies += memReplySize + int64(len(reply))
+		m.Total += memReplySize + int64(len(reply))
+	}
+	m.Limit = a.maxMemory
+	a.mu.RUnlock()
+	return m
+}
+
+// enforceMemoryQuota closes the connections of the account with the most
+// pending data, then the most memory, until the account is back under its
+// memory quota. Returns the number of connections closed.
+func (a *Account) enforceMemoryQuota() int {
+	a.mu.RLock()
+	limit := a.maxMemory
+	a.mu.RUnlock()
+	if limit <= 0 {
+		return 0
+	}
+	m := a.memoryUsage()
+	if m.Total <= limit {
+		return 0
+	}
+	type usage struct {
+		c *client
+		m AccountMemory
+	}
+	var clients []usage
+	for _, c := range a.localClients() {
+		c.mu.Lock()
+		clients = append(clients, usage{c, c.memoryUsage()})
+		c.mu.Unlock()
+	}
+	closed := 0
+	for total := m.Total; total > limit && len(clients) > 0; closed++ {
+		max := 0
+		for i := range clients {
+			cm, mm := &clients[i].m, &clients[max].m
+			if cm.Pending > mm.Pending || (cm.Pending == mm.Pending && cm.Total > mm.Total) {
+				max = i
+			}
+		}
+		u := clients[max]
+		clients = append(clients[:max], clients[max+1:]...)
+		u.c.Warnf("Closing connection, account %q over its memory quota of %d bytes with %d bytes",
+			a.Name, limit, total)
+		u.c.closeConnection(MemoryQuotaExceeded)
+		total -= u.m.Total
+	}
+	return closed
+}
+
+// startMemoryQuotas periodically checks the memory quotas of the accounts.
+func (s *Server) startMemoryQuotas() {
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		t := time.NewTicker(memQuotaCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.accounts.Range(func(_, v interface{}) bool {
+					v.(*Account).enforceMemoryQuota()
+					return true
+				})
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestAccountMemoryQuota(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A { users [{user: a, password: pwd}], max_memory: 8KB }
+			B { users [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	accA, _ := s.LookupAccount("A")
+	if accA.maxMemory != 8*1024 {
+		t.Fatalf("Expected max_memory of 8KB, got %d", accA.maxMemory)
+	}
+
+	subscribe := func(user string, n int) *nats.Conn {
+		t.Helper()
+		nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, "pwd"))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			nc.SubscribeSync(fmt.Sprintf("foo.%d", i))
+		}
+		nc.Flush()
+		return nc
+	}
+	nca := subscribe("a", 10)
+	defer nca.Close()
+	ncb := subscribe("b", 50)
+	defer ncb.Close()
+
+	m := accA.memoryUsage()
+	if m.Subscriptions < 10*memSubscriptionSize || m.Total != m.Pending+m.Subscriptions+m.Replies || m.Limit != 8*1024 {
+		t.Fatalf("Unexpected memory usage: %+v", m)
+	}
+	if n := accA.enforceMemoryQuota(); n != 0 {
+		t.Fatalf("Expected no connection closed under the quota, got %d", n)
+	}
+
+	// Go over the quota of A, B has no quota.
+	nca2 := subscribe("a", 25)
+	defer nca2.Close()
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if n := accA.NumLocalConnections(); n != 1 {
+			return fmt.Errorf("Expected 1 connection for A, got %d", n)
+		}
+		return nil
+	})
+	if n := accA.memoryUsage().Total; n > 8*1024 {
+		t.Fatalf("Expected A to be under its quota, got %d", n)
+	}
+	if !nca.IsConnected() || !ncb.IsConnected() {
+		t.Fatal("Expected the other connections to remain")
+	}
+	conns := s.closedClients()
+	if len(conns) != 1 || conns[0].Reason != MemoryQuotaExceeded.String() {
+		t.Fatalf("Unexpected closed connections: %+v", conns)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Name of the raft group replicating the cluster-wide metadata.
+	metaGroup = "META"
+
+	// The account JWT of the account resolver.
+	metaOpAccount = "account"
+	// The definitions of the streams and of their durable consumers.
+	metaOpStream         = "stream"
+	metaOpStreamDelete   = "stream_delete"
+	metaOpConsumer       = "consumer"
+	metaOpConsumerDelete = "consumer_delete"
+)
+
+var errMetaInvalidEntry = errors.New("invalid metadata entry")
+
+// metaEntry is a change of the cluster-wide metadata. The changes of the
+// streams are the ones of the streams of Account named Name, requested
+// with Reply to the server of ID Origin, which responds once applied.
+type metaEntry struct {
+	Op       string                `json:"op"`
+	Name     string                `json:"name"`
+	JWT      string                `json:"jwt,omitempty"`
+	Account  string                `json:"account,omitempty"`
+	Stream   *StreamConfig         `json:"stream,omitempty"`
+	Consumer *StreamConsumerConfig `json:"consumer,omitempty"`
+	Origin   string                `json:"origin,omitempty"`
+	Reply    string                `json:"reply,omitempty"`
+}
+
+// metaStreams are the streams of an account defined through the API, and
+// the durable consumers defined through the API by stream, including the
+// ones of the streams of the configuration.
+type metaStreams struct {
+	Streams   map[string]*StreamConfig                    `json:"streams,omitempty"`
+	Consumers map[string]map[string]*StreamConsumerConfig `json:"consumers,omitempty"`
+}
+
+// metaSnapshot is the encoded state of the metadata group.
+type metaSnapshot struct {
+	Accounts map[string]string       `json:"accounts,omitempty"`
+	Streams  map[string]*metaStreams `json:"streams,omitempty"`
+}
+
+// metaState is the cluster-wide metadata replicated by the metadata group:
+// the contents of the account resolver, and the streams and consumers
+// defined through the API, by account.
+type metaState struct {
+	s        *Server
+	mu       sync.Mutex
+	accounts map[string]string
+	streams  map[string]*metaStreams
+}
+
+func (ms *metaState) apply(data []byte) {
+	var e metaEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		ms.s.Warnf("Invalid metadata entry: %v", err)
+		return
+	}
+	switch e.Op {
+	case metaOpAccount:
+		ms.mu.Lock()
+		ms.accounts[e.Name] = e.JWT
+		ms.mu.Unlock()
+		ms.s.applyAccountClaims(e.Name, e.JWT)
+	case metaOpStream, metaOpStreamDelete, metaOpConsumer, metaOpConsumerDelete:
+		err := ms.applyStreams(&e)
+		if err == nil {
+			ms.s.applyStreamDefinition(&e)
+		}
+		ms.s.respondStreamDefinition(&e, err)
+	default:
+		ms.s.Warnf("Unknown metadata entry %q", e.Op)
+	}
+}
+
+// applyStreams applies a change of the streams. The change is checked
+// again, since the leader may have accepted conflicting requests.
+func (ms *metaState) applyStreams(e *metaEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mss := ms.streams[e.Account]
+	if mss == nil {
+		mss = &metaStreams{
+			Streams:   make(map[string]*StreamConfig),
+			Consumers: make(map[string]map[string]*StreamConsumerConfig),
+		}
+		ms.streams[e.Account] = mss
+	}
+	defer func() {
+		if len(mss.Streams) == 0 && len(mss.Consumers) == 0 {
+			delete(ms.streams, e.Account)
+		}
+	}()
+	switch e.Op {
+	case metaOpStream:
+		if e.Stream == nil {
+			return errMetaInvalidEntry
+		}
+		if mss.Streams[e.Name] != nil {
+			return fmt.Errorf("stream %q already exists", e.Name)
+		}
+		mss.Streams[e.Name] = e.Stream
+	case metaOpStreamDelete:
+		if mss.Streams[e.Name] == nil {
+			return errStreamNotFound
+		}
+		delete(mss.Streams, e.Name)
+		delete(mss.Consumers, e.Name)
+	case metaOpConsumer:
+		if e.Consumer == nil {
+			return errMetaInvalidEntry
+		}
+		if mss.Consumers[e.Name][e.Consumer.Durable] != nil {
+			return fmt.Errorf("consumer %q already exists", e.Consumer.Durable)
+		}
+		if mss.Consumers[e.Name] == nil {
+			mss.Consumers[e.Name] = make(map[string]*StreamConsumerConfig)
+		}
+		mss.Consumers[e.Name][e.Consumer.Durable] = e.Consumer
+	case metaOpConsumerDelete:
+		if e.Consumer == nil {
+			return errMetaInvalidEntry
+		}
+		if mss.Consumers[e.Name][e.Consumer.Durable] == nil {
+			return errStreamConsumerNotFound
+		}
+		delete(mss.Consumers[e.Name], e.Consumer.Durable)
+		if len(mss.Consumers[e.Name]) == 0 {
+			delete(mss.Consumers, e.Name)
+		}
+	}
+	return nil
+}
+
+// accountStreams returns a copy of the streams and consumers of the
+// account defined through the API.
+func (ms *metaState) accountStreams(account string) (map[string]*StreamConfig, map[string][]*StreamConsumerConfig) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mss := ms.streams[account]
+	if mss == nil {
+		return nil, nil
+	}
+	streams := make(map[string]*StreamConfig, len(mss.Streams))
+	for name, cfg := range mss.Streams {
+		c := *cfg
+		streams[name] = &c
+	}
+	consumers := make(map[string][]*StreamConsumerConfig, len(mss.Consumers))
+	for stream, scs := range mss.Consumers {
+		for _, cfg := range scs {
+			c := *cfg
+			consumers[stream] = append(consumers[stream], &c)
+		}
+	}
+	return streams, consumers
+}
+
+func (ms *metaState) snapshot() []byte {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	b, _ := json.Marshal(&metaSnapshot{Accounts: ms.accounts, Streams: ms.streams})
+	return b
+}
+
+func (ms *metaState) restore(data []byte) error {
+	var snap metaSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.Accounts == nil {
+		snap.Accounts = make(map[string]string)
+	}
+	if snap.Streams == nil {
+		snap.Streams = make(map[string]*metaStreams)
+	}
+	ms.mu.Lock()
+	ms.accounts, ms.streams = snap.Accounts, snap.Streams
+	ms.mu.Unlock()
+	for name, claimJWT := range snap.Accounts {
+		ms.s.applyAccountClaims(name, claimJWT)
+	}
+	ms.s.configureStreams()
+	return nil
+}
+
+// startMetadata starts the member of the metadata group of this server,
+// if configured.
+func (s *Server) startMetadata() {
+	opts := s.getOpts().Metadata
+	if len(opts.Peers) == 0 {
+		return
+	}
+	if !s.EventsEnabled() {
+		s.Warnf("Metadata replication requires a system account")
+		return
+	}
+	var dir string
+	if opts.StoreDir != _EMPTY_ {
+		dir = filepath.Join(opts.StoreDir, metaGroup)
+	}
+	ms := &metaState{s: s, accounts: make(map[string]string), streams: make(map[string]*metaStreams)}
+	// The state is needed by the streams as soon as the entries are applied.
+	s.mu.Lock()
+	s.metaState = ms
+	s.mu.Unlock()
+	n, err := s.startRaftGroup(metaGroup, opts.Peers, dir, ms)
+	if err != nil {
+		s.Errorf("Error starting metadata replication: %v", err)
+		s.mu.Lock()
+		s.metaState = nil
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Lock()
+	s.meta = n
+	s.mu.Unlock()
+	s.Noticef("Metadata replicated with %s", strings.Join(opts.Peers, ", "))
+}
+
+// proposeAccountClaims replicates an account JWT received by this server,
+// if it is the leader of the metadata group. The other members received
+// it as well.
+func (s *Server) proposeAccountClaims(name, claimJWT string) {
+	s.mu.Lock()
+	n := s.meta
+	s.mu.Unlock()
+	if n == nil || !n.isLeader() {
+		return
+	}
+	claims, _, err := s.verifyAccountClaims(claimJWT)
+	if err != nil || claims.Subject != name || !s.isTrustedIssuer(claims.Issuer) {
+		s.Debugf("Not replicating invalid claims of account %q", name)
+		return
+	}
+	b, _ := json.Marshal(&metaEntry{Op: metaOpAccount, Name: name, JWT: claimJWT})
+	if err := n.Propose(b); err != nil {
+		s.Warnf("Error replicating claims of account %q: %v", name, err)
+	}
+}
+
+// applyAccountClaims stores a replicated account JWT in the account
+// resolver and updates the account, if loaded.
+func (s *Server) applyAccountClaims(name, claimJWT string) {
+	if ar := s.AccountResolver(); ar != nil {
+		if err := ar.Store(name, claimJWT); err != nil {
+			s.Debugf("Replicated claims of account %q not stored: %v", name, err)
+		}
+	}
+	if v, ok := s.accounts.Load(name); ok {
+		s.updateAccountWithClaimJWT(v.(*Account), claimJWT)
+	}
+}
+
+func validateMetadataOptions(o *Options) error {
+	peers := o.Metadata.Peers
+	if len(peers) == 0 {
+		return nil
+	}
+	if o.ServerName == _EMPTY_ {
+		return fmt.Errorf("metadata replication requires a server_name")
+	}
+	sorted := append([]string(nil), peers...)
+	sort.Strings(sorted)
+	for i, p := range sorted {
+		if !IsValidLiteralSubject(p) || strings.Contains(p, tsep) {
+			return fmt.Errorf("invalid metadata peer %q", p)
+		}
+		if i > 0 && p == sorted[i-1] {
+			return fmt.Errorf("duplicate metadata peer %q", p)
+		}
+	}
+	for _, p := range peers {
+		if p == o.ServerName {
+			return nil
+		}
+	}
+	return fmt.Errorf("server_name %q is not one of the metadata peers", o.ServerName)
+}
@@ -20,6 +20,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
@@ -32,11 +33,9 @@ import (
 
 // Snapshot this
 var numCores int
-var maxProcs int
 
 func init() {
 	numCores = runtime.NumCPU()
-	maxProcs = runtime.GOMAXPROCS(0)
 }
 
 // Connz represents detailed information on current client connections.
@@ -78,6 +77,15 @@ type ConnzOptions struct {
 	// Filter by connection state.
 	State ConnState `json:"state"`
 
+	// RTT indicates that the RTT of the open connections should be
+	// measured before being returned.
+	RTT bool `json:"rtt"`
+
+	// Delta indicates that the rates of the counters since the previous
+	// request with the same Token should be returned.
+	Delta bool   `json:"delta"`
+	Token string `json:"token"`
+
 	// The below options only apply if auth is true.
 
 	// Filter by username.
@@ -104,19 +112,24 @@ type ConnInfo struct {
 	Cid            uint64      `json:"cid"`
 	IP             string      `json:"ip"`
 	Port           int         `json:"port"`
+	UnixSocket     string      `json:"unix_socket,omitempty"`
 	Start          time.Time   `json:"start"`
 	LastActivity   time.Time   `json:"last_activity"`
 	Stop           *time.Time  `json:"stop,omitempty"`
 	Reason         string      `json:"reason,omitempty"`
+	ReasonCode     string      `json:"reason_code,omitempty"`
 	RTT            string      `json:"rtt,omitempty"`
 	Uptime         string      `json:"uptime"`
 	Idle           string      `json:"idle"`
 	Pending        int         `json:"pending_bytes"`
+	PendingMsgs    int         `json:"pending_msgs,omitempty"`
+	DroppedMsgs    int64       `json:"dropped_msgs,omitempty"`
 	InMsgs         int64       `json:"in_msgs"`
 	OutMsgs        int64       `json:"out_msgs"`
 	InBytes        int64       `json:"in_bytes"`
 	OutBytes       int64       `json:"out_bytes"`
 	NumSubs        uint32      `json:"subscriptions"`
+	ReplyPerms     int         `json:"reply_permissions,omitempty"`
 	Name           string      `json:"name,omitempty"`
 	Lang           string      `json:"lang,omitempty"`
 	Version        string      `json:"version,omitempty"`
@@ -126,6 +139,38 @@ type ConnInfo struct {
 	Account        string      `json:"account,omitempty"`
 	Subs           []string    `json:"subscriptions_list,omitempty"`
 	SubsDetail     []SubDetail `json:"subscriptions_list_detail,omitempty"`
+	Rates          *Rates      `json:"rates,omitempty"`
+}
+
+// rttMeasurementWait is how long the monitoring endpoints wait for the
+// PONGs of the connections when asked to measure their RTT.
+const rttMeasurementWait = time.Second
+
+// measureRTT sends a PING to the given connections and waits for their
+// PONGs, at most rttMeasurementWait, so that their RTT is up to date.
+// Connections that did not answer in time keep their previous RTT.
+func measureRTT(conns []*client) {
+	pending := make([]*client, 0, len(conns))
+	for _, c := range conns {
+		if c.sendRTTPing() {
+			pending = append(pending, c)
+		}
+	}
+	deadline := time.Now().Add(rttMeasurementWait)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		n := 0
+		for _, c := range pending {
+			c.mu.Lock()
+			waiting := c.ping.out > 0 && !c.isClosed()
+			c.mu.Unlock()
+			if waiting {
+				pending[n] = c
+				n++
+			}
+		}
+		pending = pending[:n]
+	}
 }
 
 // DefaultConnListSize is the default size of the connection list.
@@ -165,6 +210,9 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		state   = ConnOpen
 		user    string
 		acc     string
+		rtt     bool
+		delta   bool
+		token   string
 	)
 
 	if opts != nil {
@@ -180,11 +228,16 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 
 		// Auth specifics.
 		auth = opts.Username
+		user = opts.User
+		acc = opts.Account
 		if !auth && (user != "" || acc != "") {
 			return nil, fmt.Errorf("filter by user or account only allowed with auth option")
 		}
-		user = opts.User
-		acc = opts.Account
+		rtt = opts.RTT
+		delta, token = opts.Delta, opts.Token
+		if delta && token == _EMPTY_ {
+			return nil, fmt.Errorf("delta requires a token")
+		}
 
 		subs = opts.Subscriptions
 		subsDet = opts.SubscriptionsDetail
@@ -271,20 +324,22 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 
 	// Search by individual CID.
 	if cid > 0 {
+		if state == ConnOpen || state == ConnAll {
+			client := s.clients[cid]
+			if client != nil {
+				openClients = append(openClients, client)
+			}
+		}
 		if state == ConnClosed || state == ConnAll {
 			copyClosed := closedClients
 			closedClients = nil
+			// An open connection can not also be in the closed list.
 			for _, cc := range copyClosed {
-				if cc.Cid == cid {
+				if cc.Cid == cid && len(openClients) == 0 {
 					closedClients = []*closedClient{cc}
 					break
 				}
 			}
-		} else if state == ConnOpen || state == ConnAll {
-			client := s.clients[cid]
-			if client != nil {
-				openClients = append(openClients, client)
-			}
 		}
 	} else {
 		// Gather all open clients.
@@ -310,6 +365,10 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		return c, nil
 	}
 
+	if rtt {
+		measureRTT(openClients)
+	}
+
 	// Now whip through and generate ConnInfo entries
 
 	// Open Clients
@@ -340,7 +399,7 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 	}
 	// Closed Clients
 	var needCopy bool
-	if subs || auth {
+	if subs || auth || delta {
 		needCopy = true
 	}
 	for _, cc := range closedClients {
@@ -394,6 +453,8 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		sort.Sort(sort.Reverse(bySubs{pconns}))
 	case ByPending:
 		sort.Sort(sort.Reverse(byPending{pconns}))
+	case ByPendingMsgs:
+		sort.Sort(sort.Reverse(byPendingMsgs{pconns}))
 	case ByOutMsgs:
 		sort.Sort(sort.Reverse(byOutMsgs{pconns}))
 	case ByInMsgs:
@@ -435,6 +496,12 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 	c.Conns = pconns[minoff:maxoff]
 	c.NumConns = len(c.Conns)
 
+	if delta {
+		if err := s.setConnRates(token, c.Conns, c.Now); err != nil {
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
@@ -450,7 +517,12 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
 	ci.OutMsgs = client.outMsgs
 	ci.OutBytes = client.outBytes
 	ci.NumSubs = uint32(len(client.subs))
+	if client.replies != nil {
+		ci.ReplyPerms = client.replies.len()
+	}
 	ci.Pending = int(client.out.pb)
+	ci.PendingMsgs = int(client.out.pm)
+	ci.DroppedMsgs = client.out.sm
 	ci.Name = client.opts.Name
 	ci.Lang = client.opts.Lang
 	ci.Version = client.opts.Version
@@ -472,6 +544,8 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
 	if client.port != 0 {
 		ci.Port = int(client.port)
 		ci.IP = client.host
+	} else if uc, ok := nc.(*net.UnixConn); ok {
+		ci.UnixSocket = uc.LocalAddr().String()
 	}
 }
 
@@ -591,6 +665,14 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	rtt, err := decodeBool(w, r, "rtt")
+	if err != nil {
+		return
+	}
+	delta, err := decodeBool(w, r, "delta")
+	if err != nil {
+		return
+	}
 
 	user := r.URL.Query().Get("user")
 	acc := r.URL.Query().Get("acc")
@@ -606,6 +688,9 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 		State:               state,
 		User:                user,
 		Account:             acc,
+		RTT:                 rtt,
+		Delta:               delta,
+		Token:               r.URL.Query().Get("token"),
 	}
 
 	s.mu.Lock()
@@ -630,6 +715,8 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 // Routez represents detailed information on current client connections.
 type Routez struct {
 	ID        string             `json:"server_id"`
+	Name      string             `json:"server_name"`
+	Cluster   string             `json:"cluster,omitempty"`
 	Now       time.Time          `json:"now"`
 	Import    *SubjectPermission `json:"import,omitempty"`
 	Export    *SubjectPermission `json:"export,omitempty"`
@@ -643,12 +730,17 @@ type RoutezOptions struct {
 	Subscriptions bool `json:"subscriptions"`
 	// SubscriptionsDetail indicates if subscription details should be included in the results
 	SubscriptionsDetail bool `json:"subscriptions_detail"`
+	// RTT indicates that the RTT of the routes should be measured before being returned.
+	RTT bool `json:"rtt"`
 }
 
 // RouteInfo has detailed information on a per connection basis.
 type RouteInfo struct {
 	Rid          uint64             `json:"rid"`
 	RemoteID     string             `json:"remote_id"`
+	RemoteName   string             `json:"remote_name,omitempty"`
+	Cluster      string             `json:"cluster,omitempty"`
+	Tags         map[string]string  `json:"tags,omitempty"`
 	DidSolicit   bool               `json:"did_solicit"`
 	IsConfigured bool               `json:"is_configured"`
 	IP           string             `json:"ip"`
@@ -675,11 +767,23 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 		routezOpts = &RoutezOptions{}
 	}
 
+	if routezOpts.RTT {
+		s.mu.Lock()
+		routes := make([]*client, 0, len(s.routes))
+		for _, r := range s.routes {
+			routes = append(routes, r)
+		}
+		s.mu.Unlock()
+		measureRTT(routes)
+	}
+
 	s.mu.Lock()
 	rs.NumRoutes = len(s.routes)
 
 	// copy the server id for monitoring
 	rs.ID = s.info.ID
+	rs.Name = s.info.Name
+	rs.Cluster = s.info.Cluster
 
 	// Check for defined permissions for all connected routes.
 	if perms := s.getOpts().Cluster.Permissions; perms != nil {
@@ -693,6 +797,9 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 		ri := &RouteInfo{
 			Rid:          r.cid,
 			RemoteID:     r.route.remoteID,
+			RemoteName:   r.route.remoteName,
+			Cluster:      r.route.cluster,
+			Tags:         copyTags(r.route.remoteTags),
 			DidSolicit:   r.route.didSolicit,
 			IsConfigured: r.route.routeType == Explicit,
 			InMsgs:       atomic.LoadInt64(&r.inMsgs),
@@ -733,7 +840,12 @@ func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	opts := RoutezOptions{Subscriptions: subs, SubscriptionsDetail: subsDetail}
+	rtt, err := decodeBool(w, r, "rtt")
+	if err != nil {
+		return
+	}
+
+	opts := RoutezOptions{Subscriptions: subs, SubscriptionsDetail: subsDetail, RTT: rtt}
 
 	s.mu.Lock()
 	s.httpReqStats[RoutezPath]++
@@ -757,6 +869,9 @@ type Subsz struct {
 	Offset int         `json:"offset"`
 	Limit  int         `json:"limit"`
 	Subs   []SubDetail `json:"subscriptions_list,omitempty"`
+
+	Routes   []RouteInterest   `json:"routes,omitempty"`
+	Gateways []GatewayInterest `json:"gateways,omitempty"`
 }
 
 // SubszOptions are the options passed to Subsz.
@@ -775,29 +890,46 @@ type SubszOptions struct {
 	// Test the list against this subject. Needs to be literal since it signifies a publish subject.
 	// We will only return subscriptions that would match if a message was sent to this subject.
 	Test string `json:"test,omitempty"`
+
+	// Routes indicates if the interest of the remote side of the routes
+	// and gateways should be included in the results.
+	Routes bool `json:"routes,omitempty"`
 }
 
 // SubDetail is for verbose information for subscriptions.
 type SubDetail struct {
-	Subject string `json:"subject"`
-	Queue   string `json:"qgroup,omitempty"`
-	Sid     string `json:"sid"`
-	Msgs    int64  `json:"msgs"`
-	Max     int64  `json:"max,omitempty"`
-	Cid     uint64 `json:"cid"`
+	Subject  string `json:"subject"`
+	Queue    string `json:"qgroup,omitempty"`
+	Sid      string `json:"sid"`
+	Msgs     int64  `json:"msgs"`
+	Max      int64  `json:"max,omitempty"`
+	Cid      uint64 `json:"cid"`
+	Priority string `json:"priority,omitempty"`
 }
 
 func newSubDetail(sub *subscription) SubDetail {
 	return SubDetail{
-		Subject: string(sub.subject),
-		Queue:   string(sub.queue),
-		Sid:     string(sub.sid),
-		Msgs:    sub.nm,
-		Max:     sub.max,
-		Cid:     sub.client.cid,
+		Subject:  string(sub.subject),
+		Queue:    string(sub.queue),
+		Sid:      string(sub.sid),
+		Msgs:     sub.nm,
+		Max:      sub.max,
+		Cid:      sub.client.cid,
+		Priority: subPriorityName(sub.prio),
 	}
 }
 
+// Returns the name of a subscription priority, empty for the default.
+func subPriorityName(prio int8) string {
+	switch prio {
+	case subPriorityHigh:
+		return "high"
+	case subPriorityLow:
+		return "low"
+	}
+	return _EMPTY_
+}
+
 // Subsz returns a Subsz struct containing subjects statistics
 func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 	var (
@@ -832,7 +964,12 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 	s.mu.Unlock()
 
 	// FIXME(dlc) - Make account aware.
-	sz := &Subsz{gaccSl.Stats(), 0, offset, limit, nil}
+	sz := &Subsz{SublistStats: gaccSl.Stats(), Offset: offset, Limit: limit}
+
+	if opts != nil && opts.Routes {
+		sz.Routes = s.routesInterest(testSub)
+		sz.Gateways = s.gatewaysInterest(testSub)
+	}
 
 	if subdetail {
 		// Now add in subscription's details
@@ -893,6 +1030,10 @@ func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	routes, err := decodeBool(w, r, "routes")
+	if err != nil {
+		return
+	}
 	testSub := r.URL.Query().Get("test")
 
 	subszOpts := &SubszOptions{
@@ -900,6 +1041,7 @@ func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
 		Offset:        offset,
 		Limit:         limit,
 		Test:          testSub,
+		Routes:        routes,
 	}
 
 	st, err := s.Subsz(subszOpts)
@@ -911,7 +1053,7 @@ func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
 
 	var b []byte
 
-	if len(st.Subs) == 0 {
+	if len(st.Subs) == 0 && !routes {
 		b, err = json.MarshalIndent(st.SublistStats, "", "  ")
 	} else {
 		b, err = json.MarshalIndent(st, "", "  ")
@@ -948,6 +1090,7 @@ func (s *Server) HandleStacksz(w http.ResponseWriter, r *http.Request) {
 type Varz struct {
 	ID                string            `json:"server_id"`
 	Name              string            `json:"server_name"`
+	Tags              map[string]string `json:"tags,omitempty"`
 	Version           string            `json:"version"`
 	Proto             int               `json:"proto"`
 	GitCommit         string            `json:"git_commit,omitempty"`
@@ -992,13 +1135,22 @@ type Varz struct {
 	InBytes           int64             `json:"in_bytes"`
 	OutBytes          int64             `json:"out_bytes"`
 	SlowConsumers     int64             `json:"slow_consumers"`
+	RejectedAccepts   map[string]int64  `json:"rejected_accepts,omitempty"`
+	QueuedAccepts     map[string]int64  `json:"queued_accepts,omitempty"`
+	TLSHandshakes     *TLSHandshakeVarz `json:"tls_handshakes,omitempty"`
+	SubsExceeded      int64             `json:"subscriptions_limit_exceeded"`
 	Subscriptions     uint32            `json:"subscriptions"`
+	SublistCacheHits  uint64            `json:"sublist_cache_hits"`
+	SublistCacheMiss  uint64            `json:"sublist_cache_misses"`
 	HTTPReqStats      map[string]uint64 `json:"http_req_stats"`
 	ConfigLoadTime    time.Time         `json:"config_load_time"`
+	SelfTests         []SelfTestResult  `json:"self_test,omitempty"`
+	Rates             *Rates            `json:"rates,omitempty"`
 }
 
 // ClusterOptsVarz contains monitoring cluster information
 type ClusterOptsVarz struct {
+	Name        string   `json:"name,omitempty"`
 	Host        string   `json:"addr,omitempty"`
 	Port        int      `json:"cluster_port,omitempty"`
 	AuthTimeout float64  `json:"auth_timeout,omitempty"`
@@ -1042,8 +1194,12 @@ type RemoteLeafOptsVarz struct {
 }
 
 // VarzOptions are the options passed to Varz().
-// Currently, there are no options defined.
-type VarzOptions struct{}
+type VarzOptions struct {
+	// Delta indicates that the rates of the counters since the previous
+	// request with the same Token should be returned.
+	Delta bool   `json:"delta"`
+	Token string `json:"token"`
+}
 
 func myUptime(d time.Duration) string {
 	// Just use total seconds for uptime, and display days / years
@@ -1095,6 +1251,15 @@ func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
 	<a href=/gatewayz>gatewayz</a><br/>
 	<a href=/leafz>leafz</a><br/>
 	<a href=/subsz>subsz</a><br/>
+	<a href=/accountz>accountz</a><br/>
+	<a href=/accstatz>accstatz</a><br/>
+	<a href=/configz>configz</a><br/>
+	<a href=/lockoutz>lockoutz</a><br/>
+	<a href=/trafficz>trafficz</a><br/>
+	<a href=/logz>logz</a><br/>
+	<a href=/capturez>capturez</a><br/>
+	<a href=/storez>storez</a><br/>
+	<a href=/healthz>healthz</a><br/>
     <br/>
     <a href=https://docs.nats.io/nats-server/configuration/monitoring.html>help</a>
   </body>
@@ -1116,6 +1281,14 @@ func (s *Server) Varz(varzOpts *VarzOptions) (*Varz, error) {
 	v := s.createVarz(pcpu, rss)
 	s.mu.Unlock()
 
+	if varzOpts != nil && varzOpts.Delta {
+		rates, err := s.varzRates(varzOpts.Token, v)
+		if err != nil {
+			return nil, err
+		}
+		v.Rates = rates
+	}
+
 	return v, nil
 }
 
@@ -1140,7 +1313,9 @@ func (s *Server) createVarz(pcpu float64, rss int64) *Varz {
 		HTTPHost:  opts.HTTPHost,
 		HTTPPort:  opts.HTTPPort,
 		HTTPSPort: opts.HTTPSPort,
+		Tags:      copyTags(info.Tags),
 		Cluster: ClusterOptsVarz{
+			Name:        info.Cluster,
 			Host:        c.Host,
 			Port:        c.Port,
 			AuthTimeout: c.AuthTimeout,
@@ -1166,11 +1341,14 @@ func (s *Server) createVarz(pcpu float64, rss int64) *Varz {
 		Start:    s.start,
 		MaxSubs:  opts.MaxSubs,
 		Cores:    numCores,
-		MaxProcs: maxProcs,
+		MaxProcs: runtime.GOMAXPROCS(0),
 	}
 	if len(opts.Routes) > 0 {
 		varz.Cluster.URLs = urlsToStrings(opts.Routes)
 	}
+	if len(s.selfTests) > 0 {
+		varz.SelfTests = append([]SelfTestResult(nil), s.selfTests...)
+	}
 	if l := len(gw.Gateways); l > 0 {
 		rgwa := make([]RemoteGatewayOptsVarz, l)
 		for i, r := range gw.Gateways {
@@ -1230,6 +1408,7 @@ func (s *Server) updateVarzConfigReloadableFields(v *Varz) {
 	v.TLSTimeout = opts.TLSTimeout
 	v.WriteDeadline = opts.WriteDeadline
 	v.ConfigLoadTime = s.configTime
+	v.MaxProcs = runtime.GOMAXPROCS(0)
 	// Update route URLs if applicable
 	if s.varzUpdateRouteURLs {
 		v.Cluster.URLs = urlsToStrings(opts.Routes)
@@ -1260,8 +1439,12 @@ func (s *Server) updateVarzRuntimeFields(v *Varz, forceUpdate bool, pcpu float64
 	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
 	v.OutBytes = atomic.LoadInt64(&s.outBytes)
 	v.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
+	v.RejectedAccepts, v.QueuedAccepts = s.acceptRateStats()
+	v.TLSHandshakes = s.tlsHandshakeVarz()
+	v.SubsExceeded = atomic.LoadInt64(&s.subsExceeded)
 	// FIXME(dlc) - make this multi-account aware.
 	v.Subscriptions = s.gacc.sl.Count()
+	v.SublistCacheHits, v.SublistCacheMiss = s.sublistCacheStats()
 	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
 	for key, val := range s.httpReqStats {
 		v.HTTPReqStats[key] = val
@@ -1303,6 +1486,11 @@ func (s *Server) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	var rss, vss int64
 	var pcpu float64
 
+	delta, err := decodeBool(w, r, "delta")
+	if err != nil {
+		return
+	}
+
 	// We want to do that outside of the lock.
 	pse.ProcUsage(&pcpu, &rss, &vss)
 
@@ -1325,8 +1513,21 @@ func (s *Server) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	}
 	s.mu.Unlock()
 
+	// The rates only apply to this response.
+	if delta {
+		rates, err := s.varzRates(r.URL.Query().Get("token"), s.varz)
+		if err != nil {
+			s.varzMu.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		s.varz.Rates = rates
+	}
+
 	// Do the marshaling outside of server lock, but under varzMu lock.
 	b, err := json.MarshalIndent(s.varz, "", "  ")
+	s.varz.Rates = nil
 	s.varzMu.Unlock()
 
 	if err != nil {
@@ -1347,6 +1548,10 @@ type GatewayzOptions struct {
 
 	// AccountName will limit the list of accounts to that account name (makes Accounts implicit)
 	AccountName string
+
+	// Subscriptions indicates that the interest-only accounts will return the
+	// subjects of their outbound interest (makes Accounts implicit)
+	Subscriptions bool
 }
 
 // Gatewayz represents detailed information on Gateways
@@ -1369,12 +1574,13 @@ type RemoteGatewayz struct {
 
 // AccountGatewayz represents interest mode for this account
 type AccountGatewayz struct {
-	Name                  string `json:"name"`
-	InterestMode          string `json:"interest_mode"`
-	NoInterestCount       int    `json:"no_interest_count,omitempty"`
-	InterestOnlyThreshold int    `json:"interest_only_threshold,omitempty"`
-	TotalSubscriptions    int    `json:"num_subs,omitempty"`
-	NumQueueSubscriptions int    `json:"num_queue_subs,omitempty"`
+	Name                  string   `json:"name"`
+	InterestMode          string   `json:"interest_mode"`
+	NoInterestCount       int      `json:"no_interest_count,omitempty"`
+	InterestOnlyThreshold int      `json:"interest_only_threshold,omitempty"`
+	TotalSubscriptions    int      `json:"num_subs,omitempty"`
+	NumQueueSubscriptions int      `json:"num_queue_subs,omitempty"`
+	Subs                  []string `json:"subscriptions_list,omitempty"`
 }
 
 // Gatewayz returns a Gatewayz struct containing information about gateways.
@@ -1411,8 +1617,8 @@ func (s *Server) Gatewayz(opts *GatewayzOptions) (*Gatewayz, error) {
 
 // Based on give options struct, returns if there is a filtered
 // Gateway Name and if we should do report Accounts.
-// Note that if Accounts is false but AccountName is not empty,
-// then Accounts is implicitly set to true.
+// Note that if Accounts is false but AccountName is not empty or
+// Subscriptions is true, then Accounts is implicitly set to true.
 func getMonitorGWOptions(opts *GatewayzOptions) (string, bool) {
 	var name string
 	var accs bool
@@ -1421,7 +1627,7 @@ func getMonitorGWOptions(opts *GatewayzOptions) (string, bool) {
 			name = opts.Name
 		}
 		accs = opts.Accounts
-		if !accs && opts.AccountName != _EMPTY_ {
+		if !accs && (opts.AccountName != _EMPTY_ || opts.Subscriptions) {
 			accs = true
 		}
 	}
@@ -1492,22 +1698,24 @@ func createOutboundAccountsGatewayz(opts *GatewayzOptions, gw *gateway) []*Accou
 	}
 
 	var accName string
+	var subs bool
 	if opts != nil {
 		accName = opts.AccountName
+		subs = opts.Subscriptions
 	}
 	if accName != _EMPTY_ {
 		ei, ok := gw.outsim.Load(accName)
 		if !ok {
 			return nil
 		}
-		a := createAccountOutboundGatewayz(accName, ei)
+		a := createAccountOutboundGatewayz(accName, ei, subs)
 		return []*AccountGatewayz{a}
 	}
 
 	accs := make([]*AccountGatewayz, 0, 4)
 	gw.outsim.Range(func(k, v interface{}) bool {
 		name := k.(string)
-		a := createAccountOutboundGatewayz(name, v)
+		a := createAccountOutboundGatewayz(name, v, subs)
 		accs = append(accs, a)
 		return true
 	})
@@ -1515,7 +1723,7 @@ func createOutboundAccountsGatewayz(opts *GatewayzOptions, gw *gateway) []*Accou
 }
 
 // Returns an AccountGatewayz for this gateway outbound connection
-func createAccountOutboundGatewayz(name string, ei interface{}) *AccountGatewayz {
+func createAccountOutboundGatewayz(name string, ei interface{}, subs bool) *AccountGatewayz {
 	a := &AccountGatewayz{
 		Name:                  name,
 		InterestOnlyThreshold: gatewayMaxRUnsubBeforeSwitch,
@@ -1527,6 +1735,14 @@ func createAccountOutboundGatewayz(name string, ei interface{}) *AccountGatewayz
 		a.NoInterestCount = len(e.ni)
 		a.NumQueueSubscriptions = e.qsubs
 		a.TotalSubscriptions = int(e.sl.Count())
+		if subs && e.mode == InterestOnly {
+			var ss []*subscription
+			e.sl.All(&ss)
+			a.Subs = make([]string, 0, len(ss))
+			for _, sub := range ss {
+				a.Subs = append(a.Subs, string(sub.subject))
+			}
+		}
 		e.RUnlock()
 	} else {
 		a.InterestMode = Optimistic.String()
@@ -1622,16 +1838,21 @@ func (s *Server) HandleGatewayz(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	subs, err := decodeBool(w, r, "subs")
+	if err != nil {
+		return
+	}
 	gwName := r.URL.Query().Get("gw_name")
 	accName := r.URL.Query().Get("acc_name")
-	if accName != _EMPTY_ {
+	if accName != _EMPTY_ || subs {
 		accs = true
 	}
 
 	opts := &GatewayzOptions{
-		Name:        gwName,
-		Accounts:    accs,
-		AccountName: accName,
+		Name:          gwName,
+		Accounts:      accs,
+		AccountName:   accName,
+		Subscriptions: subs,
 	}
 	gw, err := s.Gatewayz(opts)
 	if err != nil {
@@ -1660,20 +1881,26 @@ type Leafz struct {
 type LeafzOptions struct {
 	// Subscriptions indicates that Leafz will return a leafnode's subscriptions
 	Subscriptions bool `json:"subscriptions"`
+	// Account will only return leafnodes bound to this account.
+	Account string `json:"account"`
 }
 
 // LeafInfo has detailed information on each remote leafnode connection.
 type LeafInfo struct {
-	Account  string   `json:"account"`
-	IP       string   `json:"ip"`
-	Port     int      `json:"port"`
-	RTT      string   `json:"rtt,omitempty"`
-	InMsgs   int64    `json:"in_msgs"`
-	OutMsgs  int64    `json:"out_msgs"`
-	InBytes  int64    `json:"in_bytes"`
-	OutBytes int64    `json:"out_bytes"`
-	NumSubs  uint32   `json:"subscriptions"`
-	Subs     []string `json:"subscriptions_list,omitempty"`
+	ServerID   string   `json:"server_id,omitempty"`
+	ServerName string   `json:"server_name,omitempty"`
+	Account    string   `json:"account"`
+	Solicited  bool     `json:"solicited"`
+	IsSpoke    bool     `json:"is_spoke"`
+	IP         string   `json:"ip"`
+	Port       int      `json:"port"`
+	RTT        string   `json:"rtt,omitempty"`
+	InMsgs     int64    `json:"in_msgs"`
+	OutMsgs    int64    `json:"out_msgs"`
+	InBytes    int64    `json:"in_bytes"`
+	OutBytes   int64    `json:"out_bytes"`
+	NumSubs    uint32   `json:"subscriptions"`
+	Subs       []string `json:"subscriptions_list,omitempty"`
 }
 
 // Leafz returns a Leafz structure containing information about leafnodes.
@@ -1689,21 +1916,34 @@ func (s *Server) Leafz(opts *LeafzOptions) (*Leafz, error) {
 	}
 	s.mu.Unlock()
 
+	var acc string
+	if opts != nil {
+		acc = opts.Account
+	}
+
 	var leafnodes []*LeafInfo
 	if len(lconns) > 0 {
 		leafnodes = make([]*LeafInfo, 0, len(lconns))
 		for _, ln := range lconns {
 			ln.mu.Lock()
+			if acc != _EMPTY_ && ln.acc.Name != acc {
+				ln.mu.Unlock()
+				continue
+			}
 			lni := &LeafInfo{
-				Account:  ln.acc.Name,
-				IP:       ln.host,
-				Port:     int(ln.port),
-				RTT:      ln.getRTT(),
-				InMsgs:   atomic.LoadInt64(&ln.inMsgs),
-				OutMsgs:  ln.outMsgs,
-				InBytes:  atomic.LoadInt64(&ln.inBytes),
-				OutBytes: ln.outBytes,
-				NumSubs:  uint32(len(ln.subs)),
+				ServerID:   ln.leaf.remoteID,
+				ServerName: ln.leaf.remoteName,
+				Solicited:  ln.leaf.remote != nil,
+				IsSpoke:    ln.leaf.isSpoke,
+				Account:    ln.acc.Name,
+				IP:         ln.host,
+				Port:       int(ln.port),
+				RTT:        ln.getRTT(),
+				InMsgs:     atomic.LoadInt64(&ln.inMsgs),
+				OutMsgs:    ln.outMsgs,
+				InBytes:    atomic.LoadInt64(&ln.inBytes),
+				OutBytes:   ln.outBytes,
+				NumSubs:    uint32(len(ln.subs)),
 			}
 			if opts != nil && opts.Subscriptions {
 				lni.Subs = make([]string, 0, len(ln.subs))
@@ -1733,9 +1973,9 @@ func (s *Server) HandleLeafz(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	var opts *LeafzOptions
-	if subs {
-		opts = &LeafzOptions{Subscriptions: true}
+	opts := &LeafzOptions{
+		Subscriptions: subs,
+		Account:       r.URL.Query().Get("acc"),
 	}
 
 	l, err := s.Leafz(opts)
@@ -1753,6 +1993,625 @@ func (s *Server) HandleLeafz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// Accountz represents the accounts of the server. Without the account
+// option, only the names of the accounts are returned.
+type Accountz struct {
+	ID            string       `json:"server_id"`
+	Now           time.Time    `json:"now"`
+	SystemAccount string       `json:"system_account,omitempty"`
+	Accounts      []string     `json:"accounts,omitempty"`
+	Account       *AccountInfo `json:"account_detail,omitempty"`
+}
+
+// AccountzOptions are options passed to Accountz
+type AccountzOptions struct {
+	// Account indicates the account to return the details of.
+	Account string `json:"account"`
+}
+
+// AccountInfo has detailed information on an account.
+type AccountInfo struct {
+	Name       string          `json:"account_name"`
+	Issuer     string          `json:"issuer,omitempty"`
+	Expired    bool            `json:"expired"`
+	IsSystem   bool            `json:"is_system,omitempty"`
+	Conns      int             `json:"conns"`
+	LeafNodes  int             `json:"leafnodes"`
+	TotalConns int             `json:"total_conns"`
+	NumSubs    uint32          `json:"num_subscriptions"`
+	Limits     AccountLimits   `json:"limits"`
+	Exports    []AccountExport `json:"exports,omitempty"`
+	Imports    []AccountImport `json:"imports,omitempty"`
+}
+
+// AccountLimits are the limits of an account, -1 meaning no limit.
+type AccountLimits struct {
+	MaxConnections   int `json:"max_connections"`
+	MaxLeafNodes     int `json:"max_leafnodes"`
+	MaxSubscriptions int `json:"max_subscriptions"`
+	MaxPayload       int `json:"max_payload"`
+}
+
+// AccountExport is a stream or service exported by an account.
+type AccountExport struct {
+	Subject          string   `json:"subject"`
+	Type             string   `json:"type"`
+	TokenRequired    bool     `json:"token_required,omitempty"`
+	ApprovedAccounts []string `json:"approved_accounts,omitempty"`
+	ResponseType     string   `json:"response_type,omitempty"`
+}
+
+// AccountImport is a stream or service imported by an account.
+type AccountImport struct {
+	Subject string `json:"subject"`
+	Type    string `json:"type"`
+	Account string `json:"account"`
+	To      string `json:"to,omitempty"`
+	Invalid bool   `json:"invalid,omitempty"`
+}
+
+// Accountz returns an Accountz structure containing the names of the
+// accounts or, if requested, the details of one of them.
+func (s *Server) Accountz(opts *AccountzOptions) (*Accountz, error) {
+	a := &Accountz{
+		ID:  s.ID(),
+		Now: time.Now(),
+	}
+	if sacc := s.SystemAccount(); sacc != nil {
+		a.SystemAccount = sacc.Name
+	}
+	if opts == nil || opts.Account == _EMPTY_ {
+		s.accounts.Range(func(k, _ interface{}) bool {
+			a.Accounts = append(a.Accounts, k.(string))
+			return true
+		})
+		sort.Strings(a.Accounts)
+		return a, nil
+	}
+	acc, err := s.lookupLocalAccount(opts.Account)
+	if err != nil {
+		return nil, err
+	}
+	a.Account = acc.info(a.SystemAccount == acc.Name)
+	return a, nil
+}
+
+// lookupLocalAccount returns the account with the given name if it is
+// registered with this server. Unlike lookupAccount, it never fetches the
+// account from the resolver, so monitoring requests can not register
+// accounts.
+func (s *Server) lookupLocalAccount(name string) (*Account, error) {
+	if v, ok := s.accounts.Load(name); ok {
+		return v.(*Account), nil
+	}
+	return nil, ErrMissingAccount
+}
+
+// Returns the details of the account.
+func (a *Account) info(isSystem bool) *AccountInfo {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	ai := &AccountInfo{
+		Name:       a.Name,
+		Issuer:     a.Issuer,
+		Expired:    a.expired,
+		IsSystem:   isSystem,
+		Conns:      a.numLocalConnections(),
+		LeafNodes:  a.numLocalLeafNodes(),
+		TotalConns: len(a.clients) - int(a.sysclients) + int(a.nrclients+a.nrleafs),
+		Limits: AccountLimits{
+			MaxConnections:   int(a.mconns),
+			MaxLeafNodes:     int(a.mleafs),
+			MaxSubscriptions: int(a.mtsubs),
+			MaxPayload:       int(a.mpay),
+		},
+	}
+	if a.sl != nil {
+		ai.NumSubs = a.sl.Count()
+	}
+	for subj, se := range a.exports.streams {
+		e := AccountExport{Subject: subj, Type: "stream"}
+		if se != nil {
+			e.TokenRequired, e.ApprovedAccounts = se.tokenReq, approvedAccounts(se.approved)
+		}
+		ai.Exports = append(ai.Exports, e)
+	}
+	for subj, se := range a.exports.services {
+		e := AccountExport{Subject: subj, Type: "service", ResponseType: Singleton.String()}
+		if se != nil {
+			e.TokenRequired, e.ApprovedAccounts = se.tokenReq, approvedAccounts(se.approved)
+			e.ResponseType = se.respType.String()
+		}
+		ai.Exports = append(ai.Exports, e)
+	}
+	sort.Slice(ai.Exports, func(i, j int) bool { return ai.Exports[i].Subject < ai.Exports[j].Subject })
+	for _, si := range a.imports.streams {
+		ai.Imports = append(ai.Imports, AccountImport{
+			Subject: si.from,
+			Type:    "stream",
+			Account: si.acc.Name,
+			To:      si.prefix,
+			Invalid: si.invalid,
+		})
+	}
+	for _, si := range a.imports.services {
+		// Skip the imports of the responses.
+		if si.internal {
+			continue
+		}
+		ai.Imports = append(ai.Imports, AccountImport{
+			Subject: si.from,
+			Type:    "service",
+			Account: si.acc.Name,
+			To:      si.to,
+			Invalid: si.invalid,
+		})
+	}
+	sort.Slice(ai.Imports, func(i, j int) bool { return ai.Imports[i].Subject < ai.Imports[j].Subject })
+	return ai
+}
+
+func approvedAccounts(approved map[string]*Account) []string {
+	if len(approved) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(approved))
+	for name := range approved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HandleAccountz process HTTP requests for account information.
+func (s *Server) HandleAccountz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[AccountzPath]++
+	s.mu.Unlock()
+
+	a, err := s.Accountz(&AccountzOptions{Account: r.URL.Query().Get("acc")})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /accountz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// AccountStatz represents the usage of the accounts of the server.
+type AccountStatz struct {
+	ID       string         `json:"server_id"`
+	Now      time.Time      `json:"now"`
+	Accounts []*AccountStat `json:"account_statz"`
+}
+
+// AccountStatzOptions are options passed to AccountStatz
+type AccountStatzOptions struct {
+	// Accounts filters the accounts to return.
+	Accounts []string `json:"accounts"`
+	// IncludeUnused indicates if the accounts without connections
+	// should be returned.
+	IncludeUnused bool `json:"include_unused"`
+}
+
+// AccountStat has the usage of an account on this server. Received is
+// what the clients and leafnodes of the account published, and Sent what
+// was delivered to them. The rates, per second, are computed since the
+// previous sample of the account, taken at most once per second.
+type AccountStat struct {
+	Account      string         `json:"acc"`
+	Conns        int            `json:"conns"`
+	LeafNodes    int            `json:"leafnodes"`
+	TotalConns   int            `json:"total_conns"`
+	NumSubs      uint32         `json:"num_subscriptions"`
+	Sent         DataStats      `json:"sent"`
+	Received     DataStats      `json:"received"`
+	SentRate     RateStats      `json:"sent_rate"`
+	ReceivedRate RateStats      `json:"received_rate"`
+	Memory       *AccountMemory `json:"memory"`
+}
+
+// RateStats are message and byte rates, per second.
+type RateStats struct {
+	Msgs  float64 `json:"msgs"`
+	Bytes float64 `json:"bytes"`
+}
+
+// AccountStatz returns an AccountStatz structure containing the usage of
+// the accounts.
+func (s *Server) AccountStatz(opts *AccountStatzOptions) (*AccountStatz, error) {
+	var accs []*Account
+	if opts != nil && len(opts.Accounts) > 0 {
+		for _, name := range opts.Accounts {
+			if acc, err := s.lookupLocalAccount(name); err == nil {
+				accs = append(accs, acc)
+			}
+		}
+	} else {
+		s.accounts.Range(func(_, v interface{}) bool {
+			accs = append(accs, v.(*Account))
+			return true
+		})
+	}
+	includeUnused := opts != nil && (opts.IncludeUnused || len(opts.Accounts) > 0)
+
+	now := time.Now()
+	as := &AccountStatz{
+		ID:       s.ID(),
+		Now:      now,
+		Accounts: []*AccountStat{},
+	}
+	for _, acc := range accs {
+		if st := acc.statz(now); includeUnused || st.TotalConns > 0 {
+			as.Accounts = append(as.Accounts, st)
+		}
+	}
+	sort.Slice(as.Accounts, func(i, j int) bool { return as.Accounts[i].Account < as.Accounts[j].Account })
+	return as, nil
+}
+
+// Returns the usage of the account, sampling its counters for the rates.
+func (a *Account) statz(now time.Time) *AccountStat {
+	cur := [4]int64{
+		atomic.LoadInt64(&a.stats.inMsgs),
+		atomic.LoadInt64(&a.stats.inBytes),
+		atomic.LoadInt64(&a.stats.outMsgs),
+		atomic.LoadInt64(&a.stats.outBytes),
+	}
+	mem := a.memoryUsage()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := &AccountStat{
+		Account:    a.Name,
+		Conns:      a.numLocalConnections(),
+		LeafNodes:  a.numLocalLeafNodes(),
+		TotalConns: len(a.clients) - int(a.sysclients) + int(a.nrclients+a.nrleafs),
+		Received:   DataStats{Msgs: cur[0], Bytes: cur[1]},
+		Sent:       DataStats{Msgs: cur[2], Bytes: cur[3]},
+		Memory:     mem,
+	}
+	if a.sl != nil {
+		st.NumSubs = a.sl.Count()
+	}
+	if !a.stats.sampled.IsZero() {
+		if secs := now.Sub(a.stats.sampled).Seconds(); secs > 0 {
+			prev := a.stats.sample
+			st.ReceivedRate = RateStats{float64(cur[0]-prev[0]) / secs, float64(cur[1]-prev[1]) / secs}
+			st.SentRate = RateStats{float64(cur[2]-prev[2]) / secs, float64(cur[3]-prev[3]) / secs}
+		}
+	}
+	if now.Sub(a.stats.sampled) >= time.Second {
+		a.stats.sampled, a.stats.sample = now, cur
+	}
+	return st
+}
+
+// HandleAccountStatz process HTTP requests for account usage.
+func (s *Server) HandleAccountStatz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[AccountStatzPath]++
+	s.mu.Unlock()
+
+	unused, err := decodeBool(w, r, "unused")
+	if err != nil {
+		return
+	}
+	opts := &AccountStatzOptions{IncludeUnused: unused}
+	if accs := r.URL.Query().Get("accounts"); accs != _EMPTY_ {
+		opts.Accounts = strings.Split(accs, ",")
+	}
+	as, err := s.AccountStatz(opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(as, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /accstatz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// Configz represents the options the server is currently running with,
+// including the changes applied by configuration reloads. Secrets are
+// redacted and options with a zero value are omitted.
+type Configz struct {
+	ID             string                 `json:"server_id"`
+	Now            time.Time              `json:"now"`
+	ConfigFile     string                 `json:"config_file,omitempty"`
+	ConfigLoadTime time.Time              `json:"config_load_time"`
+	Options        map[string]interface{} `json:"options"`
+}
+
+// The values of the options tagged with `secret:"true"`, such as passwords,
+// tokens and keys, are never returned by Configz.
+const redactedValue = "[REDACTED]"
+
+// Configz returns a Configz structure containing the effective options.
+func (s *Server) Configz() *Configz {
+	opts := s.getOpts()
+	c := &Configz{
+		ID:             s.ID(),
+		Now:            time.Now(),
+		ConfigFile:     opts.ConfigFile,
+		ConfigLoadTime: s.ConfigTime(),
+	}
+	c.Options, _ = optionValue(reflect.ValueOf(opts)).(map[string]interface{})
+	return c
+}
+
+// Returns a representation of v suitable for JSON encoding, or nil
+// if v has a zero value.
+func optionValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	}
+	switch x := v.Interface().(type) {
+	case time.Duration:
+		if x == 0 {
+			return nil
+		}
+		return x.String()
+	case *url.URL:
+		return x.Redacted()
+	case *tls.Config:
+		// The certificates are reported through the file options.
+		return nil
+	case *Account:
+		// Accounts are reported by /accountz.
+		return x.Name
+	case AccountResolver, Authentication:
+		return fmt.Sprintf("%T", x)
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return optionValue(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != _EMPTY_ {
+				continue
+			}
+			if fv := optionValue(v.Field(i)); fv != nil {
+				if f.Tag.Get("secret") == "true" {
+					fv = redactedValue
+				}
+				m[f.Name] = fv
+			}
+		}
+		if len(m) == 0 {
+			return nil
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Len() == 0 {
+			return nil
+		}
+		l := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			l = append(l, optionValue(v.Index(i)))
+		}
+		return l
+	case reflect.Map:
+		if v.Len() == 0 {
+			return nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			m[fmt.Sprint(it.Key().Interface())] = optionValue(it.Value())
+		}
+		return m
+	}
+	if v.IsZero() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// HandleConfigz process HTTP requests for the effective options.
+func (s *Server) HandleConfigz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[ConfigzPath]++
+	s.mu.Unlock()
+
+	b, err := json.MarshalIndent(s.Configz(), "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /configz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// Lockoutz represents the remote IPs and users that are delayed or banned
+// after repeated authentication failures.
+type Lockoutz struct {
+	ID    string         `json:"server_id"`
+	Now   time.Time      `json:"now"`
+	IPs   []*LockoutInfo `json:"ips,omitempty"`
+	Users []*LockoutInfo `json:"users,omitempty"`
+}
+
+// LockoutInfo is the authentication failures state of a remote IP or user.
+type LockoutInfo struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	Delay       string     `json:"delay,omitempty"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+}
+
+// Lockoutz returns a Lockoutz structure with the IPs and users that had
+// recent authentication failures or are banned.
+func (s *Server) Lockoutz() *Lockoutz {
+	opts := s.getOpts().AuthLockout
+	now := time.Now()
+	lz := &Lockoutz{ID: s.ID(), Now: now.UTC()}
+	s.lockout.Lock()
+	lz.IPs = lockoutInfos(s.lockout.ips, now, &opts)
+	lz.Users = lockoutInfos(s.lockout.users, now, &opts)
+	s.lockout.Unlock()
+	sort.Slice(lz.IPs, func(i, j int) bool { return lz.IPs[i].Key < lz.IPs[j].Key })
+	sort.Slice(lz.Users, func(i, j int) bool { return lz.Users[i].Key < lz.Users[j].Key })
+	return lz
+}
+
+// HandleLockoutz process HTTP requests for the authentication lockout state.
+func (s *Server) HandleLockoutz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[LockoutzPath]++
+	s.mu.Unlock()
+
+	b, err := json.MarshalIndent(s.Lockoutz(), "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /lockoutz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// Trafficz represents the traffic analytics of the accounts: the payload
+// sizes of the published messages and the most published subjects.
+type Trafficz struct {
+	ID       string            `json:"server_id"`
+	Now      time.Time         `json:"now"`
+	Enabled  bool              `json:"enabled"`
+	Accounts []*AccountTraffic `json:"accounts"`
+}
+
+// TrafficzOptions are the options passed to Trafficz.
+type TrafficzOptions struct {
+	// Accounts filters the accounts to return.
+	Accounts []string `json:"accounts"`
+}
+
+// AccountTraffic is the traffic published by the clients of an account.
+type AccountTraffic struct {
+	Account     string          `json:"account"`
+	Msgs        uint64          `json:"msgs"`
+	Bytes       uint64          `json:"bytes"`
+	Sizes       []*SizeBucket   `json:"payload_sizes"`
+	TopSubjects []*SubjectCount `json:"top_subjects"`
+}
+
+// SizeBucket is the number of messages with a payload size up to LE bytes,
+// and larger than the previous bucket. LE is -1 for the last bucket.
+type SizeBucket struct {
+	LE    int    `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// SubjectCount is the estimated number of messages published on a subject.
+// The count may be overestimated by up to MaxError messages.
+type SubjectCount struct {
+	Subject  string `json:"subject"`
+	Msgs     uint64 `json:"msgs"`
+	MaxError uint64 `json:"max_error,omitempty"`
+}
+
+// Trafficz returns a Trafficz structure with the traffic analytics of the
+// accounts that had messages published.
+func (s *Server) Trafficz(opts *TrafficzOptions) *Trafficz {
+	var accs []*Account
+	if opts != nil && len(opts.Accounts) > 0 {
+		for _, name := range opts.Accounts {
+			if acc, err := s.lookupLocalAccount(name); err == nil {
+				accs = append(accs, acc)
+			}
+		}
+	} else {
+		s.accounts.Range(func(_, v interface{}) bool {
+			accs = append(accs, v.(*Account))
+			return true
+		})
+	}
+	tz := &Trafficz{
+		ID:       s.ID(),
+		Now:      time.Now().UTC(),
+		Enabled:  s.trafficEnabled(),
+		Accounts: []*AccountTraffic{},
+	}
+	for _, acc := range accs {
+		if at := acc.trafficz(); at != nil {
+			tz.Accounts = append(tz.Accounts, at)
+		}
+	}
+	sort.Slice(tz.Accounts, func(i, j int) bool { return tz.Accounts[i].Account < tz.Accounts[j].Account })
+	return tz
+}
+
+// Returns the traffic analytics of the account, nil if none was recorded.
+func (a *Account) trafficz() *AccountTraffic {
+	t := &a.traffic
+	t.Lock()
+	defer t.Unlock()
+	if t.msgs == 0 {
+		return nil
+	}
+	at := &AccountTraffic{
+		Account: a.Name,
+		Msgs:    t.msgs,
+		Bytes:   t.bytes,
+		Sizes:   make([]*SizeBucket, 0, len(t.sizes)),
+	}
+	for i, n := range t.sizes {
+		le := -1
+		if i < len(trafficSizeBuckets) {
+			le = trafficSizeBuckets[i]
+		}
+		at.Sizes = append(at.Sizes, &SizeBucket{LE: le, Count: n})
+	}
+	if t.top != nil {
+		at.TopSubjects = make([]*SubjectCount, 0, len(t.top.heap))
+		for _, sc := range t.top.heap {
+			at.TopSubjects = append(at.TopSubjects, &SubjectCount{sc.subject, sc.count, sc.err})
+		}
+		sort.Slice(at.TopSubjects, func(i, j int) bool {
+			if at.TopSubjects[i].Msgs != at.TopSubjects[j].Msgs {
+				return at.TopSubjects[i].Msgs > at.TopSubjects[j].Msgs
+			}
+			return at.TopSubjects[i].Subject < at.TopSubjects[j].Subject
+		})
+	}
+	return at
+}
+
+// HandleTrafficz process HTTP requests for the traffic analytics.
+func (s *Server) HandleTrafficz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[TrafficzPath]++
+	s.mu.Unlock()
+
+	opts := &TrafficzOptions{}
+	if accs := r.URL.Query().Get("accounts"); accs != _EMPTY_ {
+		opts.Accounts = strings.Split(accs, ",")
+	}
+	b, err := json.MarshalIndent(s.Trafficz(opts), "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /trafficz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
 // ResponseHandler handles responses for monitoring routes
 func ResponseHandler(w http.ResponseWriter, r *http.Request, data []byte) {
 	// Get callback from request
@@ -1762,6 +2621,9 @@ func ResponseHandler(w http.ResponseWriter, r *http.Request, data []byte) {
 		// Response for JSONP
 		w.Header().Set("Content-Type", "application/javascript")
 		fmt.Fprintf(w, "%s(%s)", callback, data)
+	} else if wantsHTML(r) {
+		// HTML summary for browsers
+		writeHTML(w, r, data)
 	} else {
 		// Otherwise JSON
 		w.Header().Set("Content-Type", "application/json")
@@ -1821,6 +2683,14 @@ func (reason ClosedState) String() string {
 		return "Missing Account"
 	case Revocation:
 		return "Credentials Revoked"
+	case MemoryQuotaExceeded:
+		return "Account Memory Quota Exceeded"
+	case AccountDeleted:
+		return "Account Deleted"
+	case Kicked:
+		return "Kicked"
+	case ClientVersionRejected:
+		return "Client Library Version Rejected"
 	}
 	return "Unknown State"
 }
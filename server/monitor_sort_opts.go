@@ -32,19 +32,20 @@ type SortOpt string
 
 // Possible sort options
 const (
-	ByCid      SortOpt = "cid"        // By connection ID
-	ByStart    SortOpt = "start"      // By connection start time, same as CID
-	BySubs     SortOpt = "subs"       // By number of subscriptions
-	ByPending  SortOpt = "pending"    // By amount of data in bytes waiting to be sent to client
-	ByOutMsgs  SortOpt = "msgs_to"    // By number of messages sent
-	ByInMsgs   SortOpt = "msgs_from"  // By number of messages received
-	ByOutBytes SortOpt = "bytes_to"   // By amount of bytes sent
-	ByInBytes  SortOpt = "bytes_from" // By amount of bytes received
-	ByLast     SortOpt = "last"       // By the last activity
-	ByIdle     SortOpt = "idle"       // By the amount of inactivity
-	ByUptime   SortOpt = "uptime"     // By the amount of time connections exist
-	ByStop     SortOpt = "stop"       // By the stop time for a closed connection
-	ByReason   SortOpt = "reason"     // By the reason for a closed connection
+	ByCid         SortOpt = "cid"          // By connection ID
+	ByStart       SortOpt = "start"        // By connection start time, same as CID
+	BySubs        SortOpt = "subs"         // By number of subscriptions
+	ByPending     SortOpt = "pending"      // By amount of data in bytes waiting to be sent to client
+	ByPendingMsgs SortOpt = "pending_msgs" // By number of messages waiting to be sent to client
+	ByOutMsgs     SortOpt = "msgs_to"      // By number of messages sent
+	ByInMsgs      SortOpt = "msgs_from"    // By number of messages received
+	ByOutBytes    SortOpt = "bytes_to"     // By amount of bytes sent
+	ByInBytes     SortOpt = "bytes_from"   // By amount of bytes received
+	ByLast        SortOpt = "last"         // By the last activity
+	ByIdle        SortOpt = "idle"         // By the amount of inactivity
+	ByUptime      SortOpt = "uptime"       // By the amount of time connections exist
+	ByStop        SortOpt = "stop"         // By the stop time for a closed connection
+	ByReason      SortOpt = "reason"       // By the reason for a closed connection
 
 )
 
@@ -64,6 +65,13 @@ type byPending struct{ ConnInfos }
 
 func (l byPending) Less(i, j int) bool { return l.ConnInfos[i].Pending < l.ConnInfos[j].Pending }
 
+// Pending Msgs
+type byPendingMsgs struct{ ConnInfos }
+
+func (l byPendingMsgs) Less(i, j int) bool {
+	return l.ConnInfos[i].PendingMsgs < l.ConnInfos[j].PendingMsgs
+}
+
 // Outbound Msgs
 type byOutMsgs struct{ ConnInfos }
 
@@ -142,7 +150,7 @@ func (l byReason) Less(i, j int) bool {
 // IsValid determines if a sort option is valid
 func (s SortOpt) IsValid() bool {
 	switch s {
-	case "", ByCid, ByStart, BySubs, ByPending, ByOutMsgs, ByInMsgs, ByOutBytes, ByInBytes, ByLast, ByIdle, ByUptime, ByStop, ByReason:
+	case "", ByCid, ByStart, BySubs, ByPending, ByPendingMsgs, ByOutMsgs, ByInMsgs, ByOutBytes, ByInBytes, ByLast, ByIdle, ByUptime, ByStop, ByReason:
 		return true
 	default:
 		return false
@@ -0,0 +1,341 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthzPath is the health check endpoint, served by the monitoring port
+// and the public listener.
+const HealthzPath = "/healthz"
+
+// Healthz is the response of the health check.
+type Healthz struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// VarzSummary is the subset of varz served by the public listener.
+type VarzSummary struct {
+	ID            string    `json:"server_id"`
+	Name          string    `json:"server_name"`
+	Version       string    `json:"version"`
+	Start         time.Time `json:"start"`
+	Now           time.Time `json:"now"`
+	Uptime        string    `json:"uptime"`
+	Connections   int       `json:"connections"`
+	Routes        int       `json:"routes"`
+	Leafs         int       `json:"leafnodes"`
+	InMsgs        int64     `json:"in_msgs"`
+	OutMsgs       int64     `json:"out_msgs"`
+	InBytes       int64     `json:"in_bytes"`
+	OutBytes      int64     `json:"out_bytes"`
+	SlowConsumers int64     `json:"slow_consumers"`
+}
+
+func validateMonitorOptions(o *Options) error {
+	mo := &o.Monitor
+	if (mo.Username == _EMPTY_) != (mo.Password == _EMPTY_) {
+		return fmt.Errorf("monitor authentication requires both a user and a password")
+	}
+	if mo.Verify && o.HTTPSPort == 0 {
+		return fmt.Errorf("monitor verify requires the https monitoring port")
+	}
+	for i, u := range mo.Users {
+		if (u.Username == _EMPTY_) != (u.Password == _EMPTY_) {
+			return fmt.Errorf("monitor user %d requires both a user and a password", i)
+		}
+		if u.Username == _EMPTY_ && u.Token == _EMPTY_ && u.CommonName == _EMPTY_ {
+			return fmt.Errorf("monitor user %d requires a user, a token or a common name", i)
+		}
+		if u.CommonName != _EMPTY_ && !mo.Verify {
+			return fmt.Errorf("monitor user %d with a common name requires verify", i)
+		}
+		for _, e := range u.Endpoints {
+			if e != "*" && !strings.HasPrefix(e, "/") {
+				return fmt.Errorf("invalid endpoint %q of monitor user %d, expected a path or *", e, i)
+			}
+		}
+	}
+	if err := validateCORSOrigins(o); err != nil {
+		return err
+	}
+	if mo.PublicListen != _EMPTY_ {
+		_, port, err := net.SplitHostPort(mo.PublicListen)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid monitor public_listen %q: %v", mo.PublicListen, err)
+		}
+	}
+	return nil
+}
+
+// authEnabled returns true if the monitoring users have to authenticate.
+func (mo *MonitorOpts) authEnabled() bool {
+	return mo.Username != _EMPTY_ || mo.Token != _EMPTY_ || len(mo.Users) > 0
+}
+
+// monitorAuth requires the credentials of the monitor options, if set, for
+// the handlers of the monitoring port, and checks that the user is allowed
+// on the endpoint. The pprof handlers keep their own credentials.
+func (s *Server) monitorAuth(h http.Handler, opts *Options) http.Handler {
+	mo := &opts.Monitor
+	users := mo.Users
+	if mo.Username != _EMPTY_ || mo.Token != _EMPTY_ {
+		users = append([]*MonitorUser{{Username: mo.Username, Password: mo.Password, Token: mo.Token}}, users...)
+	}
+	if len(users) == 0 {
+		return h
+	}
+	profiling := opts.Profiling.HTTP
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if profiling && strings.HasPrefix(r.URL.Path, ProfilingPath) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := monitorUser(users, r)
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="monitor"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !u.allowed(r.Method, r.URL.Path) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Returns the user authenticated by the request, nil if none.
+func monitorUser(users []*MonitorUser, r *http.Request) *MonitorUser {
+	var token, cn string
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cn = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	user, pass, basic := r.BasicAuth()
+	for _, u := range users {
+		switch {
+		case basic && u.Username != _EMPTY_:
+			if subtle.ConstantTimeCompare([]byte(user), []byte(u.Username)) == 1 && comparePasswords(u.Password, pass) {
+				return u
+			}
+		case token != _EMPTY_ && u.Token != _EMPTY_:
+			if subtle.ConstantTimeCompare([]byte(token), []byte(u.Token)) == 1 {
+				return u
+			}
+		case cn != _EMPTY_ && u.CommonName != _EMPTY_:
+			if cn == u.CommonName {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+// Maximum size of the JSON body of the requests changing the state of the
+// server on the monitoring port.
+const maxMonitorRequestSize = 64 * 1024
+
+// decodeMonitorRequest decodes into v the JSON body of a request changing
+// the state of the server. A POST with the JSON content type is required
+// so that browsers can not send the request from another origin without a
+// CORS preflight request. Otherwise, or if the body is invalid, the error
+// is written, prefixed with action, and false is returned.
+func decodeMonitorRequest(w http.ResponseWriter, r *http.Request, action string, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(action + " only with a POST request"))
+		return false
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte(action + " only with an application/json request"))
+		return false
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxMonitorRequestSize)).Decode(v); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Error decoding request: %v", err)))
+		return false
+	}
+	return true
+}
+
+// ConnzClosePath is the endpoint monitoring users must be granted to close
+// connections, "/connz" only allowing to list them.
+const ConnzClosePath = ConnzPath + "/close"
+
+// allowed returns true if the user is allowed on the endpoint of the
+// request.
+func (u *MonitorUser) allowed(method, path string) bool {
+	if len(u.Endpoints) == 0 {
+		return true
+	}
+	path = monitorGrant(method, path)
+	for _, e := range u.Endpoints {
+		if e == "*" || path == e {
+			return true
+		}
+	}
+	return false
+}
+
+// monitorGrant returns the endpoint a monitoring user must be granted for
+// a request. The requests changing the state of the server, whatever their
+// method on the read only endpoint or their path under it, are the same
+// action: closing connections, setting log levels or starting, stopping
+// and deleting captures.
+func monitorGrant(method, path string) string {
+	read := method == http.MethodGet || method == http.MethodHead
+	switch {
+	case strings.HasPrefix(path, ConnzPath+"/"), path == ConnzPath && !read:
+		return ConnzClosePath
+	case strings.HasPrefix(path, LogzPath+"/"), path == LogzPath && !read:
+		return LogzSetPath
+	case strings.HasPrefix(path, CapturezPath+"/"), path == CapturezPath && !read:
+		return CapturezStartPath
+	case strings.HasPrefix(path, ObjectsPath+"/"):
+		// Reading and storing objects.
+		return ObjectsPath
+	}
+	return path
+}
+
+// HandleHealthz reports whether the server is running and its listeners
+// are started.
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[HealthzPath]++
+	shutdown := s.shutdown
+	s.mu.Unlock()
+
+	health := &Healthz{Status: "ok"}
+	if shutdown || !s.readyForConnections() {
+		health = &Healthz{Status: "unavailable", Error: "server not ready for connections"}
+	}
+	b, err := json.Marshal(health)
+	if err != nil {
+		s.Errorf("Error marshaling response to /healthz request: %v", err)
+	}
+	if health.Error != _EMPTY_ {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(b)
+		return
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// HandleVarzSummary serves the summary of varz on the public listener.
+func (s *Server) HandleVarzSummary(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[VarzPath]++
+	s.mu.Unlock()
+
+	v, _ := s.Varz(nil)
+	b, err := json.MarshalIndent(&VarzSummary{
+		ID:            v.ID,
+		Name:          v.Name,
+		Version:       v.Version,
+		Start:         v.Start,
+		Now:           v.Now,
+		Uptime:        v.Uptime,
+		Connections:   v.Connections,
+		Routes:        v.Routes,
+		Leafs:         v.Leafs,
+		InMsgs:        v.InMsgs,
+		OutMsgs:       v.OutMsgs,
+		InBytes:       v.InBytes,
+		OutBytes:      v.OutBytes,
+		SlowConsumers: v.SlowConsumers,
+	}, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /varz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// startPublicMonitoring starts the listener serving only the health check
+// and the summary of varz, if configured.
+func (s *Server) startPublicMonitoring() error {
+	opts := s.getOpts()
+	hp := opts.Monitor.PublicListen
+	if hp == _EMPTY_ {
+		return nil
+	}
+	l, err := net.Listen("tcp", hp)
+	if err != nil {
+		return fmt.Errorf("can't listen to the public monitor port: %v", err)
+	}
+	s.Noticef("Starting public http monitor on %s", l.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthzPath, s.HandleHealthz)
+	mux.HandleFunc(VarzPath, s.HandleVarzSummary)
+	srv := &http.Server{
+		Addr:           hp,
+		Handler:        monitorCORS(mux, opts.Monitor.CORSOrigins),
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	s.mu.Lock()
+	if s.httpReqStats == nil {
+		s.httpReqStats = map[string]uint64{HealthzPath: 0, VarzPath: 0}
+	}
+	s.publicHTTP = l
+	s.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			s.mu.Lock()
+			shutdown := s.shutdown
+			s.mu.Unlock()
+			if !shutdown {
+				s.Fatalf("Error starting public monitor on %q: %v", hp, err)
+			}
+		}
+		srv.Close()
+		s.done <- true
+	}()
+	return nil
+}
+
+// PublicMonitorAddr returns the address of the public monitoring listener.
+func (s *Server) PublicMonitorAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.publicHTTP == nil {
+		return nil
+	}
+	return s.publicHTTP.Addr().(*net.TCPAddr)
+}
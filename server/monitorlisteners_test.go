@@ -0,0 +1,183 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMonitorOptionsConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		https_port: 8222
+		monitor {
+			public_listen: "0.0.0.0:8080"
+			user: admin
+			password: secret
+			verify: true
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	expected := MonitorOpts{PublicListen: "0.0.0.0:8080", Username: "admin", Password: "secret", Verify: true}
+	if !reflect.DeepEqual(opts.Monitor, expected) {
+		t.Fatalf("Unexpected monitor options: %+v", opts.Monitor)
+	}
+
+	for _, test := range []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{"no password", Options{Monitor: MonitorOpts{Username: "admin"}}, "user and a password"},
+		{"verify without https", Options{HTTPPort: 8222, Monitor: MonitorOpts{Verify: true}}, "https monitoring port"},
+		{"bad public listen", Options{Monitor: MonitorOpts{PublicListen: "8080"}}, "invalid monitor public_listen"},
+		{"user without credentials", Options{Monitor: MonitorOpts{Users: []*MonitorUser{{Endpoints: []string{"/varz"}}}}}, "user, a token or a common name"},
+		{"common name without verify", Options{Monitor: MonitorOpts{Users: []*MonitorUser{{CommonName: "dashboard"}}}}, "requires verify"},
+		{"bad endpoint", Options{Monitor: MonitorOpts{Users: []*MonitorUser{{Token: "t", Endpoints: []string{"varz"}}}}}, "invalid endpoint"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateMonitorOptions(&test.opts); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestMonitorPublicListener(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	opts.Monitor = MonitorOpts{PublicListen: "127.0.0.1:0", Username: "admin", Password: "secret"}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	get := func(url string, auth bool) (int, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	public := fmt.Sprintf("http://127.0.0.1:%d", s.PublicMonitorAddr().Port)
+	status, body := get(public+HealthzPath, false)
+	var health Healthz
+	if err := json.Unmarshal(body, &health); err != nil || status != http.StatusOK || health.Status != "ok" {
+		t.Fatalf("Unexpected health check %v: %s", status, body)
+	}
+	status, body = get(public+VarzPath, false)
+	var summary VarzSummary
+	if err := json.Unmarshal(body, &summary); err != nil || status != http.StatusOK || summary.ID != s.ID() {
+		t.Fatalf("Unexpected varz summary %v: %s", status, body)
+	}
+	if strings.Contains(string(body), "max_payload") {
+		t.Fatalf("Expected only the summary of varz, got %s", body)
+	}
+	if status, _ = get(public+ConnzPath, false); status != http.StatusNotFound {
+		t.Fatalf("Expected connz not to be served, got %v", status)
+	}
+
+	private := fmt.Sprintf("http://127.0.0.1:%d", s.MonitorAddr().Port)
+	for _, path := range []string{ConnzPath, SubszPath, HealthzPath} {
+		if status, _ = get(private+path, false); status != http.StatusUnauthorized {
+			t.Fatalf("Expected %s to require authentication, got %v", path, status)
+		}
+		if status, _ = get(private+path, true); status != http.StatusOK {
+			t.Fatalf("Expected %s to be served, got %v", path, status)
+		}
+	}
+}
+
+func TestMonitorEndpointAuthorization(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: "127.0.0.1:-1"
+		monitor {
+			token: admin
+			users: [
+				{token: dashboard, endpoints: ["/varz", "/healthz"]}
+				{user: ops, password: ops, endpoints: "/connz"}
+				{user: admin, password: admin, endpoints: ["/connz", "/connz/close"]}
+				{user: logs, password: logs, endpoints: ["/logz", "/capturez"]}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if len(opts.Monitor.Users) != 4 || opts.Monitor.Users[1].Username != "ops" ||
+		!reflect.DeepEqual(opts.Monitor.Users[0].Endpoints, []string{"/varz", "/healthz"}) {
+		t.Fatalf("Unexpected monitor users: %+v", opts.Monitor.Users)
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d", s.MonitorAddr().Port)
+	for _, test := range []struct {
+		method string
+		path   string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{http.MethodGet, VarzPath, func(r *http.Request) {}, http.StatusUnauthorized},
+		{http.MethodGet, VarzPath, func(r *http.Request) { r.Header.Set("Authorization", "Bearer bad") }, http.StatusUnauthorized},
+		{http.MethodGet, VarzPath, func(r *http.Request) { r.Header.Set("Authorization", "Bearer dashboard") }, http.StatusOK},
+		{http.MethodGet, ConnzPath, func(r *http.Request) { r.Header.Set("Authorization", "Bearer dashboard") }, http.StatusForbidden},
+		{http.MethodGet, ConnzPath, func(r *http.Request) { r.SetBasicAuth("ops", "ops") }, http.StatusOK},
+		// Listing connections does not allow to close them.
+		{http.MethodPost, ConnzPath + "/1000/close", func(r *http.Request) { r.SetBasicAuth("ops", "ops") }, http.StatusForbidden},
+		{http.MethodPost, ConnzClosePath, func(r *http.Request) { r.SetBasicAuth("ops", "ops") }, http.StatusForbidden},
+		{http.MethodPost, ConnzPath + "/1000/close", func(r *http.Request) { r.SetBasicAuth("admin", "admin") }, http.StatusBadRequest},
+		{http.MethodGet, ConnzPath, func(r *http.Request) { r.SetBasicAuth("ops", "bad") }, http.StatusUnauthorized},
+		{http.MethodGet, SubszPath, func(r *http.Request) { r.SetBasicAuth("ops", "ops") }, http.StatusForbidden},
+		{http.MethodGet, SubszPath, func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin") }, http.StatusOK},
+		// Reading the log levels and captures does not allow to change them,
+		// whatever the method or the path.
+		{http.MethodGet, LogzPath, func(r *http.Request) { r.SetBasicAuth("logs", "logs") }, http.StatusOK},
+		{http.MethodPost, LogzPath, func(r *http.Request) { r.SetBasicAuth("logs", "logs") }, http.StatusForbidden},
+		{http.MethodPost, LogzSetPath, func(r *http.Request) { r.SetBasicAuth("logs", "logs") }, http.StatusForbidden},
+		{http.MethodPost, LogzSetPath, func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin") }, http.StatusBadRequest},
+		{http.MethodGet, CapturezPath, func(r *http.Request) { r.SetBasicAuth("logs", "logs") }, http.StatusOK},
+		{http.MethodDelete, CapturezPath, func(r *http.Request) { r.SetBasicAuth("logs", "logs") }, http.StatusForbidden},
+		{http.MethodPost, CapturezStopPath, func(r *http.Request) { r.SetBasicAuth("logs", "logs") }, http.StatusForbidden},
+		{http.MethodPost, ConnzPath, func(r *http.Request) { r.SetBasicAuth("ops", "ops") }, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(test.method, url+test.path, strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		test.auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("Expected status %v for %s with %v, got %v", test.status, test.path, req.Header, resp.StatusCode)
+		}
+	}
+}
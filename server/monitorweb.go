@@ -0,0 +1,163 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// How long browsers can cache the response to a CORS preflight request.
+const corsMaxAge = "600"
+
+func validateCORSOrigins(o *Options) error {
+	for _, origin := range o.Monitor.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == _EMPTY_ || u.Host == _EMPTY_ || (u.Path != _EMPTY_ && u.Path != "/") {
+			return fmt.Errorf("invalid monitor cors origin %q, expected a scheme and host or *", origin)
+		}
+	}
+	return nil
+}
+
+// monitorCORS adds the CORS headers to the responses of the monitoring
+// handlers for the allowed origins, and answers the preflight requests,
+// which browsers send without credentials.
+func monitorCORS(h http.Handler, origins []string) http.Handler {
+	if len(origins) == 0 {
+		return h
+	}
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[strings.TrimSuffix(o, "/")] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == _EMPTY_ || !(allowed["*"] || allowed[origin]) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		// Only the origins listed can send the credentials of the user.
+		if allowed[origin] {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != _EMPTY_ {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wantsHTML returns true if the request asks for an HTML page, with the
+// format parameter or preferring text/html to JSON in its Accept header.
+func wantsHTML(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "html":
+		return true
+	case "json":
+		return false
+	}
+	htmlAt, jsonAt := -1, -1
+	for i, t := range strings.Split(r.Header.Get("Accept"), ",") {
+		if j := strings.IndexByte(t, ';'); j >= 0 {
+			t = t[:j]
+		}
+		switch strings.TrimSpace(t) {
+		case "text/html":
+			if htmlAt < 0 {
+				htmlAt = i
+			}
+		case "application/json":
+			if jsonAt < 0 {
+				jsonAt = i
+			}
+		}
+	}
+	return htmlAt >= 0 && (jsonAt < 0 || htmlAt < jsonAt)
+}
+
+// writeHTML writes the JSON response of a monitoring endpoint as an HTML
+// page of nested tables.
+func writeHTML(w http.ResponseWriter, r *http.Request, data []byte) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	var buf bytes.Buffer
+	title := html.EscapeString(r.URL.Path)
+	fmt.Fprintf(&buf, `<html lang="en">
+  <head>
+    <title>%s</title>
+    <style type="text/css">
+      body { font-family: sans-serif; }
+      table { border-collapse: collapse; }
+      td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+    </style>
+  </head>
+  <body>
+    <h1>%s</h1>
+`, title, title)
+	writeHTMLValue(&buf, v)
+	buf.WriteString("\n  </body>\n</html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func writeHTMLValue(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("<table>")
+		for _, k := range keys {
+			fmt.Fprintf(buf, "<tr><th>%s</th><td>", html.EscapeString(k))
+			writeHTMLValue(buf, v[k])
+			buf.WriteString("</td></tr>")
+		}
+		buf.WriteString("</table>")
+	case []interface{}:
+		buf.WriteString("<table>")
+		for _, e := range v {
+			buf.WriteString("<tr><td>")
+			writeHTMLValue(buf, e)
+			buf.WriteString("</td></tr>")
+		}
+		buf.WriteString("</table>")
+	case nil:
+	default:
+		buf.WriteString(html.EscapeString(fmt.Sprint(v)))
+	}
+}
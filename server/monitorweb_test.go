@@ -0,0 +1,145 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWantsHTML(t *testing.T) {
+	for _, test := range []struct {
+		query  string
+		accept string
+		html   bool
+	}{
+		{"", "", false},
+		{"", "*/*", false},
+		{"", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true},
+		{"", "application/json, text/html", false},
+		{"?format=html", "application/json", true},
+		{"?format=json", "text/html", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/varz"+test.query, nil)
+		if test.accept != _EMPTY_ {
+			r.Header.Set("Accept", test.accept)
+		}
+		if html := wantsHTML(r); html != test.html {
+			t.Fatalf("Expected %v for %q and %q", test.html, test.query, test.accept)
+		}
+	}
+}
+
+func TestMonitorCORS(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: "127.0.0.1:-1"
+		monitor {
+			token: secret
+			cors_origins: ["https://dash.example.com"]
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, VarzPath)
+	do := func(method, origin string, token bool) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		if token {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// The preflight requests are sent without credentials.
+	resp := do(http.MethodOptions, "https://dash.example.com", false)
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://dash.example.com" ||
+		!strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Fatalf("Unexpected preflight response %v: %v", resp.StatusCode, resp.Header)
+	}
+	resp = do(http.MethodGet, "https://dash.example.com", true)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "https://dash.example.com" ||
+		resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("Unexpected response %v: %v", resp.StatusCode, resp.Header)
+	}
+	resp = do(http.MethodGet, "https://evil.example.com", true)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != _EMPTY_ {
+		t.Fatalf("Unexpected response %v: %v", resp.StatusCode, resp.Header)
+	}
+	if resp = do(http.MethodOptions, "https://evil.example.com", false); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected the preflight request of another origin to be rejected, got %v", resp.StatusCode)
+	}
+
+	opts := &Options{Monitor: MonitorOpts{CORSOrigins: []string{"dash.example.com"}}}
+	if err := validateMonitorOptions(opts); err == nil || !strings.Contains(err.Error(), "invalid monitor cors origin") {
+		t.Fatalf("Expected an invalid origin error, got %v", err)
+	}
+}
+
+func TestMonitorHTMLFormat(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	opts.ServerName = "<b>srv</b>"
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	get := func(path, accept string) (string, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, path), nil)
+		if accept != _EMPTY_ {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	for _, test := range []struct {
+		path   string
+		accept string
+	}{
+		{VarzPath + "?format=html", ""},
+		{VarzPath, "text/html"},
+	} {
+		ct, body := get(test.path, test.accept)
+		if !strings.HasPrefix(ct, "text/html") || !strings.Contains(body, "<th>server_id</th><td>"+s.ID()+"</td>") ||
+			!strings.Contains(body, "&lt;b&gt;srv&lt;/b&gt;") || strings.Contains(body, "<b>srv") {
+			t.Fatalf("Unexpected HTML response %q: %s", ct, body)
+		}
+	}
+	if ct, body := get(ConnzPath, "application/json"); ct != "application/json" || !strings.HasPrefix(body, "{") {
+		t.Fatalf("Unexpected JSON response %q: %s", ct, body)
+	}
+}
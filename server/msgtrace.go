@@ -0,0 +1,305 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default and maximum duration of a message trace.
+var (
+	defaultMsgTraceTTL = 5 * time.Minute
+	maxMsgTraceTTL     = time.Hour
+)
+
+// MsgTraceRequest is a request to trace the messages published on a
+// subject, possibly only in a given account. Sampling is the percentage
+// of the matching messages that are traced, all of them by default.
+// Setting Stop ends the trace of the subject, or all traces if the
+// subject is empty.
+type MsgTraceRequest struct {
+	Subject  string        `json:"subject,omitempty"`
+	Account  string        `json:"account,omitempty"`
+	Sampling int           `json:"sampling,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+	Stop     bool          `json:"stop,omitempty"`
+}
+
+// MsgTraceResponse is sent back in response to a MsgTraceRequest with
+// the traces active on the server.
+type MsgTraceResponse struct {
+	Server ServerInfo     `json:"server"`
+	Traces []MsgTraceInfo `json:"traces,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// MsgTraceInfo describes an active message trace.
+type MsgTraceInfo struct {
+	Subject  string    `json:"subject"`
+	Account  string    `json:"account,omitempty"`
+	Sampling int       `json:"sampling"`
+	Expires  time.Time `json:"expires"`
+}
+
+// MsgTraceEventMsg is sent for each traced message, by every server that
+// processes it, with the connection it came from and the ones it was
+// delivered to.
+type MsgTraceEventMsg struct {
+	Server   ServerInfo       `json:"server"`
+	Subject  string           `json:"subject"`
+	Reply    string           `json:"reply,omitempty"`
+	Account  string           `json:"account,omitempty"`
+	Size     int              `json:"size"`
+	Received time.Time        `json:"received"`
+	Ingress  MsgTraceConn     `json:"ingress"`
+	Egress   []MsgTraceEgress `json:"egress,omitempty"`
+}
+
+// MsgTraceConn identifies a connection in a trace event.
+type MsgTraceConn struct {
+	Kind    string `json:"kind"`
+	CID     uint64 `json:"cid"`
+	Name    string `json:"name,omitempty"`
+	Account string `json:"account,omitempty"`
+}
+
+// MsgTraceEgress is a delivery of a traced message.
+type MsgTraceEgress struct {
+	MsgTraceConn
+	Subscription string    `json:"subscription,omitempty"`
+	Queue        string    `json:"queue,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// A message trace activated through the system account.
+type msgTraceFilter struct {
+	subject  string
+	account  string
+	sampling int
+	expires  time.Time
+	tmr      *time.Timer
+}
+
+// Returns the key of a trace in the server's map.
+func msgTraceKey(account, subject string) string {
+	return account + " " + subject
+}
+
+// msgTracing returns true if there are active message traces. This is
+// checked for every inbound message so it does not take the lock.
+func (s *Server) msgTracing() bool {
+	return atomic.LoadInt32(&s.mtraces.n) > 0
+}
+
+// Returns true if a message published on subject in account should be traced.
+func (s *Server) shouldTraceMsg(account, subject string) bool {
+	// Do not trace the trace events and other system messages.
+	if strings.HasPrefix(subject, "$SYS.") {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.mtraces.filters {
+		if (f.account == _EMPTY_ || f.account == account) && matchLiteral(subject, f.subject) {
+			return f.sampling >= 100 || rand.Intn(100) < f.sampling
+		}
+	}
+	return false
+}
+
+// Adds or replaces a message trace.
+// Lock should be held.
+func (s *Server) addMsgTrace(account, subject string, sampling int, ttl time.Duration) {
+	key := msgTraceKey(account, subject)
+	if f := s.mtraces.filters[key]; f != nil {
+		f.tmr.Stop()
+	} else {
+		if s.mtraces.filters == nil {
+			s.mtraces.filters = make(map[string]*msgTraceFilter)
+		}
+		atomic.AddInt32(&s.mtraces.n, 1)
+	}
+	f := &msgTraceFilter{
+		subject:  subject,
+		account:  account,
+		sampling: sampling,
+		expires:  time.Now().Add(ttl),
+	}
+	f.tmr = time.AfterFunc(ttl, func() {
+		s.mu.Lock()
+		if s.mtraces.filters[key] == f {
+			s.removeMsgTrace(key)
+			s.Noticef("Message trace of %q expired", subject)
+		}
+		s.mu.Unlock()
+	})
+	s.mtraces.filters[key] = f
+}
+
+// Removes a message trace.
+// Lock should be held.
+func (s *Server) removeMsgTrace(key string) {
+	if f := s.mtraces.filters[key]; f != nil {
+		f.tmr.Stop()
+		delete(s.mtraces.filters, key)
+		atomic.AddInt32(&s.mtraces.n, -1)
+	}
+}
+
+// Returns the active message traces.
+// Lock should be held.
+func (s *Server) msgTraceInfos() []MsgTraceInfo {
+	var infos []MsgTraceInfo
+	for _, f := range s.mtraces.filters {
+		infos = append(infos, MsgTraceInfo{
+			Subject:  f.subject,
+			Account:  f.account,
+			Sampling: f.sampling,
+			Expires:  f.expires.UTC(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Subject != infos[j].Subject {
+			return infos[i].Subject < infos[j].Subject
+		}
+		return infos[i].Account < infos[j].Account
+	})
+	return infos
+}
+
+// msgTraceReq is a request to start or stop tracing messages.
+func (s *Server) msgTraceReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var req MsgTraceRequest
+	var resp MsgTraceResponse
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = fmt.Sprintf("error unmarshalling request: %v", err)
+	} else if req.Stop {
+		if req.Subject != _EMPTY_ && !IsValidSubject(req.Subject) {
+			resp.Error = fmt.Sprintf("invalid subject %q", req.Subject)
+		}
+	} else if !IsValidSubject(req.Subject) {
+		resp.Error = fmt.Sprintf("invalid subject %q", req.Subject)
+	} else if req.Sampling < 0 || req.Sampling > 100 {
+		resp.Error = fmt.Sprintf("sampling must be between 1 and 100, got %d", req.Sampling)
+	} else if req.TTL < 0 || req.TTL > maxMsgTraceTTL {
+		resp.Error = fmt.Sprintf("ttl must be greater than 0 and at most %v", maxMsgTraceTTL)
+	}
+
+	s.mu.Lock()
+	if resp.Error == _EMPTY_ {
+		switch {
+		case req.Stop && req.Subject == _EMPTY_:
+			for key := range s.mtraces.filters {
+				s.removeMsgTrace(key)
+			}
+			s.Noticef("Stopped all message traces")
+		case req.Stop:
+			s.removeMsgTrace(msgTraceKey(req.Account, req.Subject))
+			s.Noticef("Stopped message trace of %q", req.Subject)
+		default:
+			if req.Sampling == 0 {
+				req.Sampling = 100
+			}
+			if req.TTL == 0 {
+				req.TTL = defaultMsgTraceTTL
+			}
+			s.addMsgTrace(req.Account, req.Subject, req.Sampling, req.TTL)
+			s.Noticef("Tracing %d%% of messages on %q for %v", req.Sampling, req.Subject, req.TTL)
+		}
+	}
+	resp.Traces = s.msgTraceInfos()
+	if reply != _EMPTY_ {
+		s.sendInternalMsg(reply, _EMPTY_, &resp.Server, &resp)
+	}
+	s.mu.Unlock()
+}
+
+// Tracks a traced message while it is being processed.
+type msgTrace struct {
+	ev *MsgTraceEventMsg
+}
+
+// Returns the connection information for a trace event.
+// Lock should be held.
+func (c *client) msgTraceConn() MsgTraceConn {
+	mc := MsgTraceConn{Kind: c.typeString(), CID: c.cid}
+	switch c.kind {
+	case CLIENT:
+		mc.Name = c.opts.Name
+	case ROUTER:
+		mc.Name = c.route.remoteName
+	case GATEWAY:
+		mc.Name = c.gw.name
+	case LEAF:
+		mc.Name = c.leaf.remoteName
+	}
+	if (c.kind == CLIENT || c.kind == LEAF) && c.acc != nil {
+		mc.Account = c.acc.Name
+	}
+	return mc
+}
+
+// startMsgTrace checks if the message being processed should be traced
+// and if so starts tracking it.
+func (c *client) startMsgTrace(msg []byte) {
+	c.mu.Lock()
+	ingress := c.msgTraceConn()
+	c.mu.Unlock()
+	account := ingress.Account
+	if c.kind == ROUTER || c.kind == GATEWAY {
+		account = string(c.pa.account)
+	}
+	subject := string(c.pa.subject)
+	if !c.srv.shouldTraceMsg(account, subject) {
+		return
+	}
+	c.mt = &msgTrace{ev: &MsgTraceEventMsg{
+		Subject:  subject,
+		Reply:    string(c.pa.reply),
+		Account:  account,
+		Size:     len(msg) - LEN_CR_LF,
+		Received: time.Now().UTC(),
+		Ingress:  ingress,
+	}}
+}
+
+// addEgress records the delivery of the traced message to client.
+// Lock for client should be held.
+func (mt *msgTrace) addEgress(client *client, sub *subscription) {
+	mt.ev.Egress = append(mt.ev.Egress, MsgTraceEgress{
+		MsgTraceConn: client.msgTraceConn(),
+		Subscription: string(sub.subject),
+		Queue:        string(sub.queue),
+		Time:         time.Now().UTC(),
+	})
+}
+
+// endMsgTrace sends the trace event for the message just processed.
+func (c *client) endMsgTrace() {
+	ev := c.mt.ev
+	c.mt = nil
+	s := c.srv
+	s.mu.Lock()
+	s.sendInternalMsg(fmt.Sprintf(msgTraceEventSubj, s.info.ID), _EMPTY_, &ev.Server, ev)
+	s.mu.Unlock()
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NetworkACL restricts the remote addresses connections are accepted from.
+// Entries are CIDR blocks or single IP addresses. An address matching Deny
+// is rejected. Otherwise, if Allow is not empty, the address must match it.
+type NetworkACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// parseNetwork parses a CIDR block or a single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	return n, nil
+}
+
+func matchNetworks(networks []string, ip net.IP) bool {
+	for _, s := range networks {
+		if n, err := parseNetwork(s); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if connections from host are accepted. A connection
+// without an IP address, such as one over a Unix socket, is only accepted
+// if there is no Allow list.
+func (n *NetworkACL) allows(host string) bool {
+	if n == nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(n.Allow) == 0
+	}
+	if matchNetworks(n.Deny, ip) {
+		return false
+	}
+	return len(n.Allow) == 0 || matchNetworks(n.Allow, ip)
+}
+
+// allowsConn returns true if the remote address of conn is accepted.
+func (n *NetworkACL) allowsConn(conn net.Conn) bool {
+	if n == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = _EMPTY_
+	}
+	return n.allows(host)
+}
+
+func (n *NetworkACL) validate() error {
+	if n == nil {
+		return nil
+	}
+	for _, s := range append(n.Allow, n.Deny...) {
+		if _, err := parseNetwork(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNetworkACLs checks the networks of the listeners and users.
+func validateNetworkACLs(o *Options) error {
+	for name, n := range map[string]*NetworkACL{
+		"client":   o.Networks,
+		"cluster":  o.Cluster.Networks,
+		"gateway":  o.Gateway.Networks,
+		"leafnode": o.LeafNode.Networks,
+	} {
+		if err := n.validate(); err != nil {
+			return fmt.Errorf("%s networks: %v", name, err)
+		}
+	}
+	for _, u := range append(o.Users, o.LeafNode.Users...) {
+		if err := u.Networks.validate(); err != nil {
+			return fmt.Errorf("networks of user %q: %v", u.Username, err)
+		}
+	}
+	for _, u := range o.Nkeys {
+		if err := u.Networks.validate(); err != nil {
+			return fmt.Errorf("networks of user %q: %v", u.Nkey, err)
+		}
+	}
+	return nil
+}
+
+// acceptAllowed returns true if the connection accepted on a listener is
+// allowed by its networks. The connection is closed otherwise.
+func (s *Server) acceptAllowed(kind string, n *NetworkACL, conn net.Conn) bool {
+	if n.allowsConn(conn) {
+		return true
+	}
+	s.Debugf("%s connection from %s rejected by networks", kind, conn.RemoteAddr())
+	conn.Close()
+	return false
+}
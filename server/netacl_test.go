@@ -0,0 +1,134 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNetworkACLAllows(t *testing.T) {
+	for _, test := range []struct {
+		acl     *NetworkACL
+		host    string
+		allowed bool
+	}{
+		{nil, "10.0.0.1", true},
+		{&NetworkACL{}, "10.0.0.1", true},
+		{&NetworkACL{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3", true},
+		{&NetworkACL{Allow: []string{"10.0.0.0/8"}}, "192.168.0.1", false},
+		{&NetworkACL{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}}, "10.0.0.1", false},
+		{&NetworkACL{Deny: []string{"192.168.0.0/16"}}, "10.0.0.1", true},
+		{&NetworkACL{Deny: []string{"192.168.0.0/16"}}, "192.168.5.5", false},
+		{&NetworkACL{Allow: []string{"fd00::/8"}}, "fd00::1", true},
+		{&NetworkACL{Allow: []string{"fd00::/8"}}, "10.0.0.1", false},
+		{&NetworkACL{Allow: []string{"10.0.0.0/8"}}, "", false},
+		{&NetworkACL{Deny: []string{"10.0.0.0/8"}}, "", true},
+	} {
+		if allowed := test.acl.allows(test.host); allowed != test.allowed {
+			t.Fatalf("Expected %+v to allow %q: %v, got %v", test.acl, test.host, test.allowed, allowed)
+		}
+	}
+}
+
+func TestNetworkACLConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		networks: ["10.0.0.0/8", "127.0.0.1"]
+		cluster {
+			networks { allow: "10.0.0.0/8", deny: ["10.0.0.1"] }
+		}
+		authorization {
+			users [{user: a, password: pwd, networks: {deny: "192.168.0.0/16"}}]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if n := opts.Networks; n == nil || len(n.Allow) != 2 || len(n.Deny) != 0 {
+		t.Fatalf("Unexpected client networks: %+v", n)
+	}
+	if n := opts.Cluster.Networks; n == nil || len(n.Allow) != 1 || len(n.Deny) != 1 {
+		t.Fatalf("Unexpected cluster networks: %+v", n)
+	}
+	if n := opts.Users[0].Networks; n == nil || len(n.Deny) != 1 {
+		t.Fatalf("Unexpected user networks: %+v", n)
+	}
+
+	conf = createConfFile(t, []byte(`networks: ["10.0.0.0/33"]`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected error for invalid network")
+	}
+}
+
+func TestNetworkACLClientListener(t *testing.T) {
+	o := DefaultOptions()
+	o.Networks = &NetworkACL{Deny: []string{"127.0.0.0/8"}}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if nc, err := nats.Connect(s.ClientURL(), nats.Timeout(500*time.Millisecond)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be rejected")
+	}
+}
+
+func TestNetworkACLUsers(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users [
+				{user: onprem, password: pwd, networks: ["10.0.0.0/8"]}
+				{user: local, password: pwd, networks: {allow: "127.0.0.0/8", deny: "127.0.0.2"}}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("onprem", "pwd")); err == nil {
+		nc.Close()
+		t.Fatal("Expected user to be rejected")
+	}
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("local", "pwd"))
+	nc.Close()
+}
+
+func TestNetworkACLRoutes(t *testing.T) {
+	ob := DefaultOptions()
+	ob.Cluster.Host = "127.0.0.1"
+	ob.Cluster.Port = -1
+	ob.Cluster.Networks = &NetworkACL{Allow: []string{"10.0.0.0/8"}}
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	oa := DefaultOptions()
+	oa.Cluster.Host = "127.0.0.1"
+	oa.Cluster.Port = -1
+	oa.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sb.ClusterAddr().Port))
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	time.Sleep(250 * time.Millisecond)
+	if n := sb.NumRoutes(); n != 0 {
+		t.Fatalf("Expected route to be rejected, got %d routes", n)
+	}
+}
@@ -14,7 +14,12 @@
 package server
 
 import (
+	"bytes"
 	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/nats-io/nkeys"
 )
 
 // Raw length of the nonce challenge
@@ -44,3 +49,41 @@ func (s *Server) generateNonce(n []byte) {
 	s.prand.Read(data)
 	base64.RawURLEncoding.Encode(n, data)
 }
+
+// readServerKeyFile loads the server's nkey identity from the given file.
+// The file can contain only the server seed, or be a decorated file where
+// the seed is one of the lines. The seed can also be loaded from a key
+// provider, in which case fname is the URL of the seed.
+func readServerKeyFile(fname string) (nkeys.KeyPair, error) {
+	var (
+		contents []byte
+		err      error
+	)
+	if p, u := keyProviderFor(fname); p != nil {
+		fname = u.Redacted()
+		contents, err = p.Seed(u)
+	} else {
+		contents, err = ioutil.ReadFile(fname)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading server key file: %v", err)
+	}
+	defer wipeSlice(contents)
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("SN")) {
+			continue
+		}
+		kp, err := nkeys.FromSeed(line)
+		if err != nil {
+			return nil, fmt.Errorf("server key file %q has malformed seed: %v", fname, err)
+		}
+		return kp, nil
+	}
+	return nil, fmt.Errorf("server key file %q does not contain a server seed", fname)
+}
+
+// signEvents tells us if system events should be signed with the server's key.
+func (s *Server) signEvents() bool {
+	return s.getOpts().ServerKeyFile != ""
+}
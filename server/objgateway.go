@@ -0,0 +1,292 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// ObjectsPath is the prefix of the paths of the objects served by the HTTP
+// gateway of the object stores, /objects/<account>/<bucket>/<object>.
+const ObjectsPath = "/objects"
+
+// Prefix of the ids of the uploads of the HTTP gateway, distinct from the
+// client ids of the uploads over the API.
+const objHTTPUploadPrefix = "http-"
+
+var errObjUploadNotFound = errors.New("upload not found")
+
+// HandleObject serves the objects of the object stores on the monitoring
+// port, which must require authentication. A GET supports ranges and the
+// conditional requests on the ETag derived from the digest of the object.
+// A PUT stores its body as the object, chunk by chunk. The object can also
+// be uploaded in parts, each a PUT with the same "upload" id sent in order,
+// the last one with "complete=true".
+func (s *Server) HandleObject(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[ObjectsPath]++
+	s.mu.Unlock()
+
+	tokens := strings.SplitN(strings.TrimPrefix(r.URL.Path, ObjectsPath+"/"), "/", 3)
+	if len(tokens) != 3 || tokens[0] == _EMPTY_ || tokens[1] == _EMPTY_ || tokens[2] == _EMPTY_ {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Unknown path %q", r.URL.Path)))
+		return
+	}
+	account, bucket, name := tokens[0], tokens[1], tokens[2]
+	s.mu.Lock()
+	st := s.objs[account]
+	s.mu.Unlock()
+	if st == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("No object store for account %q", account)))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serveObject(w, r, st, bucket, name)
+	case http.MethodPut:
+		s.storeObject(w, r, st, bucket, name)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Objects can only be read with a GET or stored with a PUT request"))
+	}
+}
+
+// serveObject writes the requested range of the object, if its conditions
+// are met.
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, st *objectStore, bucket, name string) {
+	obj, f, err := st.open(bucket, name)
+	if err == errObjBucketNotFound || err == errObjNotFound {
+		objHTTPError(w, err)
+		return
+	} else if err != nil {
+		s.Errorf("Error reading object %q of bucket %q: %v", name, bucket, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to read the object"))
+		return
+	}
+	var content io.ReadSeeker = bytes.NewReader(obj.data)
+	if f != nil {
+		defer f.Close()
+		content = &objReader{st: st, info: obj.info, f: f, r: st.dataReader(f, obj.info, st.cipher != nil)}
+	}
+	w.Header().Set("ETag", objETag(obj.info))
+	http.ServeContent(w, r, name, obj.info.Modified, content)
+}
+
+// storeObject stores the body of the request as the object, or as a part
+// of its upload.
+func (s *Server) storeObject(w http.ResponseWriter, r *http.Request, st *objectStore, bucket, name string) {
+	q := r.URL.Query()
+	id := objHTTPUploadPrefix + nuid.Next()
+	multipart := q.Get("upload") != _EMPTY_
+	complete := !multipart
+	if multipart {
+		// The id is part of the name of the file of the upload.
+		if !kvValidBucket.MatchString(q.Get("upload")) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid upload id %q", q.Get("upload"))))
+			return
+		}
+		id = objHTTPUploadPrefix + q.Get("upload")
+		complete, _ = strconv.ParseBool(q.Get("complete"))
+	}
+
+	buf := make([]byte, objChunkSize)
+	for {
+		// Not io.ReadFull, a truncated body is an io.ErrUnexpectedEOF.
+		var n int
+		var err error
+		for n < len(buf) && err == nil {
+			var nr int
+			nr, err = r.Body.Read(buf[n:])
+			n += nr
+		}
+		if n > 0 {
+			if _, perr := st.put(id, bucket, name, buf[:n]); perr != nil {
+				objHTTPError(w, perr)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			st.abort(id, bucket, name)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Error reading the object: %v", err)))
+			return
+		}
+	}
+	if !complete {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	var info *ObjectInfo
+	var err error
+	if multipart {
+		info, err = st.finish(id, bucket, name)
+	} else {
+		info, err = st.put(id, bucket, name, nil)
+	}
+	if err != nil {
+		objHTTPError(w, err)
+		return
+	}
+	b, err := json.MarshalIndent(&ObjectStoreResponse{Info: info}, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /objects request: %v", err)
+	}
+	w.Header().Set("ETag", objETag(info))
+	ResponseHandler(w, r, b)
+}
+
+// Writes the error of an object store operation.
+func objHTTPError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	switch err {
+	case errObjBucketNotFound, errObjNotFound, errObjUploadNotFound:
+		code = http.StatusNotFound
+	}
+	w.WriteHeader(code)
+	w.Write([]byte(err.Error()))
+}
+
+// Returns the strong ETag of an object, its digest.
+func objETag(info *ObjectInfo) string {
+	return `"` + info.Digest + `"`
+}
+
+// open returns the object and, if the store has a directory, its opened
+// data file, which is not replaced while the lock is held.
+func (st *objectStore) open(bucket, name string) (*object, *os.File, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := st.bucket(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj := b[name]
+	if obj == nil {
+		return nil, nil, errObjNotFound
+	}
+	if st.dir == _EMPTY_ {
+		return obj, nil, nil
+	}
+	f, err := os.Open(st.file(bucket, name, objDataExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	return obj, f, nil
+}
+
+// finish completes the upload id of the object, which must have been
+// started with a chunk.
+func (st *objectStore) finish(id, bucket, name string) (*ObjectInfo, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := st.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	key := objUploadKey(id, bucket, name)
+	up := st.uploads[key]
+	if up == nil {
+		return nil, errObjUploadNotFound
+	}
+	return st.complete(key, up, b, time.Now())
+}
+
+// abort discards the upload id of the object, if any.
+func (st *objectStore) abort(id, bucket, name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := objUploadKey(id, bucket, name)
+	if up := st.uploads[key]; up != nil {
+		st.discard(key, up)
+	}
+}
+
+// objReader reads the data of a stored object at any position. The file is
+// opened once so that an object replaced meanwhile is not mixed with it.
+// Since an encrypted object is a sequence of records, it is read again from
+// the start to seek backwards.
+type objReader struct {
+	st   *objectStore
+	info *ObjectInfo
+	f    *os.File
+	r    io.Reader
+	// The position of r and the one of the next read.
+	pos int64
+	off int64
+}
+
+func (or *objReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += or.off
+	case io.SeekEnd:
+		offset += or.info.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	or.off = offset
+	return offset, nil
+}
+
+func (or *objReader) Read(p []byte) (int, error) {
+	if or.off != or.pos {
+		if or.st.cipher == nil {
+			if _, err := or.f.Seek(or.off, io.SeekStart); err != nil {
+				return 0, err
+			}
+			or.pos = or.off
+		} else {
+			if or.off < or.pos {
+				if _, err := or.f.Seek(0, io.SeekStart); err != nil {
+					return 0, err
+				}
+				or.r, or.pos = or.st.dataReader(or.f, or.info, true), 0
+			}
+			n, err := io.CopyN(ioutil.Discard, or.r, or.off-or.pos)
+			or.pos += n
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := or.r.Read(p)
+	or.pos += int64(n)
+	or.off = or.pos
+	return n, err
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func runObjectGatewayServer(t *testing.T, dir, encryption string) (*Server, *nats.Conn) {
+	t.Helper()
+	s, nc := runAccountServer(t, fmt.Sprintf(`
+		http: "127.0.0.1:-1"
+		object_store { store_dir: %q }
+		%s
+		monitor {
+			users: [
+				{user: admin, password: admin}
+				{user: ops, password: ops, endpoints: "/varz"}
+			]
+		}
+	`, dir, encryption), `object_store { max_bytes: 1MB, max_object_size: 512KB }`)
+	if resp := objRequest(t, nc, "$OBJ.API.CREATE.files", nil); resp.Error != _EMPTY_ {
+		t.Fatalf("Error creating bucket: %s", resp.Error)
+	}
+	return s, nc
+}
+
+// Sends a request to the object gateway as the admin user.
+func objHTTPRequest(t *testing.T, s *Server, method, path string, body []byte, hdr map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, path)
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	req.SetBasicAuth("admin", "admin")
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading body: %v", err)
+	}
+	return resp, data
+}
+
+func testObjectGateway(t *testing.T, dir, encryption string) {
+	s, nc := runObjectGatewayServer(t, dir, encryption)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	path := ObjectsPath + "/A/files/big.bin"
+	resp, body := objHTTPRequest(t, s, http.MethodPut, path, data, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %v: %s", resp.StatusCode, body)
+	}
+	var put ObjectStoreResponse
+	if err := json.Unmarshal(body, &put); err != nil || put.Info == nil {
+		t.Fatalf("Unexpected response: %s (%v)", body, err)
+	}
+	if put.Info.Size != int64(len(data)) || put.Info.Chunks != 3 {
+		t.Fatalf("Unexpected object: %+v", put.Info)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag != `"`+put.Info.Digest+`"` {
+		t.Fatalf("Unexpected ETag %q", etag)
+	}
+	// The object stored over HTTP is the same over the API.
+	if got, info := objGet(t, nc, "$OBJ.API.GET.files.big.bin"); !bytes.Equal(got, data) || info.Digest != put.Info.Digest {
+		t.Fatalf("Unexpected object over the API: %+v", info)
+	}
+
+	resp, body = objHTTPRequest(t, s, http.MethodGet, path, nil, nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) || resp.Header.Get("ETag") != etag {
+		t.Fatalf("Unexpected response %v with %d bytes", resp.StatusCode, len(body))
+	}
+	// Ranges, including one spanning chunks.
+	for _, r := range []struct {
+		hdr        string
+		start, end int
+	}{
+		{"bytes=10-19", 10, 20},
+		{"bytes=131000-132000", 131000, 132001},
+		{"bytes=-100", len(data) - 100, len(data)},
+		{"bytes=5-9", 5, 10},
+	} {
+		resp, body = objHTTPRequest(t, s, http.MethodGet, path, nil, map[string]string{"Range": r.hdr})
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[r.start:r.end]) {
+			t.Fatalf("Unexpected response %v to range %q with %d bytes", resp.StatusCode, r.hdr, len(body))
+		}
+	}
+	// The ranges of a multipart response are read backwards.
+	resp, body = objHTTPRequest(t, s, http.MethodGet, path, nil, map[string]string{"Range": "bytes=200000-200009,3-7"})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Contains(body, data[200000:200010]) ||
+		!bytes.Contains(body, data[3:8]) || bytes.Index(body, data[200000:200010]) > bytes.Index(body, data[3:8]) {
+		t.Fatalf("Unexpected response %v to the ranges: %q", resp.StatusCode, body)
+	}
+	resp, _ = objHTTPRequest(t, s, http.MethodGet, path, nil, map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expected not modified, got %v", resp.StatusCode)
+	}
+	resp, _ = objHTTPRequest(t, s, http.MethodGet, path, nil, map[string]string{"If-Match": `"other"`})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Expected precondition failed, got %v", resp.StatusCode)
+	}
+	// A range with a stale ETag returns the whole object.
+	resp, body = objHTTPRequest(t, s, http.MethodGet, path, nil, map[string]string{"Range": "bytes=0-9", "If-Range": `"other"`})
+	if resp.StatusCode != http.StatusOK || len(body) != len(data) {
+		t.Fatalf("Unexpected response %v with %d bytes", resp.StatusCode, len(body))
+	}
+
+	// Multipart upload, replacing the object.
+	parts := [][]byte{data[:1000], data[1000:200000], data[200000:]}
+	for i, part := range parts {
+		p := path + "?upload=u1"
+		status := http.StatusAccepted
+		if i == len(parts)-1 {
+			p, status = p+"&complete=true", http.StatusOK
+		}
+		resp, body = objHTTPRequest(t, s, http.MethodPut, p, part, nil)
+		if resp.StatusCode != status {
+			t.Fatalf("Unexpected status %v for part %d: %s", resp.StatusCode, i, body)
+		}
+	}
+	if resp.Header.Get("ETag") != etag {
+		t.Fatalf("Expected the same ETag for the same content, got %q", resp.Header.Get("ETag"))
+	}
+	if st := s.Storez(nil).ObjectStores[0]; st.Objects != 1 || st.Bytes != int64(len(data)) || st.Uploads != 0 {
+		t.Fatalf("Unexpected object store: %+v", st)
+	}
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   []byte
+		status int
+	}{
+		{http.MethodGet, ObjectsPath + "/A/files/missing", nil, http.StatusNotFound},
+		{http.MethodGet, ObjectsPath + "/A/other/big.bin", nil, http.StatusNotFound},
+		{http.MethodGet, ObjectsPath + "/B/files/big.bin", nil, http.StatusNotFound},
+		{http.MethodGet, ObjectsPath + "/A/files", nil, http.StatusNotFound},
+		{http.MethodDelete, path, nil, http.StatusMethodNotAllowed},
+		{http.MethodPut, path + "?upload=u2&complete=true", nil, http.StatusNotFound},
+		{http.MethodPut, path + "?upload=../u2", nil, http.StatusBadRequest},
+		{http.MethodPut, ObjectsPath + "/A/files/too.big", make([]byte, 600*1024), http.StatusBadRequest},
+	} {
+		resp, body = objHTTPRequest(t, s, test.method, test.path, test.body, nil)
+		if resp.StatusCode != test.status {
+			t.Fatalf("Expected status %v for %s %s, got %v: %s", test.status, test.method, test.path, resp.StatusCode, body)
+		}
+	}
+	if st := s.Storez(nil).ObjectStores[0]; st.Uploads != 0 || st.Pending != 0 {
+		t.Fatalf("Expected the failed uploads to be discarded: %+v", st)
+	}
+}
+
+func TestObjectGateway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objgw")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	t.Run("memory", func(t *testing.T) { testObjectGateway(t, _EMPTY_, _EMPTY_) })
+	t.Run("file", func(t *testing.T) { testObjectGateway(t, filepath.Join(dir, "plain"), _EMPTY_) })
+	t.Run("encrypted", func(t *testing.T) {
+		testObjectGateway(t, filepath.Join(dir, "encrypted"), fmt.Sprintf("store_encryption: %q", testStoreKey(1)))
+	})
+}
+
+func TestObjectGatewayRequiresMonitorAuth(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: "127.0.0.1:-1"
+		accounts { A { object_store: true } }
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s/A/files/a", s.MonitorAddr().Port, ObjectsPath)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the gateway to be disabled, got %v", resp.StatusCode)
+	}
+
+	// And the monitoring users must be allowed on it.
+	dir, err := ioutil.TempDir("", "objgw")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s2, nc := runObjectGatewayServer(t, dir, _EMPTY_)
+	defer s2.Shutdown()
+	defer nc.Close()
+	url = fmt.Sprintf("http://127.0.0.1:%d%s/A/files/a", s2.MonitorAddr().Port, ObjectsPath)
+	for user, status := range map[string]int{"ops": http.StatusForbidden, "admin": http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.SetBasicAuth(user, user)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("Expected status %v for %q, got %v", status, user, resp.StatusCode)
+		}
+	}
+}
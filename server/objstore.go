@@ -0,0 +1,780 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of the subjects of the object store API, followed by the
+	// operation, the bucket and, for the operations on an object, the
+	// object name.
+	objAPIPrefix = "$OBJ.API."
+
+	objOpCreate  = "CREATE"
+	objOpDestroy = "DESTROY"
+	objOpList    = "LIST"
+	objOpPut     = "PUT"
+	objOpGet     = "GET"
+	objOpInfo    = "INFO"
+	objOpDel     = "DEL"
+	// The responses to the flow control requests of the deliveries,
+	// followed by the id of the delivery.
+	objOpFlow = "FC"
+
+	// Size of the chunks in which the objects are delivered.
+	objChunkSize = 128 * 1024
+
+	// Uploads without a new chunk for that long are discarded.
+	objUploadTimeout = 2 * time.Minute
+
+	// Extensions of the files of a stored object, its information, its
+	// data and the data of an upload in progress.
+	objInfoExt   = ".json"
+	objDataExt   = ".data"
+	objUploadExt = ".upload"
+)
+
+var (
+	errObjBucketExists   = errors.New("bucket already exists")
+	errObjBucketNotFound = errors.New("bucket not found")
+	errObjNotFound       = errors.New("object not found")
+)
+
+// objLimits are the object store limits of an account, a zero value
+// meaning no limit.
+type objLimits struct {
+	maxBuckets    int
+	maxBytes      int64
+	maxObjectSize int64
+}
+
+// ObjectInfo describes a stored object. The object is delivered in Chunks
+// messages of ChunkSize bytes, the last one possibly smaller.
+type ObjectInfo struct {
+	Bucket    string    `json:"bucket"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Chunks    int       `json:"chunks"`
+	ChunkSize int       `json:"chunk_size"`
+	Digest    string    `json:"digest"`
+	Modified  time.Time `json:"modified"`
+}
+
+// ObjectGetRequest is the optional payload of a GET request. With
+// FlowControl, a flow control request is sent after every window of chunks,
+// and the delivery continues once the client published to its reply
+// subject. Meanwhile, an idle heartbeat is sent every IdleHeartbeat. Both
+// have no payload, and a status header for the clients supporting headers.
+type ObjectGetRequest struct {
+	FlowControl   bool          `json:"flow_control,omitempty"`
+	IdleHeartbeat time.Duration `json:"idle_heartbeat,omitempty"`
+}
+
+// ObjectStoreResponse is the response to the object store API requests.
+type ObjectStoreResponse struct {
+	Info    *ObjectInfo   `json:"info,omitempty"`
+	Objects []*ObjectInfo `json:"objects,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// object is a stored object, its data is kept in memory if the store has
+// no directory.
+type object struct {
+	info *ObjectInfo
+	data []byte
+}
+
+// objUpload is an object being uploaded by a client, chunk by chunk.
+type objUpload struct {
+	bucket string
+	name   string
+	size   int64
+	chunks int
+	hash   hash.Hash
+	file   *os.File
+	data   []byte
+	last   time.Time
+}
+
+// objectStore is the object store of an account. The buckets are local to
+// this server and are stored in dir, if set.
+type objectStore struct {
+	mu      sync.Mutex
+	account string
+	limits  objLimits
+	dir     string
+	buckets map[string]map[string]*object
+	uploads map[string]*objUpload
+	bytes   int64
+	pending int64
+	cipher  *storeCipher
+	sub     *subscription
+	// The client of the API subscription, which delivers the objects.
+	deliveries
+}
+
+// configureObjectStores starts the object store of the accounts configured
+// with one, updates the limits of the existing ones and stops the ones of
+// the accounts no longer configured with one.
+func (s *Server) configureObjectStores() {
+	s.mu.Lock()
+	if s.objs == nil {
+		s.objs = make(map[string]*objectStore)
+	}
+	stores := make(map[string]*objectStore, len(s.objs))
+	for name, st := range s.objs {
+		stores[name] = st
+	}
+	s.mu.Unlock()
+
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		limits := acc.objStore
+		acc.mu.RUnlock()
+		st := stores[acc.Name]
+		delete(stores, acc.Name)
+		switch {
+		case limits == nil && st != nil:
+			s.stopObjectStore(acc, st)
+		case limits != nil && st != nil:
+			st.mu.Lock()
+			st.limits = *limits
+			st.mu.Unlock()
+		case limits != nil:
+			if !s.EventsEnabled() {
+				s.Warnf("Object store of account %q requires a system account", acc.Name)
+				return true
+			}
+			if err := s.startObjectStore(acc, *limits); err != nil {
+				s.Errorf("Error starting object store of account %q: %v", acc.Name, err)
+			}
+		}
+		return true
+	})
+	// The accounts that were removed.
+	for _, st := range stores {
+		s.stopObjectStore(nil, st)
+	}
+}
+
+// startObjectStore loads the buckets of the account and subscribes to its
+// API.
+func (s *Server) startObjectStore(acc *Account, limits objLimits) error {
+	st := &objectStore{
+		account: acc.Name,
+		limits:  limits,
+		buckets: make(map[string]map[string]*object),
+		uploads: make(map[string]*objUpload),
+	}
+	st.flowPrefix = objAPIPrefix + objOpFlow + tsep
+	if dir := s.getOpts().ObjectStore.StoreDir; dir != _EMPTY_ {
+		st.dir = filepath.Join(dir, acc.Name)
+		var err error
+		if st.cipher, err = s.storeCipher("objects/" + acc.Name); err != nil {
+			return err
+		}
+		if err := st.load(); err != nil {
+			return err
+		}
+	}
+
+	// The API is only served by this server, so the interest is not
+	// propagated to the other servers.
+	c, sub, err := s.accountSubscribeInternal(acc, objAPIPrefix+">", s.objectStoreRequest(st))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.objs[acc.Name] = st
+	s.mu.Unlock()
+
+	st.mu.Lock()
+	st.client, st.sub = c, sub
+	n := len(st.buckets)
+	st.mu.Unlock()
+	s.Noticef("Object store of account %q started with %d bucket(s)", acc.Name, n)
+	return nil
+}
+
+// stopObjectStore unsubscribes from the API of the account and discards
+// the uploads in progress, the stored objects are kept.
+func (s *Server) stopObjectStore(acc *Account, st *objectStore) {
+	st.mu.Lock()
+	sub := st.sub
+	st.sub = nil
+	for key, up := range st.uploads {
+		st.discard(key, up)
+	}
+	st.mu.Unlock()
+
+	s.mu.Lock()
+	delete(s.objs, st.account)
+	s.mu.Unlock()
+	if sub != nil {
+		s.accountUnsubscribeInternal(acc, st.client, sub)
+	}
+	s.Noticef("Object store of account %q stopped", st.account)
+}
+
+// objectStoreRequest returns the handler of the API requests of the store.
+func (s *Server) objectStoreRequest(st *objectStore) msgHandler {
+	return func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		if c != nil && c.pa.hdr > 0 && c.pa.hdr <= len(msg) {
+			msg = msg[c.pa.hdr:]
+		}
+		tokens := strings.SplitN(strings.TrimPrefix(subject, objAPIPrefix), tsep, 3)
+		op, bucket, name := tokens[0], _EMPTY_, _EMPTY_
+		if len(tokens) > 1 {
+			bucket = tokens[1]
+		}
+		if len(tokens) > 2 {
+			name = tokens[2]
+		}
+		acc, err := s.LookupAccount(st.account)
+		if err != nil {
+			return
+		}
+
+		resp := &ObjectStoreResponse{}
+		switch op {
+		case objOpFlow:
+			st.resumeFlow(bucket)
+			return
+		case objOpCreate:
+			err = st.createBucket(bucket)
+		case objOpDestroy:
+			err = st.destroyBucket(bucket)
+		case objOpList:
+			resp.Objects, err = st.list(bucket)
+		case objOpPut:
+			var cid uint64
+			if c != nil {
+				cid = c.cid
+			}
+			resp.Info, err = st.put(strconv.FormatUint(cid, 10), bucket, name, msg)
+		case objOpInfo:
+			resp.Info, err = st.info(bucket, name)
+		case objOpDel:
+			err = st.delete(bucket, name)
+		case objOpGet:
+			var obj *object
+			req := &ObjectGetRequest{}
+			if obj, err = st.get(bucket, name); err == nil && len(msg) > 0 {
+				err = json.Unmarshal(msg, req)
+			}
+			if err == nil && reply != _EMPTY_ {
+				// The chunks may be large, deliver them from a go routine.
+				s.startGoRoutine(func() {
+					defer s.grWG.Done()
+					st.deliver(acc, reply, obj, req)
+				})
+				return
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", op)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if reply != _EMPTY_ {
+			s.sendInternalAccountMsg(acc, reply, resp)
+		}
+	}
+}
+
+// deliver sends the information of the object and then its chunks to the
+// reply subject, waiting for the client between the windows of chunks if
+// the request asks for flow control.
+func (st *objectStore) deliver(acc *Account, reply string, obj *object, req *ObjectGetRequest) {
+	b, _ := json.Marshal(&ObjectStoreResponse{Info: obj.info})
+	st.publish(acc, reply, _EMPTY_, nil, b)
+
+	var id string
+	var resume chan struct{}
+	if req.FlowControl {
+		id, resume = st.startFlow()
+		defer st.endFlow(id)
+	}
+	var sent int
+	send := func(chunk []byte) bool {
+		st.publish(acc, reply, _EMPTY_, nil, chunk)
+		if sent++; resume == nil || sent%flowWindow != 0 || sent == obj.info.Chunks {
+			return true
+		}
+		return st.waitFlow(acc, reply, id, resume, req.IdleHeartbeat)
+	}
+
+	data := obj.data
+	if data == nil && obj.info.Size > 0 {
+		f, err := os.Open(st.file(obj.info.Bucket, obj.info.Name, objDataExt))
+		if err != nil {
+			st.client.Errorf("Error reading object %q of bucket %q: %v", obj.info.Name, obj.info.Bucket, err)
+			return
+		}
+		defer f.Close()
+		r := st.dataReader(f, obj.info, st.cipher != nil)
+		buf := make([]byte, obj.info.ChunkSize)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 && !send(buf[:n]) {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	for len(data) > 0 {
+		n := obj.info.ChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if !send(data[:n]) {
+			return
+		}
+		data = data[n:]
+	}
+}
+
+// objRecordReader reads the data of an encrypted object, stored as records
+// of the chunks of its upload.
+type objRecordReader struct {
+	sc    *storeCipher
+	entry string
+	r     io.Reader
+	buf   []byte
+}
+
+func (rr *objRecordReader) Read(p []byte) (int, error) {
+	for len(rr.buf) == 0 {
+		rec, err := rr.sc.readRecord(rr.entry, rr.r)
+		if err != nil {
+			return 0, err
+		}
+		rr.buf = rec
+	}
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
+
+// Returns a reader of the data of an object stored in r, encrypted or not.
+func (st *objectStore) dataReader(r io.Reader, info *ObjectInfo, sealed bool) io.Reader {
+	if !sealed {
+		return r
+	}
+	return &objRecordReader{sc: st.cipher, entry: objEntry(info.Bucket, info.Name, objDataExt), r: bufio.NewReader(r)}
+}
+
+// Writes the information of an object, synced to disk.
+func (st *objectStore) storeInfo(info *ObjectInfo) error {
+	data, _ := json.Marshal(info)
+	data, err := st.cipher.seal(objEntry(info.Bucket, info.Name, objInfoExt), data)
+	if err != nil {
+		return err
+	}
+	file := st.file(info.Bucket, info.Name, objInfoExt)
+	tmp := file + ".tmp"
+	err = writeFileSync(tmp, data, 0640)
+	if err == nil {
+		err = renameSync(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// reseal encrypts again, with the current key, an object stored without
+// encryption or with a previous key.
+func (st *objectStore) reseal(info *ObjectInfo, sealed bool) error {
+	file := st.file(info.Bucket, info.Name, objDataExt)
+	tmp := file + ".tmp"
+	in, err := os.Open(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.Create(tmp)
+	if err != nil {
+		if in != nil {
+			in.Close()
+		}
+		return err
+	}
+	if in != nil {
+		r := st.dataReader(in, info, sealed)
+		entry := objEntry(info.Bucket, info.Name, objDataExt)
+		buf := make([]byte, objChunkSize)
+		for err == nil {
+			var n int
+			n, err = io.ReadFull(r, buf)
+			if n > 0 {
+				rec, serr := st.cipher.sealRecord(entry, buf[:n])
+				if serr == nil {
+					_, serr = out.Write(rec)
+				}
+				if serr != nil {
+					err = serr
+					break
+				}
+			}
+		}
+		in.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = renameSync(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return st.storeInfo(info)
+}
+
+// Returns the file of an object with the given extension. The name of the
+// object is hex encoded since it can contain any character valid in a
+// subject.
+func (st *objectStore) file(bucket, name, ext string) string {
+	return filepath.Join(st.dir, objEntry(bucket, name, ext))
+}
+
+// Returns the name of the file of an object relative to the store
+// directory, to which its encrypted data is bound.
+func objEntry(bucket, name, ext string) string {
+	return bucket + "/" + hex.EncodeToString([]byte(name)) + ext
+}
+
+// Returns the objects of the bucket, lock should be held.
+func (st *objectStore) bucket(name string) (map[string]*object, error) {
+	b := st.buckets[name]
+	if b == nil {
+		return nil, errObjBucketNotFound
+	}
+	return b, nil
+}
+
+func (st *objectStore) createBucket(name string) error {
+	if !kvValidBucket.MatchString(name) {
+		return fmt.Errorf("invalid bucket name %q", name)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.buckets[name] != nil {
+		return errObjBucketExists
+	}
+	if st.limits.maxBuckets > 0 && len(st.buckets) >= st.limits.maxBuckets {
+		return fmt.Errorf("maximum of %d buckets reached", st.limits.maxBuckets)
+	}
+	if st.dir != _EMPTY_ {
+		if err := os.MkdirAll(filepath.Join(st.dir, name), 0750); err != nil {
+			return fmt.Errorf("unable to store the bucket: %v", err)
+		}
+	}
+	st.buckets[name] = make(map[string]*object)
+	return nil
+}
+
+func (st *objectStore) destroyBucket(name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := st.bucket(name)
+	if err != nil {
+		return err
+	}
+	if st.dir != _EMPTY_ {
+		if err := os.RemoveAll(filepath.Join(st.dir, name)); err != nil {
+			return fmt.Errorf("unable to remove the bucket: %v", err)
+		}
+	}
+	for _, obj := range b {
+		st.bytes -= obj.info.Size
+	}
+	for key, up := range st.uploads {
+		if up.bucket == name {
+			st.discard(key, up)
+		}
+	}
+	delete(st.buckets, name)
+	return nil
+}
+
+// list returns the objects of the bucket, sorted by name.
+func (st *objectStore) list(bucket string) ([]*ObjectInfo, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := st.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*ObjectInfo, 0, len(b))
+	for _, obj := range b {
+		infos = append(infos, obj.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (st *objectStore) get(bucket, name string) (*object, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := st.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	obj := b[name]
+	if obj == nil {
+		return nil, errObjNotFound
+	}
+	return obj, nil
+}
+
+func (st *objectStore) info(bucket, name string) (*ObjectInfo, error) {
+	obj, err := st.get(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.info, nil
+}
+
+func (st *objectStore) delete(bucket, name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := st.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	obj := b[name]
+	if obj == nil {
+		return errObjNotFound
+	}
+	if st.dir != _EMPTY_ {
+		if err := os.Remove(st.file(bucket, name, objInfoExt)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove the object: %v", err)
+		}
+		os.Remove(st.file(bucket, name, objDataExt))
+	}
+	st.bytes -= obj.info.Size
+	delete(b, name)
+	return nil
+}
+
+// put adds a chunk to the upload of the object identified by id, the
+// client id for the uploads over the API. An empty chunk completes the
+// upload, and the information of the stored object is returned.
+func (st *objectStore) put(id, bucket, name string, chunk []byte) (*ObjectInfo, error) {
+	if !IsValidLiteralSubject(name) {
+		return nil, fmt.Errorf("invalid object name %q", name)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	b, err := st.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	key := objUploadKey(id, bucket, name)
+	up := st.uploads[key]
+	if up == nil {
+		st.expireUploads(now)
+		up = &objUpload{bucket: bucket, name: name, hash: sha256.New()}
+		if st.dir != _EMPTY_ {
+			up.file, err = os.Create(st.file(bucket, name, "."+id+objUploadExt))
+			if err != nil {
+				return nil, fmt.Errorf("unable to store the object: %v", err)
+			}
+		}
+		st.uploads[key] = up
+	}
+	up.last = now
+
+	if len(chunk) > 0 {
+		size := int64(len(chunk))
+		if max := st.limits.maxObjectSize; max > 0 && up.size+size > max {
+			st.discard(key, up)
+			return nil, fmt.Errorf("object size exceeds the maximum of %d bytes", max)
+		}
+		if max := st.limits.maxBytes; max > 0 && st.bytes+st.pending+size > max {
+			st.discard(key, up)
+			return nil, fmt.Errorf("maximum of %d bytes reached", max)
+		}
+		if up.file != nil {
+			data := chunk
+			if st.cipher != nil {
+				data, err = st.cipher.sealRecord(objEntry(bucket, name, objDataExt), chunk)
+			}
+			if err == nil {
+				_, err = up.file.Write(data)
+			}
+			if err != nil {
+				st.discard(key, up)
+				return nil, fmt.Errorf("unable to store the object: %v", err)
+			}
+		} else {
+			up.data = append(up.data, chunk...)
+		}
+		up.hash.Write(chunk)
+		up.size += size
+		up.chunks++
+		st.pending += size
+		return nil, nil
+	}
+	return st.complete(key, up, b, now)
+}
+
+// Completes an upload and stores the object, lock should be held.
+func (st *objectStore) complete(key string, up *objUpload, b map[string]*object, now time.Time) (*ObjectInfo, error) {
+	bucket, name := up.bucket, up.name
+	delete(st.uploads, key)
+	st.pending -= up.size
+	info := &ObjectInfo{
+		Bucket:    bucket,
+		Name:      name,
+		Size:      up.size,
+		Chunks:    int((up.size + objChunkSize - 1) / objChunkSize),
+		ChunkSize: objChunkSize,
+		Digest:    "SHA-256=" + base64.URLEncoding.EncodeToString(up.hash.Sum(nil)),
+		Modified:  now.UTC(),
+	}
+	obj := &object{info: info, data: up.data}
+	if up.file != nil {
+		tmp := up.file.Name()
+		err := up.file.Sync()
+		if cerr := up.file.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = renameSync(tmp, st.file(bucket, name, objDataExt))
+		}
+		if err == nil {
+			err = st.storeInfo(info)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return nil, fmt.Errorf("unable to store the object: %v", err)
+		}
+	}
+	if old := b[name]; old != nil {
+		st.bytes -= old.info.Size
+	}
+	b[name] = obj
+	st.bytes += info.Size
+	return info, nil
+}
+
+// Returns the key of an upload in progress.
+func objUploadKey(id, bucket, name string) string {
+	return id + " " + bucket + " " + name
+}
+
+// Discards an upload, lock should be held.
+func (st *objectStore) discard(key string, up *objUpload) {
+	if up.file != nil {
+		up.file.Close()
+		os.Remove(up.file.Name())
+	}
+	st.pending -= up.size
+	delete(st.uploads, key)
+}
+
+// Discards the uploads without a chunk for too long, lock should be held.
+func (st *objectStore) expireUploads(now time.Time) {
+	for key, up := range st.uploads {
+		if now.Sub(up.last) > objUploadTimeout {
+			st.discard(key, up)
+		}
+	}
+}
+
+// load reads the information of the stored objects and removes the
+// uploads that were not completed. The objects stored without encryption
+// or with a previous key are encrypted again.
+func (st *objectStore) load() error {
+	if err := os.MkdirAll(st.dir, 0750); err != nil {
+		return err
+	}
+	dirs, err := ioutil.ReadDir(st.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range dirs {
+		if !fi.IsDir() {
+			continue
+		}
+		bucket := fi.Name()
+		b := make(map[string]*object)
+		files, err := ioutil.ReadDir(filepath.Join(st.dir, bucket))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			file := filepath.Join(st.dir, bucket, f.Name())
+			switch filepath.Ext(f.Name()) {
+			case objUploadExt:
+				os.Remove(file)
+			case objInfoExt:
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				sealed := bytes.HasPrefix(data, []byte(storeSealedMagic))
+				data, stale, err := st.cipher.open(bucket+"/"+f.Name(), data)
+				if err != nil {
+					return fmt.Errorf("object %q: %v", file, err)
+				}
+				info := &ObjectInfo{}
+				if err := json.Unmarshal(data, info); err != nil {
+					return fmt.Errorf("invalid object %q: %v", file, err)
+				}
+				if stale {
+					if err := st.reseal(info, sealed); err != nil {
+						return fmt.Errorf("unable to encrypt object %q: %v", file, err)
+					}
+				}
+				b[info.Name] = &object{info: info}
+				st.bytes += info.Size
+			}
+		}
+		st.buckets[bucket] = b
+	}
+	return nil
+}
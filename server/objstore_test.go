@@ -0,0 +1,255 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestObjectStoreConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		object_store: "/tmp/objs"
+		accounts {
+			A { object_store: true }
+			B { object_store { max_buckets: 2, max_bytes: 1MB, max_object_size: 512KB } }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.ObjectStore.StoreDir != "/tmp/objs" {
+		t.Fatalf("Unexpected store dir %q", opts.ObjectStore.StoreDir)
+	}
+	for _, acc := range opts.Accounts {
+		l := acc.objStore
+		switch {
+		case acc.Name == "A" && l != nil && *l == objLimits{}:
+		case acc.Name == "B" && l != nil && *l == objLimits{2, 1024 * 1024, 512 * 1024}:
+		default:
+			t.Fatalf("Unexpected object store limits for %q: %+v", acc.Name, l)
+		}
+	}
+
+	conf = createConfFile(t, []byte(`accounts { A { object_store { max_bytes: -1 } } }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected an error for negative limits")
+	}
+}
+
+func runObjectStoreServer(t *testing.T, dir string) (*Server, *nats.Conn) {
+	t.Helper()
+	return runAccountServer(t, fmt.Sprintf(`object_store { store_dir: %q }`, dir),
+		`object_store { max_buckets: 1, max_bytes: 1MB, max_object_size: 512KB }`)
+}
+
+func objRequest(t *testing.T, nc *nats.Conn, subject string, data []byte) *ObjectStoreResponse {
+	t.Helper()
+	var resp ObjectStoreResponse
+	apiRequest(t, nc, subject, data, &resp)
+	return &resp
+}
+
+// Uploads the data in chunks of the given size and returns the response
+// to the last, empty, chunk.
+func objPut(t *testing.T, nc *nats.Conn, subject string, data []byte, size int) *ObjectStoreResponse {
+	t.Helper()
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if resp := objRequest(t, nc, subject, data[:n]); resp.Error != _EMPTY_ {
+			return resp
+		}
+		data = data[n:]
+	}
+	return objRequest(t, nc, subject, nil)
+}
+
+// Downloads the object, checking its information.
+func objGet(t *testing.T, nc *nats.Conn, subject string) ([]byte, *ObjectInfo) {
+	t.Helper()
+	inbox := nats.NewInbox()
+	sub := natsSubSync(t, nc, inbox)
+	defer sub.Unsubscribe()
+	natsPubReq(t, nc, subject, inbox, nil)
+	var resp ObjectStoreResponse
+	if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &resp); err != nil || resp.Info == nil {
+		t.Fatalf("Unexpected response: %+v (%v)", resp, err)
+	}
+	var data []byte
+	for i := 0; i < resp.Info.Chunks; i++ {
+		data = append(data, natsNexMsg(t, sub, time.Second).Data...)
+	}
+	return data, resp.Info
+}
+
+func testObjectStore(t *testing.T, dir string) {
+	s, nc := runObjectStoreServer(t, dir)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	if resp := objRequest(t, nc, "$OBJ.API.CREATE.files", nil); resp.Error != _EMPTY_ {
+		t.Fatalf("Error creating bucket: %s", resp.Error)
+	}
+	for _, test := range []struct{ subject, err string }{
+		{"$OBJ.API.CREATE.files", "bucket already exists"},
+		{"$OBJ.API.CREATE.other", "maximum of 1 buckets"},
+		{"$OBJ.API.PUT.none.obj", "bucket not found"},
+		{"$OBJ.API.INFO.files.obj", "object not found"},
+		{"$OBJ.API.GET.files.obj", "object not found"},
+		{"$OBJ.API.DEL.files.obj", "object not found"},
+	} {
+		if resp := objRequest(t, nc, test.subject, []byte("x")); !strings.Contains(resp.Error, test.err) {
+			t.Fatalf("Expected error %q for %q, got %+v", test.err, test.subject, resp)
+		}
+	}
+
+	blob := make([]byte, 300*1024)
+	rand.Read(blob)
+	resp := objPut(t, nc, "$OBJ.API.PUT.files.blob.bin", blob, 100*1024)
+	sum := sha256.Sum256(blob)
+	info := resp.Info
+	if resp.Error != _EMPTY_ || info == nil || info.Size != int64(len(blob)) || info.Chunks != 3 ||
+		info.Digest != "SHA-256="+base64.URLEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if data, _ := objGet(t, nc, "$OBJ.API.GET.files.blob.bin"); !bytes.Equal(data, blob) {
+		t.Fatalf("Unexpected data of %d bytes", len(data))
+	}
+
+	// The quotas are enforced during the upload.
+	if resp := objPut(t, nc, "$OBJ.API.PUT.files.large", make([]byte, 600*1024), 100*1024); !strings.Contains(resp.Error, "exceeds the maximum") {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := objPut(t, nc, "$OBJ.API.PUT.files.more", make([]byte, 500*1024), 100*1024); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := objPut(t, nc, "$OBJ.API.PUT.files.full", make([]byte, 300*1024), 100*1024); !strings.Contains(resp.Error, "maximum of 1048576 bytes") {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := objRequest(t, nc, "$OBJ.API.LIST.files", nil); len(resp.Objects) != 2 || resp.Objects[0].Name != "blob.bin" {
+		t.Fatalf("Unexpected objects: %+v", resp)
+	}
+	if resp := objRequest(t, nc, "$OBJ.API.DEL.files.more", nil); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if dir == _EMPTY_ {
+		return
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// The objects are loaded by the restarted server.
+	s, nc = runObjectStoreServer(t, dir)
+	defer s.Shutdown()
+	defer nc.Close()
+	if resp := objRequest(t, nc, "$OBJ.API.LIST.files", nil); len(resp.Objects) != 1 {
+		t.Fatalf("Unexpected objects: %+v", resp)
+	}
+	if data, got := objGet(t, nc, "$OBJ.API.GET.files.blob.bin"); !bytes.Equal(data, blob) || got.Digest != info.Digest {
+		t.Fatalf("Unexpected object %+v of %d bytes", got, len(data))
+	}
+}
+
+func TestObjectStore(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testObjectStore(t, _EMPTY_) })
+	t.Run("file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "objs")
+		if err != nil {
+			t.Fatalf("Error creating dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		testObjectStore(t, dir)
+	})
+}
+
+func TestObjectStoreFlowControl(t *testing.T) {
+	fw, st := flowWindow, flowStallTimeout
+	flowWindow, flowStallTimeout = 1, 300*time.Millisecond
+	defer func() { flowWindow, flowStallTimeout = fw, st }()
+
+	s, nc := runObjectStoreServer(t, _EMPTY_)
+	defer s.Shutdown()
+	defer nc.Close()
+	objRequest(t, nc, "$OBJ.API.CREATE.files", nil)
+	blob := make([]byte, 300*1024)
+	rand.Read(blob)
+	if resp := objPut(t, nc, "$OBJ.API.PUT.files.blob", blob, 100*1024); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	get := func(req string) *nats.Subscription {
+		t.Helper()
+		inbox := nats.NewInbox()
+		sub := natsSubSync(t, nc, inbox)
+		natsPubReq(t, nc, "$OBJ.API.GET.files.blob", inbox, []byte(req))
+		if msg := natsNexMsg(t, sub, time.Second); !strings.Contains(string(msg.Data), `"info"`) {
+			t.Fatalf("Unexpected response: %q", msg.Data)
+		}
+		return sub
+	}
+	// The flow control requests and heartbeats have no payload for the
+	// clients not supporting headers.
+	sub := get(`{"flow_control": true, "idle_heartbeat": 50000000}`)
+	var data []byte
+	for i := 0; i < 3; i++ {
+		// Skip the heartbeats sent before the response was processed.
+		msg := natsNexMsg(t, sub, time.Second)
+		for len(msg.Data) == 0 && msg.Reply == _EMPTY_ {
+			msg = natsNexMsg(t, sub, time.Second)
+		}
+		data = append(data, msg.Data...)
+		// No flow control request after the last chunk.
+		if i == 2 {
+			break
+		}
+		fc := natsNexMsg(t, sub, time.Second)
+		if len(fc.Data) != 0 || !strings.HasPrefix(fc.Reply, "$OBJ.API.FC.") {
+			t.Fatalf("Expected a flow control request, got %+v", fc)
+		}
+		if hb := natsNexMsg(t, sub, time.Second); len(hb.Data) != 0 || hb.Reply != _EMPTY_ {
+			t.Fatalf("Expected a heartbeat, got %+v", hb)
+		}
+		natsPub(t, nc, fc.Reply, nil)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Fatalf("Unexpected data of %d bytes", len(data))
+	}
+
+	// The delivery is stopped when the client stalls.
+	sub = get(`{"flow_control": true}`)
+	natsNexMsg(t, sub, time.Second)
+	fc := natsNexMsg(t, sub, time.Second)
+	time.Sleep(2 * flowStallTimeout)
+	natsPub(t, nc, fc.Reply, nil)
+	if msg, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message after the stall: %+v", msg)
+	}
+}
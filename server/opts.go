@@ -17,9 +17,11 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/url"
@@ -55,19 +57,44 @@ func NoErrOnUnknownFields(noError bool) {
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
 type ClusterOpts struct {
-	Host           string            `json:"addr,omitempty"`
-	Port           int               `json:"cluster_port,omitempty"`
-	Username       string            `json:"-"`
-	Password       string            `json:"-"`
-	AuthTimeout    float64           `json:"auth_timeout,omitempty"`
-	Permissions    *RoutePermissions `json:"-"`
-	TLSTimeout     float64           `json:"-"`
-	TLSConfig      *tls.Config       `json:"-"`
-	TLSMap         bool              `json:"-"`
-	ListenStr      string            `json:"-"`
-	Advertise      string            `json:"-"`
-	NoAdvertise    bool              `json:"-"`
-	ConnectRetries int               `json:"-"`
+	Name              string              `json:"-"`
+	Host              string              `json:"addr,omitempty"`
+	HostV6            string              `json:"-"`
+	Port              int                 `json:"cluster_port,omitempty"`
+	Username          string              `json:"-"`
+	Password          string              `json:"-" secret:"true"`
+	AuthTimeout       float64             `json:"auth_timeout,omitempty"`
+	Permissions       *RoutePermissions   `json:"-"`
+	TLSTimeout        float64             `json:"-"`
+	TLSConfig         *tls.Config         `json:"-"`
+	TLSMap            bool                `json:"-"`
+	ListenStr         string              `json:"-"`
+	Advertise         string              `json:"-"`
+	NoAdvertise       bool                `json:"-"`
+	ConnectRetries    int                 `json:"-"`
+	Flush             FlushOpts           `json:"-"`
+	Compression       string              `json:"-"`
+	PreferFamily      string              `json:"-"`
+	Proxy             string              `json:"-"`
+	Discovery         RouteDiscovery      `json:"-"`
+	DiscoveryInterval time.Duration       `json:"-"`
+	Retry             RetryPolicy         `json:"-"`
+	Networks          *NetworkACL         `json:"-"`
+	AcceptRate        *AcceptRateOpts     `json:"-"`
+	SubjectOwners     []*SubjectOwnership `json:"-"`
+	Remotes           []*RemoteRouteOpts  `json:"-"`
+	PingInterval      time.Duration       `json:"-"`
+	MaxPingsOut       int                 `json:"-"`
+}
+
+// RemoteRouteOpts are options for an explicit route that needs TLS
+// settings different from the cluster's tls block, for instance a
+// distinct client certificate, CA or SNI name.
+type RemoteRouteOpts struct {
+	URL        *url.URL    `json:"url,omitempty"`
+	TLSConfig  *tls.Config `json:"-"`
+	TLSTimeout float64     `json:"tls_timeout,omitempty"`
+	ServerName string      `json:"server_name,omitempty"`
 }
 
 // GatewayOpts are options for gateways.
@@ -76,9 +103,10 @@ type ClusterOpts struct {
 type GatewayOpts struct {
 	Name           string               `json:"name"`
 	Host           string               `json:"addr,omitempty"`
+	HostV6         string               `json:"-"`
 	Port           int                  `json:"port,omitempty"`
 	Username       string               `json:"-"`
-	Password       string               `json:"-"`
+	Password       string               `json:"-" secret:"true"`
 	AuthTimeout    float64              `json:"auth_timeout,omitempty"`
 	TLSConfig      *tls.Config          `json:"-"`
 	TLSTimeout     float64              `json:"tls_timeout,omitempty"`
@@ -87,6 +115,11 @@ type GatewayOpts struct {
 	ConnectRetries int                  `json:"connect_retries,omitempty"`
 	Gateways       []*RemoteGatewayOpts `json:"gateways,omitempty"`
 	RejectUnknown  bool                 `json:"reject_unknown,omitempty"`
+	Flush          FlushOpts            `json:"-"`
+	Networks       *NetworkACL          `json:"-"`
+	AcceptRate     *AcceptRateOpts      `json:"-"`
+	PingInterval   time.Duration        `json:"-"`
+	MaxPingsOut    int                  `json:"-"`
 
 	// Not exported, for tests.
 	resolver         netResolver
@@ -101,23 +134,31 @@ type RemoteGatewayOpts struct {
 	TLSConfig  *tls.Config `json:"-"`
 	TLSTimeout float64     `json:"tls_timeout,omitempty"`
 	URLs       []*url.URL  `json:"urls,omitempty"`
+	Proxy      string      `json:"-"`
 }
 
 // LeafNodeOpts are options for a given server to accept leaf node connections and/or connect to a remote cluster.
 type LeafNodeOpts struct {
-	Host              string        `json:"addr,omitempty"`
-	Port              int           `json:"port,omitempty"`
-	Username          string        `json:"-"`
-	Password          string        `json:"-"`
-	Account           string        `json:"-"`
-	Users             []*User       `json:"-"`
-	AuthTimeout       float64       `json:"auth_timeout,omitempty"`
-	TLSConfig         *tls.Config   `json:"-"`
-	TLSTimeout        float64       `json:"tls_timeout,omitempty"`
-	TLSMap            bool          `json:"-"`
-	Advertise         string        `json:"-"`
-	NoAdvertise       bool          `json:"-"`
-	ReconnectInterval time.Duration `json:"-"`
+	Host              string          `json:"addr,omitempty"`
+	HostV6            string          `json:"-"`
+	Port              int             `json:"port,omitempty"`
+	Username          string          `json:"-"`
+	Password          string          `json:"-" secret:"true"`
+	Account           string          `json:"-"`
+	Users             []*User         `json:"-"`
+	AuthTimeout       float64         `json:"auth_timeout,omitempty"`
+	TLSConfig         *tls.Config     `json:"-"`
+	TLSTimeout        float64         `json:"tls_timeout,omitempty"`
+	TLSMap            bool            `json:"-"`
+	Advertise         string          `json:"-"`
+	NoAdvertise       bool            `json:"-"`
+	ReconnectInterval time.Duration   `json:"-"`
+	Flush             FlushOpts       `json:"-"`
+	Compression       string          `json:"-"`
+	Networks          *NetworkACL     `json:"-"`
+	AcceptRate        *AcceptRateOpts `json:"-"`
+	PingInterval      time.Duration   `json:"-"`
+	MaxPingsOut       int             `json:"-"`
 
 	// For solicited connections to other clusters/superclusters.
 	Remotes []*RemoteLeafOpts `json:"remotes,omitempty"`
@@ -139,83 +180,410 @@ type RemoteLeafOpts struct {
 	Hub          bool        `json:"hub,omitempty"`
 	DenyImports  []string    `json:"-"`
 	DenyExports  []string    `json:"-"`
+	Compression  string      `json:"-"`
+	Proxy        string      `json:"-"`
+}
+
+// Flush modes for FlushOpts.
+const (
+	// FlushModeLatency writes outbound data as soon as it is available.
+	FlushModeLatency = "latency"
+	// FlushModeThroughput lets outbound data wait up to the flush interval
+	// so that more of it is written at once.
+	FlushModeThroughput = "throughput"
+)
+
+// FlushOpts control how outbound data is coalesced and written to the
+// connections of a listener. Zero values keep the server defaults.
+type FlushOpts struct {
+	Mode          string        `json:"mode,omitempty"`
+	MaxCoalesce   int           `json:"max_coalesce,omitempty"`
+	Interval      time.Duration `json:"interval,omitempty"`
+	WriteDeadline time.Duration `json:"write_deadline,omitempty"`
+}
+
+// UnixSocketOpts are options for the Unix domain socket client listener.
+// Mode, Owner and Group are applied to the socket file so that filesystem
+// permissions control which local processes can connect.
+type UnixSocketOpts struct {
+	Path  string      `json:"path,omitempty"`
+	Mode  os.FileMode `json:"mode,omitempty"`
+	Owner string      `json:"owner,omitempty"`
+	Group string      `json:"group,omitempty"`
+}
+
+// ProfilingOpts are options for profiling a running server. When HTTP is
+// set, the pprof handlers are served under /debug/pprof on the monitoring
+// port and require the Username and Password. Dir is the directory in
+// which the profiles requested through the system account are written,
+// the oldest being removed to keep at most MaxFiles of them.
+type ProfilingOpts struct {
+	HTTP     bool   `json:"http,omitempty"`
+	Username string `json:"-"`
+	Password string `json:"-" secret:"true"`
+	Dir      string `json:"dir,omitempty"`
+	MaxFiles int    `json:"max_files,omitempty"`
+}
+
+// MonitorOpts protects the monitoring port, with basic authentication if
+// Username is set, a bearer Token, the Users allowed on some endpoints only
+// and, on the https port, with client certificates verified by the CAs of
+// the server if Verify is set. PublicListen is an additional listener
+// serving only the health check and a summary of varz, without
+// authentication. CORSOrigins are the origins of the browser based
+// dashboards allowed to request the endpoints, "*" for any.
+type MonitorOpts struct {
+	PublicListen string         `json:"public_listen,omitempty"`
+	Username     string         `json:"-"`
+	Password     string         `json:"-" secret:"true"`
+	Token        string         `json:"-" secret:"true"`
+	Users        []*MonitorUser `json:"-"`
+	Verify       bool           `json:"verify,omitempty"`
+	CORSOrigins  []string       `json:"cors_origins,omitempty"`
+}
+
+// MonitorUser is authenticated on the monitoring port by its user and
+// password, its bearer token or the common name of its client certificate,
+// and is allowed on the Endpoints only, all of them if empty or "*". The
+// endpoints only allow to read, the changes requiring their own endpoint:
+// "/connz/close" to close connections, "/logz/set" to set log levels and
+// "/capturez/start" to start, stop and delete captures. Reading and storing
+// the objects of the object stores requires the "/objects" endpoint.
+type MonitorUser struct {
+	Username   string
+	Password   string `secret:"true"`
+	Token      string `secret:"true"`
+	CommonName string
+	Endpoints  []string
+}
+
+// OpenTelemetryOpts configures the export, to an OTLP/HTTP collector, of
+// spans for the messages that carry a sampled W3C trace context. Sampling
+// is the percentage of those messages that are traced for the accounts
+// not listed in Accounts, which maps account names to their own sampling.
+type OpenTelemetryOpts struct {
+	Endpoint       string         `json:"endpoint,omitempty"`
+	ServiceName    string         `json:"service_name,omitempty"`
+	Sampling       int            `json:"sampling,omitempty"`
+	Accounts       map[string]int `json:"accounts,omitempty"`
+	ExportInterval time.Duration  `json:"export_interval,omitempty"`
+}
+
+// StatsDOpts configures the periodic push of the server metrics to a StatsD
+// server over UDP. Tags are sent in the DogStatsD format.
+type StatsDOpts struct {
+	Endpoint string            `json:"endpoint,omitempty"`
+	Prefix   string            `json:"prefix,omitempty"`
+	Interval time.Duration     `json:"interval,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// WebhookOpts configures the HTTP endpoint to which the client connection
+// events are posted. Events lists the types of events that are posted, all
+// of them if empty. A failed post is retried MaxRetries times, or not at
+// all if negative.
+type WebhookOpts struct {
+	URL           string        `json:"url,omitempty"`
+	Events        []string      `json:"events,omitempty"`
+	BatchSize     int           `json:"batch_size,omitempty"`
+	FlushInterval time.Duration `json:"flush_interval,omitempty"`
+	MaxRetries    int           `json:"max_retries,omitempty"`
+}
+
+// AuthLockoutOpts configures how client connections are slowed down or
+// rejected after repeated authentication failures from the same remote IP
+// or for the same user. Past Threshold failures within Window, the
+// authentication is delayed by Delay, doubled with each further failure up
+// to MaxDelay. Past BanThreshold failures, the IP or user is rejected for
+// BanDuration.
+type AuthLockoutOpts struct {
+	Threshold    int           `json:"threshold,omitempty"`
+	Window       time.Duration `json:"window,omitempty"`
+	Delay        time.Duration `json:"delay,omitempty"`
+	MaxDelay     time.Duration `json:"max_delay,omitempty"`
+	BanThreshold int           `json:"ban_threshold,omitempty"`
+	BanDuration  time.Duration `json:"ban_duration,omitempty"`
+}
+
+// TrafficOpts configures the traffic analytics reported by /trafficz. When
+// enabled, the payload sizes of the messages published by the clients are
+// counted in a histogram per account, and the TopSubjects most published
+// subjects of each account are estimated.
+type TrafficOpts struct {
+	Enabled     bool `json:"enabled,omitempty"`
+	TopSubjects int  `json:"top_subjects,omitempty"`
+}
+
+// DelayedDeliveryOpts enables the delivery of the messages published with
+// a Nats-Delay header, such as "Nats-Delay: 30s", after that delay. The
+// pending messages are stored in StoreDir, if set, and delivered after a
+// restart. MaxDelay and MaxMessages limit the delay and the number of
+// pending messages, if set.
+type DelayedDeliveryOpts struct {
+	Enabled     bool          `json:"enabled,omitempty"`
+	StoreDir    string        `json:"store_dir,omitempty"`
+	MaxDelay    time.Duration `json:"max_delay,omitempty"`
+	MaxMessages int           `json:"max_messages,omitempty"`
+}
+
+// KVOpts configures the key-value stores of the accounts configured with
+// one. The buckets are stored in a directory per account under StoreDir,
+// if set, and loaded after a restart. The retention limits of the buckets
+// are enforced, and their logs compacted, every CompactInterval.
+type KVOpts struct {
+	StoreDir        string        `json:"store_dir,omitempty"`
+	CompactInterval time.Duration `json:"compact_interval,omitempty"`
+}
+
+// ObjectStoreOpts configures the object stores of the accounts configured
+// with one. The objects are stored in a directory per account under
+// StoreDir, if set, or else kept in memory.
+type ObjectStoreOpts struct {
+	StoreDir string `json:"store_dir,omitempty"`
+}
+
+// StreamsOpts configures the streams of the accounts configured with some,
+// possibly none. When the metadata is replicated, more streams can be
+// created through the API of such an account, and are then created on all
+// the servers replicating the metadata. The messages of the streams are stored in a directory per account under
+// StoreDir, if set, or else kept in memory.
+type StreamsOpts struct {
+	StoreDir string `json:"store_dir,omitempty"`
+}
+
+// MetadataOpts configures the replication of the cluster-wide metadata,
+// the contents of the account resolver and the streams and consumers
+// created through the stream API, between the servers named in Peers,
+// which must include this server. The replicated state is stored under
+// StoreDir, if set, so that a restarted server catches up from it.
+type MetadataOpts struct {
+	Peers    []string `json:"peers,omitempty"`
+	StoreDir string   `json:"store_dir,omitempty"`
+}
+
+// StoreEncryptionOpts enables the encryption of the data stored by the
+// server, such as the delayed messages, the key-value and object stores
+// and the replicated metadata. Key is the base64 encoded 32 bytes master
+// key, or a key provider reference such as "env://NATS_STORE_KEY". Each
+// store encrypts with its own key derived from it. The data encrypted
+// with the PreviousKeys is still readable, and is encrypted again with
+// the current key when the store is compacted or loaded. The data stored
+// before the encryption was enabled is rejected, unless AllowPlaintext is
+// set to encrypt it once when migrating existing stores. Cipher may only be
+// "aes", for AES-256-GCM, any other value such as "chacha" being rejected.
+type StoreEncryptionOpts struct {
+	Key            string   `json:"-" secret:"true"`
+	PreviousKeys   []string `json:"-" secret:"true"`
+	Cipher         string   `json:"cipher,omitempty"`
+	AllowPlaintext bool     `json:"allow_plaintext,omitempty"`
+}
+
+// ConnectionEventsOpts enables the connection events, published in the
+// account of each client connection when it connects and disconnects, on
+// Subject followed by the type of the event. They require a system account.
+type ConnectionEventsOpts struct {
+	Subject string `json:"subject,omitempty"`
+}
+
+// QueueGroupOpts configures how the messages are distributed to the members
+// of the queue groups. Policy is "random" (the default), "local" to prefer
+// the members connected to this server over the ones of other servers, or
+// "hash" to always select the same member for a given subject, as long as
+// it stays connected. The hash is not shared between servers: each server
+// selects among its own members and the routes, so the messages of a
+// subject published on different servers may reach different members. With
+// the "local" policy, a local member with more than SpillThreshold bytes
+// pending is skipped. With the "random" policy, the local members are
+// selected LocalWeight times as often as the remote ones.
+type QueueGroupOpts struct {
+	Policy         string `json:"policy,omitempty"`
+	SpillThreshold int64  `json:"spill_threshold,omitempty"`
+	LocalWeight    int    `json:"local_weight,omitempty"`
+}
+
+// ACMEOpts configures an ACME client, such as for Let's Encrypt, that
+// obtains and renews the certificates of the client and monitoring
+// listeners for Domains, caching them in CacheDir. Challenge is either
+// "http-01", answered on HTTPListen, or "tls-alpn-01", answered by the
+// monitoring listener which then needs to be reachable on port 443.
+type ACMEOpts struct {
+	Domains      []string `json:"domains,omitempty"`
+	Email        string   `json:"email,omitempty"`
+	CacheDir     string   `json:"cache_dir,omitempty"`
+	DirectoryURL string   `json:"directory_url,omitempty"`
+	Challenge    string   `json:"challenge,omitempty"`
+	HTTPListen   string   `json:"http_listen,omitempty"`
+	AcceptTOS    bool     `json:"accept_tos,omitempty"`
 }
 
 // Options block for nats-server.
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
 type Options struct {
-	ConfigFile            string        `json:"-"`
-	ServerName            string        `json:"server_name"`
-	Host                  string        `json:"addr"`
-	Port                  int           `json:"port"`
-	ClientAdvertise       string        `json:"-"`
-	Trace                 bool          `json:"-"`
-	Debug                 bool          `json:"-"`
-	TraceVerbose          bool          `json:"-"`
-	NoLog                 bool          `json:"-"`
-	NoSigs                bool          `json:"-"`
-	NoSublistCache        bool          `json:"-"`
-	DisableShortFirstPing bool          `json:"-"`
-	Logtime               bool          `json:"-"`
-	MaxConn               int           `json:"max_connections"`
-	MaxSubs               int           `json:"max_subscriptions,omitempty"`
-	Nkeys                 []*NkeyUser   `json:"-"`
-	Users                 []*User       `json:"-"`
-	Accounts              []*Account    `json:"-"`
-	SystemAccount         string        `json:"-"`
-	AllowNewAccounts      bool          `json:"-"`
-	Username              string        `json:"-"`
-	Password              string        `json:"-"`
-	Authorization         string        `json:"-"`
-	PingInterval          time.Duration `json:"ping_interval"`
-	MaxPingsOut           int           `json:"ping_max"`
-	HTTPHost              string        `json:"http_host"`
-	HTTPPort              int           `json:"http_port"`
-	HTTPSPort             int           `json:"https_port"`
-	AuthTimeout           float64       `json:"auth_timeout"`
-	MaxControlLine        int32         `json:"max_control_line"`
-	MaxPayload            int32         `json:"max_payload"`
-	MaxPending            int64         `json:"max_pending"`
-	Cluster               ClusterOpts   `json:"cluster,omitempty"`
-	Gateway               GatewayOpts   `json:"gateway,omitempty"`
-	LeafNode              LeafNodeOpts  `json:"leaf,omitempty"`
-	ProfPort              int           `json:"-"`
-	PidFile               string        `json:"-"`
-	PortsFileDir          string        `json:"-"`
-	LogFile               string        `json:"-"`
-	LogSizeLimit          int64         `json:"-"`
-	Syslog                bool          `json:"-"`
-	RemoteSyslog          string        `json:"-"`
-	Routes                []*url.URL    `json:"-"`
-	RoutesStr             string        `json:"-"`
-	TLSTimeout            float64       `json:"tls_timeout"`
-	TLS                   bool          `json:"-"`
-	TLSVerify             bool          `json:"-"`
-	TLSMap                bool          `json:"-"`
-	TLSCert               string        `json:"-"`
-	TLSKey                string        `json:"-"`
-	TLSCaCert             string        `json:"-"`
-	TLSConfig             *tls.Config   `json:"-"`
-	WriteDeadline         time.Duration `json:"-"`
-	MaxClosedClients      int           `json:"-"`
-	LameDuckDuration      time.Duration `json:"-"`
+	ConfigFile            string            `json:"-"`
+	ServerName            string            `json:"server_name"`
+	Tags                  map[string]string `json:"-"`
+	ServerKeyFile         string            `json:"-"`
+	TrustedServerKeys     []string          `json:"-"`
+	Host                  string            `json:"addr"`
+	HostV6                string            `json:"-"`
+	Port                  int               `json:"port"`
+	ClientAdvertise       string            `json:"-"`
+	Trace                 bool              `json:"-"`
+	Debug                 bool              `json:"-"`
+	TraceVerbose          bool              `json:"-"`
+	NoLog                 bool              `json:"-"`
+	NoSigs                bool              `json:"-"`
+	NoSublistCache        bool              `json:"-"`
+	LockFreeSublist       bool              `json:"-"`
+	LegacyParser          bool              `json:"-"`
+	DisableShortFirstPing bool              `json:"-"`
+	Logtime               bool              `json:"-"`
+	MaxConn               int               `json:"max_connections"`
+	MaxProcs              int               `json:"-"`
+	AcceptWorkers         int               `json:"-"`
+	RouteAcceptWorkers    int               `json:"-"`
+	MaxTLSHandshakes      int               `json:"-"`
+	MaxSubs               int               `json:"max_subscriptions,omitempty"`
+	Nkeys                 []*NkeyUser       `json:"-"`
+	Users                 []*User           `json:"-"`
+	Accounts              []*Account        `json:"-"`
+	SystemAccount         string            `json:"-"`
+	AllowNewAccounts      bool              `json:"-"`
+	Username              string            `json:"-"`
+	Password              string            `json:"-" secret:"true"`
+	Authorization         string            `json:"-" secret:"true"`
+	PingInterval          time.Duration     `json:"ping_interval"`
+	MaxPingsOut           int               `json:"ping_max"`
+	RTTInterval           time.Duration     `json:"rtt_interval"`
+	HTTPHost              string            `json:"http_host"`
+	HTTPPort              int               `json:"http_port"`
+	HTTPSPort             int               `json:"https_port"`
+	AuthTimeout           float64           `json:"auth_timeout"`
+	MaxControlLine        int32             `json:"max_control_line"`
+	MaxPayload            int32             `json:"max_payload"`
+	MaxPending            int64             `json:"max_pending"`
+	Cluster               ClusterOpts       `json:"cluster,omitempty"`
+	Gateway               GatewayOpts       `json:"gateway,omitempty"`
+	LeafNode              LeafNodeOpts      `json:"leaf,omitempty"`
+	ProfPort              int               `json:"-"`
+	PidFile               string            `json:"-"`
+	PortsFileDir          string            `json:"-"`
+	LogFile               string            `json:"-"`
+	LogSizeLimit          int64             `json:"-"`
+	Syslog                bool              `json:"-"`
+	RemoteSyslog          string            `json:"-"`
+	Routes                []*url.URL        `json:"-"`
+	RoutesStr             string            `json:"-"`
+	TLSTimeout            float64           `json:"tls_timeout"`
+	TLS                   bool              `json:"-"`
+	TLSVerify             bool              `json:"-"`
+	TLSMap                bool              `json:"-"`
+	TLSCert               string            `json:"-"`
+	TLSKey                string            `json:"-"`
+	TLSCaCert             string            `json:"-"`
+	TLSConfig             *tls.Config       `json:"-"`
+	WriteDeadline         time.Duration     `json:"-"`
+	Flush                 FlushOpts         `json:"-"`
+	MaxClosedClients      int               `json:"-"`
+	LameDuckDuration      time.Duration     `json:"-"`
+	OutboundProxy         string            `json:"-"`
+
+	// TLSHandshakeFirst makes the clients start the TLS handshake before
+	// receiving the INFO. Those that did not after the fallback delay, if
+	// set, get the INFO first.
+	TLSHandshakeFirst         bool          `json:"-"`
+	TLSHandshakeFirstFallback time.Duration `json:"-"`
+
+	// ListenUnix is an optional Unix domain socket on which clients
+	// are accepted in addition to the TCP listener.
+	ListenUnix UnixSocketOpts `json:"-"`
+
+	// DontListen disables the TCP listener for clients. Embedding
+	// applications can then only connect through Server.InProcessConn.
+	DontListen bool `json:"-"`
+
 	// MaxTracedMsgLen is the maximum printable length for traced messages.
 	MaxTracedMsgLen int `json:"-"`
 
+	// ClientErrorLogRate is the maximum number of error logs of the
+	// connections per second for each kind of error, 0 for unlimited.
+	ClientErrorLogRate int `json:"-"`
+
+	// ReconnectMinDelay and ReconnectMaxDelay are sent to clients in the
+	// INFO protocol as hints for the range in which they should pick a
+	// random delay before reconnecting, to avoid reconnect storms.
+	ReconnectMinDelay time.Duration `json:"-"`
+	ReconnectMaxDelay time.Duration `json:"-"`
+
+	// NoHeaderSupport disables message headers (HPUB/HMSG) for clients and routes.
+	NoHeaderSupport bool `json:"-"`
+
+	// SelfTest runs diagnostics on startup, SelfTestStrict refuses to
+	// start if any of the checks of the local configuration fail.
+	SelfTest       bool `json:"-"`
+	SelfTestStrict bool `json:"-"`
+
+	// Profiling controls the pprof handlers of the monitoring port and
+	// where the profiles requested through the system account are written.
+	Profiling ProfilingOpts `json:"-"`
+
+	// Monitor controls the authentication of the monitoring port and the
+	// public listener of the health check.
+	Monitor MonitorOpts `json:"-"`
+
+	OpenTelemetry OpenTelemetryOpts `json:"-"`
+
+	StatsD StatsDOpts `json:"-"`
+
+	Webhook WebhookOpts `json:"-"`
+
+	ConnectionEvents ConnectionEventsOpts `json:"-"`
+
+	AuthLockout AuthLockoutOpts `json:"-"`
+
+	Traffic TrafficOpts `json:"-"`
+
+	QueueGroups QueueGroupOpts `json:"-"`
+
+	DelayedDelivery DelayedDeliveryOpts `json:"-"`
+
+	KV KVOpts `json:"-"`
+
+	ObjectStore ObjectStoreOpts `json:"-"`
+
+	Streams StreamsOpts `json:"-"`
+
+	Metadata MetadataOpts `json:"-"`
+
+	StoreEncryption StoreEncryptionOpts `json:"-"`
+
+	ACME ACMEOpts `json:"-"`
+
+	// Networks the client connections are accepted from.
+	Networks *NetworkACL `json:"-"`
+	// Rate of the client connections accepted, unlimited if nil.
+	AcceptRate *AcceptRateOpts `json:"-"`
+
 	// Operating a trusted NATS server
 	TrustedKeys              []string              `json:"-"`
 	TrustedOperators         []*jwt.OperatorClaims `json:"-"`
+	AccountRevocations       map[string]int64      `json:"-"`
 	AccountResolver          AccountResolver       `json:"-"`
 	AccountResolverTLSConfig *tls.Config           `json:"-"`
 	resolverPreloads         map[string]string
 
+	// CustomClientAuthentication and CustomRouterAuthentication replace
+	// the authentication of the clients and routes by the application's.
 	CustomClientAuthentication Authentication `json:"-"`
 	CustomRouterAuthentication Authentication `json:"-"`
 
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
 
+	// PrintConfig prints the fully resolved configuration file when checking it.
+	PrintConfig bool `json:"-"`
+
 	// ConnectErrorReports specifies the number of failed attempts
 	// at which point server should report the failure of an initial
 	// connection to a route, gateway or leaf node.
@@ -234,6 +602,7 @@ type Options struct {
 	// private fields, used for testing
 	gatewaysSolicitDelay time.Duration
 	routeProto           int
+	srvResolver          srvResolver
 }
 
 type netResolver interface {
@@ -270,6 +639,12 @@ func (o *Options) Clone() *Options {
 	if o.Cluster.TLSConfig != nil {
 		clone.Cluster.TLSConfig = o.Cluster.TLSConfig.Clone()
 	}
+	if len(o.Cluster.Remotes) > 0 {
+		clone.Cluster.Remotes = make([]*RemoteRouteOpts, len(o.Cluster.Remotes))
+		for i, r := range o.Cluster.Remotes {
+			clone.Cluster.Remotes[i] = r.clone()
+		}
+	}
 	if o.Gateway.TLSConfig != nil {
 		clone.Gateway.TLSConfig = o.Gateway.TLSConfig.Clone()
 	}
@@ -322,6 +697,12 @@ type TLSConfigOpts struct {
 	Timeout          float64
 	Ciphers          []uint16
 	CurvePreferences []tls.CurveID
+	ReloadInterval   time.Duration
+	MinVersion       uint16
+	MaxVersion       uint16
+	ClientAuth       tls.ClientAuthType
+	HandshakeFirst   bool
+	FallbackDelay    time.Duration
 }
 
 var tlsUsage = `
@@ -335,6 +716,14 @@ e.g.
         ca_file:        "./certs/ca.pem"
         verify:         true
         verify_and_map: true
+        reload_interval: "1m"
+        min_version:    "1.2"
+        max_version:    "1.3"
+        client_auth:    "require_and_verify"
+
+        # Client listener only: expect the TLS handshake before the INFO,
+        # or after a delay for clients still waiting for the INFO.
+        handshake_first: "50ms"
 
         cipher_suites: [
             "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
@@ -350,6 +739,21 @@ e.g.
 Available cipher suites include:
 `
 
+// PrintResolvedConfig writes the configuration file with its includes and
+// variables resolved, in JSON, which is a valid configuration format.
+func PrintResolvedConfig(w io.Writer, configFile string) error {
+	m, err := conf.ParseFile(configFile)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
 // ProcessConfigFile processes a configuration file.
 // FIXME(dlc): A bit hacky
 func ProcessConfigFile(configFile string) (*Options, error) {
@@ -465,6 +869,9 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 	if err != nil {
 		return err
 	}
+	if err := decryptConfigValues(m); err != nil {
+		return err
+	}
 	// Collect all errors and warnings and report them all together.
 	errors := make([]error, 0)
 	warnings := make([]error, 0)
@@ -479,6 +886,19 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 		o.processConfigFileLine(k, v, &errors, &warnings)
 	}
 
+	// Users and nkeys may come from the accounts block, so conflicts
+	// with the top level authorization can only be checked at the end.
+	// Having both a user/pass and token has already been reported.
+	if v, ok := m["authorization"]; ok && (len(o.Users) > 0 || len(o.Nkeys) > 0) &&
+		(o.Authorization == "" || o.Username == "") {
+		tk, _ := unwrapValue(v, nil)
+		if o.Authorization != "" {
+			errors = append(errors, &configErr{tk, "Can not have a token and users or nkeys"})
+		} else if o.Username != "" {
+			errors = append(errors, &configErr{tk, "Can not have a single user/pass and users or nkeys"})
+		}
+	}
+
 	if len(errors) > 0 || len(warnings) > 0 {
 		return &processConfigErr{
 			errors:   errors,
@@ -509,8 +929,47 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.Port = int(v.(int64))
 	case "server_name":
 		o.ServerName = v.(string)
+	case "cluster_name":
+		o.Cluster.Name = v.(string)
+	case "tags":
+		tags, err := parseTags(tk, v)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Tags = tags
+	case "server_key_file", "server_seed_file":
+		o.ServerKeyFile = v.(string)
+	case "trusted_server_keys":
+		switch v := v.(type) {
+		case string:
+			o.TrustedServerKeys = []string{v}
+		case []interface{}:
+			keys := make([]string, 0, len(v))
+			for _, mv := range v {
+				tk, mv = unwrapValue(mv, &lt)
+				if key, ok := mv.(string); ok {
+					keys = append(keys, key)
+				} else {
+					err := &configErr{tk, fmt.Sprintf("error parsing trusted_server_keys: unsupported type in array %T", mv)}
+					*errors = append(*errors, err)
+				}
+			}
+			o.TrustedServerKeys = keys
+		default:
+			err := &configErr{tk, fmt.Sprintf("error parsing trusted_server_keys: unsupported type %T", v)}
+			*errors = append(*errors, err)
+		}
+		for _, key := range o.TrustedServerKeys {
+			if !nkeys.IsValidPublicServerKey(key) {
+				err := &configErr{tk, fmt.Sprintf("trusted server key %q required to be a valid public server nkey", key)}
+				*errors = append(*errors, err)
+			}
+		}
 	case "host", "net":
-		o.Host = v.(string)
+		o.Host = trimIPv6Brackets(v.(string))
+	case "host_v6":
+		o.HostV6 = trimIPv6Brackets(v.(string))
 	case "debug":
 		o.Debug = v.(bool)
 		trackExplicitVal(o, &o.inConfig, "Debug", o.Debug)
@@ -527,6 +986,10 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		trackExplicitVal(o, &o.inConfig, "Logtime", o.Logtime)
 	case "disable_sublist_cache", "no_sublist_cache":
 		o.NoSublistCache = v.(bool)
+	case "lock_free_sublist":
+		o.LockFreeSublist = v.(bool)
+	case "legacy_parser":
+		o.LegacyParser = v.(bool)
 	case "accounts":
 		err := parseAccounts(tk, o, errors, warnings)
 		if err != nil {
@@ -642,16 +1105,30 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.MaxPending = v.(int64)
 	case "max_connections", "max_conn":
 		o.MaxConn = int(v.(int64))
+	case "max_procs":
+		o.MaxProcs = int(v.(int64))
+	case "accept_workers":
+		o.AcceptWorkers = int(v.(int64))
+	case "route_accept_workers":
+		o.RouteAcceptWorkers = int(v.(int64))
+	case "max_tls_handshakes":
+		o.MaxTLSHandshakes = int(v.(int64))
+	case "max_closed_clients":
+		o.MaxClosedClients = int(v.(int64))
 	case "max_traced_msg_len":
 		o.MaxTracedMsgLen = int(v.(int64))
+	case "client_error_log_rate":
+		o.ClientErrorLogRate = int(v.(int64))
 	case "max_subscriptions", "max_subs":
 		o.MaxSubs = int(v.(int64))
 	case "ping_interval":
 		o.PingInterval = parseDuration("ping_interval", tk, v, errors, warnings)
 	case "ping_max":
 		o.MaxPingsOut = int(v.(int64))
+	case "rtt_interval":
+		o.RTTInterval = parseDuration("rtt_interval", tk, v, errors, warnings)
 	case "tls":
-		tc, err := parseTLS(tk)
+		tc, err := parseTLS(tk, true)
 		if err != nil {
 			*errors = append(*errors, err)
 			return
@@ -663,8 +1140,127 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		}
 		o.TLSTimeout = tc.Timeout
 		o.TLSMap = tc.Map
+		o.TLSHandshakeFirst = tc.HandshakeFirst
+		o.TLSHandshakeFirstFallback = tc.FallbackDelay
 	case "write_deadline":
 		o.WriteDeadline = parseDuration("write_deadline", tk, v, errors, warnings)
+	case "flush":
+		if err := parseFlush(tk, &o.Flush, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "outbound_proxy":
+		if _, err := parseProxyURL(v.(string)); err != nil {
+			*errors = append(*errors, &configErr{tk, err.Error()})
+			return
+		}
+		o.OutboundProxy = v.(string)
+	case "profiling":
+		if err := parseProfiling(tk, &o.Profiling, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "monitor":
+		if err := parseMonitor(tk, &o.Monitor, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "opentelemetry", "otel":
+		if err := parseOpenTelemetry(tk, &o.OpenTelemetry, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "statsd", "dogstatsd":
+		if err := parseStatsD(tk, &o.StatsD, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "webhook", "webhooks":
+		if err := parseWebhook(tk, &o.Webhook, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "connection_events":
+		if err := parseConnectionEvents(tk, &o.ConnectionEvents, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "acme":
+		if err := parseACME(tk, &o.ACME, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "account_revocations":
+		revocations, err := parseAccountRevocations(tk, errors)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AccountRevocations = revocations
+	case "networks":
+		n, err := parseNetworkACL(tk, errors)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Networks = n
+	case "accept_rate":
+		ar, err := parseAcceptRate(tk, errors)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AcceptRate = ar
+	case "auth_lockout":
+		if err := parseAuthLockout(tk, &o.AuthLockout, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "traffic":
+		if err := parseTraffic(tk, &o.Traffic, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "delayed_delivery":
+		if err := parseDelayedDelivery(tk, &o.DelayedDelivery, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "kv", "key_value":
+		if err := parseKV(tk, &o.KV, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "object_store":
+		if err := parseObjectStore(tk, &o.ObjectStore, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "streams":
+		if err := parseStreams(tk, &o.Streams, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "metadata":
+		if err := parseMetadata(tk, &o.Metadata, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "store_encryption":
+		if err := parseStoreEncryption(tk, &o.StoreEncryption, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "queue_groups", "queue_policy":
+		if err := parseQueueGroups(tk, &o.QueueGroups, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "listen_unix":
+		if err := parseUnixSocket(tk, &o.ListenUnix, errors); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
 	case "lame_duck_duration":
 		dur, err := time.ParseDuration(v.(string))
 		if err != nil {
@@ -678,6 +1274,27 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			return
 		}
 		o.LameDuckDuration = dur
+	case "reconnect_min_delay":
+		o.ReconnectMinDelay = parseDuration("reconnect_min_delay", tk, v, errors, warnings)
+	case "reconnect_max_delay":
+		o.ReconnectMaxDelay = parseDuration("reconnect_max_delay", tk, v, errors, warnings)
+	case "no_header_support":
+		o.NoHeaderSupport = v.(bool)
+	case "self_test":
+		switch v := v.(type) {
+		case bool:
+			o.SelfTest = v
+		case string:
+			if !strings.EqualFold(v, "strict") {
+				err := &configErr{tk, fmt.Sprintf("error parsing self_test: expected a boolean or \"strict\", got %q", v)}
+				*errors = append(*errors, err)
+				return
+			}
+			o.SelfTest, o.SelfTestStrict = true, true
+		default:
+			err := &configErr{tk, fmt.Sprintf("error parsing self_test: unsupported type %T", v)}
+			*errors = append(*errors, err)
+		}
 	case "operator", "operators", "roots", "root", "root_operators", "root_operator":
 		opFiles := []string{}
 		switch v := v.(type) {
@@ -748,7 +1365,7 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			*errors = append(*errors, err)
 		}
 	case "resolver_tls":
-		tc, err := parseTLS(tk)
+		tc, err := parseTLS(tk, false)
 		if err != nil {
 			*errors = append(*errors, err)
 			return
@@ -821,6 +1438,8 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.ConnectErrorReports = int(v.(int64))
 	case "reconnect_error_reports":
 		o.ReconnectErrorReports = int(v.(int64))
+	case "config_key":
+		// Already used to decrypt the configuration values.
 	default:
 		if au := atomic.LoadInt32(&allowUnknownTopLevelField); au == 0 && !tk.IsUsedVariable() {
 			err := &unknownConfigFieldErr{
@@ -834,6 +1453,21 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 	}
 }
 
+// parseTags parses a map of tags, for instance `tags { region: "us-east", az: 1 }`.
+func parseTags(tk token, v interface{}) (map[string]string, error) {
+	var lt token
+	tm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected map of tags, got %T", v)}
+	}
+	tags := make(map[string]string, len(tm))
+	for name, t := range tm {
+		_, t = unwrapValue(t, &lt)
+		tags[name] = fmt.Sprintf("%v", t)
+	}
+	return tags, nil
+}
+
 func parseDuration(field string, tk token, v interface{}, errors *[]error, warnings *[]error) time.Duration {
 	if wd, ok := v.(string); ok {
 		if dur, err := time.ParseDuration(wd); err != nil {
@@ -858,62 +1492,998 @@ func parseDuration(field string, tk token, v interface{}, errors *[]error, warni
 	}
 }
 
-func trackExplicitVal(opts *Options, pm *map[string]bool, name string, val bool) {
-	m := *pm
-	if m == nil {
-		m = make(map[string]bool)
-		*pm = m
-	}
-	m[name] = val
-}
-
-// hostPort is simple struct to hold parsed listen/addr strings.
-type hostPort struct {
-	host string
-	port int
-}
+// parseFlush parses a `flush` block of a listener.
+func parseFlush(v interface{}, fo *FlushOpts, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
 
-// parseListen will parse listen option which is replacing host/net and port
-func parseListen(v interface{}) (*hostPort, error) {
-	hp := &hostPort{}
-	switch vv := v.(type) {
-	// Only a port
-	case int64:
-		hp.port = int(vv)
-	case string:
-		host, port, err := net.SplitHostPort(vv)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse address string %q", vv)
-		}
-		hp.port, err = strconv.Atoi(port)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse port %q", port)
+	tk, v := unwrapValue(v, &lt)
+	fm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define flush, got %T", v)}
+	}
+	for mk, mv := range fm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "mode":
+			mode := strings.ToLower(mv.(string))
+			if mode != FlushModeLatency && mode != FlushModeThroughput {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid flush mode %q, expected %q or %q",
+					mv, FlushModeLatency, FlushModeThroughput)})
+				continue
+			}
+			fo.Mode = mode
+		case "max_coalesce":
+			size := int(mv.(int64))
+			if size < minBufSize {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("invalid max_coalesce of %d, minimum is %d", size, minBufSize)})
+				continue
+			}
+			fo.MaxCoalesce = size
+		case "interval":
+			fo.Interval = parseDuration("interval", tk, mv, errors, warnings)
+		case "write_deadline":
+			fo.WriteDeadline = parseDuration("write_deadline", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
 		}
-		hp.host = host
 	}
-	return hp, nil
+	return nil
 }
 
-// parseCluster will parse the cluster config.
-func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+// parseRouteDiscovery parses the built-in discovery of the cluster,
+// which solicits routes to a list of seeds.
+func parseRouteDiscovery(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
 	var lt token
 	defer convertPanicToErrorList(&lt, errors)
 
 	tk, v := unwrapValue(v, &lt)
-	cm, ok := v.(map[string]interface{})
+	dm, ok := v.(map[string]interface{})
 	if !ok {
-		return &configErr{tk, fmt.Sprintf("Expected map to define cluster, got %T", v)}
+		return &configErr{tk, fmt.Sprintf("Expected map to define discovery, got %T", v)}
 	}
-
-	for mk, mv := range cm {
-		// Again, unwrap token value if line check is required.
+	for mk, mv := range dm {
 		tk, mv = unwrapValue(mv, &lt)
 		switch strings.ToLower(mk) {
-		case "listen":
-			hp, err := parseListen(mv)
-			if err != nil {
-				err := &configErr{tk, err.Error()}
-				*errors = append(*errors, err)
+		case "seeds":
+			urls, errs := parseURLs(mv.([]interface{}), "seed")
+			if errs != nil {
+				*errors = append(*errors, errs...)
+				continue
+			}
+			opts.Cluster.Discovery = &SeedDiscovery{URLs: urls}
+		case "interval":
+			opts.Cluster.DiscoveryInterval = parseDuration("interval", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseRetryPolicy parses the retry policy of the routes.
+func parseRetryPolicy(v interface{}, p *RetryPolicy, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	rm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define retry, got %T", v)}
+	}
+	for mk, mv := range rm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "initial_delay":
+			p.InitialDelay = parseDuration("initial_delay", tk, mv, errors, warnings)
+		case "max_delay":
+			p.MaxDelay = parseDuration("max_delay", tk, mv, errors, warnings)
+		case "jitter":
+			switch j := mv.(type) {
+			case float64:
+				p.Jitter = j
+			case int64:
+				p.Jitter = float64(j)
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected jitter to be a number, got %T", mv)})
+			}
+		case "max_attempts":
+			p.MaxAttempts = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := validateRetryPolicy(p); err != nil {
+		return &configErr{tk, err.Error()}
+	}
+	return nil
+}
+
+// parseUnixSocket parses the Unix socket listener, given either as a
+// path or as a map with the path and the permissions of the socket file.
+func parseUnixSocket(v interface{}, uo *UnixSocketOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case string:
+		uo.Path = vv
+		return nil
+	case map[string]interface{}:
+		for mk, mv := range vv {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "path":
+				uo.Path = mv.(string)
+			case "mode":
+				mode, err := parseFileMode(mv)
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				uo.Mode = mode
+			case "owner", "user":
+				uo.Owner = mv.(string)
+			case "group":
+				uo.Group = mv.(string)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		if uo.Path == _EMPTY_ {
+			return &configErr{tk, "listen_unix requires a path"}
+		}
+		return nil
+	default:
+		return &configErr{tk, fmt.Sprintf("Expected listen_unix to be a path or a map, got %T", v)}
+	}
+}
+
+func parseProfiling(v interface{}, po *ProfilingOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	pm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define profiling, got %T", v)}
+	}
+	for mk, mv := range pm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "http":
+			po.HTTP = mv.(bool)
+		case "user", "username":
+			po.Username = mv.(string)
+		case "pass", "password":
+			po.Password = mv.(string)
+		case "dir":
+			po.Dir = mv.(string)
+		case "max_files":
+			po.MaxFiles = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseMonitor(v interface{}, mo *MonitorOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define monitor, got %T", v)}
+	}
+	for mk, mv := range mm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "public_listen", "public":
+			mo.PublicListen = mv.(string)
+		case "user", "username":
+			mo.Username = mv.(string)
+		case "pass", "password":
+			mo.Password = mv.(string)
+		case "token":
+			mo.Token = mv.(string)
+		case "users":
+			users, ok := mv.([]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected monitor users to be an array, got %T", mv)})
+				continue
+			}
+			mo.Users = nil
+			for _, u := range users {
+				user, err := parseMonitorUser(u, errors)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				mo.Users = append(mo.Users, user)
+			}
+		case "verify":
+			mo.Verify = mv.(bool)
+		case "cors_origins", "cors_origin":
+			mo.CORSOrigins = nil
+			switch ov := mv.(type) {
+			case string:
+				mo.CORSOrigins = append(mo.CORSOrigins, ov)
+			case []interface{}:
+				for _, o := range ov {
+					_, o = unwrapValue(o, &lt)
+					mo.CORSOrigins = append(mo.CORSOrigins, o.(string))
+				}
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected origin or list of origins, got %T", mv)})
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseMonitorUser(v interface{}, errors *[]error) (*MonitorUser, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	um, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected map to define a monitor user, got %T", v)}
+	}
+	user := &MonitorUser{}
+	for mk, mv := range um {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "user", "username":
+			user.Username = mv.(string)
+		case "pass", "password":
+			user.Password = mv.(string)
+		case "token":
+			user.Token = mv.(string)
+		case "cn", "common_name":
+			user.CommonName = mv.(string)
+		case "endpoints":
+			switch ev := mv.(type) {
+			case string:
+				user.Endpoints = append(user.Endpoints, ev)
+			case []interface{}:
+				for _, e := range ev {
+					_, e = unwrapValue(e, &lt)
+					user.Endpoints = append(user.Endpoints, e.(string))
+				}
+			default:
+				return nil, &configErr{tk, fmt.Sprintf("Expected endpoint or list of endpoints, got %T", mv)}
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return user, nil
+}
+
+func parseOpenTelemetry(v interface{}, ot *OpenTelemetryOpts, errors, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	om, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define opentelemetry, got %T", v)}
+	}
+	for mk, mv := range om {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "endpoint":
+			ot.Endpoint = mv.(string)
+		case "service_name":
+			ot.ServiceName = mv.(string)
+		case "sampling":
+			ot.Sampling = int(mv.(int64))
+		case "accounts":
+			am, ok := mv.(map[string]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected map of account samplings, got %T", mv)})
+				continue
+			}
+			ot.Accounts = make(map[string]int, len(am))
+			for name, r := range am {
+				_, r = unwrapValue(r, &lt)
+				ot.Accounts[name] = int(r.(int64))
+			}
+		case "export_interval":
+			ot.ExportInterval = parseDuration("export_interval", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseStatsD(v interface{}, sd *StatsDOpts, errors, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	if endpoint, ok := v.(string); ok {
+		sd.Endpoint = endpoint
+		return nil
+	}
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected endpoint or map to define statsd, got %T", v)}
+	}
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "endpoint":
+			sd.Endpoint = mv.(string)
+		case "prefix":
+			sd.Prefix = mv.(string)
+		case "interval":
+			sd.Interval = parseDuration("interval", tk, mv, errors, warnings)
+		case "tags":
+			tags, err := parseTags(tk, mv)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			sd.Tags = tags
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseWebhook(v interface{}, wh *WebhookOpts, errors, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	if u, ok := v.(string); ok {
+		wh.URL = u
+		return nil
+	}
+	wm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected url or map to define webhook, got %T", v)}
+	}
+	for mk, mv := range wm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "url":
+			wh.URL = mv.(string)
+		case "events":
+			wh.Events = nil
+			switch ev := mv.(type) {
+			case string:
+				wh.Events = append(wh.Events, strings.ToLower(ev))
+			case []interface{}:
+				for _, e := range ev {
+					_, e = unwrapValue(e, &lt)
+					wh.Events = append(wh.Events, strings.ToLower(e.(string)))
+				}
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected event or list of events, got %T", mv)})
+			}
+		case "batch_size":
+			wh.BatchSize = int(mv.(int64))
+		case "flush_interval":
+			wh.FlushInterval = parseDuration("flush_interval", tk, mv, errors, warnings)
+		case "max_retries":
+			wh.MaxRetries = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseACME(v interface{}, ao *ACMEOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define acme, got %T", v)}
+	}
+	for mk, mv := range am {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "domains", "domain":
+			ao.Domains = nil
+			switch dv := mv.(type) {
+			case string:
+				ao.Domains = append(ao.Domains, dv)
+			case []interface{}:
+				for _, d := range dv {
+					_, d = unwrapValue(d, &lt)
+					ao.Domains = append(ao.Domains, d.(string))
+				}
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected domain or list of domains, got %T", mv)})
+			}
+		case "email":
+			ao.Email = mv.(string)
+		case "cache_dir", "cache":
+			ao.CacheDir = mv.(string)
+		case "directory_url", "directory":
+			ao.DirectoryURL = mv.(string)
+		case "challenge":
+			ao.Challenge = strings.ToLower(mv.(string))
+		case "http_listen", "http":
+			ao.HTTPListen = mv.(string)
+		case "accept_tos":
+			ao.AcceptTOS = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseAuthLockout(v interface{}, al *AuthLockoutOpts, errors, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	lm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define auth_lockout, got %T", v)}
+	}
+	for mk, mv := range lm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "threshold":
+			al.Threshold = int(mv.(int64))
+		case "window":
+			al.Window = parseDuration("window", tk, mv, errors, warnings)
+		case "delay":
+			al.Delay = parseDuration("delay", tk, mv, errors, warnings)
+		case "max_delay":
+			al.MaxDelay = parseDuration("max_delay", tk, mv, errors, warnings)
+		case "ban_threshold":
+			al.BanThreshold = int(mv.(int64))
+		case "ban_duration":
+			al.BanDuration = parseDuration("ban_duration", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseTraffic(v interface{}, to *TrafficOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	// A boolean enables the analytics with the defaults.
+	if b, ok := v.(bool); ok {
+		to.Enabled = b
+		return nil
+	}
+	tm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map or boolean to define traffic, got %T", v)}
+	}
+	to.Enabled = true
+	for mk, mv := range tm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "enabled":
+			to.Enabled = mv.(bool)
+		case "top_subjects":
+			to.TopSubjects = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseDelayedDelivery(v interface{}, do *DelayedDeliveryOpts, errors, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	// A boolean enables the delayed delivery with the defaults.
+	if b, ok := v.(bool); ok {
+		do.Enabled = b
+		return nil
+	}
+	dm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map or boolean to define delayed_delivery, got %T", v)}
+	}
+	do.Enabled = true
+	for mk, mv := range dm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "enabled":
+			do.Enabled = mv.(bool)
+		case "store_dir", "store":
+			do.StoreDir = mv.(string)
+		case "max_delay":
+			do.MaxDelay = parseDuration("max_delay", tk, mv, errors, warnings)
+		case "max_messages", "max_msgs":
+			do.MaxMessages = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseKV(v interface{}, ko *KVOpts, errors, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	// A string is the store directory.
+	if dir, ok := v.(string); ok {
+		ko.StoreDir = dir
+		return nil
+	}
+	km, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map or string to define kv, got %T", v)}
+	}
+	for mk, mv := range km {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "store_dir", "store":
+			ko.StoreDir = mv.(string)
+		case "compact_interval":
+			ko.CompactInterval = parseDuration("compact_interval", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseObjectStore(v interface{}, oo *ObjectStoreOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	// A string is the store directory.
+	if dir, ok := v.(string); ok {
+		oo.StoreDir = dir
+		return nil
+	}
+	om, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map or string to define object_store, got %T", v)}
+	}
+	for mk, mv := range om {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "store_dir", "store":
+			oo.StoreDir = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseStreams(v interface{}, so *StreamsOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	// A string is the store directory.
+	if dir, ok := v.(string); ok {
+		so.StoreDir = dir
+		return nil
+	}
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map or string to define streams, got %T", v)}
+	}
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "store_dir", "store":
+			so.StoreDir = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseMetadata(v interface{}, mo *MetadataOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define metadata, got %T", v)}
+	}
+	for mk, mv := range mm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "peers":
+			mo.Peers = nil
+			pa, ok := mv.([]interface{})
+			if !ok {
+				return &configErr{tk, fmt.Sprintf("Expected list of peers, got %T", mv)}
+			}
+			for _, p := range pa {
+				_, p = unwrapValue(p, &lt)
+				mo.Peers = append(mo.Peers, p.(string))
+			}
+		case "store_dir", "store":
+			mo.StoreDir = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseStoreEncryption(v interface{}, eo *StoreEncryptionOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	// A string is the master key.
+	if key, ok := v.(string); ok {
+		eo.Key = key
+		return nil
+	}
+	em, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map or string to define store_encryption, got %T", v)}
+	}
+	for mk, mv := range em {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "key":
+			eo.Key = mv.(string)
+		case "previous_keys":
+			eo.PreviousKeys = nil
+			switch pv := mv.(type) {
+			case string:
+				eo.PreviousKeys = append(eo.PreviousKeys, pv)
+			case []interface{}:
+				for _, k := range pv {
+					_, k = unwrapValue(k, &lt)
+					eo.PreviousKeys = append(eo.PreviousKeys, k.(string))
+				}
+			default:
+				return &configErr{tk, fmt.Sprintf("Expected key or list of keys, got %T", mv)}
+			}
+		case "cipher":
+			eo.Cipher = mv.(string)
+		case "allow_plaintext":
+			eo.AllowPlaintext = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseConnectionEvents parses the connection events, either as a boolean
+// to use the default subject, a subject or a map.
+func parseConnectionEvents(v interface{}, ce *ConnectionEventsOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch v := v.(type) {
+	case bool:
+		ce.Subject = _EMPTY_
+		if v {
+			ce.Subject = DefaultConnectionEventsSubject
+		}
+		return nil
+	case string:
+		ce.Subject = v
+		return nil
+	case map[string]interface{}:
+		ce.Subject = DefaultConnectionEventsSubject
+		for mk, mv := range v {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "subject":
+				ce.Subject = mv.(string)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		return nil
+	}
+	return &configErr{tk, fmt.Sprintf("Expected boolean, subject or map to define connection_events, got %T", v)}
+}
+
+func parseQueueGroups(v interface{}, qo *QueueGroupOpts, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	// A string is the policy, with the defaults.
+	if p, ok := v.(string); ok {
+		qo.Policy = strings.ToLower(p)
+		return nil
+	}
+	qm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map or string to define queue_groups, got %T", v)}
+	}
+	for mk, mv := range qm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "policy":
+			qo.Policy = strings.ToLower(mv.(string))
+		case "spill_threshold":
+			qo.SpillThreshold = mv.(int64)
+		case "local_weight":
+			qo.LocalWeight = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses file permissions written in octal. Since the configuration
+// parser reads 0660 as the decimal 660, integer digits are also
+// interpreted as octal.
+func parseFileMode(v interface{}) (os.FileMode, error) {
+	var s string
+	switch m := v.(type) {
+	case string:
+		s = m
+	case int64:
+		s = strconv.FormatInt(m, 10)
+	default:
+		return 0, fmt.Errorf("expected mode to be a string or integer, got %T", v)
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q, expected octal permissions such as \"0660\"", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+func trackExplicitVal(opts *Options, pm *map[string]bool, name string, val bool) {
+	m := *pm
+	if m == nil {
+		m = make(map[string]bool)
+		*pm = m
+	}
+	m[name] = val
+}
+
+// hostPort is simple struct to hold parsed listen/addr strings.
+type hostPort struct {
+	host string
+	port int
+}
+
+// parseListen will parse listen option which is replacing host/net and port
+func parseListen(v interface{}) (*hostPort, error) {
+	hp := &hostPort{}
+	switch vv := v.(type) {
+	// Only a port
+	case int64:
+		hp.port = int(vv)
+	case string:
+		host, port, err := net.SplitHostPort(vv)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse address string %q", vv)
+		}
+		hp.port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse port %q", port)
+		}
+		hp.host = host
+	}
+	return hp, nil
+}
+
+// parseCluster will parse the cluster config.
+func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	cm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected map to define cluster, got %T", v)}
+	}
+
+	for mk, mv := range cm {
+		// Again, unwrap token value if line check is required.
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "name":
+			opts.Cluster.Name = mv.(string)
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				err := &configErr{tk, err.Error()}
+				*errors = append(*errors, err)
 				continue
 			}
 			opts.Cluster.Host = hp.host
@@ -921,7 +2491,34 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 		case "port":
 			opts.Cluster.Port = int(mv.(int64))
 		case "host", "net":
-			opts.Cluster.Host = mv.(string)
+			opts.Cluster.Host = trimIPv6Brackets(mv.(string))
+		case "host_v6":
+			opts.Cluster.HostV6 = trimIPv6Brackets(mv.(string))
+		case "prefer_family":
+			family, err := parseFamily(mv.(string))
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			opts.Cluster.PreferFamily = family
+		case "proxy":
+			if _, err := parseProxyURL(mv.(string)); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			opts.Cluster.Proxy = mv.(string)
+		case "discovery_interval", "srv_refresh":
+			opts.Cluster.DiscoveryInterval = parseDuration(mk, tk, mv, errors, warnings)
+		case "discovery":
+			if err := parseRouteDiscovery(tk, opts, errors, warnings); err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+		case "retry":
+			if err := parseRetryPolicy(tk, &opts.Cluster.Retry, errors, warnings); err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
 		case "authorization":
 			auth, err := parseAuthorization(tk, opts, errors, warnings)
 			if err != nil {
@@ -954,12 +2551,13 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			}
 		case "routes":
 			ra := mv.([]interface{})
-			routes, errs := parseURLs(ra, "route")
+			routes, remotes, errs := parseRoutes(ra)
 			if errs != nil {
 				*errors = append(*errors, errs...)
 				continue
 			}
 			opts.Routes = routes
+			opts.Cluster.Remotes = remotes
 		case "tls":
 			config, tlsopts, err := getTLSConfig(tk)
 			if err != nil {
@@ -976,6 +2574,43 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			trackExplicitVal(opts, &opts.inConfig, "Cluster.NoAdvertise", opts.Cluster.NoAdvertise)
 		case "connect_retries":
 			opts.Cluster.ConnectRetries = int(mv.(int64))
+		case "ping_interval":
+			opts.Cluster.PingInterval = parseDuration("ping_interval", tk, mv, errors, warnings)
+		case "ping_max":
+			opts.Cluster.MaxPingsOut = int(mv.(int64))
+		case "networks":
+			n, err := parseNetworkACL(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.Networks = n
+		case "accept_rate":
+			ar, err := parseAcceptRate(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.AcceptRate = ar
+		case "subject_owners":
+			owners, err := parseSubjectOwners(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.SubjectOwners = owners
+		case "flush":
+			if err := parseFlush(tk, &opts.Cluster.Flush, errors, warnings); err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+		case "compression":
+			mode, err := parseCompression(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			opts.Cluster.Compression = mode
 		case "permissions":
 			perms, err := parseUserPermissions(mv, errors, warnings)
 			if err != nil {
@@ -1020,9 +2655,72 @@ func parseURLs(a []interface{}, typ string) (urls []*url.URL, errors []error) {
 			errors = append(errors, err)
 			continue
 		}
-		urls = append(urls, url)
+		urls = append(urls, url)
+	}
+	return urls, errors
+}
+
+// parseRoutes parses the cluster's routes. Each entry is either a URL or
+// a map with the URL and the TLS settings to use when soliciting it.
+func parseRoutes(a []interface{}) (urls []*url.URL, remotes []*RemoteRouteOpts, errors []error) {
+	urls = make([]*url.URL, 0, len(a))
+	var lt token
+	defer convertPanicToErrorList(&lt, &errors)
+
+	for _, r := range a {
+		tk, r := unwrapValue(r, &lt)
+		rm, ok := r.(map[string]interface{})
+		if !ok {
+			url, err := parseURL(r.(string), "route")
+			if err != nil {
+				errors = append(errors, &configErr{tk, err.Error()})
+				continue
+			}
+			urls = append(urls, url)
+			continue
+		}
+		remote := &RemoteRouteOpts{}
+		for k, v := range rm {
+			tk, v := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "url":
+				url, err := parseURL(v.(string), "route")
+				if err != nil {
+					errors = append(errors, &configErr{tk, err.Error()})
+					continue
+				}
+				remote.URL = url
+			case "tls":
+				tc, tlsopts, err := getTLSConfig(tk)
+				if err != nil {
+					errors = append(errors, err)
+					continue
+				}
+				remote.TLSConfig = tc
+				remote.TLSTimeout = tlsopts.Timeout
+			case "server_name", "sni":
+				remote.ServerName = v.(string)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					errors = append(errors, err)
+					continue
+				}
+			}
+		}
+		if remote.URL == nil {
+			errors = append(errors, &configErr{tk, "route entry requires a url"})
+			continue
+		}
+		urls = append(urls, remote.URL)
+		remotes = append(remotes, remote)
 	}
-	return urls, errors
+	return urls, remotes, errors
 }
 
 func parseURL(u string, typ string) (*url.URL, error) {
@@ -1061,7 +2759,9 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 		case "port":
 			o.Gateway.Port = int(mv.(int64))
 		case "host", "net":
-			o.Gateway.Host = mv.(string)
+			o.Gateway.Host = trimIPv6Brackets(mv.(string))
+		case "host_v6":
+			o.Gateway.HostV6 = trimIPv6Brackets(mv.(string))
 		case "authorization":
 			auth, err := parseAuthorization(tk, o, errors, warnings)
 			if err != nil {
@@ -1088,6 +2788,10 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 			o.Gateway.Advertise = mv.(string)
 		case "connect_retries":
 			o.Gateway.ConnectRetries = int(mv.(int64))
+		case "ping_interval":
+			o.Gateway.PingInterval = parseDuration("ping_interval", tk, mv, errors, warnings)
+		case "ping_max":
+			o.Gateway.MaxPingsOut = int(mv.(int64))
 		case "gateways":
 			gateways, err := parseGateways(mv, errors, warnings)
 			if err != nil {
@@ -1096,6 +2800,25 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 			o.Gateway.Gateways = gateways
 		case "reject_unknown":
 			o.Gateway.RejectUnknown = mv.(bool)
+		case "networks":
+			n, err := parseNetworkACL(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.Networks = n
+		case "accept_rate":
+			ar, err := parseAcceptRate(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.AcceptRate = ar
+		case "flush":
+			if err := parseFlush(tk, &o.Gateway.Flush, errors, warnings); err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -1139,7 +2862,9 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 		case "port":
 			opts.LeafNode.Port = int(mv.(int64))
 		case "host", "net":
-			opts.LeafNode.Host = mv.(string)
+			opts.LeafNode.Host = trimIPv6Brackets(mv.(string))
+		case "host_v6":
+			opts.LeafNode.HostV6 = trimIPv6Brackets(mv.(string))
 		case "authorization":
 			auth, err := parseLeafAuthorization(tk, errors, warnings)
 			if err != nil {
@@ -1166,7 +2891,7 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 		case "reconnect", "reconnect_delay", "reconnect_interval":
 			opts.LeafNode.ReconnectInterval = time.Duration(int(mv.(int64))) * time.Second
 		case "tls":
-			tc, err := parseTLS(tk)
+			tc, err := parseTLS(tk, false)
 			if err != nil {
 				*errors = append(*errors, err)
 				continue
@@ -1182,6 +2907,36 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 		case "no_advertise":
 			opts.LeafNode.NoAdvertise = mv.(bool)
 			trackExplicitVal(opts, &opts.inConfig, "LeafNode.NoAdvertise", opts.LeafNode.NoAdvertise)
+		case "networks":
+			n, err := parseNetworkACL(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.Networks = n
+		case "accept_rate":
+			ar, err := parseAcceptRate(tk, errors)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.AcceptRate = ar
+		case "flush":
+			if err := parseFlush(tk, &opts.LeafNode.Flush, errors, warnings); err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+		case "compression":
+			mode, err := parseCompression(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			opts.LeafNode.Compression = mode
+		case "ping_interval":
+			opts.LeafNode.PingInterval = parseDuration("ping_interval", tk, mv, errors, warnings)
+		case "ping_max":
+			opts.LeafNode.MaxPingsOut = int(mv.(int64))
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -1294,6 +3049,13 @@ func parseLeafUsers(mv interface{}, errors *[]error, warnings *[]error) ([]*User
 				// we need to create internal objects to store u/p and account
 				// name and have a server structure to hold that.
 				user.Account = NewAccount(v.(string))
+			case "networks":
+				n, err := parseNetworkACL(tk, errors)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				user.Networks = n
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -1361,7 +3123,7 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 				}
 				remote.Credentials = p
 			case "tls":
-				tc, err := parseTLS(tk)
+				tc, err := parseTLS(tk, false)
 				if err != nil {
 					*errors = append(*errors, err)
 					continue
@@ -1381,6 +3143,19 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 				}
 			case "hub":
 				remote.Hub = v.(bool)
+			case "compression":
+				mode, err := parseCompression(v)
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				remote.Compression = mode
+			case "proxy":
+				if _, err := parseProxyURL(v.(string)); err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				remote.Proxy = v.(string)
 			case "deny_imports", "deny_import":
 				subjects, err := parseSubjects(tk, errors, warnings)
 				if err != nil {
@@ -1416,7 +3191,7 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 // Parse TLS and returns a TLSConfig and TLSTimeout.
 // Used by cluster and gateway parsing.
 func getTLSConfig(tk token) (*tls.Config, *TLSConfigOpts, error) {
-	tc, err := parseTLS(tk)
+	tc, err := parseTLS(tk, false)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1428,6 +3203,9 @@ func getTLSConfig(tk token) (*tls.Config, *TLSConfigOpts, error) {
 	// For clusters/gateways, we will force strict verification. We also act
 	// as both client and server, so will mirror the rootCA to the
 	// clientCA pool.
+	if tc.ClientAuth != tls.NoClientCert && tc.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, nil, &configErr{tk, "client_auth can only be require_and_verify for routes and gateways"}
+	}
 	config.ClientAuth = tls.RequireAndVerifyClientCert
 	config.RootCAs = config.ClientCAs
 	return config, tc, nil
@@ -1480,6 +3258,12 @@ func parseGateways(v interface{}, errors *[]error, warnings *[]error) ([]*Remote
 					continue
 				}
 				gateway.URLs = urls
+			case "proxy":
+				if _, err := parseProxyURL(v.(string)); err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				gateway.Proxy = v.(string)
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -1527,6 +3311,7 @@ type importStream struct {
 	an  string
 	sub string
 	pre string
+	to  string
 }
 
 type importService struct {
@@ -1602,6 +3387,12 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 			acc := NewAccount(aname)
 			opts.Accounts = append(opts.Accounts, acc)
 
+			// Users of the account, to apply its default permissions.
+			var (
+				accUsers []*User
+				accNkeys []*NkeyUser
+				defPerms *Permissions
+			)
 			for k, v := range mv {
 				tk, mv := unwrapValue(v, &lt)
 				switch strings.ToLower(k) {
@@ -1645,6 +3436,7 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						u.Account = acc
 					}
 					opts.Users = append(opts.Users, users...)
+					accUsers = append(accUsers, users...)
 
 					for _, u := range nkeys {
 						if _, ok := uorn[u.Nkey]; ok {
@@ -1656,6 +3448,121 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						u.Account = acc
 					}
 					opts.Nkeys = append(opts.Nkeys, nkeys...)
+					accNkeys = append(accNkeys, nkeys...)
+				case "default_permission", "default_permissions":
+					permissions, err := parseUserPermissions(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					defPerms = permissions
+				case "max_subscriptions", "max_subs":
+					max, ok := mv.(int64)
+					if !ok || max < 0 {
+						err := &configErr{tk, fmt.Sprintf("invalid max_subscriptions for account %q: %v", aname, mv)}
+						*errors = append(*errors, err)
+						continue
+					}
+					if max > 0 {
+						acc.mtsubs = int32(max)
+					}
+				case "max_connections", "max_conn":
+					max, ok := mv.(int64)
+					if !ok || max < 0 {
+						err := &configErr{tk, fmt.Sprintf("invalid max_connections for account %q: %v", aname, mv)}
+						*errors = append(*errors, err)
+						continue
+					}
+					if max > 0 {
+						acc.mconns = int32(max)
+					}
+				case "max_payload", "max_control_line":
+					max, ok := mv.(int64)
+					if !ok || max <= 0 || max > 1<<31-1 {
+						err := &configErr{tk, fmt.Sprintf("invalid %s for account %q: %v", strings.ToLower(k), aname, mv)}
+						*errors = append(*errors, err)
+						continue
+					}
+					if strings.ToLower(k) == "max_payload" {
+						acc.maxPayload = int32(max)
+					} else {
+						acc.maxCtrlLine = int32(max)
+					}
+				case "max_memory":
+					max, ok := mv.(int64)
+					if !ok || max <= 0 {
+						err := &configErr{tk, fmt.Sprintf("invalid max_memory for account %q: %v", aname, mv)}
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.maxMemory = max
+				case "ping_interval":
+					acc.pingInterval = parseDuration("ping_interval", tk, mv, errors, warnings)
+				case "ping_max":
+					acc.maxPingsOut = int(mv.(int64))
+				case "dead_letter":
+					dl, err := parseDeadLetter(tk, errors)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.deadLetter = dl
+				case "min_client_version", "min_client_versions":
+					versions, err := parseMinClientVersions(tk, errors)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.minClientVersions = versions
+				case "subject_rules":
+					rules, err := parseSubjectRules(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.subjectRules = rules
+				case "duplicate_window":
+					windows, err := parseDuplicateWindows(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.dupConfig = windows
+				case "kv", "key_value":
+					limits, err := parseKVLimits(tk, errors)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.kv = limits
+				case "object_store":
+					limits, err := parseObjectStoreLimits(tk, errors)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.objStore = limits
+				case "streams":
+					cfgs, err := parseStreamConfigs(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.streams = cfgs
+				case "expected_interest":
+					subjects, err := parseSubjects(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					for _, subj := range subjects {
+						if strings.ContainsAny(subj, " \t") {
+							err := &configErr{tk, fmt.Sprintf("queue group not allowed in expected interest %q", subj)}
+							*errors = append(*errors, err)
+							continue
+						}
+						acc.interest = append(acc.interest, subj)
+					}
 				default:
 					if !tk.IsUsedVariable() {
 						err := &unknownConfigFieldErr{
@@ -1668,6 +3575,20 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 					}
 				}
 			}
+			// The default permissions apply to the users of the
+			// account that do not have their own.
+			if defPerms != nil {
+				for _, u := range accUsers {
+					if u.Permissions == nil {
+						u.Permissions = defPerms
+					}
+				}
+				for _, u := range accNkeys {
+					if u.Permissions == nil {
+						u.Permissions = defPerms
+					}
+				}
+			}
 		}
 	}
 	lt = tk
@@ -1681,9 +3602,13 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 	// since we do permissions checks.
 
 	// Create a lookup map for accounts lookups.
+	// Accounts can also be referenced by their public nkey.
 	am := make(map[string]*Account, len(opts.Accounts))
 	for _, a := range opts.Accounts {
 		am[a.Name] = a
+		if a.Nkey != "" {
+			am[a.Nkey] = a
+		}
 	}
 	// Do stream exports
 	for _, stream := range exportStreams {
@@ -1743,33 +3668,333 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 			*errors = append(*errors, &configErr{tk, msg})
 			continue
 		}
-		if err := stream.acc.AddStreamImport(ta, stream.sub, stream.pre); err != nil {
+		var err error
+		if stream.to != "" {
+			if stream.pre != "" {
+				err = ErrStreamImportBadMapping
+			} else {
+				err = stream.acc.AddMappedStreamImport(ta, stream.sub, stream.to)
+			}
+		} else {
+			err = stream.acc.AddStreamImport(ta, stream.sub, stream.pre)
+		}
+		if err != nil {
 			msg := fmt.Sprintf("Error adding stream import %q: %v", stream.sub, err)
 			*errors = append(*errors, &configErr{tk, msg})
 			continue
 		}
 	}
-	for _, service := range importServices {
-		ta := am[service.an]
-		if ta == nil {
-			msg := fmt.Sprintf("%q account not defined for service import", service.an)
-			*errors = append(*errors, &configErr{tk, msg})
-			continue
-		}
-		if service.to == "" {
-			service.to = service.sub
-		}
-		if err := service.acc.AddServiceImport(ta, service.to, service.sub); err != nil {
-			msg := fmt.Sprintf("Error adding service import %q: %v", service.sub, err)
-			*errors = append(*errors, &configErr{tk, msg})
-			continue
+	for _, service := range importServices {
+		ta := am[service.an]
+		if ta == nil {
+			msg := fmt.Sprintf("%q account not defined for service import", service.an)
+			*errors = append(*errors, &configErr{tk, msg})
+			continue
+		}
+		if service.to == "" {
+			service.to = service.sub
+		}
+		if err := service.acc.AddServiceImport(ta, service.to, service.sub); err != nil {
+			msg := fmt.Sprintf("Error adding service import %q: %v", service.sub, err)
+			*errors = append(*errors, &configErr{tk, msg})
+			continue
+		}
+	}
+
+	return nil
+}
+
+// Parse the account exports
+// parseDeadLetter parses the dead letter policy of an account, either the
+// subject of the advisories or a map with the subject and max_payload.
+func parseDeadLetter(v interface{}, errors *[]error) (*deadLetter, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	dl := &deadLetter{}
+	switch dv := v.(type) {
+	case string:
+		dl.subject = dv
+	case map[string]interface{}:
+		for mk, mv := range dv {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "subject":
+				dl.subject = mv.(string)
+			case "max_payload":
+				dl.maxPayload = int(mv.(int64))
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected map or string to define dead_letter, got %T", v)}
+	}
+	if !IsValidPublishSubject(dl.subject) {
+		return nil, &configErr{tk, fmt.Sprintf("invalid dead_letter subject %q", dl.subject)}
+	}
+	if dl.maxPayload < 0 {
+		return nil, &configErr{tk, "dead_letter max_payload can not be negative"}
+	}
+	return dl, nil
+}
+
+// parseKVLimits parses the key-value store limits of an account, either
+// a boolean to enable the store without limits or a map of the limits.
+func parseKVLimits(v interface{}, errors *[]error) (*kvLimits, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	limits := &kvLimits{}
+	switch kv := v.(type) {
+	case bool:
+		if !kv {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		for mk, mv := range kv {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "max_buckets":
+				limits.maxBuckets = int(mv.(int64))
+			case "max_bytes":
+				limits.maxBytes = mv.(int64)
+			case "max_history":
+				limits.maxHistory = int(mv.(int64))
+			case "max_value_size":
+				limits.maxValueSize = int(mv.(int64))
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected map or boolean to define kv, got %T", v)}
+	}
+	if limits.maxBuckets < 0 || limits.maxBytes < 0 || limits.maxHistory < 0 || limits.maxValueSize < 0 {
+		return nil, &configErr{tk, "kv limits can not be negative"}
+	}
+	if limits.maxHistory > kvMaxHistory {
+		return nil, &configErr{tk, fmt.Sprintf("kv max_history can not exceed %d", kvMaxHistory)}
+	}
+	return limits, nil
+}
+
+// parseObjectStoreLimits parses the object store limits of an account,
+// either a boolean to enable the store without limits or a map of the
+// limits.
+func parseObjectStoreLimits(v interface{}, errors *[]error) (*objLimits, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	limits := &objLimits{}
+	switch ov := v.(type) {
+	case bool:
+		if !ov {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		for mk, mv := range ov {
+			tk, mv = unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "max_buckets":
+				limits.maxBuckets = int(mv.(int64))
+			case "max_bytes":
+				limits.maxBytes = mv.(int64)
+			case "max_object_size":
+				limits.maxObjectSize = mv.(int64)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected map or boolean to define object_store, got %T", v)}
+	}
+	if limits.maxBuckets < 0 || limits.maxBytes < 0 || limits.maxObjectSize < 0 {
+		return nil, &configErr{tk, "object_store limits can not be negative"}
+	}
+	return limits, nil
+}
+
+// parseStreamConfigs parses the streams of an account, a map of the
+// configurations of the streams by name.
+func parseStreamConfigs(v interface{}, errors, warnings *[]error) (map[string]*StreamConfig, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected map to define streams, got %T", v)}
+	}
+	cfgs := make(map[string]*StreamConfig, len(sm))
+	for name, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		cm, ok := mv.(map[string]interface{})
+		if !ok {
+			return nil, &configErr{tk, fmt.Sprintf("Expected map to define stream %q, got %T", name, mv)}
+		}
+		cfg := &StreamConfig{Name: name}
+		for ck, cv := range cm {
+			tk, cv = unwrapValue(cv, &lt)
+			switch strings.ToLower(ck) {
+			case "subjects", "subject":
+				subjects, err := parseSubjects(tk, errors, warnings)
+				if err != nil {
+					return nil, err
+				}
+				cfg.Subjects = subjects
+			case "sample":
+				switch sv := cv.(type) {
+				case float64:
+					cfg.Sample = sv
+				case int64:
+					cfg.Sample = float64(sv)
+				default:
+					return nil, &configErr{tk, fmt.Sprintf("Expected a number for the sample of stream %q, got %T", name, cv)}
+				}
+			case "buffer":
+				cfg.Buffer = int(cv.(int64))
+			case "max_msgs":
+				cfg.MaxMsgs = cv.(int64)
+			case "max_bytes":
+				cfg.MaxBytes = cv.(int64)
+			case "max_age":
+				cfg.MaxAge = parseDuration("max_age", tk, cv, errors, warnings)
+			case "max_msg_size":
+				cfg.MaxMsgSize = int(cv.(int64))
+			case "discard":
+				cfg.Discard = strings.ToLower(cv.(string))
+			case "mirror":
+				src, err := parseStreamSource(tk, cv, &lt)
+				if err != nil {
+					return nil, err
+				}
+				cfg.Mirror = src
+			case "sources", "source":
+				var srcs []interface{}
+				switch sv := cv.(type) {
+				case []interface{}:
+					srcs = sv
+				default:
+					srcs = []interface{}{tk}
+				}
+				for _, sv := range srcs {
+					stk, sv := unwrapValue(sv, &lt)
+					src, err := parseStreamSource(stk, sv, &lt)
+					if err != nil {
+						return nil, err
+					}
+					cfg.Sources = append(cfg.Sources, src)
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: ck,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		if err := validateStreamConfig(cfg); err != nil {
+			return nil, &configErr{tk, err.Error()}
+		}
+		cfgs[name] = cfg
+	}
+	return cfgs, nil
+}
+
+// parseStreamSource parses the mirror or a source of a stream, either the
+// name of the stream or a map with its name, filter subject and api prefix.
+func parseStreamSource(tk token, v interface{}, lt *token) (*StreamSource, error) {
+	switch sv := v.(type) {
+	case string:
+		return &StreamSource{Name: sv}, nil
+	case map[string]interface{}:
+		src := &StreamSource{}
+		for k, fv := range sv {
+			ftk, fv := unwrapValue(fv, lt)
+			s, ok := fv.(string)
+			if !ok {
+				return nil, &configErr{ftk, fmt.Sprintf("Expected a string for %q of the stream source, got %T", k, fv)}
+			}
+			switch strings.ToLower(k) {
+			case "name", "stream":
+				src.Name = s
+			case "filter_subject", "filter":
+				src.FilterSubject = s
+			case "api_prefix", "api":
+				src.APIPrefix = s
+			default:
+				return nil, &configErr{ftk, fmt.Sprintf("Unknown field %q of the stream source", k)}
+			}
+		}
+		return src, nil
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected a name or a map to define the stream source, got %T", v)}
+	}
+}
+
+// parseDuplicateWindows parses the duplicate detection windows of an
+// account, either a duration for all the subjects or a map of durations
+// per subject.
+func parseDuplicateWindows(v interface{}, errors, warnings *[]error) (map[string]time.Duration, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	windows := make(map[string]time.Duration)
+	switch dv := v.(type) {
+	case string:
+		windows[fwcs] = parseDuration("duplicate_window", tk, dv, errors, warnings)
+	case map[string]interface{}:
+		for subject, mv := range dv {
+			tk, mv = unwrapValue(mv, &lt)
+			if !IsValidSubject(subject) {
+				return nil, &configErr{tk, fmt.Sprintf("invalid duplicate_window subject %q", subject)}
+			}
+			windows[subject] = parseDuration("duplicate_window", tk, mv, errors, warnings)
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected map or string to define duplicate_window, got %T", v)}
+	}
+	for subject, window := range windows {
+		if window <= 0 {
+			return nil, &configErr{tk, fmt.Sprintf("invalid duplicate_window for %q: %v", subject, window)}
 		}
 	}
-
-	return nil
+	return windows, nil
 }
 
-// Parse the account exports
 func parseAccountExports(v interface{}, acc *Account, errors, warnings *[]error) ([]*export, []*export, error) {
 	var lt token
 	defer convertPanicToErrorList(&lt, errors)
@@ -1877,10 +4102,11 @@ func parseAccount(v map[string]interface{}, errors, warnings *[]error) (string,
 
 // Parse an export stream or service.
 // e.g.
-//   {stream: "public.>"} # No accounts means public.
-//   {stream: "synadia.private.>", accounts: [cncf, natsio]}
-//   {service: "pub.request"} # No accounts means public.
-//   {service: "pub.special.request", accounts: [nats.io]}
+//
+//	{stream: "public.>"} # No accounts means public.
+//	{stream: "synadia.private.>", accounts: [cncf, natsio]}
+//	{service: "pub.request"} # No accounts means public.
+//	{service: "pub.special.request", accounts: [nats.io]}
 func parseExportStreamOrService(v interface{}, errors, warnings *[]error) (*export, *export, error) {
 	var (
 		curStream  *export
@@ -2092,9 +4318,10 @@ func parseServiceLatency(root token, v interface{}) (l *serviceLatency, retErr e
 
 // Parse an import stream or service.
 // e.g.
-//   {stream: {account: "synadia", subject:"public.synadia"}, prefix: "imports.synadia"}
-//   {stream: {account: "synadia", subject:"synadia.private.*"}}
-//   {service: {account: "synadia", subject: "pub.special.request"}, to: "synadia.request"}
+//
+//	{stream: {account: "synadia", subject:"public.synadia"}, prefix: "imports.synadia"}
+//	{stream: {account: "synadia", subject:"synadia.private.*"}}
+//	{service: {account: "synadia", subject: "pub.special.request"}, to: "synadia.request"}
 func parseImportStreamOrService(v interface{}, errors, warnings *[]error) (*importStream, *importService, error) {
 	var (
 		curStream  *importStream
@@ -2135,10 +4362,7 @@ func parseImportStreamOrService(v interface{}, errors, warnings *[]error) (*impo
 				*errors = append(*errors, err)
 				continue
 			}
-			curStream = &importStream{an: accountName, sub: subject}
-			if pre != "" {
-				curStream.pre = pre
-			}
+			curStream = &importStream{an: accountName, sub: subject, pre: pre, to: to}
 		case "service":
 			if curStream != nil {
 				err := &configErr{tk, "Detected service but already saw a stream"}
@@ -2176,6 +4400,9 @@ func parseImportStreamOrService(v interface{}, errors, warnings *[]error) (*impo
 			if curService != nil {
 				curService.to = to
 			}
+			if curStream != nil {
+				curStream.to = to
+			}
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -2291,10 +4518,12 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 		}
 
 		var (
-			user  = &User{}
-			nkey  = &NkeyUser{}
-			perms *Permissions
-			err   error
+			user     = &User{}
+			nkey     = &NkeyUser{}
+			perms    *Permissions
+			networks *NetworkACL
+			validity *UserValidity
+			err      error
 		)
 		for k, v := range um {
 			// Also needs to unwrap first
@@ -2313,6 +4542,20 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 					*errors = append(*errors, err)
 					continue
 				}
+			case "networks":
+				networks, err = parseNetworkACL(tk, errors)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+			case "nbf", "not_before", "exp", "expires", "times", "locale":
+				if validity == nil {
+					validity = &UserValidity{}
+				}
+				if err := parseUserValidity(k, tk, v, validity, errors); err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -2336,6 +4579,9 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 			}
 		}
 
+		nkey.Networks, user.Networks = networks, networks
+		nkey.Validity, user.Validity = validity, validity
+
 		// Check to make sure we have at least an nkey or username <password> defined.
 		if nkey.Nkey == "" && user.Username == "" {
 			return nil, nil, &configErr{tk, "User entry requires a user"}
@@ -2356,6 +4602,283 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 	return keys, users, nil
 }
 
+// Helper function to parse the accounts revoked by the operator. Each entry
+// maps an account public key to the time up to which its JWTs are revoked,
+// either a date or a unix timestamp.
+func parseAccountRevocations(v interface{}, errors *[]error) (map[string]int64, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	rm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected account_revocations to be a map, got %T", v)}
+	}
+	revocations := make(map[string]int64, len(rm))
+	for pub, t := range rm {
+		tk, t = unwrapValue(t, &lt)
+		switch t := t.(type) {
+		case time.Time:
+			revocations[pub] = t.Unix()
+		case int64:
+			revocations[pub] = t
+		default:
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected revocation time to be a date or a unix timestamp, got %T", t)})
+		}
+	}
+	return revocations, nil
+}
+
+// Helper function to parse a validity constraint of a user entry.
+func parseUserValidity(k string, tk token, v interface{}, uv *UserValidity, errors *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	parseTime := func(v interface{}) (time.Time, error) {
+		switch t := v.(type) {
+		case time.Time:
+			return t, nil
+		case int64:
+			return time.Unix(t, 0), nil
+		case string:
+			return time.Parse(time.RFC3339, t)
+		}
+		return time.Time{}, fmt.Errorf("expected a date, got %T", v)
+	}
+	var err error
+	switch strings.ToLower(k) {
+	case "nbf", "not_before":
+		uv.NotBefore, err = parseTime(v)
+	case "exp", "expires":
+		uv.Expires, err = parseTime(v)
+	case "locale":
+		uv.Locale = v.(string)
+		if _, err = time.LoadLocation(uv.Locale); err != nil {
+			err = fmt.Errorf("invalid locale %q: %v", uv.Locale, err)
+		}
+	case "times":
+		ranges, ok := v.([]interface{})
+		if !ok {
+			return &configErr{tk, fmt.Sprintf("Expected times to be an array, got %T", v)}
+		}
+		uv.Times = nil
+		for _, r := range ranges {
+			rtk, r := unwrapValue(r, &lt)
+			rm, ok := r.(map[string]interface{})
+			if !ok {
+				return &configErr{rtk, fmt.Sprintf("Expected time range to be a map, got %T", r)}
+			}
+			var tr TimeRange
+			for rk, rv := range rm {
+				rtk, rv = unwrapValue(rv, &lt)
+				switch strings.ToLower(rk) {
+				case "start":
+					tr.Start = rv.(string)
+				case "end":
+					tr.End = rv.(string)
+				default:
+					return &unknownConfigFieldErr{field: rk, configErr: configErr{token: rtk}}
+				}
+			}
+			for _, s := range []string{tr.Start, tr.End} {
+				if _, err := parseTimeOfDay(s); err != nil {
+					return &configErr{rtk, err.Error()}
+				}
+			}
+			uv.Times = append(uv.Times, tr)
+		}
+	}
+	if err != nil {
+		return &configErr{tk, fmt.Sprintf("Error parsing %s: %v", k, err)}
+	}
+	return nil
+}
+
+// Helper function to parse the networks connections are accepted from,
+// either a list of allowed networks or a map with allow and deny lists.
+func parseNetworkACL(mv interface{}, errors *[]error) (*NetworkACL, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, mv := unwrapValue(mv, &lt)
+	list := func(tk token, v interface{}) ([]string, error) {
+		var l []string
+		switch v := v.(type) {
+		case string:
+			l = append(l, v)
+		case []interface{}:
+			for _, e := range v {
+				tk, e = unwrapValue(e, &lt)
+				s, ok := e.(string)
+				if !ok {
+					return nil, &configErr{tk, fmt.Sprintf("Expected network to be a string, got %T", e)}
+				}
+				l = append(l, s)
+			}
+		default:
+			return nil, &configErr{tk, fmt.Sprintf("Expected network or list of networks, got %T", v)}
+		}
+		for _, s := range l {
+			if _, err := parseNetwork(s); err != nil {
+				return nil, &configErr{tk, err.Error()}
+			}
+		}
+		return l, nil
+	}
+	n := &NetworkACL{}
+	var err error
+	nm, ok := mv.(map[string]interface{})
+	if !ok {
+		if n.Allow, err = list(tk, mv); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	for k, v := range nm {
+		tk, v = unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "allow":
+			n.Allow, err = list(tk, v)
+		case "deny":
+			n.Deny, err = list(tk, v)
+		default:
+			if !tk.IsUsedVariable() {
+				err = &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+			}
+		}
+		if err != nil {
+			*errors = append(*errors, err)
+			err = nil
+		}
+	}
+	return n, nil
+}
+
+// parseSubjectOwners parses the list of the subjects owned by servers of
+// the cluster, each entry with the list of subjects and of server names.
+func parseSubjectOwners(v interface{}, errors *[]error) ([]*SubjectOwnership, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	list := func(tk token, v interface{}) ([]string, error) {
+		var l []string
+		switch v := v.(type) {
+		case string:
+			l = append(l, v)
+		case []interface{}:
+			for _, e := range v {
+				tk, e = unwrapValue(e, &lt)
+				s, ok := e.(string)
+				if !ok {
+					return nil, &configErr{tk, fmt.Sprintf("Expected a string, got %T", e)}
+				}
+				l = append(l, s)
+			}
+		default:
+			return nil, &configErr{tk, fmt.Sprintf("Expected a string or a list of strings, got %T", v)}
+		}
+		return l, nil
+	}
+	entries, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected subject_owners to be a list, got %T", v)}
+	}
+	var owners []*SubjectOwnership
+	for _, e := range entries {
+		tk, e := unwrapValue(e, &lt)
+		em, ok := e.(map[string]interface{})
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected subject owners to be a map, got %T", e)})
+			continue
+		}
+		so := &SubjectOwnership{}
+		for k, v := range em {
+			tk, v := unwrapValue(v, &lt)
+			var err error
+			switch strings.ToLower(k) {
+			case "subjects":
+				so.Subjects, err = list(tk, v)
+			case "servers":
+				so.Servers, err = list(tk, v)
+			default:
+				if !tk.IsUsedVariable() {
+					err = &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+				}
+			}
+			if err != nil {
+				*errors = append(*errors, err)
+			}
+		}
+		owners = append(owners, so)
+	}
+	return owners, nil
+}
+
+// parseAcceptRate parses the rate of the connections accepted by a listener,
+// either as a number of connections per second or as a map with the rate,
+// the burst and the overflow policy.
+func parseAcceptRate(mv interface{}, errors *[]error) (*AcceptRateOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, mv := unwrapValue(mv, &lt)
+	number := func(tk token, v interface{}) (float64, error) {
+		switch v := v.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+		return 0, &configErr{tk, fmt.Sprintf("Expected a number, got %T", v)}
+	}
+	ar := &AcceptRateOpts{}
+	nm, ok := mv.(map[string]interface{})
+	if !ok {
+		rate, err := number(tk, mv)
+		if err != nil {
+			return nil, err
+		}
+		ar.Rate = rate
+		return ar, nil
+	}
+	for k, v := range nm {
+		tk, v = unwrapValue(v, &lt)
+		var err error
+		switch strings.ToLower(k) {
+		case "rate":
+			ar.Rate, err = number(tk, v)
+		case "burst":
+			ar.Burst = int(v.(int64))
+		case "overflow":
+			ar.Overflow = strings.ToLower(v.(string))
+		default:
+			if !tk.IsUsedVariable() {
+				err = &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+			}
+		}
+		if err != nil {
+			*errors = append(*errors, err)
+		}
+	}
+	return ar, nil
+}
+
 // Helper function to parse user/account permissions
 func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissions, error) {
 	var (
@@ -2383,6 +4906,16 @@ func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissio
 				*errors = append(*errors, err)
 				continue
 			}
+			if perms != nil {
+				if err := checkNoQueueInPublish(perms.Allow); err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				if err := checkNoQueueInPublish(perms.Deny); err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+			}
 			p.Publish = perms
 		case "sub", "subscribe", "export":
 			perms, err := parseVariablePermissions(mv, errors, warnings)
@@ -2575,13 +5108,29 @@ func parseSubjectPermission(v interface{}, errors, warnings *[]error) (*SubjectP
 // Helper function to validate subjects, etc for account permissioning.
 func checkSubjectArray(sa []string) error {
 	for _, s := range sa {
-		if !IsValidSubject(s) {
+		// Entries can be in the form "subject queue" to restrict
+		// subscriptions to the given queue group(s).
+		subj, _, err := splitSubjectQueue(s)
+		if err != nil {
+			return err
+		}
+		if !IsValidSubject(string(subj)) {
 			return fmt.Errorf("subject %q is not a valid subject", s)
 		}
 	}
 	return nil
 }
 
+// Queue groups only make sense for subscribe permissions.
+func checkNoQueueInPublish(sa []string) error {
+	for _, s := range sa {
+		if _, q, _ := splitSubjectQueue(s); q != nil {
+			return fmt.Errorf("queue group not allowed in publish permission %q", s)
+		}
+	}
+	return nil
+}
+
 // PrintTLSHelpAndDie prints TLS usage and exits.
 func PrintTLSHelpAndDie() {
 	fmt.Printf("%s", tlsUsage)
@@ -2604,6 +5153,33 @@ func parseCipher(cipherName string) (uint16, error) {
 	return cipher, nil
 }
 
+// parseTLSVersion accepts versions such as "1.2" or "TLS1.2".
+func parseTLSVersion(v interface{}) (uint16, error) {
+	var name string
+	switch v := v.(type) {
+	case string:
+		name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "TLS")
+		name = strings.TrimLeft(name, "V ")
+	case float64:
+		name = strconv.FormatFloat(v, 'f', 1, 64)
+	case int64:
+		name = strconv.FormatFloat(float64(v), 'f', 1, 64)
+	}
+	version, exists := tlsVersionMap[name]
+	if !exists {
+		return 0, fmt.Errorf("unrecognized tls version %v", v)
+	}
+	return version, nil
+}
+
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	auth, exists := clientAuthMap[strings.ToLower(mode)]
+	if !exists {
+		return 0, fmt.Errorf("unrecognized client_auth mode %q", mode)
+	}
+	return auth, nil
+}
+
 func parseCurvePreferences(curveName string) (tls.CurveID, error) {
 	curve, exists := curvePreferenceMap[curveName]
 	if !exists {
@@ -2612,8 +5188,9 @@ func parseCurvePreferences(curveName string) (tls.CurveID, error) {
 	return curve, nil
 }
 
-// Helper function to parse TLS configs.
-func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
+// Helper function to parse TLS configs. Some settings only apply to
+// the client listener, as indicated by isClientCtx.
+func parseTLS(v interface{}, isClientCtx bool) (t *TLSConfigOpts, retErr error) {
 	var (
 		tlsm map[string]interface{}
 		tc   = TLSConfigOpts{}
@@ -2621,7 +5198,7 @@ func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
 	)
 	defer convertPanicToError(&lt, &retErr)
 
-	_, v = unwrapValue(v, &lt)
+	ttk, v := unwrapValue(v, &lt)
 	tlsm = v.(map[string]interface{})
 	for mk, mv := range tlsm {
 		tk, mv := unwrapValue(mv, &lt)
@@ -2700,6 +5277,69 @@ func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
 				at = mv
 			}
 			tc.Timeout = at
+		case "reload_interval":
+			switch mv := mv.(type) {
+			case int64:
+				tc.ReloadInterval = time.Duration(mv) * time.Second
+			case string:
+				dur, err := time.ParseDuration(mv)
+				if err != nil {
+					return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, invalid 'reload_interval': %v", err)}
+				}
+				tc.ReloadInterval = dur
+			default:
+				return nil, &configErr{tk, "error parsing tls config, expected 'reload_interval' to be a duration"}
+			}
+			if tc.ReloadInterval < 0 {
+				return nil, &configErr{tk, "error parsing tls config, 'reload_interval' cannot be negative"}
+			}
+		case "min_version", "max_version":
+			version, err := parseTLSVersion(mv)
+			if err != nil {
+				return nil, &configErr{tk, err.Error()}
+			}
+			if strings.ToLower(mk) == "min_version" {
+				tc.MinVersion = version
+			} else {
+				tc.MaxVersion = version
+			}
+		case "handshake_first", "first":
+			if !isClientCtx {
+				return nil, &configErr{tk, "error parsing tls config, 'handshake_first' is only supported for client connections"}
+			}
+			switch mv := mv.(type) {
+			case bool:
+				tc.HandshakeFirst = mv
+			case string:
+				switch strings.ToLower(mv) {
+				case "true", "on":
+					tc.HandshakeFirst = true
+				case "false", "off":
+					tc.HandshakeFirst = false
+				case "auto", "auto_fallback":
+					tc.HandshakeFirst = true
+					tc.FallbackDelay = DEFAULT_TLS_HANDSHAKE_FIRST_FALLBACK_DELAY
+				default:
+					dur, err := time.ParseDuration(mv)
+					if err != nil || dur <= 0 {
+						return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, invalid 'handshake_first' value %q", mv)}
+					}
+					tc.HandshakeFirst = true
+					tc.FallbackDelay = dur
+				}
+			default:
+				return nil, &configErr{tk, "error parsing tls config, expected 'handshake_first' to be a boolean or a fallback delay"}
+			}
+		case "client_auth":
+			mode, ok := mv.(string)
+			if !ok {
+				return nil, &configErr{tk, "error parsing tls config, expected 'client_auth' to be a string"}
+			}
+			auth, err := parseClientAuth(mode)
+			if err != nil {
+				return nil, &configErr{tk, err.Error()}
+			}
+			tc.ClientAuth = auth
 		default:
 			return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, unknown field [%q]", mk)}
 		}
@@ -2715,9 +5355,28 @@ func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
 		tc.CurvePreferences = defaultCurvePreferences()
 	}
 
+	if err := tc.validate(); err != nil {
+		return nil, &configErr{ttk, err.Error()}
+	}
+
 	return &tc, nil
 }
 
+func (tc *TLSConfigOpts) validate() error {
+	minVersion := tc.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	if tc.MaxVersion != 0 && tc.MaxVersion < minVersion {
+		return fmt.Errorf("error parsing tls config, 'max_version' %s is lower than 'min_version' %s",
+			tlsVersion(tc.MaxVersion), tlsVersion(minVersion))
+	}
+	if tc.Verify && tc.ClientAuth != tls.NoClientCert && tc.ClientAuth != tls.RequireAndVerifyClientCert {
+		return fmt.Errorf("error parsing tls config, 'verify' conflicts with 'client_auth'")
+	}
+	return nil
+}
+
 // GenTLSConfig loads TLS related configuration parameters.
 func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 	// Create the tls.Config from our options before including the certs.
@@ -2725,10 +5384,15 @@ func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 	// FIXME(dlc) change if ARM based.
 	config := tls.Config{
 		MinVersion:               tls.VersionTLS12,
+		MaxVersion:               tc.MaxVersion,
 		CipherSuites:             tc.Ciphers,
 		PreferServerCipherSuites: true,
 		CurvePreferences:         tc.CurvePreferences,
 		InsecureSkipVerify:       tc.Insecure,
+		ClientAuth:               tc.ClientAuth,
+	}
+	if tc.MinVersion != 0 {
+		config.MinVersion = tc.MinVersion
 	}
 
 	switch {
@@ -2738,13 +5402,9 @@ func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 		return nil, fmt.Errorf("missing 'cert_file' in TLS configuration")
 	case tc.CertFile != "" && tc.KeyFile != "":
 		// Now load in cert and private key
-		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
-		}
-		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		cert, err := loadCertificate(tc.CertFile, tc.KeyFile)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing certificate: %v", err)
+			return nil, err
 		}
 		config.Certificates = []tls.Certificate{cert}
 	}
@@ -2755,21 +5415,49 @@ func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 	}
 	// Add in CAs if applicable.
 	if tc.CaFile != "" {
-		rootPEM, err := ioutil.ReadFile(tc.CaFile)
-		if err != nil || rootPEM == nil {
+		pool, err := loadCAPool(tc.CaFile)
+		if err != nil {
 			return nil, err
 		}
-		pool := x509.NewCertPool()
-		ok := pool.AppendCertsFromPEM(rootPEM)
-		if !ok {
-			return nil, fmt.Errorf("failed to parse root ca certificate")
-		}
 		config.ClientCAs = pool
 	}
+	// Pick up rotated files without a config reload.
+	if tc.ReloadInterval > 0 {
+		watchTLSFiles(tc, &config)
+	}
 
 	return &config, nil
 }
 
+func loadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	// The key may be kept by an external provider.
+	if p, u := keyProviderFor(keyFile); p != nil {
+		return loadProviderCertificate(certFile, p, u)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	return cert, nil
+}
+
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+	rootPEM, err := ioutil.ReadFile(caFile)
+	if err != nil || rootPEM == nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	ok := pool.AppendCertsFromPEM(rootPEM)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse root ca certificate")
+	}
+	return pool, nil
+}
+
 // MergeOptions will merge two options giving preference to the flagOpts
 // if the item is present.
 func MergeOptions(fileOpts, flagOpts *Options) *Options {
@@ -2949,6 +5637,9 @@ func getInterfaceIPs() ([]net.IP, error) {
 
 func setBaselineOptions(opts *Options) {
 	// Setup non-standard Go defaults
+	if ot := &opts.OpenTelemetry; ot.Endpoint != _EMPTY_ && ot.Sampling == 0 && len(ot.Accounts) == 0 {
+		ot.Sampling = 100
+	}
 	if opts.Host == "" {
 		opts.Host = DEFAULT_HOST
 	}
@@ -2971,6 +5662,9 @@ func setBaselineOptions(opts *Options) {
 	if opts.MaxPingsOut == 0 {
 		opts.MaxPingsOut = DEFAULT_PING_MAX_OUT
 	}
+	if opts.RTTInterval == 0 {
+		opts.RTTInterval = DEFAULT_RTT_MEASUREMENT_INTERVAL
+	}
 	if opts.TLSTimeout == 0 {
 		opts.TLSTimeout = float64(TLS_TIMEOUT) / float64(time.Second)
 	}
@@ -3097,6 +5791,8 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.StringVar(&configFile, "c", "", "Configuration file.")
 	fs.StringVar(&configFile, "config", "", "Configuration file.")
 	fs.BoolVar(&opts.CheckConfig, "t", false, "Check configuration and exit.")
+	fs.BoolVar(&opts.CheckConfig, "config-check", false, "Check configuration and exit.")
+	fs.BoolVar(&opts.PrintConfig, "check-config", false, "Check configuration, print it fully resolved and exit.")
 	fs.StringVar(&signal, "sl", "", "Send signal to nats-server process (stop, quit, reopen, reload)")
 	fs.StringVar(&signal, "signal", "", "Send signal to nats-server process (stop, quit, reopen, reload)")
 	fs.StringVar(&opts.PidFile, "P", "", "File to store process pid.")
@@ -3203,6 +5899,10 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 		}
 	})
 
+	if opts.PrintConfig {
+		opts.CheckConfig = true
+	}
+
 	// Process signal control.
 	if signal != "" {
 		if err := processSignal(signal); err != nil {
@@ -3224,6 +5924,12 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 			// If we get here we only have warnings and can still continue
 			fmt.Fprint(os.Stderr, err)
 		} else if opts.CheckConfig {
+			// Also report options that parse fine but can not be used together.
+			vopts := opts.Clone()
+			setBaselineOptions(vopts)
+			if err := validateOptions(vopts); err != nil {
+				return nil, fmt.Errorf("%s: %v", configFile, err)
+			}
 			// Report configuration file syntax test was successful and exit.
 			return opts, nil
 		}
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
@@ -49,6 +50,7 @@ func TestDefaultOptions(t *testing.T) {
 		HTTPHost:         DEFAULT_HOST,
 		PingInterval:     DEFAULT_PING_INTERVAL,
 		MaxPingsOut:      DEFAULT_PING_MAX_OUT,
+		RTTInterval:      DEFAULT_RTT_MEASUREMENT_INTERVAL,
 		TLSTimeout:       float64(TLS_TIMEOUT) / float64(time.Second),
 		AuthTimeout:      float64(AUTH_TIMEOUT) / float64(time.Second),
 		MaxControlLine:   MAX_CONTROL_LINE_SIZE,
@@ -237,6 +239,110 @@ func TestTLSConfigFile(t *testing.T) {
 	}
 }
 
+func TestTLSVersionsAndClientAuthConfig(t *testing.T) {
+	tmpl := `
+		listen: 127.0.0.1:-1
+		tls {
+			cert_file: "./configs/certs/server.pem"
+			key_file: "./configs/certs/key.pem"
+			%s
+		}
+		leafnodes {
+			listen: 127.0.0.1:-1
+			tls {
+				cert_file: "./configs/certs/server.pem"
+				key_file: "./configs/certs/key.pem"
+				min_version: 1.3
+			}
+		}
+	`
+	for _, test := range []struct {
+		name       string
+		content    string
+		minVersion uint16
+		maxVersion uint16
+		clientAuth tls.ClientAuthType
+		err        string
+	}{
+		{"defaults", "", tls.VersionTLS12, 0, tls.NoClientCert, ""},
+		{"versions", `min_version: "TLS1.2", max_version: "1.3"`, tls.VersionTLS12, tls.VersionTLS13, tls.NoClientCert, ""},
+		{"number", `min_version: 1.3`, tls.VersionTLS13, 0, tls.NoClientCert, ""},
+		{"client auth", `client_auth: "verify_if_given"`, tls.VersionTLS12, 0, tls.VerifyClientCertIfGiven, ""},
+		{"verify", `verify: true, client_auth: "require_and_verify"`, tls.VersionTLS12, 0, tls.RequireAndVerifyClientCert, ""},
+		{"bad version", `min_version: "1.4"`, 0, 0, 0, "unrecognized tls version"},
+		{"max below min", `max_version: "1.1"`, 0, 0, 0, "lower than 'min_version'"},
+		{"bad client auth", `client_auth: "always"`, 0, 0, 0, "unrecognized client_auth mode"},
+		{"conflict", `verify: true, client_auth: "request"`, 0, 0, 0, "conflicts with 'client_auth'"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, test.content)))
+			defer os.Remove(conf)
+			opts, err := ProcessConfigFile(conf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error processing config: %v", err)
+			}
+			tc := opts.TLSConfig
+			if tc.MinVersion != test.minVersion || tc.MaxVersion != test.maxVersion || tc.ClientAuth != test.clientAuth {
+				t.Fatalf("Unexpected min=%x max=%x auth=%v", tc.MinVersion, tc.MaxVersion, tc.ClientAuth)
+			}
+			// Each listener has its own policy.
+			if v := opts.LeafNode.TLSConfig.MinVersion; v != tls.VersionTLS13 {
+				t.Fatalf("Unexpected leafnode min version %x", v)
+			}
+		})
+	}
+
+	// Routes and gateways always verify the certificates of their peers.
+	conf := createConfFile(t, []byte(`
+		cluster {
+			listen: 127.0.0.1:-1
+			tls {
+				cert_file: "./configs/certs/server.pem"
+				key_file: "./configs/certs/key.pem"
+				client_auth: "request"
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "can only be require_and_verify") {
+		t.Fatalf("Expected error about client_auth, got %v", err)
+	}
+}
+
+func TestTLSMinVersionEnforced(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		https: 127.0.0.1:-1
+		tls {
+			cert_file: "./configs/certs/server.pem"
+			key_file: "./configs/certs/key.pem"
+			min_version: "1.3"
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	addr := s.MonitorAddr().String()
+	if _, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Fatal("Expected handshake with TLS 1.2 to fail")
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error on handshake: %v", err)
+	}
+	defer conn.Close()
+	if v := conn.ConnectionState().Version; v != tls.VersionTLS13 {
+		t.Fatalf("Expected TLS 1.3, got %s", tlsVersion(v))
+	}
+}
+
 func TestMergeOverrides(t *testing.T) {
 	golden := &Options{
 		ConfigFile:     "./configs/test.conf",
@@ -1190,6 +1296,52 @@ func TestPingIntervalNew(t *testing.T) {
 	}
 }
 
+func TestPingIntervalPerListener(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		ping_interval: "2m"
+		ping_max: 2
+		cluster { port: -1, ping_interval: "30s", ping_max: 3 }
+		gateway { name: "A", port: -1, ping_interval: "1m" }
+		leafnodes { port: -1, ping_max: 5 }
+		accounts {
+			MOBILE { ping_interval: "10m", ping_max: 4 }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config file: %v", err)
+	}
+	var acc *Account
+	for _, a := range opts.Accounts {
+		if a.Name == "MOBILE" {
+			acc = a
+		}
+	}
+	if acc == nil {
+		t.Fatal("Expected account MOBILE")
+	}
+	for _, test := range []struct {
+		name        string
+		c           *client
+		interval    time.Duration
+		maxPingsOut int
+	}{
+		{"client", &client{kind: CLIENT}, 2 * time.Minute, 2},
+		{"account", &client{kind: CLIENT, acc: acc}, 10 * time.Minute, 4},
+		{"route", &client{kind: ROUTER}, 30 * time.Second, 3},
+		{"gateway", &client{kind: GATEWAY}, time.Minute, 2},
+		{"leafnode", &client{kind: LEAF}, 2 * time.Minute, 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d, max := test.c.pingPolicy(opts)
+			if d != test.interval || max != test.maxPingsOut {
+				t.Fatalf("Expected %v and %d, got %v and %d", test.interval, test.maxPingsOut, d, max)
+			}
+		})
+	}
+}
+
 func TestOptionsProcessConfigFile(t *testing.T) {
 	// Create options with default values of Debug and Trace
 	// that are the opposite of what is in the config file.
@@ -2460,3 +2612,183 @@ func TestExpandPath(t *testing.T) {
 		})
 	}
 }
+
+func TestParseReconnectDelays(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		reconnect_min_delay: "250ms"
+		reconnect_max_delay: "5s"
+	`))
+	defer os.Remove(conf)
+	opts := &Options{}
+	if err := opts.ProcessConfigFile(conf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.ReconnectMinDelay != 250*time.Millisecond {
+		t.Fatalf("Expected reconnect min delay to be 250ms, got %v", opts.ReconnectMinDelay)
+	}
+	if opts.ReconnectMaxDelay != 5*time.Second {
+		t.Fatalf("Expected reconnect max delay to be 5s, got %v", opts.ReconnectMaxDelay)
+	}
+}
+
+func TestQueuePermissionsConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		authorization {
+			users = [
+				{user: worker, password: pwd, permissions: {subscribe: {allow: ["orders.> v1-workers"]}}}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(opts.Users) != 1 {
+		t.Fatalf("Expected 1 user, got %d", len(opts.Users))
+	}
+	sub := opts.Users[0].Permissions.Subscribe
+	if sub == nil || len(sub.Allow) != 1 || sub.Allow[0] != "orders.> v1-workers" {
+		t.Fatalf("Unexpected subscribe permissions: %+v", sub)
+	}
+
+	for _, test := range []struct {
+		name  string
+		perms string
+		err   string
+	}{
+		{"too many fields", `subscribe: {allow: ["orders.> v1 v2"]}`, "invalid subject-queue"},
+		{"invalid subject", `subscribe: {deny: ["orders..new v1"]}`, "is not a valid subject"},
+		{"queue in publish", `publish: {allow: ["orders.> v1"]}`, "queue group not allowed"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				authorization {
+					users = [
+						{user: worker, password: pwd, permissions: {%s}}
+					]
+				}
+			`, test.perms)))
+			defer os.Remove(conf)
+			if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestFlushOptsConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		flush {
+			mode: latency
+			write_deadline: "500ms"
+		}
+		cluster {
+			port: -1
+			flush {
+				mode: throughput
+				max_coalesce: 256KB
+				interval: "2ms"
+			}
+		}
+		gateway {
+			name: "A"
+			port: -1
+			flush: {mode: "Throughput"}
+		}
+		leafnodes {
+			port: -1
+			flush: {max_coalesce: 1024}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, test := range []struct {
+		name     string
+		got      FlushOpts
+		expected FlushOpts
+	}{
+		{"client", opts.Flush, FlushOpts{Mode: FlushModeLatency, WriteDeadline: 500 * time.Millisecond}},
+		{"cluster", opts.Cluster.Flush, FlushOpts{Mode: FlushModeThroughput, MaxCoalesce: 256 * 1024, Interval: 2 * time.Millisecond}},
+		{"gateway", opts.Gateway.Flush, FlushOpts{Mode: FlushModeThroughput}},
+		{"leafnode", opts.LeafNode.Flush, FlushOpts{MaxCoalesce: 1024}},
+	} {
+		if test.got != test.expected {
+			t.Fatalf("Expected %s flush options to be %+v, got %+v", test.name, test.expected, test.got)
+		}
+	}
+
+	for _, test := range []struct {
+		name  string
+		flush string
+		err   string
+	}{
+		{"bad mode", `mode: fast`, "invalid flush mode"},
+		{"small coalesce", `max_coalesce: 10`, "invalid max_coalesce"},
+		{"bad interval", `interval: "abc"`, "error parsing interval"},
+		{"unknown field", `foo: bar`, "unknown field"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf("flush {%s}", test.flush)))
+			defer os.Remove(conf)
+			if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestConfigCheckPrintResolved(t *testing.T) {
+	defer func() { FlagSnapshot = nil }()
+
+	os.Setenv("__NATS_TEST_HOST__", "127.0.0.1")
+	defer os.Unsetenv("__NATS_TEST_HOST__")
+
+	inc := createConfFile(t, []byte(`max_payload: 2048`))
+	defer os.Remove(inc)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		port: 4222
+		listen: "${__NATS_TEST_HOST__}:${port}"
+		include %q
+	`, filepath.Base(inc))))
+	defer os.Remove(conf)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts, err := ConfigureOptions(fs, []string{"--check-config", "-c", conf}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Error on configure: %v", err)
+	}
+	if !opts.CheckConfig || !opts.PrintConfig {
+		t.Fatalf("Expected config to be checked and printed, got %v and %v", opts.CheckConfig, opts.PrintConfig)
+	}
+	if opts.Host != "127.0.0.1" || opts.Port != 4222 || opts.MaxPayload != 2048 {
+		t.Fatalf("Unexpected options: %v:%v %v", opts.Host, opts.Port, opts.MaxPayload)
+	}
+
+	var buf bytes.Buffer
+	if err := PrintResolvedConfig(&buf, conf); err != nil {
+		t.Fatalf("Error printing config: %v", err)
+	}
+	expected := `{
+  "listen": "127.0.0.1:4222",
+  "max_payload": 2048,
+  "port": 4222
+}
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	// The output can be used as a configuration file as well.
+	resolved := createConfFile(t, buf.Bytes())
+	defer os.Remove(resolved)
+	ropts, err := ProcessConfigFile(resolved)
+	if err != nil {
+		t.Fatalf("Error processing resolved config: %v", err)
+	}
+	if ropts.Host != opts.Host || ropts.Port != opts.Port || ropts.MaxPayload != opts.MaxPayload {
+		t.Fatalf("Unexpected options: %v:%v %v", ropts.Host, ropts.Port, ropts.MaxPayload)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Header carrying the W3C trace context.
+	traceParentHdr = "traceparent"
+	// Length of a version 00 traceparent value.
+	traceParentLen = 55
+
+	// Defaults for the OpenTelemetry exporter.
+	defaultOTelServiceName    = "nats-server"
+	defaultOTelExportInterval = 5 * time.Second
+	// Maximum number of spans buffered between two exports. Spans are
+	// dropped past that so that an unreachable collector does not make
+	// the server grow unbounded.
+	maxOTelPendingSpans = 16384
+
+	// OTLP span kinds.
+	otlpSpanKindProducer = 4
+	otlpSpanKindConsumer = 5
+)
+
+// otlpSpan is a span in the OTLP/HTTP JSON encoding.
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func otlpString(key, value string) otlpAttr {
+	return otlpAttr{key, map[string]string{"stringValue": value}}
+}
+
+func otlpInt(key string, value int64) otlpAttr {
+	return otlpAttr{key, map[string]string{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func newSpanID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// otelExporter buffers the spans created by the server and periodically
+// exports them to the collector.
+type otelExporter struct {
+	mu      sync.Mutex
+	spans   []*otlpSpan
+	dropped uint64
+	client  *http.Client
+}
+
+// Returns true if spans should be created for the messages carrying a
+// trace context.
+func (s *Server) otelEnabled() bool {
+	return atomic.LoadInt32(&s.otelOn) == 1
+}
+
+// startOTel starts the exporter if an OpenTelemetry collector is configured.
+func (s *Server) startOTel() {
+	opts := s.getOpts()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if opts.OpenTelemetry.Endpoint == _EMPTY_ {
+		atomic.StoreInt32(&s.otelOn, 0)
+		return
+	}
+	atomic.StoreInt32(&s.otelOn, 1)
+	if s.otel != nil {
+		return
+	}
+	e := &otelExporter{client: &http.Client{Timeout: 10 * time.Second}}
+	s.otel = e
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		t := time.NewTimer(s.otelExportInterval())
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.exportSpans(e)
+				t.Reset(s.otelExportInterval())
+			case <-s.quitCh:
+				// Send what we have before exiting.
+				s.exportSpans(e)
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) otelExportInterval() time.Duration {
+	if d := s.getOpts().OpenTelemetry.ExportInterval; d > 0 {
+		return d
+	}
+	return defaultOTelExportInterval
+}
+
+// Returns the percentage of the messages of the account that are traced.
+func (o *OpenTelemetryOpts) sampling(account string) int {
+	if r, ok := o.Accounts[account]; ok {
+		return r
+	}
+	return o.Sampling
+}
+
+// Queues spans for the next export.
+func (e *otelExporter) add(spans ...*otlpSpan) {
+	e.mu.Lock()
+	if len(e.spans)+len(spans) > maxOTelPendingSpans {
+		e.dropped += uint64(len(spans))
+	} else {
+		e.spans = append(e.spans, spans...)
+	}
+	e.mu.Unlock()
+}
+
+// exportSpans sends the pending spans to the collector.
+func (s *Server) exportSpans(e *otelExporter) {
+	e.mu.Lock()
+	spans, dropped := e.spans, e.dropped
+	e.spans, e.dropped = nil, 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		s.Warnf("Dropped %d OpenTelemetry spans", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	opts := s.getOpts().OpenTelemetry
+	if opts.Endpoint == _EMPTY_ {
+		return
+	}
+	name := opts.ServiceName
+	if name == _EMPTY_ {
+		name = defaultOTelServiceName
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttr{
+					otlpString("service.name", name),
+					otlpString("service.instance.id", s.ID()),
+					otlpString("service.version", VERSION),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "nats-server", "version": VERSION},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		s.Errorf("Error marshaling OpenTelemetry spans: %v", err)
+		return
+	}
+	resp, err := e.client.Post(opts.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		s.Warnf("Error exporting OpenTelemetry spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		s.Warnf("Error exporting OpenTelemetry spans: %s", resp.Status)
+	}
+}
+
+// getHeader returns the value of the header key, compared without
+// regard to case, or nil if not present.
+func getHeader(key string, hdr []byte) []byte {
+	// Skip the status line.
+	i := bytes.Index(hdr, []byte(_CRLF_))
+	if i < 0 {
+		return nil
+	}
+	for hdr = hdr[i+2:]; len(hdr) > 0; {
+		line := hdr
+		if i = bytes.Index(hdr, []byte(_CRLF_)); i >= 0 {
+			line, hdr = hdr[:i], hdr[i+2:]
+		} else {
+			hdr = nil
+		}
+		if c := bytes.IndexByte(line, ':'); c > 0 && bytes.EqualFold(line[:c], []byte(key)) {
+			return bytes.TrimSpace(line[c+1:])
+		}
+	}
+	return nil
+}
+
+// Tracks the spans of a message with a trace context while it is processed.
+type otelTrace struct {
+	ingress *otlpSpan
+	egress  []*otlpSpan
+}
+
+// startOTelSpan checks if the message being processed carries a sampled
+// trace context and if so starts its ingress span. The parent id of the
+// trace context is replaced with the ingress span so that the spans of
+// the receivers and of the next servers are linked to it.
+func (c *client) startOTelSpan(msg []byte) {
+	if c.pa.hdr <= 0 || c.pa.hdr > len(msg) {
+		return
+	}
+	tp := getHeader(traceParentHdr, msg[:c.pa.hdr])
+	// Only version 00 is supported: 00-<trace-id>-<parent-id>-<flags>
+	if len(tp) != traceParentLen || tp[0] != '0' || tp[1] != '0' ||
+		tp[2] != '-' || tp[35] != '-' || tp[52] != '-' {
+		return
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], tp[53:55]); err != nil || flags[0]&1 == 0 {
+		return
+	}
+	c.mu.Lock()
+	ingress := c.msgTraceConn()
+	c.mu.Unlock()
+	account := ingress.Account
+	if c.kind == ROUTER || c.kind == GATEWAY {
+		account = string(c.pa.account)
+	}
+	opts := c.srv.getOpts().OpenTelemetry
+	if r := opts.sampling(account); r <= 0 || r < 100 && rand.Intn(100) >= r {
+		return
+	}
+	subject := string(c.pa.subject)
+	span := &otlpSpan{
+		TraceID:      string(tp[3:35]),
+		SpanID:       newSpanID(),
+		ParentSpanID: string(tp[36:52]),
+		Name:         subject + " receive",
+		Kind:         otlpSpanKindConsumer,
+		Start:        otlpTime(time.Now()),
+		Attributes: []otlpAttr{
+			otlpString("messaging.system", "nats"),
+			otlpString("messaging.destination.name", subject),
+			otlpString("messaging.operation", "receive"),
+			otlpInt("messaging.message.body.size", int64(len(msg)-c.pa.hdr-LEN_CR_LF)),
+			otlpString("nats.account", account),
+			otlpString("nats.connection.kind", ingress.Kind),
+			otlpInt("nats.connection.id", int64(ingress.CID)),
+		},
+	}
+	if ingress.Name != _EMPTY_ {
+		span.Attributes = append(span.Attributes, otlpString("nats.connection.name", ingress.Name))
+	}
+	copy(tp[36:52], span.SpanID)
+	c.otel = &otelTrace{ingress: span}
+}
+
+// addEgress adds a span for the delivery of the message to client.
+// Lock for client should be held.
+func (ot *otelTrace) addEgress(client *client, subject []byte) {
+	now := otlpTime(time.Now())
+	egress := client.msgTraceConn()
+	span := &otlpSpan{
+		TraceID:      ot.ingress.TraceID,
+		SpanID:       newSpanID(),
+		ParentSpanID: ot.ingress.SpanID,
+		Name:         string(subject) + " send",
+		Kind:         otlpSpanKindProducer,
+		Start:        now,
+		End:          now,
+		Attributes: []otlpAttr{
+			otlpString("messaging.system", "nats"),
+			otlpString("messaging.destination.name", string(subject)),
+			otlpString("messaging.operation", "publish"),
+			otlpString("nats.connection.kind", egress.Kind),
+			otlpInt("nats.connection.id", int64(egress.CID)),
+		},
+	}
+	if egress.Name != _EMPTY_ {
+		span.Attributes = append(span.Attributes, otlpString("nats.connection.name", egress.Name))
+	}
+	ot.egress = append(ot.egress, span)
+}
+
+// endOTelSpan ends the ingress span and queues the spans for export.
+func (c *client) endOTelSpan() {
+	ot := c.otel
+	c.otel = nil
+	ot.ingress.End = otlpTime(time.Now())
+	c.srv.mu.Lock()
+	e := c.srv.otel
+	c.srv.mu.Unlock()
+	if e != nil {
+		e.add(append([]*otlpSpan{ot.ingress}, ot.egress...)...)
+	}
+}
+
+// Validates the OpenTelemetry options.
+func validateOTelOptions(o *Options) error {
+	ot := &o.OpenTelemetry
+	if ot.Endpoint == _EMPTY_ {
+		return nil
+	}
+	if u, err := url.Parse(ot.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == _EMPTY_ {
+		return fmt.Errorf("opentelemetry endpoint must be an http or https URL, got %q", ot.Endpoint)
+	}
+	if ot.Sampling < 0 || ot.Sampling > 100 {
+		return fmt.Errorf("opentelemetry sampling must be between 0 and 100, got %d", ot.Sampling)
+	}
+	for name, r := range ot.Accounts {
+		if r < 0 || r > 100 {
+			return fmt.Errorf("opentelemetry sampling for account %q must be between 0 and 100, got %d", name, r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetHeader(t *testing.T) {
+	hdr := []byte("NATS/1.0\r\nFoo: bar\r\nTraceParent:  abc \r\n\r\n")
+	if v := getHeader("traceparent", hdr); string(v) != "abc" {
+		t.Fatalf("Expected %q, got %q", "abc", v)
+	}
+	if v := getHeader("foo", hdr); string(v) != "bar" {
+		t.Fatalf("Expected %q, got %q", "bar", v)
+	}
+	if v := getHeader("baz", hdr); v != nil {
+		t.Fatalf("Expected no value, got %q", v)
+	}
+}
+
+func TestOpenTelemetryOptions(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts OpenTelemetryOpts
+		err  string
+	}{
+		{"bad endpoint", OpenTelemetryOpts{Endpoint: "localhost:4318"}, "endpoint"},
+		{"bad sampling", OpenTelemetryOpts{Endpoint: "http://localhost:4318", Sampling: 101}, "sampling"},
+		{"bad account sampling", OpenTelemetryOpts{Endpoint: "http://localhost:4318", Accounts: map[string]int{"A": -1}}, "account"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.OpenTelemetry = test.opts
+			if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error about %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	conf := createConfFile(t, []byte(`
+		opentelemetry {
+			endpoint: "http://localhost:4318/v1/traces"
+			service_name: "edge"
+			accounts { A: 50, B: 0 }
+			export_interval: "1s"
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	ot := opts.OpenTelemetry
+	if ot.Endpoint != "http://localhost:4318/v1/traces" || ot.ServiceName != "edge" ||
+		ot.Accounts["A"] != 50 || ot.Accounts["B"] != 0 || ot.ExportInterval != time.Second {
+		t.Fatalf("Unexpected options: %+v", ot)
+	}
+	if ot.sampling("A") != 50 || ot.sampling("C") != 0 {
+		t.Fatalf("Unexpected samplings for %+v", ot)
+	}
+}
+
+func TestOpenTelemetrySpans(t *testing.T) {
+	var mu sync.Mutex
+	var spans []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{}
+				}
+			}
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		opentelemetry {
+			endpoint: "%s/v1/traces"
+			export_interval: "50ms"
+		}
+	`, collector.URL)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(c)
+		br.ReadString('\n')
+		c.Write([]byte("CONNECT {\"verbose\":false,\"headers\":true}\r\nPING\r\n"))
+		if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q", l)
+		}
+		return c, br
+	}
+	sc, sr := connect()
+	defer sc.Close()
+	sc.Write([]byte("SUB foo 1\r\nPING\r\n"))
+	sr.ReadString('\n')
+	pc, _ := connect()
+	defer pc.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	send := func(flags string) {
+		hdr := fmt.Sprintf("NATS/1.0\r\ntraceparent: 00-%s-%s-%s\r\n\r\n", traceID, parentID, flags)
+		pc.Write([]byte(fmt.Sprintf("HPUB foo %d %d\r\n%shello\r\n", len(hdr), len(hdr)+5, hdr)))
+	}
+	// Not sampled upstream, so not traced and the header is unchanged.
+	send("00")
+	send("01")
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		if l, _ := sr.ReadString('\n'); !strings.HasPrefix(l, "HMSG foo 1") {
+			t.Fatalf("Expected message, got %q", l)
+		}
+		sr.ReadString('\n')
+		tp, _ := sr.ReadString('\n')
+		sr.ReadString('\n')
+		sr.ReadString('\n')
+		ids = append(ids, strings.Split(strings.TrimSpace(tp), "-")[2])
+	}
+	if ids[0] != parentID || ids[1] == parentID {
+		t.Fatalf("Expected only the sampled message to get a new parent, got %v", ids)
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(spans) != 2 {
+			return fmt.Errorf("Expected 2 spans, got %d", len(spans))
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	ingress, egress := spans[0], spans[1]
+	if ingress["traceId"] != traceID || ingress["parentSpanId"] != parentID ||
+		ingress["spanId"] != ids[1] || ingress["name"] != "foo receive" {
+		t.Fatalf("Unexpected ingress span: %v", ingress)
+	}
+	if egress["traceId"] != traceID || egress["parentSpanId"] != ids[1] || egress["name"] != "foo send" {
+		t.Fatalf("Unexpected egress span: %v", egress)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+// SubjectOwnership declares that the subjects are owned by the named
+// servers of the cluster. The interest and the messages on these subjects
+// are only exchanged over the routes with an owner at either end, so the
+// other servers do not exchange them with each other. This reduces the
+// traffic of subjects scoped to a region to the servers of that region.
+type SubjectOwnership struct {
+	Subjects []string `json:"subjects"`
+	Servers  []string `json:"servers"`
+}
+
+func (so *SubjectOwnership) ownedBy(name string) bool {
+	for _, s := range so.Servers {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// prunedSubjects returns the owned subjects not exchanged with the route to
+// the named server, since neither this server nor the remote one own them.
+func prunedSubjects(o *Options, remoteName string) []string {
+	var pruned []string
+	for _, so := range o.Cluster.SubjectOwners {
+		if !so.ownedBy(o.ServerName) && !so.ownedBy(remoteName) {
+			pruned = append(pruned, so.Subjects...)
+		}
+	}
+	return pruned
+}
+
+// prunes returns true if the subject, or all the subjects it matches, are
+// owned by servers other than the ones at both ends of the route.
+func (r *route) prunes(subject string) bool {
+	for _, owned := range r.pruned {
+		if subjectIsSubsetMatch(subject, owned) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSubjectOwners checks the subjects owned by servers of the cluster.
+func validateSubjectOwners(o *Options) error {
+	if len(o.Cluster.SubjectOwners) == 0 {
+		return nil
+	}
+	// The owners are known by their names.
+	if o.ServerName == _EMPTY_ {
+		return fmt.Errorf("cluster subject_owners require a server_name")
+	}
+	for _, so := range o.Cluster.SubjectOwners {
+		if len(so.Subjects) == 0 || len(so.Servers) == 0 {
+			return fmt.Errorf("cluster subject_owners require subjects and servers")
+		}
+		for _, subj := range so.Subjects {
+			if !IsValidSubject(subj) {
+				return fmt.Errorf("cluster subject_owners subject %q is not valid", subj)
+			}
+		}
+	}
+	return nil
+}
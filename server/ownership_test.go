@@ -0,0 +1,149 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSubjectOwnersConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		server_name: eu-1
+		cluster {
+			listen: 127.0.0.1:-1
+			subject_owners: [
+				{subjects: ["eu.>", "orders.eu.*"], servers: ["eu-1", "eu-2"]}
+				{subjects: "us.>", servers: "us-1"}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	owners := opts.Cluster.SubjectOwners
+	if len(owners) != 2 || len(owners[0].Subjects) != 2 || len(owners[0].Servers) != 2 ||
+		owners[1].Subjects[0] != "us.>" || owners[1].Servers[0] != "us-1" {
+		t.Fatalf("Unexpected subject owners: %+v", owners)
+	}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Routes between servers other than the owners do not exchange them.
+	if pruned := prunedSubjects(opts, "us-1"); len(pruned) != 0 {
+		t.Fatalf("Unexpected pruned subjects: %v", pruned)
+	}
+	opts.ServerName = "ap-1"
+	if pruned := prunedSubjects(opts, "eu-2"); len(pruned) != 1 || pruned[0] != "us.>" {
+		t.Fatalf("Unexpected pruned subjects: %v", pruned)
+	}
+	r := &route{pruned: prunedSubjects(opts, "ap-2")}
+	for subject, expected := range map[string]bool{
+		"eu.foo": true, "eu.*": true, "orders.eu.1": true, "us.>": true,
+		"orders.us.1": false, "eu": false, ">": false, "*.foo": false,
+	} {
+		if r.prunes(subject) != expected {
+			t.Fatalf("Expected %q to be pruned: %v", subject, expected)
+		}
+	}
+
+	for _, owners := range [][]*SubjectOwnership{
+		{{Subjects: []string{"eu.>"}}},
+		{{Subjects: []string{"eu..x"}, Servers: []string{"eu-1"}}},
+	} {
+		opts := DefaultOptions()
+		opts.ServerName = "eu-1"
+		opts.Cluster.SubjectOwners = owners
+		if err := validateOptions(opts); err == nil {
+			t.Fatalf("Expected an error for %+v", owners[0])
+		}
+	}
+	opts = DefaultOptions()
+	opts.Cluster.SubjectOwners = []*SubjectOwnership{{Subjects: []string{"eu.>"}, Servers: []string{"eu-1"}}}
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected an error without a server name")
+	}
+}
+
+func TestSubjectOwnersRoutes(t *testing.T) {
+	owners := []*SubjectOwnership{{Subjects: []string{"eu.>"}, Servers: []string{"A"}}}
+	optsA := DefaultOptions()
+	optsA.ServerName = "A"
+	optsA.Cluster.SubjectOwners = owners
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	routes := RoutesFromStr(fmt.Sprintf("nats://%s:%d", optsA.Cluster.Host, optsA.Cluster.Port))
+	optsB := DefaultOptions()
+	optsB.ServerName = "B"
+	optsB.Cluster.SubjectOwners = owners
+	optsB.Routes = routes
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	optsC := DefaultOptions()
+	optsC.ServerName = "C"
+	optsC.Cluster.SubjectOwners = owners
+	optsC.Routes = routes
+	srvC := RunServer(optsC)
+	defer srvC.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB, srvC)
+
+	ncC := natsConnect(t, srvC.ClientURL())
+	defer ncC.Close()
+	owned := natsSubSync(t, ncC, "eu.orders")
+	all := natsSubSync(t, ncC, ">")
+	natsFlush(t, ncC)
+
+	// The interest in the owned subject is only sent to the owner.
+	checkExpectedSubs(t, 2, srvA, srvC)
+	checkExpectedSubs(t, 1, srvB)
+
+	checkNoMsg := func(sub *nats.Subscription) {
+		t.Helper()
+		if msg, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Expected no message, got %v (err=%v)", msg, err)
+		}
+	}
+
+	// Messages on the owned subjects are not routed between B and C.
+	ncB := natsConnect(t, srvB.ClientURL())
+	defer ncB.Close()
+	natsPub(t, ncB, "eu.orders", []byte("pruned"))
+	natsPub(t, ncB, "us.orders", []byte("routed"))
+	natsFlush(t, ncB)
+	if msg := natsNexMsg(t, all, time.Second); msg.Subject != "us.orders" {
+		t.Fatalf("Unexpected message on %q", msg.Subject)
+	}
+	checkNoMsg(all)
+	checkNoMsg(owned)
+
+	// But are routed from the owner.
+	ncA := natsConnect(t, srvA.ClientURL())
+	defer ncA.Close()
+	natsPub(t, ncA, "eu.orders", []byte("owned"))
+	natsFlush(t, ncA)
+	for _, sub := range []*nats.Subscription{owned, all} {
+		if msg := natsNexMsg(t, sub, time.Second); string(msg.Data) != "owned" {
+			t.Fatalf("Unexpected message %q", msg.Data)
+		}
+	}
+}
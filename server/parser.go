@@ -14,6 +14,7 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 )
 
@@ -24,8 +25,11 @@ type pubArg struct {
 	subject []byte
 	reply   []byte
 	szb     []byte
+	hdb     []byte
+	psz     []byte
 	queues  [][]byte
 	size    int
+	hdr     int
 }
 
 type parserState int
@@ -37,8 +41,15 @@ type parseState struct {
 	argBuf  []byte
 	msgBuf  []byte
 	scratch [MAX_CONTROL_LINE_SIZE]byte
+	// Reused to hold the split messages that do not fit in scratch.
+	pbuf []byte
+	// Scan the control lines byte by byte and do not reuse pbuf.
+	legacy bool
 }
 
+// Split messages up to this size reuse the buffer of the connection.
+const maxParserBufSize = 64 * 1024
+
 // Parser constants
 const (
 	OP_START parserState = iota
@@ -96,6 +107,13 @@ const (
 	OP_UNSUB
 	OP_UNSUB_SPC
 	UNSUB_ARG
+	OP_D
+	OP_DR
+	OP_DRA
+	OP_DRAI
+	OP_DRAIN
+	OP_DRAIN_SPC
+	DRAIN_ARG
 	OP_M
 	OP_MS
 	OP_MSG
@@ -106,6 +124,17 @@ const (
 	OP_INF
 	OP_INFO
 	INFO_ARG
+	OP_H
+	OP_HP
+	OP_HPU
+	OP_HPUB
+	OP_HPUB_SPC
+	HPUB_ARG
+	OP_HM
+	OP_HMS
+	OP_HMSG
+	OP_HMSG_SPC
+	HMSG_ARG
 )
 
 func (c *client) parse(buf []byte) error {
@@ -143,10 +172,22 @@ func (c *client) parse(buf []byte) error {
 			switch b {
 			case 'P', 'p':
 				c.state = OP_P
+			case 'H', 'h':
+				if c.kind == LEAF {
+					goto parseErr
+				} else {
+					c.state = OP_H
+				}
 			case 'S', 's':
 				c.state = OP_S
 			case 'U', 'u':
 				c.state = OP_U
+			case 'D', 'd':
+				if c.kind != CLIENT {
+					goto parseErr
+				} else {
+					c.state = OP_D
+				}
 			case 'R', 'r':
 				if c.kind == CLIENT {
 					goto parseErr
@@ -176,6 +217,134 @@ func (c *client) parse(buf []byte) error {
 			default:
 				goto parseErr
 			}
+		case OP_H:
+			switch b {
+			case 'P', 'p':
+				if c.kind != CLIENT {
+					goto parseErr
+				}
+				c.state = OP_HP
+			case 'M', 'm':
+				if c.kind == CLIENT {
+					goto parseErr
+				}
+				c.state = OP_HM
+			default:
+				goto parseErr
+			}
+		case OP_HP:
+			switch b {
+			case 'U', 'u':
+				c.state = OP_HPU
+			default:
+				goto parseErr
+			}
+		case OP_HPU:
+			switch b {
+			case 'B', 'b':
+				c.state = OP_HPUB
+			default:
+				goto parseErr
+			}
+		case OP_HPUB:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_HPUB_SPC
+			default:
+				goto parseErr
+			}
+		case OP_HPUB_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = HPUB_ARG
+				c.as = i
+			}
+		case HPUB_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				if trace {
+					c.traceInOp("HPUB", arg)
+				}
+				if err := c.processHeaderPub(arg); err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = 0, i+1, MSG_PAYLOAD
+				// If we don't have a saved buffer then jump ahead with
+				// the index. If this overruns what is left we fall out
+				// and process split buffer.
+				if c.msgBuf == nil {
+					i = c.as + c.pa.size - LEN_CR_LF
+				}
+			default:
+				i = c.scanArg(buf, i)
+			}
+		case OP_HM:
+			switch b {
+			case 'S', 's':
+				c.state = OP_HMS
+			default:
+				goto parseErr
+			}
+		case OP_HMS:
+			switch b {
+			case 'G', 'g':
+				c.state = OP_HMSG
+			default:
+				goto parseErr
+			}
+		case OP_HMSG:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_HMSG_SPC
+			default:
+				goto parseErr
+			}
+		case OP_HMSG_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = HMSG_ARG
+				c.as = i
+			}
+		case HMSG_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				if trace {
+					c.traceInOp("HMSG", arg)
+				}
+				if err := c.processRoutedHeaderMsgArgs(arg); err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = 0, i+1, MSG_PAYLOAD
+
+				// jump ahead with the index. If this overruns
+				// what is left we fall out and process split
+				// buffer.
+				i = c.as + c.pa.size - LEN_CR_LF
+			default:
+				i = c.scanArg(buf, i)
+			}
 		case OP_P:
 			switch b {
 			case 'U', 'u':
@@ -235,9 +404,7 @@ func (c *client) parse(buf []byte) error {
 					i = c.as + c.pa.size - LEN_CR_LF
 				}
 			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
-				}
+				i = c.scanArg(buf, i)
 			}
 		case MSG_PAYLOAD:
 			if c.msgBuf != nil {
@@ -290,6 +457,7 @@ func (c *client) parse(buf []byte) error {
 			// Drop all pub args
 			c.pa.arg, c.pa.pacache, c.pa.account, c.pa.subject = nil, nil, nil, nil
 			c.pa.reply, c.pa.size, c.pa.szb, c.pa.queues = nil, 0, nil, nil
+			c.pa.hdr, c.pa.hdb, c.pa.psz = 0, nil, nil
 		case OP_A:
 			switch b {
 			case '+':
@@ -334,9 +502,7 @@ func (c *client) parse(buf []byte) error {
 				}
 				c.drop, c.as, c.state = 0, i+1, OP_START
 			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
-				}
+				i = c.scanArg(buf, i)
 			}
 		case OP_AUSUB:
 			switch b {
@@ -371,9 +537,7 @@ func (c *client) parse(buf []byte) error {
 				c.processAccountUnsub(arg)
 				c.drop, c.as, c.state = 0, i+1, OP_START
 			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
-				}
+				i = c.scanArg(buf, i)
 			}
 		case OP_S:
 			switch b {
@@ -445,9 +609,7 @@ func (c *client) parse(buf []byte) error {
 				}
 				c.drop, c.as, c.state = 0, i+1, OP_START
 			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
-				}
+				i = c.scanArg(buf, i)
 			}
 		case OP_L:
 			switch b {
@@ -569,9 +731,72 @@ func (c *client) parse(buf []byte) error {
 				}
 				c.drop, c.as, c.state = 0, i+1, OP_START
 			default:
+				i = c.scanArg(buf, i)
+			}
+		case OP_D:
+			switch b {
+			case 'R', 'r':
+				c.state = OP_DR
+			default:
+				goto parseErr
+			}
+		case OP_DR:
+			switch b {
+			case 'A', 'a':
+				c.state = OP_DRA
+			default:
+				goto parseErr
+			}
+		case OP_DRA:
+			switch b {
+			case 'I', 'i':
+				c.state = OP_DRAI
+			default:
+				goto parseErr
+			}
+		case OP_DRAI:
+			switch b {
+			case 'N', 'n':
+				c.state = OP_DRAIN
+			default:
+				goto parseErr
+			}
+		case OP_DRAIN:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_DRAIN_SPC
+			default:
+				goto parseErr
+			}
+		case OP_DRAIN_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = DRAIN_ARG
+				c.as = i
+			}
+		case DRAIN_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
 				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
 				}
+				if trace {
+					c.traceInOp("DRAIN", arg)
+				}
+				if err := c.processDrain(arg); err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = 0, i+1, OP_START
+			default:
+				i = c.scanArg(buf, i)
 			}
 		case OP_PI:
 			switch b {
@@ -693,9 +918,7 @@ func (c *client) parse(buf []byte) error {
 				authSet = c.awaitingAuth()
 				c.mu.Unlock()
 			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
-				}
+				i = c.scanArg(buf, i)
 			}
 		case OP_M:
 			switch b {
@@ -760,9 +983,7 @@ func (c *client) parse(buf []byte) error {
 				// buffer.
 				i = c.as + c.pa.size - LEN_CR_LF
 			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
-				}
+				i = c.scanArg(buf, i)
 			}
 		case OP_I:
 			switch b {
@@ -809,10 +1030,14 @@ func (c *client) parse(buf []byte) error {
 					return err
 				}
 				c.drop, c.as, c.state = 0, i+1, OP_START
-			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
+				// The rest of the buffer is compressed and handed
+				// back to the readLoop.
+				if c.in.zs {
+					c.in.zb = append([]byte(nil), buf[i+1:]...)
+					return nil
 				}
+			default:
+				i = c.scanArg(buf, i)
 			}
 		case OP_PLUS:
 			switch b {
@@ -884,9 +1109,7 @@ func (c *client) parse(buf []byte) error {
 				c.processErr(string(arg))
 				c.drop, c.as, c.state = 0, i+1, OP_START
 			default:
-				if c.argBuf != nil {
-					c.argBuf = append(c.argBuf, b)
-				}
+				i = c.scanArg(buf, i)
 			}
 		default:
 			goto parseErr
@@ -894,10 +1117,11 @@ func (c *client) parse(buf []byte) error {
 	}
 
 	// Check for split buffer scenarios for any ARG state.
-	if c.state == SUB_ARG || c.state == UNSUB_ARG || c.state == PUB_ARG ||
+	if c.state == SUB_ARG || c.state == UNSUB_ARG || c.state == DRAIN_ARG || c.state == PUB_ARG ||
 		c.state == ASUB_ARG || c.state == AUSUB_ARG ||
 		c.state == MSG_ARG || c.state == MINUS_ERR_ARG ||
-		c.state == CONNECT_ARG || c.state == INFO_ARG {
+		c.state == CONNECT_ARG || c.state == INFO_ARG ||
+		c.state == HPUB_ARG || c.state == HMSG_ARG {
 		// Setup a holder buffer to deal with split buffer scenario.
 		if c.argBuf == nil {
 			c.argBuf = c.scratch[:0]
@@ -937,7 +1161,7 @@ func (c *client) parse(buf []byte) error {
 			if lrem > c.pa.size+LEN_CR_LF {
 				goto parseErr
 			}
-			c.msgBuf = make([]byte, lrem, c.pa.size+LEN_CR_LF)
+			c.msgBuf = c.splitMsgBuf(lrem, c.pa.size+LEN_CR_LF)
 			copy(c.msgBuf, buf[c.as:])
 		} else {
 			c.msgBuf = c.scratch[len(c.argBuf):len(c.argBuf)]
@@ -959,6 +1183,44 @@ parseErr:
 	return err
 }
 
+// scanArg is called with the index of a byte of a control line argument
+// and returns the index of the last byte before the next CR or LF, saving
+// the bytes if the control line is split. The end of the control line is
+// searched with bytes.IndexByte, which is vectorized, unless scanning byte
+// by byte.
+func (c *client) scanArg(buf []byte, i int) int {
+	j := i + 1
+	if !c.legacy {
+		if k := bytes.IndexByte(buf[j:], '\n'); k >= 0 {
+			j += k
+		} else {
+			j = len(buf)
+		}
+		// Stop before the CR, it needs to be dropped.
+		if j > i+1 && buf[j-1] == '\r' {
+			j--
+		}
+	}
+	if c.argBuf != nil {
+		c.argBuf = append(c.argBuf, buf[i:j]...)
+	}
+	return j - 1
+}
+
+// splitMsgBuf returns a buffer of the given length and capacity to hold a
+// split message. The buffer of the connection is reused for the messages
+// up to maxParserBufSize since, like the read buffer, it is only used
+// while the message is processed.
+func (c *client) splitMsgBuf(n, size int) []byte {
+	if c.legacy || size > maxParserBufSize {
+		return make([]byte, n, size)
+	}
+	if cap(c.pbuf) < size {
+		c.pbuf = make([]byte, 0, size)
+	}
+	return c.pbuf[:n:size]
+}
+
 func protoSnippet(start int, buf []byte) string {
 	stop := start + PROTO_SNIPPET_SIZE
 	bufSize := len(buf)
@@ -980,10 +1242,16 @@ func (c *client) clonePubArg() error {
 
 	switch c.kind {
 	case ROUTER, GATEWAY:
+		if c.pa.hdr > 0 {
+			return c.processRoutedHeaderMsgArgs(c.argBuf)
+		}
 		return c.processRoutedMsgArgs(c.argBuf)
 	case LEAF:
 		return c.processLeafMsgArgs(c.argBuf)
 	default:
+		if c.pa.hdr > 0 {
+			return c.processHeaderPub(c.argBuf)
+		}
 		return c.processPub(c.argBuf)
 	}
 }
@@ -175,6 +175,27 @@ func TestParseSub(t *testing.T) {
 	}
 }
 
+func TestParseDrain(t *testing.T) {
+	c := dummyClient()
+	drain := []byte("DRAIN 22\r")
+	err := c.parse(drain)
+	if err != nil || c.state != DRAIN_ARG {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(drain[c.as:], []byte("22\r")) {
+		t.Fatalf("Arg state incorrect: %s\n", drain[c.as:])
+	}
+	if err := c.parse([]byte("\n")); err != nil || c.state != OP_START {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+
+	// Only clients can drain their subscriptions.
+	c = dummyRouteClient()
+	if err := c.parse([]byte("DRAIN 22\r\n")); err == nil {
+		t.Fatalf("Expected an error for a route")
+	}
+}
+
 func TestParsePub(t *testing.T) {
 	c := dummyClient()
 
@@ -329,6 +350,107 @@ func TestParsePubBadSize(t *testing.T) {
 	}
 }
 
+func TestParseHeaderPub(t *testing.T) {
+	c := dummyClient()
+
+	hpub := []byte("HPUB foo 12 17\r\nNATS/1.0\r\n\r\nhello\r")
+	if err := c.parse(hpub); err == nil {
+		t.Fatalf("Expected an error when headers are not enabled")
+	}
+
+	c = dummyClient()
+	c.headers = true
+	if err := c.parse(hpub); err != nil || c.state != MSG_END_N {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.subject, []byte("foo")) {
+		t.Fatalf("Did not parse subject correctly: 'foo' vs '%s'\n", c.pa.subject)
+	}
+	if c.pa.reply != nil {
+		t.Fatalf("Did not parse reply correctly: 'nil' vs '%s'\n", c.pa.reply)
+	}
+	if c.pa.hdr != 12 || c.pa.size != 17 {
+		t.Fatalf("Did not parse sizes correctly: 12/17 vs %d/%d\n", c.pa.hdr, c.pa.size)
+	}
+	if !bytes.Equal(c.pa.psz, []byte("5")) {
+		t.Fatalf("Did not compute payload size correctly: '5' vs '%s'\n", c.pa.psz)
+	}
+
+	// Clear snapshots
+	c.argBuf, c.msgBuf, c.state = nil, nil, OP_START
+
+	hpub = []byte("HPUB foo.bar INBOX.22 12 23\r\nNATS/1.0\r\n\r\nhello world\r")
+	if err := c.parse(hpub); err != nil || c.state != MSG_END_N {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.reply, []byte("INBOX.22")) {
+		t.Fatalf("Did not parse reply correctly: 'INBOX.22' vs '%s'\n", c.pa.reply)
+	}
+	if c.pa.hdr != 12 || c.pa.size != 23 {
+		t.Fatalf("Did not parse sizes correctly: 12/23 vs %d/%d\n", c.pa.hdr, c.pa.size)
+	}
+
+	for _, arg := range []string{"foo 5", "foo 0 5", "foo 12 5", "foo bar baz 12 17", "foo x 17"} {
+		c.argBuf, c.msgBuf, c.state = nil, nil, OP_START
+		if err := c.processHeaderPub([]byte(arg)); err == nil {
+			t.Fatalf("Expected error for %q", arg)
+		}
+	}
+}
+
+func TestParseHeaderPubSplitBuffer(t *testing.T) {
+	c := dummyClient()
+	c.headers = true
+	hpub := []byte("HPUB foo bar 12 17\r\nNATS/1.0\r\n\r\nhello\r\n")
+	for i := 1; i < len(hpub)-1; i++ {
+		c.argBuf, c.msgBuf, c.state = nil, nil, OP_START
+		if err := c.parse(hpub[:i]); err != nil {
+			t.Fatalf("Unexpected error at split %d: %v", i, err)
+		}
+		if err := c.parse(hpub[i:]); err != nil || c.state != OP_START {
+			t.Fatalf("Unexpected at split %d: %d : %v\n", i, c.state, err)
+		}
+	}
+}
+
+func TestParseRouteHeaderMsg(t *testing.T) {
+	c := dummyRouteClient()
+
+	hmsg := []byte("HMSG $foo foo 12 17\r\nNATS/1.0\r\n\r\nhello\r")
+	if err := c.parse(hmsg); err == nil {
+		t.Fatalf("Expected an error when headers are not enabled")
+	}
+
+	for _, test := range []struct {
+		proto  string
+		reply  string
+		queues int
+	}{
+		{"HMSG $foo foo 12 17\r\nNATS/1.0\r\n\r\nhello\r", "", 0},
+		{"HMSG $foo foo bar 12 17\r\nNATS/1.0\r\n\r\nhello\r", "bar", 0},
+		{"HMSG $foo foo + bar q1 q2 12 17\r\nNATS/1.0\r\n\r\nhello\r", "bar", 2},
+		{"HMSG $foo foo | q1 12 17\r\nNATS/1.0\r\n\r\nhello\r", "", 1},
+	} {
+		c := dummyRouteClient()
+		c.headers = true
+		if err := c.parse([]byte(test.proto)); err != nil || c.state != MSG_END_N {
+			t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+		}
+		if !bytes.Equal(c.pa.account, []byte("$foo")) || !bytes.Equal(c.pa.subject, []byte("foo")) {
+			t.Fatalf("Did not parse account and subject correctly: '%s' '%s'\n", c.pa.account, c.pa.subject)
+		}
+		if string(c.pa.reply) != test.reply {
+			t.Fatalf("Did not parse reply correctly: '%s' vs '%s'\n", test.reply, c.pa.reply)
+		}
+		if len(c.pa.queues) != test.queues {
+			t.Fatalf("Expected %d queues, got %d", test.queues, len(c.pa.queues))
+		}
+		if c.pa.hdr != 12 || c.pa.size != 17 {
+			t.Fatalf("Did not parse sizes correctly: 12/17 vs %d/%d\n", c.pa.hdr, c.pa.size)
+		}
+	}
+}
+
 func TestParseRouteMsg(t *testing.T) {
 	c := dummyRouteClient()
 
@@ -586,3 +708,25 @@ func TestMaxControlLine(t *testing.T) {
 		t.Fatalf("Expected an error parsing longer than expected control line")
 	}
 }
+
+func benchmarkParsePub(b *testing.B, legacy bool) {
+	c := dummyClient()
+	c.legacy = legacy
+	pub := []byte("PUB orders.region.eu-west.customer.4f2a9c.created _INBOX.Kx3bq7TPm0yZQd9uXGvL2a.1 5\r\nhello\r\n")
+	buf := bytes.Repeat(pub, 32)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.parse(buf); err != nil {
+			b.Fatalf("Unexpected parse error: %v", err)
+		}
+	}
+}
+
+func BenchmarkParsePub(b *testing.B) {
+	benchmarkParsePub(b, false)
+}
+
+func BenchmarkParsePubLegacy(b *testing.B) {
+	benchmarkParsePub(b, true)
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "strings"
+
+// permTrie is the compiled form of the allow and deny subjects of the
+// publish permissions. Unlike a Sublist, matching a subject does not
+// collect the matching subscriptions nor allocate: it walks the tokens
+// of the subject once, following the literal and the '*' branches, and
+// stops as soon as a deny subject matches.
+type permTrie struct {
+	root     permNode
+	hasAllow bool
+}
+
+// Flags of the subjects ending at a node.
+const (
+	permAllow = 1 << iota // an allow subject ends at this node
+	permDeny              // a deny subject ends at this node
+)
+
+type permNode struct {
+	next map[string]*permNode
+	pwc  *permNode
+	end  uint8 // subjects ending at this node
+	fwc  uint8 // subjects ending with '>' after this node
+}
+
+// newPermTrie compiles the allow and deny subjects of publish permissions.
+func newPermTrie(allow, deny []string) *permTrie {
+	t := &permTrie{hasAllow: allow != nil}
+	for _, subject := range allow {
+		t.insert(subject, permAllow)
+	}
+	for _, subject := range deny {
+		t.insert(subject, permDeny)
+	}
+	return t
+}
+
+func (t *permTrie) insert(subject string, flag uint8) {
+	n := &t.root
+	start := 0
+	for i := 0; i <= len(subject); i++ {
+		if i < len(subject) && subject[i] != btsep {
+			continue
+		}
+		token := subject[start:i]
+		start = i + 1
+		switch {
+		case token == fwcs && i == len(subject):
+			n.fwc |= flag
+			return
+		case token == pwcs:
+			if n.pwc == nil {
+				n.pwc = &permNode{}
+			}
+			n = n.pwc
+		default:
+			if n.next == nil {
+				n.next = make(map[string]*permNode)
+			}
+			nn := n.next[token]
+			if nn == nil {
+				nn = &permNode{}
+				n.next[token] = nn
+			}
+			n = nn
+		}
+	}
+	n.end |= flag
+}
+
+// allowed returns true if the literal subject matches an allow subject, or
+// if there are none, and no deny subject.
+func (t *permTrie) allowed(subject string) bool {
+	flags := t.root.match(subject, true)
+	if flags&permDeny != 0 {
+		return false
+	}
+	return !t.hasAllow || flags&permAllow != 0
+}
+
+// Returns the flags of the subjects matching the rest of the subject from
+// this node, more telling if tokens remain since the last one can be empty.
+func (n *permNode) match(subject string, more bool) uint8 {
+	if !more {
+		return n.end
+	}
+	// A trailing '>' matches one or more tokens.
+	flags := n.fwc
+	if flags&permDeny != 0 {
+		return flags
+	}
+	token, rest := subject, _EMPTY_
+	more = false
+	if i := strings.IndexByte(subject, btsep); i >= 0 {
+		token, rest, more = subject[:i], subject[i+1:], true
+	}
+	if nn := n.next[token]; nn != nil {
+		if flags |= nn.match(rest, more); flags&permDeny != 0 {
+			return flags
+		}
+	}
+	if n.pwc != nil {
+		flags |= n.pwc.match(rest, more)
+	}
+	return flags
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPermTrieMatchesSublists(t *testing.T) {
+	for _, test := range []struct {
+		allow []string
+		deny  []string
+	}{
+		{[]string{"foo", "foo.*", "bar.>", "*.baz", "a.*.c.>"}, nil},
+		{nil, []string{"foo.>", "*.secret", "x.*.z"}},
+		{[]string{">"}, []string{"foo.bar", "admin.>"}},
+		{[]string{"foo.*", "foo.bar.>"}, []string{"foo.baz", "*.*.secret"}},
+		{[]string{}, nil},
+		{[]string{"*"}, []string{"*.>"}},
+	} {
+		c := &client{}
+		c.setPermissions(&Permissions{Publish: &SubjectPermission{Allow: test.allow, Deny: test.deny}})
+		for _, subject := range []string{
+			"foo", "foo.bar", "foo.baz", "foo.bar.baz", "foo.bar.secret", "bar", "bar.x",
+			"bar.x.y", "x.baz", "x.y.baz", "a.b.c", "a.b.c.d", "a.b.c.d.e", "x.y.z",
+			"x.y.z.w", "admin", "admin.users", "one.secret", "baz", "foo.", "a",
+		} {
+			trie := c.perms.ptrie.allowed(subject)
+			sublists := c.pubAllowedBySublists(subject)
+			if trie != sublists {
+				t.Fatalf("Allow %q, deny %q: subject %q is allowed=%v with the trie, %v with the sublists",
+					test.allow, test.deny, subject, trie, sublists)
+			}
+		}
+	}
+}
+
+func TestPermTrieNotCompiledWithoutPublishPermissions(t *testing.T) {
+	c := &client{}
+	c.setPermissions(&Permissions{Subscribe: &SubjectPermission{Allow: []string{"foo"}}})
+	if c.perms.ptrie != nil {
+		t.Fatal("Expected no compiled publish permissions")
+	}
+	if !c.pubAllowed("bar") {
+		t.Fatal("Expected publish to be allowed")
+	}
+}
+
+// Permissions of a user with many allowed subjects, the first half literal
+// and the second half with wildcards.
+func benchPubPermissions(n int) *Permissions {
+	allow := make([]string, 0, n)
+	for i := 0; i < n/2; i++ {
+		allow = append(allow, fmt.Sprintf("svc.%d.requests", i))
+	}
+	for i := n / 2; i < n; i++ {
+		allow = append(allow, fmt.Sprintf("events.%d.*.>", i))
+	}
+	return &Permissions{Publish: &SubjectPermission{
+		Allow: allow,
+		Deny:  []string{"svc.*.admin", "events.*.internal.>"},
+	}}
+}
+
+func benchPubSubjects(n int) []string {
+	subjects := make([]string, 0, 4096)
+	for i := 0; i < 4096; i++ {
+		if i%2 == 0 {
+			subjects = append(subjects, fmt.Sprintf("svc.%d.requests", i%n))
+		} else {
+			subjects = append(subjects, fmt.Sprintf("events.%d.orders.created.%d", i%n, i))
+		}
+	}
+	return subjects
+}
+
+func benchmarkPubPermsMiss(b *testing.B, n int, trie bool) {
+	c := &client{}
+	c.setPermissions(benchPubPermissions(n))
+	subjects := benchPubSubjects(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		subject := subjects[i%len(subjects)]
+		if trie {
+			c.perms.ptrie.allowed(subject)
+		} else {
+			c.pubAllowedBySublists(subject)
+		}
+	}
+}
+
+func Benchmark___PubPermsSublists100(b *testing.B)  { benchmarkPubPermsMiss(b, 100, false) }
+func Benchmark_______PubPermsTrie100(b *testing.B)  { benchmarkPubPermsMiss(b, 100, true) }
+func Benchmark__PubPermsSublists10000(b *testing.B) { benchmarkPubPermsMiss(b, 10000, false) }
+func Benchmark______PubPermsTrie10000(b *testing.B) { benchmarkPubPermsMiss(b, 10000, true) }
+
+func Benchmark_______PubPermsCached(b *testing.B) {
+	c := &client{}
+	c.setPermissions(benchPubPermissions(10000))
+	// Fits in the cache of the connection.
+	subjects := benchPubSubjects(10000)[:maxPermCacheSize/2]
+	for _, subject := range subjects {
+		c.pubAllowed(subject)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.pubAllowed(subjects[i%len(subjects)])
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ProfilingPath is the prefix of the pprof handlers on the monitoring port.
+	ProfilingPath = "/debug/pprof/"
+
+	// CPUProfile is the name of the CPU profile in ProfileRequest.
+	CPUProfile = "cpu"
+
+	defaultCPUProfileDuration = 30 * time.Second
+	maxCPUProfileDuration     = 5 * time.Minute
+
+	// Number of profiles kept in the profiling directory by default.
+	defaultMaxProfileFiles = 20
+)
+
+var errProfileInProgress = errors.New("profiles are already being written")
+
+// ProfileRequest is a request to write profiles in the profiling directory.
+// Profiles are the names of runtime/pprof profiles, such as "heap" or
+// "goroutine", or "cpu" for a CPU profile of CPUDuration. An empty request
+// writes the heap and goroutine profiles.
+type ProfileRequest struct {
+	Profiles    []string      `json:"profiles,omitempty"`
+	CPUDuration time.Duration `json:"cpu_duration,omitempty"`
+}
+
+// ProfileResponse is sent back in response to ProfileRequest.
+type ProfileResponse struct {
+	Server ServerInfo `json:"server"`
+	Files  []string   `json:"files,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// handleProfiling registers the pprof handlers on the monitoring mux,
+// behind basic authentication.
+func (s *Server) handleProfiling(mux *http.ServeMux, po *ProfilingOpts) {
+	user, pass := po.Username, po.Password
+	auth := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || !comparePasswords(pass, p) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="profiling"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc(ProfilingPath, auth(pprof.Index))
+	mux.HandleFunc(ProfilingPath+"cmdline", auth(pprof.Cmdline))
+	mux.HandleFunc(ProfilingPath+"profile", auth(pprof.Profile))
+	mux.HandleFunc(ProfilingPath+"symbol", auth(pprof.Symbol))
+	mux.HandleFunc(ProfilingPath+"trace", auth(pprof.Trace))
+	// Enable blocking profile
+	runtime.SetBlockProfileRate(1)
+}
+
+// WriteProfiles writes the given profiles in the profiling directory and
+// returns the paths of the files. See ProfileRequest for the names and
+// the defaults. A CPU profile blocks for its whole duration, and a request
+// made while profiles are written is rejected.
+func (s *Server) WriteProfiles(names []string, cpuDuration time.Duration) ([]string, error) {
+	po := s.getOpts().Profiling
+	dir := po.Dir
+	if dir == _EMPTY_ {
+		return nil, fmt.Errorf("profiling directory not configured")
+	}
+	if len(names) == 0 {
+		names = []string{"heap", "goroutine"}
+	}
+	for _, name := range names {
+		if name != CPUProfile && rpprof.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+	}
+	if cpuDuration < 0 || cpuDuration > maxCPUProfileDuration {
+		return nil, fmt.Errorf("cpu profile duration must be at most %v", maxCPUProfileDuration)
+	}
+	if cpuDuration == 0 {
+		cpuDuration = defaultCPUProfileDuration
+	}
+	if !atomic.CompareAndSwapInt32(&s.profiling, 0, 1) {
+		return nil, errProfileInProgress
+	}
+	defer atomic.StoreInt32(&s.profiling, 0)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	max := po.MaxFiles
+	if max == 0 {
+		max = defaultMaxProfileFiles
+	}
+	defer s.removeOldProfiles(dir, max)
+
+	stamp := time.Now().UTC().Format("20060102T150405.000000000")
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%s.pprof", name, stamp))
+		if err := s.writeProfile(path, name, cpuDuration); err != nil {
+			return files, fmt.Errorf("error writing %s profile: %v", name, err)
+		}
+		s.Noticef("Wrote %s profile to %q", name, path)
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// removeOldProfiles removes the oldest profiles of the directory to keep
+// at most max of them.
+func (s *Server) removeOldProfiles(dir string, max int) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pprof"))
+	if err != nil || len(files) <= max {
+		return
+	}
+	// The names end with the time they were written.
+	sort.Slice(files, func(i, j int) bool {
+		return profileStamp(files[i]) < profileStamp(files[j])
+	})
+	for _, f := range files[:len(files)-max] {
+		if err := os.Remove(f); err != nil {
+			s.Warnf("Error removing profile %q: %v", f, err)
+		}
+	}
+}
+
+// Returns the time stamp of the name of a profile written by WriteProfiles.
+func profileStamp(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".pprof")
+	return name[strings.LastIndexByte(name, '-')+1:]
+}
+
+func (s *Server) writeProfile(path, name string, cpuDuration time.Duration) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if name != CPUProfile {
+		return rpprof.Lookup(name).WriteTo(f, 0)
+	}
+	if err := rpprof.StartCPUProfile(f); err != nil {
+		return err
+	}
+	select {
+	case <-time.After(cpuDuration):
+	case <-s.quitCh:
+	}
+	rpprof.StopCPUProfile()
+	return nil
+}
+
+// profileReq writes the requested profiles. This is done in a go routine
+// since a CPU profile takes a while.
+func (s *Server) profileReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var req ProfileRequest
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp := &ProfileResponse{Error: fmt.Sprintf("error unmarshalling request: %v", err)}
+			if reply != _EMPTY_ {
+				s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, resp)
+			}
+			return
+		}
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		resp := &ProfileResponse{}
+		files, err := s.WriteProfiles(req.Profiles, req.CPUDuration)
+		resp.Files = files
+		if err != nil {
+			resp.Error = err.Error()
+			s.Warnf("Profile request failed: %v", err)
+		}
+		if reply != _EMPTY_ {
+			s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, resp)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProfilingHTTP(t *testing.T) {
+	conf := createConfFile(t, []byte(`profiling { http: true }`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "requires a user and password") {
+		t.Fatalf("Expected error for profiling without auth, got %v", err)
+	}
+
+	conf = createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		profiling {
+			http: true
+			user: prof
+			password: pwd
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	get := func(user, pass, path string) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s%s", s.MonitorAddr(), path), nil)
+		if user != _EMPTY_ {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(_EMPTY_, _EMPTY_, ProfilingPath); code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %v, got %v", http.StatusUnauthorized, code)
+	}
+	if code := get("prof", "bad", ProfilingPath+"goroutine?debug=1"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %v, got %v", http.StatusUnauthorized, code)
+	}
+	for _, path := range []string{ProfilingPath, ProfilingPath + "goroutine?debug=1", ProfilingPath + "cmdline"} {
+		if code := get("prof", "pwd", path); code != http.StatusOK {
+			t.Fatalf("Expected status %v for %q, got %v", http.StatusOK, path, code)
+		}
+	}
+}
+
+func TestProfilingRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			SYS { users [{user: admin, password: pwd}] }
+		}
+		system_account: SYS
+		profiling { dir: '%s', max_files: 4 }
+	`, dir)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs := natsConnect(t, fmt.Sprintf("nats://admin:pwd@%s", s.Addr()))
+	defer ncs.Close()
+
+	profile := func(r *ProfileRequest) *ProfileResponse {
+		t.Helper()
+		req, _ := json.Marshal(r)
+		msg, err := ncs.Request(fmt.Sprintf(profileReqSubj, s.ID()), req, 2*time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := &ProfileResponse{}
+		if err := json.Unmarshal(msg.Data, resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		return resp
+	}
+
+	resp := profile(&ProfileRequest{})
+	if resp.Error != _EMPTY_ || len(resp.Files) != 2 || resp.Server.ID != s.ID() {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	oldest := resp.Files
+	resp = profile(&ProfileRequest{Profiles: []string{CPUProfile}, CPUDuration: 50 * time.Millisecond})
+	if resp.Error != _EMPTY_ || len(resp.Files) != 1 || !strings.Contains(resp.Files[0], "cpu-") {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 profiles, got %v", len(files))
+	}
+	for _, f := range files {
+		if f.Size() == 0 {
+			t.Fatalf("Profile %q is empty", f.Name())
+		}
+	}
+
+	if resp = profile(&ProfileRequest{Profiles: []string{"bad"}}); !strings.Contains(resp.Error, "unknown profile") {
+		t.Fatalf("Expected unknown profile error, got %+v", resp)
+	}
+	if resp = profile(&ProfileRequest{CPUDuration: time.Hour}); !strings.Contains(resp.Error, "at most") {
+		t.Fatalf("Expected duration error, got %+v", resp)
+	}
+
+	// Only one request is served at a time.
+	done := make(chan *ProfileResponse, 1)
+	go func() {
+		files, err := s.WriteProfiles([]string{CPUProfile}, 500*time.Millisecond)
+		resp := &ProfileResponse{Files: files}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		done <- resp
+	}()
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if atomic.LoadInt32(&s.profiling) == 0 {
+			return fmt.Errorf("profiles not being written")
+		}
+		return nil
+	})
+	if resp = profile(&ProfileRequest{Profiles: []string{CPUProfile}, CPUDuration: 50 * time.Millisecond}); resp.Error != errProfileInProgress.Error() {
+		t.Fatalf("Expected the request to be rejected, got %+v", resp)
+	}
+	if resp = <-done; resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	// The oldest profiles are removed.
+	if resp = profile(&ProfileRequest{Profiles: []string{"heap"}}); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	files, _ = ioutil.ReadDir(dir)
+	if len(files) != 4 {
+		t.Fatalf("Expected 4 profiles, got %v", len(files))
+	}
+	var kept int
+	for _, f := range oldest {
+		if _, err := os.Stat(f); err == nil {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Fatalf("Expected one of the oldest profiles to be removed, %v kept", kept)
+	}
+}
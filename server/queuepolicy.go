@@ -0,0 +1,173 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// Distribution policies of the queue groups.
+	QueuePolicyRandom = "random"
+	QueuePolicyLocal  = "local"
+	QueuePolicyHash   = "hash"
+)
+
+// The queue_groups options used without a server, never modified.
+var defaultQueueGroupOpts QueueGroupOpts
+
+func validateQueueGroupOptions(o *Options) error {
+	qo := &o.QueueGroups
+	switch qo.Policy {
+	case _EMPTY_, QueuePolicyRandom, QueuePolicyLocal, QueuePolicyHash:
+	default:
+		return fmt.Errorf("unknown queue_groups policy %q", qo.Policy)
+	}
+	if qo.SpillThreshold < 0 {
+		return fmt.Errorf("queue_groups spill_threshold can not be negative")
+	}
+	if qo.LocalWeight < 0 {
+		return fmt.Errorf("queue_groups local_weight can not be negative")
+	}
+	return nil
+}
+
+// queueGroupOpts returns the snapshot of the queue_groups options of the
+// client, taken again once they are reloaded. Only the read loop uses it.
+func (c *client) queueGroupOpts() *QueueGroupOpts {
+	if gen := atomic.LoadInt32(&c.srv.queueGroupsGen); c.in.qp == nil || c.in.qpgen != gen {
+		qo := c.srv.getOpts().QueueGroups
+		c.in.qp, c.in.qpgen = &qo, gen
+	}
+	return c.in.qp
+}
+
+// Returns true if the member of a queue group is connected to this server.
+func isLocalQSub(sub *subscription) bool {
+	kind := sub.client.kind
+	return kind != ROUTER && kind != LEAF && kind != GATEWAY
+}
+
+// localQSubs returns the local members of the queue group that have less
+// than threshold bytes pending, or if there are none, the remote members.
+// The first remote member is also returned so that the message can still
+// be routed if the delivery to all the local members fails.
+func localQSubs(qsubs []*subscription, ql []*subscription, threshold int64) ([]*subscription, *subscription) {
+	var rsub *subscription
+	var busy bool
+	for _, sub := range qsubs {
+		if !isLocalQSub(sub) {
+			if rsub == nil {
+				rsub = sub
+			}
+			continue
+		}
+		if threshold > 0 {
+			if atomic.LoadInt64(&sub.client.opb) >= threshold {
+				busy = true
+				continue
+			}
+		}
+		ql = append(ql, sub)
+	}
+	if len(ql) > 0 {
+		return ql, rsub
+	}
+	// All the local members are busy, spill to the other servers.
+	if busy && rsub != nil {
+		for _, sub := range qsubs {
+			if !isLocalQSub(sub) {
+				ql = append(ql, sub)
+			}
+		}
+		return ql, nil
+	}
+	return qsubs, nil
+}
+
+// weightedQSubIndex returns a random index in the queue group where the
+// local members are weight times more likely to be selected than the
+// remote ones. Remote subscriptions are already repeated once per member.
+func weightedQSubIndex(qsubs []*subscription, weight int, r int) int {
+	total := 0
+	for _, sub := range qsubs {
+		if isLocalQSub(sub) {
+			total += weight
+		} else {
+			total++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	r %= total
+	for i, sub := range qsubs {
+		if isLocalQSub(sub) {
+			r -= weight
+		} else {
+			r--
+		}
+		if r < 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+const (
+	qhashOffset = 14695981039346656037
+	qhashPrime  = 1099511628211
+)
+
+// hashQSubIndex returns the index of the member of the queue group selected
+// by rendezvous hashing of the subject, so that the messages of a subject
+// keep going to the same member as long as it is part of the group, and
+// only the subjects of a member leaving the group are moved. The members
+// are told apart by their connection id, so the assignment is only sticky
+// on this server, and a member that reconnects gets other subjects. A route
+// counts as a single member, the server at the other end selecting again
+// among its own members, so a subject published on another server may be
+// delivered to a different member than when published on this one.
+func hashQSubIndex(qsubs []*subscription, subject []byte) int {
+	hs := uint64(qhashOffset)
+	for _, b := range subject {
+		hs ^= uint64(b)
+		hs *= qhashPrime
+	}
+	var best uint64
+	index := 0
+	for i, sub := range qsubs {
+		if i > 0 && sub == qsubs[i-1] {
+			continue
+		}
+		h := hs
+		for _, b := range sub.sid {
+			h ^= uint64(b)
+			h *= qhashPrime
+		}
+		for cid := sub.client.cid; cid > 0; cid >>= 8 {
+			h ^= cid & 0xff
+			h *= qhashPrime
+		}
+		// Mix the bits so that the last bytes hashed do not dominate.
+		h ^= h >> 33
+		h *= 0xff51afd7ed558ccd
+		h ^= h >> 33
+		if i == 0 || h > best {
+			best, index = h, i
+		}
+	}
+	return index
+}
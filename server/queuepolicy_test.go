@@ -0,0 +1,198 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestQueueGroupsConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		queue_groups {
+			policy: local
+			spill_threshold: 1MB
+			local_weight: 3
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	qo := opts.QueueGroups
+	if qo.Policy != QueuePolicyLocal || qo.SpillThreshold != 1024*1024 || qo.LocalWeight != 3 {
+		t.Fatalf("Unexpected options: %+v", qo)
+	}
+
+	opts = DefaultOptions()
+	opts.QueueGroups.Policy = "sticky"
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected an error for an unknown policy")
+	}
+}
+
+func TestQueueGroupsLocalSubs(t *testing.T) {
+	local := &subscription{client: &client{kind: CLIENT}}
+	busy := &subscription{client: &client{kind: CLIENT}}
+	busy.client.addPendingBytes(1000)
+	remote := &subscription{client: &client{kind: ROUTER}}
+
+	qsubs := []*subscription{remote, busy, local}
+	ql, rsub := localQSubs(qsubs, nil, 500)
+	if len(ql) != 1 || ql[0] != local || rsub != remote {
+		t.Fatalf("Expected the local sub, got %v, %v", ql, rsub)
+	}
+	// Without a threshold, busy subs are still local.
+	if ql, _ = localQSubs(qsubs, nil, 0); len(ql) != 2 {
+		t.Fatalf("Expected 2 local subs, got %v", ql)
+	}
+	// When all local subs are busy, spill to the remote ones.
+	ql, rsub = localQSubs([]*subscription{busy, remote, remote}, nil, 500)
+	if len(ql) != 2 || ql[0] != remote || rsub != nil {
+		t.Fatalf("Expected the remote subs, got %v, %v", ql, rsub)
+	}
+	// With no remote subs, keep the busy ones.
+	if ql, _ = localQSubs([]*subscription{busy}, nil, 500); len(ql) != 1 {
+		t.Fatalf("Expected the busy sub, got %v", ql)
+	}
+}
+
+func TestQueueGroupsOptsSnapshot(t *testing.T) {
+	opts := DefaultOptions()
+	opts.QueueGroups.Policy = QueuePolicyLocal
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c := &client{srv: s}
+	if qp := c.queueGroupOpts(); qp.Policy != QueuePolicyLocal {
+		t.Fatalf("Unexpected policy %q", qp.Policy)
+	}
+	// The snapshot is kept until the options are reloaded.
+	newOpts := opts.Clone()
+	newOpts.QueueGroups.Policy = QueuePolicyHash
+	s.setOpts(newOpts)
+	if qp := c.queueGroupOpts(); qp.Policy != QueuePolicyLocal {
+		t.Fatalf("Expected the snapshot to be kept, got %q", qp.Policy)
+	}
+	(&queueGroupsOption{newValue: newOpts.QueueGroups}).Apply(s)
+	if qp := c.queueGroupOpts(); qp.Policy != QueuePolicyHash {
+		t.Fatalf("Expected the reloaded policy, got %q", qp.Policy)
+	}
+}
+
+func TestQueueGroupsLocalWeight(t *testing.T) {
+	local := &subscription{client: &client{kind: CLIENT}}
+	remote := &subscription{client: &client{kind: ROUTER}}
+	qsubs := []*subscription{remote, local, remote}
+	counts := make(map[*subscription]int)
+	for r := 0; r < 8; r++ {
+		counts[qsubs[weightedQSubIndex(qsubs, 6, r)]]++
+	}
+	if counts[local] != 6 || counts[remote] != 2 {
+		t.Fatalf("Unexpected distribution: local=%d remote=%d", counts[local], counts[remote])
+	}
+}
+
+func TestQueueGroupsPolicyLocal(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.QueueGroups.Policy = QueuePolicyLocal
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://%s:%d", optsA.Cluster.Host, srvA.ClusterAddr().Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	ncA := natsConnect(t, fmt.Sprintf("nats://%s:%d", optsA.Host, optsA.Port))
+	defer ncA.Close()
+	ncB := natsConnect(t, fmt.Sprintf("nats://%s:%d", optsB.Host, optsB.Port))
+	defer ncB.Close()
+
+	subA := natsQueueSubSync(t, ncA, "foo", "bar")
+	subB := natsQueueSubSync(t, ncB, "foo", "bar")
+	natsFlush(t, ncA)
+	natsFlush(t, ncB)
+	checkExpectedSubs(t, 2, srvA, srvB)
+
+	// Messages published on A go to the member connected to A.
+	for i := 0; i < 20; i++ {
+		natsPub(t, ncA, "foo", []byte("hello"))
+	}
+	natsFlush(t, ncA)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n, _, _ := subA.Pending(); n != 20 {
+			return fmt.Errorf("Expected 20 messages on A, got %d", n)
+		}
+		return nil
+	})
+	if n, _, _ := subB.Pending(); n != 0 {
+		t.Fatalf("Expected no message on B, got %d", n)
+	}
+
+	// Without a local member, the messages are routed.
+	subA.Unsubscribe()
+	natsFlush(t, ncA)
+	checkExpectedSubs(t, 1, srvA, srvB)
+	natsPub(t, ncA, "foo", []byte("hello"))
+	if _, err := subB.NextMsg(time.Second); err != nil {
+		t.Fatalf("Expected a message on B: %v", err)
+	}
+}
+
+func TestQueueGroupsPolicyHash(t *testing.T) {
+	opts := DefaultOptions()
+	opts.QueueGroups.Policy = QueuePolicyHash
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+
+	received := make(chan string, 100)
+	members := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		i := i
+		natsQueueSub(t, nc, "foo.*", "bar", func(m *nats.Msg) {
+			received <- fmt.Sprintf("%s %d", m.Subject, i)
+		})
+	}
+	natsFlush(t, nc)
+
+	// Each subject always goes to the same member.
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			natsPub(t, nc, fmt.Sprintf("foo.%d", j), nil)
+		}
+	}
+	natsFlush(t, nc)
+	for i := 0; i < 50; i++ {
+		select {
+		case m := <-received:
+			members[m]++
+		case <-time.After(time.Second):
+			t.Fatalf("Received %d messages, expected 50", i)
+		}
+	}
+	if len(members) != 10 {
+		t.Fatalf("Expected each subject to go to a single member, got %v", members)
+	}
+}
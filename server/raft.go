@@ -0,0 +1,938 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Subject on which the members of a raft group receive the messages
+	// of the other members, with the group and the member name.
+	raftSubj = "$SYS.RAFT.%s.%s"
+
+	raftVote       = "vote"
+	raftVoteResp   = "vote_resp"
+	raftAppend     = "append"
+	raftAppendResp = "append_resp"
+	raftInstall    = "install"
+	raftPropose    = "propose"
+
+	// Files of a stored raft group.
+	raftStateFile    = "state.json"
+	raftSnapshotFile = "snapshot.json"
+	raftLogFile      = "log"
+)
+
+var (
+	// Interval of the heartbeats of the leader.
+	raftHeartbeatInterval = 250 * time.Millisecond
+	// Minimum time without a leader before a member starts an election,
+	// the actual time is randomized up to twice this value.
+	raftElectionTimeout = 1500 * time.Millisecond
+	// Number of applied entries after which the log is compacted into a
+	// snapshot.
+	raftSnapshotThreshold = uint64(1024)
+	// Maximum number of entries sent in a single append.
+	raftMaxAppendEntries = 256
+
+	errRaftNoLeader = errors.New("raft group has no leader")
+)
+
+// raftFSM is the state machine replicated by a raft group.
+type raftFSM interface {
+	// apply applies a committed entry.
+	apply(data []byte)
+	// snapshot returns the encoded state.
+	snapshot() []byte
+	// restore replaces the state with a snapshot.
+	restore(data []byte) error
+}
+
+type raftState int
+
+const (
+	raftFollower raftState = iota
+	raftCandidate
+	raftLeader
+)
+
+func (rs raftState) String() string {
+	switch rs {
+	case raftFollower:
+		return "follower"
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+type raftEntry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+type raftSnapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+// raftMsg is a message between the members of a raft group.
+type raftMsg struct {
+	Type      string        `json:"type"`
+	From      string        `json:"from"`
+	Term      uint64        `json:"term"`
+	LastIndex uint64        `json:"last_index,omitempty"`
+	LastTerm  uint64        `json:"last_term,omitempty"`
+	Granted   bool          `json:"granted,omitempty"`
+	PrevIndex uint64        `json:"prev_index,omitempty"`
+	PrevTerm  uint64        `json:"prev_term,omitempty"`
+	Entries   []*raftEntry  `json:"entries,omitempty"`
+	Commit    uint64        `json:"commit,omitempty"`
+	Success   bool          `json:"success,omitempty"`
+	Snapshot  *raftSnapshot `json:"snapshot,omitempty"`
+	Data      []byte        `json:"data,omitempty"`
+}
+
+type raftOut struct {
+	to string
+	m  *raftMsg
+}
+
+// raftNode is the member of a raft group run by this server. The members
+// are the servers named in peers, and exchange messages over the system
+// account. The state of the member is stored in dir, if set.
+type raftNode struct {
+	mu     sync.Mutex
+	s      *Server
+	group  string
+	id     string
+	peers  []string
+	dir    string
+	cipher *storeCipher
+	fsm    raftFSM
+
+	state  raftState
+	term   uint64
+	vote   string
+	leader string
+
+	// The last snapshot and the entries after it.
+	snap    *raftSnapshot
+	log     []*raftEntry
+	commit  uint64
+	applied uint64
+	restore *raftSnapshot
+
+	votes    map[string]bool
+	next     map[string]uint64
+	match    map[string]uint64
+	deadline time.Time
+
+	msgs chan *raftMsg
+	kick chan struct{}
+	out  []raftOut
+}
+
+// startRaftGroup starts the member of the group for this server, whose
+// name must be one of peers.
+func (s *Server) startRaftGroup(group string, peers []string, dir string, fsm raftFSM) (*raftNode, error) {
+	n := &raftNode{
+		s:     s,
+		group: group,
+		id:    s.getOpts().ServerName,
+		peers: peers,
+		dir:   dir,
+		fsm:   fsm,
+		msgs:  make(chan *raftMsg, 1024),
+		kick:  make(chan struct{}, 1),
+	}
+	if n.dir != _EMPTY_ {
+		var err error
+		if n.cipher, err = s.storeCipher("raft/" + group); err != nil {
+			return nil, err
+		}
+		if err := n.load(); err != nil {
+			return nil, err
+		}
+	}
+	n.resetElection()
+
+	subj := fmt.Sprintf(raftSubj, group, n.id)
+	if _, err := s.sysSubscribe(subj, n.receive); err != nil {
+		return nil, err
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		n.run()
+	})
+	return n, nil
+}
+
+// receive queues a message of another member for the run loop.
+func (n *raftNode) receive(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	m := &raftMsg{}
+	if err := json.Unmarshal(msg, m); err != nil {
+		n.s.Debugf("Raft group %q: invalid message: %v", n.group, err)
+		return
+	}
+	// Messages may be lost, the protocol recovers from that.
+	select {
+	case n.msgs <- m:
+	default:
+	}
+}
+
+func (n *raftNode) run() {
+	t := time.NewTimer(time.Until(n.deadline))
+	defer t.Stop()
+	for {
+		select {
+		case <-n.s.quitCh:
+			return
+		case m := <-n.msgs:
+			n.mu.Lock()
+			n.handle(m)
+			n.mu.Unlock()
+		case <-n.kick:
+			n.mu.Lock()
+			if n.state == raftLeader {
+				n.broadcastAppend()
+			}
+			n.mu.Unlock()
+		case <-t.C:
+			n.mu.Lock()
+			n.tick()
+			n.mu.Unlock()
+		}
+		n.flush()
+		n.applyCommitted()
+
+		n.mu.Lock()
+		wait := time.Until(n.deadline)
+		n.mu.Unlock()
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+		t.Reset(wait)
+	}
+}
+
+// Propose submits data to be replicated. A follower forwards it to the
+// leader, without a guarantee that the leader receives it.
+func (n *raftNode) Propose(data []byte) error {
+	n.mu.Lock()
+	switch {
+	case n.state == raftLeader:
+		if err := n.appendEntry(data); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	case n.leader != _EMPTY_:
+		n.send(n.leader, &raftMsg{Type: raftPropose, Data: data})
+	default:
+		n.mu.Unlock()
+		return errRaftNoLeader
+	}
+	n.mu.Unlock()
+	n.flush()
+	select {
+	case n.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Leader returns the name of the leader, if known.
+func (n *raftNode) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+func (n *raftNode) isLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == raftLeader
+}
+
+// Applied returns the index of the last entry applied.
+func (n *raftNode) Applied() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applied
+}
+
+// The methods below are called with the lock held.
+
+func (n *raftNode) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *raftNode) snapIndex() uint64 {
+	if n.snap == nil {
+		return 0
+	}
+	return n.snap.Index
+}
+
+func (n *raftNode) lastIndex() uint64 {
+	return n.snapIndex() + uint64(len(n.log))
+}
+
+func (n *raftNode) lastTerm() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Term
+	}
+	if n.snap != nil {
+		return n.snap.Term
+	}
+	return 0
+}
+
+// termAt returns the term of the entry at index, if known.
+func (n *raftNode) termAt(index uint64) (uint64, bool) {
+	si := n.snapIndex()
+	switch {
+	case index == 0:
+		return 0, true
+	case index == si:
+		return n.snap.Term, true
+	case index < si || index > n.lastIndex():
+		return 0, false
+	}
+	return n.log[index-si-1].Term, true
+}
+
+func (n *raftNode) entry(index uint64) *raftEntry {
+	si := n.snapIndex()
+	if index <= si || index > n.lastIndex() {
+		return nil
+	}
+	return n.log[index-si-1]
+}
+
+func (n *raftNode) isPeer(name string) bool {
+	for _, p := range n.peers {
+		if p == name && p != n.id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *raftNode) resetElection() {
+	n.deadline = time.Now().Add(raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout))))
+}
+
+func (n *raftNode) send(to string, m *raftMsg) {
+	m.From = n.id
+	if m.Term == 0 {
+		m.Term = n.term
+	}
+	n.out = append(n.out, raftOut{to, m})
+}
+
+// flush sends the queued messages, the lock must not be held.
+func (n *raftNode) flush() {
+	n.mu.Lock()
+	out := n.out
+	n.out = nil
+	n.mu.Unlock()
+	for _, o := range out {
+		n.s.sendInternalMsgLocked(fmt.Sprintf(raftSubj, n.group, o.to), _EMPTY_, nil, o.m)
+	}
+}
+
+func (n *raftNode) tick() {
+	if n.state == raftLeader {
+		n.broadcastAppend()
+		n.deadline = time.Now().Add(raftHeartbeatInterval)
+		return
+	}
+	if time.Now().Before(n.deadline) {
+		return
+	}
+	n.campaign()
+}
+
+func (n *raftNode) campaign() {
+	n.state = raftCandidate
+	n.term++
+	n.vote = n.id
+	n.leader = _EMPTY_
+	n.resetElection()
+	// The member can not vote for itself without storing it.
+	if err := n.saveState(); err != nil {
+		n.storeError(err)
+		n.state = raftFollower
+		return
+	}
+	n.votes = map[string]bool{n.id: true}
+	n.s.Debugf("Raft group %q: starting election for term %d", n.group, n.term)
+	if len(n.votes) >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, p := range n.peers {
+		if p != n.id {
+			n.send(p, &raftMsg{Type: raftVote, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()})
+		}
+	}
+}
+
+func (n *raftNode) becomeLeader() {
+	n.state = raftLeader
+	n.leader = n.id
+	n.votes = nil
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	for _, p := range n.peers {
+		n.next[p] = n.lastIndex() + 1
+	}
+	n.s.Noticef("Raft group %q: elected leader for term %d", n.group, n.term)
+	// An entry of the new term commits the entries of the previous ones.
+	n.appendEntry(nil)
+	n.broadcastAppend()
+	n.deadline = time.Now().Add(raftHeartbeatInterval)
+}
+
+func (n *raftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.vote = _EMPTY_
+		n.storeError(n.saveState())
+	}
+	if n.state == raftLeader {
+		n.s.Noticef("Raft group %q: stepping down in term %d", n.group, n.term)
+	}
+	n.state = raftFollower
+	n.votes = nil
+}
+
+// appendEntry adds an entry to the log of the leader, once stored.
+func (n *raftNode) appendEntry(data []byte) error {
+	e := &raftEntry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	if err := n.appendLog([]*raftEntry{e}); err != nil {
+		n.storeError(err)
+		return err
+	}
+	n.log = append(n.log, e)
+	n.advanceCommit()
+	return nil
+}
+
+// advanceCommit commits the entries of the current term stored by a
+// majority of the members.
+func (n *raftNode) advanceCommit() {
+	for i := n.lastIndex(); i > n.commit; i-- {
+		if t, _ := n.termAt(i); t != n.term {
+			break
+		}
+		count := 1
+		for _, p := range n.peers {
+			if p != n.id && n.match[p] >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commit = i
+			break
+		}
+	}
+}
+
+func (n *raftNode) broadcastAppend() {
+	for _, p := range n.peers {
+		if p != n.id {
+			n.sendAppend(p)
+		}
+	}
+}
+
+// sendAppend sends the entries the peer is missing, or the snapshot if
+// they were compacted.
+func (n *raftNode) sendAppend(peer string) {
+	next := n.next[peer]
+	if next == 0 {
+		next = 1
+	}
+	if last := n.lastIndex(); next > last+1 {
+		next = last + 1
+	}
+	n.next[peer] = next
+	if n.snap != nil && next <= n.snap.Index {
+		n.send(peer, &raftMsg{Type: raftInstall, Snapshot: n.snap, Commit: n.commit})
+		return
+	}
+	prev := next - 1
+	prevTerm, _ := n.termAt(prev)
+	si := n.snapIndex()
+	entries := n.log[next-si-1:]
+	if len(entries) > raftMaxAppendEntries {
+		entries = entries[:raftMaxAppendEntries]
+	}
+	n.send(peer, &raftMsg{
+		Type:      raftAppend,
+		PrevIndex: prev,
+		PrevTerm:  prevTerm,
+		Entries:   entries,
+		Commit:    n.commit,
+	})
+}
+
+func (n *raftNode) handle(m *raftMsg) {
+	if !n.isPeer(m.From) {
+		return
+	}
+	if m.Term > n.term {
+		n.stepDown(m.Term)
+		n.leader = _EMPTY_
+	}
+	switch m.Type {
+	case raftVote:
+		n.handleVote(m)
+	case raftVoteResp:
+		if n.state == raftCandidate && m.Term == n.term && m.Granted {
+			n.votes[m.From] = true
+			if len(n.votes) >= n.quorum() {
+				n.becomeLeader()
+			}
+		}
+	case raftAppend:
+		n.handleAppend(m)
+	case raftInstall:
+		n.handleInstall(m)
+	case raftAppendResp:
+		n.handleAppendResp(m)
+	case raftPropose:
+		if n.state == raftLeader && n.appendEntry(m.Data) == nil {
+			n.broadcastAppend()
+		}
+	}
+}
+
+func (n *raftNode) handleVote(m *raftMsg) {
+	resp := &raftMsg{Type: raftVoteResp}
+	upToDate := m.LastTerm > n.lastTerm() || (m.LastTerm == n.lastTerm() && m.LastIndex >= n.lastIndex())
+	if m.Term == n.term && (n.vote == _EMPTY_ || n.vote == m.From) && upToDate {
+		// The vote is only granted once stored, so that it is not given
+		// to another candidate of the term after a crash.
+		vote := n.vote
+		n.vote = m.From
+		if err := n.saveState(); err != nil {
+			n.storeError(err)
+			n.vote = vote
+		} else {
+			n.resetElection()
+			resp.Granted = true
+		}
+	}
+	n.send(m.From, resp)
+}
+
+// follow accepts the sender of the message as the leader of its term,
+// returns false if its term is stale.
+func (n *raftNode) follow(m *raftMsg) bool {
+	if m.Term < n.term {
+		n.send(m.From, &raftMsg{Type: raftAppendResp, LastIndex: n.lastIndex()})
+		return false
+	}
+	if n.state != raftFollower {
+		n.stepDown(m.Term)
+	}
+	if n.leader != m.From {
+		n.s.Debugf("Raft group %q: following %q in term %d", n.group, m.From, m.Term)
+	}
+	n.leader = m.From
+	n.resetElection()
+	return true
+}
+
+// handleAppend stores the entries of the leader. They are only
+// acknowledged once stored: if storing them fails the log is left as it
+// was and nothing is sent back, the leader sending them again with its
+// next heartbeat.
+func (n *raftNode) handleAppend(m *raftMsg) {
+	if !n.follow(m) {
+		return
+	}
+	resp := &raftMsg{Type: raftAppendResp}
+	if m.PrevIndex > n.lastIndex() {
+		resp.LastIndex = n.lastIndex()
+		n.send(m.From, resp)
+		return
+	}
+	// The entries up to the snapshot are committed, so they match.
+	if m.PrevIndex > n.snapIndex() {
+		if t, _ := n.termAt(m.PrevIndex); t != m.PrevTerm {
+			resp.LastIndex = m.PrevIndex - 1
+			n.send(m.From, resp)
+			return
+		}
+	}
+	log := n.log
+	var added []*raftEntry
+	var truncated bool
+	for _, e := range m.Entries {
+		if e.Index <= n.snapIndex() {
+			continue
+		}
+		if e.Index <= n.snapIndex()+uint64(len(log)) {
+			if t, _ := n.termAt(e.Index); t == e.Term {
+				continue
+			}
+			// Drop the conflicting entry and the ones after it, in a
+			// copy of the log in case it can not be stored.
+			log = append([]*raftEntry(nil), log[:e.Index-n.snapIndex()-1]...)
+			truncated = true
+		}
+		log = append(log, e)
+		added = append(added, e)
+	}
+	var err error
+	if truncated {
+		err = n.rewriteLog(log)
+	} else if len(added) > 0 {
+		err = n.appendLog(added)
+	}
+	if err != nil {
+		n.storeError(err)
+		return
+	}
+	n.log = log
+	last := m.PrevIndex + uint64(len(m.Entries))
+	if commit := min64(m.Commit, last); commit > n.commit {
+		n.commit = commit
+	}
+	resp.Success = true
+	resp.LastIndex = last
+	n.send(m.From, resp)
+}
+
+func (n *raftNode) handleInstall(m *raftMsg) {
+	if !n.follow(m) || m.Snapshot == nil {
+		return
+	}
+	snap := m.Snapshot
+	if snap.Index > n.commit {
+		// Keep the entries after the snapshot if they match it.
+		var log []*raftEntry
+		if t, ok := n.termAt(snap.Index); ok && t == snap.Term && snap.Index > n.snapIndex() {
+			log = append(log, n.log[snap.Index-n.snapIndex():]...)
+		}
+		err := n.saveSnapshot(snap)
+		if err == nil {
+			err = n.rewriteLog(log)
+		}
+		if err != nil {
+			n.storeError(err)
+			return
+		}
+		n.log, n.snap = log, snap
+		n.commit, n.applied = snap.Index, snap.Index
+		n.restore = snap
+		n.s.Debugf("Raft group %q: installed snapshot at index %d", n.group, snap.Index)
+	}
+	n.send(m.From, &raftMsg{Type: raftAppendResp, Success: true, LastIndex: snap.Index})
+}
+
+func (n *raftNode) handleAppendResp(m *raftMsg) {
+	if n.state != raftLeader || m.Term != n.term {
+		return
+	}
+	if m.Success {
+		if m.LastIndex > n.match[m.From] {
+			n.match[m.From] = m.LastIndex
+		}
+		if m.LastIndex+1 > n.next[m.From] {
+			n.next[m.From] = m.LastIndex + 1
+		}
+		n.advanceCommit()
+		if n.next[m.From] <= n.lastIndex() {
+			n.sendAppend(m.From)
+		}
+		return
+	}
+	if next := m.LastIndex + 1; next < n.next[m.From] {
+		n.next[m.From] = next
+	}
+	n.sendAppend(m.From)
+}
+
+// applyCommitted applies the committed entries to the state machine, and
+// compacts the log if needed. The lock must not be held.
+func (n *raftNode) applyCommitted() {
+	n.mu.Lock()
+	restore := n.restore
+	n.restore = nil
+	var entries []*raftEntry
+	for n.applied < n.commit {
+		n.applied++
+		if e := n.entry(n.applied); e != nil {
+			entries = append(entries, e)
+		}
+	}
+	applied := n.applied
+	compact := applied-n.snapIndex() >= raftSnapshotThreshold
+	n.mu.Unlock()
+
+	if restore != nil {
+		if err := n.fsm.restore(restore.Data); err != nil {
+			n.s.Errorf("Raft group %q: error restoring snapshot: %v", n.group, err)
+		}
+	}
+	for _, e := range entries {
+		if len(e.Data) > 0 {
+			n.fsm.apply(e.Data)
+		}
+	}
+	if compact {
+		data := n.fsm.snapshot()
+		n.mu.Lock()
+		n.compact(applied, data)
+		n.mu.Unlock()
+	}
+}
+
+// compact replaces the entries up to index by the snapshot.
+func (n *raftNode) compact(index uint64, data []byte) {
+	if index <= n.snapIndex() {
+		return
+	}
+	term, _ := n.termAt(index)
+	log := append([]*raftEntry(nil), n.log[index-n.snapIndex():]...)
+	snap := &raftSnapshot{Index: index, Term: term, Data: data}
+	err := n.saveSnapshot(snap)
+	if err == nil {
+		err = n.rewriteLog(log)
+	}
+	if err != nil {
+		// The log is kept, and compacted again later.
+		n.storeError(err)
+		return
+	}
+	n.log, n.snap = log, snap
+}
+
+// Storage, the lock is held by the callers. The files are synced to disk
+// before returning, since a member must not reply on what it could lose.
+
+func (n *raftNode) storeError(err error) {
+	if err != nil {
+		n.s.Errorf("Raft group %q: error storing state: %v", n.group, err)
+	}
+}
+
+func (n *raftNode) writeFile(name string, data []byte) error {
+	tmp := filepath.Join(n.dir, name+".tmp")
+	if err := writeFileSync(tmp, data, 0640); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return renameSync(tmp, filepath.Join(n.dir, name))
+}
+
+func (n *raftNode) saveState() error {
+	if n.dir == _EMPTY_ {
+		return nil
+	}
+	b, _ := json.Marshal(map[string]interface{}{"term": n.term, "vote": n.vote})
+	return n.writeSealedFile(raftStateFile, b)
+}
+
+func (n *raftNode) saveSnapshot(snap *raftSnapshot) error {
+	if n.dir == _EMPTY_ || snap == nil {
+		return nil
+	}
+	b, _ := json.Marshal(snap)
+	return n.writeSealedFile(raftSnapshotFile, b)
+}
+
+// writeSealedFile encrypts the data, if enabled, and writes it to the file.
+func (n *raftNode) writeSealedFile(name string, data []byte) error {
+	data, err := n.cipher.seal(name, data)
+	if err != nil {
+		return err
+	}
+	return n.writeFile(name, data)
+}
+
+func (n *raftNode) encodeEntries(entries []*raftEntry) ([]byte, error) {
+	var buf []byte
+	for _, e := range entries {
+		b, _ := json.Marshal(e)
+		b, err := n.cipher.sealLine(raftLogFile, b)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	return buf, nil
+}
+
+func (n *raftNode) appendLog(entries []*raftEntry) error {
+	if n.dir == _EMPTY_ {
+		return nil
+	}
+	buf, err := n.encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	err = appendLogSync(&f, filepath.Join(n.dir, raftLogFile), buf)
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (n *raftNode) rewriteLog(entries []*raftEntry) error {
+	if n.dir == _EMPTY_ {
+		return nil
+	}
+	buf, err := n.encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+	return n.writeFile(raftLogFile, buf)
+}
+
+// load reads the stored state, snapshot and log of the member. They are
+// stored again if they were not encrypted with the current key.
+func (n *raftNode) load() error {
+	if err := os.MkdirAll(n.dir, 0750); err != nil {
+		return err
+	}
+	var rewrite bool
+	open := func(name string, b []byte) ([]byte, error) {
+		b, stale, err := n.cipher.open(name, b)
+		rewrite = rewrite || stale
+		return b, err
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(n.dir, raftStateFile)); err == nil {
+		if b, err = open(raftStateFile, b); err != nil {
+			return fmt.Errorf("raft state: %v", err)
+		}
+		var st struct {
+			Term uint64 `json:"term"`
+			Vote string `json:"vote"`
+		}
+		if err := json.Unmarshal(b, &st); err != nil {
+			return fmt.Errorf("invalid raft state: %v", err)
+		}
+		n.term, n.vote = st.Term, st.Vote
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(n.dir, raftSnapshotFile)); err == nil {
+		if b, err = open(raftSnapshotFile, b); err != nil {
+			return fmt.Errorf("raft snapshot: %v", err)
+		}
+		snap := &raftSnapshot{}
+		if err := json.Unmarshal(b, snap); err != nil {
+			return fmt.Errorf("invalid raft snapshot: %v", err)
+		}
+		if err := n.fsm.restore(snap.Data); err != nil {
+			return err
+		}
+		n.snap = snap
+		n.commit, n.applied = snap.Index, snap.Index
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := n.loadLog(&rewrite); err != nil {
+		return err
+	}
+	if rewrite {
+		if err := n.saveState(); err != nil {
+			return err
+		}
+		if err := n.saveSnapshot(n.snap); err != nil {
+			return err
+		}
+		return n.rewriteLog(n.log)
+	}
+	return nil
+}
+
+// loadLog reads the stored log, setting rewrite if some entries were not
+// encrypted with the current key.
+func (n *raftNode) loadLog(rewrite *bool) error {
+	f, err := os.Open(filepath.Join(n.dir, raftLogFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// The last entry was torn by a crash, so it was not
+			// acknowledged, rewrite the log without.
+			*rewrite = true
+			return nil
+		}
+		if len(line) > 1 {
+			line, stale, oerr := n.cipher.openLine(raftLogFile, line)
+			if oerr != nil {
+				return fmt.Errorf("raft log: %v", oerr)
+			}
+			*rewrite = *rewrite || stale
+			e := &raftEntry{}
+			if jerr := json.Unmarshal(line, e); jerr != nil {
+				return fmt.Errorf("invalid raft log: %v", jerr)
+			}
+			if e.Index == n.lastIndex()+1 {
+				n.log = append(n.log, e)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
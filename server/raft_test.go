@@ -0,0 +1,517 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestMetadataConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		server_name: B
+		metadata {
+			peers: [A, B, C]
+			store_dir: "/tmp/meta"
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if mo := opts.Metadata; len(mo.Peers) != 3 || mo.Peers[1] != "B" || mo.StoreDir != "/tmp/meta" {
+		t.Fatalf("Unexpected options: %+v", mo)
+	}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, test := range []struct {
+		name  string
+		peers []string
+	}{
+		{_EMPTY_, []string{"A"}},
+		{"D", []string{"A", "B"}},
+		{"A", []string{"A", "A"}},
+		{"A", []string{"A", "B.C"}},
+	} {
+		opts := DefaultOptions()
+		opts.ServerName = test.name
+		opts.Metadata.Peers = test.peers
+		if err := validateOptions(opts); err == nil {
+			t.Fatalf("Expected an error for %q in %v", test.name, test.peers)
+		}
+	}
+}
+
+// testRaftFSM records the applied entries.
+type testRaftFSM struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (f *testRaftFSM) apply(data []byte) {
+	f.mu.Lock()
+	f.entries = append(f.entries, string(data))
+	f.mu.Unlock()
+}
+
+func (f *testRaftFSM) snapshot() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, _ := json.Marshal(f.entries)
+	return b
+}
+
+func (f *testRaftFSM) restore(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Unmarshal(data, &f.entries)
+}
+
+func (f *testRaftFSM) values() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.Join(f.entries, ",")
+}
+
+// Shortens the raft timers, returns a function restoring them.
+func setRaftTestTimers() func() {
+	hb, et, st := raftHeartbeatInterval, raftElectionTimeout, raftSnapshotThreshold
+	raftHeartbeatInterval, raftElectionTimeout, raftSnapshotThreshold = 25*time.Millisecond, 150*time.Millisecond, 4
+	return func() {
+		raftHeartbeatInterval, raftElectionTimeout, raftSnapshotThreshold = hb, et, st
+	}
+}
+
+// Returns the options of a cluster of servers named A, B and C with a
+// system account.
+func raftClusterOpts(t *testing.T, configure func(*Options)) []*Options {
+	var all []*Options
+	var routes []string
+	for _, name := range []string{"A", "B", "C"} {
+		opts := DefaultOptions()
+		opts.ServerName = name
+		opts.Cluster.Host = "127.0.0.1"
+		opts.Cluster.Port = -1
+		opts.Routes = RoutesFromStr(strings.Join(routes, ","))
+		if configure != nil {
+			configure(opts)
+		} else {
+			opts.Accounts = []*Account{NewAccount("SYS")}
+			opts.SystemAccount = "SYS"
+		}
+		all = append(all, opts)
+		s := RunServer(opts)
+		s.Shutdown()
+		routes = append(routes, fmt.Sprintf("nats://127.0.0.1:%d", opts.Cluster.Port))
+	}
+	return all
+}
+
+func checkRaftLeader(t *testing.T, nodes ...*raftNode) *raftNode {
+	t.Helper()
+	var leader *raftNode
+	checkFor(t, 5*time.Second, 25*time.Millisecond, func() error {
+		leader = nil
+		for _, n := range nodes {
+			if n.isLeader() {
+				if leader != nil {
+					return fmt.Errorf("two leaders")
+				}
+				leader = n
+			}
+		}
+		if leader == nil {
+			return fmt.Errorf("no leader")
+		}
+		for _, n := range nodes {
+			if n.Leader() != leader.id {
+				return fmt.Errorf("%q follows %q", n.id, n.Leader())
+			}
+		}
+		return nil
+	})
+	return leader
+}
+
+func checkRaftValues(t *testing.T, expected string, fsms ...*testRaftFSM) {
+	t.Helper()
+	checkFor(t, 5*time.Second, 25*time.Millisecond, func() error {
+		for i, f := range fsms {
+			if v := f.values(); v != expected {
+				return fmt.Errorf("member %d has %q, expected %q", i, v, expected)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRaftGroupReplication(t *testing.T) {
+	defer setRaftTestTimers()()
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	all := raftClusterOpts(t, nil)
+	peers := []string{"A", "B", "C"}
+	servers := make([]*Server, 3)
+	nodes := make([]*raftNode, 3)
+	fsms := make([]*testRaftFSM, 3)
+	start := func(i int) {
+		t.Helper()
+		servers[i] = RunServer(all[i])
+		fsms[i] = &testRaftFSM{}
+		n, err := servers[i].startRaftGroup("TEST", peers, filepath.Join(dir, peers[i]), fsms[i])
+		if err != nil {
+			t.Fatalf("Error starting group: %v", err)
+		}
+		nodes[i] = n
+	}
+	for i := range all {
+		start(i)
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+	checkClusterFormed(t, servers...)
+
+	leader := checkRaftLeader(t, nodes...)
+	// Proposals are accepted by the leader and forwarded by the followers.
+	var follower *raftNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+		}
+	}
+	leader.Propose([]byte("1"))
+	checkRaftValues(t, "1", fsms...)
+	follower.Propose([]byte("2"))
+	checkRaftValues(t, "1,2", fsms...)
+
+	// A new leader is elected when the leader stops, and the stopped
+	// member catches up, from a snapshot, when restarted.
+	var stopped int
+	for i, n := range nodes {
+		if n == leader {
+			stopped = i
+		}
+	}
+	servers[stopped].Shutdown()
+	var running []*raftNode
+	var runningFSMs []*testRaftFSM
+	for i := range nodes {
+		if i != stopped {
+			running = append(running, nodes[i])
+			runningFSMs = append(runningFSMs, fsms[i])
+		}
+	}
+	leader = checkRaftLeader(t, running...)
+	for i := 3; i <= 10; i++ {
+		if err := leader.Propose([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("Error on propose: %v", err)
+		}
+	}
+	expected := "1,2,3,4,5,6,7,8,9,10"
+	checkRaftValues(t, expected, runningFSMs...)
+	checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+		if _, err := os.Stat(filepath.Join(dir, leader.id, raftSnapshotFile)); err != nil {
+			return fmt.Errorf("Expected a snapshot: %v", err)
+		}
+		return nil
+	})
+
+	start(stopped)
+	checkClusterFormed(t, servers...)
+	checkRaftValues(t, expected, fsms...)
+	checkRaftLeader(t, nodes...)
+}
+
+func TestMetadataReplicatesAccountResolver(t *testing.T) {
+	defer setRaftTestTimers()()
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	okp, _ := nkeys.FromSeed(oSeed)
+	opub, _ := okp.PublicKey()
+	skp, _ := nkeys.CreateAccount()
+	spub, _ := skp.PublicKey()
+	sjwt, _ := jwt.NewAccountClaims(spub).Encode(okp)
+
+	var resolvers []*MemAccResolver
+	all := raftClusterOpts(t, func(opts *Options) {
+		mr := &MemAccResolver{}
+		mr.Store(spub, sjwt)
+		resolvers = append(resolvers, mr)
+		opts.TrustedKeys = []string{opub}
+		opts.AccountResolver = mr
+		opts.SystemAccount = spub
+		opts.Metadata = MetadataOpts{
+			Peers:    []string{"A", "B", "C"},
+			StoreDir: filepath.Join(dir, opts.ServerName),
+		}
+	})
+	servers := make([]*Server, 3)
+	for i, opts := range all {
+		servers[i] = RunServer(opts)
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+	checkClusterFormed(t, servers...)
+	checkRaftLeader(t, servers[0].meta, servers[1].meta, servers[2].meta)
+
+	// Stop C, publish the claims of a new account, and C gets them when
+	// it is restarted.
+	servers[2].Shutdown()
+	checkRaftLeader(t, servers[0].meta, servers[1].meta)
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ac := jwt.NewAccountClaims(apub)
+	ac.Limits.Conn = 7
+	ajwt, _ := ac.Encode(okp)
+
+	nc, err := nats.Connect(servers[0].ClientURL(), createUserCreds(t, servers[0], skp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	natsPub(t, nc, fmt.Sprintf(accUpdateEventSubj, apub), []byte(ajwt))
+	natsFlush(t, nc)
+	checkFor(t, 2*time.Second, 25*time.Millisecond, func() error {
+		for i, mr := range resolvers[:2] {
+			if got, _ := mr.Fetch(apub); got != ajwt {
+				return fmt.Errorf("resolver of %d does not have the claims", i)
+			}
+		}
+		return nil
+	})
+
+	// A fresh resolver for the restarted server.
+	mr := &MemAccResolver{}
+	mr.Store(spub, sjwt)
+	all[2].AccountResolver = mr
+	servers[2] = RunServer(all[2])
+	checkFor(t, 5*time.Second, 25*time.Millisecond, func() error {
+		if got, _ := mr.Fetch(apub); got != ajwt {
+			return fmt.Errorf("restarted resolver does not have the claims")
+		}
+		return nil
+	})
+	acc, err := servers[2].LookupAccount(apub)
+	if err != nil || acc.MaxActiveConnections() != 7 {
+		t.Fatalf("Unexpected account %v: %v", acc, err)
+	}
+}
+
+// checkStreamDefined waits for the stream, and the consumer if set, to be
+// started, or stopped, on all the servers.
+func checkStreamDefined(t *testing.T, stream, consumer string, defined bool, servers ...*Server) {
+	t.Helper()
+	checkFor(t, 5*time.Second, 25*time.Millisecond, func() error {
+		for _, s := range servers {
+			s.mu.Lock()
+			ss := s.streams["A"]
+			s.mu.Unlock()
+			var found bool
+			if ss != nil {
+				ss.mu.Lock()
+				st := ss.streams[stream]
+				ss.mu.Unlock()
+				if found = st != nil; found && consumer != _EMPTY_ {
+					st.mu.Lock()
+					found = st.consumers[consumer] != nil
+					st.mu.Unlock()
+				}
+			}
+			if found != defined {
+				return fmt.Errorf("stream %q consumer %q defined on %s: %v", stream, consumer, s.info.Name, found)
+			}
+		}
+		return nil
+	})
+}
+
+func TestMetadataReplicatesStreamDefinitions(t *testing.T) {
+	defer setRaftTestTimers()()
+	dir, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	configure := func(opts *Options) {
+		acc := NewAccount("A")
+		acc.streams = map[string]*StreamConfig{
+			"EVENTS": {Name: "EVENTS", Subjects: []string{"events.>"}, MaxMsgs: 100},
+		}
+		opts.Accounts = []*Account{NewAccount("SYS"), acc}
+		opts.Users = []*User{{Username: "a", Password: "a", Account: acc}}
+		opts.SystemAccount = "SYS"
+		opts.Streams.StoreDir = filepath.Join(dir, opts.ServerName, "streams")
+		opts.Metadata = MetadataOpts{
+			Peers:    []string{"A", "B", "C"},
+			StoreDir: filepath.Join(dir, opts.ServerName, "meta"),
+		}
+	}
+	all := raftClusterOpts(t, configure)
+	servers := make([]*Server, 3)
+	for i, opts := range all {
+		servers[i] = RunServer(opts)
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+	checkClusterFormed(t, servers...)
+	leader := checkRaftLeader(t, servers[0].meta, servers[1].meta, servers[2].meta)
+
+	// The definitions are handled by the leader, and applied by all.
+	nc, err := nats.Connect(leader.s.ClientURL(), nats.UserInfo("a", "a"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	resp := streamRequest(t, nc, streamAPIPrefix+streamOpCreate+tsep+"ORDERS",
+		[]byte(`{"subjects":["orders.*"],"max_msgs":100}`))
+	if resp.Error != _EMPTY_ || resp.Stream == nil || resp.Stream.Config.Name != "ORDERS" {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkStreamDefined(t, "ORDERS", _EMPTY_, true, servers...)
+	resp = streamRequest(t, nc, streamAPIPrefix+streamOpConsumerCreate+tsep+"ORDERS", []byte(`{"durable":"d"}`))
+	if resp.Error != _EMPTY_ || resp.Consumer == nil || resp.Consumer.Name != "d" {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkStreamDefined(t, "ORDERS", "d", true, servers...)
+
+	for _, test := range []struct {
+		op, name, data, err string
+	}{
+		{streamOpCreate, "ORDERS", `{"subjects":["orders.*"],"max_msgs":10}`, "already exists"},
+		{streamOpCreate, "EVENTS", `{"subjects":["other.*"],"max_msgs":10}`, "already exists"},
+		{streamOpDelete, "EVENTS", _EMPTY_, "defined in the configuration"},
+		{streamOpConsumerCreate, "ORDERS", `{"durable":"d"}`, "already exists"},
+		{streamOpConsumerDelete, "ORDERS", `{"durable":"x"}`, errStreamConsumerNotFound.Error()},
+	} {
+		resp := streamRequest(t, nc, streamAPIPrefix+test.op+tsep+test.name, []byte(test.data))
+		if !strings.Contains(resp.Error, test.err) {
+			t.Fatalf("Expected error %q for %s %s, got %+v", test.err, test.op, test.name, resp)
+		}
+	}
+
+	// Stop a follower, and it catches up on the definitions when restarted.
+	var follower int
+	for i, s := range servers {
+		if s.meta != leader {
+			follower = i
+			break
+		}
+	}
+	servers[follower].Shutdown()
+	resp = streamRequest(t, nc, streamAPIPrefix+streamOpCreate+tsep+"LOGS", []byte(`{"subjects":["logs.>"],"max_msgs":100}`))
+	if resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	resp = streamRequest(t, nc, streamAPIPrefix+streamOpConsumerCreate+tsep+"LOGS", []byte(`{"durable":"l"}`))
+	if resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	resp = streamRequest(t, nc, streamAPIPrefix+streamOpDelete+tsep+"ORDERS", nil)
+	if resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	configure(all[follower])
+	servers[follower] = RunServer(all[follower])
+	checkStreamDefined(t, "LOGS", "l", true, servers...)
+	checkStreamDefined(t, "ORDERS", _EMPTY_, false, servers...)
+	checkStreamDefined(t, "EVENTS", _EMPTY_, true, servers...)
+	for _, s := range servers {
+		s.mu.Lock()
+		ss := s.streams["A"]
+		s.mu.Unlock()
+		if _, err := os.Stat(filepath.Join(ss.dir, "ORDERS"+streamLogExt)); !os.IsNotExist(err) {
+			t.Fatalf("Expected the log of the deleted stream to be removed from %s: %v", s.info.Name, err)
+		}
+	}
+}
+
+func TestRaftRefusesWhatItCanNotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The directory of the member is missing, so nothing can be stored.
+	n := &raftNode{s: &Server{}, group: "TEST", id: "A", peers: []string{"A", "B", "C"}, dir: filepath.Join(dir, "A"), term: 1}
+	vote := &raftMsg{Type: raftVote, From: "B", Term: 1}
+	appendMsg := &raftMsg{Type: raftAppend, From: "B", Term: 1, Entries: []*raftEntry{{Index: 1, Term: 1, Data: []byte("x")}}, Commit: 1}
+	n.handle(vote)
+	n.handle(appendMsg)
+	if len(n.out) != 1 || n.out[0].m.Type != raftVoteResp || n.out[0].m.Granted || n.vote != _EMPTY_ {
+		t.Fatalf("Expected the vote to be refused, got %+v", n.out)
+	}
+	if len(n.log) != 0 || n.commit != 0 {
+		t.Fatalf("Expected the entries to be refused, got %+v", n.log)
+	}
+
+	n.out = nil
+	if err := os.MkdirAll(n.dir, 0750); err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	n.handle(vote)
+	n.handle(appendMsg)
+	if len(n.out) != 2 || !n.out[0].m.Granted || !n.out[1].m.Success || n.vote != "B" || len(n.log) != 1 {
+		t.Fatalf("Expected the vote and the entries to be accepted, got %+v", n.out)
+	}
+
+	// A partial entry left by a crash is dropped when loading the log.
+	f, err := os.OpenFile(filepath.Join(n.dir, raftLogFile), os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatalf("Error opening log: %v", err)
+	}
+	f.Write([]byte(`{"index":2,"te`))
+	f.Close()
+	loaded := &raftNode{s: &Server{}, group: "TEST", id: "A", dir: n.dir, fsm: &testRaftFSM{}}
+	if err := loaded.load(); err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	if loaded.term != 1 || loaded.vote != "B" || len(loaded.log) != 1 || string(loaded.log[0].Data) != "x" {
+		t.Fatalf("Unexpected state: term %d, vote %q, log %+v", loaded.term, loaded.vote, loaded.log)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(n.dir, raftLogFile)); err != nil || strings.Contains(string(b), `"index":2`) {
+		t.Fatalf("Expected the partial entry to be removed, got %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Samples of a token not used for this long are removed.
+	rateSampleTTL = 10 * time.Minute
+	// Maximum number of tokens with samples, the least recently used
+	// token is removed to make room for a new one.
+	maxRateTokens = 256
+)
+
+// Rates are the per second rates of the message and byte counters since
+// the previous sample taken for the same token, or since the start of the
+// server or connection for the first sample.
+type Rates struct {
+	Since    time.Time `json:"since"`
+	InMsgs   float64   `json:"in_msgs"`
+	OutMsgs  float64   `json:"out_msgs"`
+	InBytes  float64   `json:"in_bytes"`
+	OutBytes float64   `json:"out_bytes"`
+}
+
+// counterSample is the value of the counters at a given time.
+type counterSample struct {
+	time     time.Time
+	inMsgs   int64
+	outMsgs  int64
+	inBytes  int64
+	outBytes int64
+}
+
+// rates returns the rates from the previous sample prev, or from zero at
+// start if there is none, to this sample.
+func (cs *counterSample) rates(prev *counterSample, start time.Time) *Rates {
+	if prev == nil {
+		prev = &counterSample{time: start}
+	}
+	r := &Rates{Since: prev.time}
+	secs := cs.time.Sub(prev.time).Seconds()
+	if secs <= 0 {
+		return r
+	}
+	rate := func(cur, prev int64) float64 {
+		// The counter was reset, count from zero.
+		if cur < prev {
+			prev = 0
+		}
+		return float64(cur-prev) / secs
+	}
+	r.InMsgs = rate(cs.inMsgs, prev.inMsgs)
+	r.OutMsgs = rate(cs.outMsgs, prev.outMsgs)
+	r.InBytes = rate(cs.inBytes, prev.inBytes)
+	r.OutBytes = rate(cs.outBytes, prev.outBytes)
+	return r
+}
+
+// rateSamples are the last samples of the counters, by requester token.
+type rateSamples struct {
+	sync.Mutex
+	tokens map[string]*tokenSamples
+}
+
+type tokenSamples struct {
+	used  time.Time
+	varz  *counterSample
+	conns map[uint64]*counterSample
+}
+
+// Returns the samples of the token, creating them if needed.
+// Lock should be held.
+func (rs *rateSamples) get(token string, now time.Time) (*tokenSamples, error) {
+	if token == _EMPTY_ {
+		return nil, fmt.Errorf("delta requires a token")
+	}
+	ts := rs.tokens[token]
+	if ts == nil {
+		if rs.tokens == nil {
+			rs.tokens = make(map[string]*tokenSamples)
+		}
+		var lru string
+		for t, ts := range rs.tokens {
+			if now.Sub(ts.used) > rateSampleTTL {
+				delete(rs.tokens, t)
+			} else if lru == _EMPTY_ || ts.used.Before(rs.tokens[lru].used) {
+				lru = t
+			}
+		}
+		if len(rs.tokens) >= maxRateTokens {
+			delete(rs.tokens, lru)
+		}
+		ts = &tokenSamples{conns: make(map[uint64]*counterSample)}
+		rs.tokens[token] = ts
+	}
+	ts.used = now
+	return ts, nil
+}
+
+// varzRates returns the rates of the counters of the server since the
+// previous sample of the token.
+func (s *Server) varzRates(token string, v *Varz) (*Rates, error) {
+	cur := &counterSample{v.Now, v.InMsgs, v.OutMsgs, v.InBytes, v.OutBytes}
+	rs := &s.rateSamples
+	rs.Lock()
+	defer rs.Unlock()
+	ts, err := rs.get(token, v.Now)
+	if err != nil {
+		return nil, err
+	}
+	r := cur.rates(ts.varz, v.Start)
+	ts.varz = cur
+	return r, nil
+}
+
+// setConnRates sets the rates of the connections since the previous
+// sample of the token. The samples of the connections no longer open are
+// removed.
+func (s *Server) setConnRates(token string, conns []*ConnInfo, now time.Time) error {
+	rs := &s.rateSamples
+	rs.Lock()
+	defer rs.Unlock()
+	ts, err := rs.get(token, now)
+	if err != nil {
+		return err
+	}
+	for _, ci := range conns {
+		cur := &counterSample{now, ci.InMsgs, ci.OutMsgs, ci.InBytes, ci.OutBytes}
+		if ci.Stop != nil {
+			cur.time = *ci.Stop
+		}
+		ci.Rates = cur.rates(ts.conns[ci.Cid], ci.Start)
+		if ci.Stop != nil {
+			delete(ts.conns, ci.Cid)
+		} else {
+			ts.conns[ci.Cid] = cur
+		}
+	}
+	s.mu.Lock()
+	for cid := range ts.conns {
+		if _, ok := s.clients[cid]; !ok {
+			delete(ts.conns, cid)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
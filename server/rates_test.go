@@ -0,0 +1,130 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCounterSampleRates(t *testing.T) {
+	start := time.Now()
+	prev := &counterSample{start.Add(time.Second), 10, 20, 100, 200}
+	cur := &counterSample{start.Add(3 * time.Second), 30, 10, 300, 600}
+	r := cur.rates(prev, start)
+	// The out messages were reset, counted from zero.
+	if r.Since != prev.time || r.InMsgs != 10 || r.OutMsgs != 5 || r.InBytes != 100 || r.OutBytes != 200 {
+		t.Fatalf("Unexpected rates: %+v", r)
+	}
+	if r = cur.rates(nil, start); r.Since != start || r.InMsgs != 10 || r.OutBytes != 200 {
+		t.Fatalf("Unexpected rates: %+v", r)
+	}
+}
+
+func TestConnzDelta(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		natsPub(t, nc, "foo", []byte("hello"))
+	}
+	natsFlush(t, nc)
+
+	connz := func(token string) *Connz {
+		t.Helper()
+		url := fmt.Sprintf("http://127.0.0.1:%d%s?delta=true&token=%s", s.MonitorAddr().Port, ConnzPath, token)
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if token == _EMPTY_ {
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("Expected a bad request, got %v", resp.StatusCode)
+			}
+			return nil
+		}
+		var c Connz
+		if err := json.Unmarshal(body, &c); err != nil {
+			t.Fatalf("Error unmarshalling response %q: %v", body, err)
+		}
+		if len(c.Conns) != 1 || c.Conns[0].Rates == nil {
+			t.Fatalf("Expected the rates of the connection, got %s", body)
+		}
+		return &c
+	}
+	connz(_EMPTY_)
+
+	// The first sample is since the start of the connection.
+	c := connz("a")
+	if r := c.Conns[0].Rates; !r.Since.Equal(c.Conns[0].Start) || r.InMsgs <= 0 || r.InBytes <= 0 {
+		t.Fatalf("Unexpected rates: %+v", r)
+	}
+	prev := c.Now
+	c = connz("a")
+	if r := c.Conns[0].Rates; !r.Since.Equal(prev) || r.InMsgs != 0 {
+		t.Fatalf("Unexpected rates: %+v", r)
+	}
+	// Other tokens have their own samples.
+	if r := connz("b").Conns[0].Rates; !r.Since.Equal(c.Conns[0].Start) || r.InMsgs <= 0 {
+		t.Fatalf("Unexpected rates: %+v", r)
+	}
+
+	// Without delta, no rates.
+	cz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error on connz: %v", err)
+	}
+	if cz.Conns[0].Rates != nil {
+		t.Fatalf("Unexpected rates: %+v", cz.Conns[0].Rates)
+	}
+}
+
+func TestVarzDelta(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	natsPub(t, nc, "foo", []byte("hello"))
+	natsFlush(t, nc)
+
+	if _, err := s.Varz(&VarzOptions{Delta: true}); err == nil {
+		t.Fatal("Expected an error without token")
+	}
+	v, err := s.Varz(&VarzOptions{Delta: true, Token: "a"})
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	if v.Rates == nil || !v.Rates.Since.Equal(v.Start) || v.Rates.InMsgs <= 0 {
+		t.Fatalf("Unexpected rates: %+v", v.Rates)
+	}
+	prev := v.Now
+	if v, err = s.Varz(&VarzOptions{Delta: true, Token: "a"}); err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	if !v.Rates.Since.Equal(prev) || v.Rates.InMsgs != 0 {
+		t.Fatalf("Unexpected rates: %+v", v.Rates)
+	}
+}
@@ -202,6 +202,19 @@ func (t *tlsTimeoutOption) Apply(server *Server) {
 	server.Noticef("Reloaded: tls timeout = %v", t.newValue)
 }
 
+// tlsHandshakeFirstOption implements the option interface for the tls
+// `handshake_first` setting.
+type tlsHandshakeFirstOption struct {
+	noopOption
+	newValue bool
+	fallback time.Duration
+}
+
+// Apply is a no-op because the setting is read when accepting clients.
+func (t *tlsHandshakeFirstOption) Apply(server *Server) {
+	server.Noticef("Reloaded: tls handshake first = %v, fallback delay = %v", t.newValue, t.fallback)
+}
+
 // authOption is a base struct that provides default option behaviors.
 type authOption struct {
 	noopOption
@@ -334,8 +347,16 @@ func (r *routesOption) Apply(server *Server) {
 	}
 	server.mu.Unlock()
 
-	// Remove routes.
+	// Remove routes, including the ones resolved from removed SRV routes.
+	var removed []*url.URL
 	for _, remove := range r.remove {
+		if isSRVURL(remove) {
+			removed = append(removed, server.discoveredRoutes.get(remove.String())...)
+		} else {
+			removed = append(removed, remove)
+		}
+	}
+	for _, remove := range removed {
 		for _, client := range routes {
 			var url *url.URL
 			client.mu.Lock()
@@ -368,31 +389,12 @@ type maxConnOption struct {
 // Apply the max connections change by closing random connections til we are
 // below the limit if necessary.
 func (m *maxConnOption) Apply(server *Server) {
+	// A reload of this setting replaces any limit set at runtime.
 	server.mu.Lock()
-	var (
-		clients = make([]*client, len(server.clients))
-		i       = 0
-	)
-	// Map iteration is random, which allows us to close random connections.
-	for _, client := range server.clients {
-		clients[i] = client
-		i++
-	}
+	server.connLimits.maxConn = 0
 	server.mu.Unlock()
 
-	if m.newValue > 0 && len(clients) > m.newValue {
-		// Close connections til we are within the limit.
-		var (
-			numClose = len(clients) - m.newValue
-			closed   = 0
-		)
-		for _, client := range clients {
-			client.maxConnExceeded()
-			closed++
-			if closed >= numClose {
-				break
-			}
-		}
+	if closed := server.closeClientsOverLimit(m.newValue); closed > 0 {
 		server.Noticef("Closed %d connections to fall within max_connections", closed)
 	}
 	server.Noticef("Reloaded: max_connections = %v", m.newValue)
@@ -464,6 +466,22 @@ func (m *maxPayloadOption) Apply(server *Server) {
 	server.Noticef("Reloaded: max_payload = %d", m.newValue)
 }
 
+// maxClosedClientsOption implements the option interface for the
+// `max_closed_clients` setting.
+type maxClosedClientsOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the setting by resizing the closed connections buffer, keeping
+// the most recent ones.
+func (m *maxClosedClientsOption) Apply(server *Server) {
+	server.mu.Lock()
+	server.closed = server.closed.resize(m.newValue)
+	server.mu.Unlock()
+	server.Noticef("Reloaded: max_closed_clients = %d", m.newValue)
+}
+
 // pingIntervalOption implements the option interface for the `ping_interval`
 // setting.
 type pingIntervalOption struct {
@@ -477,6 +495,18 @@ func (p *pingIntervalOption) Apply(server *Server) {
 	server.Noticef("Reloaded: ping_interval = %s", p.newValue)
 }
 
+// rttIntervalOption implements the option interface for the `rtt_interval`
+// setting.
+type rttIntervalOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the RTT interval is read by the ping timers.
+func (r *rttIntervalOption) Apply(server *Server) {
+	server.Noticef("Reloaded: rtt_interval = %s", r.newValue)
+}
+
 // maxPingsOutOption implements the option interface for the `ping_max`
 // setting.
 type maxPingsOutOption struct {
@@ -503,6 +533,33 @@ func (w *writeDeadlineOption) Apply(server *Server) {
 	server.Noticef("Reloaded: write_deadline = %s", w.newValue)
 }
 
+// flushOption implements the option interface for the `flush` setting.
+type flushOption struct {
+	noopOption
+	newValue FlushOpts
+}
+
+// Apply is a no-op because the flush options are applied to new connections.
+func (f *flushOption) Apply(server *Server) {
+	server.Noticef("Reloaded: flush = %+v", f.newValue)
+}
+
+// outboundProxyOption implements the option interface for the `outbound_proxy` setting.
+type outboundProxyOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op because the proxy is looked up when dialing.
+func (o *outboundProxyOption) Apply(server *Server) {
+	proxy := o.newValue
+	if u, err := parseProxyURL(proxy); err == nil {
+		// Do not log the proxy credentials.
+		proxy = u.Scheme + "://" + u.Host
+	}
+	server.Noticef("Reloaded: outbound_proxy = %s", proxy)
+}
+
 // clientAdvertiseOption implements the option interface for the `client_advertise` setting.
 type clientAdvertiseOption struct {
 	noopOption
@@ -566,6 +623,163 @@ func (m *maxTracedMsgLenOption) Apply(server *Server) {
 	server.Noticef("Reloaded: max_traced_msg_len = %d", m.newValue)
 }
 
+// clientErrorLogRateOption implements the option interface for the
+// `client_error_log_rate` setting.
+type clientErrorLogRateOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op because the rate is read from the options when logging.
+func (c *clientErrorLogRateOption) Apply(server *Server) {
+	server.Noticef("Reloaded: client_error_log_rate = %d", c.newValue)
+}
+
+// openTelemetryOption implements the option interface for the OpenTelemetry
+// exporter.
+type openTelemetryOption struct {
+	noopOption
+	newValue OpenTelemetryOpts
+}
+
+// Apply the setting by enabling or disabling the spans. The new options
+// are otherwise used for the next messages and exports.
+func (o *openTelemetryOption) Apply(server *Server) {
+	server.startOTel()
+	server.Noticef("Reloaded: opentelemetry endpoint = %q", o.newValue.Endpoint)
+}
+
+// statsdOption implements the option interface for the StatsD emitter.
+type statsdOption struct {
+	noopOption
+	newValue StatsDOpts
+}
+
+// Apply the setting by starting the emitter if needed. The new options are
+// otherwise used from the next emission.
+func (o *statsdOption) Apply(server *Server) {
+	server.startStatsD()
+	server.Noticef("Reloaded: statsd endpoint = %q", o.newValue.Endpoint)
+}
+
+// webhookOption implements the option interface for the connection
+// events webhook.
+type webhookOption struct {
+	noopOption
+	newValue WebhookOpts
+}
+
+// Apply the setting by enabling or disabling the webhook. The new options
+// are otherwise used for the next events.
+func (o *webhookOption) Apply(server *Server) {
+	server.startWebhook()
+	server.Noticef("Reloaded: webhook url = %q", o.newValue.URL)
+}
+
+// connectionEventsOption implements the option interface for the
+// `connection_events` setting.
+type connectionEventsOption struct {
+	noopOption
+	newValue ConnectionEventsOpts
+}
+
+// Apply is a no-op because the subject is read for each event. Only the
+// clients connecting once enabled have their disconnect published.
+func (o *connectionEventsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: connection_events subject = %q", o.newValue.Subject)
+}
+
+// authLockoutOption implements the option interface for the authentication
+// lockout settings.
+type authLockoutOption struct {
+	noopOption
+	newValue AuthLockoutOpts
+}
+
+// Apply is a no-op because the settings are read on each authentication.
+// The failures recorded so far are kept.
+func (o *authLockoutOption) Apply(server *Server) {
+	server.Noticef("Reloaded: auth_lockout threshold = %d, ban_threshold = %d",
+		o.newValue.Threshold, o.newValue.BanThreshold)
+}
+
+// maxProcsOption implements the option interface for the max_procs setting.
+type maxProcsOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the setting by updating GOMAXPROCS.
+func (o *maxProcsOption) Apply(server *Server) {
+	server.configureMaxProcs()
+	server.Noticef("Reloaded: max_procs = %d", o.newValue)
+}
+
+// trafficOption implements the option interface for the traffic analytics.
+type trafficOption struct {
+	noopOption
+	newValue TrafficOpts
+}
+
+// Apply the setting by enabling or disabling the analytics. The top
+// subjects of the accounts are reset if their number changed.
+func (o *trafficOption) Apply(server *Server) {
+	server.startTraffic()
+	server.Noticef("Reloaded: traffic enabled = %v, top_subjects = %d",
+		o.newValue.Enabled, o.newValue.TopSubjects)
+}
+
+// queueGroupsOption implements the option interface for the distribution
+// policy of the queue groups.
+type queueGroupsOption struct {
+	noopOption
+	newValue QueueGroupOpts
+}
+
+// Apply the setting by making the clients take a new snapshot of the
+// policy with their next message.
+func (o *queueGroupsOption) Apply(server *Server) {
+	atomic.AddInt32(&server.queueGroupsGen, 1)
+	server.Noticef("Reloaded: queue_groups policy = %q", o.newValue.Policy)
+}
+
+// networksOption implements the option interface for the networks client
+// connections are accepted from.
+type networksOption struct {
+	noopOption
+	newValue *NetworkACL
+}
+
+// Apply is a no-op because the networks are checked on each accept. The
+// connections already established are not affected.
+func (o *networksOption) Apply(server *Server) {
+	server.Noticef("Reloaded: client networks")
+}
+
+// acceptRateOption implements the option interface for the client
+// `accept_rate` setting.
+type acceptRateOption struct {
+	noopOption
+	newValue *AcceptRateOpts
+}
+
+// Apply is a no-op because the accept rate is checked on each accept.
+func (o *acceptRateOption) Apply(server *Server) {
+	server.Noticef("Reloaded: client accept_rate")
+}
+
+// accountRevocationsOption implements the option interface for the accounts
+// revoked by the operator.
+type accountRevocationsOption struct {
+	noopOption
+}
+
+// Apply the setting by closing the connections of the revoked accounts.
+func (o *accountRevocationsOption) Apply(server *Server) {
+	server.closeRevokedAccounts()
+	server.Noticef("Reloaded: account_revocations")
+}
+
 // Reload reads the current configuration file and applies any supported
 // changes. This returns an error if the server was not started with a config
 // file or an option which doesn't support hot-swapping was changed.
@@ -607,6 +821,11 @@ func (s *Server) Reload() error {
 
 	setBaselineOptions(newOpts)
 
+	// The ACME client can't be reconfigured, keep serving its certificates.
+	if s.acme != nil && newOpts.TLSConfig == nil && reflect.DeepEqual(curOpts.ACME, newOpts.ACME) {
+		newOpts.TLSConfig = curOpts.TLSConfig
+	}
+
 	// setBaselineOptions sets Port to 0 if set to -1 (RANDOM port)
 	// If that's the case, set it to the saved value when the accept loop was
 	// created.
@@ -721,6 +940,15 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &remoteSyslogOption{newValue: newValue.(string)})
 		case "tlsconfig":
 			diffOpts = append(diffOpts, &tlsOption{newValue: newValue.(*tls.Config)})
+		case "tlshandshakefirst", "tlshandshakefirstfallback":
+			// Report both settings once.
+			if field.Name == "TLSHandshakeFirstFallback" && s.getOpts().TLSHandshakeFirst != newOpts.TLSHandshakeFirst {
+				continue
+			}
+			diffOpts = append(diffOpts, &tlsHandshakeFirstOption{
+				newValue: newOpts.TLSHandshakeFirst,
+				fallback: newOpts.TLSHandshakeFirstFallback,
+			})
 		case "tlstimeout":
 			diffOpts = append(diffOpts, &tlsTimeoutOption{newValue: newValue.(float64)})
 		case "username":
@@ -756,12 +984,20 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &maxControlLineOption{newValue: newValue.(int32)})
 		case "maxpayload":
 			diffOpts = append(diffOpts, &maxPayloadOption{newValue: newValue.(int32)})
+		case "maxclosedclients":
+			diffOpts = append(diffOpts, &maxClosedClientsOption{newValue: newValue.(int)})
 		case "pinginterval":
 			diffOpts = append(diffOpts, &pingIntervalOption{newValue: newValue.(time.Duration)})
+		case "rttinterval":
+			diffOpts = append(diffOpts, &rttIntervalOption{newValue: newValue.(time.Duration)})
 		case "maxpingsout":
 			diffOpts = append(diffOpts, &maxPingsOutOption{newValue: newValue.(int)})
 		case "writedeadline":
 			diffOpts = append(diffOpts, &writeDeadlineOption{newValue: newValue.(time.Duration)})
+		case "flush":
+			diffOpts = append(diffOpts, &flushOption{newValue: newValue.(FlushOpts)})
+		case "outboundproxy":
+			diffOpts = append(diffOpts, &outboundProxyOption{newValue: newValue.(string)})
 		case "clientadvertise":
 			cliAdv := newValue.(string)
 			if cliAdv != "" {
@@ -823,6 +1059,30 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			continue
 		case "maxtracedmsglen":
 			diffOpts = append(diffOpts, &maxTracedMsgLenOption{newValue: newValue.(int)})
+		case "clienterrorlograte":
+			diffOpts = append(diffOpts, &clientErrorLogRateOption{newValue: newValue.(int)})
+		case "opentelemetry":
+			diffOpts = append(diffOpts, &openTelemetryOption{newValue: newValue.(OpenTelemetryOpts)})
+		case "statsd":
+			diffOpts = append(diffOpts, &statsdOption{newValue: newValue.(StatsDOpts)})
+		case "webhook":
+			diffOpts = append(diffOpts, &webhookOption{newValue: newValue.(WebhookOpts)})
+		case "connectionevents":
+			diffOpts = append(diffOpts, &connectionEventsOption{newValue: newValue.(ConnectionEventsOpts)})
+		case "networks":
+			diffOpts = append(diffOpts, &networksOption{newValue: newValue.(*NetworkACL)})
+		case "acceptrate":
+			diffOpts = append(diffOpts, &acceptRateOption{newValue: newValue.(*AcceptRateOpts)})
+		case "accountrevocations":
+			diffOpts = append(diffOpts, &accountRevocationsOption{})
+		case "authlockout":
+			diffOpts = append(diffOpts, &authLockoutOption{newValue: newValue.(AuthLockoutOpts)})
+		case "maxprocs":
+			diffOpts = append(diffOpts, &maxProcsOption{newValue: newValue.(int)})
+		case "traffic":
+			diffOpts = append(diffOpts, &trafficOption{newValue: newValue.(TrafficOpts)})
+		case "queuegroups":
+			diffOpts = append(diffOpts, &queueGroupsOption{newValue: newValue.(QueueGroupOpts)})
 		case "port":
 			// check to see if newValue == 0 and continue if so.
 			if newValue == 0 {
@@ -870,6 +1130,8 @@ func (s *Server) applyOptions(ctx *reloadContext, opts []option) {
 
 	if reloadLogging {
 		s.ConfigureLogger()
+		// The levels of the configuration replace the ones set at runtime.
+		s.removeLogScope(serverLogScopeKey)
 	}
 	if reloadClientTrcLvl {
 		s.reloadClientTraceLevel()
@@ -891,7 +1153,11 @@ func (s *Server) reloadClientTraceLevel() {
 	if opts.NoLog {
 		return
 	}
+	s.updateClientTraceLevel()
+}
 
+// Updates the cached trace level of every client.
+func (s *Server) updateClientTraceLevel() {
 	// Create a list of all clients.
 	// Update their trace level when not holding server or gateway lock
 
@@ -976,7 +1242,9 @@ func (s *Server) reloadAuthorization() {
 				}
 				newAcc.sl = acc.sl
 				newAcc.rm = acc.rm
+				newAcc.isubs = acc.isubs
 				newAcc.respMap = acc.respMap
+				atomic.StoreInt32(&newAcc.csubs, atomic.LoadInt32(&acc.csubs))
 				acc.mu.RUnlock()
 
 				// Check if current and new config of this account are same
@@ -1046,6 +1314,18 @@ func (s *Server) reloadAuthorization() {
 	}
 	s.mu.Unlock()
 
+	// Update expected interest for accounts that were transferred or added.
+	s.accounts.Range(func(k, v interface{}) bool {
+		s.updateExpectedInterest(v.(*Account))
+		return true
+	})
+
+	// Start or stop the key-value and object stores and the streams of the
+	// accounts.
+	s.configureKV()
+	s.configureObjectStores()
+	s.configureStreams()
+
 	// Close clients that have moved accounts
 	for _, client := range cclients {
 		client.closeConnection(ClientClosed)
@@ -1229,14 +1509,28 @@ func (s *Server) reloadClusterPermissions(oldPerms *RoutePermissions) {
 // validateClusterOpts ensures the new ClusterOpts does not change host or
 // port, which do not support reload.
 func validateClusterOpts(old, new ClusterOpts) error {
+	if old.Name != new.Name {
+		return fmt.Errorf("config reload not supported for cluster name: old=%s, new=%s",
+			old.Name, new.Name)
+	}
 	if old.Host != new.Host {
 		return fmt.Errorf("config reload not supported for cluster host: old=%s, new=%s",
 			old.Host, new.Host)
 	}
+	if old.HostV6 != new.HostV6 {
+		return fmt.Errorf("config reload not supported for cluster host_v6: old=%s, new=%s",
+			old.HostV6, new.HostV6)
+	}
 	if old.Port != new.Port {
 		return fmt.Errorf("config reload not supported for cluster port: old=%d, new=%d",
 			old.Port, new.Port)
 	}
+	if !reflect.DeepEqual(old.Discovery, new.Discovery) {
+		return fmt.Errorf("config reload not supported for cluster discovery")
+	}
+	if !reflect.DeepEqual(old.SubjectOwners, new.SubjectOwners) {
+		return fmt.Errorf("config reload not supported for cluster subject_owners")
+	}
 	// Validate Cluster.Advertise syntax
 	if new.Advertise != "" {
 		if _, _, err := parseHostPort(new.Advertise, 0); err != nil {
@@ -31,6 +31,7 @@ import (
 	"reflect"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -4121,3 +4122,179 @@ func TestLoggingReload(t *testing.T) {
 	check("on.log", tracingPresent)
 	check("off-post.log", tracingAbsent)
 }
+
+func TestConfigReloadKeepsResponsePermissions(t *testing.T) {
+	template := `
+		listen: "127.0.0.1:-1"
+		authorization {
+			users = [
+				{user: service, password: pwd, permissions: {subscribe: "request", %s}}
+				{user: ivan, password: pwd}
+			]
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, "allow_responses: {max: 2}")))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	svcNC := natsConnect(t, fmt.Sprintf("nats://service:pwd@%s:%d", opts.Host, opts.Port))
+	defer svcNC.Close()
+	reqSub := natsSubSync(t, svcNC, "request")
+	natsFlush(t, svcNC)
+
+	nc := natsConnect(t, fmt.Sprintf("nats://ivan:pwd@%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	replySub := natsSubSync(t, nc, "reply")
+	natsFlush(t, nc)
+
+	natsPubReq(t, nc, "request", "reply", []byte("req1"))
+	req1 := natsNexMsg(t, reqSub, time.Second)
+
+	// Reload with a change to the response permissions. The service should
+	// still be able to respond to the request it received before the reload.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(template, "allow_responses: {max: 3}")))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	natsPub(t, svcNC, req1.Reply, []byte("reply"))
+	natsNexMsg(t, replySub, time.Second)
+
+	// Now remove response permissions altogether, this should not cause
+	// any issue when delivering new requests to the service.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(template, "publish: \">\"")))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		natsPubReq(t, nc, "request", "reply", []byte("req"))
+		natsNexMsg(t, reqSub, time.Second)
+	}
+	s.mu.Lock()
+	var svc *client
+	for _, c := range s.clients {
+		if c.opts.Username == "service" {
+			svc = c
+		}
+	}
+	s.mu.Unlock()
+	if svc == nil {
+		t.Fatal("Could not find service connection")
+	}
+	svc.mu.Lock()
+	replies := svc.replies
+	svc.mu.Unlock()
+	if replies != nil {
+		t.Fatalf("Expected replies to no longer be tracked, got %v", replies)
+	}
+}
+
+func TestConfigReloadRTTInterval(t *testing.T) {
+	s, _, conf := runReloadServerWithContent(t, []byte(`
+		listen: "127.0.0.1:-1"
+		ping_interval: "50ms"
+		rtt_interval: "100ms"
+	`))
+	defer os.Remove(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	s.mu.Lock()
+	var c *client
+	for _, cli := range s.clients {
+		c = cli
+	}
+	s.mu.Unlock()
+	getRTTStart := func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.rttStart
+	}
+
+	// The RTT is measured again while the client is active.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if getRTTStart().IsZero() {
+			return fmt.Errorf("RTT not measured yet")
+		}
+		return nil
+	})
+	start := getRTTStart()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		nc.Publish("foo", []byte("hello"))
+		if !getRTTStart().After(start) {
+			return fmt.Errorf("RTT not measured again")
+		}
+		return nil
+	})
+
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(`
+		listen: "127.0.0.1:-1"
+		ping_interval: "50ms"
+		rtt_interval: "1h"
+	`))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if ri := s.getOpts().RTTInterval; ri != time.Hour {
+		t.Fatalf("Expected rtt_interval to be 1h, got %v", ri)
+	}
+	// Let a possible PING in flight be answered.
+	time.Sleep(100 * time.Millisecond)
+	start = getRTTStart()
+	for i := 0; i < 10; i++ {
+		nc.Publish("foo", []byte("hello"))
+		time.Sleep(15 * time.Millisecond)
+	}
+	if !getRTTStart().Equal(start) {
+		t.Fatal("RTT should not have been measured again")
+	}
+}
+
+func TestConfigReloadAccountMaxSubscriptions(t *testing.T) {
+	template := `
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				max_subscriptions: 3
+				users [{user: a1, password: pwd}, {user: a2, password: pwd}]
+			}
+			%s
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, "")))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://a1:pwd@%s", s.Addr()))
+	defer nc.Close()
+	natsSubSync(t, nc, "foo")
+	natsSubSync(t, nc, "bar")
+	natsFlush(t, nc)
+
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(template, "B { users [{user: b, password: pwd}] }"))
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if n := atomic.LoadInt32(&acc.csubs); n != 2 {
+		t.Fatalf("Expected 2 client subscriptions after reload, got %v", n)
+	}
+
+	// The subscriptions created before the reload still count toward the limit.
+	c, cr, _ := newClientForServer(s)
+	defer c.close()
+	c.parseAsync("CONNECT {\"user\":\"a2\",\"pass\":\"pwd\",\"verbose\":false}\r\nSUB baz 1\r\nPING\r\n")
+	expectPong(t, cr)
+	c.parseAsync("SUB bat 2\r\n")
+	l, _ := cr.ReadString('\n')
+	if !strings.HasPrefix(l, "-ERR") || !strings.Contains(l, ErrTooManyAccountSubs.Error()) {
+		t.Fatalf("Expected an ERR for max account subscriptions exceeded, got: %v", l)
+	}
+}
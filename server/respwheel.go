@@ -0,0 +1,180 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Number of slots in the response permissions timer wheel.
+const respWheelSlots = 64
+
+// This is used to dynamically track responses and reply subjects
+// for dynamic permissioning.
+type resp struct {
+	t time.Time
+	n int
+	// Tick of the wheel in which this entry expires.
+	exp int64
+}
+
+// respWheel tracks the reply subjects a client is allowed to respond to.
+// Entries are placed in the slots of a timer wheel based on when they
+// expire, so expiring them only visits the entries that are due. The
+// number of entries is capped so memory stays bounded under high
+// request rates.
+type respWheel struct {
+	replies map[string]*resp
+	slots   [respWheelSlots][]string
+	ttl     time.Duration
+	// Width of a slot in nanoseconds, 0 if entries do not expire.
+	tick int64
+	// Next tick to expire.
+	next int64
+	max  int
+	tmr  *time.Timer
+}
+
+// Create a new wheel. A ttl <= 0 means entries do not expire.
+func newRespWheel(ttl time.Duration, max int, now time.Time) *respWheel {
+	w := &respWheel{replies: make(map[string]*resp), ttl: ttl, max: max}
+	if ttl > 0 {
+		// Leave room so that an entry never lands in the slot being expired.
+		w.tick = int64(ttl)/(respWheelSlots-2) + 1
+		w.next = now.UnixNano() / w.tick
+	}
+	return w
+}
+
+func (w *respWheel) len() int {
+	return len(w.replies)
+}
+
+// add tracks a new reply subject, evicting the entries closest to
+// expiring if we are at capacity.
+func (w *respWheel) add(reply string, now time.Time) {
+	w.expire(now)
+	if _, ok := w.replies[reply]; !ok && len(w.replies) >= w.max {
+		w.evict(len(w.replies) - w.max + 1)
+	}
+	w.insert(reply, &resp{t: now})
+}
+
+func (w *respWheel) insert(reply string, r *resp) {
+	if w.tick > 0 {
+		r.exp = (r.t.UnixNano() + int64(w.ttl)) / w.tick
+		i := r.exp % respWheelSlots
+		w.slots[i] = append(w.slots[i], reply)
+	}
+	w.replies[reply] = r
+}
+
+// allow returns true if a response can be sent to reply, accounting
+// for it. Entries are removed as soon as they are used up.
+func (w *respWheel) allow(reply string, now time.Time, maxMsgs int) bool {
+	r := w.replies[reply]
+	if r == nil {
+		return false
+	}
+	if w.ttl > 0 && now.Sub(r.t) > w.ttl {
+		delete(w.replies, reply)
+		return false
+	}
+	if r.n++; maxMsgs > 0 && r.n >= maxMsgs {
+		delete(w.replies, reply)
+	}
+	return true
+}
+
+// expire removes the entries that are past their ttl.
+func (w *respWheel) expire(now time.Time) {
+	if w.tick == 0 {
+		return
+	}
+	nt := now.UnixNano() / w.tick
+	// Entries expire less than a full rotation after being added,
+	// so if we are that far behind all of them have expired.
+	if nt-w.next >= respWheelSlots {
+		w.replies = make(map[string]*resp)
+		w.slots = [respWheelSlots][]string{}
+		w.next = nt
+		return
+	}
+	for ; w.next < nt; w.next++ {
+		i := w.next % respWheelSlots
+		for _, reply := range w.slots[i] {
+			if r := w.replies[reply]; r != nil && r.exp == w.next {
+				delete(w.replies, reply)
+			}
+		}
+		w.slots[i] = nil
+	}
+}
+
+// evict removes at least n entries, the ones closest to expiring first.
+func (w *respWheel) evict(n int) {
+	if w.tick == 0 {
+		// Nothing expires, so remove random entries.
+		for reply := range w.replies {
+			delete(w.replies, reply)
+			if n--; n <= 0 {
+				return
+			}
+		}
+		return
+	}
+	for t := w.next; n > 0 && t < w.next+respWheelSlots; t++ {
+		i := t % respWheelSlots
+		// Slots are in insertion order, so the oldest come first.
+		k := 0
+		for ; k < len(w.slots[i]) && n > 0; k++ {
+			reply := w.slots[i][k]
+			if r := w.replies[reply]; r != nil && r.exp == t {
+				delete(w.replies, reply)
+				n--
+			}
+		}
+		w.slots[i] = w.slots[i][k:]
+	}
+}
+
+// setTTL changes the ttl, keeping the entries we already track.
+func (w *respWheel) setTTL(ttl time.Duration, now time.Time) *respWheel {
+	if ttl == w.ttl {
+		return w
+	}
+	nw := newRespWheel(ttl, w.max, now)
+	for reply, r := range w.replies {
+		if ttl <= 0 || now.Sub(r.t) <= ttl {
+			nw.insert(reply, r)
+		}
+	}
+	w.stop()
+	return nw
+}
+
+// sweepInterval returns when to expire entries next. This is jittered
+// so that clients with the same permissions do not all sweep together.
+func (w *respWheel) sweepInterval() time.Duration {
+	d := w.ttl / 4
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+func (w *respWheel) stop() {
+	if w.tmr != nil {
+		w.tmr.Stop()
+		w.tmr = nil
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRespWheelExpire(t *testing.T) {
+	now := time.Now()
+	w := newRespWheel(time.Minute, 100, now)
+	for i := 0; i < 10; i++ {
+		w.add(fmt.Sprintf("reply.%d", i), now.Add(time.Duration(i)*time.Second))
+	}
+	// Nothing expires before the ttl.
+	w.expire(now.Add(time.Minute))
+	if l := w.len(); l != 10 {
+		t.Fatalf("Expected 10 entries, got %d", l)
+	}
+	// Entries expire within a slot of their ttl.
+	w.expire(now.Add(time.Minute + 5*time.Second + time.Duration(w.tick)))
+	if l := w.len(); l != 4 {
+		t.Fatalf("Expected 4 entries, got %d", l)
+	}
+	// Even if we have not checked for a long time.
+	w.expire(now.Add(time.Hour))
+	if l := w.len(); l != 0 {
+		t.Fatalf("Expected no entries, got %d", l)
+	}
+	// Re-adding a reply extends it.
+	w.add("reply", now.Add(time.Hour))
+	w.add("reply", now.Add(time.Hour+30*time.Second))
+	w.expire(now.Add(time.Hour + time.Minute + time.Duration(w.tick)))
+	if l := w.len(); l != 1 {
+		t.Fatalf("Expected 1 entry, got %d", l)
+	}
+}
+
+func TestRespWheelAllow(t *testing.T) {
+	now := time.Now()
+	w := newRespWheel(time.Minute, 100, now)
+	w.add("reply", now)
+	// Used up entries are released right away.
+	if !w.allow("reply", now, 2) || !w.allow("reply", now, 2) {
+		t.Fatal("Expected responses to be allowed")
+	}
+	if w.allow("reply", now, 2) || w.len() != 0 {
+		t.Fatalf("Expected response to be denied and entry removed, got %d entries", w.len())
+	}
+	// Expired entries are denied even if not swept yet.
+	w.add("reply", now)
+	if w.allow("reply", now.Add(2*time.Minute), -1) || w.len() != 0 {
+		t.Fatalf("Expected response to be denied and entry removed, got %d entries", w.len())
+	}
+}
+
+func TestRespWheelBounded(t *testing.T) {
+	for _, ttl := range []time.Duration{time.Minute, -1} {
+		now := time.Now()
+		w := newRespWheel(ttl, 100, now)
+		for i := 0; i < 1000; i++ {
+			w.add(fmt.Sprintf("reply.%d", i), now.Add(time.Duration(i)*time.Millisecond))
+		}
+		if l := w.len(); l != 100 {
+			t.Fatalf("Expected 100 entries, got %d", l)
+		}
+		if ttl > 0 {
+			// The oldest were evicted.
+			if _, ok := w.replies["reply.999"]; !ok {
+				t.Fatal("Expected newest entry to be kept")
+			}
+			if _, ok := w.replies["reply.0"]; ok {
+				t.Fatal("Expected oldest entry to be evicted")
+			}
+		}
+	}
+}
+
+func TestRespWheelSetTTL(t *testing.T) {
+	now := time.Now()
+	w := newRespWheel(time.Minute, 100, now)
+	w.add("old", now)
+	w.add("new", now.Add(50*time.Second))
+	if nw := w.setTTL(time.Minute, now); nw != w {
+		t.Fatal("Expected same wheel")
+	}
+	w = w.setTTL(30*time.Second, now.Add(50*time.Second))
+	if _, ok := w.replies["old"]; ok || w.len() != 1 {
+		t.Fatalf("Expected only the new entry, got %v", w.replies)
+	}
+	w.expire(now.Add(80*time.Second + time.Duration(w.tick)))
+	if l := w.len(); l != 0 {
+		t.Fatalf("Expected no entries, got %d", l)
+	}
+}
@@ -25,6 +25,8 @@ type closedClient struct {
 type closedRingBuffer struct {
 	total uint64
 	conns []*closedClient
+	// Connections that were dropped when the buffer was resized.
+	dropped uint64
 }
 
 // Create a new ring buffer with at most max items.
@@ -53,7 +55,22 @@ func (rb *closedRingBuffer) len() int {
 }
 
 func (rb *closedRingBuffer) totalConns() uint64 {
-	return rb.total
+	return rb.total + rb.dropped
+}
+
+// Returns a ring buffer of at most max items holding the most
+// recent connections of this one.
+func (rb *closedRingBuffer) resize(max int) *closedRingBuffer {
+	nrb := newClosedRingBuffer(max)
+	ccs := rb.closedClients()
+	if len(ccs) > max {
+		ccs = ccs[len(ccs)-max:]
+	}
+	for _, cc := range ccs {
+		nrb.append(cc)
+	}
+	nrb.dropped = rb.totalConns() - nrb.total
+	return nrb
 }
 
 // This will return a sorted copy of the list which recipient can
@@ -74,3 +74,30 @@ func TestRBclosedClients(t *testing.T) {
 		testList(i)
 	}
 }
+
+func TestRBResize(t *testing.T) {
+	rb := newClosedRingBuffer(10)
+	for i := 1; i <= 25; i++ {
+		rb.append(&closedClient{user: fmt.Sprintf("%d", i)})
+	}
+
+	rb = rb.resize(3)
+	if rbl := rb.len(); rbl != 3 {
+		t.Fatalf("Expected len of 3, got %d", rbl)
+	}
+	if rbt := rb.totalConns(); rbt != 25 {
+		t.Fatalf("Expected total of 25, got %d", rbt)
+	}
+	if ccs := fmt.Sprint(rb.closedClients()); ccs != "[23 24 25]" {
+		t.Fatalf("Expected the most recent connections, got %v", ccs)
+	}
+
+	rb = rb.resize(5)
+	rb.append(&closedClient{user: "26"})
+	if ccs := fmt.Sprint(rb.closedClients()); ccs != "[23 24 25 26]" {
+		t.Fatalf("Unexpected connections after growing: %v", ccs)
+	}
+	if rbt := rb.totalConns(); rbt != 26 {
+		t.Fatalf("Expected total of 26, got %d", rbt)
+	}
+}
@@ -66,6 +66,10 @@ func setRouteProtoForTest(wantedProto int) int {
 type route struct {
 	remoteID     string
 	remoteName   string
+	pruned       []string
+	lastInterest time.Time
+	remoteTags   map[string]string
+	cluster      string
 	didSolicit   bool
 	retry        bool
 	routeType    RouteType
@@ -226,6 +230,68 @@ func (c *client) processRoutedMsgArgs(arg []byte) error {
 	return nil
 }
 
+// processRoutedHeaderMsgArgs is like processRoutedMsgArgs, but for HMSG
+// which has the header size before the total size.
+func (c *client) processRoutedHeaderMsgArgs(arg []byte) error {
+	if !c.headers {
+		return ErrMsgHeadersNotSupported
+	}
+	args := splitArg(arg)
+	c.pa.arg = arg
+	switch len(args) {
+	case 0, 1, 2, 3:
+		return fmt.Errorf("processRoutedHeaderMsgArgs Parse Error: '%s'", args)
+	case 4:
+		c.pa.reply = nil
+		c.pa.queues = nil
+		c.pa.hdb = args[2]
+		c.pa.szb = args[3]
+	case 5:
+		c.pa.reply = args[2]
+		c.pa.queues = nil
+		c.pa.hdb = args[3]
+		c.pa.szb = args[4]
+	default:
+		// args[2] is our reply indicator. Should be + or | normally.
+		if len(args[2]) != 1 {
+			return fmt.Errorf("processRoutedHeaderMsgArgs Bad or Missing Reply Indicator: '%s'", args[2])
+		}
+		switch args[2][0] {
+		case '+':
+			c.pa.reply = args[3]
+		case '|':
+			c.pa.reply = nil
+		default:
+			return fmt.Errorf("processRoutedHeaderMsgArgs Bad or Missing Reply Indicator: '%s'", args[2])
+		}
+		// Grab header and total size.
+		c.pa.hdb = args[len(args)-2]
+		c.pa.szb = args[len(args)-1]
+
+		// Grab queue names.
+		if c.pa.reply != nil {
+			c.pa.queues = args[4 : len(args)-2]
+		} else {
+			c.pa.queues = args[3 : len(args)-2]
+		}
+	}
+	c.pa.hdr = parseSize(c.pa.hdb)
+	c.pa.size = parseSize(c.pa.szb)
+	if c.pa.hdr <= 0 {
+		return fmt.Errorf("processRoutedHeaderMsgArgs Bad or Missing Header Size: '%s'", args)
+	}
+	if c.pa.size < 0 || c.pa.hdr > c.pa.size {
+		return fmt.Errorf("processRoutedHeaderMsgArgs Bad or Missing Size: '%s'", args)
+	}
+	c.pa.psz = []byte(strconv.Itoa(c.pa.size - c.pa.hdr))
+
+	// Common ones processed after check for arg length
+	c.pa.account = args[0]
+	c.pa.subject = args[1]
+	c.pa.pacache = arg[:len(args[0])+len(args[1])+1]
+	return nil
+}
+
 // processInboundRouteMsg is called to process an inbound msg from a route.
 func (c *client) processInboundRoutedMsg(msg []byte) {
 	// Update statistics
@@ -248,6 +314,13 @@ func (c *client) processInboundRoutedMsg(msg []byte) {
 		return
 	}
 
+	// Drop messages on subjects this route is not allowed to import. The
+	// remote may still forward them if its export permissions are broader.
+	if !c.canImport(string(c.pa.subject)) {
+		c.Debugf("Dropping routed message on subject %q not allowed by import permissions", c.pa.subject)
+		return
+	}
+
 	acc, r := c.getAccAndResultFromCache()
 	if acc == nil {
 		c.Debugf("Unknown account %q for routed message on subject: %q", c.pa.account, c.pa.subject)
@@ -359,6 +432,8 @@ func (c *client) processRouteInfo(info *Info) {
 	c.route.tlsRequired = info.TLSRequired
 	c.route.gatewayURL = info.GatewayURL
 	c.route.remoteName = info.Name
+	c.route.remoteTags = info.Tags
+	c.route.cluster = info.Cluster
 	// When sent through route INFO, if the field is set, it should be of size 1.
 	if len(info.LeafNodeURLs) == 1 {
 		c.route.leafnodeURL = info.LeafNodeURLs[0]
@@ -378,6 +453,18 @@ func (c *client) processRouteInfo(info *Info) {
 	c.opts.Import = info.Import
 	c.opts.Export = info.Export
 
+	// The subjects owned by other servers than both ends are not exchanged.
+	// Set once, since the messages are routed without the route's lock.
+	c.route.pruned = prunedSubjects(s.getOpts(), info.Name)
+
+	// Messages with headers are sent as HMSG only if both sides support it.
+	c.headers = info.Headers && s.supportsHeaders()
+
+	// Compress what we send if both sides have compression enabled.
+	if info.Compression {
+		c.startCompression(s.getOpts().Cluster.Compression, info.CompressionAlgorithms)
+	}
+
 	// If we do not know this route's URL, construct one on the fly
 	// from the information provided.
 	if c.route.url == nil {
@@ -403,6 +490,7 @@ func (c *client) processRouteInfo(info *Info) {
 
 	if added, sendInfo := s.addRoute(c, info); added {
 		c.Debugf("Registering remote route %q", info.ID)
+		s.routeConnected(c)
 
 		// Send our subs to the other side.
 		s.sendSubsToRoute(c)
@@ -551,7 +639,7 @@ func (s *Server) hasThisRouteConfigured(info *Info) bool {
 			return true
 		}
 	}
-	return false
+	return s.discoveredRoutes.containsHost(urlToCheckExplicit)
 }
 
 // forwardNewRouteInfoToKnownServers sends the INFO protocol of the new route
@@ -577,6 +665,10 @@ func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
 // This is for ROUTER connections only.
 // Lock is held on entry.
 func (c *client) canImport(subject string) bool {
+	// Subjects owned by other servers are not exchanged with this route.
+	if c.route != nil && c.route.prunes(subject) {
+		return false
+	}
 	// Use pubAllowed() since this checks Publish permissions which
 	// is what Import maps to.
 	return c.pubAllowedFullCheck(subject, false)
@@ -586,11 +678,61 @@ func (c *client) canImport(subject string) bool {
 // This is for ROUTER connections only.
 // Lock is held on entry
 func (c *client) canExport(subject string) bool {
+	if c.route != nil && c.route.prunes(subject) {
+		return false
+	}
 	// Use canSubscribe() since this checks Subscribe permissions which
 	// is what Export maps to.
 	return c.canSubscribe(subject)
 }
 
+func (r *RemoteRouteOpts) clone() *RemoteRouteOpts {
+	if r == nil {
+		return nil
+	}
+	clone := &RemoteRouteOpts{
+		TLSTimeout: r.TLSTimeout,
+		ServerName: r.ServerName,
+	}
+	if r.URL != nil {
+		clone.URL = deepCopyURLs([]*url.URL{r.URL})[0]
+	}
+	if r.TLSConfig != nil {
+		clone.TLSConfig = r.TLSConfig.Clone()
+	}
+	return clone
+}
+
+// remoteFor returns the explicit route options configured for the given
+// route URL, or nil if the route uses the cluster's settings.
+func (c *ClusterOpts) remoteFor(rURL *url.URL) *RemoteRouteOpts {
+	if rURL == nil {
+		return nil
+	}
+	for _, r := range c.Remotes {
+		if r.URL != nil && urlsAreEqual(r.URL, rURL) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Ensure that the TLS settings of explicit routes can be used.
+func validateRouteRemotes(o *Options) error {
+	for _, r := range o.Cluster.Remotes {
+		if r.TLSConfig == nil && r.ServerName == "" {
+			continue
+		}
+		// Whether a route uses TLS is decided by the cluster's tls block,
+		// which also serves accepted routes.
+		if o.Cluster.TLSConfig == nil {
+			return fmt.Errorf("route %q has TLS settings but the cluster has no tls configuration",
+				r.URL.Redacted())
+		}
+	}
+	return nil
+}
+
 // Initialize or reset cluster's permissions.
 // This is for ROUTER connections only.
 // Client lock is held on entry
@@ -710,6 +852,7 @@ func (c *client) processRemoteUnsub(arg []byte) (err error) {
 		c.removeReplySubTimeout(sub)
 		updateGWs = srv.gateway.enabled
 	}
+	c.route.lastInterest = time.Now()
 	c.mu.Unlock()
 
 	if updateGWs {
@@ -794,6 +937,8 @@ func (c *client) processRemoteSub(argo []byte) (err error) {
 	key := string(sub.sid)
 	osub := c.subs[key]
 	updateGWs := false
+	c.route.lastInterest = time.Now()
+	sub.updated = c.route.lastInterest.UnixNano()
 	if osub == nil {
 		c.subs[key] = sub
 		// Now place into the account sl.
@@ -809,6 +954,7 @@ func (c *client) processRemoteSub(argo []byte) (err error) {
 		// For a queue we need to update the weight.
 		atomic.StoreInt32(&osub.qw, sub.qw)
 		acc.sl.UpdateRemoteQSub(osub)
+		osub.updated = sub.updated
 	}
 	c.mu.Unlock()
 
@@ -859,16 +1005,16 @@ func (s *Server) sendSubsToRoute(route *client) {
 			subs := raw[:0]
 
 			a.mu.RLock()
-			c := a.randomClient()
-			if c == nil {
-				nsubs := len(a.rm)
-				accName := a.Name
+			if len(a.rm) == 0 {
 				a.mu.RUnlock()
-				if nsubs > 0 {
-					route.Warnf("Ignoring account %q with %d subs, no clients", accName, nsubs)
-				}
 				continue
 			}
+			// The subs are sent for the account with a client of its own:
+			// the internal subscriptions, of the system account or of the
+			// streams, exist without clients, and the client of the system
+			// account is bound to the account it sends a message to.
+			now := time.Now()
+			c := &client{srv: s, acc: a, kind: SYSTEM, opts: internalOpts, msubs: -1, mpay: -1, start: now, last: now}
 			for key, n := range a.rm {
 				// FIXME(dlc) - Just pass rme around.
 				// Construct a sub on the fly. We need to place
@@ -995,6 +1141,10 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 			r.routeType = Explicit
 		}
 	}
+	// Discovered routes are explicit too.
+	if rURL != nil && r.routeType != Explicit && s.discoveredRoutes.contains(rURL) {
+		r.routeType = Explicit
+	}
 
 	c := &client{srv: s, nc: conn, opts: clientOpts{}, kind: ROUTER, msubs: -1, mpay: -1, route: r}
 
@@ -1023,7 +1173,8 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	// Check for TLS
 	if tlsRequired {
 		// Copy off the config to add in ServerName if we need to.
-		tlsConfig := opts.Cluster.TLSConfig.Clone()
+		tlsConfig := tlsClientConfig(opts.Cluster.TLSConfig)
+		timeout := opts.Cluster.TLSTimeout
 
 		// If we solicited, we will act like the client, otherwise the server.
 		if didSolicit {
@@ -1031,6 +1182,19 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 			// Specify the ServerName we are expecting.
 			host, _, _ := net.SplitHostPort(rURL.Host)
 			tlsConfig.ServerName = host
+			// Explicit routes may override the TLS settings and SNI name.
+			if remote := opts.Cluster.remoteFor(rURL); remote != nil {
+				if remote.TLSConfig != nil {
+					tlsConfig = tlsClientConfig(remote.TLSConfig)
+					tlsConfig.ServerName = host
+					if remote.TLSTimeout > 0 {
+						timeout = remote.TLSTimeout
+					}
+				}
+				if remote.ServerName != "" {
+					tlsConfig.ServerName = remote.ServerName
+				}
+			}
 			c.nc = tls.Client(c.nc, tlsConfig)
 		} else {
 			c.Debugf("Starting TLS route server handshake")
@@ -1040,12 +1204,18 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		conn := c.nc.(*tls.Conn)
 
 		// Setup the timeout
-		ttl := secondsToDuration(opts.Cluster.TLSTimeout)
+		ttl := secondsToDuration(timeout)
 		time.AfterFunc(ttl, func() { tlsTimeout(c, conn) })
 		conn.SetReadDeadline(time.Now().Add(ttl))
 
 		c.mu.Unlock()
-		if err := conn.Handshake(); err != nil {
+		var err error
+		if didSolicit {
+			err = conn.Handshake()
+		} else {
+			err = s.tlsHandshake(conn, ttl)
+		}
+		if err != nil {
 			c.Errorf("TLS route handshake error: %v", err)
 			c.sendErr("Secure Connection - TLS Required")
 			c.closeConnection(TLSHandshakeError)
@@ -1367,14 +1537,17 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		port = 0
 	}
 
-	hp := net.JoinHostPort(opts.Cluster.Host, strconv.Itoa(port))
-	l, e := net.Listen("tcp", hp)
+	l, e := natsListen(opts.Cluster.Host, opts.Cluster.HostV6, port)
 	if e != nil {
 		s.Fatalf("Error listening on router port: %d - %v", opts.Cluster.Port, e)
 		return
 	}
 	s.Noticef("Listening for route connections on %s",
 		net.JoinHostPort(opts.Cluster.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	if opts.Cluster.HostV6 != _EMPTY_ {
+		s.Noticef("Listening for route connections on %s",
+			net.JoinHostPort(opts.Cluster.HostV6, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	}
 
 	s.mu.Lock()
 	proto := RouteProtoV2
@@ -1393,6 +1566,8 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	info := Info{
 		ID:           s.info.ID,
 		Name:         s.info.Name,
+		Cluster:      s.info.Cluster,
+		Tags:         s.info.Tags,
 		Version:      s.info.Version,
 		GoVersion:    runtime.Version(),
 		AuthRequired: false,
@@ -1401,6 +1576,7 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		MaxPayload:   s.info.MaxPayload,
 		Proto:        proto,
 		GatewayURL:   s.getGatewayURL(),
+		Headers:      s.supportsHeaders(),
 	}
 	// Set this if only if advertise is not disabled
 	if !opts.Cluster.NoAdvertise {
@@ -1428,6 +1604,9 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	if !opts.LeafNode.NoAdvertise && s.leafNodeInfo.IP != _EMPTY_ {
 		info.LeafNodeURLs = []string{s.leafNodeInfo.IP}
 	}
+	if _, info.Compression = compressionLevel(opts.Cluster.Compression); info.Compression {
+		info.CompressionAlgorithms = compressionAlgorithms
+	}
 	s.routeInfo = info
 	// Possibly override Host/Port and set IP based on Cluster.Advertise
 	if err := s.setRouteInfoHostPortAndIP(); err != nil {
@@ -1457,10 +1636,13 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 			continue
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
-		s.startGoRoutine(func() {
-			s.createRoute(conn, nil)
-			s.grWG.Done()
-		})
+		if !s.acceptAllowed("Route", s.getOpts().Cluster.Networks, conn) {
+			continue
+		}
+		if !s.acceptRateAllowed("Route", s.getOpts().Cluster.AcceptRate, conn) {
+			continue
+		}
+		s.startAcceptWorker(s.routeAcceptPool, conn, func(conn net.Conn) { s.createRoute(conn, nil) })
 	}
 	s.Debugf("Router accept loop exiting..")
 	s.done <- true
@@ -1502,6 +1684,7 @@ func (s *Server) StartRouting(clientListenReady chan struct{}) {
 
 	// Solicit Routes if needed.
 	s.solicitRoutes(s.getOpts().Routes)
+	s.startRouteDiscovery()
 }
 
 func (s *Server) reConnectToRoute(rURL *url.URL, rtype RouteType) {
@@ -1531,7 +1714,7 @@ func (s *Server) routeStillValid(rURL *url.URL) bool {
 			return true
 		}
 	}
-	return false
+	return s.discoveredRoutes.contains(rURL)
 }
 
 func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
@@ -1548,7 +1731,13 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 			return
 		}
 		s.Debugf("Trying to connect to route on %s", rURL.Host)
-		conn, err := net.DialTimeout("tcp", rURL.Host, DEFAULT_ROUTE_DIAL)
+		var conn net.Conn
+		var err error
+		if proxy := outboundProxy(opts.Cluster.Proxy, opts.OutboundProxy); proxy != _EMPTY_ {
+			conn, err = dialProxy(proxy, rURL.Host, DEFAULT_ROUTE_DIAL)
+		} else {
+			conn, err = dialPreferFamily(rURL.Host, opts.Cluster.PreferFamily, DEFAULT_ROUTE_DIAL)
+		}
 		if err != nil {
 			attempts++
 			if s.shouldReportConnectErr(firstConnect, attempts) {
@@ -1563,11 +1752,14 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 				if attempts > opts.Cluster.ConnectRetries {
 					return
 				}
+			} else if max := opts.Cluster.Retry.MaxAttempts; max > 0 && attempts >= max && s.discoveredRoutes.forget(rURL) {
+				s.Debugf("Giving up on discovered route %s after %d attempts", rURL.Host, attempts)
+				return
 			}
 			select {
 			case <-s.quitCh:
 				return
-			case <-time.After(routeConnectDelay):
+			case <-time.After(opts.Cluster.Retry.delay(attempts)):
 				continue
 			}
 		}
@@ -1593,6 +1785,10 @@ func (c *client) isSolicitedRoute() bool {
 func (s *Server) solicitRoutes(routes []*url.URL) {
 	for _, r := range routes {
 		route := r
+		if isSRVURL(route) {
+			s.startGoRoutine(func() { s.solicitSRVRoutes(route) })
+			continue
+		}
 		s.startGoRoutine(func() { s.connectToRoute(route, true, true) })
 	}
 }
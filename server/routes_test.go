@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -1005,6 +1006,152 @@ func TestRoutePermsAppliedOnInboundAndOutboundRoute(t *testing.T) {
 	check(t, srvb)
 }
 
+func TestRoutePermsFilterRoutedMessages(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Permissions = &RoutePermissions{
+		Import: &SubjectPermission{Deny: []string{"internal.>"}},
+		Export: &SubjectPermission{Deny: []string{"internal.>"}},
+	}
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://%s:%d", optsA.Cluster.Host, optsA.Cluster.Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	ncA := natsConnect(t, fmt.Sprintf("nats://%s:%d", optsA.Host, optsA.Port))
+	defer ncA.Close()
+	ncB := natsConnect(t, fmt.Sprintf("nats://%s:%d", optsB.Host, optsB.Port))
+	defer ncB.Close()
+
+	// Wildcard subscriptions are propagated since they are not within
+	// the denied subject space, so messages need to be filtered.
+	subA := natsSubSync(t, ncA, ">")
+	subB := natsSubSync(t, ncB, ">")
+	natsFlush(t, ncA)
+	natsFlush(t, ncB)
+	checkExpectedSubs(t, 2, srvA, srvB)
+
+	check := func(pub *nats.Conn, local, sub *nats.Subscription) {
+		t.Helper()
+		natsPub(t, pub, "internal.foo", []byte("local"))
+		natsPub(t, pub, "public.foo", []byte("global"))
+		natsFlush(t, pub)
+		// Local delivery is not affected.
+		for i := 0; i < 2; i++ {
+			natsNexMsg(t, local, time.Second)
+		}
+		msg := natsNexMsg(t, sub, time.Second)
+		if msg.Subject != "public.foo" {
+			t.Fatalf("Expected message on %q, got %q", "public.foo", msg.Subject)
+		}
+		if msg, err := sub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Expected no more messages, got %v (err=%v)", msg, err)
+		}
+	}
+	// Messages from A are not exported to B.
+	check(ncA, subA, subB)
+	// Messages from B are not imported into A.
+	check(ncB, subB, subA)
+}
+
+func TestRouteRemoteTLSSettings(t *testing.T) {
+	tmpl := `
+		listen: 127.0.0.1:-1
+		cluster {
+			listen: 127.0.0.1:-1
+			tls {
+				cert_file: "./configs/certs/server.pem"
+				key_file: "./configs/certs/key.pem"
+				ca_file: "./configs/certs/server.pem"
+				timeout: 2
+			}
+			%s
+		}
+	`
+	confA := createConfFile(t, []byte(fmt.Sprintf(tmpl, "")))
+	defer os.Remove(confA)
+	srvA, optsA := RunServerWithConfig(confA)
+	defer srvA.Shutdown()
+
+	// The remote's SNI name does not match the certificate, so the route
+	// should not be established.
+	confB := createConfFile(t, []byte(fmt.Sprintf(tmpl, fmt.Sprintf(`
+		routes [
+			{url: "nats://127.0.0.1:%d", server_name: "bad.example.com"}
+		]`, optsA.Cluster.Port))))
+	defer os.Remove(confB)
+	srvB, optsB := RunServerWithConfig(confB)
+	defer srvB.Shutdown()
+
+	if len(optsB.Cluster.Remotes) != 1 || optsB.Cluster.Remotes[0].ServerName != "bad.example.com" {
+		t.Fatalf("Unexpected remotes: %+v", optsB.Cluster.Remotes)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := srvA.NumRoutes(); n != 0 {
+		t.Fatalf("Expected no route, got %v", n)
+	}
+	srvB.Shutdown()
+
+	// With its own tls block and a matching name, the route is established.
+	confC := createConfFile(t, []byte(fmt.Sprintf(tmpl, fmt.Sprintf(`
+		routes [
+			{
+				url: "nats://127.0.0.1:%d"
+				server_name: "127.0.0.1"
+				tls {
+					cert_file: "./configs/certs/server.pem"
+					key_file: "./configs/certs/key.pem"
+					ca_file: "./configs/certs/server.pem"
+					timeout: 3
+				}
+			}
+		]`, optsA.Cluster.Port))))
+	defer os.Remove(confC)
+	srvC, optsC := RunServerWithConfig(confC)
+	defer srvC.Shutdown()
+
+	if r := optsC.Cluster.remoteFor(optsC.Routes[0]); r == nil || r.TLSConfig == nil || r.TLSTimeout != 3 {
+		t.Fatalf("Unexpected remote: %+v", r)
+	}
+	checkClusterFormed(t, srvA, srvC)
+}
+
+func TestRouteRemoteTLSSettingsRequireClusterTLS(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		cluster {
+			listen: 127.0.0.1:-1
+			routes [
+				{url: "nats://127.0.0.1:4244", server_name: "foo"}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "no tls configuration") {
+		t.Fatalf("Expected error about cluster tls, got %v", err)
+	}
+
+	conf = createConfFile(t, []byte(`
+		cluster {
+			routes [
+				{server_name: "foo"}
+			]
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "requires a url") {
+		t.Fatalf("Expected error about missing url, got %v", err)
+	}
+}
+
 func TestRouteSendLocalSubsWithLowMaxPending(t *testing.T) {
 	optsA := DefaultOptions()
 	optsA.MaxPending = 1024
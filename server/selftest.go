@@ -0,0 +1,322 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// SelfTestResult is the outcome of one of the startup self tests. Remote
+// tests check the endpoints of other servers, which may not be started yet,
+// so they never prevent the server from starting.
+type SelfTestResult struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Remote   bool          `json:"remote,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Thresholds used by the startup self tests.
+var (
+	selfTestClockSleep     = 10 * time.Millisecond
+	selfTestClockMaxDrift  = 250 * time.Millisecond
+	selfTestEntropyTimeout = time.Second
+	selfTestDialTimeout    = 2 * time.Second
+	selfTestStorageMaxSync = time.Second
+)
+
+// runSelfTests runs the startup self tests, logs and records their results
+// for monitoring. Returns the error of the first local test that failed.
+func (s *Server) runSelfTests() error {
+	opts := s.getOpts()
+
+	results := []SelfTestResult{
+		runSelfTest("clock", checkClock),
+		runSelfTest("entropy", checkEntropy),
+	}
+	if tlsConfigs := selfTestTLSConfigs(opts); len(tlsConfigs) > 0 {
+		results = append(results, runSelfTest("certificates", func() error {
+			return checkCertificates(tlsConfigs)
+		}))
+	}
+	if opts.PidFile != _EMPTY_ || opts.LogFile != _EMPTY_ || opts.PortsFileDir != _EMPTY_ {
+		results = append(results, runSelfTest("files", func() error {
+			return checkFileDirs(opts)
+		}))
+	}
+	for _, dir := range selfTestStoreDirs(opts) {
+		dir := dir
+		results = append(results, runSelfTest("storage "+dir, func() error {
+			return checkStorage(dir)
+		}))
+	}
+	for _, l := range selfTestListeners(opts) {
+		addr := l.addr
+		results = append(results, runSelfTest(l.name, func() error {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			return ln.Close()
+		}))
+	}
+	for _, t := range selfTestTargets(opts) {
+		addr := t.addr
+		r := runSelfTest(t.name, func() error {
+			conn, err := net.DialTimeout("tcp", addr, selfTestDialTimeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+		r.Remote = true
+		results = append(results, r)
+	}
+
+	var err error
+	for _, r := range results {
+		if r.OK {
+			s.Debugf("Self test %q passed in %v", r.Name, r.Duration)
+			continue
+		}
+		s.Warnf("Self test %q failed: %s", r.Name, r.Error)
+		if err == nil && !r.Remote {
+			err = fmt.Errorf("self test %q failed: %s", r.Name, r.Error)
+		}
+	}
+
+	s.mu.Lock()
+	s.selfTests = results
+	s.mu.Unlock()
+	return err
+}
+
+func runSelfTest(name string, check func() error) SelfTestResult {
+	start := time.Now()
+	err := check()
+	r := SelfTestResult{Name: name, OK: err == nil, Duration: time.Since(start)}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Checks that the monotonic clock moves forward and that the wall clock
+// does not drift away from it.
+func checkClock() error {
+	start := time.Now()
+	time.Sleep(selfTestClockSleep)
+	mono := time.Since(start)
+	wall := time.Now().Round(0).Sub(start.Round(0))
+	if mono < selfTestClockSleep {
+		return fmt.Errorf("monotonic clock advanced %v after sleeping %v", mono, selfTestClockSleep)
+	}
+	if drift := wall - mono; drift > selfTestClockMaxDrift || drift < -selfTestClockMaxDrift {
+		return fmt.Errorf("wall clock drifted %v from monotonic clock", drift)
+	}
+	return nil
+}
+
+// Checks that random data can be read without blocking.
+func checkEntropy() error {
+	errCh := make(chan error, 1)
+	go func() {
+		var buf [32]byte
+		_, err := rand.Read(buf[:])
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(selfTestEntropyTimeout):
+		return fmt.Errorf("reading random data blocked for more than %v", selfTestEntropyTimeout)
+	}
+}
+
+// Returns the TLS configurations of the listeners.
+func selfTestTLSConfigs(opts *Options) []*tls.Config {
+	var configs []*tls.Config
+	for _, tc := range []*tls.Config{opts.TLSConfig, opts.Cluster.TLSConfig, opts.Gateway.TLSConfig, opts.LeafNode.TLSConfig} {
+		if tc != nil {
+			configs = append(configs, tc)
+		}
+	}
+	return configs
+}
+
+// Checks that the certificates of the TLS configurations are valid now.
+func checkCertificates(configs []*tls.Config) error {
+	now := time.Now()
+	for _, tc := range configs {
+		for _, cert := range tc.Certificates {
+			if len(cert.Certificate) == 0 {
+				continue
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return err
+			}
+			if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+				return fmt.Errorf("certificate %q is only valid from %v to %v",
+					leaf.Subject.CommonName, leaf.NotBefore, leaf.NotAfter)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that the directories of the files the server writes exist.
+func checkFileDirs(opts *Options) error {
+	dirs := []string{opts.PortsFileDir}
+	for _, f := range []string{opts.PidFile, opts.LogFile} {
+		if f != _EMPTY_ {
+			dirs = append(dirs, filepath.Dir(f))
+		}
+	}
+	for _, dir := range dirs {
+		if dir == _EMPTY_ {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%q is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// Returns the distinct store directories of the persistent subsystems.
+func selfTestStoreDirs(opts *Options) []string {
+	var dirs []string
+	seen := make(map[string]struct{})
+	for _, dir := range []string{opts.DelayedDelivery.StoreDir, opts.KV.StoreDir, opts.ObjectStore.StoreDir, opts.Metadata.StoreDir} {
+		if dir == _EMPTY_ {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		if _, ok := seen[dir]; !ok {
+			seen[dir] = struct{}{}
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Checks that a block can be written and synced to the store directory,
+// which is created like the stores do, within selfTestStorageMaxSync.
+func checkStorage(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".selftest")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	var buf [4096]byte
+	start := time.Now()
+	_, err = f.Write(buf[:])
+	if err == nil {
+		err = f.Sync()
+	}
+	elapsed := time.Since(start)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if elapsed > selfTestStorageMaxSync {
+		return fmt.Errorf("writing and syncing %d bytes took %v", len(buf), elapsed)
+	}
+	return nil
+}
+
+// Returns the listeners with a fixed port, which must not be in use.
+func selfTestListeners(opts *Options) []selfTestTarget {
+	var listeners []selfTestTarget
+	add := func(kind, host string, port int) {
+		if port <= 0 {
+			return
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		listeners = append(listeners, selfTestTarget{name: kind + " listen " + addr, addr: addr})
+	}
+	add("client", opts.Host, opts.Port)
+	add("route", opts.Cluster.Host, opts.Cluster.Port)
+	add("gateway", opts.Gateway.Host, opts.Gateway.Port)
+	add("leafnode", opts.LeafNode.Host, opts.LeafNode.Port)
+	add("http", opts.HTTPHost, opts.HTTPPort)
+	add("https", opts.HTTPHost, opts.HTTPSPort)
+	return listeners
+}
+
+type selfTestTarget struct {
+	name string
+	addr string
+}
+
+// Returns the configured remote endpoints that should be reachable.
+func selfTestTargets(opts *Options) []selfTestTarget {
+	var targets []selfTestTarget
+	add := func(kind string, urls []*url.URL) {
+		for _, u := range urls {
+			// SRV names are resolved when connecting.
+			if isSRVURL(u) {
+				continue
+			}
+			targets = append(targets, selfTestTarget{name: kind + " " + u.Host, addr: u.Host})
+		}
+	}
+	// Our own route URL is not listening yet.
+	routes, err := RemoveSelfReference(opts.Cluster.Port, opts.Routes)
+	if err != nil {
+		routes = opts.Routes
+	}
+	add("route", routes)
+	for _, gw := range opts.Gateway.Gateways {
+		if gw.Name != opts.Gateway.Name {
+			add("gateway", gw.URLs)
+		}
+	}
+	for _, r := range opts.LeafNode.Remotes {
+		add("leafnode", r.URLs)
+	}
+	if ur, ok := opts.AccountResolver.(*URLAccResolver); ok {
+		if u, err := url.Parse(ur.url); err == nil {
+			addr := u.Host
+			if u.Port() == _EMPTY_ {
+				port := "80"
+				if u.Scheme == "https" {
+					port = "443"
+				}
+				addr = net.JoinHostPort(u.Hostname(), port)
+			}
+			targets = append(targets, selfTestTarget{name: "resolver " + u.Host, addr: addr})
+		}
+	}
+	return targets
+}
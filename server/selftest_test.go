@@ -0,0 +1,181 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns an address on which nothing is listening.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestSelfTestResultsInVarz(t *testing.T) {
+	o := DefaultOptions()
+	o.SelfTest = true
+	o.Cluster.Host = "127.0.0.1"
+	o.Cluster.Port = -1
+	o.Routes = []*url.URL{{Scheme: "nats-route", Host: closedAddr(t)}}
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	o.KV.StoreDir = filepath.Join(dir, "kv")
+	o.ObjectStore.StoreDir = filepath.Join(dir, "kv")
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	results := make(map[string]SelfTestResult)
+	for _, r := range v.SelfTests {
+		results[r.Name] = r
+	}
+	for _, name := range []string{"clock", "entropy", "storage " + o.KV.StoreDir} {
+		if r, ok := results[name]; !ok || !r.OK {
+			t.Fatalf("Expected %q self test to pass, got %+v", name, v.SelfTests)
+		}
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected the shared store directory to be tested once, got %+v", v.SelfTests)
+	}
+	r, ok := results["route "+o.Routes[0].Host]
+	if !ok || r.OK || r.Error == "" {
+		t.Fatalf("Expected route self test to fail, got %+v", v.SelfTests)
+	}
+}
+
+func TestSelfTestStrictRefusesToStart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer l.Close()
+	busy := l.Addr().(*net.TCPAddr).Port
+	f, err := ioutil.TempFile("", "selftest")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	for _, test := range []struct {
+		name  string
+		setup func(o *Options)
+		err   string
+	}{
+		{"port in use", func(o *Options) { o.Port = busy }, "client listen"},
+		{"missing directory", func(o *Options) { o.PidFile = "missing/dir/nats.pid" }, "files"},
+		{"store directory", func(o *Options) { o.KV.StoreDir = f.Name() }, "storage"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := DefaultOptions()
+			o.SelfTest = true
+			o.SelfTestStrict = true
+			test.setup(o)
+			s := New(o)
+			defer s.Shutdown()
+
+			done := make(chan struct{})
+			go func() {
+				s.Start()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Start should have returned")
+			}
+			if err := s.StartError(); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error about %q, got %v", test.err, err)
+			}
+			if s.Addr() != nil || s.isRunning() {
+				t.Fatal("Server should have been shut down")
+			}
+		})
+	}
+}
+
+func TestSelfTestStrictIgnoresRemotes(t *testing.T) {
+	o := DefaultOptions()
+	o.SelfTest = true
+	o.SelfTestStrict = true
+	o.Cluster.Host = "127.0.0.1"
+	o.Cluster.Port = -1
+	o.Routes = []*url.URL{{Scheme: "nats-route", Host: closedAddr(t)}}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.StartError(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	v, _ := s.Varz(nil)
+	for _, r := range v.SelfTests {
+		if r.Name == "route "+o.Routes[0].Host && (r.OK || !r.Remote) {
+			t.Fatalf("Expected the route self test to fail as remote, got %+v", r)
+		}
+	}
+}
+
+func TestSelfTestConfig(t *testing.T) {
+	for _, test := range []struct {
+		value  string
+		test   bool
+		strict bool
+		err    string
+	}{
+		{"true", true, false, ""},
+		{"false", false, false, ""},
+		{"strict", true, true, ""},
+		{"foo", false, false, "expected a boolean"},
+		{"1", false, false, "unsupported type"},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf("self_test: %s", test.value)))
+			defer os.Remove(conf)
+			o, err := ProcessConfigFile(conf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if o.SelfTest != test.test || o.SelfTestStrict != test.strict {
+				t.Fatalf("Unexpected options: %v/%v", o.SelfTest, o.SelfTestStrict)
+			}
+		})
+	}
+}
@@ -39,6 +39,7 @@ import (
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats-server/v2/logger"
 	"github.com/nats-io/nkeys"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
@@ -58,24 +59,28 @@ var lameDuckModeInitialDelay = int64(lameDuckModeDefaultInitialDelay)
 // Info is the information sent to clients, routes, gateways, and leaf nodes,
 // to help them understand information about this server.
 type Info struct {
-	ID                string   `json:"server_id"`
-	Name              string   `json:"server_name"`
-	Version           string   `json:"version"`
-	Proto             int      `json:"proto"`
-	GitCommit         string   `json:"git_commit,omitempty"`
-	GoVersion         string   `json:"go"`
-	Host              string   `json:"host"`
-	Port              int      `json:"port"`
-	AuthRequired      bool     `json:"auth_required,omitempty"`
-	TLSRequired       bool     `json:"tls_required,omitempty"`
-	TLSVerify         bool     `json:"tls_verify,omitempty"`
-	MaxPayload        int32    `json:"max_payload"`
-	IP                string   `json:"ip,omitempty"`
-	CID               uint64   `json:"client_id,omitempty"`
-	ClientIP          string   `json:"client_ip,omitempty"`
-	Nonce             string   `json:"nonce,omitempty"`
-	Cluster           string   `json:"cluster,omitempty"`
-	ClientConnectURLs []string `json:"connect_urls,omitempty"` // Contains URLs a client can connect to.
+	ID                string            `json:"server_id"`
+	Name              string            `json:"server_name"`
+	Version           string            `json:"version"`
+	Proto             int               `json:"proto"`
+	GitCommit         string            `json:"git_commit,omitempty"`
+	GoVersion         string            `json:"go"`
+	Host              string            `json:"host"`
+	Port              int               `json:"port"`
+	AuthRequired      bool              `json:"auth_required,omitempty"`
+	TLSRequired       bool              `json:"tls_required,omitempty"`
+	TLSVerify         bool              `json:"tls_verify,omitempty"`
+	MaxPayload        int32             `json:"max_payload"`
+	MaxControlLine    int32             `json:"max_control_line,omitempty"`
+	Headers           bool              `json:"headers,omitempty"`
+	Drain             bool              `json:"drain,omitempty"`
+	IP                string            `json:"ip,omitempty"`
+	CID               uint64            `json:"client_id,omitempty"`
+	ClientIP          string            `json:"client_ip,omitempty"`
+	Nonce             string            `json:"nonce,omitempty"`
+	Cluster           string            `json:"cluster,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	ClientConnectURLs []string          `json:"connect_urls,omitempty"` // Contains URLs a client can connect to.
 
 	// Route Specific
 	Import *SubjectPermission `json:"import,omitempty"`
@@ -91,27 +96,44 @@ type Info struct {
 
 	// LeafNode Specific
 	LeafNodeURLs []string `json:"leafnode_urls,omitempty"` // LeafNode URLs that the server can reconnect to.
+
+	// Reconnect hints, the client should pick a random delay in this
+	// range before trying to reconnect after being disconnected.
+	ReconnectMinDelay time.Duration `json:"reconnect_min_delay,omitempty"`
+	ReconnectMaxDelay time.Duration `json:"reconnect_max_delay,omitempty"`
+	// Set when the server has entered lame duck mode.
+	LameDuckMode bool `json:"ldm,omitempty"`
+
+	// Route and LeafNode Specific
+	Compression           bool     `json:"compression,omitempty"`            // Compression is enabled on this side.
+	CompressionAlgorithms []string `json:"compression_algorithms,omitempty"` // Algorithms this side can decompress.
+	CompressionStart      bool     `json:"compression_start,omitempty"`      // Everything after this INFO is compressed.
+	CompressionAlgorithm  string   `json:"compression_algorithm,omitempty"`  // Algorithm of the compressed data, deflate if empty.
 }
 
 // Server is our main struct.
 type Server struct {
 	gcid uint64
 	stats
-	mu               sync.Mutex
-	kp               nkeys.KeyPair
-	prand            *rand.Rand
-	info             Info
-	configFile       string
-	optsMu           sync.RWMutex
-	opts             *Options
-	running          bool
-	shutdown         bool
-	listener         net.Listener
-	gacc             *Account
-	sys              *internal
-	accounts         sync.Map
-	tmpAccounts      sync.Map // Temporarily stores accounts that are being built
-	activeAccounts   int32
+	mu             sync.Mutex
+	kp             nkeys.KeyPair
+	prand          *rand.Rand
+	info           Info
+	configFile     string
+	optsMu         sync.RWMutex
+	opts           *Options
+	running        bool
+	shutdown       bool
+	listener       net.Listener
+	unixListener   net.Listener
+	gacc           *Account
+	sys            *internal
+	accounts       sync.Map
+	tmpAccounts    sync.Map // Temporarily stores accounts that are being built
+	activeAccounts int32
+	// Incremented, atomically, when the queue_groups options are reloaded
+	// so that the clients refresh their snapshot of them.
+	queueGroupsGen   int32
 	accResolver      AccountResolver
 	clients          map[uint64]*client
 	routes           map[uint64]*client
@@ -127,11 +149,14 @@ type Server struct {
 	start            time.Time
 	http             net.Listener
 	httpHandler      http.Handler
+	publicHTTP       net.Listener
 	profiler         net.Listener
 	httpReqStats     map[string]uint64
 	routeListener    net.Listener
 	routeInfo        Info
 	routeInfoJSON    []byte
+	discoveredRoutes discoveredRoutes
+	hooks            lifecycleHooks
 	leafNodeListener net.Listener
 	leafNodeInfo     Info
 	leafNodeInfoJSON []byte
@@ -180,9 +205,101 @@ type Server struct {
 	ldm   bool
 	ldmCh chan bool
 
+	// Set while profiles are written, accessed atomically.
+	profiling int32
+
+	// Results of the startup self tests, if enabled.
+	selfTests []SelfTestResult
+	// Why Start() refused to start the server, if it did.
+	startErr error
+
+	// Connection limits adjusted at runtime through the system account.
+	connLimits struct {
+		maxConn int       // overrides opts.MaxConn when positive
+		paused  time.Time // client accepts are paused until then
+	}
+
+	// Exporter of the OpenTelemetry spans, if enabled.
+	otel   *otelExporter
+	otelOn int32
+
+	// Emitter of the StatsD metrics, if enabled.
+	statsd *statsdEmitter
+
+	// Sender of the connection events to the webhook, if enabled.
+	webhook   *webhookSender
+	webhookOn int32
+
+	// Authentication failures of the client connections.
+	lockout authLockout
+
+	// Messages held for a delayed delivery, if enabled.
+	delayed *delayedDelivery
+
+	// Key-value stores of the accounts, by account name.
+	kv map[string]*kvStore
+
+	// Object stores of the accounts, by account name.
+	objs map[string]*objectStore
+
+	// Streams of the accounts, by account name, and the lock serializing
+	// their changes.
+	streams   map[string]*streamStore
+	streamsMu sync.Mutex
+
+	// Master keys of the encryption of the stores, if enabled.
+	storeKeys storeKeys
+
+	// Member of the group replicating the cluster-wide metadata, if enabled,
+	// and the replicated state.
+	meta      *raftNode
+	metaState *metaState
+
+	// Workers setting up the accepted client connections, and the route,
+	// gateway and leafnode connections. Nil if not bounded.
+	acceptPool      chan struct{}
+	routeAcceptPool chan struct{}
+
+	// Token buckets of the accept rates, by listener.
+	acceptLimiters map[string]*acceptLimiter
+
+	// Bounds the TLS handshakes of the accepted connections.
+	tlsHandshakes *tlsHandshakes
+
+	// Accounts and connections whose log level is raised, and the limit
+	// of the error logs of the connections.
+	logScopes logScopes
+	errLogs   errLogLimiter
+
+	// Protocol captures of the connections.
+	captures protoCaptures
+
+	// Last samples of the counters returned to the monitoring requests
+	// asking for rates.
+	rateSamples rateSamples
+
+	// Number of subjects tracked per account by the traffic analytics,
+	// 0 if disabled. Accessed atomically.
+	trafficTopK int32
+
+	// ACME client obtaining the certificates of the client and
+	// monitoring listeners, and the listener of its http-01 challenges.
+	acme         *autocert.Manager
+	acmeListener net.Listener
+
+	// Message traces activated through the system account.
+	mtraces struct {
+		n       int32 // number of active traces, accessed atomically
+		filters map[string]*msgTraceFilter
+	}
+
 	// Trusted public operator keys.
 	trustedKeys []string
 
+	// Public keys of the servers whose signed system events are accepted,
+	// including our own.
+	trustedServerKeys map[string]struct{}
+
 	// We use this to minimize mem copies for request to monitoring
 	// endpoint /varz (when it comes from http).
 	varzMu sync.Mutex
@@ -212,6 +329,7 @@ type stats struct {
 	inBytes       int64
 	outBytes      int64
 	slowConsumers int64
+	subsExceeded  int64
 }
 
 // New will setup a new server struct after parsing the options.
@@ -226,12 +344,26 @@ func New(opts *Options) *Server {
 func NewServer(opts *Options) (*Server, error) {
 	setBaselineOptions(opts)
 
+	// Get the certificates from an ACME CA if configured.
+	acm, err := configureACME(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	// Process TLS options, including whether we require client certificates.
 	tlsReq := opts.TLSConfig != nil
 	verify := (tlsReq && opts.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert)
 
-	// Created server's nkey identity.
-	kp, _ := nkeys.CreateServer()
+	// Created server's nkey identity, or load it if a seed file was given.
+	var kp nkeys.KeyPair
+	if opts.ServerKeyFile != "" {
+		var err error
+		if kp, err = readServerKeyFile(opts.ServerKeyFile); err != nil {
+			return nil, err
+		}
+	} else {
+		kp, _ = nkeys.CreateServer()
+	}
 	pub, _ := kp.PublicKey()
 
 	serverName := pub
@@ -247,6 +379,12 @@ func NewServer(opts *Options) (*Server, error) {
 		return nil, err
 	}
 
+	// Load the keys encrypting the stores, if enabled.
+	skeys, err := loadStoreKeys(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	info := Info{
 		ID:           pub,
 		Version:      VERSION,
@@ -254,17 +392,24 @@ func NewServer(opts *Options) (*Server, error) {
 		GitCommit:    gitCommit,
 		GoVersion:    runtime.Version(),
 		Name:         serverName,
+		Tags:         opts.Tags,
 		Host:         opts.Host,
 		Port:         opts.Port,
 		AuthRequired: false,
 		TLSRequired:  tlsReq,
 		TLSVerify:    verify,
 		MaxPayload:   opts.MaxPayload,
+		Headers:      !opts.NoHeaderSupport,
+		Drain:        true,
+
+		ReconnectMinDelay: opts.ReconnectMinDelay,
+		ReconnectMaxDelay: opts.ReconnectMaxDelay,
 	}
 
 	now := time.Now()
 	s := &Server{
 		kp:         kp,
+		storeKeys:  skeys,
 		configFile: opts.ConfigFile,
 		info:       info,
 		prand:      rand.New(rand.NewSource(time.Now().UnixNano())),
@@ -273,6 +418,13 @@ func NewServer(opts *Options) (*Server, error) {
 		start:      now,
 		configTime: now,
 		gwLeafSubs: NewSublistWithCache(),
+		acme:       acm,
+	}
+
+	// Servers trusted to send signed system events, our own being implied.
+	s.trustedServerKeys = map[string]struct{}{pub: {}}
+	for _, key := range opts.TrustedServerKeys {
+		s.trustedServerKeys[key] = struct{}{}
 	}
 
 	// Trusted root operator keys.
@@ -296,9 +448,7 @@ func NewServer(opts *Options) (*Server, error) {
 		return nil, err
 	}
 
-	if s.gateway.enabled {
-		s.info.Cluster = s.getGatewayName()
-	}
+	s.info.Cluster = s.clusterName()
 
 	// This is normally done in the AcceptLoop, once the
 	// listener has been created (possibly with random port),
@@ -326,6 +476,12 @@ func NewServer(opts *Options) (*Server, error) {
 	// Used to kick out all go routines possibly waiting on server
 	// to shutdown.
 	s.quitCh = make(chan struct{})
+
+	// Bound the connections set up concurrently, if configured.
+	s.acceptPool = newAcceptPool(opts.AcceptWorkers)
+	s.routeAcceptPool = newAcceptPool(opts.RouteAcceptWorkers)
+	s.acceptLimiters = newAcceptLimiters()
+	s.tlsHandshakes = newTLSHandshakes(opts.MaxTLSHandshakes)
 	// Closed when Shutdown() is complete. Allows WaitForShutdown() to block
 	// waiting for complete shutdown.
 	s.shutdownComplete = make(chan struct{})
@@ -397,7 +553,7 @@ func (s *Server) ClientURL() string {
 	if opts.TLSConfig != nil {
 		scheme = "tls://"
 	}
-	return fmt.Sprintf("%s%s:%d", scheme, opts.Host, opts.Port)
+	return scheme + net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
 }
 
 func validateOptions(o *Options) error {
@@ -410,11 +566,148 @@ func validateOptions(o *Options) error {
 	if err := validateLeafNode(o); err != nil {
 		return err
 	}
+	// Check that reconnect hints, if specified, make sense.
+	if err := validateReconnectDelays(o); err != nil {
+		return err
+	}
+	if o.MaxClosedClients < 0 {
+		return fmt.Errorf("max_closed_clients can not be negative")
+	}
+	// Check that the limits of the accounts fit in the pending buffers.
+	if err := validateAccountLimits(o); err != nil {
+		return err
+	}
+	// Check that the route retry policy makes sense.
+	if err := validateRetryPolicy(&o.Cluster.Retry); err != nil {
+		return err
+	}
+	// Check that the outbound proxies, if any, can be used.
+	if err := validateOutboundProxies(o); err != nil {
+		return err
+	}
+	// The pprof handlers expose the internals of the server.
+	if o.Profiling.HTTP && (o.Profiling.Username == _EMPTY_ || o.Profiling.Password == _EMPTY_) {
+		return fmt.Errorf("profiling over http requires a user and password")
+	}
+	if o.Profiling.MaxFiles < 0 {
+		return fmt.Errorf("profiling max_files can not be negative")
+	}
+	// Trusting other servers only makes sense if our events are signed too.
+	if len(o.TrustedServerKeys) > 0 && o.ServerKeyFile == _EMPTY_ {
+		return fmt.Errorf("trusted_server_keys requires server_key_file")
+	}
+	for _, key := range o.TrustedServerKeys {
+		if !nkeys.IsValidPublicServerKey(key) {
+			return fmt.Errorf("trusted server key %q is not a valid public server nkey", key)
+		}
+	}
+	// Check the authentication and listeners of the monitoring.
+	if err := validateMonitorOptions(o); err != nil {
+		return err
+	}
+	// Check that the OpenTelemetry exporter can be used.
+	if err := validateOTelOptions(o); err != nil {
+		return err
+	}
+	// Check that the StatsD emitter can be used.
+	if err := validateStatsDOptions(o); err != nil {
+		return err
+	}
+	// Check that the webhook can be used.
+	if err := validateWebhookOptions(o); err != nil {
+		return err
+	}
+	// Check the subject of the connection events.
+	if err := validateConnectionEvents(o); err != nil {
+		return err
+	}
+	// Check the networks of the listeners and users.
+	if err := validateNetworkACLs(o); err != nil {
+		return err
+	}
+	// Check the subjects owned by servers of the cluster.
+	if err := validateSubjectOwners(o); err != nil {
+		return err
+	}
+	// Check the accept rates of the listeners.
+	if err := validateAcceptRates(o); err != nil {
+		return err
+	}
+	// Check the validity constraints of the users.
+	if err := validateUserValidities(o); err != nil {
+		return err
+	}
+	// Check the authentication lockout settings.
+	if err := validateAuthLockoutOptions(o); err != nil {
+		return err
+	}
+	// Check the GOMAXPROCS and accept workers settings.
+	if err := validateMaxProcsOptions(o); err != nil {
+		return err
+	}
+	// Check the traffic analytics settings.
+	if err := validateTrafficOptions(o); err != nil {
+		return err
+	}
+	// Check the delayed delivery settings.
+	if err := validateDelayedDeliveryOptions(o); err != nil {
+		return err
+	}
+	if err := validateMetadataOptions(o); err != nil {
+		return err
+	}
+	if err := validateKVOptions(o); err != nil {
+		return err
+	}
+	if err := validateStoreEncryptionOptions(o); err != nil {
+		return err
+	}
+	// Check the queue groups distribution policy.
+	if err := validateQueueGroupOptions(o); err != nil {
+		return err
+	}
+	// Check the TLS settings of explicit routes.
+	if err := validateRouteRemotes(o); err != nil {
+		return err
+	}
+	// The name of the cluster and of its gateway are the same.
+	if o.Cluster.Name != _EMPTY_ && o.Gateway.Name != _EMPTY_ && o.Cluster.Name != o.Gateway.Name {
+		return fmt.Errorf("cluster name %q does not match gateway name %q", o.Cluster.Name, o.Gateway.Name)
+	}
 	// Check that gateway is properly configured. Returns no error
 	// if there is no gateway defined.
 	return validateGatewayOptions(o)
 }
 
+func validateAccountLimits(o *Options) error {
+	maxPending := o.MaxPending
+	if maxPending == 0 {
+		maxPending = MAX_PENDING_SIZE
+	}
+	for _, acc := range o.Accounts {
+		if int64(acc.maxPayload) > maxPending {
+			return fmt.Errorf("max_payload of account %q (%d) can not be greater than max_pending (%d)",
+				acc.Name, acc.maxPayload, maxPending)
+		}
+		if int64(acc.maxCtrlLine) > maxPending {
+			return fmt.Errorf("max_control_line of account %q (%d) can not be greater than max_pending (%d)",
+				acc.Name, acc.maxCtrlLine, maxPending)
+		}
+	}
+	return nil
+}
+
+func validateReconnectDelays(o *Options) error {
+	if o.ReconnectMinDelay < 0 || o.ReconnectMaxDelay < 0 {
+		return fmt.Errorf("reconnect delays can not be negative")
+	}
+	if o.ReconnectMaxDelay > 0 && o.ReconnectMinDelay > o.ReconnectMaxDelay {
+		return fmt.Errorf("reconnect_min_delay (%v) can not be greater than reconnect_max_delay (%v)",
+			o.ReconnectMinDelay, o.ReconnectMaxDelay)
+	}
+	return nil
+}
+
 func (s *Server) getOpts() *Options {
 	s.optsMu.RLock()
 	opts := s.opts
@@ -428,6 +721,11 @@ func (s *Server) setOpts(opts *Options) {
 	s.optsMu.Unlock()
 }
 
+// supportsHeaders returns true if message headers are enabled.
+func (s *Server) supportsHeaders() bool {
+	return !s.getOpts().NoHeaderSupport
+}
+
 func (s *Server) globalAccount() *Account {
 	s.mu.Lock()
 	gacc := s.gacc
@@ -904,7 +1202,9 @@ func (s *Server) registerAccount(acc *Account) *Account {
 func (s *Server) setAccountSublist(acc *Account) {
 	if acc != nil && acc.sl == nil {
 		opts := s.getOpts()
-		if opts != nil && opts.NoSublistCache {
+		if opts != nil && opts.LockFreeSublist {
+			acc.sl = NewSublistLockFree(!opts.NoSublistCache)
+		} else if opts != nil && opts.NoSublistCache {
 			acc.sl = NewSublistNoCache()
 		} else {
 			acc.sl = NewSublistWithCache()
@@ -1028,6 +1328,9 @@ func (s *Server) updateAccountWithClaimJWT(acc *Account, claimJWT string) error
 		s.updateAccountClaims(acc, accClaims)
 		return nil
 	}
+	if err == ErrAccountRevoked {
+		s.closeRevokedAccount(acc)
+	}
 	return err
 }
 
@@ -1075,6 +1378,9 @@ func (s *Server) verifyAccountClaims(claimJWT string) (*jwt.AccountClaims, strin
 	if vr.IsBlocking(true) {
 		return nil, _EMPTY_, ErrAccountValidation
 	}
+	if isRevoked(s.getOpts().AccountRevocations, accClaims.Subject, accClaims.IssuedAt) {
+		return nil, _EMPTY_, ErrAccountRevoked
+	}
 	return accClaims, claimJWT, nil
 }
 
@@ -1117,6 +1423,9 @@ func (s *Server) Start() {
 	// Check for insecure configurations.op
 	s.checkAuthforWarnings()
 
+	// Match GOMAXPROCS to the CPUs available.
+	s.configureMaxProcs()
+
 	// Avoid RACE between Start() and Shutdown()
 	s.mu.Lock()
 	s.running = true
@@ -1149,6 +1458,18 @@ func (s *Server) Start() {
 		s.checkResolvePreloads()
 	}
 
+	// Run the startup diagnostics before opening any listener.
+	if opts.SelfTest {
+		if err := s.runSelfTests(); err != nil && opts.SelfTestStrict {
+			s.Errorf("Startup self test failed, refusing to start: %v", err)
+			s.mu.Lock()
+			s.startErr = err
+			s.mu.Unlock()
+			s.Shutdown()
+			return
+		}
+	}
+
 	// Log the pid to a file
 	if opts.PidFile != _EMPTY_ {
 		if err := s.logPid(); err != nil {
@@ -1162,6 +1483,12 @@ func (s *Server) Start() {
 		return
 	}
 
+	// Answer the ACME http-01 challenges, if configured.
+	if err := s.startACME(); err != nil {
+		s.Fatalf("Can't start ACME: %v", err)
+		return
+	}
+
 	// Setup system account which will start the eventing stack.
 	if sa := opts.SystemAccount; sa != _EMPTY_ {
 		if err := s.SetSystemAccount(sa); err != nil {
@@ -1174,6 +1501,13 @@ func (s *Server) Start() {
 	// this server is configured with gateway or not.
 	s.startGWReplyMapExpiration()
 
+	// Propagate expected interest declared by accounts. This is recorded
+	// and sent to routes, gateways and leafnodes as they connect.
+	s.accounts.Range(func(k, v interface{}) bool {
+		s.updateExpectedInterest(v.(*Account))
+		return true
+	})
+
 	// Start up gateway if needed. Do this before starting the routes, because
 	// we want to resolve the gateway host:port so that this information can
 	// be sent to other routes.
@@ -1216,6 +1550,45 @@ func (s *Server) Start() {
 		s.logPorts()
 	}
 
+	// Accept clients on the Unix socket as well if needed.
+	if opts.ListenUnix.Path != _EMPTY_ {
+		go s.unixAcceptLoop(clientListenReady)
+	}
+
+	// Export the spans of traced messages, if configured.
+	s.startOTel()
+
+	// Push the metrics to StatsD, if configured.
+	s.startStatsD()
+
+	// Post the connection events to the webhook, if configured.
+	s.startWebhook()
+
+	// Record the traffic analytics, if configured.
+	s.startTraffic()
+
+	// Check the memory quotas of the accounts.
+	s.startMemoryQuotas()
+
+	// Deliver the delayed messages, if enabled.
+	s.startDelayedDelivery()
+
+	// Serve the key-value stores of the accounts configured with one.
+	s.configureKV()
+
+	// Serve the object stores of the accounts configured with one.
+	s.configureObjectStores()
+
+	// Capture the messages of the streams of the accounts configured with
+	// some.
+	s.configureStreams()
+
+	// Replicate the cluster-wide metadata, if configured.
+	s.startMetadata()
+
+	// Let systemd know when we are ready, if we were started by it.
+	s.startSystemdNotify()
+
 	// Wait for clients.
 	s.AcceptLoop(clientListenReady)
 }
@@ -1236,6 +1609,7 @@ func (s *Server) Shutdown() {
 		return
 	}
 	s.Noticef("Initiating Shutdown...")
+	sdNotify("STOPPING=1")
 
 	opts := s.getOpts()
 
@@ -1280,6 +1654,13 @@ func (s *Server) Shutdown() {
 		s.listener = nil
 	}
 
+	// Kick client Unix socket AcceptLoop()
+	if s.unixListener != nil {
+		doneExpected++
+		s.unixListener.Close()
+		s.unixListener = nil
+	}
+
 	// Kick leafnodes AcceptLoop()
 	if s.leafNodeListener != nil {
 		doneExpected++
@@ -1308,6 +1689,13 @@ func (s *Server) Shutdown() {
 		s.http = nil
 	}
 
+	// Kick the public HTTP monitoring if its running
+	if s.publicHTTP != nil {
+		doneExpected++
+		s.publicHTTP.Close()
+		s.publicHTTP = nil
+	}
+
 	// Kick Profiling if its running
 	if s.profiler != nil {
 		doneExpected++
@@ -1371,14 +1759,24 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	// Snapshot server options.
 	opts := s.getOpts()
 
+	if opts.DontListen {
+		s.startWithoutListener(clr)
+		clr = nil
+		return
+	}
+
 	hp := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
-	l, e := net.Listen("tcp", hp)
+	l, e := natsListen(opts.Host, opts.HostV6, opts.Port)
 	if e != nil {
 		s.Fatalf("Error listening on port: %s, %q", hp, e)
 		return
 	}
 	s.Noticef("Listening for client connections on %s",
 		net.JoinHostPort(opts.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	if opts.HostV6 != _EMPTY_ {
+		s.Noticef("Listening for client connections on %s",
+			net.JoinHostPort(opts.HostV6, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	}
 
 	// Alert of TLS enabled.
 	if opts.TLSConfig != nil {
@@ -1414,6 +1812,7 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	// Let the caller know that we are ready
 	close(clr)
 	clr = nil
+	s.notifyReady()
 
 	tmpDelay := ACCEPT_MIN_SLEEP
 
@@ -1431,10 +1830,17 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 			continue
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
-		s.startGoRoutine(func() {
-			s.createClient(conn)
-			s.grWG.Done()
-		})
+		if s.acceptsPaused() || s.ipBanned(conn) {
+			conn.Close()
+			continue
+		}
+		if !s.acceptAllowed("Client", s.getOpts().Networks, conn) {
+			continue
+		}
+		if !s.acceptRateAllowed("Client", s.getOpts().AcceptRate, conn) {
+			continue
+		}
+		s.startAcceptWorker(s.acceptPool, conn, func(conn net.Conn) { s.createClient(conn) })
 	}
 	s.done <- true
 }
@@ -1543,6 +1949,9 @@ func (s *Server) StartMonitoring() error {
 		}
 		err = s.startMonitoring(true)
 	}
+	if err == nil {
+		err = s.startPublicMonitoring()
+	}
 	return err
 }
 
@@ -1556,6 +1965,15 @@ const (
 	LeafzPath    = "/leafz"
 	SubszPath    = "/subsz"
 	StackszPath  = "/stacksz"
+
+	AccountzPath     = "/accountz"
+	AccountStatzPath = "/accstatz"
+	ConfigzPath      = "/configz"
+	LockoutzPath     = "/lockoutz"
+	TrafficzPath     = "/trafficz"
+	LogzPath         = "/logz"
+	CapturezPath     = "/capturez"
+	StorezPath       = "/storez"
 )
 
 // Start the monitoring server
@@ -1571,6 +1989,18 @@ func (s *Server) startMonitoring(secure bool) error {
 		RoutezPath:   0,
 		GatewayzPath: 0,
 		SubszPath:    0,
+		LeafzPath:    0,
+
+		AccountzPath:     0,
+		AccountStatzPath: 0,
+		ConfigzPath:      0,
+		LockoutzPath:     0,
+		TrafficzPath:     0,
+		LogzPath:         0,
+		CapturezPath:     0,
+		StorezPath:       0,
+		ObjectsPath:      0,
+		HealthzPath:      0,
 	}
 
 	var (
@@ -1590,7 +2020,21 @@ func (s *Server) startMonitoring(secure bool) error {
 		}
 		hp = net.JoinHostPort(opts.HTTPHost, strconv.Itoa(port))
 		config := opts.TLSConfig.Clone()
-		config.ClientAuth = tls.NoClientCert
+		clientAuth := tls.NoClientCert
+		if opts.Monitor.Verify {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+		config.ClientAuth = clientAuth
+		// Configs watching their files are replaced on each handshake.
+		if getConfig := config.GetConfigForClient; getConfig != nil {
+			config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				c, err := getConfig(hello)
+				if c != nil {
+					c.ClientAuth = clientAuth
+				}
+				return c, err
+			}
+		}
 		httpListener, err = tls.Listen("tcp", hp, config)
 
 	} else {
@@ -1617,6 +2061,10 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc(VarzPath, s.HandleVarz)
 	// Connz
 	mux.HandleFunc(ConnzPath, s.HandleConnz)
+	// Close connections, only if the monitoring users are authenticated.
+	if opts.Monitor.authEnabled() {
+		mux.HandleFunc(ConnzPath+"/", s.HandleConnzClose)
+	}
 	// Routez
 	mux.HandleFunc(RoutezPath, s.HandleRoutez)
 	// Gatewayz
@@ -1629,18 +2077,53 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc("/subscriptionsz", s.HandleSubsz)
 	// Stacksz
 	mux.HandleFunc(StackszPath, s.HandleStacksz)
+	// Accountz
+	mux.HandleFunc(AccountzPath, s.HandleAccountz)
+	// Accstatz
+	mux.HandleFunc(AccountStatzPath, s.HandleAccountStatz)
+	// Configz
+	mux.HandleFunc(ConfigzPath, s.HandleConfigz)
+	// Lockoutz
+	mux.HandleFunc(LockoutzPath, s.HandleLockoutz)
+	// Trafficz
+	mux.HandleFunc(TrafficzPath, s.HandleTrafficz)
+	// Logz
+	mux.HandleFunc(LogzPath, s.HandleLogz)
+	// Change log levels, only if the monitoring users are authenticated.
+	if opts.Monitor.authEnabled() {
+		mux.HandleFunc(LogzSetPath, s.HandleLogzSet)
+	}
+	// Capturez, listing, downloading and changing captures, only if the
+	// monitoring users are authenticated since captures hold payloads.
+	if opts.Monitor.authEnabled() {
+		mux.HandleFunc(CapturezPath, s.HandleCapturez)
+		mux.HandleFunc(CapturezPath+"/", s.HandleCapturezChange)
+	}
+	// Storez
+	mux.HandleFunc(StorezPath, s.HandleStorez)
+	// Objects, only if the monitoring users are authenticated.
+	if opts.Monitor.authEnabled() {
+		mux.HandleFunc(ObjectsPath+"/", s.HandleObject)
+	}
+	// Healthz
+	mux.HandleFunc(HealthzPath, s.HandleHealthz)
+	// Profiling
+	if opts.Profiling.HTTP {
+		s.handleProfiling(mux, &opts.Profiling)
+	}
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
 	// server needs more time to build the response.
+	handler := monitorCORS(s.monitorAuth(mux, opts), opts.Monitor.CORSOrigins)
 	srv := &http.Server{
 		Addr:           hp,
-		Handler:        mux,
+		Handler:        handler,
 		MaxHeaderBytes: 1 << 20,
 	}
 	s.mu.Lock()
 	s.http = httpListener
-	s.httpHandler = mux
+	s.httpHandler = handler
 	s.monitoringServer = srv
 	s.mu.Unlock()
 
@@ -1673,6 +2156,40 @@ func (s *Server) HTTPHandler() http.Handler {
 	return s.httpHandler
 }
 
+// tlsHandshakeStarted waits up to delay for the client to send the first
+// bytes of the TLS handshake. It returns whether it did and the connection
+// to use, which replays the bytes read.
+func tlsHandshakeStarted(conn net.Conn, delay time.Duration) (bool, net.Conn) {
+	var buf [1]byte
+	conn.SetReadDeadline(time.Now().Add(delay))
+	n, err := conn.Read(buf[:])
+	conn.SetReadDeadline(time.Time{})
+	if n == 0 {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return false, conn
+		}
+		// The connection is likely closed, let the handshake fail.
+		return true, conn
+	}
+	return true, &prefixConn{Conn: conn, prefix: buf[:n]}
+}
+
+// prefixConn is a net.Conn returning the given bytes before the ones
+// read from the underlying connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
 // Perform a conditional deep copy due to reference nature of ClientConnectURLs.
 // If updates are made to Info, this function should be consulted and updated.
 // Assume lock is held.
@@ -1693,6 +2210,10 @@ func (s *Server) copyInfo() Info {
 }
 
 func (s *Server) createClient(conn net.Conn) *client {
+	return s.createClientEx(conn, false)
+}
+
+func (s *Server) createClientEx(conn net.Conn, inProcess bool) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
 
@@ -1715,8 +2236,24 @@ func (s *Server) createClient(conn net.Conn) *client {
 	s.totalClients++
 	s.mu.Unlock()
 
+	// Connections on the Unix socket and in-process are local, TLS is not used.
+	if _, ok := conn.(*net.UnixConn); ok || inProcess {
+		info.TLSRequired, info.TLSVerify = false, false
+	}
+
+	// With TLS handshake first, nothing is sent in clear, the INFO is sent
+	// once the connection is secured. If there is a fallback delay, clients
+	// that have not started the handshake by then get the INFO first.
+	tlsFirst := info.TLSRequired && opts.TLSHandshakeFirst
+	if tlsFirst && opts.TLSHandshakeFirstFallback > 0 {
+		tlsFirst, c.nc = tlsHandshakeStarted(conn, opts.TLSHandshakeFirstFallback)
+	}
+
 	// Grab lock
 	c.mu.Lock()
+	if inProcess {
+		c.flags.set(inProcessConn)
+	}
 	if info.AuthRequired {
 		c.flags.set(expectConnect)
 	}
@@ -1729,7 +2266,9 @@ func (s *Server) createClient(conn net.Conn) *client {
 	// Send our information.
 	// Need to be sent in place since writeLoop cannot be started until
 	// TLS handshake is done (if applicable).
-	c.sendProtoNow(c.generateClientInfoJSON(info))
+	if !tlsFirst {
+		c.sendProtoNow(c.generateClientInfoJSON(info))
+	}
 
 	// Unlock to register
 	c.mu.Unlock()
@@ -1747,7 +2286,7 @@ func (s *Server) createClient(conn net.Conn) *client {
 
 	// If there is a max connections specified, check that adding
 	// this new client would not push us over the max
-	if opts.MaxConn > 0 && len(s.clients) >= opts.MaxConn {
+	if maxConn := s.maxConnections(); maxConn > 0 && len(s.clients) >= maxConn {
 		s.mu.Unlock()
 		c.maxConnExceeded()
 		return nil
@@ -1771,7 +2310,7 @@ func (s *Server) createClient(conn net.Conn) *client {
 
 		// Force handshake
 		c.mu.Unlock()
-		if err := conn.Handshake(); err != nil {
+		if err := s.tlsHandshake(conn, ttl); err != nil {
 			c.Errorf("TLS handshake error: %v", err)
 			c.closeConnection(TLSHandshakeError)
 			return nil
@@ -1784,6 +2323,11 @@ func (s *Server) createClient(conn net.Conn) *client {
 
 		// Indicate that handshake is complete (used in monitoring)
 		c.flags.set(handshakeComplete)
+
+		// Now that the connection is secured, send our information.
+		if tlsFirst && !c.isClosed() {
+			c.sendProtoNow(c.generateClientInfoJSON(info))
+		}
 	}
 
 	// The connection may have been closed
@@ -1826,7 +2370,8 @@ func (s *Server) createClient(conn net.Conn) *client {
 func (s *Server) saveClosedClient(c *client, nc net.Conn, reason ClosedState) {
 	now := time.Now()
 
-	s.accountDisconnectEvent(c, now, reason.String())
+	s.accountDisconnectEvent(c, now, reason)
+	s.clientDisconnected(c, now, reason)
 
 	c.mu.Lock()
 
@@ -1834,6 +2379,7 @@ func (s *Server) saveClosedClient(c *client, nc net.Conn, reason ClosedState) {
 	cc.fill(c, nc, now)
 	cc.Stop = &now
 	cc.Reason = reason.String()
+	cc.ReasonCode = s.closedReasonCode(reason)
 
 	// Do subs, do not place by default in main ConnInfo
 	if len(c.subs) > 0 {
@@ -1972,12 +2518,15 @@ func (s *Server) removeClient(c *client) {
 			s.cproto--
 		}
 		s.mu.Unlock()
+		s.removeConnLogScope(cid)
+		s.stopConnCapture(cid)
 	case ROUTER:
 		s.removeRoute(c)
 	case GATEWAY:
 		s.removeRemoteGatewayConnection(c)
 	case LEAF:
 		s.removeLeafNodeConnection(c)
+		s.stopConnCapture(c.cid)
 	}
 }
 
@@ -2071,11 +2620,34 @@ func (s *Server) numSubscriptions() uint32 {
 	return uint32(subs)
 }
 
+// sublistCacheStats will report the sublist cache hits and misses
+// across all accounts.
+func (s *Server) sublistCacheStats() (hits, misses uint64) {
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		acc.mu.RLock()
+		sl := acc.sl
+		acc.mu.RUnlock()
+		if sl != nil {
+			hits += atomic.LoadUint64(&sl.cacheHits)
+			misses += atomic.LoadUint64(&sl.cacheMisses)
+		}
+		return true
+	})
+	return hits, misses
+}
+
 // NumSlowConsumers will report the number of slow consumers.
 func (s *Server) NumSlowConsumers() int64 {
 	return atomic.LoadInt64(&s.slowConsumers)
 }
 
+// NumSubsLimitExceeded will report the number of subscriptions rejected
+// because a connection or account limit was reached.
+func (s *Server) NumSubsLimitExceeded() int64 {
+	return atomic.LoadInt64(&s.subsExceeded)
+}
+
 // ConfigTime will report the last time the server configuration was loaded.
 func (s *Server) ConfigTime() time.Time {
 	s.mu.Lock()
@@ -2123,19 +2695,21 @@ func (s *Server) ProfilerAddr() *net.TCPAddr {
 	return s.profiler.Addr().(*net.TCPAddr)
 }
 
+// StartError returns the error that prevented Start() from starting the
+// server, which has then been shut down, nil if there is none.
+func (s *Server) StartError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.startErr
+}
+
 // ReadyForConnections returns `true` if the server is ready to accept clients
 // and, if routing is enabled, route connections. If after the duration
 // `dur` the server is still not ready, returns `false`.
 func (s *Server) ReadyForConnections(dur time.Duration) bool {
-	// Snapshot server options.
-	opts := s.getOpts()
-
 	end := time.Now().Add(dur)
 	for time.Now().Before(end) {
-		s.mu.Lock()
-		ok := s.listener != nil && (opts.Cluster.Port == 0 || s.routeListener != nil) && (opts.Gateway.Name == "" || s.gatewayListener != nil)
-		s.mu.Unlock()
-		if ok {
+		if s.readyForConnections() {
 			return true
 		}
 		time.Sleep(25 * time.Millisecond)
@@ -2143,6 +2717,53 @@ func (s *Server) ReadyForConnections(dur time.Duration) bool {
 	return false
 }
 
+// Returns true if all the listeners of the server are started.
+func (s *Server) readyForConnections() bool {
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return (s.listener != nil || opts.DontListen && s.running) &&
+		(opts.ListenUnix.Path == "" || s.unixListener != nil) &&
+		(opts.Cluster.Port == 0 || s.routeListener != nil) && (opts.Gateway.Name == "" || s.gatewayListener != nil)
+}
+
+// drainDelay returns how long a draining subscription needs to be kept
+// so that the messages already sent by remote servers are delivered.
+// This is twice the highest round trip time to a remote server, or 0 if
+// there is none.
+func (s *Server) drainDelay() time.Duration {
+	var rtt time.Duration
+	var remotes bool
+	check := func(c *client) {
+		remotes = true
+		if r := c.getRTTValue(); r > rtt {
+			rtt = r
+		}
+	}
+	s.mu.Lock()
+	for _, r := range s.routes {
+		check(r)
+	}
+	for _, l := range s.leafs {
+		check(l)
+	}
+	s.mu.Unlock()
+	s.gateway.RLock()
+	for _, gw := range s.gateway.out {
+		check(gw)
+	}
+	s.gateway.RUnlock()
+	if !remotes {
+		return 0
+	}
+	if d := 2 * rtt; d > minDrainDelay {
+		return d
+	}
+	return minDrainDelay
+}
+
 // ID returns the server's ID
 func (s *Server) ID() string {
 	s.mu.Lock()
@@ -2150,13 +2771,49 @@ func (s *Server) ID() string {
 	return s.info.ID
 }
 
-func (s *Server) startGoRoutine(f func()) {
+// ClusterName returns the name of the cluster of the server, which defaults
+// to the name of its gateway, if any.
+func (s *Server) ClusterName() string {
+	return s.clusterName()
+}
+
+func (s *Server) clusterName() string {
+	if name := s.getOpts().Cluster.Name; name != _EMPTY_ {
+		return name
+	}
+	if s.gateway.enabled {
+		return s.getGatewayName()
+	}
+	return _EMPTY_
+}
+
+// Tags returns the tags of the server, for instance its region or zone.
+func (s *Server) Tags() map[string]string {
+	return copyTags(s.getOpts().Tags)
+}
+
+// Returns a copy of the tags, nil if there are none.
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+func (s *Server) startGoRoutine(f func()) bool {
+	var started bool
 	s.grMu.Lock()
 	if s.grRunning {
 		s.grWG.Add(1)
 		go f()
+		started = true
 	}
 	s.grMu.Unlock()
+	return started
 }
 
 func (s *Server) numClosedConns() int {
@@ -2193,23 +2850,33 @@ func (s *Server) getClientConnectURLs() []string {
 		// just use the info host/port. This is updated in s.New()
 		urls = append(urls, net.JoinHostPort(s.info.Host, strconv.Itoa(s.info.Port)))
 	} else {
-		sPort := strconv.Itoa(opts.Port)
-		_, ips, err := s.getNonLocalIPsIfHostIsIPAny(opts.Host, true)
-		for _, ip := range ips {
-			urls = append(urls, net.JoinHostPort(ip, sPort))
-		}
-		if err != nil || len(urls) == 0 {
-			// We are here if s.opts.Host is not "0.0.0.0" nor "::", or if for some
-			// reason we could not add any URL in the loop above.
-			// We had a case where a Windows VM was hosed and would have err == nil
-			// and not add any address in the array in the loop above, and we
-			// ended-up returning 0.0.0.0, which is problematic for Windows clients.
-			// Check for 0.0.0.0 or :: specifically, and ignore if that's the case.
-			if opts.Host == "0.0.0.0" || opts.Host == "::" {
-				s.Errorf("Address %q can not be resolved properly", opts.Host)
-			} else {
-				urls = append(urls, net.JoinHostPort(opts.Host, sPort))
-			}
+		urls = s.appendClientConnectURLs(urls, opts.Host, opts.Port)
+		if opts.HostV6 != _EMPTY_ {
+			urls = s.appendClientConnectURLs(urls, opts.HostV6, opts.Port)
+		}
+	}
+	return urls
+}
+
+// Appends the URLs clients can use to connect to the given listen host.
+func (s *Server) appendClientConnectURLs(urls []string, host string, port int) []string {
+	sPort := strconv.Itoa(port)
+	n := len(urls)
+	_, ips, err := s.getNonLocalIPsIfHostIsIPAny(host, true)
+	for _, ip := range ips {
+		urls = append(urls, net.JoinHostPort(ip, sPort))
+	}
+	if err != nil || len(urls) == n {
+		// We are here if host is not "0.0.0.0" nor "::", or if for some
+		// reason we could not add any URL in the loop above.
+		// We had a case where a Windows VM was hosed and would have err == nil
+		// and not add any address in the array in the loop above, and we
+		// ended-up returning 0.0.0.0, which is problematic for Windows clients.
+		// Check for 0.0.0.0 or :: specifically, and ignore if that's the case.
+		if host == "0.0.0.0" || host == "::" {
+			s.Errorf("Address %q can not be resolved properly", host)
+		} else {
+			urls = append(urls, net.JoinHostPort(host, sPort))
 		}
 	}
 	return urls
@@ -2232,6 +2899,8 @@ func (s *Server) getNonLocalIPsIfHostIsIPAny(host string, all bool) (bool, []str
 		return false, nil, nil
 	}
 	s.Debugf("Get non local IPs for %q", host)
+	// Listening on 0.0.0.0 accepts IPv4 connections only.
+	v4Only := ip.To4() != nil
 	var ips []string
 	ifaces, _ := net.Interfaces()
 	for _, i := range ifaces {
@@ -2245,7 +2914,7 @@ func (s *Server) getNonLocalIPsIfHostIsIPAny(host string, all bool) (bool, []str
 			}
 			ipStr := ip.String()
 			// Skip non global unicast addresses
-			if !ip.IsGlobalUnicast() || ip.IsUnspecified() {
+			if !ip.IsGlobalUnicast() || ip.IsUnspecified() || (v4Only && ip.To4() == nil) {
 				ip = nil
 				continue
 			}
@@ -2477,6 +3146,10 @@ func (s *Server) lameDuckMode() {
 	s.ldmCh = make(chan bool, 1)
 	s.listener.Close()
 	s.listener = nil
+	if s.unixListener != nil {
+		s.unixListener.Close()
+		s.unixListener = nil
+	}
 	s.mu.Unlock()
 
 	// Wait for accept loop to be done to make sure that no new
@@ -2484,6 +3157,10 @@ func (s *Server) lameDuckMode() {
 	<-s.ldmCh
 
 	s.mu.Lock()
+	// Let clients that support async INFO know that we are in lame
+	// duck mode, along with reconnect hints if any, so that they can
+	// start spreading their reconnect attempts.
+	s.sendLDMToClients()
 	// Need to recheck few things
 	if s.shutdown || len(s.clients) == 0 {
 		s.mu.Unlock()
@@ -2556,6 +3233,14 @@ func (s *Server) lameDuckMode() {
 	s.Shutdown()
 }
 
+// Sends an async INFO with the lame duck mode flag set to clients
+// that support it.
+// Server lock is held on entry.
+func (s *Server) sendLDMToClients() {
+	s.info.LameDuckMode = true
+	s.sendAsyncInfoToClients()
+}
+
 // If given error is a net.Error and is temporary, sleeps for the given
 // delay and double it, but cap it to ACCEPT_MAX_SLEEP. The sleep is
 // interrupted if the server is shutdown.
@@ -2632,7 +3317,7 @@ func (s *Server) shouldReportConnectErr(firstConnect bool, attempts int) bool {
 // Client lock should be held.
 func (s *Server) setFirstPingTimer(c *client) {
 	opts := s.getOpts()
-	d := opts.PingInterval
+	d, _ := c.pingPolicy(opts)
 
 	if !opts.DisableShortFirstPing {
 		if c.kind != CLIENT {
@@ -2648,3 +3333,80 @@ func (s *Server) setFirstPingTimer(c *client) {
 	d += time.Duration(addDelay)
 	c.ping.tmr = time.AfterFunc(d, c.processPingTimer)
 }
+
+// Returns the maximum number of client connections, which is either the
+// configured value or the one set at runtime.
+// Lock should be held.
+func (s *Server) maxConnections() int {
+	if s.connLimits.maxConn > 0 {
+		return s.connLimits.maxConn
+	}
+	return s.getOpts().MaxConn
+}
+
+// setMaxConnections overrides the configured max_connections until the next
+// reload of that setting. A negative value restores the configured limit.
+// Connections above the new limit are closed.
+func (s *Server) setMaxConnections(max int) {
+	s.mu.Lock()
+	if max < 0 {
+		max = 0
+	}
+	s.connLimits.maxConn = max
+	max = s.maxConnections()
+	s.mu.Unlock()
+
+	s.Noticef("Max connections set to %d", max)
+	if closed := s.closeClientsOverLimit(max); closed > 0 {
+		s.Noticef("Closed %d connections to fall within max_connections", closed)
+	}
+}
+
+// Closes random client connections until we are within the given limit.
+// Returns the number of connections closed.
+func (s *Server) closeClientsOverLimit(max int) int {
+	s.mu.Lock()
+	var (
+		clients = make([]*client, 0, len(s.clients))
+		closed  = 0
+	)
+	// Map iteration is random, which allows us to close random connections.
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	if max <= 0 || len(clients) <= max {
+		return 0
+	}
+	for _, client := range clients[max:] {
+		client.maxConnExceeded()
+		closed++
+	}
+	return closed
+}
+
+// pauseAccepts will have the accept loop drop new client connections for
+// the given duration. A duration of 0 resumes accepting right away.
+func (s *Server) pauseAccepts(d time.Duration) {
+	s.mu.Lock()
+	if d > 0 {
+		s.connLimits.paused = time.Now().Add(d)
+	} else {
+		s.connLimits.paused = time.Time{}
+	}
+	s.mu.Unlock()
+	if d > 0 {
+		s.Warnf("Pausing accepts of client connections for %v", d)
+	} else {
+		s.Noticef("Resuming accepts of client connections")
+	}
+}
+
+// acceptsPaused returns true if new client connections should be dropped.
+func (s *Server) acceptsPaused() bool {
+	s.mu.Lock()
+	paused := time.Now().Before(s.connLimits.paused)
+	s.mu.Unlock()
+	return paused
+}
@@ -14,9 +14,11 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -24,6 +26,7 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -49,6 +52,41 @@ func checkFor(t *testing.T, totalWait, sleepDur time.Duration, f func() error) {
 	}
 }
 
+// runAccountServer runs a server with the system account SYS, the
+// configuration conf and the account A configured with acc, and connects
+// as the user of the account A.
+func runAccountServer(t *testing.T, conf, acc string) (*Server, *nats.Conn) {
+	t.Helper()
+	cf := createConfFile(t, []byte(fmt.Sprintf(`
+		port: -1
+		system_account: SYS
+		%s
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				%s
+			}
+		}
+	`, conf, acc)))
+	defer os.Remove(cf)
+	s, opts := RunServerWithConfig(cf)
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port), nats.UserInfo("a", "a"))
+	return s, nc
+}
+
+// apiRequest sends a request and unmarshals the JSON response into resp.
+func apiRequest(t *testing.T, nc *nats.Conn, subject string, data []byte, resp interface{}) {
+	t.Helper()
+	msg, err := nc.Request(subject, data, time.Second)
+	if err != nil {
+		t.Fatalf("Error on request %q: %v", subject, err)
+	}
+	if err := json.Unmarshal(msg.Data, resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+}
+
 func DefaultOptions() *Options {
 	return &Options{
 		Host:     "127.0.0.1",
@@ -182,6 +220,129 @@ func TestTLSVersions(t *testing.T) {
 	}
 }
 
+func TestTLSHandshakeFirst(t *testing.T) {
+	tmpl := `
+		listen: 127.0.0.1:-1
+		tls {
+			cert_file: "./configs/certs/server.pem"
+			key_file: "./configs/certs/key.pem"
+			timeout: 1
+			handshake_first: %s
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, "true")))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if !opts.TLSHandshakeFirst || opts.TLSHandshakeFirstFallback != 0 {
+		t.Fatalf("Unexpected options: %v %v", opts.TLSHandshakeFirst, opts.TLSHandshakeFirstFallback)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", opts.Port)
+
+	// The INFO is received once the TLS handshake is done.
+	checkTLSInfo := func() {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Error on handshake: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "INFO ") {
+			t.Fatalf("Expected INFO, got %q (err=%v)", line, err)
+		}
+	}
+	// Returns what a client not starting the handshake receives.
+	readClear := func(wait time.Duration) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(wait))
+		buf := make([]byte, 5)
+		n, _ := conn.Read(buf)
+		return string(buf[:n])
+	}
+
+	checkTLSInfo()
+	if got := readClear(250 * time.Millisecond); got != "" {
+		t.Fatalf("Expected nothing in clear, got %q", got)
+	}
+
+	// With a fallback delay, legacy clients still get the INFO first.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, `"100ms"`))
+	if o := s.getOpts(); !o.TLSHandshakeFirst || o.TLSHandshakeFirstFallback != 100*time.Millisecond {
+		t.Fatalf("Unexpected options: %v %v", o.TLSHandshakeFirst, o.TLSHandshakeFirstFallback)
+	}
+	checkTLSInfo()
+	if got := readClear(time.Second); got != "INFO " {
+		t.Fatalf("Expected INFO, got %q", got)
+	}
+	nc, err := nats.Connect("nats://"+addr, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+}
+
+func TestTLSHandshakeFirstConfig(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		first    bool
+		fallback time.Duration
+		err      string
+	}{
+		{`false`, false, 0, ""},
+		{`"auto"`, true, DEFAULT_TLS_HANDSHAKE_FIRST_FALLBACK_DELAY, ""},
+		{`"300ms"`, true, 300 * time.Millisecond, ""},
+		{`"soon"`, false, 0, "invalid 'handshake_first' value"},
+		{`5`, false, 0, "expected 'handshake_first' to be a boolean"},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				tls {
+					cert_file: "./configs/certs/server.pem"
+					key_file: "./configs/certs/key.pem"
+					handshake_first: %s
+				}
+			`, test.value)))
+			defer os.Remove(conf)
+			opts, err := ProcessConfigFile(conf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error processing config: %v", err)
+			}
+			if opts.TLSHandshakeFirst != test.first || opts.TLSHandshakeFirstFallback != test.fallback {
+				t.Fatalf("Unexpected options: %v %v", opts.TLSHandshakeFirst, opts.TLSHandshakeFirstFallback)
+			}
+		})
+	}
+
+	// Only clients support it.
+	conf := createConfFile(t, []byte(`
+		leafnodes {
+			tls {
+				cert_file: "./configs/certs/server.pem"
+				key_file: "./configs/certs/key.pem"
+				handshake_first: true
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "only supported for client connections") {
+		t.Fatalf("Expected error, got %v", err)
+	}
+}
+
 func TestTlsCipher(t *testing.T) {
 	if strings.Compare(tlsCipher(0x0005), "TLS_RSA_WITH_RC4_128_SHA") != 0 {
 		t.Fatalf("Invalid tls cipher")
@@ -613,6 +774,73 @@ func TestCustomRouterAuthentication(t *testing.T) {
 	checkNumRoutes(t, s3, 1)
 }
 
+type tokenAuth struct {
+	users map[string]*User
+}
+
+func (a *tokenAuth) Check(c ClientAuthentication) bool {
+	u, ok := a.users[c.GetOpts().Authorization]
+	if ok {
+		c.RegisterUser(u)
+	}
+	return ok
+}
+
+func TestCustomClientAuthenticationAccountAndPermissions(t *testing.T) {
+	auth := &tokenAuth{}
+	opts := DefaultOptions()
+	opts.CustomClientAuthentication = auth
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	acc, _ := s.LookupOrRegisterAccount("tenant")
+	auth.users = map[string]*User{
+		"":      {},
+		"admin": {Account: acc},
+		"reader": {Account: acc, Permissions: &Permissions{
+			Publish: &SubjectPermission{Deny: []string{">"}},
+		}},
+	}
+
+	addr := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	if _, err := nats.Connect(addr, nats.Token("unknown")); err == nil {
+		t.Fatal("Expected client to fail to connect")
+	}
+
+	// Clients without token are in the global account and do not see
+	// the tenant's messages.
+	ncg := natsConnect(t, addr)
+	defer ncg.Close()
+	subg := natsSubSync(t, ncg, "foo")
+	natsFlush(t, ncg)
+
+	errCh := make(chan error, 1)
+	ncr := natsConnect(t, addr, nats.Token("reader"), nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	}))
+	defer ncr.Close()
+	subr := natsSubSync(t, ncr, "foo")
+	natsFlush(t, ncr)
+
+	nca := natsConnect(t, addr, nats.Token("admin"))
+	defer nca.Close()
+	natsPub(t, nca, "foo", []byte("hello"))
+	natsNexMsg(t, subr, time.Second)
+	if _, err := subg.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no message in the global account, got %v", err)
+	}
+
+	natsPub(t, ncr, "foo", []byte("denied"))
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "Permissions Violation") {
+			t.Fatalf("Expected permissions violation, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected permissions violation")
+	}
+}
+
 func TestMonitoringNoTimeout(t *testing.T) {
 	s := runMonitorServer()
 	defer s.Shutdown()
@@ -873,6 +1101,76 @@ func TestLameDuckMode(t *testing.T) {
 	})
 }
 
+func TestReconnectHintsAndLameDuckModeInfo(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ReconnectMinDelay = 100 * time.Millisecond
+	opts.ReconnectMaxDelay = 2 * time.Second
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	readInfo := func() *Info {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		if !strings.HasPrefix(line, "INFO ") {
+			t.Fatalf("Expected INFO, got %q", line)
+		}
+		info := &Info{}
+		if err := json.Unmarshal([]byte(line[5:]), info); err != nil {
+			t.Fatalf("Error unmarshalling INFO: %v", err)
+		}
+		return info
+	}
+
+	info := readInfo()
+	if info.ReconnectMinDelay != opts.ReconnectMinDelay || info.ReconnectMaxDelay != opts.ReconnectMaxDelay {
+		t.Fatalf("Unexpected reconnect hints: min=%v max=%v", info.ReconnectMinDelay, info.ReconnectMaxDelay)
+	}
+	if info.LameDuckMode {
+		t.Fatal("Lame duck mode should not be set")
+	}
+
+	conn.Write([]byte(fmt.Sprintf("CONNECT {\"verbose\":false,\"protocol\":%d}\r\nPING\r\n", ClientProtoInfo)))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if l, err := br.ReadString('\n'); err != nil || l != pongProto {
+		t.Fatalf("Expected PONG, got %q (err=%v)", l, err)
+	}
+
+	go s.lameDuckMode()
+
+	info = readInfo()
+	if !info.LameDuckMode {
+		t.Fatal("Expected lame duck mode to be set")
+	}
+	if info.ReconnectMinDelay != opts.ReconnectMinDelay || info.ReconnectMaxDelay != opts.ReconnectMaxDelay {
+		t.Fatalf("Unexpected reconnect hints: min=%v max=%v", info.ReconnectMinDelay, info.ReconnectMaxDelay)
+	}
+}
+
+func TestReconnectHintsValidation(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ReconnectMinDelay = 2 * time.Second
+	opts.ReconnectMaxDelay = time.Second
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "reconnect_min_delay") {
+		t.Fatalf("Expected error about reconnect delays, got %v", err)
+	}
+	opts.ReconnectMinDelay = -time.Second
+	opts.ReconnectMaxDelay = 0
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Fatalf("Expected error about negative delays, got %v", err)
+	}
+}
+
 func TestServerValidateGatewaysOptions(t *testing.T) {
 	baseOpt := testDefaultOptionsForGateway("A")
 	u, _ := url.Parse("host:5222")
@@ -1574,3 +1872,100 @@ func TestReconnectErrorReports(t *testing.T) {
 		})
 	}
 }
+
+func TestServerClusterNameAndTags(t *testing.T) {
+	tmpl := `
+		server_name: %s
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		tags { region: "us-east", az: %d }
+		cluster { name: "C1", listen: "127.0.0.1:-1" %s }
+		accounts {
+			SYS { users [{user: sys, password: pwd}] }
+			A { users [{user: a, password: pwd}] }
+		}
+		system_account: SYS
+	`
+	conf1 := createConfFile(t, []byte(fmt.Sprintf(tmpl, "S1", 1, "")))
+	defer os.Remove(conf1)
+	s1, o1 := RunServerWithConfig(conf1)
+	defer s1.Shutdown()
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(tmpl, "S2", 2,
+		fmt.Sprintf(`, routes: ["nats://127.0.0.1:%d"]`, o1.Cluster.Port))))
+	defer os.Remove(conf2)
+	s2, _ := RunServerWithConfig(conf2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	if name := s1.ClusterName(); name != "C1" {
+		t.Fatalf("Expected cluster name C1, got %q", name)
+	}
+	if tags := s1.Tags(); len(tags) != 2 || tags["region"] != "us-east" || tags["az"] != "1" {
+		t.Fatalf("Unexpected tags: %v", tags)
+	}
+
+	// The INFO sent to the clients.
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", o1.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		t.Fatalf("Error unmarshalling INFO: %v", err)
+	}
+	if info.Name != "S1" || info.Cluster != "C1" || info.Tags["az"] != "1" {
+		t.Fatalf("Unexpected INFO: %+v", info)
+	}
+
+	v, _ := s1.Varz(nil)
+	if v.Name != "S1" || v.Cluster.Name != "C1" || v.Tags["region"] != "us-east" {
+		t.Fatalf("Unexpected varz: %+v", v)
+	}
+	rz, _ := s1.Routez(nil)
+	if rz.Name != "S1" || rz.Cluster != "C1" || len(rz.Routes) != 1 {
+		t.Fatalf("Unexpected routez: %+v", rz)
+	}
+	if r := rz.Routes[0]; r.RemoteName != "S2" || r.Cluster != "C1" || r.Tags["az"] != "2" {
+		t.Fatalf("Unexpected route: %+v", r)
+	}
+
+	// The events of the system account.
+	ncs, err := nats.Connect(s1.ClientURL(), nats.UserInfo("sys", "pwd"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer ncs.Close()
+	sub, _ := ncs.SubscribeSync("$SYS.ACCOUNT.A.CONNECT")
+	ncs.Flush()
+	nc, err := nats.Connect(s1.ClientURL(), nats.UserInfo("a", "pwd"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer nc.Close()
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error receiving event: %v", err)
+	}
+	var cem ConnectEventMsg
+	if err := json.Unmarshal(msg.Data, &cem); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+	if cem.Server.Name != "S1" || cem.Server.Cluster != "C1" || cem.Server.Tags["region"] != "us-east" {
+		t.Fatalf("Unexpected server info: %+v", cem.Server)
+	}
+}
+
+func TestServerClusterNameMismatchGateway(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Cluster.Name = "C1"
+	opts.Gateway.Name = "C2"
+	opts.Gateway.Port = -1
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("Expected error about cluster and gateway names, got %v", err)
+	}
+}
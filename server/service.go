@@ -19,7 +19,7 @@ package server
 // hook for running NATS as a service.
 func Run(server *Server) error {
 	server.Start()
-	return nil
+	return server.StartError()
 }
 
 // isWindowsService indicates if NATS is running as a Windows service.
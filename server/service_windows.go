@@ -107,7 +107,7 @@ loop:
 func Run(server *Server) error {
 	if dockerized {
 		server.Start()
-		return nil
+		return server.StartError()
 	}
 	isInteractive, err := svc.IsAnInteractiveSession()
 	if err != nil {
@@ -115,7 +115,7 @@ func Run(server *Server) error {
 	}
 	if isInteractive {
 		server.Start()
-		return nil
+		return server.StartError()
 	}
 	return svc.Run(serviceName, &winServiceWrapper{server})
 }
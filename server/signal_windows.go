@@ -17,10 +17,14 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/mgr"
+
+	srvlog "github.com/nats-io/nats-server/v2/logger"
 )
 
 // Signal Handling
@@ -30,13 +34,32 @@ func (s *Server) handleSignals() {
 	}
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, os.Interrupt)
+	// CTRL_C and CTRL_BREAK are delivered as os.Interrupt, while closing
+	// the console, logging off and shutting down are delivered as SIGTERM.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		for sig := range c {
-			s.Debugf("Trapped %q signal", sig)
-			s.Shutdown()
-			os.Exit(0)
+		ldm := false
+		for {
+			select {
+			case sig := <-c:
+				s.Debugf("Trapped %q signal", sig)
+				// A second event while in lame duck mode stops right away.
+				if ldm {
+					s.Shutdown()
+					os.Exit(0)
+				}
+				ldm = true
+				// Note that Windows only waits a few seconds for the
+				// process to exit on console close, log off and shutdown.
+				go func() {
+					s.lameDuckMode()
+					s.Shutdown()
+					os.Exit(0)
+				}()
+			case <-s.quitCh:
+				return
+			}
 		}
 	}()
 }
@@ -55,6 +78,13 @@ func ProcessSignal(command Command, service string) error {
 	}
 	defer m.Disconnect()
 
+	switch command {
+	case CommandInstall:
+		return installService(m, service)
+	case CommandUninstall:
+		return uninstallService(m, service)
+	}
+
 	s, err := m.OpenService(service)
 	if err != nil {
 		return fmt.Errorf("could not access service: %v", err)
@@ -79,15 +109,26 @@ func ProcessSignal(command Command, service string) error {
 	case commandLDMode:
 		cmd = ldmCmd
 		to = svc.Running
+	case CommandStart:
+		to = svc.Running
 	default:
 		return fmt.Errorf("unknown signal %q", command)
 	}
 
-	status, err := s.Control(cmd)
-	if err != nil {
+	var status svc.Status
+	if command == CommandStart {
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("could not start service: %v", err)
+		}
+	} else if status, err = s.Control(cmd); err != nil {
 		return fmt.Errorf("could not send control=%d: %v", cmd, err)
 	}
+	return waitForServiceState(s, status, to)
+}
 
+// waitForServiceState waits for the service to reach the given state.
+func waitForServiceState(s *mgr.Service, status svc.Status, to svc.State) error {
+	var err error
 	timeout := time.Now().Add(10 * time.Second)
 	for status.State != to {
 		if timeout.Before(time.Now()) {
@@ -102,3 +143,70 @@ func ProcessSignal(command Command, service string) error {
 
 	return nil
 }
+
+// installService installs the running executable as a service that is
+// started automatically. The service is started with the same arguments
+// as the current command, minus the signal flag.
+func installService(m *mgr.Mgr, name string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find executable: %v", err)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "NATS Server",
+		Description: "NATS messaging server",
+		StartType:   mgr.StartAutomatic,
+	}, serviceArgs(os.Args[1:])...)
+	if err != nil {
+		return fmt.Errorf("could not install service: %v", err)
+	}
+	defer s.Close()
+	if err := srvlog.InstallSysLogSource(); err != nil {
+		s.Delete()
+		return fmt.Errorf("could not register event log source: %v", err)
+	}
+	return nil
+}
+
+// uninstallService stops the service if needed and removes it.
+func uninstallService(m *mgr.Mgr, name string) error {
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("could not access service: %v", err)
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("could not retrieve service status: %v", err)
+	}
+	if status.State != svc.Stopped {
+		if status, err = s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("could not stop service: %v", err)
+		}
+		if err := waitForServiceState(s, status, svc.Stopped); err != nil {
+			return err
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("could not remove service: %v", err)
+	}
+	// The event log source may be shared with other installs, so this
+	// is best effort.
+	srvlog.RemoveSysLogSource()
+	return nil
+}
+
+// serviceArgs removes the signal flag and its value from args.
+func serviceArgs(args []string) []string {
+	var sargs []string
+	for i := 0; i < len(args); i++ {
+		switch name := strings.TrimLeft(args[i], "-"); {
+		case name == "sl" || name == "signal":
+			i++
+		case strings.HasPrefix(name, "sl=") || strings.HasPrefix(name, "signal="):
+		default:
+			sargs = append(sargs, args[i])
+		}
+	}
+	return sargs
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServiceArgs(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"-sl", "install", "-c", "nats.conf"}, []string{"-c", "nats.conf"}},
+		{[]string{"-c", "nats.conf", "--signal", "install=nats"}, []string{"-c", "nats.conf"}},
+		{[]string{"--signal=install=nats", "-p", "4333"}, []string{"-p", "4333"}},
+		{[]string{"-sl=install"}, nil},
+	} {
+		if got := serviceArgs(test.args); !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("Expected %q for %q, got %q", test.expected, test.args, got)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package server
 import (
 	"bytes"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -566,3 +567,34 @@ func TestSplitBufferLeafMsgArg(t *testing.T) {
 		t.Fatalf("parser state not cleaned-up properly: %+v", c.pa)
 	}
 }
+
+func TestSplitBufferAllPositions(t *testing.T) {
+	big := strings.Repeat("x", 5000)
+	proto := []byte("SUB foo 1\r\nPUB foo.bar INBOX.22 11\r\nhello world\r\n" +
+		"PUB big 5000\r\n" + big + "\r\nUNSUB 1\r\n")
+
+	for _, legacy := range []bool{false, true} {
+		c := &client{msubs: -1, mpay: -1, mcl: 1024, subs: make(map[string]*subscription)}
+		c.legacy = legacy
+		for k := 1; k < len(proto); k++ {
+			// Parse from copies that are overwritten once parsed, so that
+			// nothing refers to them after the split.
+			for _, part := range [][]byte{proto[:k], proto[k:]} {
+				buf := append([]byte(nil), part...)
+				if err := c.parse(buf); err != nil {
+					t.Fatalf("Unexpected parse error with legacy=%v at %d: %v", legacy, k, err)
+				}
+				copy(buf, bytes.Repeat([]byte{'#'}, len(buf)))
+			}
+			if c.state != OP_START || len(c.subs) != 0 || c.in.msgs != 2 || c.in.bytes != 5011 {
+				t.Fatalf("Unexpected state with legacy=%v at %d: state=%d subs=%d msgs=%d bytes=%d",
+					legacy, k, c.state, len(c.subs), c.in.msgs, c.in.bytes)
+			}
+			c.in.msgs, c.in.bytes = 0, 0
+		}
+		// The buffer of the large split messages is only reused by default.
+		if legacy != (c.pbuf == nil) {
+			t.Fatalf("Unexpected buffer with legacy=%v: %d bytes", legacy, cap(c.pbuf))
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SRVScheme is the URL scheme of routes and leafnode remotes whose
+// host is the name of DNS SRV records, for instance
+// "nats+srv://_nats-route._tcp.example.com". The targets of the records
+// are the servers to connect to.
+const SRVScheme = "nats+srv"
+
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+func isSRVURL(u *url.URL) bool {
+	return u != nil && u.Scheme == SRVScheme
+}
+
+// resolveSRV returns the URLs of the targets of the SRV records named by
+// the host of u, in the order of priority and weight given by the resolver.
+// The user information of u is kept so that it can be used for the
+// authentication with the targets.
+func (s *Server) resolveSRV(u *url.URL) ([]*url.URL, error) {
+	var resolver srvResolver = net.DefaultResolver
+	if r := s.getOpts().srvResolver; r != nil {
+		resolver = r
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_ROUTE_DIAL)
+	defer cancel()
+	_, addrs, err := resolver.LookupSRV(ctx, _EMPTY_, _EMPTY_, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no SRV record found for %q", u.Hostname())
+	}
+	urls := make([]*url.URL, 0, len(addrs))
+	for _, a := range addrs {
+		host := strings.TrimSuffix(a.Target, ".")
+		urls = append(urls, &url.URL{
+			Scheme: "nats",
+			User:   u.User,
+			Host:   net.JoinHostPort(host, strconv.Itoa(int(a.Port))),
+		})
+	}
+	return urls, nil
+}
+
+// srvDiscovery is the RouteDiscovery of a route given as SRV records.
+type srvDiscovery struct {
+	s   *Server
+	url *url.URL
+}
+
+func (sd *srvDiscovery) Discover() ([]*url.URL, error) {
+	return sd.s.resolveSRV(sd.url)
+}
+
+// solicitSRVRoutes connects to the targets of the SRV route, which are
+// resolved again every Cluster.DiscoveryInterval so that servers added
+// to the cluster are connected to.
+func (s *Server) solicitSRVRoutes(srvURL *url.URL) {
+	name := fmt.Sprintf("SRV %q", srvURL.Hostname())
+	s.discoverRoutes(srvURL.String(), name, &srvDiscovery{s, srvURL}, func() bool {
+		return s.routeStillValid(srvURL)
+	})
+}
+
+// pickSRVTarget resolves the SRV remote and returns one of its targets.
+// Each attempt picks the next target so that a target that can not be
+// reached is not retried forever.
+func (s *Server) pickSRVTarget(srvURL *url.URL, attempt int) (*url.URL, error) {
+	urls, err := s.resolveSRV(srvURL)
+	if err != nil {
+		return nil, err
+	}
+	return urls[attempt%len(urls)], nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Defaults for the StatsD emitter.
+	defaultStatsDPrefix   = "nats"
+	defaultStatsDInterval = 10 * time.Second
+	// Maximum size of the UDP packets sent to the StatsD server, chosen
+	// to avoid fragmentation on common networks.
+	maxStatsDPacketSize = 1432
+)
+
+// statsdEmitter holds the state kept between two emissions.
+type statsdEmitter struct {
+	conn     net.Conn
+	endpoint string
+	last     stats
+	buf      bytes.Buffer
+	pkts     [][]byte
+}
+
+// startStatsD starts the emitter if a StatsD endpoint is configured. The
+// emitter runs until shutdown and picks up the options on each interval,
+// so that it can be reconfigured or disabled on reload.
+func (s *Server) startStatsD() {
+	opts := s.getOpts()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if opts.StatsD.Endpoint == _EMPTY_ || s.statsd != nil {
+		return
+	}
+	e := &statsdEmitter{}
+	s.statsd = e
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		defer e.close()
+		e.last = s.statsSnapshot()
+		t := time.NewTimer(s.statsdInterval())
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.emitStatsD(e)
+				t.Reset(s.statsdInterval())
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) statsdInterval() time.Duration {
+	if d := s.getOpts().StatsD.Interval; d > 0 {
+		return d
+	}
+	return defaultStatsDInterval
+}
+
+func (s *Server) statsSnapshot() stats {
+	return stats{
+		inMsgs:        atomic.LoadInt64(&s.inMsgs),
+		outMsgs:       atomic.LoadInt64(&s.outMsgs),
+		inBytes:       atomic.LoadInt64(&s.inBytes),
+		outBytes:      atomic.LoadInt64(&s.outBytes),
+		slowConsumers: atomic.LoadInt64(&s.slowConsumers),
+		subsExceeded:  atomic.LoadInt64(&s.subsExceeded),
+	}
+}
+
+// emitStatsD sends the current metrics to the StatsD server. Message and
+// byte totals are sent as counters of what happened since the previous
+// emission, from which the StatsD server derives the rates.
+func (s *Server) emitStatsD(e *statsdEmitter) {
+	opts := s.getOpts().StatsD
+	cur := s.statsSnapshot()
+	last := e.last
+	e.last = cur
+	if opts.Endpoint == _EMPTY_ {
+		e.close()
+		return
+	}
+
+	s.mu.Lock()
+	conns := len(s.clients)
+	routes := len(s.routes)
+	leafs := len(s.leafs)
+	subs := s.numSubscriptions()
+	connected := make(map[string]bool)
+	for _, r := range s.routes {
+		r.mu.Lock()
+		if r.route != nil && r.route.didSolicit && r.route.url != nil {
+			connected[r.route.url.Host] = true
+		}
+		r.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	prefix := opts.Prefix
+	if prefix == _EMPTY_ {
+		prefix = defaultStatsDPrefix
+	}
+	tags := statsdTags(opts.Tags)
+	e.buf.Reset()
+	e.pkts = e.pkts[:0]
+	add := func(name string, value int64, typ string, extra string) {
+		line := fmt.Sprintf("%s.%s:%d|%s", prefix, name, value, typ)
+		if t := joinStatsDTags(tags, extra); t != _EMPTY_ {
+			line += "|#" + t
+		}
+		if e.buf.Len() > 0 && e.buf.Len()+1+len(line) > maxStatsDPacketSize {
+			e.pkts = append(e.pkts, append([]byte(nil), e.buf.Bytes()...))
+			e.buf.Reset()
+		}
+		if e.buf.Len() > 0 {
+			e.buf.WriteByte('\n')
+		}
+		e.buf.WriteString(line)
+	}
+	add("connections", int64(conns), "g", _EMPTY_)
+	add("subscriptions", int64(subs), "g", _EMPTY_)
+	add("leafnodes", int64(leafs), "g", _EMPTY_)
+	add("gateways", int64(s.numOutboundGateways()), "g", _EMPTY_)
+	add("routes", int64(routes), "g", _EMPTY_)
+	add("in_msgs", cur.inMsgs-last.inMsgs, "c", _EMPTY_)
+	add("out_msgs", cur.outMsgs-last.outMsgs, "c", _EMPTY_)
+	add("in_bytes", cur.inBytes-last.inBytes, "c", _EMPTY_)
+	add("out_bytes", cur.outBytes-last.outBytes, "c", _EMPTY_)
+	add("slow_consumers", cur.slowConsumers-last.slowConsumers, "c", _EMPTY_)
+	// The state of each explicitly configured route, 1 if connected.
+	for _, u := range s.getOpts().Routes {
+		var up int64
+		if connected[u.Host] {
+			up = 1
+		}
+		add("route.connected", up, "g", "route:"+u.Host)
+	}
+	if e.buf.Len() > 0 {
+		e.pkts = append(e.pkts, e.buf.Bytes())
+	}
+
+	if e.conn == nil || e.endpoint != opts.Endpoint {
+		e.close()
+		conn, err := net.Dial("udp", opts.Endpoint)
+		if err != nil {
+			s.Warnf("Error connecting to StatsD at %q: %v", opts.Endpoint, err)
+			return
+		}
+		e.conn, e.endpoint = conn, opts.Endpoint
+	}
+	for _, pkt := range e.pkts {
+		if _, err := e.conn.Write(pkt); err != nil {
+			s.Warnf("Error sending metrics to StatsD: %v", err)
+			return
+		}
+	}
+}
+
+func (e *statsdEmitter) close() {
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+}
+
+// statsdTags returns the configured tags in the DogStatsD format, sorted
+// so that the lines are stable between emissions.
+func statsdTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return _EMPTY_
+	}
+	l := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v == _EMPTY_ {
+			l = append(l, k)
+		} else {
+			l = append(l, k+":"+v)
+		}
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+func joinStatsDTags(tags, extra string) string {
+	switch {
+	case tags == _EMPTY_:
+		return extra
+	case extra == _EMPTY_:
+		return tags
+	}
+	return tags + "," + extra
+}
+
+// validateStatsDOptions checks that the StatsD endpoint is a host and port
+// and that the tags can be sent in the DogStatsD format.
+func validateStatsDOptions(o *Options) error {
+	sd := &o.StatsD
+	if sd.Endpoint == _EMPTY_ {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(sd.Endpoint); err != nil {
+		return fmt.Errorf("statsd endpoint must be a host and port, got %q: %v", sd.Endpoint, err)
+	}
+	for k, v := range sd.Tags {
+		if k == _EMPTY_ || strings.ContainsAny(k, ":,|#") || strings.ContainsAny(v, ",|#") {
+			return fmt.Errorf("invalid statsd tag %q: %q", k, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDOptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		statsd {
+			endpoint: "127.0.0.1:8125"
+			prefix: "edge"
+			interval: "1s"
+			tags { env: prod, dc: 1 }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	sd := opts.StatsD
+	if sd.Endpoint != "127.0.0.1:8125" || sd.Prefix != "edge" || sd.Interval != time.Second ||
+		sd.Tags["env"] != "prod" || sd.Tags["dc"] != "1" {
+		t.Fatalf("Unexpected options: %+v", sd)
+	}
+	if tags := statsdTags(sd.Tags); tags != "dc:1,env:prod" {
+		t.Fatalf("Unexpected tags: %q", tags)
+	}
+
+	conf = createConfFile(t, []byte(`statsd: "localhost:8125"`))
+	defer os.Remove(conf)
+	if opts, err = ProcessConfigFile(conf); err != nil || opts.StatsD.Endpoint != "localhost:8125" {
+		t.Fatalf("Unexpected result: %+v, %v", opts.StatsD, err)
+	}
+
+	for _, sd := range []StatsDOpts{
+		{Endpoint: "localhost"},
+		{Endpoint: "localhost:8125", Tags: map[string]string{"a|b": "c"}},
+	} {
+		opts := DefaultOptions()
+		opts.StatsD = sd
+		if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "statsd") {
+			t.Fatalf("Expected error for %+v, got %v", sd, err)
+		}
+	}
+}
+
+func TestStatsDEmitter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer pc.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+			routes: ["nats://127.0.0.1:1"]
+		}
+		statsd {
+			endpoint: "%s"
+			interval: "50ms"
+			tags { env: test }
+		}
+	`, pc.LocalAddr())))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	natsSubSync(t, nc, "foo")
+	for i := 0; i < 10; i++ {
+		natsPub(t, nc, "foo", []byte("hello"))
+	}
+	natsFlush(t, nc)
+
+	expected := map[string]bool{
+		"nats.connections:1|g|#env:test":                       false,
+		"nats.subscriptions:":                                  false,
+		"nats.routes:0|g|#env:test":                            false,
+		"nats.route.connected:0|g|#env:test,route:127.0.0.1:1": false,
+		"nats.in_msgs:10|c|#env:test":                          false,
+		"nats.in_bytes:50|c|#env:test":                         false,
+		"nats.out_msgs:10|c|#env:test":                         false,
+	}
+	// Counters are for the interval so they are summed up.
+	counters := map[string]int{"nats.in_msgs": 0, "nats.in_bytes": 0, "nats.out_msgs": 0}
+	countersOK := func() bool {
+		return counters["nats.in_msgs"] == 10 && counters["nats.in_bytes"] == 50 && counters["nats.out_msgs"] == 10
+	}
+	buf := make([]byte, maxStatsDPacketSize)
+	deadline := time.Now().Add(2 * time.Second)
+	for remaining := len(expected); remaining > 0 || !countersOK(); {
+		pc.SetReadDeadline(deadline)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Missing metrics %v %v: %v", expected, counters, err)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			var name string
+			var v int
+			if _, err := fmt.Sscanf(strings.Replace(line, ":", " ", 1), "%s %d|c", &name, &v); err == nil {
+				if _, ok := counters[name]; ok {
+					counters[name] += v
+				}
+			}
+			for prefix, seen := range expected {
+				if !seen && strings.HasPrefix(line, prefix) {
+					expected[prefix] = true
+					remaining--
+				}
+			}
+		}
+	}
+}
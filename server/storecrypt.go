@@ -0,0 +1,272 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Prefix of the data encrypted by a store cipher, followed by the id
+	// of the key, the nonce and the sealed data.
+	storeSealedMagic = "NATSENC1"
+	storeKeyIDLen    = 4
+
+	// The cipher of the stores, AES-256-GCM. It is the only one
+	// supported, ChaCha20-Poly1305 being rejected like any other value.
+	StoreCipherAES = "aes"
+
+	// Maximum size of the data of a record, so that a corrupted length
+	// can not make the server allocate up to 4GB when reading it back.
+	maxStoreRecordSize = 64 * 1024 * 1024
+)
+
+var (
+	errStoreEncrypted = errors.New("stored data is encrypted but no store_encryption key is configured")
+	errStorePlaintext = errors.New("stored data is not encrypted, set store_encryption allow_plaintext to encrypt it")
+)
+
+// storeKeys are the master keys of the store encryption, the current one
+// first.
+type storeKeys [][]byte
+
+// loadStoreKeys loads the master keys of the store encryption, if enabled.
+func loadStoreKeys(o *Options) (storeKeys, error) {
+	eo := o.StoreEncryption
+	if eo.Key == _EMPTY_ {
+		return nil, nil
+	}
+	var keys storeKeys
+	for _, ref := range append([]string{eo.Key}, eo.PreviousKeys...) {
+		key, err := loadStoreKey(ref)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// loadStoreKey loads a base64 encoded 32 bytes key, either from a key
+// provider reference or given as is.
+func loadStoreKey(ref string) ([]byte, error) {
+	encoded := []byte(ref)
+	if p, u := keyProviderFor(ref); p != nil {
+		var err error
+		if encoded, err = p.Seed(u); err != nil {
+			return nil, fmt.Errorf("error loading store key: %v", err)
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid store key, expected 32 base64 encoded bytes")
+	}
+	return key, nil
+}
+
+// storeCipher encrypts the data of a store with a key derived from the
+// current master key, and decrypts the data encrypted with any of the
+// master keys. The data is bound to the name of the entry, file or log,
+// it is stored as. A nil storeCipher leaves the data as is.
+type storeCipher struct {
+	aeads []cipher.AEAD
+	ids   [][]byte
+	// Accept the data stored before the encryption was enabled.
+	plaintext bool
+}
+
+// storeCipher returns the cipher of the named store, or nil if the store
+// encryption is not enabled.
+func (s *Server) storeCipher(name string) (*storeCipher, error) {
+	if len(s.storeKeys) == 0 {
+		return nil, nil
+	}
+	sc := &storeCipher{plaintext: s.getOpts().StoreEncryption.AllowPlaintext}
+	for _, master := range s.storeKeys {
+		// Each store has its own key.
+		mac := hmac.New(sha256.New, master)
+		mac.Write([]byte("nats-store:" + name))
+		key := mac.Sum(nil)
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256(key)
+		sc.aeads = append(sc.aeads, aead)
+		sc.ids = append(sc.ids, id[:storeKeyIDLen])
+	}
+	return sc, nil
+}
+
+// seal encrypts data with the current key, as the named entry.
+func (sc *storeCipher) seal(name string, data []byte) ([]byte, error) {
+	if sc == nil {
+		return data, nil
+	}
+	aead := sc.aeads[0]
+	out := make([]byte, 0, len(storeSealedMagic)+storeKeyIDLen+aead.NonceSize()+len(data)+aead.Overhead())
+	out = append(append(out, storeSealedMagic...), sc.ids[0]...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte(name)), nil
+}
+
+// open decrypts the data of the named entry. Data that was not encrypted is
+// only returned as is when allowed. stale is true if the data was not
+// encrypted with the current key, and so should be encrypted again.
+func (sc *storeCipher) open(name string, data []byte) (plain []byte, stale bool, err error) {
+	if !bytes.HasPrefix(data, []byte(storeSealedMagic)) {
+		return sc.openPlaintext(data)
+	}
+	if sc == nil {
+		return nil, false, errStoreEncrypted
+	}
+	data = data[len(storeSealedMagic):]
+	if len(data) < storeKeyIDLen {
+		return nil, false, errors.New("invalid encrypted data")
+	}
+	id, data := data[:storeKeyIDLen], data[storeKeyIDLen:]
+	for i, kid := range sc.ids {
+		if !bytes.Equal(id, kid) {
+			continue
+		}
+		aead := sc.aeads[i]
+		if len(data) < aead.NonceSize() {
+			return nil, false, errors.New("invalid encrypted data")
+		}
+		plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to decrypt data: %v", err)
+		}
+		return plain, i > 0, nil
+	}
+	return nil, false, errors.New("data encrypted with an unknown store key")
+}
+
+// Returns data that was not encrypted, if allowed.
+func (sc *storeCipher) openPlaintext(data []byte) ([]byte, bool, error) {
+	if sc == nil {
+		return data, false, nil
+	}
+	if !sc.plaintext {
+		return nil, false, errStorePlaintext
+	}
+	return data, true, nil
+}
+
+// sealLine encrypts a line of the named log of JSON records, so that it
+// does not contain a new line.
+func (sc *storeCipher) sealLine(name string, line []byte) ([]byte, error) {
+	if sc == nil {
+		return line, nil
+	}
+	sealed, err := sc.seal(name, line)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, base64.RawStdEncoding.EncodedLen(len(sealed)))
+	base64.RawStdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+// openLine decrypts a line sealed by sealLine, a JSON record being
+// returned as is if allowed.
+func (sc *storeCipher) openLine(name string, line []byte) ([]byte, bool, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '{' {
+		return sc.openPlaintext(line)
+	}
+	sealed := make([]byte, base64.RawStdEncoding.DecodedLen(len(line)))
+	n, err := base64.RawStdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid encrypted record: %v", err)
+	}
+	return sc.open(name, sealed[:n])
+}
+
+// Returns the size of data once sealed.
+func (sc *storeCipher) sealedSize(n int) int {
+	aead := sc.aeads[0]
+	return len(storeSealedMagic) + storeKeyIDLen + aead.NonceSize() + n + aead.Overhead()
+}
+
+// sealRecord encrypts data as a record of the named stream of records,
+// prefixed by its length.
+func (sc *storeCipher) sealRecord(name string, data []byte) ([]byte, error) {
+	if len(data) > maxStoreRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the maximum of %d bytes", len(data), maxStoreRecordSize)
+	}
+	sealed, err := sc.seal(name, data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(out, uint32(len(sealed)))
+	return append(out, sealed...), nil
+}
+
+// readRecord reads and decrypts the next record written by sealRecord.
+func (sc *storeCipher) readRecord(name string, r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > uint32(sc.sealedSize(maxStoreRecordSize)) {
+		return nil, fmt.Errorf("invalid encrypted record of %d bytes", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	plain, _, err := sc.open(name, sealed)
+	return plain, err
+}
+
+func validateStoreEncryptionOptions(o *Options) error {
+	eo := &o.StoreEncryption
+	if eo.Key == _EMPTY_ {
+		if len(eo.PreviousKeys) > 0 {
+			return fmt.Errorf("store_encryption previous_keys require a key")
+		}
+		if eo.AllowPlaintext {
+			return fmt.Errorf("store_encryption allow_plaintext requires a key")
+		}
+		return nil
+	}
+	switch strings.ToLower(eo.Cipher) {
+	case _EMPTY_, StoreCipherAES:
+	default:
+		return fmt.Errorf("store_encryption cipher %q is not supported, only %q is", eo.Cipher, StoreCipherAES)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func testStoreKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestStoreEncryptionConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		store_encryption {
+			key: %q
+			previous_keys: [%q]
+			cipher: aes
+			allow_plaintext: true
+		}
+	`, testStoreKey(1), testStoreKey(2))))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	eo := opts.StoreEncryption
+	if eo.Key != testStoreKey(1) || len(eo.PreviousKeys) != 1 || eo.PreviousKeys[0] != testStoreKey(2) || eo.Cipher != "aes" || !eo.AllowPlaintext {
+		t.Fatalf("Unexpected options: %+v", eo)
+	}
+	if err := validateOptions(opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keys, err := loadStoreKeys(opts)
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Unexpected keys %v: %v", keys, err)
+	}
+
+	for _, eo := range []StoreEncryptionOpts{
+		{PreviousKeys: []string{testStoreKey(2)}},
+		{Key: testStoreKey(1), Cipher: "des"},
+		{Key: testStoreKey(1), Cipher: "chacha"},
+		{AllowPlaintext: true},
+	} {
+		opts := DefaultOptions()
+		opts.StoreEncryption = eo
+		if err := validateOptions(opts); err == nil {
+			t.Fatalf("Expected an error for %+v", eo)
+		}
+	}
+	opts = DefaultOptions()
+	opts.StoreEncryption.Key = "c2hvcnQ="
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "invalid store key") {
+		t.Fatalf("Expected an invalid key error, got %v", err)
+	}
+}
+
+func TestStoreCipher(t *testing.T) {
+	newCipher := func(keys ...string) *storeCipher {
+		t.Helper()
+		s := &Server{opts: &Options{}}
+		for _, k := range keys {
+			key, err := loadStoreKey(k)
+			if err != nil {
+				t.Fatalf("Error loading key: %v", err)
+			}
+			s.storeKeys = append(s.storeKeys, key)
+		}
+		sc, err := s.storeCipher("test")
+		if err != nil {
+			t.Fatalf("Error creating cipher: %v", err)
+		}
+		return sc
+	}
+	plain := []byte(`{"secret":"value"}`)
+	old := newCipher(testStoreKey(1))
+	sealed, err := old.seal("entry", plain)
+	if err != nil {
+		t.Fatalf("Error sealing: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("Sealed data contains the plain text")
+	}
+	if got, stale, err := old.open("entry", sealed); err != nil || stale || !bytes.Equal(got, plain) {
+		t.Fatalf("Unexpected open: %q %v %v", got, stale, err)
+	}
+	// The data can not be read as another entry.
+	if _, _, err := old.open("other", sealed); err == nil {
+		t.Fatal("Expected an error for data of another entry")
+	}
+	// Data stored with a previous key is stale.
+	rotated := newCipher(testStoreKey(2), testStoreKey(1))
+	if got, stale, err := rotated.open("entry", sealed); err != nil || !stale || !bytes.Equal(got, plain) {
+		t.Fatalf("Unexpected open: %q %v %v", got, stale, err)
+	}
+	if _, _, err := newCipher(testStoreKey(3)).open("entry", sealed); err == nil {
+		t.Fatal("Expected an error for an unknown key")
+	}
+	var none *storeCipher
+	if _, _, err := none.open("entry", sealed); err != errStoreEncrypted {
+		t.Fatalf("Expected %v, got %v", errStoreEncrypted, err)
+	}
+	// Data not encrypted is only accepted when migrating.
+	if _, _, err := rotated.open("entry", plain); err != errStorePlaintext {
+		t.Fatalf("Expected %v, got %v", errStorePlaintext, err)
+	}
+	if _, _, err := rotated.openLine("log", plain); err != errStorePlaintext {
+		t.Fatalf("Expected %v, got %v", errStorePlaintext, err)
+	}
+	rotated.plaintext = true
+	if got, stale, err := rotated.open("entry", plain); err != nil || !stale || !bytes.Equal(got, plain) {
+		t.Fatalf("Unexpected open: %q %v %v", got, stale, err)
+	}
+
+	line, err := rotated.sealLine("log", plain)
+	if err != nil || bytes.ContainsAny(line, "\n{") {
+		t.Fatalf("Unexpected sealed line %q: %v", line, err)
+	}
+	if got, stale, err := rotated.openLine("log", line); err != nil || stale || !bytes.Equal(got, plain) {
+		t.Fatalf("Unexpected open: %q %v %v", got, stale, err)
+	}
+	var buf bytes.Buffer
+	for _, data := range []string{"one", "two"} {
+		rec, err := rotated.sealRecord("records", []byte(data))
+		if err != nil {
+			t.Fatalf("Error sealing record: %v", err)
+		}
+		buf.Write(rec)
+	}
+	for _, expected := range []string{"one", "two"} {
+		if got, err := rotated.readRecord("records", &buf); err != nil || string(got) != expected {
+			t.Fatalf("Unexpected record %q: %v", got, err)
+		}
+	}
+	// A corrupted length is rejected before allocating the record.
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := rotated.readRecord("records", &buf); err == nil || !strings.Contains(err.Error(), "invalid encrypted record") {
+		t.Fatalf("Expected an invalid record error, got %v", err)
+	}
+	if _, err := rotated.sealRecord("records", make([]byte, maxStoreRecordSize+1)); err == nil {
+		t.Fatal("Expected an error sealing a record above the maximum size")
+	}
+}
+
+func runStoreEncryptionServer(t *testing.T, dir, encryption string) (*Server, *nats.Conn) {
+	t.Helper()
+	return runAccountServer(t, fmt.Sprintf(`
+		kv { store_dir: %q }
+		object_store { store_dir: %q }
+		%s
+	`, filepath.Join(dir, "kv"), filepath.Join(dir, "obj"), encryption), `
+		kv: true
+		object_store: true
+	`)
+}
+
+// Checks that none of the stored files contains the text.
+func checkStoreFilesExclude(t *testing.T, dir, text string) {
+	t.Helper()
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", path, err)
+		}
+		if bytes.Contains(b, []byte(text)) {
+			t.Fatalf("File %q contains %q", path, text)
+		}
+		return nil
+	})
+}
+
+func TestStoreEncryptionRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storecrypt")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	object := bytes.Repeat([]byte("object-secret "), 20*1024)
+	check := func(nc *nats.Conn) {
+		t.Helper()
+		if resp := kvRequest(t, nc, "$KV.API.GET.bucket.key", nil); resp.Entry == nil || string(resp.Entry.Value) != "kv-secret" {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		if data, _ := objGet(t, nc, "$OBJ.API.GET.files.obj"); !bytes.Equal(data, object) {
+			t.Fatalf("Unexpected object of %d bytes", len(data))
+		}
+	}
+
+	// Data stored without encryption.
+	s, nc := runStoreEncryptionServer(t, dir, _EMPTY_)
+	kvRequest(t, nc, "$KV.API.CREATE.bucket", nil)
+	kvRequest(t, nc, "$KV.API.PUT.bucket.key", []byte("kv-secret"))
+	objRequest(t, nc, "$OBJ.API.CREATE.files", nil)
+	if resp := objPut(t, nc, "$OBJ.API.PUT.files.obj", object, 100*1024); resp.Error != _EMPTY_ {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// It is encrypted when loaded with a key, if migrating.
+	key1 := fmt.Sprintf("store_encryption { key: %q, allow_plaintext: true }", testStoreKey(1))
+	s, nc = runStoreEncryptionServer(t, dir, key1)
+	check(nc)
+	checkStoreFilesExclude(t, dir, "secret")
+	nc.Close()
+	s.Shutdown()
+
+	// And encrypted again when the key is rotated.
+	rotated := fmt.Sprintf("store_encryption { key: %q, previous_keys: [%q] }", testStoreKey(2), testStoreKey(1))
+	s, nc = runStoreEncryptionServer(t, dir, rotated)
+	check(nc)
+	nc.Close()
+	s.Shutdown()
+
+	key2 := fmt.Sprintf("store_encryption: %q", testStoreKey(2))
+	s, nc = runStoreEncryptionServer(t, dir, key2)
+	defer s.Shutdown()
+	defer nc.Close()
+	check(nc)
+	checkStoreFilesExclude(t, dir, "secret")
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storez reports the usage of the stores of this server, versus their
+// limits. A store without a directory is kept in memory.
+type Storez struct {
+	ID           string              `json:"server_id"`
+	Now          time.Time           `json:"now"`
+	KV           []*KVStoreStats     `json:"kv,omitempty"`
+	ObjectStores []*ObjectStoreStats `json:"object_stores,omitempty"`
+	Streams      []*StreamStoreStats `json:"streams,omitempty"`
+	Delayed      *DelayedStoreStats  `json:"delayed,omitempty"`
+}
+
+// StorezOptions are the options passed to Storez().
+type StorezOptions struct {
+	// Accounts whose stores are reported, all of them if empty.
+	Accounts []string `json:"accounts"`
+}
+
+// KVStoreStats is the usage of the key-value store of an account.
+type KVStoreStats struct {
+	Account    string          `json:"account"`
+	Dir        string          `json:"dir,omitempty"`
+	Bytes      int64           `json:"bytes"`
+	MaxBytes   int64           `json:"max_bytes,omitempty"`
+	MaxBuckets int             `json:"max_buckets,omitempty"`
+	Buckets    []*KVBucketInfo `json:"buckets"`
+}
+
+// ObjectStoreStats is the usage of the object store of an account. The
+// pending bytes are the ones of the uploads in progress.
+type ObjectStoreStats struct {
+	Account    string `json:"account"`
+	Dir        string `json:"dir,omitempty"`
+	Buckets    int    `json:"buckets"`
+	Objects    int    `json:"objects"`
+	Bytes      int64  `json:"bytes"`
+	Pending    int64  `json:"pending_bytes"`
+	Uploads    int    `json:"uploads"`
+	MaxBytes   int64  `json:"max_bytes,omitempty"`
+	MaxBuckets int    `json:"max_buckets,omitempty"`
+}
+
+// StreamStoreStats is the usage of the streams of an account.
+type StreamStoreStats struct {
+	Account string        `json:"account"`
+	Dir     string        `json:"dir,omitempty"`
+	Bytes   int64         `json:"bytes"`
+	Streams []*StreamInfo `json:"streams"`
+}
+
+// DelayedStoreStats is the usage of the store of the delayed messages.
+type DelayedStoreStats struct {
+	Dir         string `json:"dir,omitempty"`
+	Messages    int    `json:"messages"`
+	Bytes       int64  `json:"bytes"`
+	MaxMessages int    `json:"max_messages,omitempty"`
+}
+
+// ServerStorezMsg is the response to the storez requests sent over the
+// system account.
+type ServerStorezMsg struct {
+	Server ServerInfo `json:"server"`
+	Storez *Storez    `json:"storez"`
+}
+
+// Storez returns a Storez structure with the usage of the stores.
+func (s *Server) Storez(opts *StorezOptions) *Storez {
+	var filter map[string]struct{}
+	if opts != nil && len(opts.Accounts) > 0 {
+		filter = make(map[string]struct{}, len(opts.Accounts))
+		for _, name := range opts.Accounts {
+			filter[name] = struct{}{}
+		}
+	}
+	include := func(name string) bool {
+		_, ok := filter[name]
+		return filter == nil || ok
+	}
+
+	s.mu.Lock()
+	sz := &Storez{ID: s.info.ID, Now: time.Now()}
+	kvs := make([]*kvStore, 0, len(s.kv))
+	for name, st := range s.kv {
+		if include(name) {
+			kvs = append(kvs, st)
+		}
+	}
+	objs := make([]*objectStore, 0, len(s.objs))
+	for name, st := range s.objs {
+		if include(name) {
+			objs = append(objs, st)
+		}
+	}
+	streams := make([]*streamStore, 0, len(s.streams))
+	for name, ss := range s.streams {
+		if include(name) {
+			streams = append(streams, ss)
+		}
+	}
+	dd := s.delayed
+	s.mu.Unlock()
+
+	for _, st := range kvs {
+		sz.KV = append(sz.KV, st.stats())
+	}
+	sort.Slice(sz.KV, func(i, j int) bool { return sz.KV[i].Account < sz.KV[j].Account })
+	for _, st := range objs {
+		sz.ObjectStores = append(sz.ObjectStores, st.stats())
+	}
+	sort.Slice(sz.ObjectStores, func(i, j int) bool { return sz.ObjectStores[i].Account < sz.ObjectStores[j].Account })
+	for _, ss := range streams {
+		sz.Streams = append(sz.Streams, ss.stats())
+	}
+	sort.Slice(sz.Streams, func(i, j int) bool { return sz.Streams[i].Account < sz.Streams[j].Account })
+	// The delayed messages are not stored per account.
+	if dd != nil && filter == nil {
+		sz.Delayed = dd.stats()
+	}
+	return sz
+}
+
+// Returns the usage of the key-value store.
+func (kvs *kvStore) stats() *KVStoreStats {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	st := &KVStoreStats{
+		Account:    kvs.account,
+		Dir:        kvs.dir,
+		Bytes:      kvs.bytes,
+		MaxBytes:   kvs.limits.maxBytes,
+		MaxBuckets: kvs.limits.maxBuckets,
+		Buckets:    make([]*KVBucketInfo, 0, len(kvs.buckets)),
+	}
+	for _, b := range kvs.buckets {
+		st.Buckets = append(st.Buckets, b.info())
+	}
+	sort.Slice(st.Buckets, func(i, j int) bool { return st.Buckets[i].Name < st.Buckets[j].Name })
+	return st
+}
+
+// Returns the usage of the object store.
+func (st *objectStore) stats() *ObjectStoreStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ss := &ObjectStoreStats{
+		Account:    st.account,
+		Dir:        st.dir,
+		Buckets:    len(st.buckets),
+		Bytes:      st.bytes,
+		Pending:    st.pending,
+		Uploads:    len(st.uploads),
+		MaxBytes:   st.limits.maxBytes,
+		MaxBuckets: st.limits.maxBuckets,
+	}
+	for _, objects := range st.buckets {
+		ss.Objects += len(objects)
+	}
+	return ss
+}
+
+// Returns the usage of the streams.
+func (ss *streamStore) stats() *StreamStoreStats {
+	st := &StreamStoreStats{Account: ss.account, Dir: ss.dir, Streams: ss.list()}
+	for _, si := range st.Streams {
+		st.Bytes += si.Bytes
+	}
+	return st
+}
+
+// Returns the usage of the store of the delayed messages.
+func (dd *delayedDelivery) stats() *DelayedStoreStats {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	ds := &DelayedStoreStats{Dir: dd.dir, Messages: len(dd.queue), MaxMessages: dd.max}
+	for _, dm := range dd.queue {
+		ds.Bytes += int64(len(dm.Msg))
+	}
+	return ds
+}
+
+// HandleStorez process HTTP requests for the usage of the stores.
+func (s *Server) HandleStorez(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[StorezPath]++
+	s.mu.Unlock()
+
+	opts := &StorezOptions{}
+	if accs := r.URL.Query().Get("accounts"); accs != _EMPTY_ {
+		opts.Accounts = strings.Split(accs, ",")
+	}
+	b, err := json.MarshalIndent(s.Storez(opts), "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /storez request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// storezReq is a request for the usage of the stores of this server, or
+// of all of them. The optional payload is a StorezOptions.
+func (s *Server) storezReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() || reply == _EMPTY_ {
+		return
+	}
+	var opts StorezOptions
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, &opts); err != nil {
+			s.Debugf("Error unmarshalling storez request: %v", err)
+			return
+		}
+	}
+	resp := &ServerStorezMsg{Storez: s.Storez(&opts)}
+	s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, resp)
+}
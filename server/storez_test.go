@@ -0,0 +1,119 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestStorez(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		http: "127.0.0.1:-1"
+		system_account: SYS
+		delayed_delivery { enabled: true, max_messages: 10 }
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				kv { max_buckets: 2, max_bytes: 1KB }
+				object_store { max_bytes: 1MB }
+			}
+			B {
+				users: [{user: b, password: b}]
+				kv: true
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port), nats.UserInfo("a", "a"))
+	defer nc.Close()
+	if resp := kvRequest(t, nc, "$KV.API.CREATE.cfg", nil); resp.Error != _EMPTY_ {
+		t.Fatalf("Error creating bucket: %s", resp.Error)
+	}
+	if resp := kvRequest(t, nc, "$KV.API.PUT.cfg.key", []byte("value")); resp.Error != _EMPTY_ {
+		t.Fatalf("Error putting value: %s", resp.Error)
+	}
+	if resp := objRequest(t, nc, "$OBJ.API.CREATE.files", nil); resp.Error != _EMPTY_ {
+		t.Fatalf("Error creating bucket: %s", resp.Error)
+	}
+	if resp := objPut(t, nc, "$OBJ.API.PUT.files.a", []byte("hello"), 2); resp.Error != _EMPTY_ {
+		t.Fatalf("Error putting object: %s", resp.Error)
+	}
+
+	check := func(sz *Storez) {
+		t.Helper()
+		if len(sz.KV) != 2 || sz.KV[0].Account != "A" || sz.KV[1].Account != "B" {
+			t.Fatalf("Unexpected key-value stores: %+v", sz.KV)
+		}
+		kv := sz.KV[0]
+		if kv.Bytes != 8 || kv.MaxBytes != 1024 || kv.MaxBuckets != 2 ||
+			len(kv.Buckets) != 1 || kv.Buckets[0].Name != "cfg" || kv.Buckets[0].Entries != 1 {
+			t.Fatalf("Unexpected key-value store: %+v", kv)
+		}
+		if len(sz.ObjectStores) != 1 {
+			t.Fatalf("Unexpected object stores: %+v", sz.ObjectStores)
+		}
+		if ost := sz.ObjectStores[0]; ost.Account != "A" || ost.Buckets != 1 || ost.Objects != 1 ||
+			ost.Bytes != 5 || ost.MaxBytes != 1024*1024 {
+			t.Fatalf("Unexpected object store: %+v", ost)
+		}
+		if sz.Delayed == nil || sz.Delayed.Messages != 0 || sz.Delayed.MaxMessages != 10 {
+			t.Fatalf("Unexpected delayed store: %+v", sz.Delayed)
+		}
+	}
+	check(s.Storez(nil))
+
+	sz := &Storez{}
+	body := readBody(t, fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, StorezPath))
+	if err := json.Unmarshal(body, sz); err != nil {
+		t.Fatalf("Error unmarshalling: %v", err)
+	}
+	check(sz)
+	body = readBody(t, fmt.Sprintf("http://127.0.0.1:%d%s?accounts=B", s.MonitorAddr().Port, StorezPath))
+	sz = &Storez{}
+	if err := json.Unmarshal(body, sz); err != nil {
+		t.Fatalf("Error unmarshalling: %v", err)
+	}
+	if len(sz.KV) != 1 || sz.KV[0].Account != "B" || len(sz.ObjectStores) != 0 || sz.Delayed != nil {
+		t.Fatalf("Unexpected stores of account B: %+v", sz)
+	}
+
+	// The same is reported over the system account.
+	snc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port), nats.UserInfo("sys", "sys"))
+	defer snc.Close()
+	for _, subj := range []string{fmt.Sprintf(storezReqSubj, s.ID()), storezPingReqSubj} {
+		msg, err := snc.Request(subj, nil, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		var resp ServerStorezMsg
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatalf("Error unmarshalling: %v", err)
+		}
+		if resp.Server.ID != s.ID() || resp.Storez == nil {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		check(resp.Storez)
+	}
+}
@@ -0,0 +1,988 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Prefix of the subjects of the stream API, followed by the operation
+	// and, for the operations on a stream, its name.
+	streamAPIPrefix = "$STREAM.API."
+	// The subjects with this prefix, the ones of the API and its inboxes,
+	// are never captured.
+	streamPrefix = "$STREAM."
+
+	streamOpList  = "LIST"
+	streamOpInfo  = "INFO"
+	streamOpGet   = "GET"
+	streamOpFetch = "FETCH"
+	// Delivers the messages to a durable consumer, and the responses to
+	// the flow control requests of the deliveries, followed by their id.
+	streamOpConsume = "CONSUME"
+	streamOpFlow    = "FC"
+	// Create and delete the streams and their durable consumers, when the
+	// metadata is replicated.
+	streamOpCreate         = "CREATE"
+	streamOpDelete         = "DELETE"
+	streamOpConsumerCreate = "CONSUMER_CREATE"
+	streamOpConsumerDelete = "CONSUMER_DELETE"
+
+	// Discard policies of the streams, when a retention limit is reached
+	// the oldest messages are discarded, or the new message is dropped.
+	StreamDiscardOld = "old"
+	StreamDiscardNew = "new"
+
+	// Default number of captured messages waiting to be stored.
+	streamDefaultBuffer = 1024
+
+	// Default and maximum number of messages returned by a fetch.
+	streamDefaultBatch = 100
+	streamMaxBatch     = 1000
+
+	// Extension of the log of the messages of a stored stream.
+	streamLogExt = ".log"
+)
+
+var (
+	// Interval of the enforcement of the maximum age of the messages and
+	// of the compaction of the logs.
+	streamCompactInterval = time.Minute
+
+	errStreamNotFound    = errors.New("stream not found")
+	errStreamMsgNotFound = errors.New("message not found")
+)
+
+// StreamConfig configures a stream of an account. The messages published
+// on Subjects, on any server of the cluster, are captured by the stream
+// without ever slowing down their publishers: they are queued for storage
+// in a buffer of Buffer messages and dropped while it is full. Only the
+// Sample ratio of the messages, between 0 and 1, is captured, all of them
+// by default. A stream is bounded by at least one retention limit, and
+// discards its oldest messages or drops the new ones when a limit is
+// reached, per its Discard policy.
+//
+// Instead of capturing messages, a stream can be the Mirror of another
+// stream, with the same sequences. A stream can also add the messages of
+// other streams, its Sources, to the ones it captures.
+type StreamConfig struct {
+	Name       string          `json:"name"`
+	Subjects   []string        `json:"subjects,omitempty"`
+	Mirror     *StreamSource   `json:"mirror,omitempty"`
+	Sources    []*StreamSource `json:"sources,omitempty"`
+	Sample     float64         `json:"sample,omitempty"`
+	Buffer     int             `json:"buffer,omitempty"`
+	MaxMsgs    int64           `json:"max_msgs,omitempty"`
+	MaxBytes   int64           `json:"max_bytes,omitempty"`
+	MaxAge     time.Duration   `json:"max_age,omitempty"`
+	MaxMsgSize int             `json:"max_msg_size,omitempty"`
+	// StreamDiscardOld, the default, or StreamDiscardNew.
+	Discard string `json:"discard,omitempty"`
+}
+
+// StreamSource is a stream replicated by a stream, from anywhere its API
+// is reachable, over the routes, gateways and leafnodes. The API is the
+// one of the account, or the one at APIPrefix, such as a prefix imported
+// from another account. A source can be limited to the messages matching
+// FilterSubject, a mirror can not.
+type StreamSource struct {
+	Name          string `json:"name"`
+	FilterSubject string `json:"filter_subject,omitempty"`
+	APIPrefix     string `json:"api_prefix,omitempty"`
+}
+
+// StreamMsg is a message stored by a stream. The messages of the sources
+// of a stream are stored with the name of their Source and their sequence
+// in it.
+type StreamMsg struct {
+	Sequence  uint64    `json:"seq"`
+	Subject   string    `json:"subject"`
+	Reply     string    `json:"reply,omitempty"`
+	Header    []byte    `json:"hdr,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source,omitempty"`
+	SourceSeq uint64    `json:"source_seq,omitempty"`
+}
+
+// StreamInfo is the state of a stream. The messages are counted since the
+// stream was started: the ones Received on its subjects, the ones not
+// captured by the sampling, Dropped while the buffer was full, Rejected
+// by the limits, and the stored ones Discarded or Expired since.
+type StreamInfo struct {
+	Config     StreamConfig `json:"config"`
+	Messages   int          `json:"messages"`
+	Bytes      int64        `json:"bytes"`
+	FirstSeq   uint64       `json:"first_seq"`
+	LastSeq    uint64       `json:"last_seq"`
+	Received   uint64       `json:"received"`
+	NotSampled uint64       `json:"not_sampled"`
+	Dropped    uint64       `json:"dropped"`
+	Rejected   uint64       `json:"rejected"`
+	Discarded  uint64       `json:"discarded"`
+	Expired    uint64       `json:"expired"`
+	Consumers  int          `json:"consumers"`
+}
+
+// StreamGetRequest is the payload of a GET request, the sequence of the
+// message.
+type StreamGetRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// StreamFetchRequest is the optional payload of a FETCH request. Up to
+// Batch messages are returned in order, from StartSeq or the first one
+// kept, matching FilterSubject if set.
+type StreamFetchRequest struct {
+	StartSeq      uint64 `json:"start_seq,omitempty"`
+	Batch         int    `json:"batch,omitempty"`
+	FilterSubject string `json:"filter_subject,omitempty"`
+}
+
+// StreamResponse is the response to the stream API requests. The response
+// to a fetch has the sequence from which to fetch the next messages.
+type StreamResponse struct {
+	Stream   *StreamInfo         `json:"stream,omitempty"`
+	Streams  []*StreamInfo       `json:"streams,omitempty"`
+	Msg      *StreamMsg          `json:"msg,omitempty"`
+	Msgs     []*StreamMsg        `json:"msgs,omitempty"`
+	NextSeq  uint64              `json:"next_seq,omitempty"`
+	Consumer *StreamConsumerInfo `json:"consumer,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// stream holds the messages of a stream, oldest first, and captures the
+// messages published on its subjects while started.
+type stream struct {
+	// Counters of the capture, updated without the lock.
+	received   uint64
+	notSampled uint64
+	dropped    uint64
+
+	mu        sync.Mutex
+	cfg       StreamConfig
+	msgs      []*StreamMsg
+	bytes     int64
+	last      uint64
+	rejected  uint64
+	discarded uint64
+	expired   uint64
+
+	// The last sequence of each source copied, or skipped by its filter.
+	sourced map[string]uint64
+
+	// The durable consumers, and the log of their acks if the stream is
+	// stored.
+	consumers map[string]*streamConsumer
+	ackFile   string
+	ackLog    *os.File
+	ackLogged int
+
+	// The log, if the stream is stored, and its number of records
+	// including the ones no longer kept.
+	file   string
+	log    *os.File
+	logged int
+	closed bool
+	cipher *storeCipher
+
+	// Set while started.
+	in   chan *StreamMsg
+	subs []*streamSub
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// streamSub is an internal subscription of a stream.
+type streamSub struct {
+	client *client
+	sub    *subscription
+}
+
+// streamStore is the set of the streams of an account. The streams are
+// local to this server and are stored in dir, if set. Since their API is
+// reachable from the other servers, the name of a stream should be unique
+// in its account.
+type streamStore struct {
+	mu      sync.Mutex
+	account string
+	dir     string
+	cipher  *storeCipher
+	streams map[string]*stream
+	api     *streamSub
+	acks    *streamSub
+	// The client of the API subscription, which delivers the messages to
+	// the consumers.
+	deliveries
+}
+
+// Size accounted for a message.
+func streamMsgSize(sm *StreamMsg) int64 {
+	return int64(len(sm.Subject) + len(sm.Reply) + len(sm.Header) + len(sm.Data))
+}
+
+// Returns whether the subjects, which can contain wildcards, match at
+// least one common subject.
+func subjectsCollide(a, b string) bool {
+	ta, tb := strings.Split(a, tsep), strings.Split(b, tsep)
+	for i := 0; i < len(ta) && i < len(tb); i++ {
+		if ta[i] == fwcs || tb[i] == fwcs {
+			return true
+		}
+		if ta[i] != tb[i] && ta[i] != pwcs && tb[i] != pwcs {
+			return false
+		}
+	}
+	return len(ta) == len(tb)
+}
+
+// validateStreamConfig checks the configuration of a stream and sets the
+// defaults of the options not set.
+func validateStreamConfig(cfg *StreamConfig) error {
+	if !kvValidBucket.MatchString(cfg.Name) {
+		return fmt.Errorf("invalid stream name %q", cfg.Name)
+	}
+	if len(cfg.Subjects) == 0 && cfg.Mirror == nil && len(cfg.Sources) == 0 {
+		return fmt.Errorf("stream %q has no subjects", cfg.Name)
+	}
+	if err := validateStreamSources(cfg); err != nil {
+		return err
+	}
+	for i, subj := range cfg.Subjects {
+		if !IsValidSubject(subj) || strings.HasPrefix(subj, streamPrefix) {
+			return fmt.Errorf("invalid subject %q of stream %q", subj, cfg.Name)
+		}
+		// A message is captured once.
+		for _, other := range cfg.Subjects[:i] {
+			if subjectsCollide(subj, other) {
+				return fmt.Errorf("subjects %q and %q of stream %q overlap", other, subj, cfg.Name)
+			}
+		}
+	}
+	if cfg.Sample == 0 {
+		cfg.Sample = 1
+	}
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		return fmt.Errorf("sample of stream %q must be between 0 and 1", cfg.Name)
+	}
+	if cfg.Buffer == 0 {
+		cfg.Buffer = streamDefaultBuffer
+	}
+	if cfg.Buffer < 0 || cfg.MaxMsgs < 0 || cfg.MaxBytes < 0 || cfg.MaxAge < 0 || cfg.MaxMsgSize < 0 {
+		return fmt.Errorf("limits of stream %q can not be negative", cfg.Name)
+	}
+	if cfg.MaxMsgs == 0 && cfg.MaxBytes == 0 && cfg.MaxAge == 0 {
+		return fmt.Errorf("stream %q requires a max_msgs, max_bytes or max_age limit", cfg.Name)
+	}
+	switch cfg.Discard {
+	case _EMPTY_:
+		cfg.Discard = StreamDiscardOld
+	case StreamDiscardOld, StreamDiscardNew:
+	default:
+		return fmt.Errorf("invalid discard policy %q of stream %q", cfg.Discard, cfg.Name)
+	}
+	return nil
+}
+
+// configureStreams starts the streams of the accounts configured with
+// some, restarts the ones whose configuration changed and stops the ones
+// no longer configured. The messages of a stopped stream are kept.
+func (s *Server) configureStreams() {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	s.mu.Lock()
+	if s.streams == nil {
+		s.streams = make(map[string]*streamStore)
+	}
+	stores := make(map[string]*streamStore, len(s.streams))
+	for name, ss := range s.streams {
+		stores[name] = ss
+	}
+	s.mu.Unlock()
+
+	s.accounts.Range(func(k, v interface{}) bool {
+		acc := v.(*Account)
+		s.configureAccountStreams(acc, stores[acc.Name])
+		delete(stores, acc.Name)
+		return true
+	})
+	// The accounts that were removed.
+	for _, ss := range stores {
+		s.stopStreams(nil, ss)
+	}
+}
+
+// configureAccountStreams starts, updates or stops the streams of the
+// account, whose current streams are ss if started. The streams and the
+// consumers defined through the API are added to the ones configured.
+// Lock streamsMu should be held.
+func (s *Server) configureAccountStreams(acc *Account, ss *streamStore) {
+	cfgs, consumers := s.streamConfigs(acc)
+	switch {
+	case cfgs == nil && ss != nil:
+		s.stopStreams(acc, ss)
+		return
+	case cfgs != nil && ss != nil:
+		s.updateStreams(acc, ss, cfgs)
+	case cfgs != nil:
+		if !s.EventsEnabled() {
+			s.Warnf("Streams of account %q require a system account", acc.Name)
+			return
+		}
+		if err := s.startStreams(acc, cfgs); err != nil {
+			s.Errorf("Error starting streams of account %q: %v", acc.Name, err)
+			return
+		}
+		s.mu.Lock()
+		ss = s.streams[acc.Name]
+		s.mu.Unlock()
+	default:
+		return
+	}
+	for stream, scs := range consumers {
+		for _, cfg := range scs {
+			s.addStreamConsumer(acc, ss, stream, cfg)
+		}
+	}
+}
+
+// startStreams starts the streams of the account and subscribes to its
+// API.
+func (s *Server) startStreams(acc *Account, cfgs map[string]*StreamConfig) error {
+	ss := &streamStore{account: acc.Name, streams: make(map[string]*stream)}
+	ss.flowPrefix = streamAPIPrefix + streamOpFlow + tsep
+	if dir := s.getOpts().Streams.StoreDir; dir != _EMPTY_ {
+		ss.dir = filepath.Join(dir, acc.Name)
+		if err := os.MkdirAll(ss.dir, 0750); err != nil {
+			return err
+		}
+		var err error
+		if ss.cipher, err = s.storeCipher("streams/" + acc.Name); err != nil {
+			return err
+		}
+	}
+	// The API is reachable from the other servers, the streams can be read
+	// from anywhere in the account.
+	c, sub, err := s.accountSubscribe(acc, streamAPIPrefix+">", s.streamRequest(ss))
+	if err != nil {
+		return err
+	}
+	ss.api = &streamSub{c, sub}
+	ss.client = c
+	if c, sub, err = s.accountSubscribe(acc, streamAckPrefix+">", s.streamAckRequest(ss)); err != nil {
+		s.accountUnsubscribeInternal(acc, ss.api.client, ss.api.sub)
+		return err
+	}
+	ss.acks = &streamSub{c, sub}
+	s.mu.Lock()
+	s.streams[acc.Name] = ss
+	s.mu.Unlock()
+
+	s.updateStreams(acc, ss, cfgs)
+	s.Noticef("Streams of account %q started", acc.Name)
+	return nil
+}
+
+// updateStreams starts, restarts or stops the streams of the account to
+// match their configuration.
+func (s *Server) updateStreams(acc *Account, ss *streamStore, cfgs map[string]*StreamConfig) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	changed := make(map[string]*stream)
+	for name, st := range ss.streams {
+		st.mu.Lock()
+		cfg := st.cfg
+		st.mu.Unlock()
+		if ncfg := cfgs[name]; ncfg == nil || !reflect.DeepEqual(cfg, *ncfg) {
+			s.stopStream(acc, st)
+			delete(ss.streams, name)
+			changed[name] = st
+		}
+	}
+	for name, cfg := range cfgs {
+		if ss.streams[name] != nil {
+			continue
+		}
+		// A changed stream keeps its messages.
+		st, err := s.startStream(acc, ss, *cfg, changed[name])
+		if err != nil {
+			s.Errorf("Error starting stream %q of account %q: %v", name, acc.Name, err)
+			continue
+		}
+		ss.streams[name] = st
+	}
+}
+
+// stopStreams stops the streams of the account and unsubscribes from its
+// API.
+func (s *Server) stopStreams(acc *Account, ss *streamStore) {
+	ss.mu.Lock()
+	for name, st := range ss.streams {
+		s.stopStream(acc, st)
+		delete(ss.streams, name)
+	}
+	api, acks := ss.api, ss.acks
+	ss.api, ss.acks = nil, nil
+	ss.mu.Unlock()
+
+	s.mu.Lock()
+	delete(s.streams, ss.account)
+	s.mu.Unlock()
+	if api != nil {
+		s.accountUnsubscribeInternal(acc, api.client, api.sub)
+	}
+	if acks != nil {
+		s.accountUnsubscribeInternal(acc, acks.client, acks.sub)
+	}
+	s.Noticef("Streams of account %q stopped", ss.account)
+}
+
+// startStream loads the stored messages of the stream, or takes the ones
+// of its stopped previous version, subscribes to its subjects and starts
+// storing the captured messages.
+func (s *Server) startStream(acc *Account, ss *streamStore, cfg StreamConfig, prev *stream) (*stream, error) {
+	st := &stream{
+		cfg:       cfg,
+		cipher:    ss.cipher,
+		sourced:   make(map[string]uint64),
+		consumers: make(map[string]*streamConsumer),
+		in:        make(chan *StreamMsg, cfg.Buffer),
+		quit:      make(chan struct{}),
+	}
+	if ss.dir != _EMPTY_ {
+		st.file = filepath.Join(ss.dir, cfg.Name+streamLogExt)
+		st.ackFile = filepath.Join(ss.dir, cfg.Name+streamAckLogExt)
+	}
+	if prev != nil {
+		prev.mu.Lock()
+		st.msgs, st.bytes, st.last, st.logged = prev.msgs, prev.bytes, prev.last, prev.logged
+		st.sourced, st.consumers, st.ackLogged = prev.sourced, prev.consumers, prev.ackLogged
+		prev.mu.Unlock()
+		st.mu.Lock()
+		st.trim(time.Now())
+		st.mu.Unlock()
+	} else if st.file != _EMPTY_ {
+		if err := st.load(); err != nil {
+			return nil, err
+		}
+		if err := st.loadAcks(); err != nil {
+			return nil, err
+		}
+	}
+	st.wg.Add(1)
+	s.startGoRoutine(func() { s.runStream(st) })
+	s.startStreamSources(acc, st)
+
+	capture := s.streamCapture(st)
+	for _, subj := range cfg.Subjects {
+		c, sub, err := s.accountSubscribe(acc, subj, capture)
+		if err != nil {
+			s.stopStream(acc, st)
+			return nil, err
+		}
+		// The headers are captured with the messages.
+		c.mu.Lock()
+		c.headers = true
+		c.mu.Unlock()
+		st.subs = append(st.subs, &streamSub{c, sub})
+	}
+	st.mu.Lock()
+	n := len(st.msgs)
+	st.mu.Unlock()
+	s.Noticef("Stream %q of account %q started with %d message(s)", cfg.Name, acc.Name, n)
+	return st, nil
+}
+
+// stopStream unsubscribes from the subjects of the stream and waits for
+// the messages to no longer be stored, the ones still in the buffer are
+// dropped.
+func (s *Server) stopStream(acc *Account, st *stream) {
+	for _, ssub := range st.subs {
+		s.accountUnsubscribeInternal(acc, ssub.client, ssub.sub)
+	}
+	st.subs = nil
+	close(st.quit)
+	st.wg.Wait()
+	st.closeLog()
+}
+
+// streamCapture returns the handler of the messages published on the
+// subjects of the stream. It is invoked by the publishers, and so never
+// waits: the messages are dropped if the buffer is full.
+func (s *Server) streamCapture(st *stream) msgHandler {
+	rate := st.cfg.Sample
+	return func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		if strings.HasPrefix(subject, streamPrefix) {
+			return
+		}
+		// The sampled messages are evenly spread.
+		n := atomic.AddUint64(&st.received, 1)
+		if rate < 1 && uint64(float64(n)*rate) == uint64(float64(n-1)*rate) {
+			atomic.AddUint64(&st.notSampled, 1)
+			return
+		}
+		sm := &StreamMsg{Subject: subject, Reply: reply, Time: time.Now().UTC()}
+		if c != nil && c.pa.hdr > 0 && c.pa.hdr <= len(msg) {
+			sm.Header = append([]byte(nil), msg[:c.pa.hdr]...)
+			msg = msg[c.pa.hdr:]
+		}
+		sm.Data = append([]byte(nil), msg...)
+		select {
+		case st.in <- sm:
+		default:
+			atomic.AddUint64(&st.dropped, 1)
+		}
+	}
+}
+
+// runStream stores the captured messages, and periodically expires the
+// old ones and compacts the log, until the stream is stopped.
+func (s *Server) runStream(st *stream) {
+	defer s.grWG.Done()
+	defer st.wg.Done()
+	t := time.NewTicker(streamCompactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case sm := <-st.in:
+			if err := st.store(sm); err != nil {
+				s.Warnf("Error storing message of stream %q: %v", st.cfg.Name, err)
+			}
+		case <-t.C:
+			if err := st.compact(time.Now(), false); err != nil {
+				s.Warnf("Error compacting stream %q: %v", st.cfg.Name, err)
+			}
+			if err := st.compactAcks(false); err != nil {
+				s.Warnf("Error compacting the acks of stream %q: %v", st.cfg.Name, err)
+			}
+		case <-st.quit:
+			return
+		case <-s.quitCh:
+			st.closeLog()
+			return
+		}
+	}
+}
+
+// store adds the message to the stream, within its retention limits.
+func (st *stream) store(sm *StreamMsg) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	size := streamMsgSize(sm)
+	if st.rejects(size) {
+		st.rejected++
+		return nil
+	}
+	sm.Sequence = st.last + 1
+	if st.file != _EMPTY_ {
+		if err := st.appendLog(sm); err != nil {
+			return err
+		}
+	}
+	st.last = sm.Sequence
+	st.msgs = append(st.msgs, sm)
+	st.bytes += size
+	st.trim(sm.Time)
+	return nil
+}
+
+// Returns whether a new message of that size is dropped by the limits,
+// lock should be held.
+func (st *stream) rejects(size int64) bool {
+	cfg := &st.cfg
+	if (cfg.MaxMsgSize > 0 && size > int64(cfg.MaxMsgSize)) || (cfg.MaxBytes > 0 && size > cfg.MaxBytes) {
+		return true
+	}
+	if cfg.Discard != StreamDiscardNew {
+		return false
+	}
+	return (cfg.MaxMsgs > 0 && int64(len(st.msgs)) >= cfg.MaxMsgs) ||
+		(cfg.MaxBytes > 0 && st.bytes+size > cfg.MaxBytes)
+}
+
+// trim removes the oldest messages over the limits of the stream, and the
+// ones older than its maximum age, lock should be held.
+func (st *stream) trim(now time.Time) {
+	cfg := &st.cfg
+	n := 0
+	for bytes := st.bytes; n < len(st.msgs) && ((cfg.MaxMsgs > 0 && int64(len(st.msgs)-n) > cfg.MaxMsgs) ||
+		(cfg.MaxBytes > 0 && bytes > cfg.MaxBytes)); n++ {
+		bytes -= streamMsgSize(st.msgs[n])
+		st.discarded++
+	}
+	if cfg.MaxAge > 0 {
+		cutoff := now.Add(-cfg.MaxAge)
+		for ; n < len(st.msgs) && st.msgs[n].Time.Before(cutoff); n++ {
+			st.expired++
+		}
+	}
+	for i := 0; i < n; i++ {
+		st.bytes -= streamMsgSize(st.msgs[i])
+		st.msgs[i] = nil
+	}
+	st.msgs = st.msgs[n:]
+}
+
+// Returns the records of the last sequence of the stream and of its
+// sources, lock should be held.
+func (st *stream) markers() []*StreamMsg {
+	records := []*StreamMsg{{Sequence: st.last}}
+	for src, seq := range st.sourced {
+		records = append(records, &StreamMsg{Sequence: st.last, Source: src, SourceSeq: seq})
+	}
+	return records
+}
+
+// Returns the index of the first message kept with a sequence at least
+// seq, lock should be held.
+func (st *stream) index(seq uint64) int {
+	return sort.Search(len(st.msgs), func(i int) bool { return st.msgs[i].Sequence >= seq })
+}
+
+// get returns the message with the sequence.
+func (st *stream) get(seq uint64) (*StreamMsg, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if i := st.index(seq); i < len(st.msgs) && st.msgs[i].Sequence == seq {
+		return st.msgs[i], nil
+	}
+	return nil, errStreamMsgNotFound
+}
+
+// fetch returns the messages requested, up to maxBytes of data but at
+// least one, and the sequence from which to fetch the next ones.
+func (st *stream) fetch(req *StreamFetchRequest, maxBytes int64) ([]*StreamMsg, uint64) {
+	batch := req.Batch
+	if batch <= 0 {
+		batch = streamDefaultBatch
+	} else if batch > streamMaxBatch {
+		batch = streamMaxBatch
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var msgs []*StreamMsg
+	var size int64
+	// Past the messages kept, the next sequence is the one of the next
+	// message stored.
+	next := st.last + 1
+	if req.StartSeq > next {
+		next = req.StartSeq
+	}
+	for i := st.index(req.StartSeq); i < len(st.msgs); i++ {
+		sm := st.msgs[i]
+		if len(msgs) == batch {
+			next = sm.Sequence
+			break
+		}
+		if req.FilterSubject != _EMPTY_ && !subjectIsSubsetMatch(sm.Subject, req.FilterSubject) {
+			continue
+		}
+		if size += streamMsgSize(sm); len(msgs) > 0 && size > maxBytes {
+			next = sm.Sequence
+			break
+		}
+		msgs = append(msgs, sm)
+	}
+	return msgs, next
+}
+
+// info returns the state of the stream.
+func (st *stream) info() *StreamInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	si := &StreamInfo{
+		Config:     st.cfg,
+		Messages:   len(st.msgs),
+		Bytes:      st.bytes,
+		LastSeq:    st.last,
+		Received:   atomic.LoadUint64(&st.received),
+		NotSampled: atomic.LoadUint64(&st.notSampled),
+		Dropped:    atomic.LoadUint64(&st.dropped),
+		Rejected:   st.rejected,
+		Discarded:  st.discarded,
+		Expired:    st.expired,
+		Consumers:  len(st.consumers),
+	}
+	if len(st.msgs) > 0 {
+		si.FirstSeq = st.msgs[0].Sequence
+	}
+	return si
+}
+
+// Returns the stream, lock should be held.
+func (ss *streamStore) stream(name string) (*stream, error) {
+	st := ss.streams[name]
+	if st == nil {
+		return nil, errStreamNotFound
+	}
+	return st, nil
+}
+
+// list returns the state of the streams, sorted by name.
+func (ss *streamStore) list() []*StreamInfo {
+	ss.mu.Lock()
+	streams := make([]*stream, 0, len(ss.streams))
+	for _, st := range ss.streams {
+		streams = append(streams, st)
+	}
+	ss.mu.Unlock()
+	infos := make([]*StreamInfo, 0, len(streams))
+	for _, st := range streams {
+		infos = append(infos, st.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Config.Name < infos[j].Config.Name })
+	return infos
+}
+
+// streamRequest returns the handler of the API requests of the streams.
+func (s *Server) streamRequest(ss *streamStore) msgHandler {
+	return func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		if c != nil && c.pa.hdr > 0 && c.pa.hdr <= len(msg) {
+			msg = msg[c.pa.hdr:]
+		}
+		tokens := strings.SplitN(strings.TrimPrefix(subject, streamAPIPrefix), tsep, 2)
+		op, name := tokens[0], _EMPTY_
+		if len(tokens) > 1 {
+			name = tokens[1]
+		}
+		acc, err := s.LookupAccount(ss.account)
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case streamOpFlow:
+			ss.resumeFlow(name)
+			return
+		case streamOpCreate, streamOpDelete, streamOpConsumerCreate, streamOpConsumerDelete:
+			s.streamDefinitionRequest(acc, op, name, reply, msg)
+			return
+		}
+
+		resp := &StreamResponse{}
+		var st *stream
+		if op != streamOpList {
+			ss.mu.Lock()
+			st, err = ss.stream(name)
+			ss.mu.Unlock()
+		}
+		if err == nil {
+			switch op {
+			case streamOpList:
+				resp.Streams = ss.list()
+			case streamOpInfo:
+				resp.Stream = st.info()
+			case streamOpGet:
+				var req StreamGetRequest
+				if err = json.Unmarshal(msg, &req); err == nil {
+					resp.Msg, err = st.get(req.Seq)
+				}
+			case streamOpFetch:
+				var req StreamFetchRequest
+				if len(msg) > 0 {
+					err = json.Unmarshal(msg, &req)
+				}
+				if err == nil {
+					// The messages are base64 encoded in the response.
+					resp.Msgs, resp.NextSeq = st.fetch(&req, int64(s.getOpts().MaxPayload)/2)
+					resp.Stream = st.info()
+				}
+			case streamOpConsume:
+				var req StreamConsumeRequest
+				var msgs []*StreamMsg
+				if err = json.Unmarshal(msg, &req); err == nil {
+					resp.Consumer, msgs, err = st.consume(&req)
+				}
+				if err == nil && reply != _EMPTY_ {
+					// The messages are delivered from a go routine, with
+					// flow control if requested.
+					s.startGoRoutine(func() {
+						defer s.grWG.Done()
+						ss.deliverConsumer(acc, reply, resp.Consumer, msgs, &req)
+					})
+					return
+				}
+			default:
+				err = fmt.Errorf("unknown operation %q", op)
+			}
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if reply != _EMPTY_ {
+			s.sendInternalAccountMsg(acc, reply, resp)
+		}
+	}
+}
+
+// Appends the message to the log and syncs it, lock should be held.
+func (st *stream) appendLog(sm *StreamMsg) error {
+	if st.closed {
+		return errors.New("stream stopped")
+	}
+	b, _ := json.Marshal(sm)
+	b, err := st.cipher.sealLine(filepath.Base(st.file), b)
+	if err != nil {
+		return err
+	}
+	if err := appendLogSync(&st.log, st.file, append(b, '\n')); err != nil {
+		return err
+	}
+	st.logged++
+	return nil
+}
+
+// appendLogSync appends a record to the log file, opening it if needed, and
+// syncs it so that the record survives a crash. The directory is synced
+// too when the file is created.
+func appendLogSync(log **os.File, file string, record []byte) error {
+	if *log == nil {
+		_, serr := os.Stat(file)
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		if os.IsNotExist(serr) {
+			if err := syncDir(filepath.Dir(file)); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		*log = f
+	}
+	if _, err := (*log).Write(record); err != nil {
+		return err
+	}
+	return (*log).Sync()
+}
+
+// closeLog closes the log, if opened.
+func (st *stream) closeLog() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.log != nil {
+		st.log.Close()
+		st.log = nil
+	}
+	if st.ackLog != nil {
+		st.ackLog.Close()
+		st.ackLog = nil
+	}
+	st.closed = true
+}
+
+// load reads the log of the stream and applies its limits. A record
+// without a subject only holds the last sequence of the stream, so that it
+// is not reused once all the messages are removed, and possibly the last
+// sequence of a source.
+func (st *stream) load() error {
+	f, err := os.Open(st.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rewrite bool
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// The last record was torn by a crash, rewrite the log without.
+			rewrite = true
+			break
+		}
+		if len(line) > 1 {
+			line, stale, oerr := st.cipher.openLine(filepath.Base(st.file), line)
+			if oerr != nil {
+				return oerr
+			}
+			sm := &StreamMsg{}
+			if jerr := json.Unmarshal(line, sm); jerr != nil {
+				return fmt.Errorf("invalid log of stream %q: %v", st.cfg.Name, jerr)
+			}
+			if sm.Sequence > st.last {
+				st.last = sm.Sequence
+			}
+			if sm.Source != _EMPTY_ && sm.SourceSeq > st.sourced[sm.Source] {
+				st.sourced[sm.Source] = sm.SourceSeq
+			}
+			if sm.Subject != _EMPTY_ {
+				st.msgs = append(st.msgs, sm)
+				st.bytes += streamMsgSize(sm)
+			}
+			rewrite = rewrite || stale
+			st.logged++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return st.compact(time.Now(), rewrite)
+}
+
+// compact expires the old messages and rewrites the log with the ones
+// kept, once at least half of its records are no longer kept, or if force
+// is set.
+func (st *stream) compact(now time.Time, force bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.trim(now)
+	// The log starts with the records of the last sequences.
+	records := st.markers()
+	stale := st.logged - len(st.msgs)
+	if st.file == _EMPTY_ || (!force && (stale <= len(records) || stale < len(st.msgs))) {
+		return nil
+	}
+	var buf []byte
+	records = append(records, st.msgs...)
+	for _, sm := range records {
+		data, _ := json.Marshal(sm)
+		data, err := st.cipher.sealLine(filepath.Base(st.file), data)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	tmp := st.file + ".tmp"
+	if err := writeFileSync(tmp, buf, 0640); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if st.log != nil {
+		st.log.Close()
+		st.log = nil
+	}
+	if err := renameSync(tmp, st.file); err != nil {
+		return err
+	}
+	st.logged = len(records)
+	return nil
+}
@@ -0,0 +1,392 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestStreamConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		streams { store_dir: "/tmp/streams" }
+		accounts {
+			A {
+				streams {
+					CAPTURE {
+						subjects: ["orders.>", "audit"]
+						sample: 0.25
+						buffer: 64
+						max_msgs: 1000
+						max_bytes: 1MB
+						max_age: "1h"
+						max_msg_size: 512
+						discard: new
+					}
+					ALL { subjects: "events.*", max_msgs: 10 }
+				}
+			}
+			B {}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Streams.StoreDir != "/tmp/streams" {
+		t.Fatalf("Unexpected options: %+v", opts.Streams)
+	}
+	for _, acc := range opts.Accounts {
+		switch acc.Name {
+		case "A":
+			expected := map[string]*StreamConfig{
+				"CAPTURE": {"CAPTURE", []string{"orders.>", "audit"}, nil, nil, 0.25, 64, 1000, 1024 * 1024, time.Hour, 512, StreamDiscardNew},
+				"ALL":     {"ALL", []string{"events.*"}, nil, nil, 1, streamDefaultBuffer, 10, 0, 0, 0, StreamDiscardOld},
+			}
+			if !reflect.DeepEqual(acc.streams, expected) {
+				t.Fatalf("Unexpected streams: %+v", acc.streams)
+			}
+		case "B":
+			if acc.streams != nil {
+				t.Fatalf("Unexpected streams: %+v", acc.streams)
+			}
+		}
+	}
+
+	for _, test := range []struct{ cfg, err string }{
+		{`S { max_msgs: 1 }`, "has no subjects"},
+		{`S { subjects: "a", max_msgs: 1, sample: 2 }`, "must be between 0 and 1"},
+		{`S { subjects: "a" }`, "requires a max_msgs, max_bytes or max_age limit"},
+		{`S { subjects: ["a.*", "*.b"], max_msgs: 1 }`, "overlap"},
+		{`S { subjects: "$STREAM.API.>", max_msgs: 1 }`, "invalid subject"},
+		{`S { subjects: "a", max_msgs: 1, discard: "all" }`, "invalid discard policy"},
+		{`S { subjects: "a", max_msgs: -1 }`, "can not be negative"},
+		{`"S.1" { subjects: "a", max_msgs: 1 }`, "invalid stream name"},
+	} {
+		conf := createConfFile(t, []byte(fmt.Sprintf(`accounts { A { streams { %s } } }`, test.cfg)))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error %q for %q, got %v", test.err, test.cfg, err)
+		}
+	}
+}
+
+func TestStreamSubjectsCollide(t *testing.T) {
+	for _, test := range []struct {
+		a, b    string
+		collide bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "*.b", true},
+		{"a.>", "a.b.c", true},
+		{"a.*", "a.b.c", false},
+		{">", "a", true},
+		{"a.b", "a", false},
+	} {
+		if subjectsCollide(test.a, test.b) != test.collide || subjectsCollide(test.b, test.a) != test.collide {
+			t.Fatalf("Expected %q and %q to collide: %v", test.a, test.b, test.collide)
+		}
+	}
+}
+
+func runStreamServer(t *testing.T, dir, streams string) (*Server, *nats.Conn) {
+	t.Helper()
+	return runAccountServer(t, fmt.Sprintf(`streams { store_dir: %q }`, dir),
+		fmt.Sprintf(`streams { %s }`, streams))
+}
+
+func streamRequest(t *testing.T, nc *nats.Conn, subject string, data []byte) *StreamResponse {
+	t.Helper()
+	var resp StreamResponse
+	apiRequest(t, nc, subject, data, &resp)
+	return &resp
+}
+
+// Waits for the stream to have the number of messages stored.
+func checkStreamMsgs(t *testing.T, nc *nats.Conn, stream string, msgs int) *StreamInfo {
+	t.Helper()
+	var si *StreamInfo
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		si = streamRequest(t, nc, streamAPIPrefix+streamOpInfo+tsep+stream, nil).Stream
+		if si == nil || si.Messages != msgs {
+			return fmt.Errorf("Expected %d messages, got %+v", msgs, si)
+		}
+		return nil
+	})
+	return si
+}
+
+func TestStreamCapture(t *testing.T) {
+	s, nc := runStreamServer(t, _EMPTY_, `
+		CAPTURE { subjects: ["orders.>", "audit"], sample: 0.5, max_msgs: 5 }
+		LATEST { subjects: "events.*", max_msgs: 2, discard: new }
+	`)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	for i := 1; i <= 20; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+	}
+	natsPub(t, nc, "other", []byte("not captured"))
+	for i := 1; i <= 4; i++ {
+		natsPub(t, nc, fmt.Sprintf("events.%d", i), []byte("event"))
+	}
+	natsFlush(t, nc)
+
+	// Every other message is captured, and the oldest ones discarded.
+	si := checkStreamMsgs(t, nc, "CAPTURE", 5)
+	if si.Received != 20 || si.NotSampled != 10 || si.Discarded != 5 || si.FirstSeq != 6 || si.LastSeq != 10 || si.Dropped != 0 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	resp := streamRequest(t, nc, "$STREAM.API.FETCH.CAPTURE", []byte(`{"start_seq": 7, "batch": 2}`))
+	if len(resp.Msgs) != 2 || resp.Msgs[0].Sequence != 7 || resp.Msgs[0].Subject != "orders.14" || resp.Msgs[1].Subject != "orders.16" {
+		t.Fatalf("Unexpected messages: %+v", resp)
+	}
+	if resp := streamRequest(t, nc, "$STREAM.API.GET.CAPTURE", []byte(`{"seq": 10}`)); resp.Msg == nil ||
+		resp.Msg.Subject != "orders.20" || string(resp.Msg.Data) != "order" {
+		t.Fatalf("Unexpected message: %+v", resp)
+	}
+
+	// The new messages are dropped once full.
+	si = checkStreamMsgs(t, nc, "LATEST", 2)
+	if si.Rejected != 2 || si.LastSeq != 2 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	if resp := streamRequest(t, nc, "$STREAM.API.FETCH.LATEST", []byte(`{"filter_subject": "events.2"}`)); len(resp.Msgs) != 1 || resp.Msgs[0].Sequence != 2 {
+		t.Fatalf("Unexpected messages: %+v", resp)
+	}
+
+	for _, test := range []struct{ subject, data, err string }{
+		{"$STREAM.API.INFO.MISSING", "", errStreamNotFound.Error()},
+		{"$STREAM.API.GET.CAPTURE", `{"seq": 1}`, errStreamMsgNotFound.Error()},
+		{"$STREAM.API.PURGE.CAPTURE", "", "unknown operation"},
+	} {
+		if resp := streamRequest(t, nc, test.subject, []byte(test.data)); !strings.Contains(resp.Error, test.err) {
+			t.Fatalf("Expected error %q for %q, got %+v", test.err, test.subject, resp)
+		}
+	}
+	if resp := streamRequest(t, nc, "$STREAM.API.LIST", nil); len(resp.Streams) != 2 || resp.Streams[0].Config.Name != "CAPTURE" {
+		t.Fatalf("Unexpected streams: %+v", resp)
+	}
+	if sz := s.Storez(nil); len(sz.Streams) != 1 || sz.Streams[0].Account != "A" || len(sz.Streams[0].Streams) != 2 {
+		t.Fatalf("Unexpected storez: %+v", sz.Streams)
+	}
+}
+
+func TestStreamCaptureHeaders(t *testing.T) {
+	s, nc := runStreamServer(t, _EMPTY_, `CAPTURE { subjects: "orders.*", max_bytes: 1KB }`)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	br.ReadString('\n')
+	hdr := "NATS/1.0\r\nOrder-Id: 1\r\n\r\n"
+	c.Write([]byte(fmt.Sprintf("CONNECT {\"verbose\":false,\"headers\":true,\"user\":\"a\",\"pass\":\"a\"}\r\n"+
+		"HPUB orders.new reply.1 %d %d\r\n%shello\r\nPING\r\n", len(hdr), len(hdr)+5, hdr)))
+	if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+
+	checkStreamMsgs(t, nc, "CAPTURE", 1)
+	sm := streamRequest(t, nc, "$STREAM.API.GET.CAPTURE", []byte(`{"seq": 1}`)).Msg
+	if sm == nil || sm.Subject != "orders.new" || sm.Reply != "reply.1" || string(sm.Header) != hdr || string(sm.Data) != "hello" {
+		t.Fatalf("Unexpected message: %+v", sm)
+	}
+}
+
+func TestStreamCaptureNeverBlocks(t *testing.T) {
+	s := &Server{}
+	st := &stream{cfg: StreamConfig{Name: "S", Sample: 1}, in: make(chan *StreamMsg, 2)}
+	capture := s.streamCapture(st)
+	// Nothing stores the messages, the ones over the buffer are dropped.
+	for i := 0; i < 5; i++ {
+		capture(nil, nil, "orders", _EMPTY_, []byte("order"))
+	}
+	capture(nil, nil, "$STREAM.API.INFO.S", _EMPTY_, nil)
+	if si := st.info(); si.Received != 5 || si.Dropped != 3 || len(st.in) != 2 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+}
+
+func TestStreamStored(t *testing.T) {
+	ci := streamCompactInterval
+	streamCompactInterval = 50 * time.Millisecond
+	defer func() { streamCompactInterval = ci }()
+
+	dir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	streams := `CAPTURE { subjects: "orders.*", max_msgs: 3 }`
+	s, nc := runStreamServer(t, dir, streams)
+	for i := 1; i <= 5; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+	}
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "CAPTURE", 3)
+	nc.Close()
+	s.Shutdown()
+
+	// The messages and the sequence are kept after a restart.
+	s, nc = runStreamServer(t, dir, streams)
+	si := checkStreamMsgs(t, nc, "CAPTURE", 3)
+	if si.FirstSeq != 3 || si.LastSeq != 5 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	natsPub(t, nc, "orders.6", []byte("order"))
+	natsFlush(t, nc)
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if si := streamRequest(t, nc, "$STREAM.API.INFO.CAPTURE", nil).Stream; si.LastSeq != 6 || si.FirstSeq != 4 {
+			return fmt.Errorf("Unexpected info: %+v", si)
+		}
+		return nil
+	})
+	nc.Close()
+	s.Shutdown()
+
+	// Even once all the messages expired.
+	s, nc = runStreamServer(t, dir, `CAPTURE { subjects: "orders.*", max_age: "100ms" }`)
+	checkStreamMsgs(t, nc, "CAPTURE", 0)
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "A", "CAPTURE"+streamLogExt)); err != nil || strings.Count(string(b), "\n") != 1 {
+			return fmt.Errorf("Expected a compacted log, got %q (%v)", b, err)
+		}
+		return nil
+	})
+	nc.Close()
+	s.Shutdown()
+	s, nc = runStreamServer(t, dir, streams)
+	defer s.Shutdown()
+	defer nc.Close()
+	natsPub(t, nc, "orders.7", []byte("order"))
+	natsFlush(t, nc)
+	if si := checkStreamMsgs(t, nc, "CAPTURE", 1); si.FirstSeq != 7 || si.LastSeq != 7 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+}
+
+func TestStreamStoredTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	streams := `CAPTURE { subjects: "orders.*", max_msgs: 10 }`
+	s, nc := runStreamServer(t, dir, streams)
+	for i := 1; i <= 2; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+	}
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "CAPTURE", 2)
+	nc.Close()
+	s.Shutdown()
+
+	// A crash in the middle of a write leaves a partial last record.
+	file := filepath.Join(dir, "A", "CAPTURE"+streamLogExt)
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatalf("Error opening log: %v", err)
+	}
+	f.Write([]byte(`{"seq":3,"subj`))
+	f.Close()
+
+	s, nc = runStreamServer(t, dir, streams)
+	defer s.Shutdown()
+	defer nc.Close()
+	if si := checkStreamMsgs(t, nc, "CAPTURE", 2); si.LastSeq != 2 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	natsPub(t, nc, "orders.3", []byte("order"))
+	natsFlush(t, nc)
+	if si := checkStreamMsgs(t, nc, "CAPTURE", 3); si.LastSeq != 3 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading log: %v", err)
+	}
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line == _EMPTY_ {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line), &StreamMsg{}); err != nil || !strings.HasSuffix(line, "\n") {
+			t.Fatalf("Expected the torn record to be removed, got %q", b)
+		}
+	}
+}
+
+func TestStreamReload(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				streams { CAPTURE { subjects: "orders.*", max_msgs: 10 } }
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port), nats.UserInfo("a", "a"))
+	defer nc.Close()
+	natsPub(t, nc, "orders.1", []byte("order"))
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "CAPTURE", 1)
+
+	// The changed stream keeps its messages, the removed one is stopped.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(`
+		port: -1
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				streams { CAPTURE { subjects: "audit", max_msgs: 10 }, OTHER { subjects: "orders.*", max_msgs: 1 } }
+			}
+		}
+	`))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	natsPub(t, nc, "orders.2", []byte("order"))
+	natsPub(t, nc, "audit", []byte("audit"))
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "OTHER", 1)
+	if si := checkStreamMsgs(t, nc, "CAPTURE", 2); si.LastSeq != 2 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix of the subjects of the acks of the delivered messages,
+	// followed by the stream, the consumer and the sequence of the message.
+	streamAckPrefix = streamPrefix + "ACK."
+
+	// Extension of the log of the acks of the consumers of a stream.
+	streamAckLogExt = ".acks"
+)
+
+var (
+	errStreamConsumerNotFound = errors.New("consumer not found")
+	errStreamAckInvalid       = errors.New("invalid ack")
+)
+
+// StreamConsumeRequest is the payload of a CONSUME request. The messages
+// of the stream not yet acknowledged by the Durable consumer, matching its
+// FilterSubject, are delivered to the reply subject, up to Batch. Each
+// message has the subject of its ack as reply. The messages delivered and
+// not acknowledged are delivered again by the next request. The flow
+// control and the idle heartbeats are the ones of the object deliveries.
+type StreamConsumeRequest struct {
+	Durable       string        `json:"durable"`
+	FilterSubject string        `json:"filter_subject,omitempty"`
+	Batch         int           `json:"batch,omitempty"`
+	FlowControl   bool          `json:"flow_control,omitempty"`
+	IdleHeartbeat time.Duration `json:"idle_heartbeat,omitempty"`
+}
+
+// StreamConsumerConfig is the payload of the requests creating and
+// deleting a Durable consumer of a stream, defined on all the servers
+// replicating the metadata.
+type StreamConsumerConfig struct {
+	Durable       string `json:"durable"`
+	FilterSubject string `json:"filter_subject,omitempty"`
+}
+
+// validateStreamConsumerConfig checks the name and the filter subject of a
+// consumer.
+func validateStreamConsumerConfig(cfg *StreamConsumerConfig) error {
+	if !kvValidBucket.MatchString(cfg.Durable) {
+		return fmt.Errorf("invalid consumer name %q", cfg.Durable)
+	}
+	if cfg.FilterSubject != _EMPTY_ && !IsValidSubject(cfg.FilterSubject) {
+		return fmt.Errorf("invalid filter subject %q", cfg.FilterSubject)
+	}
+	return nil
+}
+
+// StreamConsumerInfo is the state of a durable consumer of a stream, the
+// first message delivered in response to a CONSUME request, followed by
+// the Batch messages. The messages up to the AckFloor are acknowledged, as
+// are Acked of the following ones.
+type StreamConsumerInfo struct {
+	Stream        string `json:"stream"`
+	Name          string `json:"name"`
+	FilterSubject string `json:"filter_subject,omitempty"`
+	AckFloor      uint64 `json:"ack_floor"`
+	Acked         int    `json:"acked"`
+	Batch         int    `json:"batch"`
+}
+
+// StreamAckResponse is the response to an ack published with a reply
+// subject, sent once the ack is stored. Only the first ack of a message
+// counts, the next ones are Duplicate: a consumer processing the messages
+// exactly once commits its processing of a message on the response to its
+// first ack, and discards it otherwise.
+type StreamAckResponse struct {
+	Stream    string `json:"stream"`
+	Consumer  string `json:"consumer"`
+	Seq       uint64 `json:"seq"`
+	AckFloor  uint64 `json:"ack_floor"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// streamConsumer is a durable consumer of a stream, all the messages up to
+// floor are acknowledged, as are the acked ones following it.
+type streamConsumer struct {
+	name   string
+	filter string
+	floor  uint64
+	acked  map[uint64]struct{}
+}
+
+// streamAck is a record of the log of the acks. A record without a
+// sequence holds the filter and the ack floor of the consumer.
+type streamAck struct {
+	Consumer string `json:"consumer"`
+	Filter   string `json:"filter,omitempty"`
+	Floor    uint64 `json:"floor,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+}
+
+// Returns whether the consumer is delivered the message.
+func (sc *streamConsumer) matches(sm *StreamMsg) bool {
+	return sc.filter == _EMPTY_ || subjectIsSubsetMatch(sm.Subject, sc.filter)
+}
+
+// Returns the state of the consumer, lock of the stream should be held.
+func (sc *streamConsumer) info(stream string) *StreamConsumerInfo {
+	return &StreamConsumerInfo{
+		Stream:        stream,
+		Name:          sc.name,
+		FilterSubject: sc.filter,
+		AckFloor:      sc.floor,
+		Acked:         len(sc.acked),
+	}
+}
+
+// consume returns the consumer of the request, created if needed, and the
+// messages to deliver to it.
+func (st *stream) consume(req *StreamConsumeRequest) (*StreamConsumerInfo, []*StreamMsg, error) {
+	if err := validateStreamConsumerConfig(&StreamConsumerConfig{req.Durable, req.FilterSubject}); err != nil {
+		return nil, nil, err
+	}
+	batch := req.Batch
+	if batch <= 0 {
+		batch = streamDefaultBatch
+	} else if batch > streamMaxBatch {
+		batch = streamMaxBatch
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sc, err := st.addConsumer(req.Durable, req.FilterSubject)
+	if err != nil {
+		return nil, nil, err
+	}
+	var msgs []*StreamMsg
+	for i := st.index(sc.floor + 1); i < len(st.msgs) && len(msgs) < batch; i++ {
+		sm := st.msgs[i]
+		if _, ok := sc.acked[sm.Sequence]; !ok && sc.matches(sm) {
+			msgs = append(msgs, sm)
+		}
+	}
+	info := sc.info(st.cfg.Name)
+	info.Batch = len(msgs)
+	return info, msgs, nil
+}
+
+// addConsumer returns the consumer, created if needed. Lock should be held.
+func (st *stream) addConsumer(name, filter string) (*streamConsumer, error) {
+	sc := st.consumers[name]
+	if sc == nil {
+		sc = &streamConsumer{name: name, filter: filter, acked: make(map[uint64]struct{})}
+		if st.ackFile != _EMPTY_ {
+			if err := st.appendAck(&streamAck{Consumer: sc.name, Filter: sc.filter}); err != nil {
+				return nil, err
+			}
+		}
+		st.consumers[sc.name] = sc
+		st.advance(sc)
+	} else if sc.filter != filter {
+		return nil, fmt.Errorf("filter subject of consumer %q can not be changed", sc.name)
+	}
+	return sc, nil
+}
+
+// deleteConsumer deletes the consumer and rewrites the log of the acks
+// without it.
+func (st *stream) deleteConsumer(name string) error {
+	st.mu.Lock()
+	_, ok := st.consumers[name]
+	delete(st.consumers, name)
+	st.mu.Unlock()
+	if !ok {
+		return errStreamConsumerNotFound
+	}
+	return st.compactAcks(true)
+}
+
+// ack stores the ack of the message with the sequence by the consumer, and
+// returns whether it was already acknowledged.
+func (st *stream) ack(consumer string, seq uint64) (*StreamAckResponse, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sc := st.consumers[consumer]
+	if sc == nil {
+		return nil, errStreamConsumerNotFound
+	}
+	if seq == 0 || seq > st.last {
+		return nil, errStreamAckInvalid
+	}
+	resp := &StreamAckResponse{Stream: st.cfg.Name, Consumer: consumer, Seq: seq}
+	if _, ok := sc.acked[seq]; ok || seq <= sc.floor {
+		resp.Duplicate = true
+	} else {
+		if st.ackFile != _EMPTY_ {
+			if err := st.appendAck(&streamAck{Consumer: consumer, Seq: seq}); err != nil {
+				return nil, err
+			}
+		}
+		sc.acked[seq] = struct{}{}
+		st.advance(sc)
+	}
+	resp.AckFloor = sc.floor
+	return resp, nil
+}
+
+// advance raises the ack floor of the consumer up to the first message it
+// has not acknowledged, the ones discarded or not matching its filter are
+// skipped. Lock should be held.
+func (st *stream) advance(sc *streamConsumer) {
+	floor := st.last
+	for i := st.index(sc.floor + 1); i < len(st.msgs); i++ {
+		sm := st.msgs[i]
+		if _, ok := sc.acked[sm.Sequence]; !ok && sc.matches(sm) {
+			floor = sm.Sequence - 1
+			break
+		}
+	}
+	if floor <= sc.floor {
+		return
+	}
+	sc.floor = floor
+	for seq := range sc.acked {
+		if seq <= floor {
+			delete(sc.acked, seq)
+		}
+	}
+}
+
+// streamAckRequest returns the handler of the acks of the messages
+// delivered to the consumers of the streams.
+func (s *Server) streamAckRequest(ss *streamStore) msgHandler {
+	return func(sub *subscription, c *client, subject, reply string, msg []byte) {
+		tokens := strings.Split(strings.TrimPrefix(subject, streamAckPrefix), tsep)
+		resp := &StreamAckResponse{}
+		var err error
+		if len(tokens) != 3 {
+			err = errStreamAckInvalid
+		} else {
+			resp.Stream, resp.Consumer = tokens[0], tokens[1]
+			resp.Seq, err = strconv.ParseUint(tokens[2], 10, 64)
+			if err != nil {
+				err = errStreamAckInvalid
+			}
+		}
+		var st *stream
+		if err == nil {
+			ss.mu.Lock()
+			st, err = ss.stream(resp.Stream)
+			ss.mu.Unlock()
+		}
+		if err == nil {
+			var aresp *StreamAckResponse
+			if aresp, err = st.ack(resp.Consumer, resp.Seq); err == nil {
+				resp = aresp
+			}
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if reply == _EMPTY_ {
+			return
+		}
+		if acc, lerr := s.LookupAccount(ss.account); lerr == nil {
+			s.sendInternalAccountMsg(acc, reply, resp)
+		}
+	}
+}
+
+// deliverConsumer sends the state of the consumer and then the messages
+// to the reply subject, waiting for the client between the windows of
+// messages if the request asks for flow control.
+func (ss *streamStore) deliverConsumer(acc *Account, reply string, info *StreamConsumerInfo, msgs []*StreamMsg, req *StreamConsumeRequest) {
+	b, _ := json.Marshal(&StreamResponse{Consumer: info})
+	ss.publish(acc, reply, _EMPTY_, nil, b)
+
+	var id string
+	var resume chan struct{}
+	if req.FlowControl {
+		id, resume = ss.startFlow()
+		defer ss.endFlow(id)
+	}
+	ack := streamAckPrefix + info.Stream + tsep + info.Name + tsep
+	for i, sm := range msgs {
+		ss.publish(acc, reply, ack+strconv.FormatUint(sm.Sequence, 10), sm.Header, sm.Data)
+		if sent := i + 1; resume == nil || sent%flowWindow != 0 || sent == len(msgs) {
+			continue
+		}
+		if !ss.waitFlow(acc, reply, id, resume, req.IdleHeartbeat) {
+			return
+		}
+	}
+}
+
+// Appends the record to the log of the acks and syncs it, lock should be
+// held.
+func (st *stream) appendAck(ack *streamAck) error {
+	if st.closed {
+		return errors.New("stream stopped")
+	}
+	b, _ := json.Marshal(ack)
+	b, err := st.cipher.sealLine(filepath.Base(st.ackFile), b)
+	if err != nil {
+		return err
+	}
+	if err := appendLogSync(&st.ackLog, st.ackFile, append(b, '\n')); err != nil {
+		return err
+	}
+	st.ackLogged++
+	return nil
+}
+
+// loadAcks reads the log of the acks of the consumers, once the messages
+// of the stream are loaded.
+func (st *stream) loadAcks() error {
+	f, err := os.Open(st.ackFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rewrite bool
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			// The last record was torn by a crash, rewrite the log without.
+			rewrite = true
+			break
+		}
+		if len(line) > 1 {
+			line, stale, oerr := st.cipher.openLine(filepath.Base(st.ackFile), line)
+			if oerr != nil {
+				return oerr
+			}
+			ack := &streamAck{}
+			if jerr := json.Unmarshal(line, ack); jerr != nil {
+				return fmt.Errorf("invalid acks log of stream %q: %v", st.cfg.Name, jerr)
+			}
+			sc := st.consumers[ack.Consumer]
+			if sc == nil {
+				sc = &streamConsumer{name: ack.Consumer, acked: make(map[uint64]struct{})}
+				st.consumers[sc.name] = sc
+			}
+			if ack.Seq == 0 {
+				sc.filter = ack.Filter
+				if ack.Floor > sc.floor {
+					sc.floor = ack.Floor
+				}
+			} else if ack.Seq > sc.floor {
+				sc.acked[ack.Seq] = struct{}{}
+			}
+			rewrite = rewrite || stale
+			st.ackLogged++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	st.mu.Lock()
+	for _, sc := range st.consumers {
+		st.advance(sc)
+	}
+	st.mu.Unlock()
+	return st.compactAcks(rewrite)
+}
+
+// compactAcks rewrites the log of the acks with the state of the
+// consumers, once at least half of its records are no longer needed, or if
+// force is set.
+func (st *stream) compactAcks(force bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var records []*streamAck
+	for _, sc := range st.consumers {
+		st.advance(sc)
+		records = append(records, &streamAck{Consumer: sc.name, Filter: sc.filter, Floor: sc.floor})
+		for seq := range sc.acked {
+			records = append(records, &streamAck{Consumer: sc.name, Seq: seq})
+		}
+	}
+	if st.ackFile == _EMPTY_ || (!force && (st.ackLogged == 0 || st.ackLogged < 2*len(records))) {
+		return nil
+	}
+	var buf []byte
+	for _, ack := range records {
+		data, _ := json.Marshal(ack)
+		data, err := st.cipher.sealLine(filepath.Base(st.ackFile), data)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	tmp := st.ackFile + ".tmp"
+	if err := writeFileSync(tmp, buf, 0640); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if st.ackLog != nil {
+		st.ackLog.Close()
+		st.ackLog = nil
+	}
+	if err := renameSync(tmp, st.ackFile); err != nil {
+		return err
+	}
+	st.ackLogged = len(records)
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Sends a CONSUME request and returns the state of the consumer and the
+// messages delivered.
+func streamConsume(t *testing.T, nc *nats.Conn, stream, req string) (*StreamConsumerInfo, []*nats.Msg) {
+	t.Helper()
+	inbox := nats.NewInbox()
+	sub := natsSubSync(t, nc, inbox)
+	defer sub.Unsubscribe()
+	natsPubReq(t, nc, "$STREAM.API.CONSUME."+stream, inbox, []byte(req))
+	var resp StreamResponse
+	if err := json.Unmarshal(natsNexMsg(t, sub, time.Second).Data, &resp); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+	if resp.Error != _EMPTY_ {
+		return nil, nil
+	}
+	var msgs []*nats.Msg
+	for i := 0; i < resp.Consumer.Batch; i++ {
+		msgs = append(msgs, natsNexMsg(t, sub, time.Second))
+	}
+	return resp.Consumer, msgs
+}
+
+func streamAckRequest(t *testing.T, nc *nats.Conn, subject string) *StreamAckResponse {
+	t.Helper()
+	var resp StreamAckResponse
+	apiRequest(t, nc, subject, nil, &resp)
+	return &resp
+}
+
+func TestStreamConsumerAckAck(t *testing.T) {
+	s, nc := runStreamServer(t, _EMPTY_, `ORDERS { subjects: "orders.*", max_msgs: 100 }`)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	for i := 1; i <= 5; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte(fmt.Sprintf("order %d", i)))
+	}
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "ORDERS", 5)
+
+	info, msgs := streamConsume(t, nc, "ORDERS", `{"durable": "C", "batch": 3}`)
+	if info == nil || info.AckFloor != 0 || len(msgs) != 3 {
+		t.Fatalf("Unexpected consumer: %+v", info)
+	}
+	for i, msg := range msgs {
+		if string(msg.Data) != fmt.Sprintf("order %d", i+1) || msg.Reply != fmt.Sprintf("$STREAM.ACK.ORDERS.C.%d", i+1) {
+			t.Fatalf("Unexpected message: %+v", msg)
+		}
+	}
+
+	// The ack floor is raised once the messages before it are acked.
+	for _, test := range []struct {
+		seq       int
+		floor     uint64
+		duplicate bool
+	}{
+		{2, 0, false},
+		{1, 2, false},
+		{1, 2, true},
+		{2, 2, true},
+	} {
+		resp := streamAckRequest(t, nc, msgs[test.seq-1].Reply)
+		if resp.Error != _EMPTY_ || resp.Seq != uint64(test.seq) || resp.AckFloor != test.floor || resp.Duplicate != test.duplicate {
+			t.Fatalf("Unexpected response to the ack of %d: %+v", test.seq, resp)
+		}
+	}
+
+	// The messages not acked are delivered again, and acks without a
+	// reply subject are stored as well.
+	info, msgs = streamConsume(t, nc, "ORDERS", `{"durable": "C"}`)
+	if info.AckFloor != 2 || len(msgs) != 3 || !strings.HasSuffix(msgs[0].Reply, ".3") {
+		t.Fatalf("Unexpected consumer: %+v", info)
+	}
+	natsPub(t, nc, msgs[0].Reply, nil)
+	if resp := streamAckRequest(t, nc, msgs[0].Reply); !resp.Duplicate || resp.AckFloor != 3 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	// Each consumer has its own floor, the messages not matching the
+	// filter are skipped.
+	info, msgs = streamConsume(t, nc, "ORDERS", `{"durable": "D", "filter_subject": "orders.4"}`)
+	if info.AckFloor != 3 || len(msgs) != 1 {
+		t.Fatalf("Unexpected consumer: %+v", info)
+	}
+	if resp := streamAckRequest(t, nc, msgs[0].Reply); resp.Duplicate || resp.AckFloor != 5 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if si := streamRequest(t, nc, "$STREAM.API.INFO.ORDERS", nil).Stream; si.Consumers != 2 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+
+	for _, test := range []struct{ subject, err string }{
+		{"$STREAM.ACK.ORDERS.X.1", errStreamConsumerNotFound.Error()},
+		{"$STREAM.ACK.ORDERS.C.9", errStreamAckInvalid.Error()},
+		{"$STREAM.ACK.ORDERS.C.x", errStreamAckInvalid.Error()},
+		{"$STREAM.ACK.MISSING.C.1", errStreamNotFound.Error()},
+	} {
+		if resp := streamAckRequest(t, nc, test.subject); resp.Error != test.err {
+			t.Fatalf("Expected error %q for %q, got %+v", test.err, test.subject, resp)
+		}
+	}
+	for _, test := range []struct{ req, err string }{
+		{`{"durable": "D", "filter_subject": "orders.5"}`, "can not be changed"},
+		{`{"durable": "a.b"}`, "invalid consumer name"},
+		{`{}`, "invalid consumer name"},
+	} {
+		if resp := streamRequest(t, nc, "$STREAM.API.CONSUME.ORDERS", []byte(test.req)); !strings.Contains(resp.Error, test.err) {
+			t.Fatalf("Expected error %q for %s, got %+v", test.err, test.req, resp)
+		}
+	}
+}
+
+func TestStreamConsumerStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	streams := `ORDERS { subjects: "orders.*", max_msgs: 100 }`
+	s, nc := runStreamServer(t, dir, streams)
+	for i := 1; i <= 4; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+	}
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "ORDERS", 4)
+	_, msgs := streamConsume(t, nc, "ORDERS", `{"durable": "C"}`)
+	for _, i := range []int{0, 1, 3} {
+		streamAckRequest(t, nc, msgs[i].Reply)
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// The acks are kept after a restart, the acked messages are not
+	// delivered again and their acks are confirmed as duplicates.
+	s, nc = runStreamServer(t, dir, streams)
+	defer s.Shutdown()
+	defer nc.Close()
+	checkStreamMsgs(t, nc, "ORDERS", 4)
+	info, msgs := streamConsume(t, nc, "ORDERS", `{"durable": "C"}`)
+	if info.AckFloor != 2 || info.Acked != 1 || len(msgs) != 1 || !strings.HasSuffix(msgs[0].Reply, ".3") {
+		t.Fatalf("Unexpected consumer: %+v", info)
+	}
+	if resp := streamAckRequest(t, nc, "$STREAM.ACK.ORDERS.C.4"); !resp.Duplicate {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if resp := streamAckRequest(t, nc, msgs[0].Reply); resp.Duplicate || resp.AckFloor != 4 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+}
+
+func TestStreamConsumerFlowControl(t *testing.T) {
+	fw, st := flowWindow, flowStallTimeout
+	flowWindow, flowStallTimeout = 2, 300*time.Millisecond
+	defer func() { flowWindow, flowStallTimeout = fw, st }()
+
+	s, nc := runStreamServer(t, _EMPTY_, `ORDERS { subjects: "orders.*", max_msgs: 100 }`)
+	defer s.Shutdown()
+	defer nc.Close()
+	for i := 1; i <= 5; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+	}
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "ORDERS", 5)
+
+	consume := func(req string) *nats.Subscription {
+		t.Helper()
+		inbox := nats.NewInbox()
+		sub := natsSubSync(t, nc, inbox)
+		natsPubReq(t, nc, "$STREAM.API.CONSUME.ORDERS", inbox, []byte(req))
+		if msg := natsNexMsg(t, sub, time.Second); !strings.Contains(string(msg.Data), `"consumer"`) {
+			t.Fatalf("Unexpected response: %q", msg.Data)
+		}
+		return sub
+	}
+	// A flow control request follows every window of messages, but the
+	// last one.
+	sub := consume(`{"durable": "C", "flow_control": true, "idle_heartbeat": 50000000}`)
+	for seq := 1; seq <= 5; seq++ {
+		msg := natsNexMsg(t, sub, time.Second)
+		for len(msg.Data) == 0 && msg.Reply == _EMPTY_ {
+			msg = natsNexMsg(t, sub, time.Second)
+		}
+		if msg.Reply != fmt.Sprintf("$STREAM.ACK.ORDERS.C.%d", seq) {
+			t.Fatalf("Unexpected message: %+v", msg)
+		}
+		if seq%2 != 0 || seq == 5 {
+			continue
+		}
+		fc := natsNexMsg(t, sub, time.Second)
+		if len(fc.Data) != 0 || !strings.HasPrefix(fc.Reply, "$STREAM.API.FC.") {
+			t.Fatalf("Expected a flow control request, got %+v", fc)
+		}
+		if hb := natsNexMsg(t, sub, time.Second); len(hb.Data) != 0 || hb.Reply != _EMPTY_ {
+			t.Fatalf("Expected a heartbeat, got %+v", hb)
+		}
+		natsPub(t, nc, fc.Reply, nil)
+	}
+
+	// The delivery is stopped when the consumer stalls.
+	sub = consume(`{"durable": "C", "flow_control": true}`)
+	natsNexMsg(t, sub, time.Second)
+	natsNexMsg(t, sub, time.Second)
+	fc := natsNexMsg(t, sub, time.Second)
+	time.Sleep(2 * flowStallTimeout)
+	natsPub(t, nc, fc.Reply, nil)
+	if msg, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message after the stall: %+v", msg)
+	}
+}
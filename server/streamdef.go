@@ -0,0 +1,225 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var errStreamNoMetadata = errors.New("streams can only be defined through the API when the metadata is replicated")
+
+// streamConfigs returns the configurations of the streams of the account,
+// the ones of its configuration and the ones defined through the API, and
+// the consumers defined through the API by stream. The configuration wins
+// over the API. Nil if the account has no streams.
+func (s *Server) streamConfigs(acc *Account) (map[string]*StreamConfig, map[string][]*StreamConsumerConfig) {
+	acc.mu.RLock()
+	cfgs := acc.streams
+	acc.mu.RUnlock()
+	s.mu.Lock()
+	ms := s.metaState
+	s.mu.Unlock()
+	if ms == nil {
+		return cfgs, nil
+	}
+	streams, consumers := ms.accountStreams(acc.Name)
+	if len(streams) == 0 {
+		return cfgs, consumers
+	}
+	all := make(map[string]*StreamConfig, len(cfgs)+len(streams))
+	for name, cfg := range streams {
+		all[name] = cfg
+	}
+	for name, cfg := range cfgs {
+		all[name] = cfg
+	}
+	return all, consumers
+}
+
+// addStreamConsumer creates the consumer defined through the API, if its
+// stream is started.
+func (s *Server) addStreamConsumer(acc *Account, ss *streamStore, stream string, cfg *StreamConsumerConfig) {
+	ss.mu.Lock()
+	st, err := ss.stream(stream)
+	ss.mu.Unlock()
+	if err != nil {
+		return
+	}
+	st.mu.Lock()
+	_, err = st.addConsumer(cfg.Durable, cfg.FilterSubject)
+	st.mu.Unlock()
+	if err != nil {
+		s.Warnf("Error creating consumer %q of stream %q of account %q: %v", cfg.Durable, stream, acc.Name, err)
+	}
+}
+
+// streamDefinitionRequest handles the requests creating and deleting the
+// streams and their durable consumers. The changes are replicated by the
+// metadata group and applied by all its members, so the request is only
+// handled by the leader, the other servers receiving it ignore it. The
+// leader responds once the change is applied.
+func (s *Server) streamDefinitionRequest(acc *Account, op, name, reply string, msg []byte) {
+	s.mu.Lock()
+	n, ms, id := s.meta, s.metaState, s.info.ID
+	s.mu.Unlock()
+	var err error
+	if n == nil {
+		err = errStreamNoMetadata
+	} else if !n.isLeader() {
+		return
+	} else {
+		var e *metaEntry
+		if e, err = s.streamDefinitionEntry(acc, ms, op, name, msg); err == nil {
+			e.Origin, e.Reply = id, reply
+			b, _ := json.Marshal(e)
+			err = n.Propose(b)
+		}
+	}
+	if err != nil && reply != _EMPTY_ {
+		s.sendInternalAccountMsg(acc, reply, &StreamResponse{Error: err.Error()})
+	}
+}
+
+// respondStreamDefinition responds to the request of an applied change of
+// the streams, if it was handled by this server.
+func (s *Server) respondStreamDefinition(e *metaEntry, err error) {
+	if e.Reply == _EMPTY_ || e.Origin != s.ID() {
+		return
+	}
+	v, ok := s.accounts.Load(e.Account)
+	if !ok {
+		return
+	}
+	resp := &StreamResponse{}
+	switch {
+	case err != nil:
+		resp.Error = err.Error()
+	case e.Op == metaOpStream:
+		resp.Stream = &StreamInfo{Config: *e.Stream}
+	case e.Op == metaOpConsumer:
+		resp.Consumer = &StreamConsumerInfo{Stream: e.Name, Name: e.Consumer.Durable, FilterSubject: e.Consumer.FilterSubject}
+	}
+	s.sendInternalAccountMsg(v.(*Account), e.Reply, resp)
+}
+
+// streamDefinitionEntry validates a request creating or deleting a stream
+// or a consumer, and returns the entry to replicate.
+func (s *Server) streamDefinitionEntry(acc *Account, ms *metaState, op, name string, msg []byte) (*metaEntry, error) {
+	cfgs, _ := s.streamConfigs(acc)
+	streams, consumers := ms.accountStreams(acc.Name)
+	e := &metaEntry{Account: acc.Name, Name: name}
+	switch op {
+	case streamOpCreate:
+		var cfg StreamConfig
+		if err := json.Unmarshal(msg, &cfg); err != nil {
+			return nil, err
+		}
+		if cfg.Name == _EMPTY_ {
+			cfg.Name = name
+		} else if cfg.Name != name {
+			return nil, fmt.Errorf("stream name %q does not match %q", cfg.Name, name)
+		}
+		if err := validateStreamConfig(&cfg); err != nil {
+			return nil, err
+		}
+		if cfgs[name] != nil {
+			return nil, fmt.Errorf("stream %q already exists", name)
+		}
+		e.Op, e.Stream = metaOpStream, &cfg
+	case streamOpDelete:
+		if streams[name] == nil {
+			if cfgs[name] != nil {
+				return nil, fmt.Errorf("stream %q is defined in the configuration", name)
+			}
+			return nil, errStreamNotFound
+		}
+		e.Op = metaOpStreamDelete
+	case streamOpConsumerCreate, streamOpConsumerDelete:
+		var cfg StreamConsumerConfig
+		if err := json.Unmarshal(msg, &cfg); err != nil {
+			return nil, err
+		}
+		if cfgs[name] == nil {
+			return nil, errStreamNotFound
+		}
+		var existing *StreamConsumerConfig
+		for _, sc := range consumers[name] {
+			if sc.Durable == cfg.Durable {
+				existing = sc
+			}
+		}
+		if op == streamOpConsumerDelete {
+			if existing == nil {
+				return nil, errStreamConsumerNotFound
+			}
+			e.Op, e.Consumer = metaOpConsumerDelete, existing
+			break
+		}
+		if err := validateStreamConsumerConfig(&cfg); err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, fmt.Errorf("consumer %q already exists", cfg.Durable)
+		}
+		e.Op, e.Consumer = metaOpConsumer, &cfg
+	}
+	return e, nil
+}
+
+// applyStreamDefinition applies a replicated change of the streams or of
+// the consumers of an account. The files of a deleted stream are removed.
+func (s *Server) applyStreamDefinition(e *metaEntry) {
+	v, ok := s.accounts.Load(e.Account)
+	if !ok {
+		// Applied once the account is loaded and its streams configured.
+		return
+	}
+	acc := v.(*Account)
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	s.mu.Lock()
+	ss := s.streams[acc.Name]
+	s.mu.Unlock()
+
+	switch e.Op {
+	case metaOpStream:
+		s.configureAccountStreams(acc, ss)
+	case metaOpStreamDelete:
+		s.configureAccountStreams(acc, ss)
+		if cfgs, _ := s.streamConfigs(acc); ss != nil && ss.dir != _EMPTY_ && cfgs[e.Name] == nil {
+			os.Remove(filepath.Join(ss.dir, e.Name+streamLogExt))
+			os.Remove(filepath.Join(ss.dir, e.Name+streamAckLogExt))
+		}
+	case metaOpConsumer:
+		if ss != nil {
+			s.addStreamConsumer(acc, ss, e.Name, e.Consumer)
+		}
+	case metaOpConsumerDelete:
+		if ss == nil {
+			return
+		}
+		ss.mu.Lock()
+		st, err := ss.stream(e.Name)
+		ss.mu.Unlock()
+		if err == nil {
+			if err := st.deleteConsumer(e.Consumer.Durable); err != nil && err != errStreamConsumerNotFound {
+				s.Warnf("Error deleting consumer %q of stream %q of account %q: %v", e.Consumer.Durable, e.Name, acc.Name, err)
+			}
+		}
+	}
+}
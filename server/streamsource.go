@@ -0,0 +1,261 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+const (
+	// Prefix of the inboxes of the responses to the fetches of the
+	// sources, followed by a unique id.
+	streamSourceInboxPrefix = streamPrefix + "SRC."
+
+	// Number of messages fetched at once from a source.
+	streamSourceBatch = 256
+)
+
+var (
+	// Interval of the fetches from a source once caught up with it.
+	streamSourcePoll = 250 * time.Millisecond
+	// Time to wait for the response of a source, and then before the next
+	// attempt.
+	streamSourceTimeout = 2 * time.Second
+	streamSourceRetry   = time.Second
+)
+
+// Returns the prefix of the API of the source.
+func (src *StreamSource) api() string {
+	if src.APIPrefix != _EMPTY_ {
+		return src.APIPrefix + tsep
+	}
+	return streamAPIPrefix
+}
+
+// Returns the key of the source in the sequences of the sources, which
+// is its name unless it is reached with another API.
+func (src *StreamSource) key() string {
+	if src.APIPrefix != _EMPTY_ {
+		return src.APIPrefix + tsep + src.Name
+	}
+	return src.Name
+}
+
+// validateStreamSources checks the mirror and the sources of the stream.
+func validateStreamSources(cfg *StreamConfig) error {
+	srcs := cfg.Sources
+	if cfg.Mirror != nil {
+		if len(cfg.Subjects) > 0 || len(cfg.Sources) > 0 {
+			return fmt.Errorf("mirror stream %q can not have subjects or sources", cfg.Name)
+		}
+		if cfg.Mirror.FilterSubject != _EMPTY_ {
+			return fmt.Errorf("mirror of stream %q can not be filtered", cfg.Name)
+		}
+		srcs = []*StreamSource{cfg.Mirror}
+	}
+	keys := make(map[string]struct{}, len(srcs))
+	for _, src := range srcs {
+		if !kvValidBucket.MatchString(src.Name) {
+			return fmt.Errorf("invalid source name %q of stream %q", src.Name, cfg.Name)
+		}
+		if src.APIPrefix != _EMPTY_ && !IsValidLiteralSubject(src.APIPrefix) {
+			return fmt.Errorf("invalid api prefix %q of source %q of stream %q", src.APIPrefix, src.Name, cfg.Name)
+		}
+		if src.FilterSubject != _EMPTY_ && !IsValidSubject(src.FilterSubject) {
+			return fmt.Errorf("invalid filter subject %q of source %q of stream %q", src.FilterSubject, src.Name, cfg.Name)
+		}
+		if src.api() == streamAPIPrefix && src.Name == cfg.Name {
+			return fmt.Errorf("stream %q can not be its own source", cfg.Name)
+		}
+		if _, ok := keys[src.key()]; ok {
+			return fmt.Errorf("duplicate source %q of stream %q", src.Name, cfg.Name)
+		}
+		keys[src.key()] = struct{}{}
+	}
+	return nil
+}
+
+// startStreamSources starts copying the messages of the mirror or the
+// sources of the stream.
+func (s *Server) startStreamSources(acc *Account, st *stream) {
+	if src := st.cfg.Mirror; src != nil {
+		st.wg.Add(1)
+		s.startGoRoutine(func() { s.runStreamSource(acc, st, src, true) })
+	}
+	for _, src := range st.cfg.Sources {
+		src := src
+		st.wg.Add(1)
+		s.startGoRoutine(func() { s.runStreamSource(acc, st, src, false) })
+	}
+}
+
+// runStreamSource fetches the messages of the source, from the sequence
+// following the last one copied, until the stream is stopped. The source
+// is fetched again, from where it was left, once it can be reached again.
+func (s *Server) runStreamSource(acc *Account, st *stream, src *StreamSource, mirror bool) {
+	defer s.grWG.Done()
+	defer st.wg.Done()
+
+	resps := make(chan []byte, 8)
+	inbox := streamSourceInboxPrefix + nuid.Next()
+	c, sub, err := s.accountSubscribe(acc, inbox, func(_ *subscription, _ *client, _, _ string, msg []byte) {
+		select {
+		case resps <- append([]byte(nil), msg...):
+		default:
+		}
+	})
+	if err != nil {
+		s.Errorf("Error starting source %q of stream %q: %v", src.Name, st.cfg.Name, err)
+		return
+	}
+	defer s.accountUnsubscribeInternal(acc, c, sub)
+
+	subject := src.api() + streamOpFetch + tsep + src.Name
+	var lost error
+	for {
+		req := &StreamFetchRequest{
+			StartSeq:      st.sourceSeq(src, mirror) + 1,
+			Batch:         streamSourceBatch,
+			FilterSubject: src.FilterSubject,
+		}
+		s.sendInternalAccountRequest(acc, subject, inbox, req)
+
+		// The other servers of the account with streams respond that they
+		// do not have the source, the one that has it is waited for.
+		var resp StreamResponse
+		err := errors.New("no response")
+		timeout := time.NewTimer(streamSourceTimeout)
+		for waiting := true; waiting; {
+			select {
+			case b := <-resps:
+				resp = StreamResponse{}
+				if err = json.Unmarshal(b, &resp); err == nil && resp.Error != _EMPTY_ {
+					err = errors.New(resp.Error)
+				}
+				waiting = resp.Error == errStreamNotFound.Error()
+			case <-timeout.C:
+				waiting = false
+			case <-st.quit:
+				timeout.Stop()
+				return
+			case <-s.quitCh:
+				timeout.Stop()
+				return
+			}
+		}
+		timeout.Stop()
+
+		wait := streamSourceRetry
+		if err != nil {
+			if lost == nil {
+				s.Warnf("Unable to fetch source %q of stream %q: %v", src.Name, st.cfg.Name, err)
+			}
+			lost = err
+		} else {
+			if lost != nil {
+				s.Noticef("Fetching source %q of stream %q from sequence %d", src.Name, st.cfg.Name, req.StartSeq)
+				lost = nil
+			}
+			if err := st.storeSourced(src, mirror, resp.Msgs, resp.NextSeq); err != nil {
+				s.Warnf("Error storing source %q of stream %q: %v", src.Name, st.cfg.Name, err)
+			}
+			wait = streamSourcePoll
+			if len(resp.Msgs) > 0 {
+				wait = 0
+			}
+		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-st.quit:
+				return
+			case <-s.quitCh:
+				return
+			}
+		}
+	}
+}
+
+// sourceSeq returns the last sequence copied from the source, or skipped.
+// The messages of a mirror keep their sequence.
+func (st *stream) sourceSeq(src *StreamSource, mirror bool) uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if mirror {
+		return st.last
+	}
+	return st.sourced[src.key()]
+}
+
+// storeSourced adds the messages fetched from the source, within the
+// limits of the stream, and records the sequence from which to fetch the
+// next ones. The messages already copied are skipped.
+func (st *stream) storeSourced(src *StreamSource, mirror bool, msgs []*StreamMsg, next uint64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key := src.key()
+	last := st.last
+	if !mirror {
+		last = st.sourced[key]
+	}
+	for _, sm := range msgs {
+		if sm.Sequence <= last {
+			continue
+		}
+		last = sm.Sequence
+		if st.rejects(streamMsgSize(sm)) {
+			st.rejected++
+			continue
+		}
+		if mirror {
+			st.last = sm.Sequence
+		} else {
+			sm.Source, sm.SourceSeq = key, sm.Sequence
+			st.last++
+			sm.Sequence = st.last
+			st.sourced[key] = last
+		}
+		if st.file != _EMPTY_ {
+			if err := st.appendLog(sm); err != nil {
+				return err
+			}
+		}
+		st.msgs = append(st.msgs, sm)
+		st.bytes += streamMsgSize(sm)
+	}
+	st.trim(time.Now())
+
+	// The messages rejected, or skipped by the filter, are not fetched
+	// again.
+	if next > 0 && next-1 > last {
+		last = next - 1
+	}
+	var marker *StreamMsg
+	if mirror && last > st.last {
+		st.last = last
+		marker = &StreamMsg{Sequence: last}
+	} else if !mirror && last > st.sourced[key] {
+		st.sourced[key] = last
+		marker = &StreamMsg{Sequence: st.last, Source: key, SourceSeq: last}
+	}
+	if marker == nil || st.file == _EMPTY_ {
+		return nil
+	}
+	return st.appendLog(marker)
+}
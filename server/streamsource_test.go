@@ -0,0 +1,341 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Shortens the intervals of the fetches of the sources.
+func setStreamSourceIntervals() func() {
+	poll, timeout, retry := streamSourcePoll, streamSourceTimeout, streamSourceRetry
+	streamSourcePoll, streamSourceTimeout, streamSourceRetry = 20*time.Millisecond, 250*time.Millisecond, 50*time.Millisecond
+	return func() {
+		streamSourcePoll, streamSourceTimeout, streamSourceRetry = poll, timeout, retry
+	}
+}
+
+func TestStreamSourceConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accounts {
+			A {
+				streams {
+					COPY { mirror: ORDERS, max_msgs: 10 }
+					REMOTE { mirror: { name: ORDERS, api_prefix: "hub.streams" }, max_msgs: 10 }
+					ALL {
+						subjects: "audit"
+						sources: [ORDERS, { name: EVENTS, filter_subject: "events.eu.*" }]
+						max_msgs: 10
+					}
+				}
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	streams := opts.Accounts[0].streams
+	if src := streams["COPY"].Mirror; !reflect.DeepEqual(src, &StreamSource{Name: "ORDERS"}) || src.api() != "$STREAM.API." {
+		t.Fatalf("Unexpected mirror: %+v", src)
+	}
+	if src := streams["REMOTE"].Mirror; src.api() != "hub.streams." || src.key() != "hub.streams.ORDERS" {
+		t.Fatalf("Unexpected mirror: %+v", src)
+	}
+	expected := []*StreamSource{{Name: "ORDERS"}, {Name: "EVENTS", FilterSubject: "events.eu.*"}}
+	if cfg := streams["ALL"]; !reflect.DeepEqual(cfg.Sources, expected) || cfg.Mirror != nil {
+		t.Fatalf("Unexpected sources: %+v", cfg.Sources)
+	}
+
+	for _, test := range []struct{ cfg, err string }{
+		{`S { mirror: O, subjects: "a", max_msgs: 1 }`, "can not have subjects or sources"},
+		{`S { mirror: O, sources: P, max_msgs: 1 }`, "can not have subjects or sources"},
+		{`S { mirror: { name: O, filter: "a" }, max_msgs: 1 }`, "can not be filtered"},
+		{`S { sources: S, max_msgs: 1 }`, "can not be its own source"},
+		{`S { sources: [O, { name: O, filter: "a" }], max_msgs: 1 }`, "duplicate source"},
+		{`S { sources: "O.1", max_msgs: 1 }`, "invalid source name"},
+		{`S { sources: { name: O, api_prefix: "a.*" }, max_msgs: 1 }`, "invalid api prefix"},
+		{`S { sources: { name: O, filter: "a..b" }, max_msgs: 1 }`, "invalid filter subject"},
+		{`S { sources: { name: O, other: "a" }, max_msgs: 1 }`, "Unknown field"},
+		{`S { sources: 1, max_msgs: 1 }`, "Expected a name or a map"},
+	} {
+		conf := createConfFile(t, []byte(fmt.Sprintf(`accounts { A { streams { %s } } }`, test.cfg)))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error %q for %q, got %v", test.err, test.cfg, err)
+		}
+	}
+}
+
+func TestStreamMirrorAndSources(t *testing.T) {
+	defer setStreamSourceIntervals()()
+
+	s, nc := runStreamServer(t, _EMPTY_, `
+		ORDERS { subjects: "orders.*", max_msgs: 100 }
+		EVENTS { subjects: "events.>", max_msgs: 100 }
+		COPY { mirror: ORDERS, max_msgs: 100 }
+		ALL { subjects: "audit", sources: [ORDERS, { name: EVENTS, filter: "events.eu.*" }], max_msgs: 100 }
+	`)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	for i := 1; i <= 5; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+		natsPub(t, nc, fmt.Sprintf("events.us.%d", i), []byte("event"))
+	}
+	natsPub(t, nc, "events.eu.1", []byte("event"))
+	natsPub(t, nc, "audit", []byte("audit"))
+	natsFlush(t, nc)
+
+	// The mirror keeps the sequences of its origin.
+	checkStreamMsgs(t, nc, "ORDERS", 5)
+	if si := checkStreamMsgs(t, nc, "COPY", 5); si.FirstSeq != 1 || si.LastSeq != 5 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	sm := streamRequest(t, nc, "$STREAM.API.GET.COPY", []byte(`{"seq": 3}`)).Msg
+	if sm == nil || sm.Subject != "orders.3" || sm.Source != _EMPTY_ {
+		t.Fatalf("Unexpected message: %+v", sm)
+	}
+
+	// The sources are added to the messages captured, with their own
+	// sequence.
+	checkStreamMsgs(t, nc, "ALL", 7)
+	resp := streamRequest(t, nc, "$STREAM.API.FETCH.ALL", []byte(`{"filter_subject": "events.>"}`))
+	if len(resp.Msgs) != 1 || resp.Msgs[0].Subject != "events.eu.1" || resp.Msgs[0].Source != "EVENTS" || resp.Msgs[0].SourceSeq != 6 {
+		t.Fatalf("Unexpected messages: %+v", resp.Msgs)
+	}
+	resp = streamRequest(t, nc, "$STREAM.API.FETCH.ALL", []byte(`{"filter_subject": "orders.5"}`))
+	if len(resp.Msgs) != 1 || resp.Msgs[0].Source != "ORDERS" || resp.Msgs[0].SourceSeq != 5 {
+		t.Fatalf("Unexpected messages: %+v", resp.Msgs)
+	}
+
+	// And the new messages are copied as they are stored.
+	natsPub(t, nc, "orders.6", []byte("order"))
+	natsPub(t, nc, "events.us.6", []byte("event"))
+	natsPub(t, nc, "events.eu.2", []byte("event"))
+	natsFlush(t, nc)
+	if si := checkStreamMsgs(t, nc, "COPY", 6); si.LastSeq != 6 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	if si := checkStreamMsgs(t, nc, "ALL", 9); si.LastSeq != 9 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+}
+
+func TestStreamFetchNextSeq(t *testing.T) {
+	s, nc := runStreamServer(t, _EMPTY_, `ORDERS { subjects: "orders.*", max_msgs: 100 }`)
+	defer s.Shutdown()
+	defer nc.Close()
+
+	for i := 1; i <= 5; i++ {
+		natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+	}
+	natsFlush(t, nc)
+	checkStreamMsgs(t, nc, "ORDERS", 5)
+
+	for _, test := range []struct {
+		req  string
+		msgs int
+		next uint64
+	}{
+		{`{"batch": 2}`, 2, 3},
+		{`{"start_seq": 4}`, 2, 6},
+		{`{"start_seq": 9}`, 0, 9},
+		// The messages not matching the filter are skipped.
+		{`{"filter_subject": "orders.2"}`, 1, 6},
+		{`{"filter_subject": "orders.9"}`, 0, 6},
+	} {
+		resp := streamRequest(t, nc, "$STREAM.API.FETCH.ORDERS", []byte(test.req))
+		if len(resp.Msgs) != test.msgs || resp.NextSeq != test.next {
+			t.Fatalf("Expected %d messages and next %d for %s, got %d and %d", test.msgs, test.next, test.req, len(resp.Msgs), resp.NextSeq)
+		}
+	}
+}
+
+// Runs a hub with the ORDERS stream and a leafnode whose ALL stream has it
+// as a source, both with the streams stored in their dir.
+func runStreamSourceLeafnode(t *testing.T, hubDir, leafDir string) (*Server, *Server) {
+	t.Helper()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		port: -1
+		system_account: SYS
+		leafnodes { listen: "127.0.0.1:-1" }
+		streams { store_dir: %q }
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				streams { ORDERS { subjects: "orders.*", max_msgs: 100 } }
+			}
+		}
+	`, hubDir)))
+	defer os.Remove(conf)
+	hub, opts := RunServerWithConfig(conf)
+	return hub, runStreamSourceLeaf(t, hub, opts.LeafNode.Port, leafDir)
+}
+
+func runStreamSourceLeaf(t *testing.T, hub *Server, port int, dir string) *Server {
+	t.Helper()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		port: -1
+		system_account: SYS
+		leafnodes { remotes [{ url: "nats://a:a@127.0.0.1:%d", account: A }] }
+		streams { store_dir: %q }
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				streams {
+					COPY { mirror: ORDERS, max_msgs: 100 }
+					ALL { sources: ORDERS, max_msgs: 100 }
+				}
+			}
+		}
+	`, port, dir)))
+	defer os.Remove(conf)
+	leaf, _ := RunServerWithConfig(conf)
+	checkLeafNodeConnected(t, hub)
+	return leaf
+}
+
+func streamConnect(t *testing.T, s *Server) *nats.Conn {
+	t.Helper()
+	return natsConnect(t, s.ClientURL(), nats.UserInfo("a", "a"))
+}
+
+func TestStreamSourceOverLeafnode(t *testing.T) {
+	defer setStreamSourceIntervals()()
+
+	hubDir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(hubDir)
+	leafDir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(leafDir)
+
+	hub, leaf := runStreamSourceLeafnode(t, hubDir, leafDir)
+	port := hub.getOpts().LeafNode.Port
+	defer hub.Shutdown()
+	nc := streamConnect(t, hub)
+	defer nc.Close()
+	publish := func(from, to int) {
+		t.Helper()
+		for i := from; i <= to; i++ {
+			natsPub(t, nc, fmt.Sprintf("orders.%d", i), []byte("order"))
+		}
+		natsFlush(t, nc)
+	}
+	publish(1, 5)
+	lnc := streamConnect(t, leaf)
+	checkStreamMsgs(t, lnc, "COPY", 5)
+	checkStreamMsgs(t, lnc, "ALL", 5)
+
+	// The link is lost, the messages stored meanwhile are fetched once it
+	// is back.
+	hub.mu.Lock()
+	for _, ln := range hub.leafs {
+		ln.closeConnection(ClientClosed)
+	}
+	hub.mu.Unlock()
+	publish(6, 8)
+	checkLeafNodeConnected(t, hub)
+	if si := checkStreamMsgs(t, lnc, "COPY", 8); si.FirstSeq != 1 || si.LastSeq != 8 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	checkStreamMsgs(t, lnc, "ALL", 8)
+	lnc.Close()
+
+	// And they are fetched from where they were left after a restart,
+	// without the ones already copied.
+	leaf.Shutdown()
+	publish(9, 10)
+	leaf = runStreamSourceLeaf(t, hub, port, leafDir)
+	defer leaf.Shutdown()
+	lnc = streamConnect(t, leaf)
+	defer lnc.Close()
+	if si := checkStreamMsgs(t, lnc, "ALL", 10); si.FirstSeq != 1 || si.LastSeq != 10 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+	checkStreamMsgs(t, lnc, "COPY", 10)
+	resp := streamRequest(t, lnc, "$STREAM.API.FETCH.ALL", []byte(`{"start_seq": 9}`))
+	if len(resp.Msgs) != 2 || resp.Msgs[0].Subject != "orders.9" || resp.Msgs[1].SourceSeq != 10 {
+		t.Fatalf("Unexpected messages: %+v", resp.Msgs)
+	}
+}
+
+func TestStreamMirrorOverGateway(t *testing.T) {
+	defer setStreamSourceIntervals()()
+
+	confA := createConfFile(t, []byte(`
+		port: -1
+		system_account: SYS
+		gateway { name: A, listen: "127.0.0.1:-1" }
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				streams { ORDERS { subjects: "orders.*", max_msgs: 100 } }
+			}
+		}
+	`))
+	defer os.Remove(confA)
+	sa, _ := RunServerWithConfig(confA)
+	defer sa.Shutdown()
+	confB := createConfFile(t, []byte(fmt.Sprintf(`
+		port: -1
+		system_account: SYS
+		gateway {
+			name: B
+			listen: "127.0.0.1:-1"
+			gateways [{ name: A, url: "nats://127.0.0.1:%d" }]
+		}
+		accounts {
+			SYS { users: [{user: sys, password: sys}] }
+			A {
+				users: [{user: a, password: a}]
+				streams { COPY { mirror: ORDERS, max_msgs: 100 } }
+			}
+		}
+	`, sa.GatewayAddr().Port)))
+	defer os.Remove(confB)
+	sb, _ := RunServerWithConfig(confB)
+	defer sb.Shutdown()
+	waitForOutboundGateways(t, sa, 1, 2*time.Second)
+	waitForOutboundGateways(t, sb, 1, 2*time.Second)
+
+	nca := streamConnect(t, sa)
+	defer nca.Close()
+	for i := 1; i <= 5; i++ {
+		natsPub(t, nca, fmt.Sprintf("orders.%d", i), []byte("order"))
+	}
+	natsFlush(t, nca)
+	ncb := streamConnect(t, sb)
+	defer ncb.Close()
+	if si := checkStreamMsgs(t, ncb, "COPY", 5); si.FirstSeq != 1 || si.LastSeq != 5 {
+		t.Fatalf("Unexpected info: %+v", si)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Subjects exempt from the naming rules of an account if not configured,
+// so that request/reply keeps working.
+var defaultSubjectRulesExempt = []string{"_INBOX.>"}
+
+// subjectRules are the naming conventions the client connections of an
+// account have to follow to publish and subscribe. Wildcard tokens of the
+// subscriptions are not checked against the allowed characters.
+type subjectRules struct {
+	maxTokens    int
+	allowedChars string
+	allowed      *[256]bool
+	prefixes     []string
+	exempt       []string
+}
+
+// Parses a character class such as "a-z0-9_-" into the set of the allowed
+// bytes. A '-' that is not between two characters is a literal.
+func parseCharClass(class string) (*[256]bool, error) {
+	if class == _EMPTY_ {
+		return nil, fmt.Errorf("empty character class")
+	}
+	var set [256]bool
+	for i := 0; i < len(class); i++ {
+		from := class[i]
+		if i+2 < len(class) && class[i+1] == '-' {
+			to := class[i+2]
+			if to < from {
+				return nil, fmt.Errorf("invalid range %q", class[i:i+3])
+			}
+			for b := int(from); b <= int(to); b++ {
+				set[b] = true
+			}
+			i += 2
+			continue
+		}
+		set[from] = true
+	}
+	if set[btsep] || set[pwc] || set[fwc] || set[' '] {
+		return nil, fmt.Errorf("separators and wildcards can not be in the character class")
+	}
+	return &set, nil
+}
+
+// check returns an error describing the violated rule, if any.
+func (r *subjectRules) check(subject string) error {
+	for _, e := range r.exempt {
+		if subjectIsSubsetMatch(subject, e) {
+			return nil
+		}
+	}
+	if len(r.prefixes) > 0 {
+		var ok bool
+		for _, p := range r.prefixes {
+			if strings.HasPrefix(subject, p) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("subject must start with one of %q", r.prefixes)
+		}
+	}
+	tokens := strings.Split(subject, tsep)
+	if r.maxTokens > 0 && len(tokens) > r.maxTokens {
+		return fmt.Errorf("subject has %d tokens, maximum is %d", len(tokens), r.maxTokens)
+	}
+	if r.allowed != nil {
+		for _, t := range tokens {
+			if t == pwcs || t == fwcs {
+				continue
+			}
+			for i := 0; i < len(t); i++ {
+				if !r.allowed[t[i]] {
+					return fmt.Errorf("character %q is not in the allowed characters %q", t[i], r.allowedChars)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseSubjectRules parses the subject naming rules of an account.
+func parseSubjectRules(v interface{}, errors, warnings *[]error) (*subjectRules, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected map to define subject_rules, got %T", v)}
+	}
+	r := &subjectRules{exempt: defaultSubjectRulesExempt}
+	for mk, mv := range m {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "max_tokens":
+			max := mv.(int64)
+			if max < 0 {
+				return nil, &configErr{tk, "subject_rules max_tokens can not be negative"}
+			}
+			r.maxTokens = int(max)
+		case "allowed_chars", "allowed_characters":
+			r.allowedChars = mv.(string)
+			set, err := parseCharClass(r.allowedChars)
+			if err != nil {
+				return nil, &configErr{tk, fmt.Sprintf("invalid subject_rules allowed_chars: %v", err)}
+			}
+			r.allowed = set
+		case "prefixes", "required_prefixes":
+			switch pv := mv.(type) {
+			case string:
+				r.prefixes = append(r.prefixes, pv)
+			case []interface{}:
+				for _, p := range pv {
+					_, p = unwrapValue(p, &lt)
+					r.prefixes = append(r.prefixes, p.(string))
+				}
+			default:
+				return nil, &configErr{tk, fmt.Sprintf("Expected prefix or array of prefixes, got %T", mv)}
+			}
+		case "exempt":
+			exempt, err := parseSubjects(tk, errors, warnings)
+			if err != nil {
+				return nil, err
+			}
+			r.exempt = exempt
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Reported to the client as a permissions violation, which the client
+// libraries handle without closing the connection.
+func (c *client) subjectNamingViolation(op string, subject []byte, err error) {
+	c.sendErr(fmt.Sprintf("Permissions Violation for %s to %q, naming convention: %v", op, subject, err))
+	c.Errorf("Subject Naming Violation - %s, %s %q: %v", c.getAuthUser(), op, subject, err)
+}
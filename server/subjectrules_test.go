@@ -0,0 +1,171 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSubjectRulesCheck(t *testing.T) {
+	allowed, err := parseCharClass("a-z0-9_-")
+	if err != nil {
+		t.Fatalf("Error parsing character class: %v", err)
+	}
+	r := &subjectRules{
+		maxTokens:    4,
+		allowedChars: "a-z0-9_-",
+		allowed:      allowed,
+		prefixes:     []string{"orders.", "app."},
+		exempt:       defaultSubjectRulesExempt,
+	}
+	for subject, errTxt := range map[string]string{
+		"orders.created":         _EMPTY_,
+		"app.user-1.updated":     _EMPTY_,
+		"orders.*.created":       _EMPTY_,
+		"orders.>":               _EMPTY_,
+		"_INBOX.ABC.DEF.GHI.JKL": _EMPTY_,
+		"billing.created":        "must start with",
+		">":                      "must start with",
+		"orders.a.b.c.d":         "5 tokens",
+		"orders.Created":         "'C'",
+		"orders.created!":        "'!'",
+	} {
+		err := r.check(subject)
+		if errTxt == _EMPTY_ && err != nil {
+			t.Fatalf("Unexpected error for %q: %v", subject, err)
+		} else if errTxt != _EMPTY_ && (err == nil || !strings.Contains(err.Error(), errTxt)) {
+			t.Fatalf("Expected error with %q for %q, got %v", errTxt, subject, err)
+		}
+	}
+
+	for _, class := range []string{"", "z-a", "a-z.", "a-z*"} {
+		if _, err := parseCharClass(class); err == nil {
+			t.Fatalf("Expected an error for %q", class)
+		}
+	}
+}
+
+func TestSubjectRulesConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		accounts {
+			A {
+				subject_rules {
+					max_tokens: 6
+					allowed_chars: "a-z0-9_"
+					prefixes: ["orders.", "app."]
+				}
+			}
+			B { subject_rules { prefixes: "b.", exempt: ["_INBOX.>", "$SYS.>"] } }
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	for _, acc := range opts.Accounts {
+		r := acc.subjectRules
+		switch {
+		case acc.Name == "A" && r != nil && r.maxTokens == 6 && r.allowed != nil &&
+			len(r.prefixes) == 2 && len(r.exempt) == 1:
+		case acc.Name == "B" && r != nil && r.allowed == nil && len(r.prefixes) == 1 && len(r.exempt) == 2:
+		default:
+			t.Fatalf("Unexpected rules for %q: %+v", acc.Name, r)
+		}
+	}
+
+	for _, c := range []string{
+		`accounts { A { subject_rules: "orders." } }`,
+		`accounts { A { subject_rules { max_tokens: -1 } } }`,
+		`accounts { A { subject_rules { allowed_chars: "a-z." } } }`,
+		`accounts { A { subject_rules { exempt: "foo..bar" } } }`,
+		`accounts { A { subject_rules { foo: bar } } }`,
+	} {
+		conf := createConfFile(t, []byte(c))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil {
+			t.Fatalf("Expected an error for %q", c)
+		}
+	}
+}
+
+func TestSubjectRulesEnforced(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		port: -1
+		accounts {
+			A {
+				users: [{user: a, password: a}]
+				subject_rules { max_tokens: 3, allowed_chars: "a-z", prefixes: "orders." }
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 10)
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nc := natsConnect(t, url, nats.UserInfo("a", "a"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+
+	expectErr := func(txt string) {
+		t.Helper()
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "naming convention") || !strings.Contains(err.Error(), txt) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected an error")
+		}
+	}
+
+	sub := natsSubSync(t, nc, "orders.*")
+	natsSubSync(t, nc, "billing.*")
+	expectErr("must start with")
+	natsFlush(t, nc)
+	if n := s.NumSubscriptions(); n != 1 {
+		t.Fatalf("Expected 1 subscription, got %d", n)
+	}
+
+	natsPub(t, nc, "orders.created", []byte("ok"))
+	natsPub(t, nc, "orders.Created", []byte("bad"))
+	expectErr("'C'")
+	natsPub(t, nc, "orders.created.too.long", []byte("bad"))
+	expectErr("4 tokens")
+	natsFlush(t, nc)
+
+	msg := natsNexMsg(t, sub, time.Second)
+	if string(msg.Data) != "ok" {
+		t.Fatalf("Unexpected message: %q", msg.Data)
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message: %q", msg.Data)
+	}
+
+	// Requests still work with the inbox exempt from the rules.
+	natsSub(t, nc, "orders.get", func(m *nats.Msg) { m.Respond([]byte("reply")) })
+	if resp, err := nc.Request("orders.get", nil, time.Second); err != nil || string(resp.Data) != "reply" {
+		t.Fatalf("Unexpected response: %v %v", resp, err)
+	}
+}
@@ -16,6 +16,7 @@ package server
 import (
 	"bytes"
 	"errors"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -29,7 +30,9 @@ import (
 // Common byte variables for wildcards and token separator.
 const (
 	pwc   = '*'
+	pwcs  = "*"
 	fwc   = '>'
+	fwcs  = ">"
 	tsep  = "."
 	btsep = '.'
 )
@@ -47,6 +50,9 @@ const (
 	slCacheMax = 1024
 	// If we run a sweeper we will drain to this count.
 	slCacheSweep = 512
+	// Number of shards for the frontend cache, needs to be a power of 2.
+	// The limits above are split evenly across the shards.
+	slCacheShards = 16
 	// plistMin is our lower bounds to create a fast plist for Match.
 	plistMin = 256
 )
@@ -60,16 +66,53 @@ type SublistResult struct {
 // A Sublist stores and efficiently retrieves subscriptions.
 type Sublist struct {
 	sync.RWMutex
-	genid     uint64
-	matches   uint64
-	cacheHits uint64
-	inserts   uint64
-	removes   uint64
-	root      *level
-	cache     *sync.Map
-	cacheNum  int32
-	ccSweep   int32
-	count     uint32
+	genid       uint64
+	matches     uint64
+	cacheHits   uint64
+	cacheMisses uint64
+	inserts     uint64
+	removes     uint64
+	root        *level
+	lf          *slLockFree
+	cache       *slCache
+	cacheNum    int32
+	count       uint32
+}
+
+// slLockFree holds the two copies of the trie of a sublist with lock free
+// matches. Matches run on the active copy without taking the sublist lock.
+// Writers, holding the lock, update the inactive copy, make it the active
+// one, wait for the matches still running on the other copy and then
+// update it the same way.
+type slLockFree struct {
+	roots   [2]*level
+	readers [2]slReaders
+	active  uint32
+}
+
+// Number of matches running on a copy of the trie, padded to avoid
+// false sharing between the two copies.
+type slReaders struct {
+	n int64
+	_ [56]byte
+}
+
+// The frontend cache is sharded by subject hash so that matches for
+// different subjects do not contend on the same lock.
+type slCache struct {
+	shards [slCacheShards]slCacheShard
+}
+
+type slCacheShard struct {
+	sync.RWMutex
+	m map[string]*slCacheEntry
+}
+
+// Entries are marked as used when hit. The sweeper gives used entries
+// a second chance before evicting them.
+type slCacheEntry struct {
+	r    *SublistResult
+	used int32
 }
 
 // A node contains subscriptions and a pointer to the next level.
@@ -105,7 +148,7 @@ func newLevel() *level {
 // NewSublist will create a default sublist with caching enabled per the flag.
 func NewSublist(enableCache bool) *Sublist {
 	if enableCache {
-		return &Sublist{root: newLevel(), cache: &sync.Map{}}
+		return &Sublist{root: newLevel(), cache: newSlCache()}
 	}
 	return &Sublist{root: newLevel(), cacheNum: slNoCache}
 }
@@ -120,6 +163,54 @@ func NewSublistNoCache() *Sublist {
 	return NewSublist(false)
 }
 
+// NewSublistLockFree will create a sublist whose matches never wait for
+// inserts and removals, with caching enabled per the flag. This doubles
+// the memory used by the levels and nodes of the sublist, and inserts and
+// removals wait for the matches in progress.
+func NewSublistLockFree(enableCache bool) *Sublist {
+	s := NewSublist(enableCache)
+	s.lf = &slLockFree{roots: [2]*level{s.root, newLevel()}}
+	return s
+}
+
+// LockFree returns whether or not matches are lock free for this sublist.
+func (s *Sublist) LockFree() bool {
+	return s.lf != nil
+}
+
+// update applies the change to the trie, or to both its copies if matches
+// are lock free. Lock should be held.
+func (s *Sublist) update(change func(root *level) error) error {
+	lf := s.lf
+	if lf == nil {
+		return change(s.root)
+	}
+	i := atomic.LoadUint32(&lf.active)
+	err := change(lf.roots[i^1])
+	atomic.StoreUint32(&lf.active, i^1)
+	for atomic.LoadInt64(&lf.readers[i].n) != 0 {
+		runtime.Gosched()
+	}
+	change(lf.roots[i])
+	return err
+}
+
+// match matches the tokens against the active copy of the trie.
+func (lf *slLockFree) match(toks []string, results *SublistResult) {
+	for {
+		i := atomic.LoadUint32(&lf.active)
+		r := &lf.readers[i].n
+		atomic.AddInt64(r, 1)
+		// A writer may have switched copies before it could see us.
+		if atomic.LoadUint32(&lf.active) == i {
+			matchLevel(lf.roots[i], toks, results)
+			atomic.AddInt64(r, -1)
+			return
+		}
+		atomic.AddInt64(r, -1)
+	}
+}
+
 // CacheEnabled returns whether or not caching is enabled for this sublist.
 func (s *Sublist) CacheEnabled() bool {
 	return atomic.LoadInt32(&s.cacheNum) != slNoCache
@@ -142,14 +233,29 @@ func (s *Sublist) Insert(sub *subscription) error {
 
 	s.Lock()
 
+	if err := s.update(func(root *level) error { return insertInLevel(root, tokens, sub) }); err != nil {
+		s.Unlock()
+		return err
+	}
+
+	s.count++
+	s.inserts++
+
+	atomic.AddUint64(&s.genid, 1)
+	s.addToCache(subject, sub)
+
+	s.Unlock()
+	return nil
+}
+
+// insertInLevel adds the subscription to the trie.
+func insertInLevel(l *level, tokens []string, sub *subscription) error {
 	sfwc := false
-	l := s.root
 	var n *node
 
 	for _, t := range tokens {
 		lt := len(t)
 		if lt == 0 || sfwc {
-			s.Unlock()
 			return ErrInvalidSubject
 		}
 
@@ -210,14 +316,6 @@ func (s *Sublist) Insert(sub *subscription) error {
 		}
 		subs[sub] = sub
 	}
-
-	s.count++
-	s.inserts++
-
-	s.addToCache(subject, sub)
-	atomic.AddUint64(&s.genid, 1)
-
-	s.Unlock()
 	return nil
 }
 
@@ -248,6 +346,92 @@ func (r *SublistResult) addSubToResult(sub *subscription) *SublistResult {
 	return nr
 }
 
+func newSlCache() *slCache {
+	c := &slCache{}
+	for i := range c.shards {
+		c.shards[i].m = make(map[string]*slCacheEntry)
+	}
+	return c
+}
+
+// Returns the shard for this subject using FNV-1a.
+func (c *slCache) shard(subject string) *slCacheShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(subject); i++ {
+		h ^= uint32(subject[i])
+		h *= 16777619
+	}
+	return &c.shards[h&(slCacheShards-1)]
+}
+
+// get returns the cached result for this subject, if any.
+func (c *slCache) get(subject string) (*SublistResult, bool) {
+	sh := c.shard(subject)
+	sh.RLock()
+	e := sh.m[subject]
+	var r *SublistResult
+	if e != nil {
+		r = e.r
+	}
+	sh.RUnlock()
+	if e == nil {
+		return nil, false
+	}
+	if atomic.LoadInt32(&e.used) == 0 {
+		atomic.StoreInt32(&e.used, 1)
+	}
+	return r, true
+}
+
+// put stores the result for this subject, sweeping the shard if it went
+// over its limit. If genid is not nil, the result is only stored if genid
+// still has the expected value. Returns the change in the number of cached
+// entries.
+func (c *slCache) put(subject string, r *SublistResult, genid *uint64, expected uint64) int32 {
+	sh := c.shard(subject)
+	sh.Lock()
+	defer sh.Unlock()
+	// Writers update genid before the cache, so a result computed before
+	// their change is either not stored or fixed by them.
+	if genid != nil && atomic.LoadUint64(genid) != expected {
+		return 0
+	}
+	if e := sh.m[subject]; e != nil {
+		e.r = r
+		return 0
+	}
+	sh.m[subject] = &slCacheEntry{r: r}
+	if len(sh.m) <= slCacheMax/slCacheShards {
+		return 1
+	}
+	return 1 - sh.sweep(slCacheSweep/slCacheShards)
+}
+
+// Evicts entries until we are down to max, preferring entries that have
+// not been used since the last sweep. Returns the number evicted.
+// Shard lock is held on entry.
+func (sh *slCacheShard) sweep(max int) int32 {
+	var n int32
+	for key, e := range sh.m {
+		if len(sh.m) <= max {
+			return n
+		}
+		if atomic.SwapInt32(&e.used, 0) == 0 {
+			delete(sh.m, key)
+			n++
+		}
+	}
+	// Everything was used, so evict in map order.
+	for key := range sh.m {
+		if len(sh.m) <= max {
+			break
+		}
+		delete(sh.m, key)
+		n++
+	}
+	return n
+}
+
 // addToCache will add the new entry to the existing cache
 // entries if needed. Assumes write lock is held.
 func (s *Sublist) addToCache(subject string, sub *subscription) {
@@ -256,20 +440,24 @@ func (s *Sublist) addToCache(subject string, sub *subscription) {
 	}
 	// If literal we can direct match.
 	if subjectIsLiteral(subject) {
-		if v, ok := s.cache.Load(subject); ok {
-			r := v.(*SublistResult)
-			s.cache.Store(subject, r.addSubToResult(sub))
+		sh := s.cache.shard(subject)
+		sh.Lock()
+		if e := sh.m[subject]; e != nil {
+			e.r = e.r.addSubToResult(sub)
 		}
+		sh.Unlock()
 		return
 	}
-	s.cache.Range(func(k, v interface{}) bool {
-		key := k.(string)
-		r := v.(*SublistResult)
-		if matchLiteral(key, subject) {
-			s.cache.Store(key, r.addSubToResult(sub))
+	for i := range s.cache.shards {
+		sh := &s.cache.shards[i]
+		sh.Lock()
+		for key, e := range sh.m {
+			if matchLiteral(key, subject) {
+				e.r = e.r.addSubToResult(sub)
+			}
 		}
-		return true
-	})
+		sh.Unlock()
+	}
 }
 
 // removeFromCache will remove the sub from any active cache entries.
@@ -280,23 +468,28 @@ func (s *Sublist) removeFromCache(subject string, sub *subscription) {
 	}
 	// If literal we can direct match.
 	if subjectIsLiteral(subject) {
-		// Load for accounting
-		if _, ok := s.cache.Load(subject); ok {
-			s.cache.Delete(subject)
+		sh := s.cache.shard(subject)
+		sh.Lock()
+		if _, ok := sh.m[subject]; ok {
+			delete(sh.m, subject)
 			atomic.AddInt32(&s.cacheNum, -1)
 		}
+		sh.Unlock()
 		return
 	}
-	s.cache.Range(func(k, v interface{}) bool {
-		key := k.(string)
-		if matchLiteral(key, subject) {
-			// Since someone else may be referecing, can't modify the list
-			// safely, just let it re-populate.
-			s.cache.Delete(key)
-			atomic.AddInt32(&s.cacheNum, -1)
+	for i := range s.cache.shards {
+		sh := &s.cache.shards[i]
+		sh.Lock()
+		for key := range sh.m {
+			if matchLiteral(key, subject) {
+				// Since someone else may be referecing, can't modify the list
+				// safely, just let it re-populate.
+				delete(sh.m, key)
+				atomic.AddInt32(&s.cacheNum, -1)
+			}
 		}
-		return true
-	})
+		sh.Unlock()
+	}
 }
 
 // a place holder for an empty result.
@@ -309,11 +502,14 @@ func (s *Sublist) Match(subject string) *SublistResult {
 
 	// Check cache first.
 	if atomic.LoadInt32(&s.cacheNum) > 0 {
-		if r, ok := s.cache.Load(subject); ok {
+		if r, ok := s.cache.get(subject); ok {
 			atomic.AddUint64(&s.cacheHits, 1)
-			return r.(*SublistResult)
+			return r
 		}
 	}
+	if s.cache != nil {
+		atomic.AddUint64(&s.cacheMisses, 1)
+	}
 
 	tsa := [32]string{}
 	tokens := tsa[:0]
@@ -330,43 +526,38 @@ func (s *Sublist) Match(subject string) *SublistResult {
 	result := &SublistResult{}
 
 	// Get result from the main structure and place into the shared cache.
-	// Hold the read lock to avoid race between match and store.
-	var n int32
-
-	s.RLock()
-	matchLevel(s.root, tokens, result)
+	// Hold the read lock to avoid race between match and store. Lock free
+	// matches instead only store the result if no writer updated the
+	// sublist since the match started.
+	var genid uint64
+	if s.lf == nil {
+		s.RLock()
+		matchLevel(s.root, tokens, result)
+	} else {
+		genid = atomic.LoadUint64(&s.genid)
+		s.lf.match(tokens, result)
+	}
 	// Check for empty result.
 	if len(result.psubs) == 0 && len(result.qsubs) == 0 {
 		result = emptyResult
 	}
 	if s.cache != nil {
-		s.cache.Store(subject, result)
-		n = atomic.AddInt32(&s.cacheNum, 1)
+		var sgenid *uint64
+		if s.lf != nil {
+			sgenid = &s.genid
+		}
+		// The shard is swept inline if it goes over its share of the maximum.
+		if n := s.cache.put(subject, result, sgenid, genid); n != 0 {
+			atomic.AddInt32(&s.cacheNum, n)
+		}
 	}
-	s.RUnlock()
-
-	// Reduce the cache count if we have exceeded our set maximum.
-	if n > slCacheMax && atomic.CompareAndSwapInt32(&s.ccSweep, 0, 1) {
-		go s.reduceCacheCount()
+	if s.lf == nil {
+		s.RUnlock()
 	}
 
 	return result
 }
 
-// Remove entries in the cache until we are under the maximum.
-// TODO(dlc) this could be smarter now that its not inline.
-func (s *Sublist) reduceCacheCount() {
-	defer atomic.StoreInt32(&s.ccSweep, 0)
-	// If we are over the cache limit randomly drop until under the limit.
-	s.Lock()
-	s.cache.Range(func(k, v interface{}) bool {
-		s.cache.Delete(k.(string))
-		n := atomic.AddInt32(&s.cacheNum, -1)
-		return n >= slCacheSweep
-	})
-	s.Unlock()
-}
-
 // Helper function for auto-expanding remote qsubs.
 func isRemoteQSub(sub *subscription) bool {
 	return sub != nil && sub.queue != nil && sub.client != nil && sub.client.kind == ROUTER
@@ -379,8 +570,8 @@ func (s *Sublist) UpdateRemoteQSub(sub *subscription) {
 	// it unless we are thrashing the cache. Just remove from our L2 and update
 	// the genid so L1 will be flushed.
 	s.Lock()
-	s.removeFromCache(string(sub.subject), sub)
 	atomic.AddUint64(&s.genid, 1)
+	s.removeFromCache(string(sub.subject), sub)
 	s.Unlock()
 }
 
@@ -490,8 +681,23 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
 		defer s.Unlock()
 	}
 
+	if err := s.update(func(root *level) error { return s.removeFromLevel(root, tokens, sub) }); err != nil {
+		return err
+	}
+
+	s.count--
+	s.removes++
+
+	atomic.AddUint64(&s.genid, 1)
+	s.removeFromCache(subject, sub)
+
+	return nil
+}
+
+// removeFromLevel removes the subscription from the trie, pruning the
+// nodes left empty.
+func (s *Sublist) removeFromLevel(l *level, tokens []string, sub *subscription) error {
 	sfwc := false
-	l := s.root
 	var n *node
 
 	// Track levels for pruning
@@ -530,18 +736,12 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
 		return ErrNotFound
 	}
 
-	s.count--
-	s.removes++
-
 	for i := len(levels) - 1; i >= 0; i-- {
 		l, n, t := levels[i].l, levels[i].n, levels[i].t
 		if n.isEmpty() {
 			l.pruneNode(n, t)
 		}
 	}
-	s.removeFromCache(subject, sub)
-	atomic.AddUint64(&s.genid, 1)
-
 	return nil
 }
 
@@ -552,24 +752,36 @@ func (s *Sublist) Remove(sub *subscription) error {
 
 // RemoveBatch will remove a list of subscriptions.
 func (s *Sublist) RemoveBatch(subs []*subscription) error {
+	_, err := s.removeBatch(subs)
+	return err
+}
+
+// removeBatch removes a list of subscriptions and returns how many were
+// actually removed. The ones no longer there are skipped, and the first
+// error is returned.
+func (s *Sublist) removeBatch(subs []*subscription) (int, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	var err error
+	removed := 0
 	for _, sub := range subs {
-		if err := s.remove(sub, false); err != nil {
-			return err
+		if rerr := s.remove(sub, false); rerr != nil {
+			if err == nil {
+				err = rerr
+			}
+			continue
 		}
+		removed++
 	}
-	return nil
+	return removed, err
 }
 
-func (s *Sublist) checkNodeForClientSubs(n *node, c *client) {
-	var removed uint32
+func (s *Sublist) checkNodeForClientSubs(n *node, c *client, removed *[]*subscription) {
 	for _, sub := range n.psubs {
 		if sub.client == c {
 			if s.removeFromNode(n, sub) {
-				s.removeFromCache(string(sub.subject), sub)
-				removed++
+				*removed = append(*removed, sub)
 			}
 		}
 	}
@@ -578,38 +790,45 @@ func (s *Sublist) checkNodeForClientSubs(n *node, c *client) {
 		for _, sub := range qr {
 			if sub.client == c {
 				if s.removeFromNode(n, sub) {
-					s.removeFromCache(string(sub.subject), sub)
-					removed++
+					*removed = append(*removed, sub)
 				}
 			}
 		}
 	}
-	s.count -= removed
-	s.removes += uint64(removed)
 }
 
-func (s *Sublist) removeClientSubs(l *level, c *client) {
+func (s *Sublist) removeClientSubs(l *level, c *client, removed *[]*subscription) {
 	for _, n := range l.nodes {
-		s.checkNodeForClientSubs(n, c)
-		s.removeClientSubs(n.next, c)
+		s.checkNodeForClientSubs(n, c, removed)
+		s.removeClientSubs(n.next, c, removed)
 	}
 	if l.pwc != nil {
-		s.checkNodeForClientSubs(l.pwc, c)
-		s.removeClientSubs(l.pwc.next, c)
+		s.checkNodeForClientSubs(l.pwc, c, removed)
+		s.removeClientSubs(l.pwc.next, c, removed)
 	}
 	if l.fwc != nil {
-		s.checkNodeForClientSubs(l.fwc, c)
-		s.removeClientSubs(l.fwc.next, c)
+		s.checkNodeForClientSubs(l.fwc, c, removed)
+		s.removeClientSubs(l.fwc.next, c, removed)
 	}
 }
 
 // RemoveAllForClient will remove all subscriptions for a given client.
 func (s *Sublist) RemoveAllForClient(c *client) {
+	var removed []*subscription
 	s.Lock()
-	removes := s.removes
-	s.removeClientSubs(s.root, c)
-	if s.removes != removes {
+	s.update(func(root *level) error {
+		// The same subscriptions are removed from both copies.
+		removed = removed[:0]
+		s.removeClientSubs(root, c, &removed)
+		return nil
+	})
+	if len(removed) > 0 {
+		s.count -= uint32(len(removed))
+		s.removes += uint64(len(removed))
 		atomic.AddUint64(&s.genid, 1)
+		for _, sub := range removed {
+			s.removeFromCache(string(sub.subject), sub)
+		}
 	}
 	s.Unlock()
 }
@@ -697,6 +916,8 @@ type SublistStats struct {
 	NumInserts   uint64  `json:"num_inserts"`
 	NumRemoves   uint64  `json:"num_removes"`
 	NumMatches   uint64  `json:"num_matches"`
+	CacheHits    uint64  `json:"cache_hits"`
+	CacheMisses  uint64  `json:"cache_misses"`
 	CacheHitRate float64 `json:"cache_hit_rate"`
 	MaxFanout    uint32  `json:"max_fanout"`
 	AvgFanout    float64 `json:"avg_fanout"`
@@ -717,24 +938,29 @@ func (s *Sublist) Stats() *SublistStats {
 		st.NumCache = uint32(cn)
 	}
 	st.NumMatches = atomic.LoadUint64(&s.matches)
+	st.CacheHits = atomic.LoadUint64(&s.cacheHits)
+	st.CacheMisses = atomic.LoadUint64(&s.cacheMisses)
 	if st.NumMatches > 0 {
-		st.CacheHitRate = float64(atomic.LoadUint64(&s.cacheHits)) / float64(st.NumMatches)
+		st.CacheHitRate = float64(st.CacheHits) / float64(st.NumMatches)
 	}
 
 	// whip through cache for fanout stats, this can be off if cache is full and doing evictions.
 	// If this is called frequently, which it should not be, this could hurt performance.
 	if cache != nil {
 		tot, max, clen := 0, 0, 0
-		s.cache.Range(func(k, v interface{}) bool {
-			clen++
-			r := v.(*SublistResult)
-			l := len(r.psubs) + len(r.qsubs)
-			tot += l
-			if l > max {
-				max = l
+		for i := range cache.shards {
+			sh := &cache.shards[i]
+			sh.RLock()
+			for _, e := range sh.m {
+				clen++
+				l := len(e.r.psubs) + len(e.r.qsubs)
+				tot += l
+				if l > max {
+					max = l
+				}
 			}
-			return true
-		})
+			sh.RUnlock()
+		}
 		st.MaxFanout = uint32(max)
 		if tot > 0 {
 			st.AvgFanout = float64(tot) / float64(clen)
@@ -830,19 +1056,23 @@ func IsValidSubject(subject string) bool {
 }
 
 // IsValidLiteralSubject returns true if a subject is valid and literal (no wildcards), false otherwise
+// This is called for every publish from pedantic clients, so avoid allocations.
 func IsValidLiteralSubject(subject string) bool {
-	tokens := strings.Split(subject, tsep)
-	for _, t := range tokens {
-		if len(t) == 0 {
-			return false
-		}
-		if len(t) > 1 {
+	start := 0
+	for i := 0; i <= len(subject); i++ {
+		if i < len(subject) && subject[i] != btsep {
 			continue
 		}
-		switch t[0] {
-		case pwc, fwc:
+		switch i - start {
+		case 0:
 			return false
+		case 1:
+			switch subject[start] {
+			case pwc, fwc:
+				return false
+			}
 		}
+		start = i + 1
 	}
 	return true
 }
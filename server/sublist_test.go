@@ -595,6 +595,12 @@ func TestSublistValidLiteralSubjects(t *testing.T) {
 	checkBool(IsValidLiteralSubject("foo.>bar"), true, t)
 	checkBool(IsValidLiteralSubject("foo>.bar"), true, t)
 	checkBool(IsValidLiteralSubject(">bar"), true, t)
+	checkBool(IsValidLiteralSubject(""), false, t)
+
+	// This is in the publish path of pedantic clients.
+	if n := testing.AllocsPerRun(100, func() { IsValidLiteralSubject("foo.bar.baz") }); n != 0 {
+		t.Fatalf("Expected no allocations, got %v", n)
+	}
 }
 
 func TestSublistValidlSubjects(t *testing.T) {
@@ -1008,6 +1014,101 @@ func TestSublistSharedEmptyResult(t *testing.T) {
 	}
 }
 
+func TestSublistLockFree(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		f    func(*testing.T, *Sublist)
+	}{
+		{"InsertCount", testSublistInsertCount},
+		{"Simple", testSublistSimple},
+		{"PartialWildcard", testSublistPartialWildcard},
+		{"FullWildcard", testSublistFullWildcard},
+		{"Remove", testSublistRemove},
+		{"RemoveWildcard", testSublistRemoveWildcard},
+		{"RemoveCleanup", testSublistRemoveCleanup},
+		{"RemoveCleanupWildcards", testSublistRemoveCleanupWildcards},
+		{"RemoveWithLargeSubs", testSublistRemoveWithLargeSubs},
+		{"RemoveByClient", testSublistRemoveByClient},
+		{"InvalidSubjectsInsert", testSublistInvalidSubjectsInsert},
+		{"BasicQueueResults", testSublistBasicQueueResults},
+		{"BadSubjectOnRemove", testSublistBadSubjectOnRemove},
+		{"RaceOnRemove", testSublistRaceOnRemove},
+		{"RaceOnInsert", testSublistRaceOnInsert},
+		{"RemoteQueueSubscriptions", testSublistRemoteQueueSubscriptions},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.f(t, NewSublistLockFree(true))
+		})
+		t.Run(test.name+"NoCache", func(t *testing.T) {
+			test.f(t, NewSublistLockFree(false))
+		})
+	}
+}
+
+func TestSublistLockFreeMatchDuringUpdates(t *testing.T) {
+	s := NewSublistLockFree(true)
+	// Always present, so every match must return it.
+	stable := newSub("foo.*")
+	s.Insert(stable)
+
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			sub := newSub(fmt.Sprintf("foo.%d", i%100))
+			s.Insert(sub)
+			s.Remove(sub)
+		}
+	}()
+	for i := 0; i < 50000; i++ {
+		r := s.Match(fmt.Sprintf("foo.%d", i%100))
+		found := false
+		for _, sub := range r.psubs {
+			if sub == stable {
+				found = true
+			}
+		}
+		if !found || len(r.psubs) > 2 {
+			close(quit)
+			wg.Wait()
+			t.Fatalf("Unexpected result on iteration %d: %+v", i, r.psubs)
+		}
+	}
+	close(quit)
+	wg.Wait()
+
+	// Once writers are done, cached results must be consistent.
+	for i := 0; i < 100; i++ {
+		if r := s.Match(fmt.Sprintf("foo.%d", i)); len(r.psubs) != 1 {
+			t.Fatalf("Expected only the wildcard subscription, got %d results", len(r.psubs))
+		}
+	}
+	verifyCount(s, 1, t)
+}
+
+func TestSublistLockFreeAccounts(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		lock_free_sublist: true
+		no_sublist_cache: true
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	sl := s.globalAccount().sl
+	if !sl.LockFree() || sl.CacheEnabled() {
+		t.Fatalf("Expected lock free sublist without cache")
+	}
+}
+
 func TestSublistNoCacheStats(t *testing.T) {
 	s := NewSublistNoCache()
 	s.Insert(newSub("foo"))
@@ -1022,6 +1123,48 @@ func TestSublistNoCacheStats(t *testing.T) {
 	}
 }
 
+func TestSublistCacheStats(t *testing.T) {
+	s := NewSublistWithCache()
+	s.Insert(newSub("foo"))
+	s.Match("foo")
+	s.Match("foo")
+	s.Match("bar")
+	stats := s.Stats()
+	if stats.CacheHits != 1 || stats.CacheMisses != 2 {
+		t.Fatalf("Expected 1 hit and 2 misses, got %d and %d", stats.CacheHits, stats.CacheMisses)
+	}
+	if stats.NumCache != 2 {
+		t.Fatalf("Expected 2 for NumCache stat, got %d", stats.NumCache)
+	}
+}
+
+func TestSublistCacheSweepKeepsUsedEntries(t *testing.T) {
+	s := NewSublistWithCache()
+	s.Insert(newSub("hot"))
+	s.Match("hot")
+	n := 10 * slCacheMax
+	for i := 0; i < n; i++ {
+		s.Match(fmt.Sprintf("cold.%d", i))
+		s.Match("hot")
+	}
+	stats := s.Stats()
+	// Only the first match on the hot subject should have missed.
+	if stats.CacheHits != uint64(n) || stats.CacheMisses != uint64(n+1) {
+		t.Fatalf("Expected %d hits and %d misses, got %d and %d", n, n+1, stats.CacheHits, stats.CacheMisses)
+	}
+	if cc := s.CacheCount(); cc > slCacheMax {
+		t.Fatalf("Cache should be constrained by cacheMax, got %d", cc)
+	}
+	// The count needs to match what is in the shards.
+	total := 0
+	for i := range s.cache.shards {
+		total += len(s.cache.shards[i].m)
+	}
+	if total != s.CacheCount() {
+		t.Fatalf("Expected cache count of %d, got %d", total, s.CacheCount())
+	}
+}
+
 func TestSublistAll(t *testing.T) {
 	s := NewSublistNoCache()
 	subs := []*subscription{
@@ -1366,7 +1509,7 @@ func Benchmark___SublistRemove1kBatch2TokensMulti(b *testing.B) {
 }
 
 // Cache contention tests
-func cacheContentionTest(b *testing.B, numMatchers, numAdders, numRemovers int) {
+func cacheContentionTest(b *testing.B, numMatchers, numAdders, numRemovers int, lockFree bool) {
 	var swg, fwg, mwg sync.WaitGroup
 	total := numMatchers + numAdders + numRemovers
 	swg.Add(total)
@@ -1380,6 +1523,9 @@ func cacheContentionTest(b *testing.B, numMatchers, numAdders, numRemovers int)
 
 	// Set up a new sublist. subjects will be foo.bar.baz.N
 	s := NewSublistWithCache()
+	if lockFree {
+		s = NewSublistLockFree(true)
+	}
 	mu.Lock()
 	for i := 0; i < 10000; i++ {
 		sub := newSub(fmt.Sprintf("foo.bar.baz.%d", i))
@@ -1468,19 +1614,90 @@ func cacheContentionTest(b *testing.B, numMatchers, numAdders, numRemovers int)
 }
 
 func Benchmark____SublistCacheContention10M10A10R(b *testing.B) {
-	cacheContentionTest(b, 10, 10, 10)
+	cacheContentionTest(b, 10, 10, 10, false)
 }
 
 func Benchmark_SublistCacheContention100M100A100R(b *testing.B) {
-	cacheContentionTest(b, 100, 100, 100)
+	cacheContentionTest(b, 100, 100, 100, false)
 }
 
 func Benchmark____SublistCacheContention1kM1kA1kR(b *testing.B) {
-	cacheContentionTest(b, 1024, 1024, 1024)
+	cacheContentionTest(b, 1024, 1024, 1024, false)
 }
 
 func Benchmark_SublistCacheContention10kM10kA10kR(b *testing.B) {
-	cacheContentionTest(b, 10*1024, 10*1024, 10*1024)
+	cacheContentionTest(b, 10*1024, 10*1024, 10*1024, false)
+}
+
+func Benchmark______SublistLFContention10M10A10R(b *testing.B) {
+	cacheContentionTest(b, 10, 10, 10, true)
+}
+
+func Benchmark____SublistLFContention100M100A100R(b *testing.B) {
+	cacheContentionTest(b, 100, 100, 100, true)
+}
+
+func Benchmark______SublistLFContention1kM1kA1kR(b *testing.B) {
+	cacheContentionTest(b, 1024, 1024, 1024, true)
+}
+
+// Matches missing the cache while a single writer inserts and removes.
+func sublistMatchDuringUpdates(b *testing.B, s *Sublist) {
+	for i := 0; i < 100000; i++ {
+		s.Insert(newSub(fmt.Sprintf("foo.bar.%d", i)))
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			sub := newSub(fmt.Sprintf("foo.baz.%d", i))
+			s.Insert(sub)
+			s.Remove(sub)
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(100000)
+		for pb.Next() {
+			s.Match("foo.bar." + strconv.Itoa(i%100000))
+			i++
+		}
+	})
+	b.StopTimer()
+	close(quit)
+	<-done
+}
+
+func Benchmark___________SublistMatchDuringUpdates(b *testing.B) {
+	sublistMatchDuringUpdates(b, NewSublistNoCache())
+}
+
+func Benchmark_________SublistLFMatchDuringUpdates(b *testing.B) {
+	sublistMatchDuringUpdates(b, NewSublistLockFree(false))
+}
+
+func Benchmark___________SublistMatchParallelCached(b *testing.B) {
+	s := NewSublistWithCache()
+	subjects := make([]string, slCacheSweep)
+	for i := range subjects {
+		subjects[i] = fmt.Sprintf("foo.bar.%d", i)
+		s.Insert(newSub(subjects[i]))
+		s.Match(subjects[i])
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(len(subjects))
+		for pb.Next() {
+			s.Match(subjects[i%len(subjects)])
+			i++
+		}
+	})
 }
 
 func Benchmark______________IsValidLiteralSubject(b *testing.B) {
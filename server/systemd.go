@@ -0,0 +1,107 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How long to wait for the explicit routes to be connected before
+// reporting the server as ready to systemd.
+const sdRoutesWait = 10 * time.Second
+
+// sdNotify sends a state notification to systemd. This is a no-op if the
+// server was not started by a unit of Type=notify.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == _EMPTY_ {
+		return nil
+	}
+	// A leading '@' denotes a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often keepalives need to be sent to
+// systemd, or 0 if the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != _EMPTY_ && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// Notify at half the timeout, as recommended by sd_watchdog_enabled(3).
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startSystemdNotify reports the server as ready to systemd once the
+// listeners are up and the explicit routes are connected, then keeps
+// the watchdog, if any, fed until shutdown.
+func (s *Server) startSystemdNotify() {
+	if os.Getenv("NOTIFY_SOCKET") == _EMPTY_ {
+		return
+	}
+	opts := s.getOpts()
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(25 * time.Millisecond)
+		defer t.Stop()
+		routesDeadline := time.Now().Add(sdRoutesWait)
+		for !s.readyForConnections() ||
+			(s.NumRoutes() < len(opts.Routes) && time.Now().Before(routesDeadline)) {
+			select {
+			case <-t.C:
+			case <-s.quitCh:
+				return
+			}
+		}
+		if err := sdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())); err != nil {
+			s.Warnf("Error notifying systemd: %v", err)
+			return
+		}
+
+		interval := sdWatchdogInterval()
+		if interval == 0 {
+			return
+		}
+		wt := time.NewTicker(interval)
+		defer wt.Stop()
+		for {
+			select {
+			case <-wt.C:
+				// Grabbing the server lock makes sure that a server
+				// stuck on it is reported as unresponsive.
+				s.mu.Lock()
+				s.mu.Unlock()
+				sdNotify("WATCHDOG=1")
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	os.Setenv("WATCHDOG_USEC", "100000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	expect := func(state string) {
+		t.Helper()
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Error reading notification %q: %v", state, err)
+		}
+		if got := string(buf[:n]); !strings.HasPrefix(got, state) {
+			t.Fatalf("Expected notification %q, got %q", state, got)
+		}
+	}
+
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	expect("READY=1")
+	expect("WATCHDOG=1")
+	expect("WATCHDOG=1")
+
+	s.Shutdown()
+	// A keepalive may have been sent before shutting down.
+	for {
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Error reading notification: %v", err)
+		}
+		if got := string(buf[:n]); got == "STOPPING=1" {
+			break
+		} else if got != "WATCHDOG=1" {
+			t.Fatalf("Unexpected notification %q", got)
+		}
+	}
+}
+
+func TestSystemdWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "2000000")
+	if d := sdWatchdogInterval(); d != time.Second {
+		t.Fatalf("Expected 1s, got %v", d)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	if d := sdWatchdogInterval(); d != 0 {
+		t.Fatalf("Expected watchdog to be disabled for another pid, got %v", d)
+	}
+	os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "bad")
+	if d := sdWatchdogInterval(); d != 0 {
+		t.Fatalf("Expected watchdog to be disabled, got %v", d)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errTLSHandshakeQueueTimeout = errors.New("timeout waiting for a TLS handshake slot")
+
+// tlsHandshakes bounds the TLS handshakes of the accepted connections
+// performed concurrently, and keeps their metrics. The counters are
+// accessed atomically.
+type tlsHandshakes struct {
+	active    int64
+	queued    int64
+	completed int64
+	failed    int64
+	// Total time spent waiting for a slot, and handshaking, in nanoseconds.
+	waitTime      int64
+	handshakeTime int64
+
+	// Handshake slots, nil if not bounded.
+	slots chan struct{}
+}
+
+func newTLSHandshakes(max int) *tlsHandshakes {
+	hs := &tlsHandshakes{}
+	if max > 0 {
+		hs.slots = make(chan struct{}, max)
+	}
+	return hs
+}
+
+// tlsHandshake performs the handshake of an accepted TLS connection once a
+// slot is available, so that a flood of new connections can not take the
+// CPU from the established ones. The wait counts in the handshake timeout.
+func (s *Server) tlsHandshake(conn *tls.Conn, timeout time.Duration) error {
+	hs := s.tlsHandshakes
+	if hs == nil {
+		return conn.Handshake()
+	}
+	start := time.Now()
+	if hs.slots != nil {
+		atomic.AddInt64(&hs.queued, 1)
+		t := time.NewTimer(timeout)
+		var err error
+		select {
+		case hs.slots <- struct{}{}:
+		case <-t.C:
+			err = errTLSHandshakeQueueTimeout
+		case <-s.quitCh:
+			err = ErrServerNotRunning
+		}
+		t.Stop()
+		atomic.AddInt64(&hs.queued, -1)
+		if err != nil {
+			atomic.AddInt64(&hs.waitTime, int64(time.Since(start)))
+			atomic.AddInt64(&hs.failed, 1)
+			return err
+		}
+		defer func() { <-hs.slots }()
+	}
+	began := time.Now()
+	atomic.AddInt64(&hs.active, 1)
+	err := conn.Handshake()
+	atomic.AddInt64(&hs.active, -1)
+	atomic.AddInt64(&hs.waitTime, int64(began.Sub(start)))
+	atomic.AddInt64(&hs.handshakeTime, int64(time.Since(began)))
+	if err != nil {
+		atomic.AddInt64(&hs.failed, 1)
+	} else {
+		atomic.AddInt64(&hs.completed, 1)
+	}
+	return err
+}
+
+// TLSHandshakeVarz contains the metrics of the TLS handshakes of the
+// accepted connections.
+type TLSHandshakeVarz struct {
+	Limit      int           `json:"limit,omitempty"`
+	Active     int64         `json:"active"`
+	Queued     int64         `json:"queued"`
+	Completed  int64         `json:"completed"`
+	Failed     int64         `json:"failed"`
+	AvgWait    time.Duration `json:"avg_wait"`
+	AvgLatency time.Duration `json:"avg_latency"`
+}
+
+// tlsHandshakeVarz returns the metrics of the TLS handshakes, nil if no
+// handshake was performed and they are not bounded.
+func (s *Server) tlsHandshakeVarz() *TLSHandshakeVarz {
+	hs := s.tlsHandshakes
+	if hs == nil {
+		return nil
+	}
+	v := &TLSHandshakeVarz{
+		Limit:     cap(hs.slots),
+		Active:    atomic.LoadInt64(&hs.active),
+		Queued:    atomic.LoadInt64(&hs.queued),
+		Completed: atomic.LoadInt64(&hs.completed),
+		Failed:    atomic.LoadInt64(&hs.failed),
+	}
+	if n := v.Completed + v.Failed; n > 0 {
+		v.AvgWait = time.Duration(atomic.LoadInt64(&hs.waitTime) / n)
+		v.AvgLatency = time.Duration(atomic.LoadInt64(&hs.handshakeTime) / n)
+	} else if v.Limit == 0 && v.Active == 0 {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTLSHandshakesConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`max_tls_handshakes: 16`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.MaxTLSHandshakes != 16 {
+		t.Fatalf("Unexpected max TLS handshakes: %d", opts.MaxTLSHandshakes)
+	}
+	opts = DefaultOptions()
+	opts.MaxTLSHandshakes = -1
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected an error for negative max TLS handshakes")
+	}
+}
+
+func TestTLSHandshakesLimit(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/tls.conf")
+	if err != nil {
+		t.Fatalf("Error processing config file: %v", err)
+	}
+	opts.Port = -1
+	opts.NoLog, opts.NoSigs = true, true
+	opts.MaxTLSHandshakes = 1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// Connects and reads the INFO, sent before the handshake.
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		return conn
+	}
+	checkHandshakes := func(check func(v *TLSHandshakeVarz) bool) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			v, _ := s.Varz(nil)
+			if v.TLSHandshakes == nil || !check(v.TLSHandshakes) {
+				return fmt.Errorf("unexpected TLS handshakes: %+v", v.TLSHandshakes)
+			}
+			return nil
+		})
+	}
+
+	// A client that does not handshake holds the only slot.
+	stalled := dial()
+	checkHandshakes(func(v *TLSHandshakeVarz) bool { return v.Limit == 1 && v.Active == 1 })
+
+	errCh := make(chan error, 1)
+	go func() {
+		tc := tls.Client(dial(), &tls.Config{InsecureSkipVerify: true})
+		defer tc.Close()
+		errCh <- tc.Handshake()
+	}()
+	checkHandshakes(func(v *TLSHandshakeVarz) bool { return v.Queued == 1 })
+
+	stalled.Close()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Error on handshake: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for the handshake")
+	}
+	checkHandshakes(func(v *TLSHandshakeVarz) bool {
+		return v.Completed == 1 && v.Failed == 1 && v.Queued == 0 && v.AvgWait > 0
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Number of subjects tracked per account by default.
+	defaultTrafficTopSubjects = 10
+	// Upper limit of the subjects tracked per account, since each
+	// untracked subject replaces the least published one.
+	maxTrafficTopSubjects = 10000
+)
+
+// Upper bounds, inclusive, of the buckets of the payload size histogram.
+// The last bucket counts the larger payloads.
+var trafficSizeBuckets = [...]int{0, 64, 256, 1024, 4096, 16 * 1024, 64 * 1024, 256 * 1024, 1024 * 1024}
+
+// accountTraffic holds the traffic analytics of an account.
+type accountTraffic struct {
+	sync.Mutex
+	msgs  uint64
+	bytes uint64
+	sizes [len(trafficSizeBuckets) + 1]uint64
+	top   *topSubjects
+}
+
+// topSubjects estimates the most published subjects with the space-saving
+// algorithm: up to k subjects are counted and a subject that is not yet
+// counted replaces the one with the lowest count, inheriting that count as
+// its overestimation error.
+type topSubjects struct {
+	k        int
+	counters map[string]*subjectCounter
+	heap     subjectHeap
+}
+
+type subjectCounter struct {
+	subject string
+	count   uint64
+	err     uint64
+	index   int
+}
+
+// subjectHeap is a min-heap of the counters, ordered by count.
+type subjectHeap []*subjectCounter
+
+func (h subjectHeap) Len() int           { return len(h) }
+func (h subjectHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h subjectHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *subjectHeap) Push(x interface{}) {
+	sc := x.(*subjectCounter)
+	sc.index = len(*h)
+	*h = append(*h, sc)
+}
+
+func (h *subjectHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	sc := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return sc
+}
+
+func newTopSubjects(k int) *topSubjects {
+	return &topSubjects{k: k, counters: make(map[string]*subjectCounter, k)}
+}
+
+// Counts a message published on the subject.
+func (t *topSubjects) add(subject []byte) {
+	if sc := t.counters[string(subject)]; sc != nil {
+		sc.count++
+		heap.Fix(&t.heap, sc.index)
+		return
+	}
+	if len(t.heap) < t.k {
+		sc := &subjectCounter{subject: string(subject), count: 1}
+		t.counters[sc.subject] = sc
+		heap.Push(&t.heap, sc)
+		return
+	}
+	// Replace the least published subject.
+	sc := t.heap[0]
+	delete(t.counters, sc.subject)
+	sc.subject = string(subject)
+	sc.err = sc.count
+	sc.count++
+	t.counters[sc.subject] = sc
+	heap.Fix(&t.heap, 0)
+}
+
+// Records a message of the given size published on the subject. The top
+// subjects are reset if the number of subjects to track changed.
+func (at *accountTraffic) record(subject []byte, size, k int) {
+	i := sort.SearchInts(trafficSizeBuckets[:], size)
+	at.Lock()
+	at.msgs++
+	at.bytes += uint64(size)
+	at.sizes[i]++
+	if at.top == nil || at.top.k != k {
+		at.top = newTopSubjects(k)
+	}
+	at.top.add(subject)
+	at.Unlock()
+}
+
+func (o *TrafficOpts) topSubjects() int {
+	if o.TopSubjects > 0 {
+		return o.TopSubjects
+	}
+	return defaultTrafficTopSubjects
+}
+
+// trafficEnabled returns true if the traffic analytics are enabled.
+func (s *Server) trafficEnabled() bool {
+	return atomic.LoadInt32(&s.trafficTopK) > 0
+}
+
+// startTraffic enables or disables the traffic analytics according to the
+// options. The analytics already recorded are kept.
+func (s *Server) startTraffic() {
+	opts := s.getOpts()
+	var k int32
+	if opts.Traffic.Enabled {
+		k = int32(opts.Traffic.topSubjects())
+	}
+	atomic.StoreInt32(&s.trafficTopK, k)
+}
+
+// recordTraffic records the message being processed by the client in the
+// traffic analytics of its account, if enabled.
+func (c *client) recordTraffic() {
+	if k := atomic.LoadInt32(&c.srv.trafficTopK); k > 0 {
+		c.acc.traffic.record(c.pa.subject, c.pa.size, int(k))
+	}
+}
+
+func validateTrafficOptions(o *Options) error {
+	if n := o.Traffic.TopSubjects; n < 0 || n > maxTrafficTopSubjects {
+		return fmt.Errorf("traffic top_subjects should be between 0 and %d, got %d", maxTrafficTopSubjects, n)
+	}
+	return nil
+}
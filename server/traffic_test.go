@@ -0,0 +1,161 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestTrafficTopSubjects(t *testing.T) {
+	top := newTopSubjects(3)
+	for subj, n := range map[string]int{"a": 50, "b": 30, "c": 20} {
+		for i := 0; i < n; i++ {
+			top.add([]byte(subj))
+		}
+	}
+	// Each new subject replaces the least published one.
+	top.add([]byte("d"))
+	top.add([]byte("e"))
+	if top.counters["c"] != nil || top.counters["d"] != nil {
+		t.Fatalf("Expected c and d to be replaced, got %+v", top.counters)
+	}
+	if sc := top.counters["e"]; sc == nil || sc.count != 22 || sc.err != 21 {
+		t.Fatalf("Unexpected counter for e: %+v", sc)
+	}
+	if sc := top.counters["a"]; sc == nil || sc.count != 50 || sc.err != 0 {
+		t.Fatalf("Unexpected counter for a: %+v", sc)
+	}
+	if top.heap[0].subject != "e" {
+		t.Fatalf("Expected e to be the least published, got %q", top.heap[0].subject)
+	}
+}
+
+func TestTrafficz(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		accounts {
+			A { users [{user: a, password: pwd}] }
+			B { users [{user: b, password: pwd}] }
+		}
+		traffic {
+			top_subjects: 2
+		}
+	`))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", "pwd"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	for i := 0; i < 5; i++ {
+		nc.Publish("bar", make([]byte, 100))
+	}
+	nc.Publish("baz", make([]byte, 2000))
+	nc.Flush()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s?accounts=A", s.MonitorAddr().Port, TrafficzPath))
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	defer resp.Body.Close()
+	tz := &Trafficz{}
+	if err := json.NewDecoder(resp.Body).Decode(tz); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if !tz.Enabled || len(tz.Accounts) != 1 {
+		t.Fatalf("Expected traffic of account A, got %+v", tz)
+	}
+	at := tz.Accounts[0]
+	if at.Account != "A" || at.Msgs != 16 || at.Bytes != 2550 {
+		t.Fatalf("Unexpected traffic: %+v", at)
+	}
+	counts := map[int]uint64{}
+	for _, b := range at.Sizes {
+		counts[b.LE] = b.Count
+	}
+	if counts[64] != 10 || counts[256] != 5 || counts[4096] != 1 || counts[-1] != 0 {
+		t.Fatalf("Unexpected payload sizes: %v", counts)
+	}
+	if len(at.TopSubjects) != 2 || at.TopSubjects[0].Subject != "foo" || at.TopSubjects[0].Msgs != 10 ||
+		at.TopSubjects[1].Subject != "baz" || at.TopSubjects[1].MaxError != 5 {
+		t.Fatalf("Unexpected top subjects: %+v %+v", at.TopSubjects[0], at.TopSubjects[1])
+	}
+
+	// Accounts without traffic are not returned.
+	if tz := s.Trafficz(nil); len(tz.Accounts) != 1 {
+		t.Fatalf("Expected only account A, got %+v", tz.Accounts)
+	}
+}
+
+func TestTrafficReload(t *testing.T) {
+	template := `
+		listen: "127.0.0.1:-1"
+		traffic: %v
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, false)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer nc.Close()
+	nc.Publish("foo", nil)
+	nc.Flush()
+	if tz := s.Trafficz(nil); tz.Enabled || len(tz.Accounts) != 0 {
+		t.Fatalf("Expected no traffic analytics, got %+v", tz)
+	}
+
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(template, true))
+	nc.Publish("foo", nil)
+	nc.Flush()
+	tz := s.Trafficz(nil)
+	if !tz.Enabled || len(tz.Accounts) != 1 || tz.Accounts[0].Msgs != 1 ||
+		len(tz.Accounts[0].TopSubjects) != 1 || tz.Accounts[0].TopSubjects[0].Subject != "foo" {
+		t.Fatalf("Unexpected traffic analytics: %+v", tz)
+	}
+}
+
+func TestTrafficConfigErrors(t *testing.T) {
+	conf := createConfFile(t, []byte(`traffic { top_subjects: -1 }`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if err := validateOptions(opts); err == nil {
+		t.Fatal("Expected error for negative top_subjects")
+	}
+
+	conf = createConfFile(t, []byte(`traffic { top_k: 10 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected error for unknown field")
+	}
+}
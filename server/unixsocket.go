@@ -0,0 +1,150 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// listenUnix listens on the Unix socket described by uo and applies the
+// configured permissions and ownership to the socket file.
+func listenUnix(uo *UnixSocketOpts) (net.Listener, error) {
+	// A socket file left by a server that did not exit cleanly would make
+	// the listen fail. Remove it, unless a server is still listening on it.
+	if fi, err := os.Lstat(uo.Path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", uo.Path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %q is in use", uo.Path)
+		}
+		os.Remove(uo.Path)
+	}
+	l, err := net.Listen("unix", uo.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setUnixSocketPerms(uo); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func setUnixSocketPerms(uo *UnixSocketOpts) error {
+	if uo.Mode != 0 {
+		if err := os.Chmod(uo.Path, uo.Mode); err != nil {
+			return err
+		}
+	}
+	if uo.Owner == _EMPTY_ && uo.Group == _EMPTY_ {
+		return nil
+	}
+	uid, gid := -1, -1
+	if uo.Owner != _EMPTY_ {
+		id, err := lookupUnixID(uo.Owner, false)
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if uo.Group != _EMPTY_ {
+		id, err := lookupUnixID(uo.Group, true)
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	return os.Chown(uo.Path, uid, gid)
+}
+
+// Returns the numeric id of the given user or group name. Numeric
+// values are used as-is.
+func lookupUnixID(name string, group bool) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = u.Uid
+	}
+	return strconv.Atoi(id)
+}
+
+// unixAcceptLoop accepts client connections on the Unix socket. It waits
+// for the client TCP listener to be ready so that the INFO sent to the
+// clients is complete.
+func (s *Server) unixAcceptLoop(clr chan struct{}) {
+	<-clr
+	if !s.isRunning() {
+		return
+	}
+
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	l, err := listenUnix(&opts.ListenUnix)
+	if err != nil {
+		s.Fatalf("Error listening on unix socket: %s, %q", opts.ListenUnix.Path, err)
+		return
+	}
+	s.Noticef("Listening for client connections on unix socket %s", opts.ListenUnix.Path)
+
+	// Setup state that can enable shutdown
+	s.mu.Lock()
+	if s.shutdown || s.ldm {
+		s.mu.Unlock()
+		l.Close()
+		return
+	}
+	s.unixListener = l
+	s.mu.Unlock()
+	s.notifyReady()
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isLameDuckMode() {
+				// Wait for the Shutdown, which does not expect
+				// this loop to report since the listener is gone.
+				<-s.quitCh
+				return
+			}
+			tmpDelay = s.acceptError("Client", err, tmpDelay)
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		if s.acceptsPaused() {
+			conn.Close()
+			continue
+		}
+		s.startAcceptWorker(s.acceptPool, conn, func(conn net.Conn) { s.createClient(conn) })
+	}
+	s.done <- true
+}
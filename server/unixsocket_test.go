@@ -0,0 +1,185 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// unixDialer makes the NATS client connect to a Unix socket,
+// whatever the server URL.
+type unixDialer string
+
+func (d unixDialer) Dial(network, address string) (net.Conn, error) {
+	return net.Dial("unix", string(d))
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats-unix")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nats.sock")
+
+	// A stale socket file is replaced.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	o := DefaultOptions()
+	o.ListenUnix = UnixSocketOpts{Path: path, Mode: 0660}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Error on stat: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Fatalf("Unexpected socket file mode: %v", fi.Mode())
+	}
+
+	unc, err := nats.Connect(s.ClientURL(), nats.SetCustomDialer(unixDialer(path)))
+	if err != nil {
+		t.Fatalf("Error connecting over unix socket: %v", err)
+	}
+	defer unc.Close()
+	sub := natsSubSync(t, unc, "foo")
+	natsFlush(t, unc)
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	natsPub(t, nc, "foo", []byte("hello"))
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+
+	connz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	var unix int
+	for _, ci := range connz.Conns {
+		if ci.UnixSocket != _EMPTY_ {
+			unix++
+			if ci.UnixSocket != path || ci.Port != 0 {
+				t.Fatalf("Unexpected connection info: %+v", ci)
+			}
+		}
+	}
+	if unix != 1 || connz.NumConns != 2 {
+		t.Fatalf("Expected 1 unix socket connection out of 2, got %d out of %d", unix, connz.NumConns)
+	}
+
+	// A second server can not take over the socket.
+	if _, err := listenUnix(&o.ListenUnix); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("Expected socket in use error, got %v", err)
+	}
+
+	// The socket file is removed on shutdown.
+	s.Shutdown()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected socket file to be removed, got %v", err)
+	}
+}
+
+func TestUnixSocketConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`listen_unix: "/var/run/nats.sock"`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.ListenUnix.Path != "/var/run/nats.sock" {
+		t.Fatalf("Unexpected path: %q", opts.ListenUnix.Path)
+	}
+
+	for _, test := range []struct {
+		name     string
+		conf     string
+		expected UnixSocketOpts
+	}{
+		{"string mode", `listen_unix: {path: "/tmp/a.sock", mode: "0660", owner: nats, group: "1000"}`,
+			UnixSocketOpts{Path: "/tmp/a.sock", Mode: 0660, Owner: "nats", Group: "1000"}},
+		{"integer mode", `listen_unix: {path: "/tmp/a.sock", mode: 0600, user: "nats"}`,
+			UnixSocketOpts{Path: "/tmp/a.sock", Mode: 0600, Owner: "nats"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.conf))
+			defer os.Remove(conf)
+			opts, err := ProcessConfigFile(conf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if opts.ListenUnix != test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, opts.ListenUnix)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"no path", `listen_unix: {mode: "0660"}`, "requires a path"},
+		{"bad mode", `listen_unix: {path: "/tmp/a.sock", mode: "0980"}`, "invalid file mode"},
+		{"bad type", `listen_unix: 1`, "Expected listen_unix to be a path or a map"},
+		{"unknown field", `listen_unix: {path: "/tmp/a.sock", perms: 1}`, `unknown field "perms"`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.conf))
+			defer os.Remove(conf)
+			if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestUnixSocketLookupID(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		group    bool
+		expected int
+	}{
+		{"0", false, 0},
+		{"1234", true, 1234},
+		{"root", false, 0},
+	} {
+		id, err := lookupUnixID(test.name, test.group)
+		if err != nil {
+			t.Fatalf("Error looking up %q: %v", test.name, err)
+		}
+		if id != test.expected {
+			t.Fatalf("Expected id %d for %q, got %d", test.expected, test.name, id)
+		}
+	}
+	if _, err := lookupUnixID(fmt.Sprintf("no-such-user-%d", time.Now().UnixNano()), false); err == nil {
+		t.Fatal("Expected error for unknown user")
+	}
+}
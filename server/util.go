@@ -15,10 +15,12 @@ package server
 
 import (
 	"errors"
-	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -87,8 +89,13 @@ func parseHostPort(hostPort string, defaultPort int) (host string, port int, err
 		host, sPort, err := net.SplitHostPort(hostPort)
 		switch err.(type) {
 		case *net.AddrError:
-			// try appending the current port
-			host, sPort, err = net.SplitHostPort(fmt.Sprintf("%s:%d", hostPort, defaultPort))
+			// try appending the current port, bracketing an IPv6 address as needed.
+			if ip := net.ParseIP(trimIPv6Brackets(strings.TrimSpace(hostPort))); ip != nil {
+				hostPort = net.JoinHostPort(ip.String(), strconv.Itoa(defaultPort))
+			} else {
+				hostPort += ":" + strconv.Itoa(defaultPort)
+			}
+			host, sPort, err = net.SplitHostPort(hostPort)
 		}
 		if err != nil {
 			return "", -1, err
@@ -110,3 +117,46 @@ func parseHostPort(hostPort string, defaultPort int) (host string, port int, err
 func urlsAreEqual(u1, u2 *url.URL) bool {
 	return reflect.DeepEqual(u1, u2)
 }
+
+// writeFileSync is like ioutil.WriteFile but syncs the file to disk before
+// returning, so that its content survives a crash.
+func writeFileSync(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// renameSync renames a file and syncs its directory, so that the rename
+// survives a crash.
+func renameSync(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newpath))
+}
+
+// syncDir syncs a directory, so that the files created, renamed or removed
+// in it survive a crash. Directories can not be synced on Windows.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
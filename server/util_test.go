@@ -85,6 +85,11 @@ func TestParseHostPort(t *testing.T) {
 	check(" addr : 0 ", 5678, "addr", 5678, false)
 	check("addr:addr", 0, "", 0, true)
 	check("addr:::1234", 0, "", 0, true)
+	check("::1", 5678, "::1", 5678, false)
+	check("[::1]", 5678, "::1", 5678, false)
+	check("[::1]:1234", 5678, "::1", 1234, false)
+	check(" fd00::2 ", 5678, "fd00::2", 5678, false)
+	check("[fd00::2]:-1", 5678, "fd00::2", 5678, false)
 	check("", 0, "", 0, true)
 }
 
@@ -0,0 +1,160 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeRange is a range of the day, with times in the "15:04" or "15:04:05"
+// format. A range whose end is before its start spans midnight.
+type TimeRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// UserValidity restricts when a user can connect and stay connected. The
+// user is valid from NotBefore until Expires, if set, and only during the
+// Times ranges, if any, evaluated in the Locale time zone or local time.
+type UserValidity struct {
+	NotBefore time.Time   `json:"nbf,omitempty"`
+	Expires   time.Time   `json:"exp,omitempty"`
+	Times     []TimeRange `json:"times,omitempty"`
+	Locale    string      `json:"locale,omitempty"`
+}
+
+// Parses a time of day into its offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+				time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q", s)
+}
+
+// check returns true if the user is valid at the given time, and then the
+// time at which it stops being valid, or the zero time if it never does.
+func (v *UserValidity) check(now time.Time) (bool, time.Time) {
+	if v == nil {
+		return true, time.Time{}
+	}
+	if !v.NotBefore.IsZero() && now.Before(v.NotBefore) {
+		return false, time.Time{}
+	}
+	if !v.Expires.IsZero() && !now.Before(v.Expires) {
+		return false, time.Time{}
+	}
+	until := v.Expires
+	if len(v.Times) == 0 {
+		return true, until
+	}
+	loc := time.Local
+	if v.Locale != _EMPTY_ {
+		var err error
+		if loc, err = time.LoadLocation(v.Locale); err != nil {
+			return false, time.Time{}
+		}
+	}
+	lnow := now.In(loc)
+	midnight := time.Date(lnow.Year(), lnow.Month(), lnow.Day(), 0, 0, 0, 0, loc)
+	var end time.Time
+	for _, r := range v.Times {
+		start, err1 := parseTimeOfDay(r.Start)
+		stop, err2 := parseTimeOfDay(r.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		// Check the range starting today and the one that started
+		// yesterday, which matters for ranges spanning midnight.
+		for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+			rs, re := day.Add(start), day.Add(stop)
+			if stop <= start {
+				re = re.AddDate(0, 0, 1)
+			}
+			if !lnow.Before(rs) && lnow.Before(re) && re.After(end) {
+				end = re
+			}
+		}
+	}
+	if end.IsZero() {
+		return false, time.Time{}
+	}
+	if until.IsZero() || end.Before(until) {
+		until = end
+	}
+	return true, until
+}
+
+func (v *UserValidity) validate() error {
+	if v == nil {
+		return nil
+	}
+	if !v.NotBefore.IsZero() && !v.Expires.IsZero() && !v.NotBefore.Before(v.Expires) {
+		return fmt.Errorf("nbf %v is not before exp %v", v.NotBefore, v.Expires)
+	}
+	for _, r := range v.Times {
+		if _, err := parseTimeOfDay(r.Start); err != nil {
+			return err
+		}
+		if _, err := parseTimeOfDay(r.End); err != nil {
+			return err
+		}
+	}
+	if v.Locale != _EMPTY_ {
+		if _, err := time.LoadLocation(v.Locale); err != nil {
+			return fmt.Errorf("invalid locale %q: %v", v.Locale, err)
+		}
+	}
+	return nil
+}
+
+// validateUserValidities checks the validity constraints of the users.
+func validateUserValidities(o *Options) error {
+	for _, u := range o.Users {
+		if err := u.Validity.validate(); err != nil {
+			return fmt.Errorf("validity of user %q: %v", u.Username, err)
+		}
+	}
+	for _, u := range o.Nkeys {
+		if err := u.Validity.validate(); err != nil {
+			return fmt.Errorf("validity of user %q: %v", u.Nkey, err)
+		}
+	}
+	return nil
+}
+
+// checkValidity returns false if the user can not be connected now. If it
+// can, the client is disconnected when the user stops being valid. This is
+// checked again, and the timer updated, when the users are reloaded.
+func (c *client) checkValidity(v *UserValidity) bool {
+	now := time.Now()
+	ok, until := v.check(now)
+	if !ok {
+		c.Debugf("User credentials not valid at this time")
+		return false
+	}
+	c.mu.Lock()
+	if c.atmr != nil {
+		c.atmr.Stop()
+		c.atmr = nil
+	}
+	if !until.IsZero() {
+		c.atmr = time.AfterFunc(until.Sub(now), c.authExpired)
+	}
+	c.mu.Unlock()
+	return true
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestUserValidityCheck(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("Error parsing time: %v", err)
+		}
+		return tm
+	}
+	exp := at("2020-06-30T00:00:00Z")
+	for _, test := range []struct {
+		name  string
+		v     *UserValidity
+		now   string
+		ok    bool
+		until string
+	}{
+		{"none", nil, "2020-06-01T12:00:00Z", true, ""},
+		{"not yet", &UserValidity{NotBefore: at("2020-06-02T00:00:00Z")}, "2020-06-01T12:00:00Z", false, ""},
+		{"expired", &UserValidity{Expires: exp}, "2020-07-01T00:00:00Z", false, ""},
+		{"expires", &UserValidity{Expires: exp}, "2020-06-01T12:00:00Z", true, "2020-06-30T00:00:00Z"},
+		{"in range", &UserValidity{Times: []TimeRange{{"08:00", "18:00"}}, Locale: "UTC"},
+			"2020-06-01T12:00:00Z", true, "2020-06-01T18:00:00Z"},
+		{"out of range", &UserValidity{Times: []TimeRange{{"08:00", "18:00"}}, Locale: "UTC"},
+			"2020-06-01T19:00:00Z", false, ""},
+		{"overnight", &UserValidity{Times: []TimeRange{{"22:00", "06:00:30"}}, Locale: "UTC"},
+			"2020-06-02T01:00:00Z", true, "2020-06-02T06:00:30Z"},
+		{"overnight before midnight", &UserValidity{Times: []TimeRange{{"22:00", "06:00"}}, Locale: "UTC"},
+			"2020-06-01T23:00:00Z", true, "2020-06-02T06:00:00Z"},
+		{"range after expiration", &UserValidity{Expires: at("2020-06-01T13:00:00Z"), Times: []TimeRange{{"08:00", "18:00"}}, Locale: "UTC"},
+			"2020-06-01T12:00:00Z", true, "2020-06-01T13:00:00Z"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ok, until := test.v.check(at(test.now))
+			if ok != test.ok {
+				t.Fatalf("Expected ok=%v, got %v", test.ok, ok)
+			}
+			if test.until == "" && !until.IsZero() || test.until != "" && !until.Equal(at(test.until)) {
+				t.Fatalf("Expected until %q, got %v", test.until, until)
+			}
+		})
+	}
+}
+
+func TestUserValidityConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		authorization {
+			users [{
+				user: contractor, password: pwd
+				nbf: 2020-01-01T00:00:00Z
+				exp: "2020-12-31T00:00:00Z"
+				times: [{start: "08:00", end: "18:30"}]
+				locale: "UTC"
+			}]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	v := opts.Users[0].Validity
+	if v == nil || v.NotBefore.Year() != 2020 || v.Expires.Month() != time.December ||
+		len(v.Times) != 1 || v.Times[0].End != "18:30" || v.Locale != "UTC" {
+		t.Fatalf("Unexpected validity: %+v", v)
+	}
+
+	conf = createConfFile(t, []byte(`
+		authorization {
+			users [{user: a, password: pwd, times: [{start: "8h", end: "18:00"}]}]
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected error for invalid time of day")
+	}
+}
+
+func TestUserValidityEnforced(t *testing.T) {
+	exp := time.Now().Add(500 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users [
+				{user: expired, password: pwd, exp: "2020-01-01T00:00:00Z"}
+				{user: future, password: pwd, nbf: "2999-01-01T00:00:00Z"}
+				{user: contractor, password: pwd, exp: %q}
+			]
+		}
+	`, exp)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	for _, user := range []string{"expired", "future"} {
+		if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo(user, "pwd")); err == nil {
+			nc.Close()
+			t.Fatalf("Expected user %q to be rejected", user)
+		}
+	}
+
+	errCh := make(chan error, 1)
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("contractor", "pwd"), nats.NoReconnect(),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+	select {
+	case err := <-errCh:
+		if err == nil || err != nats.ErrAuthExpired {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected connection to be closed when the user expires")
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the connection events sent to the webhook.
+const (
+	WebhookClientConnect    = "connect"
+	WebhookClientDisconnect = "disconnect"
+	WebhookAuthError        = "auth_error"
+)
+
+const (
+	// Defaults for the webhook.
+	defaultWebhookBatchSize     = 100
+	defaultWebhookFlushInterval = time.Second
+	defaultWebhookMaxRetries    = 5
+	webhookRetryBackoff         = 250 * time.Millisecond
+	webhookMaxRetryBackoff      = 30 * time.Second
+	// Maximum number of events waiting to be sent. Events are dropped
+	// past that so that an unreachable endpoint does not make the
+	// server grow unbounded.
+	maxWebhookPendingEvents = 65536
+)
+
+// WebhookEvent is a connection event posted to the webhook. The events
+// are posted in batches, as a JSON array.
+type WebhookEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	ServerID   string    `json:"server_id"`
+	ServerName string    `json:"server_name,omitempty"`
+	Client     ConnEvent `json:"client"`
+}
+
+// webhookSender queues the events and posts them in batches.
+type webhookSender struct {
+	mu      sync.Mutex
+	events  []*WebhookEvent
+	dropped uint64
+	kick    chan struct{}
+	client  *http.Client
+}
+
+// Returns true if events of the given type are posted to the webhook.
+func (s *Server) webhookEnabled(typ string) bool {
+	if atomic.LoadInt32(&s.webhookOn) == 0 {
+		return false
+	}
+	return s.getOpts().Webhook.wants(typ)
+}
+
+func (o *WebhookOpts) wants(typ string) bool {
+	if len(o.Events) == 0 {
+		return true
+	}
+	for _, e := range o.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// startWebhook starts the sender if a webhook is configured.
+func (s *Server) startWebhook() {
+	opts := s.getOpts()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if opts.Webhook.URL == _EMPTY_ {
+		atomic.StoreInt32(&s.webhookOn, 0)
+		return
+	}
+	atomic.StoreInt32(&s.webhookOn, 1)
+	if s.webhook != nil {
+		return
+	}
+	w := &webhookSender{
+		kick:   make(chan struct{}, 1),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	s.webhook = w
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		t := time.NewTimer(s.webhookFlushInterval())
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-w.kick:
+			case <-s.quitCh:
+				// Send what we have, without retries, before exiting.
+				for s.postWebhookBatch(w, false) {
+				}
+				return
+			}
+			for s.postWebhookBatch(w, true) {
+			}
+			t.Reset(s.webhookFlushInterval())
+		}
+	})
+}
+
+func (s *Server) webhookFlushInterval() time.Duration {
+	if d := s.getOpts().Webhook.FlushInterval; d > 0 {
+		return d
+	}
+	return defaultWebhookFlushInterval
+}
+
+// queueWebhookEvent queues the event of the given type for the connection.
+func (s *Server) queueWebhookEvent(typ string, e ConnEvent) {
+	s.mu.Lock()
+	w := s.webhook
+	ev := &WebhookEvent{Type: typ, Time: time.Now().UTC(), ServerID: s.info.ID, ServerName: s.info.Name, Client: e}
+	s.mu.Unlock()
+	if w == nil {
+		return
+	}
+	batch := s.getOpts().Webhook.BatchSize
+	if batch <= 0 {
+		batch = defaultWebhookBatchSize
+	}
+	w.mu.Lock()
+	if len(w.events) >= maxWebhookPendingEvents {
+		w.dropped++
+	} else {
+		w.events = append(w.events, ev)
+	}
+	full := len(w.events) >= batch
+	w.mu.Unlock()
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// clientAuthFailed posts the authentication failure of the client to
+// the webhook, if enabled.
+func (s *Server) clientAuthFailed(c *client) {
+	if !s.webhookEnabled(WebhookAuthError) {
+		return
+	}
+	c.mu.Lock()
+	e := c.connEvent()
+	c.mu.Unlock()
+	e.Reason = AuthenticationViolation.String()
+	s.queueWebhookEvent(WebhookAuthError, e)
+}
+
+// postWebhookBatch posts the next batch of events. If retry is true, a
+// failed post is retried with an exponential backoff up to the configured
+// number of times, after which the batch is dropped. Returns true if there
+// are more events to send.
+func (s *Server) postWebhookBatch(w *webhookSender, retry bool) bool {
+	opts := s.getOpts().Webhook
+	batch := opts.BatchSize
+	if batch <= 0 {
+		batch = defaultWebhookBatchSize
+	}
+	w.mu.Lock()
+	events, dropped := w.events, w.dropped
+	if len(events) > batch {
+		events = events[:batch]
+	}
+	w.events, w.dropped = w.events[len(events):], 0
+	more := len(w.events) > 0
+	w.mu.Unlock()
+	if dropped > 0 {
+		s.Warnf("Dropped %d webhook events", dropped)
+	}
+	if len(events) == 0 || opts.URL == _EMPTY_ {
+		return false
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		s.Errorf("Error marshaling webhook events: %v", err)
+		return more
+	}
+	retries := opts.MaxRetries
+	if retries == 0 {
+		retries = defaultWebhookMaxRetries
+	}
+	backoff := webhookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = s.postWebhook(w, opts.URL, b)
+		if err == nil {
+			return more
+		}
+		if !retry || retries < 0 || attempt >= retries {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.quitCh:
+			retry = false
+		}
+		if backoff *= 2; backoff > webhookMaxRetryBackoff {
+			backoff = webhookMaxRetryBackoff
+		}
+	}
+	s.Warnf("Error posting %d webhook events, dropping them: %v", len(events), err)
+	return more
+}
+
+func (s *Server) postWebhook(w *webhookSender, url string, body []byte) error {
+	resp, err := w.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// validateWebhookOptions checks that the webhook URL and events are valid.
+func validateWebhookOptions(o *Options) error {
+	wh := &o.Webhook
+	if wh.URL == _EMPTY_ {
+		return nil
+	}
+	if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == _EMPTY_ {
+		return fmt.Errorf("webhook url must be an http or https URL, got %q", wh.URL)
+	}
+	for _, e := range wh.Events {
+		switch e {
+		case WebhookClientConnect, WebhookClientDisconnect, WebhookAuthError:
+		default:
+			return fmt.Errorf("unknown webhook event %q, expected one of %s", e,
+				strings.Join([]string{WebhookClientConnect, WebhookClientDisconnect, WebhookAuthError}, ", "))
+		}
+	}
+	return nil
+}
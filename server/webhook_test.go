@@ -0,0 +1,137 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestWebhookOptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		webhook {
+			url: "http://localhost:8080/hook"
+			events: [connect, AUTH_ERROR]
+			batch_size: 10
+			flush_interval: "2s"
+			max_retries: -1
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	wh := opts.Webhook
+	if wh.URL != "http://localhost:8080/hook" || len(wh.Events) != 2 || wh.Events[1] != WebhookAuthError ||
+		wh.BatchSize != 10 || wh.FlushInterval != 2*time.Second || wh.MaxRetries != -1 {
+		t.Fatalf("Unexpected options: %+v", wh)
+	}
+	if !wh.wants(WebhookClientConnect) || wh.wants(WebhookClientDisconnect) {
+		t.Fatalf("Unexpected events filter: %+v", wh.Events)
+	}
+
+	for _, wh := range []WebhookOpts{
+		{URL: "localhost:8080"},
+		{URL: "http://localhost:8080", Events: []string{"subscribe"}},
+	} {
+		opts := DefaultOptions()
+		opts.Webhook = wh
+		if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "webhook") {
+			t.Fatalf("Expected error for %+v, got %v", wh, err)
+		}
+	}
+}
+
+func TestWebhookConnectionEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events []WebhookEvent
+	failures := 1
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// Make sure that a failed post is retried.
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events = append(events, batch...)
+	}))
+	defer hook.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		server_name: "hooked"
+		accounts {
+			A { users [{user: a, password: pwd}] }
+		}
+		webhook {
+			url: "%s"
+			flush_interval: "50ms"
+		}
+	`, hook.URL)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL(), nats.UserInfo("a", "pwd"), nats.Name("audited"))
+	nc.Close()
+	if nc, err := nats.Connect(s.ClientURL(), nats.UserInfo("a", "bad")); err == nil {
+		nc.Close()
+		t.Fatal("Expected authentication failure")
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(events) != 3 {
+			return fmt.Errorf("Expected 3 events, got %+v", events)
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	// Disconnects are reported asynchronously, so the order may vary.
+	byType := make(map[string]WebhookEvent)
+	for _, e := range events {
+		if e.ServerID != s.ID() || e.ServerName != "hooked" {
+			t.Fatalf("Unexpected server in %+v", e)
+		}
+		byType[e.Type] = e
+	}
+	if e := byType[WebhookClientConnect]; e.Client.Account != "A" || e.Client.User != "a" || e.Client.Name != "audited" {
+		t.Fatalf("Unexpected connect event: %+v", e)
+	}
+	if e := byType[WebhookClientDisconnect]; e.Client.Name != "audited" || e.Client.Reason != ClientClosed.String() {
+		t.Fatalf("Unexpected disconnect event: %+v", e)
+	}
+	if e := byType[WebhookAuthError]; e.Client.User != "a" || e.Client.Reason != AuthenticationViolation.String() {
+		t.Fatalf("Unexpected auth error event: %+v", e)
+	}
+}
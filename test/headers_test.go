@@ -0,0 +1,218 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const (
+	testHdr     = "NATS/1.0\r\nX-Trace: 1\r\n\r\n"
+	testPayload = "hello"
+)
+
+var hpubProto = fmt.Sprintf("HPUB foo %d %d\r\n%s%s\r\n", len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload)
+
+func setupHeadersConn(t *testing.T, c net.Conn) (sendFun, expectFun) {
+	t.Helper()
+	if info := checkInfoMsg(t, c); !info.Headers {
+		t.Fatal("Expected server to support headers")
+	}
+	sendProto(t, c, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true}\r\n")
+	return sendCommand(t, c), expectCommand(t, c)
+}
+
+var pongAnyRe = regexp.MustCompile(`PONG\r\n`)
+
+func expectProto(t *testing.T, expect expectFun, proto string) {
+	t.Helper()
+	expect(regexp.MustCompile(regexp.QuoteMeta(proto)))
+}
+
+func TestHeadersClientDelivery(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	hc := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer hc.Close()
+	hsend, hexpect := setupHeadersConn(t, hc)
+
+	lc := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer lc.Close()
+	lsend, lexpect := setupConn(t, lc)
+
+	hsend("SUB foo 1\r\nPING\r\n")
+	hexpect(pongRe)
+	lsend("SUB foo 2\r\nPING\r\n")
+	lexpect(pongRe)
+
+	hsend(hpubProto)
+	expectProto(t, hexpect, fmt.Sprintf("HMSG foo 1 %d %d\r\n%s%s\r\n",
+		len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	// Clients that did not opt in get the payload only.
+	expectProto(t, lexpect, fmt.Sprintf("MSG foo 2 %d\r\n%s\r\n", len(testPayload), testPayload))
+
+	// Regular messages are still sent as MSG.
+	lsend("PUB foo bar 2\r\nok\r\n")
+	expectProto(t, hexpect, "MSG foo 1 bar 2\r\nok\r\n")
+}
+
+func TestHeadersLongSubject(t *testing.T) {
+	opts := DefaultTestOptions
+	opts.Port = -1
+	opts.MaxControlLine = 4096
+	s := RunServer(&opts)
+	defer s.Shutdown()
+
+	c := createClientConn(t, opts.Host, s.Addr().(*net.TCPAddr).Port)
+	defer c.Close()
+	send, expect := setupHeadersConn(t, c)
+
+	// The protocol line of the message outgrows the scratch buffer of the
+	// server.
+	subj := strings.Repeat("a", 2000)
+	send(fmt.Sprintf("SUB %s 1\r\nSUB %s q 2\r\nPING\r\n", subj, subj))
+	expect(pongRe)
+	send(fmt.Sprintf("HPUB %s reply %d %d\r\n%s%s\r\n", subj, len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	var msgs string
+	for _, sid := range []string{"1", "2"} {
+		msgs += fmt.Sprintf("HMSG %s %s reply %d %d\r\n%s%s\r\n",
+			subj, sid, len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload)
+	}
+	send("PING\r\n")
+	expectProto(t, expect, msgs+"PONG\r\n")
+}
+
+func TestHeadersNotSupported(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	// Client that did not opt in to headers.
+	c := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer c.Close()
+	send, expect := setupConn(t, c)
+	send(hpubProto)
+	expect(errRe)
+	expectDisconnect(t, c)
+
+	// Server with headers disabled.
+	opts := DefaultTestOptions
+	opts.Port = -1
+	opts.NoHeaderSupport = true
+	s2 := RunServer(&opts)
+	defer s2.Shutdown()
+
+	c = createClientConn(t, opts.Host, s2.Addr().(*net.TCPAddr).Port)
+	defer c.Close()
+	if info := checkInfoMsg(t, c); info.Headers {
+		t.Fatal("Expected server to not support headers")
+	}
+	sendProto(t, c, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true}\r\n")
+	sendProto(t, c, hpubProto)
+	expectResult(t, c, errRe)
+	expectDisconnect(t, c)
+}
+
+func TestHeadersAcrossRoutes(t *testing.T) {
+	s, opts := runRouteServer(t)
+	defer s.Shutdown()
+
+	hc := createClientConn(t, opts.Host, opts.Port)
+	defer hc.Close()
+	hsend, hexpect := setupHeadersConn(t, hc)
+
+	lc := createClientConn(t, opts.Host, opts.Port)
+	defer lc.Close()
+	lsend, lexpect := setupConn(t, lc)
+
+	hsend("SUB foo 1\r\nPING\r\n")
+	hexpect(pongRe)
+	lsend("SUB foo 2\r\nPING\r\n")
+	lexpect(pongRe)
+
+	setupHeadersRoute := func(id string, headers bool) (net.Conn, sendFun, expectFun) {
+		t.Helper()
+		rc := createRouteConn(t, opts.Cluster.Host, opts.Cluster.Port)
+		info := checkInfoMsg(t, rc)
+		if !info.Headers {
+			t.Fatal("Expected route INFO to advertise headers")
+		}
+		routeSend, routeExpect := setupRouteEx(t, rc, opts, id)
+		routeSend(fmt.Sprintf("INFO {\"server_id\":%q,\"headers\":%v}\r\n", id, headers))
+		routeSend("PING\r\n")
+		routeExpect(pongAnyRe)
+		return rc, routeSend, routeExpect
+	}
+
+	hrc, hrouteSend, hrouteExpect := setupHeadersRoute("ROUTER:hdr", true)
+	defer hrc.Close()
+
+	// Inbound HMSG from the route is delivered according to client support.
+	hrouteSend(fmt.Sprintf("HMSG $G foo %d %d\r\n%s%s\r\n",
+		len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	expectProto(t, hexpect, fmt.Sprintf("HMSG foo 1 %d %d\r\n%s%s\r\n",
+		len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	expectProto(t, lexpect, fmt.Sprintf("MSG foo 2 %d\r\n%s\r\n", len(testPayload), testPayload))
+
+	// Outbound messages with headers are sent as HMSG to the route.
+	hrouteSend("RS+ $G bar\r\nPING\r\n")
+	hrouteExpect(pongAnyRe)
+	hsend(fmt.Sprintf("HPUB bar %d %d\r\n%s%s\r\n", len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	expectProto(t, hrouteExpect, fmt.Sprintf("HMSG $G bar %d %d\r\n%s%s\r\n",
+		len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	hrc.Close()
+
+	// A route without header support gets the payload only.
+	lrc, lrouteSend, lrouteExpect := setupHeadersRoute("ROUTER:nohdr", false)
+	defer lrc.Close()
+	lrouteSend("RS+ $G bar\r\nPING\r\n")
+	lrouteExpect(pongAnyRe)
+	hsend(fmt.Sprintf("HPUB bar %d %d\r\n%s%s\r\n", len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	expectProto(t, lrouteExpect, fmt.Sprintf("RMSG $G bar %d\r\n%s\r\n", len(testPayload), testPayload))
+
+	// And may not send HMSG.
+	lrouteSend(fmt.Sprintf("HMSG $G foo %d %d\r\n%s%s\r\n",
+		len(testHdr), len(testHdr)+len(testPayload), testHdr, testPayload))
+	expectDisconnect(t, lrc)
+}
+
+func TestHeadersNoResponders(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	c := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer c.Close()
+	checkInfoMsg(t, c)
+	sendProto(t, c, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true,\"no_responders\":true}\r\n")
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+
+	send("SUB reply 1\r\nPUB foo reply 2\r\nok\r\nPING\r\n")
+	expectProto(t, expect, "HMSG reply 1 16 16\r\nNATS/1.0 503\r\n\r\n\r\nPONG\r\n")
+
+	// No status message when there is interest.
+	send("SUB foo 2\r\nPUB foo reply 2\r\nok\r\nPING\r\n")
+	expectProto(t, expect, "MSG foo 2 reply 2\r\nok\r\nPONG\r\n")
+
+	// Requires headers support.
+	nc := createClientConn(t, "127.0.0.1", PROTO_TEST_PORT)
+	defer nc.Close()
+	checkInfoMsg(t, nc)
+	sendProto(t, nc, "CONNECT {\"verbose\":false,\"pedantic\":false,\"no_responders\":true}\r\n")
+	expectResult(t, nc, errRe)
+	expectDisconnect(t, nc)
+}